@@ -272,6 +272,18 @@ type DefinitionSimplestream struct {
 	// is a comma delimited string of additional release aliases.
 	ReleaseAliases map[string]string `yaml:"release_aliases,omitempty"`
 
+	// Map of release end-of-life dates in format YYYY-MM-DD. Key represents
+	// the release name.
+	ReleaseEOL map[string]string `yaml:"release_eol,omitempty"`
+
+	// Map of release support levels (for example, "lts" or "interim"). Key
+	// represents the release name.
+	SupportLevel map[string]string `yaml:"support_level,omitempty"`
+
+	// Map of release lifecycle stages (for example, "supported",
+	// "deprecated", or "eol"). Key represents the release name.
+	Lifecycle map[string]string `yaml:"lifecycle,omitempty"`
+
 	// List of the image requirements.
 	Requirements []DefinitionSimplestreamRequirements `yaml:"requirements,omitempty"`
 }
@@ -0,0 +1,8 @@
+package shared
+
+// FileID identifies the file on the disk. Hard links of the same file share
+// its ID.
+type FileID struct {
+	Dev uint64
+	Ino uint64
+}
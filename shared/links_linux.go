@@ -0,0 +1,36 @@
+//go:build linux
+
+package shared
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// FileLinks returns the ID of the file with the given info and the number of
+// its hard links.
+func FileLinks(info fs.FileInfo) (FileID, uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return FileID{}, 0, false
+	}
+
+	return FileID{Dev: uint64(stat.Dev), Ino: uint64(stat.Ino)}, uint64(stat.Nlink), true
+}
+
+// CloneFile clones the content of the source file into the destination file,
+// so that both share the same data blocks until either of them is modified
+// (reflink). If the filesystem does not support cloning, errors.ErrUnsupported
+// is returned.
+func CloneFile(dst *os.File, src *os.File) error {
+	err := unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EXDEV) {
+		return errors.ErrUnsupported
+	}
+
+	return err
+}
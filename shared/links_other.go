@@ -0,0 +1,21 @@
+//go:build !linux
+
+package shared
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// FileLinks returns false, because hard links of files are not reported on
+// this platform.
+func FileLinks(info fs.FileInfo) (FileID, uint64, bool) {
+	return FileID{}, 0, false
+}
+
+// CloneFile returns errors.ErrUnsupported, because cloning files is not
+// supported on this platform.
+func CloneFile(dst *os.File, src *os.File) error {
+	return errors.ErrUnsupported
+}
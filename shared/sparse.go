@@ -0,0 +1,180 @@
+package shared
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// sparseBlockSize is the size of the blocks that are checked for zeros by the
+// SparseWriter. It matches the block size of the common filesystems.
+const sparseBlockSize = 4096
+
+// SparseWriter writes to a file and skips the blocks that contain only zeros
+// instead of writing them, so that they become holes in the file. Skipped
+// blocks read as zeros, therefore, the writer must only be used to write
+// beyond the end of the file (for example, into a new or truncated file).
+type SparseWriter struct {
+	file   *os.File
+	offset int64
+}
+
+// NewSparseWriter returns a sparse writer that writes to the given file,
+// starting at its current offset.
+func NewSparseWriter(file *os.File) (*SparseWriter, error) {
+	offset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SparseWriter{file: file, offset: offset}, nil
+}
+
+// Write implements io.Writer.
+func (w *SparseWriter) Write(p []byte) (int, error) {
+	var n int
+
+	for len(p) > 0 {
+		// Split the data on the block boundaries of the file.
+		size := sparseBlockSize - int(w.offset%sparseBlockSize)
+		if size > len(p) {
+			size = len(p)
+		}
+
+		block := p[:size]
+
+		if isZero(block) {
+			_, err := w.file.Seek(int64(size), io.SeekCurrent)
+			if err != nil {
+				return n, err
+			}
+		} else {
+			_, err := w.file.Write(block)
+			if err != nil {
+				return n, err
+			}
+		}
+
+		w.offset += int64(size)
+		n += size
+		p = p[size:]
+	}
+
+	return n, nil
+}
+
+// Close extends the file to the written size in case the trailing blocks were
+// skipped. The underlying file is not closed.
+func (w *SparseWriter) Close() error {
+	info, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if info.Size() >= w.offset {
+		return nil
+	}
+
+	return w.file.Truncate(w.offset)
+}
+
+// isZero returns true if the given data contains only zeros.
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CopySparse copies the content of the source file into the destination file,
+// which is expected to be empty, and preserves the holes of the source file.
+// Data regions of the source file are found using SEEK_DATA and SEEK_HOLE where
+// supported. Otherwise, the content is copied using the SparseWriter, which
+// turns the blocks of zeros into holes. It returns the number of bytes copied,
+// which equals the (logical) size of the source file.
+func CopySparse(dst *os.File, src *os.File) (int64, error) {
+	info, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	size := info.Size()
+
+	var offset int64
+
+	for offset < size {
+		start, end, err := nextDataRegion(src, offset)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				// Only a hole remains.
+				break
+			}
+
+			if errors.Is(err, errors.ErrUnsupported) {
+				err := copyZeroBlocksAsHoles(dst, src, offset)
+				if err != nil {
+					return offset, err
+				}
+
+				return size, nil
+			}
+
+			return offset, err
+		}
+
+		end = min(end, size)
+
+		_, err = src.Seek(start, io.SeekStart)
+		if err != nil {
+			return offset, err
+		}
+
+		_, err = dst.Seek(start, io.SeekStart)
+		if err != nil {
+			return offset, err
+		}
+
+		_, err = io.CopyN(dst, src, end-start)
+		if err != nil {
+			return offset, err
+		}
+
+		offset = end
+	}
+
+	err = dst.Truncate(size)
+	if err != nil {
+		return offset, err
+	}
+
+	return size, nil
+}
+
+// copyZeroBlocksAsHoles copies the source file from the given offset using the
+// SparseWriter.
+func copyZeroBlocksAsHoles(dst *os.File, src *os.File, offset int64) error {
+	_, err := src.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = dst.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	w, err := NewSparseWriter(dst)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, src)
+	if err != nil {
+		return err
+	}
+
+	return w.Close()
+}
@@ -0,0 +1,51 @@
+//go:build linux
+
+package shared
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// nextDataRegion returns the start and the end of the first data region of the
+// file at or after the given offset. If only a hole follows the offset, io.EOF
+// is returned. If the filesystem cannot report holes, errors.ErrUnsupported is
+// returned.
+func nextDataRegion(file *os.File, offset int64) (int64, int64, error) {
+	start, err := file.Seek(offset, unix.SEEK_DATA)
+	if err != nil {
+		if errors.Is(err, unix.ENXIO) {
+			return 0, 0, io.EOF
+		}
+
+		if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EOPNOTSUPP) {
+			return 0, 0, errors.ErrUnsupported
+		}
+
+		return 0, 0, err
+	}
+
+	end, err := file.Seek(start, unix.SEEK_HOLE)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return start, end, nil
+}
+
+// DiskUsage returns the number of bytes allocated on the disk for the file
+// with the given info, which is less than its size if the file is sparse.
+func DiskUsage(info fs.FileInfo) (int64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+
+	// Blocks are always counted in units of 512 bytes.
+	return stat.Blocks * 512, true
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package shared
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// nextDataRegion returns errors.ErrUnsupported, because detecting holes is not
+// supported on this platform.
+func nextDataRegion(file *os.File, offset int64) (int64, int64, error) {
+	return 0, 0, errors.ErrUnsupported
+}
+
+// DiskUsage returns false, because the disk usage of files is not reported on
+// this platform.
+func DiskUsage(info fs.FileInfo) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,126 @@
+package shared
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeSparseFile writes a file that contains the given data at the given
+// offsets, and holes elsewhere.
+func writeSparseFile(t *testing.T, path string, size int64, data map[int64][]byte) []byte {
+	t.Helper()
+
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	require.NoError(t, file.Truncate(size))
+
+	content := make([]byte, size)
+	for offset, d := range data {
+		_, err := file.WriteAt(d, offset)
+		require.NoError(t, err)
+		copy(content[offset:], d)
+	}
+
+	return content
+}
+
+func TestCopySparse(t *testing.T) {
+	tests := []struct {
+		Name string
+		Size int64
+		Data map[int64][]byte
+	}{
+		{
+			Name: "Empty file",
+		},
+		{
+			Name: "Only hole",
+			Size: 1 << 20,
+		},
+		{
+			Name: "Data surrounded by holes",
+			Size: 4 << 20,
+			Data: map[int64][]byte{
+				1 << 20: []byte("data"),
+			},
+		},
+		{
+			Name: "Data at both ends",
+			Size: 4 << 20,
+			Data: map[int64][]byte{
+				0:             []byte("head"),
+				4<<20 - 4:     []byte("tail"),
+				2<<20 + 12345: bytes.Repeat([]byte("x"), 10000),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			srcPath := filepath.Join(dir, "src.img")
+			dstPath := filepath.Join(dir, "dst.img")
+
+			content := writeSparseFile(t, srcPath, test.Size, test.Data)
+
+			require.NoError(t, Copy(srcPath, dstPath))
+
+			copied, err := os.ReadFile(dstPath)
+			require.NoError(t, err)
+			require.Equal(t, content, copied)
+
+			srcInfo, err := os.Stat(srcPath)
+			require.NoError(t, err)
+
+			dstInfo, err := os.Stat(dstPath)
+			require.NoError(t, err)
+
+			srcUsage, ok := DiskUsage(srcInfo)
+			if !ok || srcUsage >= test.Size {
+				// The filesystem does not support sparse files.
+				return
+			}
+
+			dstUsage, ok := DiskUsage(dstInfo)
+			require.True(t, ok)
+			require.Less(t, dstUsage, test.Size, "Copied file is not sparse")
+		})
+	}
+}
+
+func TestSparseWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.img")
+
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	w, err := NewSparseWriter(file)
+	require.NoError(t, err)
+
+	var content []byte
+	for _, chunk := range [][]byte{
+		[]byte("head"),
+		make([]byte, 3*sparseBlockSize+5),
+		[]byte("middle"),
+		make([]byte, 2*sparseBlockSize),
+	} {
+		n, err := w.Write(chunk)
+		require.NoError(t, err)
+		require.Equal(t, len(chunk), n)
+
+		content = append(content, chunk...)
+	}
+
+	require.NoError(t, w.Close())
+
+	written, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, content, written)
+}
@@ -12,6 +12,7 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"slices"
 	"strconv"
@@ -32,7 +33,7 @@ type EnvVariable struct {
 // Environment represents a set of environment variables.
 type Environment map[string]EnvVariable
 
-// Copy copies a file.
+// Copy copies a file. Holes of sparse files are preserved.
 func Copy(src, dest string) error {
 	var err error
 
@@ -50,7 +51,7 @@ func Copy(src, dest string) error {
 
 	defer destFile.Close()
 
-	_, err = io.Copy(destFile, srcFile)
+	_, err = CopySparse(destFile, srcFile)
 	if err != nil {
 		return fmt.Errorf("Failed to copy file: %w", err)
 	}
@@ -565,6 +566,99 @@ func WriteJSONFile(path string, obj any) error {
 	return nil
 }
 
+// AtomicWriteFile replaces the file on the given path with the content read
+// from the reader. Content is written to a hidden temporary file next to the
+// destination, synced to disk, and renamed over the destination, so that
+// readers observe either the old or the new content, but never a partial
+// file, even after a crash. If the reader is a file, its whole content is
+// copied and its holes are preserved.
+func AtomicWriteFile(path string, r io.Reader, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+
+	file, err := os.CreateTemp(dir, fmt.Sprintf(".%s.*.tmp", filepath.Base(path)))
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	// Preserve holes when copying from a sparse file.
+	src, ok := r.(*os.File)
+	if ok {
+		_, err = CopySparse(file, src)
+	} else {
+		_, err = io.Copy(file, r)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = file.Chmod(perm)
+	if err != nil {
+		return err
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	// Sync the directory to persist the rename. Not all platforms and
+	// filesystems support syncing directories, therefore, failures are
+	// ignored.
+	d, err := os.Open(dir)
+	if err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+
+	return nil
+}
+
+// AtomicMoveFile moves the file on the source path to the destination path.
+// If both paths are not on the same filesystem (for example, when the
+// destination is within a bind mount), the file cannot be renamed. In such
+// case, it is copied using AtomicWriteFile and the source file is removed.
+func AtomicMoveFile(srcPath string, dstPath string, perm os.FileMode) error {
+	err := os.Chmod(srcPath, perm)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(srcPath, dstPath)
+	if err == nil || !errors.Is(err, unix.EXDEV) {
+		return err
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+
+	defer src.Close()
+
+	err = AtomicWriteFile(dstPath, src, perm)
+	if err != nil {
+		return err
+	}
+
+	_ = src.Close()
+
+	return os.Remove(srcPath)
+}
+
 // MapKeys returns map keys as a list.
 func MapKeys[K comparable, V any](m map[K]V) []K {
 	keys := make([]K, 0, len(m))
@@ -3,6 +3,8 @@ package shared
 import (
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/flosch/pongo2/v4"
@@ -217,3 +219,56 @@ func TestSquashfsParseCompression(t *testing.T) {
 		}
 	}
 }
+
+func TestAtomicWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "index.json")
+
+	require.NoError(t, os.WriteFile(path, []byte("old"), 0600))
+	require.NoError(t, AtomicWriteFile(path, strings.NewReader("new"), 0644))
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "new", string(content))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	// Ensure no temporary files are left behind.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestAtomicMoveFile(t *testing.T) {
+	dirs := map[string]string{
+		"Same filesystem": t.TempDir(),
+	}
+
+	// Memory backed filesystem is used to test moves across filesystems.
+	shmDir, err := os.MkdirTemp("/dev/shm", "atomic-move-")
+	if err == nil {
+		t.Cleanup(func() { _ = os.RemoveAll(shmDir) })
+		dirs["Different filesystem"] = shmDir
+	}
+
+	for name, srcDir := range dirs {
+		t.Run(name, func(t *testing.T) {
+			srcPath := filepath.Join(srcDir, "src.json")
+			dstPath := filepath.Join(t.TempDir(), "dst.json")
+
+			require.NoError(t, os.WriteFile(srcPath, []byte("content"), 0600))
+			require.NoError(t, AtomicMoveFile(srcPath, dstPath, 0644))
+
+			content, err := os.ReadFile(dstPath)
+			require.NoError(t, err)
+			require.Equal(t, "content", string(content))
+			require.NoFileExists(t, srcPath)
+
+			info, err := os.Stat(dstPath)
+			require.NoError(t, err)
+			require.Equal(t, os.FileMode(0644), info.Mode().Perm())
+		})
+	}
+}
@@ -0,0 +1,164 @@
+// Package audit records the actions that change the published content (jobs
+// triggered through the API, imports, prunes, deduplications, rollbacks, and
+// publishes) in an append-only log, so that it can be determined who changed
+// what and when.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+)
+
+// FileName is the name of the audit log within the root directory. The file
+// is hidden, so that it is not served along with the published content.
+const FileName = ".audit.log"
+
+// Results of the recorded actions.
+const (
+	ResultSucceeded = "succeeded"
+	ResultFailed    = "failed"
+)
+
+// Record is a single entry of the audit log.
+type Record struct {
+	// Time when the action finished.
+	Time time.Time `json:"time"`
+
+	// Actor who performed the action. This is the local user for commands,
+	// and the client address for the jobs API.
+	Actor string `json:"actor"`
+
+	// Action is the name of the performed action (e.g. "prune" or
+	// "api:build").
+	Action string `json:"action"`
+
+	// Params contains the parameters of the action, such as the command
+	// arguments and flags.
+	Params map[string]string `json:"params,omitempty"`
+
+	// Result of the action, and the error if it failed.
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// NewRecord returns the record of the action that finished now with the given
+// error.
+func NewRecord(actor string, action string, params map[string]string, err error) Record {
+	record := Record{
+		Time:   time.Now().UTC(),
+		Actor:  actor,
+		Action: action,
+		Params: params,
+		Result: ResultSucceeded,
+	}
+
+	if err != nil {
+		record.Result = ResultFailed
+		record.Error = err.Error()
+	}
+
+	return record
+}
+
+// mutex serializes appends to the audit log, as the backend may need to
+// rewrite the whole file.
+var mutex sync.Mutex
+
+// Append appends the record to the audit log in the given root directory. The
+// log is created if it does not exist.
+func Append(rootDir string, record Record) error {
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	err = storage.AppendFile(b, FileName, string(line)+"\n")
+	if errors.Is(err, fs.ErrNotExist) {
+		err = storage.WriteFile(b, FileName, append(line, '\n'))
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to write audit log: %w", err)
+	}
+
+	return nil
+}
+
+// Read returns the records of the audit log in the given root directory in the
+// order in which they were appended. If the log does not exist, no records
+// are returned.
+func Read(rootDir string) ([]Record, error) {
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := storage.ReadFile(b, FileName)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("Failed to read audit log: %w", err)
+	}
+
+	var records []Record
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var record Record
+
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid audit log record on line %d: %w", line, err)
+		}
+
+		records = append(records, record)
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read audit log: %w", err)
+	}
+
+	return records, nil
+}
+
+// LocalUser returns the name of the user running the process.
+func LocalUser() string {
+	u, err := user.Current()
+	if err == nil && u.Username != "" {
+		return u.Username
+	}
+
+	name := os.Getenv("USER")
+	if name != "" {
+		return name
+	}
+
+	return "unknown"
+}
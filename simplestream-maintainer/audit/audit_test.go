@@ -0,0 +1,54 @@
+package audit_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/audit"
+)
+
+func TestAppendAndRead(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	// Ensure missing audit log has no records.
+	records, err := audit.Read(rootDir)
+	require.NoError(t, err)
+	require.Empty(t, records)
+
+	prune := audit.NewRecord("alice", "prune", map[string]string{"args": "/srv/images"}, nil)
+	build := audit.NewRecord("10.0.0.1", "api:build", nil, errors.New("build failed"))
+
+	require.NoError(t, audit.Append(rootDir, prune))
+	require.NoError(t, audit.Append(rootDir, build))
+
+	// Ensure records are read in the order in which they were appended.
+	records, err = audit.Read(rootDir)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+
+	require.Equal(t, "alice", records[0].Actor)
+	require.Equal(t, "prune", records[0].Action)
+	require.Equal(t, map[string]string{"args": "/srv/images"}, records[0].Params)
+	require.Equal(t, audit.ResultSucceeded, records[0].Result)
+	require.True(t, prune.Time.Equal(records[0].Time))
+
+	require.Equal(t, "api:build", records[1].Action)
+	require.Equal(t, audit.ResultFailed, records[1].Result)
+	require.Equal(t, "build failed", records[1].Error)
+
+	// Ensure corrupted records are reported.
+	file, err := os.OpenFile(filepath.Join(rootDir, audit.FileName), os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = file.WriteString("{\"time\":\n")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	_, err = audit.Read(rootDir)
+	require.ErrorContains(t, err, "Invalid audit log record on line 3")
+}
@@ -0,0 +1,79 @@
+// Package clock provides the current time to the code whose behavior depends
+// on it, such as pruning of old product versions. The clock carried by the
+// context can be replaced with a fake one, so that such behavior can be
+// tested deterministically.
+package clock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock reports the current time.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+}
+
+type system struct{}
+
+func (system) Now() time.Time {
+	return time.Now()
+}
+
+// System is the clock that reports the current system time.
+var System Clock = system{}
+
+// Fake is the clock whose time changes only when it is set or advanced.
+type Fake struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFake returns a fake clock set to the given time.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now implements Clock.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.now
+}
+
+// Set sets the current time of the clock.
+func (f *Fake) Set(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = now
+}
+
+// Advance moves the current time of the clock by the given duration.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = f.now.Add(d)
+}
+
+type contextKey struct{}
+
+// WithContext returns a copy of the context that carries the given clock.
+func WithContext(ctx context.Context, c Clock) context.Context {
+	return context.WithValue(ctx, contextKey{}, c)
+}
+
+// FromContext returns the clock carried by the context, or the system clock
+// if the context carries none.
+func FromContext(ctx context.Context) Clock {
+	c, ok := ctx.Value(contextKey{}).(Clock)
+	if !ok || c == nil {
+		return System
+	}
+
+	return c
+}
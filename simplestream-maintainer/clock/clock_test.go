@@ -0,0 +1,37 @@
+package clock_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/clock"
+)
+
+func TestFake(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	c := clock.NewFake(start)
+	require.Equal(t, start, c.Now())
+
+	c.Advance(time.Hour)
+	require.Equal(t, start.Add(time.Hour), c.Now())
+
+	c.Set(start)
+	require.Equal(t, start, c.Now())
+}
+
+func TestFromContext(t *testing.T) {
+	t.Parallel()
+
+	// Ensure system clock is used by default.
+	require.Equal(t, clock.System, clock.FromContext(context.Background()))
+
+	c := clock.NewFake(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	ctx := clock.WithContext(context.Background(), c)
+	require.Equal(t, c, clock.FromContext(ctx))
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/audit"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/server"
+)
+
+type auditOptions struct {
+	global *globalOptions
+
+	Actions []string
+	Actor   string
+	Since   time.Duration
+	Format  string
+}
+
+func (o *auditOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "audit <path> [flags]",
+		Short: "Show the audit log of the actions that changed the published content",
+		Long: `Show the audit log of the actions that changed the published content on the given path.
+
+Imports, prunes, deduplications, rollbacks, and publishes, as well as the jobs triggered through the jobs API of the
+serve command, are appended to the hidden file ".audit.log" in the root of the path once they finish.
+Each record contains the time, the actor (the local user for commands, and the client address for the
+jobs API), the action, its parameters, and the result. Read-only invocations, such as computing the
+prune plan or listing the snapshots, are not recorded.
+
+The path may also be an S3 URL in the format s3://bucket/prefix (see the build command).`,
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringSliceVar(&o.Actions, "action", nil, "Show only the records of the given actions (e.g. prune, api:build)")
+	cmd.PersistentFlags().StringVar(&o.Actor, "actor", "", "Show only the records of the given actor")
+	cmd.PersistentFlags().DurationVar(&o.Since, "since", 0, "Show only the records of the given recent period (e.g. 24h)")
+	cmd.PersistentFlags().StringVar(&o.Format, "format", "table", "Output format (table, json)")
+
+	return cmd
+}
+
+func (o *auditOptions) Run(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
+	}
+
+	if o.Format != "table" && o.Format != "json" {
+		return fmt.Errorf("Invalid output format %q. Valid formats are: [table, json]", o.Format)
+	}
+
+	records, err := audit.Read(args[0])
+	if err != nil {
+		return err
+	}
+
+	var since time.Time
+	if o.Since > 0 {
+		since = time.Now().Add(-o.Since)
+	}
+
+	records = filterAuditRecords(records, o.Actions, o.Actor, since)
+
+	return writeAuditRecords(cmd.OutOrStdout(), records, o.Format)
+}
+
+// filterAuditRecords returns the records of the given actions and actor that
+// were recorded after the given time. Empty filters match all records.
+func filterAuditRecords(records []audit.Record, actions []string, actor string, since time.Time) []audit.Record {
+	return slices.DeleteFunc(records, func(r audit.Record) bool {
+		return (len(actions) > 0 && !slices.Contains(actions, r.Action)) ||
+			(actor != "" && r.Actor != actor) ||
+			r.Time.Before(since)
+	})
+}
+
+// writeAuditRecords writes the records in the given format (table or json).
+func writeAuditRecords(w io.Writer, records []audit.Record, format string) error {
+	if format == "json" {
+		// Ensure an empty list is not encoded as null.
+		if records == nil {
+			records = []audit.Record{}
+		}
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tACTOR\tACTION\tRESULT\tPARAMETERS\tERROR")
+
+	for _, r := range records {
+		keys := make([]string, 0, len(r.Params))
+		for key := range r.Params {
+			keys = append(keys, key)
+		}
+
+		slices.Sort(keys)
+
+		params := make([]string, 0, len(keys))
+		for _, key := range keys {
+			params = append(params, fmt.Sprintf("%s=%s", key, r.Params[key]))
+		}
+
+		errMsg := r.Error
+		if errMsg == "" {
+			errMsg = "-"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Time.Format(time.RFC3339), r.Actor, r.Action, r.Result, strings.Join(params, " "), errMsg)
+	}
+
+	return tw.Flush()
+}
+
+// recordCommand appends the record of the action performed by the command on
+// the given root directory to the audit log. Parameters are the command
+// arguments and the flags set by the user, if the command is known. Failure
+// to write the record is only logged, so that it does not mask the result of
+// the command.
+func recordCommand(rootDir string, action string, cmd *cobra.Command, args []string, err error) {
+	params := map[string]string{
+		"args": strings.Join(redactArgs(args), " "),
+	}
+
+	if cmd != nil {
+		cmd.Flags().Visit(func(f *pflag.Flag) {
+			params["--"+f.Name] = f.Value.String()
+		})
+	}
+
+	recordAudit(rootDir, audit.NewRecord(audit.LocalUser(), action, params, err))
+}
+
+// recordJob appends the record of the job finished through the jobs API to
+// the audit log of the given root directory.
+func recordJob(rootDir string, job server.Job, input []byte) {
+	params := map[string]string{
+		"job": job.ID,
+	}
+
+	// Input (e.g. the approved prune plan) is identified by its hash.
+	if len(input) > 0 {
+		hash := sha256.Sum256(input)
+		params["input_sha256"] = hex.EncodeToString(hash[:])
+	}
+
+	var err error
+	if job.Status == server.JobFailed {
+		err = fmt.Errorf("%s", job.Error)
+	}
+
+	recordAudit(rootDir, audit.NewRecord(job.Client, "api:"+job.Operation, params, err))
+}
+
+// recordAudit appends the record to the audit log of the given root directory,
+// and logs a warning if it cannot be written.
+func recordAudit(rootDir string, record audit.Record) {
+	err := audit.Append(rootDir, record)
+	if err != nil {
+		slog.Warn("Failed to record the action in the audit log", "action", record.Action, "error", err)
+	}
+}
+
+// redactArgs returns the arguments with the passwords removed from the URLs
+// (e.g. the WebDAV targets of the publish command).
+func redactArgs(args []string) []string {
+	redacted := make([]string, 0, len(args))
+
+	for _, arg := range args {
+		u, err := url.Parse(arg)
+		if err == nil && u.User != nil {
+			arg = u.Redacted()
+		}
+
+		redacted = append(redacted, arg)
+	}
+
+	return redacted
+}
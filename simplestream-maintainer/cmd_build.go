@@ -1,22 +1,35 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log/slog"
+	"maps"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"runtime"
 	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/spf13/cobra"
 
 	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/clock"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/config"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/delta"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/imagesize"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/metrics"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/notify"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/pool"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/smoketest"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
 	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
 	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/webpage"
 )
@@ -27,417 +40,2994 @@ type buildOptions struct {
 	StreamVersion string
 	ImageDirs     []string
 	Workers       int
+	MaxWorkers    int
 	BuildWebPage  bool
+	LowMemory     bool
+	GPGKey        string
+	GPGHomeDir    string
+	Keyring       string
+	NoCache       bool
+	Checksums     []string
+	DeltaBackend  string
+	DirIndex      bool
+	DeltaWorkers  int
+	DeltaFormats  []string
+	DeltaDepth    int
+	DeltaWindow   string
+	Nice          int
+	IONice        string
+	LockTimeout   time.Duration
+	ContinueOnErr bool
+	Snapshots     int
+	BuildReports  int
+	ReportFile    string
+	VerifyDeltas  bool
+	InstalledSize bool
+	Qcow2Info     bool
+	Products      []string
+	Version       string
+	Strict        bool
+
+	UploadSentinel string
+	MinAge         time.Duration
+
+	XDelta3Level     int
+	XDelta3Window    int64
+	XDelta3Secondary string
+
+	RetryBackoff     time.Duration
+	RetryMaxBackoff  time.Duration
+	RetryMaxAttempts int
 }
 
 func (o *buildOptions) NewCommand() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:     "build <path> [flags]",
-		Short:   "Build simplestream index on the given path",
+		Use:   "build <path>... [flags]",
+		Short: "Build simplestream index on the given path",
+		Long: `Build simplestream index on the given path.
+
+Multiple paths can be given, in which case they are built concurrently and share a single pool of workers.
+Index entries, rolling aliases, notifications, and smoke tests are configured in the configuration file.
+
+The path may also be an S3 URL in the format s3://bucket/prefix. Credentials are read from the
+AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables, and the region and the endpoint
+of S3 compatible object stores can be set using the "region" and "endpoint" URL query parameters.`,
 		GroupID: "main",
 		RunE:    o.Run,
 	}
 
 	cmd.PersistentFlags().StringVar(&o.StreamVersion, "stream-version", "v1", "Stream version")
 	cmd.PersistentFlags().StringSliceVarP(&o.ImageDirs, "image-dir", "d", []string{"images"}, "Image directory (relative to path argument)")
-	cmd.PersistentFlags().IntVar(&o.Workers, "workers", max(runtime.NumCPU()/2, 1), "Maximum number of concurrent operations")
+	cmd.PersistentFlags().IntVar(&o.Workers, "workers", 0, "Maximum number of concurrent operations (0 tunes the number automatically)")
+	cmd.PersistentFlags().IntVar(&o.MaxWorkers, "max-workers", runtime.NumCPU()*2, "Upper limit of concurrent operations when the number of workers is tuned automatically")
 	cmd.PersistentFlags().BoolVar(&o.BuildWebPage, "build-webpage", false, "Build index.html")
+	cmd.PersistentFlags().StringSliceVar(&o.Products, "product", nil, "Pattern of the product IDs to build, publishing other products with their existing catalog entries (e.g. ubuntu:noble:*)")
+	cmd.PersistentFlags().StringVar(&o.Version, "version", "", "Name of the product version to build, leaving other versions unchanged")
+	cmd.PersistentFlags().BoolVar(&o.LowMemory, "low-memory", false, "Process and write products one at a time to bound peak memory usage")
+	cmd.PersistentFlags().StringVar(&o.GPGKey, "gpg-key", "", "GPG key used to sign the index and product catalog files")
+	cmd.PersistentFlags().StringVar(&o.GPGHomeDir, "gpg-homedir", "", "GPG home directory")
+	cmd.PersistentFlags().StringVar(&o.Keyring, "keyring", "", "GPG keyring (as exported by \"gpg --export\") used to verify signed checksum files of the versions (e.g. SHA256SUMS.gpg)")
+	cmd.PersistentFlags().BoolVar(&o.NoCache, "no-cache", false, "Calculate all file hashes without consulting the hash cache")
+	cmd.PersistentFlags().StringVar(&o.DeltaBackend, "delta-backend", delta.BackendNative, "Backend used to create delta files (native, xdelta3)")
+	cmd.PersistentFlags().IntVar(&o.XDelta3Level, "xdelta3-level", 0, "Compression level (1-9) of the xdelta3 backend (0 defaults to 9)")
+	cmd.PersistentFlags().Int64Var(&o.XDelta3Window, "xdelta3-source-window", 0, "Source window size in bytes of the xdelta3 backend, larger windows find more matches in large images at the cost of memory (0 uses the xdelta3 default)")
+	cmd.PersistentFlags().StringVar(&o.XDelta3Secondary, "xdelta3-secondary", "", "Secondary compressor of the xdelta3 backend (none, djw, fgk, lzma)")
+	cmd.PersistentFlags().IntVar(&o.DeltaWorkers, "delta-workers", max(runtime.NumCPU()/2, 1), "Maximum number of delta files created concurrently")
+	cmd.PersistentFlags().StringSliceVar(&o.DeltaFormats, "delta-formats", []string{delta.FormatVCDiff}, "Formats of delta files created for squashfs and qcow2 items (vcdiff, zsync)")
+	cmd.PersistentFlags().IntVar(&o.DeltaDepth, "delta-depth", 1, "Number of previous product versions against which delta (vcdiff) files are created (0 defaults to 1)")
+	cmd.PersistentFlags().BoolVar(&o.VerifyDeltas, "verify-deltas", false, "Apply each generated delta (vcdiff) file to its base and ensure the result matches the target item before publishing it")
+	cmd.PersistentFlags().BoolVar(&o.InstalledSize, "installed-size", false, "Publish the installed size of new squashfs and qcow2 items (requires unsquashfs and qemu-img)")
+	cmd.PersistentFlags().BoolVar(&o.Qcow2Info, "qcow2-info", false, "Publish the virtual size and compression type of new qcow2 items, read from their headers")
+	cmd.PersistentFlags().StringVar(&o.DeltaWindow, "delta-window", "", "Daily time window (HH:MM-HH:MM in local time) outside of which the generation of delta files is deferred to a later build")
+	cmd.PersistentFlags().IntVar(&o.Nice, "nice", 0, "Niceness increment (0-19) applied to the generation of delta files")
+	cmd.PersistentFlags().StringVar(&o.IONice, "ionice", "", "I/O scheduling class applied to the generation of delta files (idle, best-effort[:level])")
+	cmd.PersistentFlags().StringSliceVar(&o.Checksums, "checksum", nil, "Additional checksum algorithm of items included in the product catalog (sha512)")
+	cmd.PersistentFlags().BoolVar(&o.DirIndex, "dir-index", false, "Write directory listing files (for hosting on object stores without directory listings)")
+	cmd.PersistentFlags().BoolVar(&o.Strict, "strict", false, "Fail the build if the image config of any product version is invalid or has warnings, instead of skipping the invalid versions")
+	cmd.PersistentFlags().BoolVar(&o.ContinueOnErr, "continue-on-error", false, "Publish the remaining streams if some fail to build, keeping the previous product catalogs of the failed ones")
+	cmd.PersistentFlags().IntVar(&o.Snapshots, "snapshots", defaultSnapshots, "Number of snapshots of the previously published index and product catalogs kept for the rollback command (0 disables snapshots)")
+	cmd.PersistentFlags().IntVar(&o.BuildReports, "build-reports", defaultBuildReports, "Number of the latest build reports (streams/<stream-version>/.build-report-<time>.json) kept (0 disables build reports)")
+	cmd.PersistentFlags().StringVar(&o.ReportFile, "report-file", "", "Local file to which the combined report of the builds of all given paths is written")
+	cmd.PersistentFlags().DurationVar(&o.LockTimeout, "lock-timeout", defaultLockTimeout, "Maximum time to wait for another build or prune to finish (0 fails immediately)")
+	cmd.PersistentFlags().StringVar(&o.UploadSentinel, "upload-sentinel", defaultUploadSentinel, "Name of the file whose presence in the version directory marks the upload in progress (empty disables the check)")
+	cmd.PersistentFlags().DurationVar(&o.MinAge, "min-age", 0, "Minimum time since the last modification of the version files before the version is built (0 disables the check)")
+	cmd.PersistentFlags().DurationVar(&o.RetryBackoff, "retry-backoff", 10*time.Minute, "Delay before a failed version or delta file is attempted again, doubled after each failure (0 retries on every build)")
+	cmd.PersistentFlags().DurationVar(&o.RetryMaxBackoff, "retry-max-backoff", 24*time.Hour, "Upper limit of the delay between attempts of a failed version or delta file (0 means no limit)")
+	cmd.PersistentFlags().IntVar(&o.RetryMaxAttempts, "retry-max-attempts", 10, "Number of failed attempts after which a version or delta file is skipped until its files change (0 means no limit)")
 
 	return cmd
 }
 
 func (o *buildOptions) Run(_ *cobra.Command, args []string) error {
-	if len(args) < 1 || args[0] == "" {
+	if len(args) < 1 || slices.Contains(args, "") {
 		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
 	}
 
-	return buildIndex(o.global.ctx, args[0], o.StreamVersion, o.ImageDirs, o.Workers, o.BuildWebPage)
-}
-
-// replace struct holds old and new path for a file replace.
-type replace struct {
-	OldPath string
-	NewPath string
-}
+	for i, rootDir := range args {
+		if slices.Contains(args[:i], rootDir) {
+			return fmt.Errorf("Path %q is given multiple times", rootDir)
+		}
+	}
 
-func buildIndex(ctx context.Context, rootDir string, streamVersion string, streamNames []string, workers int, buildWebpage bool) error {
-	if len(streamNames) > 1 && buildWebpage {
-		return fmt.Errorf("Building index.html is supported only for a single stream")
+	opts, err := o.buildOptions()
+	if err != nil {
+		return err
 	}
 
-	var indexHTML *webpage.WebPage
-	var replaces []replace
-	index := stream.NewStreamIndex()
-	metaDir := path.Join(rootDir, "streams", streamVersion)
+	return buildRoots(o.global.ctx, args, o.StreamVersion, o.ImageDirs, o.Workers, o.BuildWebPage, o.ReportFile, opts...)
+}
 
-	// Ensure meta directory exists.
-	err := os.MkdirAll(metaDir, os.ModePerm)
+// buildOptions converts the command flags into build options.
+func (o *buildOptions) buildOptions() ([]buildOption, error) {
+	// Ensure the delta backend is available before the build starts.
+	deltaEncoder, err := delta.NewEncoder(o.DeltaBackend)
 	if err != nil {
-		return fmt.Errorf("Create metadata directory: %w", err)
+		return nil, err
 	}
 
-	// Create product catalogs by reading image directories.
-	for _, streamName := range streamNames {
-		// Create product catalog from directory structure.
-		catalog, err := buildProductCatalog(ctx, rootDir, streamVersion, streamName, workers)
+	xdelta3, ok := deltaEncoder.(delta.XDelta3Encoder)
+	if ok {
+		xdelta3.Level = o.XDelta3Level
+		xdelta3.SourceWindow = o.XDelta3Window
+		xdelta3.Secondary = o.XDelta3Secondary
+
+		err := xdelta3.Validate()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		// Write product catalog to a temporary file that is located next
-		// to the final file to ensure atomic replace. Temporary file is
-		// prefixed with a dot to hide it.
-		catalogPath := filepath.Join(metaDir, fmt.Sprintf("%s.json", streamName))
-		catalogPathTemp := filepath.Join(metaDir, fmt.Sprintf(".%s.json.tmp", streamName))
+		deltaEncoder = xdelta3
+	} else if o.XDelta3Level != 0 || o.XDelta3Window != 0 || o.XDelta3Secondary != "" {
+		return nil, fmt.Errorf("Flags --xdelta3-level, --xdelta3-source-window, and --xdelta3-secondary require delta backend %q", delta.BackendXDelta3)
+	}
 
-		err = shared.WriteJSONFile(catalogPathTemp, catalog)
+	for _, format := range o.DeltaFormats {
+		err := delta.ValidateFormat(format)
 		if err != nil {
-			return fmt.Errorf("Write product catalog file: %w", err)
+			return nil, err
 		}
+	}
 
-		defer os.Remove(catalogPathTemp)
-
-		// Create compressed version of the product catalog file.
-		catalogGzPath := fmt.Sprintf("%s.gz", catalogPath)
-		catalogGzPathTemp := fmt.Sprintf("%s.gz", catalogPathTemp)
+	if o.DeltaDepth < 0 {
+		return nil, fmt.Errorf("Delta depth cannot be negative")
+	}
 
-		err = shared.GZipFile(catalogPathTemp, catalogGzPathTemp)
+	for _, pattern := range o.Products {
+		_, err := path.Match(pattern, "")
 		if err != nil {
-			return fmt.Errorf("Compress product catalog file: %w", err)
+			return nil, fmt.Errorf("Invalid product pattern %q: %w", pattern, err)
 		}
+	}
 
-		defer os.Remove(catalogGzPathTemp)
-
-		// Add replaces for temporary files.
-		replaces = append(replaces,
-			replace{OldPath: catalogPathTemp, NewPath: catalogPath},
-			replace{OldPath: catalogGzPathTemp, NewPath: catalogGzPath},
-		)
+	if o.Snapshots < 0 {
+		return nil, fmt.Errorf("Number of snapshots cannot be negative")
+	}
 
-		// Relative path for index.
-		catalogRelPath, err := filepath.Rel(rootDir, catalogPath)
-		if err != nil {
-			return err
-		}
+	if o.BuildReports < 0 {
+		return nil, fmt.Errorf("Number of build reports cannot be negative")
+	}
 
-		// Create webpage for the stream.
-		if buildWebpage {
-			indexHTML = webpage.NewWebPage(*catalog)
-		}
+	if o.MinAge < 0 {
+		return nil, fmt.Errorf("Minimum age cannot be negative")
+	}
 
-		// Add index entry.
-		index.AddEntry(streamName, catalogRelPath, *catalog)
+	if strings.ContainsRune(o.UploadSentinel, '/') {
+		return nil, fmt.Errorf("Upload sentinel %q must be a file name", o.UploadSentinel)
 	}
 
-	// Write index to a temporary file that is located next to the
-	// final file to ensure atomic replace. Temporary file is
-	// prefixed with a dot to hide it.
-	indexPath := filepath.Join(metaDir, "index.json")
-	indexPathTemp := filepath.Join(metaDir, ".index.json.tmp")
+	if o.RetryBackoff < 0 || o.RetryMaxBackoff < 0 || o.RetryMaxAttempts < 0 {
+		return nil, fmt.Errorf("Retry backoff and attempts cannot be negative")
+	}
 
-	err = shared.WriteJSONFile(indexPathTemp, index)
+	deltaWindow, err := delta.ParseWindow(o.DeltaWindow)
 	if err != nil {
-		return fmt.Errorf("Write index file: %w", err)
+		return nil, err
 	}
 
-	defer os.Remove(indexPathTemp)
+	ioClass, ioLevel, err := delta.ParseIOPriority(o.IONice)
+	if err != nil {
+		return nil, err
+	}
 
-	// Create compressed version of the index file.
-	indexGzPath := fmt.Sprintf("%s.gz", indexPath)
-	indexGzPathTemp := fmt.Sprintf("%s.gz", indexPathTemp)
+	deltaPriority := delta.Priority{Nice: o.Nice, IOClass: ioClass, IOLevel: ioLevel}
 
-	err = shared.GZipFile(indexPathTemp, indexGzPathTemp)
+	err = deltaPriority.Validate()
 	if err != nil {
-		return fmt.Errorf("Compress index file: %w", err)
+		return nil, err
 	}
 
-	defer os.Remove(indexGzPathTemp)
+	var sizer *imagesize.Sizer
 
-	// Add replaces for temporary files. Note that index file must
-	// be updated last, once all catalog files are in place, to
-	// avoid referencing non-existing products (from catalog).
-	replaces = append(replaces,
-		replace{OldPath: indexPathTemp, NewPath: indexPath},
-		replace{OldPath: indexGzPathTemp, NewPath: indexGzPath},
-	)
+	if o.InstalledSize {
+		sizer = &imagesize.Sizer{}
 
-	// Move temporary files to final destinations.
-	for _, r := range replaces {
-		err := os.Rename(r.OldPath, r.NewPath)
+		err := sizer.Check()
 		if err != nil {
-			return err
+			return nil, err
 		}
+	}
+
+	var checksumAlgorithms []stream.ChecksumAlgorithm
 
-		// Set read permissions.
-		err = os.Chmod(r.NewPath, 0644)
+	for _, name := range o.Checksums {
+		algorithm, err := stream.ParseChecksumAlgorithm(name)
 		if err != nil {
-			return err
+			return nil, err
+		}
+
+		// SHA256 hashes are always included, and the product catalog
+		// has no field for other algorithms.
+		if algorithm != stream.ChecksumSHA512 {
+			return nil, fmt.Errorf("Checksum algorithm %q cannot be included in the product catalog", name)
 		}
+
+		checksumAlgorithms = append(checksumAlgorithms, algorithm)
 	}
 
-	// Write stream's index.html.
-	if indexHTML != nil {
-		err := indexHTML.Write(rootDir)
-		if err != nil {
-			return fmt.Errorf("Failed to write index.html: %w", err)
+	return []buildOption{
+		withLowMemory(o.LowMemory),
+		withSigner(o.GPGKey, o.GPGHomeDir),
+		withKeyring(o.Keyring),
+		withNoCache(o.NoCache),
+		withMaxWorkers(o.MaxWorkers),
+		withChecksumAlgorithms(checksumAlgorithms...),
+		withDeltaEncoder(deltaEncoder),
+		withDirIndex(o.DirIndex),
+		withDeltaWorkers(o.DeltaWorkers),
+		withDeltaFormats(o.DeltaFormats...),
+		withDeltaDepth(o.DeltaDepth),
+		withDeltaWindow(deltaWindow),
+		withDeltaPriority(deltaPriority),
+		withVerifyDeltas(o.VerifyDeltas),
+		withInstalledSize(sizer),
+		withQcow2Info(o.Qcow2Info),
+		withProducts(o.Products...),
+		withVersion(o.Version),
+		withLockTimeout(o.LockTimeout),
+		withContinueOnError(o.ContinueOnErr),
+		withStrict(o.Strict),
+		withSnapshots(o.Snapshots),
+		withBuildReports(o.BuildReports),
+		withUploadGuard(o.UploadSentinel, o.MinAge),
+		withPathSchema(o.global.pathSchema),
+		withRetryPolicy(stream.RetryPolicy{
+			Backoff:     o.RetryBackoff,
+			MaxBackoff:  o.RetryMaxBackoff,
+			MaxAttempts: o.RetryMaxAttempts,
+		}),
+	}, nil
+}
+
+// buildOption modifies the behavior of the index and product catalog build.
+type buildOption func(*buildConfig)
+
+type buildConfig struct {
+	lowMemory     bool
+	signer        *stream.Signer
+	verifier      *stream.Verifier
+	noCache       bool
+	maxWorkers    int
+	checksums     []stream.ChecksumAlgorithm
+	deltaEncoder  delta.DeltaEncoder
+	deltaWorkers  int
+	deltaFormats  []string
+	deltaDepth    int
+	deltaWindow   delta.Window
+	deltaPriority delta.Priority
+	verifyDeltas  bool
+	sizer         *imagesize.Sizer
+	qcow2Info     bool
+	dirIndex      bool
+	lockTimeout   time.Duration
+	continueOnErr bool
+	strict        bool
+	snapshots     int
+	buildReports  int
+	pathSchema    stream.PathSchema
+	retry         stream.RetryPolicy
+	uploadGuard   stream.Option
+	productWriter func(id string, product stream.Product) error
+	products      []string
+	version       string
+	report        *buildReport
+	reportHandler func(report stream.BuildReport)
+	workerPool    *pool.Pool
+}
+
+func newBuildConfig(opts ...buildOption) *buildConfig {
+	cfg := &buildConfig{
+		maxWorkers:   runtime.NumCPU() * 2,
+		deltaEncoder: delta.NativeEncoder{},
+		deltaFormats: []string{delta.FormatVCDiff},
+		deltaDepth:   1,
+		lockTimeout:  defaultLockTimeout,
+		snapshots:    defaultSnapshots,
+		buildReports: defaultBuildReports,
+		uploadGuard:  stream.WithUploadGuard(defaultUploadSentinel, 0),
+	}
+
+	for _, opt := range opts {
+		if opt != nil {
+			opt(cfg)
 		}
 	}
 
-	return nil
+	return cfg
 }
 
-// buildProductCatalog compares the existing product catalog and actual products on
-// the disk. For missing any new version, hashes are calculated and compared against
-// the checksums file. Based on the final catalog (that contains only valid version)
-// missing delta files are generated. Finally the catalog is returned.
-//
-// Note: Workers limit the maximum number of concurent tasks when calulcating hashes
-// and delta files.
-func buildProductCatalog(ctx context.Context, rootDir string, streamVersion string, streamName string, workers int) (*stream.ProductCatalog, error) {
-	// Get current product catalog (from json file).
-	catalogPath := filepath.Join(rootDir, "streams", streamVersion, fmt.Sprintf("%s.json", streamName))
-	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		return nil, err
+// withLowMemory ensures products are processed and written to the product
+// catalog file one at a time, which bounds the peak memory usage of a build.
+func withLowMemory(val bool) buildOption {
+	return func(cfg *buildConfig) {
+		cfg.lowMemory = val
 	}
+}
 
-	if catalog == nil {
-		catalog = stream.NewCatalog(streamName, nil)
+// withSigner ensures that the index and product catalog files are signed
+// using the given GPG key. If the key is empty, files are not signed.
+func withSigner(keyID string, homeDir string) buildOption {
+	return func(cfg *buildConfig) {
+		if keyID != "" {
+			cfg.signer = stream.NewSigner(keyID, homeDir)
+		}
 	}
+}
 
-	// Get existing products (from actual directory hierarchy).
-	products, err := stream.GetProducts(rootDir, streamName)
-	if err != nil {
-		return nil, err
+// withKeyring ensures that the signatures of the version checksum files are
+// verified against the given GPG keyring, and that the versions with invalid
+// signatures are rejected. If the keyring is empty, signatures are ignored.
+func withKeyring(keyring string) buildOption {
+	return func(cfg *buildConfig) {
+		if keyring != "" {
+			cfg.verifier = stream.NewVerifier(keyring)
+		}
 	}
+}
 
-	var wg sync.WaitGroup
-	var mutex sync.Mutex // To safely update the catalog.Products map
+// withNoCache ensures that file hashes are always calculated, instead of
+// being retrieved from the hash cache for unchanged files.
+func withNoCache(val bool) buildOption {
+	return func(cfg *buildConfig) {
+		cfg.noCache = val
+	}
+}
 
-	// Ensure at least 1 worker is spawned.
-	if workers < 1 {
-		workers = 1
+// withMaxWorkers sets the upper limit of concurrent operations when the
+// number of workers is tuned automatically.
+func withMaxWorkers(val int) buildOption {
+	return func(cfg *buildConfig) {
+		if val > 0 {
+			cfg.maxWorkers = val
+		}
 	}
+}
 
-	// Job queue.
-	jobs := make(chan func(), workers)
-	defer close(jobs)
+// withWorkerPool runs the concurrent operations of the build in the given pool
+// of workers, which is shared with other builds. The number of workers is
+// then set by the pool.
+func withWorkerPool(workerPool *pool.Pool) buildOption {
+	return func(cfg *buildConfig) {
+		cfg.workerPool = workerPool
+	}
+}
 
-	// Create new pool of workers.
-	for i := 0; i < workers; i++ {
-		go func() {
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case job, ok := <-jobs:
-					if !ok {
-						return
-					}
+// withChecksumAlgorithms ensures that item hashes calculated using the given
+// algorithms are included in the product catalog, in addition to SHA256.
+func withChecksumAlgorithms(algorithms ...stream.ChecksumAlgorithm) buildOption {
+	return func(cfg *buildConfig) {
+		cfg.checksums = append(cfg.checksums, algorithms...)
+	}
+}
 
-					job()
-				}
-			}
-		}()
+// withDeltaEncoder sets the encoder used to create delta files.
+func withDeltaEncoder(encoder delta.DeltaEncoder) buildOption {
+	return func(cfg *buildConfig) {
+		if encoder != nil {
+			cfg.deltaEncoder = encoder
+		}
 	}
+}
 
-	// Extract new (unreferenced products and product versions) and add them
-	// to the catalog.
-	_, newProducts := diffProducts(catalog.Products, products)
-	for id, p := range newProducts {
-		productPath := filepath.Join(streamName, p.RelPath())
+// withDeltaWorkers limits the number of delta files that are created
+// concurrently, as delta encoding is memory intensive. Zero means delta
+// files are limited only by the number of workers.
+func withDeltaWorkers(val int) buildOption {
+	return func(cfg *buildConfig) {
+		if val >= 0 {
+			cfg.deltaWorkers = val
+		}
+	}
+}
 
-		// Copy value of the product retrieved from the directory hierarchy
-		// to the catalog's product to ensure the potential new metadata is
-		// applied.
-		mutex.Lock()
-		tmp := p
+// withDeltaFormats sets the formats in which delta files are created. Zsync
+// control files allow clients that cannot apply VCDiff deltas to download
+// only the changed parts of the image using HTTP range requests. If no format
+// is given, only VCDiff deltas are created.
+func withDeltaFormats(formats ...string) buildOption {
+	return func(cfg *buildConfig) {
+		if len(formats) > 0 {
+			cfg.deltaFormats = formats
+		}
+	}
+}
 
-		_, ok := catalog.Products[id]
-		if ok {
-			// Retain existing product versions.
-			tmp.Versions = catalog.Products[id].Versions
-		} else {
-			// Create new map for product versions. They will be added
-			// in the next step.
-			tmp.Versions = make(map[string]stream.Version, len(p.Versions))
+// withDeltaDepth sets the number of previous product versions against which
+// delta (VCDiff) files are created, so that clients that are several versions
+// behind can also update using a delta file.
+func withDeltaDepth(val int) buildOption {
+	return func(cfg *buildConfig) {
+		if val > 0 {
+			cfg.deltaDepth = val
 		}
+	}
+}
+
+// withDeltaWindow ensures that delta files are generated only within the given
+// daily time window. Versions are still published outside the window, and
+// their delta files are generated by a later build within the window.
+func withDeltaWindow(window delta.Window) buildOption {
+	return func(cfg *buildConfig) {
+		cfg.deltaWindow = window
+	}
+}
 
-		catalog.Products[id] = tmp
-		mutex.Unlock()
+// withDeltaPriority sets the CPU and I/O priority of the delta generation.
+func withDeltaPriority(priority delta.Priority) buildOption {
+	return func(cfg *buildConfig) {
+		cfg.deltaPriority = priority
+	}
+}
 
-		for versionName := range p.Versions {
-			// Add a job for processing a new version.
-			wg.Add(1)
-			jobs <- func() {
-				defer wg.Done()
+// withVerifyDeltas ensures that each generated delta file is applied to its
+// base and reconstructs the target item before it is published.
+func withVerifyDeltas(val bool) buildOption {
+	return func(cfg *buildConfig) {
+		cfg.verifyDeltas = val
+	}
+}
 
-				// Read the version and generate the file hashes.
-				versionPath := filepath.Join(productPath, versionName)
-				version, err := stream.GetVersion(rootDir, versionPath, stream.WithHashes(true))
-				if err != nil {
-					slog.Error("Failed to get version", "streamName", streamName, "product", id, "version", versionName, "error", err)
-					return
-				}
+// withInstalledSize ensures the installed size of the items of new product
+// versions is determined using the given sizer and published in the product
+// catalog. If the sizer is nil, the installed size is not published.
+func withInstalledSize(sizer *imagesize.Sizer) buildOption {
+	return func(cfg *buildConfig) {
+		cfg.sizer = sizer
+	}
+}
 
-				// Verify items checksums if checksum file is present
-				// within the version.
-				if version.Checksums != nil {
-					for itemName, item := range version.Items {
-						checksum := version.Checksums[itemName]
-
-						// Ignore verification, if the checksum for the delta
-						// file does not exist. This is because the delta file
-						// is generated after the checksums file is created.
-						if !ok && (item.Ftype == stream.ItemTypeDiskKVMDelta || item.Ftype == stream.ItemTypeSquashfsDelta) {
-							continue
-						}
-
-						// Verify checksum.
-						if checksum != item.SHA256 {
-							slog.Error("Checksum mismatch", "streamName", streamName, "product", id, "version", versionName, "item", itemName)
-							return
-						}
-					}
-				}
+// withQcow2Info ensures the virtual size and compression type of the qcow2
+// items of new product versions are read from their headers and published in
+// the product catalog.
+func withQcow2Info(val bool) buildOption {
+	return func(cfg *buildConfig) {
+		cfg.qcow2Info = val
+	}
+}
 
-				mutex.Lock()
-				catalog.Products[id].Versions[versionName] = *version
-				mutex.Unlock()
+// withProducts limits the build to the products whose ID matches any of the
+// given patterns (using the syntax of path.Match). Other products are not
+// read, and their entries in the product catalog are left intact. If no
+// pattern is given, all products are built.
+func withProducts(patterns ...string) buildOption {
+	return func(cfg *buildConfig) {
+		cfg.products = append(cfg.products, patterns...)
+	}
+}
 
-				slog.Info("New version added to the product catalog", "streamName", streamName, "product", id, "version", versionName)
-			}
-		}
+// withVersion limits the build to the product versions with the given name.
+// Entries of other versions in the product catalog are left intact. If the
+// name is empty, all versions are built.
+func withVersion(name string) buildOption {
+	return func(cfg *buildConfig) {
+		cfg.version = name
 	}
+}
 
-	// Wait for all workers to finish to ensure the final catalog contains
-	// all valid product versions.
-	wg.Wait()
+// withUploadGuard ensures product versions whose directory contains the given
+// sentinel file, or any file modified within the given minimum age, are not
+// built, as they may still be uploaded.
+func withUploadGuard(sentinel string, minAge time.Duration) buildOption {
+	return func(cfg *buildConfig) {
+		cfg.uploadGuard = stream.WithUploadGuard(sentinel, minAge)
+	}
+}
 
-	// Build delta files after all new versions are added to the catalog.
-	// This way we can determine which versions are valid for delta files.
-	//
-	// Traverse through the products. For each product iterate over versions
-	// and find items that are valid for delta files. If a delta file already
-	// exists, ensure that the catalog contains its file hash. If a delta file
-	// does not exist, create it and update the catalog with the new file hash.
-	for id, product := range catalog.Products {
-		productRelPath := filepath.Join(streamName, product.RelPath())
-
-		versions := shared.MapKeys(product.Versions)
-		slices.Sort(versions)
-
-		if len(versions) < 2 {
-			// At least 2 versions must be available for delta.
-			continue
-		}
+// partial returns true if the build is limited to some of the products or
+// product versions.
+func (cfg *buildConfig) partial() bool {
+	return len(cfg.products) > 0 || cfg.version != ""
+}
 
-		// Skip the oldest version because even if the .vcdiff does
-		// not exist, we cannot generate it.
-		for i := 1; i < len(versions); i++ {
-			sourceVerName := versions[i-1]
-			targetVerName := versions[i]
-			targetVersion := product.Versions[targetVerName]
+// selectsProduct returns true if the product with the given ID is built.
+func (cfg *buildConfig) selectsProduct(id string) bool {
+	if len(cfg.products) == 0 {
+		return true
+	}
 
-			for itemName, item := range targetVersion.Items {
-				// Delta should be created only for qcow2 and squashfs files.
-				if item.Ftype != stream.ItemTypeDiskKVM && item.Ftype != stream.ItemTypeSquashfs {
-					continue
-				}
+	return slices.ContainsFunc(cfg.products, func(pattern string) bool {
+		match, _ := path.Match(pattern, id)
+		return match
+	})
+}
 
-				wg.Add(1)
-				jobs <- func() {
-					defer wg.Done()
+// withDirIndex ensures that directory listing files are written into each
+// directory once the index is built.
+func withDirIndex(val bool) buildOption {
+	return func(cfg *buildConfig) {
+		cfg.dirIndex = val
+	}
+}
 
-					// Evaluate delta file name.
-					prefix, _ := strings.CutSuffix(itemName, filepath.Ext(itemName))
-					suffix := "vcdiff"
+// withProductWriter ensures products are processed one at a time. Once the
+// product is complete, it is passed to the given function and its versions
+// are released from the product catalog.
+func withProductWriter(fn func(id string, product stream.Product) error) buildOption {
+	return func(cfg *buildConfig) {
+		cfg.productWriter = fn
+	}
+}
 
-					if item.Ftype == stream.ItemTypeDiskKVM {
-						suffix = "qcow2.vcdiff"
-					}
+// withLockTimeout sets the maximum time to wait for the streams lock held by
+// another process.
+func withLockTimeout(timeout time.Duration) buildOption {
+	return func(cfg *buildConfig) {
+		cfg.lockTimeout = max(timeout, 0)
+	}
+}
 
-					deltaName := fmt.Sprintf("%s.%s.%s", prefix, sourceVerName, suffix)
-					deltaItem, deltaExists := targetVersion.Items[deltaName]
+// withContinueOnError ensures that the index is published even if some of the
+// streams fail to build. Failed streams keep their previously published
+// product catalogs, and the build still returns an error listing them.
+func withContinueOnError(val bool) buildOption {
+	return func(cfg *buildConfig) {
+		cfg.continueOnErr = val
+	}
+}
 
-					// Generate delta file if it does not already exist.
-					if !deltaExists {
-						sourcePath := filepath.Join(rootDir, productRelPath, sourceVerName, itemName)
-						targetPath := filepath.Join(rootDir, productRelPath, targetVerName, itemName)
-						outputPath := filepath.Join(rootDir, productRelPath, targetVerName, deltaName)
-
-						// Ensure source path exists.
-						_, err := os.Stat(sourcePath)
-						if err != nil {
-							if errors.Is(err, os.ErrNotExist) {
-								// Source does not exist. Skip..
-								return
-							}
-
-							slog.Error("Failed to read base delta file", "product", id, "version", targetVerName, "item", itemName, "deltaBase", sourceVerName, "error", err)
-							return
-						}
-
-						// -e compress
-						// -9 compression level (0 no-compression -> 9 max-compression)
-						// -s source
-						cmd := exec.CommandContext(ctx, "xdelta3", "-e", "-9", "-s", sourcePath, targetPath, outputPath)
-						cmd.Stdout = os.Stdout
-						cmd.Stderr = os.Stderr
-
-						err = cmd.Run()
-						if err != nil {
-							slog.Error("Failed creating delta file", "product", id, "version", targetVerName, "item", deltaName, "deltaBase", sourceVerName, "error", err)
-							_ = os.Remove(outputPath)
-							return
-						}
-
-						slog.Info("Delta generated successfully", "product", id, "version", targetVerName, "item", deltaName, "deltaBase", sourceVerName)
-					}
+// withStrict ensures that the build of a stream fails if the image config of
+// any of its product versions is invalid or has warnings, instead of skipping
+// the versions with an invalid image config.
+func withStrict(val bool) buildOption {
+	return func(cfg *buildConfig) {
+		cfg.strict = val
+	}
+}
 
-					// If delta file exists but is missing a hash in the catalog,
-					// or was just generated, calculate it's hash and add it to
-					// the catalog.
-					if !deltaExists || deltaItem.SHA256 == "" {
-						deltaRelPath := filepath.Join(productRelPath, targetVerName, deltaName)
-						deltaItem, err := stream.GetItem(rootDir, deltaRelPath, stream.WithHashes(true))
-						if err != nil {
-							slog.Error("Failed to get existing delta item", "product", id, "version", targetVerName, "item", deltaName, "error", err)
-							return
-						}
-
-						// Append delta file hash to the version checksums
-						// file if it exists.
-						_, ok := targetVersion.Checksums[deltaName]
-						if !ok && len(targetVersion.Checksums) > 0 {
-							// Append new item to the checksums file.
-							checksumFile := filepath.Join(rootDir, productRelPath, targetVerName, stream.FileChecksumSHA256)
-							err := shared.AppendToFile(checksumFile, fmt.Sprintf("%s  %s\n", deltaItem.SHA256, deltaName))
-							if err != nil {
-								slog.Error("Failed to update checksums file", "product", id, "version", targetVerName, "error", err)
-								return
-							}
-
-							// Update version checksums map.
-							mutex.Lock()
-							catalog.Products[id].Versions[targetVerName].Checksums[deltaName] = deltaItem.SHA256
-							mutex.Unlock()
-						}
-
-						// Include delta item with hashes in the catalog.
-						mutex.Lock()
-						catalog.Products[id].Versions[targetVerName].Items[deltaName] = *deltaItem
-						mutex.Unlock()
-					}
-				}
-			}
+// withPathSchema sets the layout of product directories within the streams.
+func withPathSchema(schema stream.PathSchema) buildOption {
+	return func(cfg *buildConfig) {
+		cfg.pathSchema = schema
+	}
+}
+
+// withRetryPolicy ensures that the failed attempts to add product versions and
+// create delta files are recorded, and that the failed operations are attempted
+// again according to the given policy. By default, failed operations are
+// attempted again on every build without being recorded.
+func withRetryPolicy(policy stream.RetryPolicy) buildOption {
+	return func(cfg *buildConfig) {
+		cfg.retry = policy
+	}
+}
+
+// withSnapshots sets the number of snapshots of the previously published
+// metadata files that are kept. Before the new files are published, the
+// current ones are copied into a new snapshot, which allows rolling back the
+// build. Zero disables snapshots.
+func withSnapshots(retain int) buildOption {
+	return func(cfg *buildConfig) {
+		cfg.snapshots = max(retain, 0)
+	}
+}
+
+// withBuildReports sets the number of the latest build reports that are kept.
+// Each build writes a report of its outcome, and removes the older reports.
+// Zero disables build reports.
+func withBuildReports(retain int) buildOption {
+	return func(cfg *buildConfig) {
+		cfg.buildReports = max(retain, 0)
+	}
+}
+
+// withReportHandler passes the report of the build to the given handler once
+// the build finishes, regardless of whether build reports are written.
+func withReportHandler(handler func(report stream.BuildReport)) buildOption {
+	return func(cfg *buildConfig) {
+		cfg.reportHandler = handler
+	}
+}
+
+// withReport collects the outcome of the build into the given report.
+func withReport(report *buildReport) buildOption {
+	return func(cfg *buildConfig) {
+		cfg.report = report
+	}
+}
+
+// buildReport collects the outcome of a build: the added and skipped versions,
+// created delta files, and failed operations, which do not prevent the build
+// from finishing. The outcome is written to the build report, and the failures
+// are sent to the notifiers.
+type buildReport struct {
+	mu       sync.Mutex
+	failures []notify.Failure
+	skipped  []notify.Failure
+	streams  map[string]*stream.StreamReport
+}
+
+// stream returns the report of the stream with the given name. The caller must
+// hold the lock.
+func (r *buildReport) stream(streamName string) *stream.StreamReport {
+	if r.streams == nil {
+		r.streams = make(map[string]*stream.StreamReport)
+	}
+
+	s, ok := r.streams[streamName]
+	if !ok {
+		s = &stream.StreamReport{
+			Name:    streamName,
+			Added:   []stream.ReportEntry{},
+			Skipped: []stream.ReportEntry{},
+			Deltas:  []stream.ReportEntry{},
+			Errors:  []stream.ReportEntry{},
 		}
+
+		r.streams[streamName] = s
 	}
 
-	// Wait for all goroutines to finish.
-	wg.Wait()
+	return s
+}
 
-	return catalog, nil
+// add records the failed operation with the given failure key (see
+// stream.FailureKey) on the product within the stream.
+func (r *buildReport) add(streamName string, id string, key string, cause error) {
+	if r == nil {
+		return
+	}
+
+	versionName, itemName, _ := strings.Cut(key, "/")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.failures = append(r.failures, notify.Failure{
+		Stream:  streamName,
+		Product: id,
+		Version: versionName,
+		Item:    itemName,
+		Error:   cause.Error(),
+	})
+
+	s := r.stream(streamName)
+	s.Errors = append(s.Errors, stream.ReportEntry{Product: id, Version: versionName, Item: itemName, Error: cause.Error()})
+}
+
+// skip records the product version that was skipped for the given reason (see
+// stream.SkipReasonIncomplete). Only the versions with an invalid image config
+// are sent to the notifiers, as incomplete versions are usually still being
+// uploaded, and checksum mismatches are reported as failures.
+func (r *buildReport) skip(streamName string, id string, versionName string, reason string, cause error) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if reason == stream.SkipReasonInvalidConfig {
+		r.skipped = append(r.skipped, notify.Failure{
+			Stream:  streamName,
+			Product: id,
+			Version: versionName,
+			Error:   cause.Error(),
+		})
+	}
+
+	s := r.stream(streamName)
+	s.Skipped = append(s.Skipped, stream.ReportEntry{Product: id, Version: versionName, Reason: reason, Error: cause.Error()})
+}
+
+// addVersion records the version added to the product catalog.
+func (r *buildReport) addVersion(streamName string, id string, versionName string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.stream(streamName)
+	s.Added = append(s.Added, stream.ReportEntry{Product: id, Version: versionName})
+}
+
+// addDelta records the delta file created for the version. Base version is
+// empty for the zsync control files.
+func (r *buildReport) addDelta(streamName string, id string, versionName string, itemName string, baseVersion string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.stream(streamName)
+	s.Deltas = append(s.Deltas, stream.ReportEntry{Product: id, Version: versionName, Item: itemName, Base: baseVersion})
+}
+
+// finishStream records the duration and the error of the stream build.
+func (r *buildReport) finishStream(streamName string, duration time.Duration, err error) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.stream(streamName)
+	s.Duration = duration.Seconds()
+	if err != nil {
+		s.Error = err.Error()
+	}
+}
+
+// summary returns the report of the build that started and finished at the
+// given times.
+func (r *buildReport) summary(streamVersion string, startedAt time.Time, finishedAt time.Time, buildErr error) stream.BuildReport {
+	r.mu.Lock()
+	report := stream.BuildReport{
+		StreamVersion: streamVersion,
+		StartedAt:     startedAt.UTC(),
+		FinishedAt:    finishedAt.UTC(),
+		Duration:      finishedAt.Sub(startedAt).Seconds(),
+		Streams:       make([]stream.StreamReport, 0, len(r.streams)),
+	}
+
+	for _, s := range r.streams {
+		report.Streams = append(report.Streams, *s)
+	}
+	r.mu.Unlock()
+
+	if buildErr != nil {
+		report.Error = buildErr.Error()
+	}
+
+	report.Sort()
+
+	return report
+}
+
+// writeBuildReport writes the report of the build, and removes all but the
+// given number of the latest reports.
+func writeBuildReport(b storage.Backend, report stream.BuildReport, retain int) {
+	reportPath, err := stream.WriteBuildReport(b, report)
+	if err != nil {
+		slog.Warn("Failed to write build report", "error", err)
+		return
+	}
+
+	slog.Debug("Wrote build report", "path", reportPath)
+
+	err = stream.PruneBuildReports(b, report.StreamVersion, retain)
+	if err != nil {
+		slog.Warn("Failed to prune build reports", "error", err)
+	}
+}
+
+// notify sends the summary of the build to the notifier if the build failed,
+// any of its operations failed, or any version was skipped. Interrupted builds are not reported.
+func (r *buildReport) notify(ctx context.Context, notifier notify.Notifier, streamVersion string, buildErr error) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	r.mu.Lock()
+	summary := notify.Summary{
+		StreamVersion: streamVersion,
+		Failures:      slices.Clone(r.failures),
+		Skipped:       slices.Clone(r.skipped),
+	}
+	r.mu.Unlock()
+
+	if buildErr != nil {
+		summary.Error = buildErr.Error()
+	}
+
+	if summary.Error == "" && len(summary.Failures) == 0 && len(summary.Skipped) == 0 {
+		return
+	}
+
+	compareFailures := func(a notify.Failure, b notify.Failure) int {
+		return cmp.Or(
+			cmp.Compare(a.Stream, b.Stream),
+			cmp.Compare(a.Product, b.Product),
+			cmp.Compare(a.Version, b.Version),
+			cmp.Compare(a.Item, b.Item),
+		)
+	}
+
+	slices.SortStableFunc(summary.Failures, compareFailures)
+	slices.SortStableFunc(summary.Skipped, compareFailures)
+
+	ctx, cancel := context.WithTimeout(ctx, notifyTimeout)
+	defer cancel()
+
+	err := notifier.Notify(ctx, summary)
+	if err != nil {
+		slog.Warn("Failed to send build notification", "error", err)
+		return
+	}
+
+	slog.Info("Sent build notification", "failures", len(summary.Failures), "skipped", len(summary.Skipped))
+}
+
+// replace struct holds the path of the local file that is published under
+// the new path (relative to the root directory).
+type replace struct {
+	OldPath string
+	NewPath string
+}
+
+// buildRoots builds the index of each of the given root directories. Roots are
+// built concurrently and share a single pool of workers, which limits the
+// number of concurrent operations across all builds. If reportFile is set,
+// the combined report of the builds is written to it.
+func buildRoots(ctx context.Context, rootDirs []string, streamVersion string, streamNames []string, workers int, buildWebpage bool, reportFile string, opts ...buildOption) error {
+	cfg := newBuildConfig(opts...)
+
+	workerPool := newWorkerPool(ctx, workers, cfg.maxWorkers)
+	defer workerPool.Close()
+
+	var mutex sync.Mutex
+	combined := stream.CombinedBuildReport{
+		StartedAt: clock.FromContext(ctx).Now().UTC(),
+		Builds:    make([]stream.BuildReport, 0, len(rootDirs)),
+	}
+
+	errs := make([]error, len(rootDirs))
+
+	var wg sync.WaitGroup
+	for i, rootDir := range rootDirs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			addReport := func(report stream.BuildReport) {
+				report.Root = rootDir
+
+				mutex.Lock()
+				combined.Builds = append(combined.Builds, report)
+				mutex.Unlock()
+			}
+
+			err := buildIndex(ctx, rootDir, streamVersion, streamNames, workers, buildWebpage, append(slices.Clip(opts), withWorkerPool(workerPool), withReportHandler(addReport))...)
+			if err != nil && len(rootDirs) > 1 {
+				err = fmt.Errorf("Root %q: %w", rootDir, err)
+			}
+
+			errs[i] = err
+		}()
+	}
+
+	wg.Wait()
+
+	err := errors.Join(errs...)
+
+	if reportFile != "" {
+		combined.FinishedAt = clock.FromContext(ctx).Now().UTC()
+		combined.Duration = combined.FinishedAt.Sub(combined.StartedAt).Seconds()
+		if err != nil {
+			combined.Error = err.Error()
+		}
+
+		combined.Sort()
+
+		writeErr := shared.WriteJSONFile(reportFile, combined)
+		if writeErr != nil {
+			return errors.Join(err, fmt.Errorf("Failed to write combined build report: %w", writeErr))
+		}
+	}
+
+	return err
+}
+
+// newWorkerPool returns a pool of the given number of workers. If the number
+// of workers is not set, it is tuned automatically up to maxWorkers based on
+// the measured throughput.
+func newWorkerPool(ctx context.Context, workers int, maxWorkers int) *pool.Pool {
+	if workers > 0 {
+		return pool.New(ctx, workers)
+	}
+
+	return pool.NewAdaptive(ctx, maxWorkers, 0)
+}
+
+func buildIndex(ctx context.Context, rootDir string, streamVersion string, streamNames []string, workers int, buildWebpage bool, opts ...buildOption) (err error) {
+	cfg := newBuildConfig(opts...)
+
+	if len(streamNames) > 1 && buildWebpage {
+		return fmt.Errorf("Building index.html is supported only for a single stream")
+	}
+
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return err
+	}
+
+	// Hold the streams lock for the whole build, so that concurrent
+	// builds do not interleave replaces of the catalog and index files.
+	unlock, err := lockStreams(ctx, b, cfg.lockTimeout)
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	conf, err := config.Load(rootDir)
+	if err != nil {
+		return err
+	}
+
+	// Write the report and send the summary of the failed operations once
+	// the build finishes.
+	report := &buildReport{}
+	opts = append(slices.Clip(opts), withReport(report))
+
+	startedAt := clock.FromContext(ctx).Now()
+
+	defer func() {
+		summary := report.summary(streamVersion, startedAt, clock.FromContext(ctx).Now(), err)
+
+		if cfg.buildReports > 0 {
+			writeBuildReport(b, summary, cfg.buildReports)
+		}
+
+		if cfg.reportHandler != nil {
+			cfg.reportHandler(summary)
+		}
+	}()
+
+	notifier := notify.New(conf.Notifications)
+	if notifier != nil {
+		defer func() {
+			report.notify(ctx, notifier, streamVersion, err)
+		}()
+	}
+
+	// Streams included in any entry are published only as part of the
+	// entries.
+	entryStreams := make(map[string]bool)
+	for _, entry := range conf.Entries {
+		if slices.Contains(streamNames, entry.Name) {
+			return fmt.Errorf("Entry %q has the same name as a stream", entry.Name)
+		}
+
+		for _, streamName := range entry.Streams {
+			entryStreams[streamName] = true
+		}
+	}
+
+	// Files are written to a temporary directory first, and published
+	// only once all of them are ready.
+	tempDir, cleanup, err := storage.TempDir(b)
+	if err != nil {
+		return fmt.Errorf("Create temporary directory: %w", err)
+	}
+
+	defer cleanup()
+
+	var indexHTML *webpage.WebPage
+	var replaces []replace
+	index := stream.NewStreamIndex()
+	metaDir := path.Join("streams", streamVersion)
+
+	// Content IDs of the built catalogs, which must not collide.
+	contentIDs := make(map[string]string, len(streamNames))
+
+	// Errors of the streams that failed to build.
+	var failures []error
+
+	// Local paths of the product catalog files of the successfully built
+	// streams, from which the entries are composed.
+	builtPaths := make(map[string]string, len(streamNames))
+
+	// Create product catalogs by reading image directories.
+	for _, streamName := range streamNames {
+		catalogPath := path.Join(metaDir, fmt.Sprintf("%s.json", streamName))
+
+		// Streams that are not reached before the build is interrupted
+		// are not built.
+		var catalog *stream.ProductCatalog
+		var page *webpage.WebPage
+		var streamReplaces []replace
+
+		err := ctx.Err()
+		if err == nil {
+			start := time.Now()
+			catalog, page, streamReplaces, err = buildStreamCatalog(ctx, rootDir, streamVersion, streamName, workers, tempDir, buildWebpage, cfg, opts...)
+			report.finishStream(streamName, time.Since(start), err)
+		}
+
+		if err != nil {
+			interrupted := ctx.Err() != nil
+			if !cfg.continueOnErr && !interrupted {
+				return err
+			}
+
+			buildErr := fmt.Errorf("Stream %q: %w", streamName, err)
+			if !interrupted {
+				failures = append(failures, buildErr)
+				metrics.BuildFailures.Inc(streamName)
+			}
+
+			// Keep the previously published product catalog of the
+			// failed stream, so that the remaining streams can still
+			// be published.
+			catalog, err = storage.ReadJSONFile(b, catalogPath, &stream.ProductCatalog{})
+			if err != nil {
+				if !errors.Is(err, fs.ErrNotExist) {
+					return fmt.Errorf("Failed to read previous product catalog %q: %w", streamName, err)
+				}
+
+				if interrupted {
+					slog.Warn("Build interrupted, stream is not published", "streamName", streamName)
+				} else {
+					slog.Error("Failed to build product catalog, stream is not published", "streamName", streamName, "error", buildErr)
+				}
+
+				continue
+			}
+
+			if interrupted {
+				slog.Warn("Build interrupted, keeping the previous product catalog", "streamName", streamName)
+			} else {
+				slog.Error("Failed to build product catalog, keeping the previous one", "streamName", streamName, "error", buildErr)
+			}
+		} else {
+			builtPaths[streamName] = filepath.Join(tempDir, fmt.Sprintf("%s.json", streamName))
+		}
+
+		if page != nil {
+			indexHTML = page
+		}
+
+		replaces = append(replaces, streamReplaces...)
+
+		if entryStreams[streamName] {
+			continue
+		}
+
+		other, ok := contentIDs[catalog.ContentID]
+		if ok {
+			return fmt.Errorf("Streams %q and %q have the same content ID %q", other, streamName, catalog.ContentID)
+		}
+
+		contentIDs[catalog.ContentID] = streamName
+
+		// Add index entry.
+		index.AddEntryAt(streamName, catalogPath, *catalog, clock.FromContext(ctx).Now())
+	}
+
+	// Processed versions are published even if the build is interrupted,
+	// which requires the context for signing the remaining files.
+	flushCtx, cancel := flushContext(ctx)
+	defer cancel()
+
+	// Create product catalogs of the entries from the stream catalogs.
+	for _, entry := range conf.Entries {
+		catalogPath := path.Join(metaDir, fmt.Sprintf("%s.json", entry.Name))
+		catalogPathTemp := filepath.Join(tempDir, fmt.Sprintf("%s.json", entry.Name))
+
+		catalog, err := buildEntryCatalog(b, streamVersion, entry, builtPaths)
+		if err != nil {
+			return fmt.Errorf("Entry %q: %w", entry.Name, err)
+		}
+
+		err = catalog.Validate()
+		if err != nil {
+			return fmt.Errorf("Invalid product catalog %q: %w", entry.Name, err)
+		}
+
+		other, ok := contentIDs[catalog.ContentID]
+		if ok {
+			return fmt.Errorf("Streams %q and %q have the same content ID %q", other, entry.Name, catalog.ContentID)
+		}
+
+		contentIDs[catalog.ContentID] = entry.Name
+
+		err = writeCatalogFile(catalogPathTemp, catalog)
+		if err != nil {
+			return fmt.Errorf("Write product catalog file: %w", err)
+		}
+
+		entryReplaces, err := catalogReplaces(flushCtx, cfg, catalogPathTemp, catalogPath)
+		if err != nil {
+			return err
+		}
+
+		replaces = append(replaces, entryReplaces...)
+		index.AddEntryAt(entry.Name, catalogPath, *catalog, clock.FromContext(ctx).Now())
+	}
+
+	// Ensure index is valid before publishing it.
+	err = index.Validate()
+	if err != nil {
+		return fmt.Errorf("Invalid index: %w", err)
+	}
+
+	// Write index to a temporary file.
+	indexPath := path.Join(metaDir, "index.json")
+	indexPathTemp := filepath.Join(tempDir, "index.json")
+
+	err = shared.WriteJSONFile(indexPathTemp, index)
+	if err != nil {
+		return fmt.Errorf("Write index file: %w", err)
+	}
+
+	// Create compressed version of the index file.
+	indexGzPath := fmt.Sprintf("%s.gz", indexPath)
+	indexGzPathTemp := fmt.Sprintf("%s.gz", indexPathTemp)
+
+	err = shared.GZipFile(indexPathTemp, indexGzPathTemp)
+	if err != nil {
+		return fmt.Errorf("Compress index file: %w", err)
+	}
+
+	// Add replaces for temporary files. Note that index file must
+	// be updated last, once all catalog files are in place, to
+	// avoid referencing non-existing products (from catalog).
+	replaces = append(replaces,
+		replace{OldPath: indexPathTemp, NewPath: indexPath},
+		replace{OldPath: indexGzPathTemp, NewPath: indexGzPath},
+	)
+
+	// Sign index file.
+	if cfg.signer != nil {
+		signReplaces, err := signFile(flushCtx, cfg.signer, indexPathTemp, indexPath)
+		if err != nil {
+			return fmt.Errorf("Sign index file: %w", err)
+		}
+
+		replaces = append(replaces, signReplaces...)
+	}
+
+	// Keep a copy of the currently published metadata files, so that
+	// they can be restored if the new ones turn out to be broken.
+	if cfg.snapshots > 0 {
+		snapshot, err := stream.CreateSnapshot(b, streamVersion, clock.FromContext(ctx).Now())
+		if err != nil {
+			return fmt.Errorf("Create snapshot: %w", err)
+		}
+
+		if snapshot != nil {
+			slog.Debug("Created snapshot of published metadata files", "snapshot", snapshot.ID)
+		}
+
+		err = stream.PruneSnapshots(b, streamVersion, cfg.snapshots)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Move temporary files to final destinations.
+	for _, r := range replaces {
+		err := storage.Publish(b, r.OldPath, r.NewPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Write stream's index.html.
+	if indexHTML != nil {
+		err := indexHTML.Write(rootDir)
+		if err != nil {
+			return fmt.Errorf("Failed to write index.html: %w", err)
+		}
+	}
+
+	// Write directory listings.
+	if cfg.dirIndex {
+		err := stream.WriteDirIndexes(rootDir)
+		if err != nil {
+			return fmt.Errorf("Failed to write directory listings: %w", err)
+		}
+	}
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("Build interrupted, only the processed versions were published: %w", ctx.Err())
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("Failed to build %d of %d streams: %w", len(failures), len(streamNames), errors.Join(failures...))
+	}
+
+	return nil
+}
+
+// buildStreamCatalog builds the product catalog of the given stream and
+// writes it, along with its compressed and signed variants, into the
+// temporary directory. Returned replaces publish the written files. If
+// buildWebpage is true, the web page of the stream is returned as well.
+func buildStreamCatalog(ctx context.Context, rootDir string, streamVersion string, streamName string, workers int, tempDir string, buildWebpage bool, cfg *buildConfig, opts ...buildOption) (*stream.ProductCatalog, *webpage.WebPage, []replace, error) {
+	catalogPath := path.Join("streams", streamVersion, fmt.Sprintf("%s.json", streamName))
+	catalogPathTemp := filepath.Join(tempDir, fmt.Sprintf("%s.json", streamName))
+
+	var catalog *stream.ProductCatalog
+	var indexHTML *webpage.WebPage
+	var err error
+
+	if cfg.lowMemory {
+		// Create product catalog from directory structure and write
+		// each product to the catalog file as soon as it is processed.
+		catalog, indexHTML, err = writeProductCatalog(ctx, rootDir, streamVersion, streamName, workers, catalogPathTemp, buildWebpage, opts...)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	} else {
+		// Create product catalog from directory structure.
+		catalog, err = buildProductCatalog(ctx, rootDir, streamVersion, streamName, workers, opts...)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		// Ensure product catalog is valid before publishing it.
+		err = catalog.Validate()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("Invalid product catalog %q: %w", streamName, err)
+		}
+
+		err = writeCatalogFile(catalogPathTemp, catalog)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("Write product catalog file: %w", err)
+		}
+
+		// Create webpage for the stream.
+		if buildWebpage {
+			indexHTML = webpage.NewWebPage(streamName, *catalog)
+		}
+	}
+
+	// Catalog of the interrupted build is signed as well.
+	flushCtx, cancel := flushContext(ctx)
+	defer cancel()
+
+	replaces, err := catalogReplaces(flushCtx, cfg, catalogPathTemp, catalogPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return catalog, indexHTML, replaces, nil
+}
+
+// catalogReplaces creates the compressed and signed variants of the product
+// catalog file written to the temporary path, and returns the replaces that
+// publish all of them on the given path.
+func catalogReplaces(ctx context.Context, cfg *buildConfig, catalogPathTemp string, catalogPath string) ([]replace, error) {
+	// Create compressed version of the product catalog file.
+	catalogGzPath := fmt.Sprintf("%s.gz", catalogPath)
+	catalogGzPathTemp := fmt.Sprintf("%s.gz", catalogPathTemp)
+
+	err := shared.GZipFile(catalogPathTemp, catalogGzPathTemp)
+	if err != nil {
+		return nil, fmt.Errorf("Compress product catalog file: %w", err)
+	}
+
+	// Add replaces for temporary files.
+	replaces := []replace{
+		{OldPath: catalogPathTemp, NewPath: catalogPath},
+		{OldPath: catalogGzPathTemp, NewPath: catalogGzPath},
+	}
+
+	// Sign product catalog file.
+	if cfg.signer != nil {
+		signReplaces, err := signFile(ctx, cfg.signer, catalogPathTemp, catalogPath)
+		if err != nil {
+			return nil, fmt.Errorf("Sign product catalog file: %w", err)
+		}
+
+		replaces = append(replaces, signReplaces...)
+	}
+
+	return replaces, nil
+}
+
+// buildEntryCatalog composes the product catalog of the given index entry from
+// the product catalogs of its streams. Catalogs of the streams built within
+// the current build are read from the given local paths, while the published
+// catalogs are used for the other streams.
+func buildEntryCatalog(b storage.Backend, streamVersion string, entry config.EntryConfig, builtPaths map[string]string) (*stream.ProductCatalog, error) {
+	products := make(map[string]stream.Product)
+
+	// Streams from which the products are included.
+	sources := make(map[string]string)
+
+	for _, streamName := range entry.Streams {
+		var catalog *stream.ProductCatalog
+		var err error
+
+		localPath, ok := builtPaths[streamName]
+		if ok {
+			catalog, err = shared.ReadJSONFile(localPath, &stream.ProductCatalog{})
+		} else {
+			catalogPath := path.Join("streams", streamVersion, fmt.Sprintf("%s.json", streamName))
+			catalog, err = storage.ReadJSONFile(b, catalogPath, &stream.ProductCatalog{})
+			if errors.Is(err, fs.ErrNotExist) {
+				slog.Warn("Product catalog not found, stream is not included in the entry", "entry", entry.Name, "streamName", streamName)
+				continue
+			}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read product catalog %q: %w", streamName, err)
+		}
+
+		for id, product := range catalog.Products {
+			if !entry.Includes(id) {
+				continue
+			}
+
+			other, ok := sources[id]
+			if ok {
+				return nil, fmt.Errorf("Product %q is included from both streams %q and %q", id, other, streamName)
+			}
+
+			sources[id] = streamName
+			products[id] = product
+		}
+	}
+
+	catalog := stream.NewCatalog(entry.CatalogContentID(), products)
+	catalog.DataType = entry.CatalogDataType()
+
+	return catalog, nil
+}
+
+// defaultSnapshots is the default number of snapshots of the previously
+// published metadata files kept by the build.
+const defaultSnapshots = 3
+
+// defaultBuildReports is the default number of the latest build reports kept
+// by the build.
+const defaultBuildReports = 10
+
+// defaultLockTimeout is the default maximum time to wait for the streams lock.
+const defaultLockTimeout = 10 * time.Minute
+
+// defaultUploadSentinel is the default name of the file that marks the upload
+// of the product version in progress.
+const defaultUploadSentinel = ".upload-in-progress"
+
+// notifyTimeout is the maximum time to send the summary of a failed build.
+const notifyTimeout = time.Minute
+
+// flushTimeout is the maximum time to publish the processed versions once the
+// build is interrupted.
+const flushTimeout = time.Minute
+
+// flushContext returns the context for publishing the processed versions. If
+// the build is interrupted, the returned context is detached from the given
+// one and expires after flushTimeout. Otherwise, the given context is returned.
+func flushContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx.Err() == nil {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(context.WithoutCancel(ctx), flushTimeout)
+}
+
+// lockStreams acquires the advisory lock "streams/.lock", which is held by
+// every command that publishes the index or product catalog files. If the
+// lock is held by another process, it waits for at most the given timeout.
+// Backends that do not support locking are used without the lock. The
+// returned function releases the lock.
+func lockStreams(ctx context.Context, b storage.Backend, timeout time.Duration) (func(), error) {
+	unlock, err := storage.Lock(ctx, b, path.Join("streams", ".lock"), timeout)
+	if err != nil {
+		if errors.Is(err, storage.ErrLockNotSupported) {
+			slog.Warn("Storage backend does not support locking, concurrent builds are not prevented")
+			return func() {}, nil
+		}
+
+		return nil, fmt.Errorf("Failed to acquire streams lock: %w", err)
+	}
+
+	return unlock, nil
+}
+
+// signFile creates the clear-signed file and the detached signature for the
+// temporary file that is going to replace the JSON file on the given path.
+// Signed files are written to temporary files in the same directory as the
+// signed temporary file, and the replaces for them are returned.
+func signFile(ctx context.Context, signer *stream.Signer, tempPath string, path string) ([]replace, error) {
+	clearSignedPath, detachedPath := stream.SignedPaths(path)
+
+	files := []struct {
+		path string
+		sign func(ctx context.Context, srcPath string, dstPath string) error
+	}{
+		{path: clearSignedPath, sign: signer.ClearSign},
+		{path: detachedPath, sign: signer.DetachSign},
+	}
+
+	replaces := make([]replace, 0, len(files))
+
+	for _, f := range files {
+		signedPathTemp := filepath.Join(filepath.Dir(tempPath), filepath.Base(f.path))
+
+		err := f.sign(ctx, tempPath, signedPathTemp)
+		if err != nil {
+			for _, r := range replaces {
+				_ = os.Remove(r.OldPath)
+			}
+
+			return nil, err
+		}
+
+		replaces = append(replaces, replace{OldPath: signedPathTemp, NewPath: f.path})
+	}
+
+	return replaces, nil
+}
+
+// buildProductCatalog compares the existing product catalog and actual products on
+// the disk. For missing any new version, hashes are calculated and compared against
+// the checksums file. Based on the final catalog (that contains only valid version)
+// missing delta files are generated. Finally the catalog is returned.
+//
+// Note: Workers limit the maximum number of concurent tasks when calulcating hashes
+// and delta files. If workers is not positive, the number of concurrent tasks is
+// tuned automatically based on the measured throughput.
+func buildProductCatalog(ctx context.Context, rootDir string, streamVersion string, streamName string, workers int, opts ...buildOption) (*stream.ProductCatalog, error) {
+	cfg := newBuildConfig(opts...)
+
+	start := time.Now()
+	defer func() {
+		metrics.BuildDuration.Observe(time.Since(start).Seconds(), streamName)
+	}()
+
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Delta files are created within the temporary directory.
+	tempDir, cleanup, err := storage.TempDir(b)
+	if err != nil {
+		return nil, fmt.Errorf("Create temporary directory: %w", err)
+	}
+
+	defer cleanup()
+
+	conf, err := config.Load(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &catalogBuilder{
+		ctx:           ctx,
+		b:             b,
+		rootDir:       rootDir,
+		streamVersion: streamVersion,
+		streamName:    streamName,
+		tempDir:       tempDir,
+		cfg:           cfg,
+		conf:          conf,
+		now:           clock.FromContext(ctx).Now(),
+	}
+
+	err = c.readCatalog()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.catalogVersions != nil {
+		defer c.catalogVersions.close()
+	}
+
+	err = c.readProducts()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.strict && len(c.invalidConfigs) > 0 {
+		return nil, fmt.Errorf("Invalid image configs: %w", errors.Join(c.invalidConfigs...))
+	}
+
+	if cfg.partial() {
+		slog.Info("Building only the selected products", "streamName", streamName, "products", len(c.products))
+	}
+
+	c.applyAliases()
+
+	// Products processed one at a time are refreshed once their versions
+	// are read.
+	if cfg.productWriter == nil {
+		for id := range c.products {
+			c.refreshProduct(id)
+		}
+	}
+
+	// Load the hash cache to skip hash calculation for unchanged files.
+	if !cfg.noCache {
+		hashCachePath := stream.HashCachePath(streamVersion, streamName)
+
+		c.hashCache, err = stream.LoadHashCache(rootDir, hashCachePath)
+		if err != nil {
+			return nil, err
+		}
+
+		defer func() {
+			err := c.hashCache.Save(rootDir)
+			if err != nil {
+				slog.Warn("Failed to save hash cache", "streamName", streamName, "error", err)
+			}
+		}()
+	}
+
+	// Load the times when the product versions were first published, so
+	// that the publish times of the new versions can be recorded.
+	c.published, err = stream.ReadPublishedTimes(b, streamVersion, streamName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Load the failed attempts of the previous builds, so that operations
+	// that keep failing are attempted again with a backoff.
+	if cfg.retry.Enabled() {
+		c.failures, err = stream.ReadFailures(b, streamVersion, streamName)
+		if err != nil {
+			return nil, err
+		}
+
+		// Products that are not built in a partial build keep
+		// their failed attempts.
+		if !cfg.partial() {
+			c.failuresChanged = c.failures.Retain(c.products)
+		}
+	}
+
+	// Use the shared pool of workers, or create a new one.
+	sharedPool := cfg.workerPool
+	if sharedPool == nil {
+		sharedPool = newWorkerPool(ctx, workers, cfg.maxWorkers)
+		defer sharedPool.Close()
+	}
+
+	// Jobs of the catalog are waited for separately from the jobs of
+	// other builds sharing the pool.
+	c.workerPool = sharedPool.Group()
+	defer c.workerPool.Wait()
+
+	// Limit the number of delta files created concurrently. Delta jobs
+	// wait for the free slot while occupying the worker.
+	if cfg.deltaWorkers > 0 {
+		c.deltaSlots = make(chan struct{}, cfg.deltaWorkers)
+	}
+
+	// Extract new (unreferenced products and product versions).
+	_, newProducts := diffProducts(c.catalog.Products, c.products)
+
+	if cfg.productWriter == nil {
+		c.buildProducts(newProducts)
+	} else {
+		err = c.writeProducts(newProducts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = c.finish()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.catalog, nil
+}
+
+// catalogBuilder builds the product catalog of a single stream (see
+// buildProductCatalog). Jobs verifying the new versions and creating delta
+// files run in the worker pool and update the catalog under the mutex.
+type catalogBuilder struct {
+	ctx           context.Context
+	b             storage.Backend
+	rootDir       string
+	streamVersion string
+	streamName    string
+	tempDir       string
+	cfg           *buildConfig
+	conf          *config.Config
+
+	// now is the time at which the new versions are published.
+	now time.Time
+
+	// catalog is the product catalog being built. When products are
+	// processed one at a time, it holds only the outlines of the products
+	// that are not being processed, and their versions are read using
+	// catalogVersions.
+	catalog         *stream.ProductCatalog
+	catalogVersions *catalogVersionReader
+
+	// products are the products read from the disk.
+	products map[string]stream.Product
+
+	// invalidConfigs are the errors of the invalid image configs, which
+	// fail the strict build.
+	invalidConfigs []error
+
+	hashCache *stream.HashCache
+
+	// published are the times when the product versions were first
+	// published, and publishedChanged indicates whether the times of any
+	// new versions were recorded. Added is the number of versions added to
+	// the catalog within this build.
+	published        stream.PublishedTimes
+	publishedChanged bool
+	added            int
+
+	// failures are the failed attempts of the operations, which are nil if
+	// the failed operations are not retried with a backoff.
+	failures        stream.Failures
+	failuresChanged bool
+
+	mutex          sync.Mutex // To safely update the catalog.Products map
+	checksumMutex  sync.Mutex // To safely append to the checksums files
+	smokeTestMutex sync.Mutex // To launch one smoke test instance at a time
+
+	workerPool *pool.Group
+
+	// deltaSlots limit the number of delta files created concurrently, and
+	// deltaDeferred ensures the deferred delta files are reported once.
+	deltaSlots    chan struct{}
+	deltaDeferred sync.Once
+}
+
+// readCatalog reads the existing product catalog. When products are processed
+// one at a time, only the outlines of the products are read upfront, and their
+// versions are read once the product is processed.
+func (c *catalogBuilder) readCatalog() error {
+	catalogPath := path.Join("streams", c.streamVersion, fmt.Sprintf("%s.json", c.streamName))
+
+	var catalog *stream.ProductCatalog
+	var err error
+
+	if c.cfg.productWriter == nil {
+		catalog, err = storage.ReadJSONFile(c.b, catalogPath, &stream.ProductCatalog{})
+	} else {
+		catalog, err = readCatalogOutline(c.b, catalogPath)
+		c.catalogVersions = &catalogVersionReader{b: c.b, path: catalogPath}
+	}
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if catalog == nil {
+		catalog = stream.NewCatalog(c.streamName, nil)
+	}
+
+	// Content ID and data type may change through the config.
+	catalog.ContentID = c.conf.ContentID(c.streamName)
+	catalog.DataType = c.conf.DataType(c.streamName)
+
+	c.catalog = catalog
+	return nil
+}
+
+// readProducts reads the products from the directory hierarchy. When products
+// are processed one at a time, products are read one at a time and only their
+// outlines are retained. Items of the new versions are read once they are
+// processed.
+func (c *catalogBuilder) readProducts() error {
+	productOpts := []stream.Option{
+		stream.WithRequirementDefaults(c.conf.Requirements),
+		stream.WithPathSchema(c.cfg.pathSchema),
+		stream.WithProductFilter(c.cfg.selectsProduct),
+		stream.WithSkippedVersions(c.skipVersion),
+		c.cfg.uploadGuard,
+	}
+
+	if c.cfg.productWriter == nil {
+		products, err := stream.GetProducts(c.ctx, c.rootDir, c.streamName, productOpts...)
+		if err != nil {
+			return err
+		}
+
+		for id, p := range products {
+			p, ok := c.prepareProduct(id, p)
+			if !ok {
+				delete(products, id)
+				continue
+			}
+
+			products[id] = p
+		}
+
+		c.products = products
+		return nil
+	}
+
+	productRelPaths, err := stream.ListProducts(c.ctx, c.rootDir, c.streamName, productOpts...)
+	if err != nil {
+		return err
+	}
+
+	c.products = make(map[string]stream.Product, len(productRelPaths))
+
+	for _, relPath := range productRelPaths {
+		err := c.ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		p, err := stream.GetProduct(c.ctx, c.rootDir, relPath, productOpts...)
+		if err != nil {
+			if errors.Is(err, stream.ErrProductInvalidPath) {
+				// Ignore invalid product paths.
+				continue
+			}
+
+			return err
+		}
+
+		// Skip products with no versions (empty products).
+		if len(p.Versions) == 0 {
+			continue
+		}
+
+		product, ok := c.prepareProduct(p.ID(), *p)
+		if ok {
+			c.products[p.ID()] = productOutline(product)
+		}
+	}
+
+	return nil
+}
+
+// skipVersion reports the product version that is skipped while reading the
+// products. Versions with an invalid image config are skipped, so that they
+// do not prevent the remaining versions from being published.
+func (c *catalogBuilder) skipVersion(id string, versionName string, err error) {
+	if c.cfg.version != "" && versionName != c.cfg.version {
+		return
+	}
+
+	if errors.Is(err, stream.ErrVersionIncomplete) {
+		c.cfg.report.skip(c.streamName, id, versionName, stream.SkipReasonIncomplete, err)
+		return
+	}
+
+	slog.Warn("Skipping product version with invalid image config", "streamName", c.streamName, "product", id, "version", versionName, "error", err)
+	c.cfg.report.skip(c.streamName, id, versionName, stream.SkipReasonInvalidConfig, err)
+	c.invalidConfigs = append(c.invalidConfigs, fmt.Errorf("Product %q version %q: %w", id, versionName, err))
+}
+
+// prepareProduct retains only the selected version of the product read from
+// the disk, so that other versions are neither added to the catalog nor affect
+// the failed attempts, and reports the warnings of its image configs. False is
+// returned if the product is not built.
+func (c *catalogBuilder) prepareProduct(id string, p stream.Product) (stream.Product, bool) {
+	if c.cfg.version != "" {
+		version, ok := p.Versions[c.cfg.version]
+		if !ok {
+			return p, false
+		}
+
+		p.Versions = map[string]stream.Version{c.cfg.version: version}
+	}
+
+	// Report the warnings of the image configs, such as unknown fields.
+	for versionName, v := range p.Versions {
+		for _, issue := range v.ImageConfigWarnings {
+			slog.Warn("Image config has warnings", "streamName", c.streamName, "product", id, "version", versionName, "warning", issue.String())
+			c.invalidConfigs = append(c.invalidConfigs, fmt.Errorf("Product %q version %q: %s: %s", id, versionName, stream.FileImageConfig, issue))
+		}
+	}
+
+	return p, true
+}
+
+// applyAliases points the custom aliases at the latest releases, and ensures
+// each alias references a single product per architecture. Products of the
+// catalog that are not read from the disk (e.g. in a partial build) are
+// candidates as well, so that the aliases are shifted from them.
+func (c *catalogBuilder) applyAliases() {
+	if len(c.conf.Aliases) > 0 {
+		candidates := maps.Clone(c.catalog.Products)
+		if candidates == nil {
+			candidates = make(map[string]stream.Product, len(c.products))
+		}
+
+		maps.Copy(candidates, c.products)
+		stream.ApplyCustomAliases(candidates, c.conf.CustomAliases(), c.now)
+
+		for id, p := range candidates {
+			_, ok := c.products[id]
+			if ok {
+				c.products[id] = p
+				continue
+			}
+
+			cp := c.catalog.Products[id]
+			cp.Aliases = p.Aliases
+			c.catalog.Products[id] = cp
+		}
+	}
+
+	conflicts := stream.ResolveAliasConflicts(c.products, c.conf.Streams[c.streamName].AliasPrecedence)
+	for _, conflict := range conflicts {
+		slog.Warn("Resolved conflicting alias", "streamName", c.streamName, "alias", conflict.Alias, "architecture", conflict.Architecture, "product", conflict.Product, "excluded", strings.Join(conflict.Excluded, ","))
+	}
+}
+
+// refreshProduct refreshes requirements and aliases of the product and its
+// versions that already exist in the catalog, as the config may have changed.
+func (c *catalogBuilder) refreshProduct(id string) {
+	p, ok := c.products[id]
+	if !ok {
+		return
+	}
+
+	cp, ok := c.catalog.Products[id]
+	if !ok {
+		return
+	}
+
+	cp.Requirements = p.Requirements
+	cp.Aliases = p.Aliases
+	c.catalog.Products[id] = cp
+
+	for name, v := range cp.Versions {
+		diskVersion, ok := p.Versions[name]
+		if ok {
+			v.Requirements = diskVersion.Requirements
+			cp.Versions[name] = v
+		}
+	}
+}
+
+// buildProducts adds the new versions of all products to the catalog, and
+// once all of them are processed, creates the missing delta files. This way
+// all valid versions are known when the versions for delta files are chosen.
+func (c *catalogBuilder) buildProducts(newProducts map[string]stream.Product) {
+	for id, p := range newProducts {
+		c.addVersions(id, p)
+	}
+
+	// Wait for all workers to finish to ensure the final catalog contains
+	// all valid product versions.
+	c.workerPool.Wait()
+
+	for id, p := range newProducts {
+		// Leave out new products none of whose versions were
+		// processed before the build was interrupted.
+		if c.ctx.Err() != nil && len(c.catalog.Products[id].Versions) == 0 {
+			delete(c.catalog.Products, id)
+			continue
+		}
+
+		c.deduplicate(id, p)
+	}
+
+	for id, product := range c.catalog.Products {
+		_, ok := c.products[id]
+		if (c.cfg.partial() && !ok) || c.ctx.Err() != nil {
+			// Product is not built.
+			continue
+		}
+
+		c.addDeltas(id, product)
+	}
+
+	// Wait for all goroutines to finish.
+	c.workerPool.Wait()
+}
+
+// writeProducts processes products one at a time in the ascending order of
+// their IDs. Once the product is complete, it is passed to the product writer
+// and its versions are released to bound the memory usage.
+func (c *catalogBuilder) writeProducts(newProducts map[string]stream.Product) error {
+	productIDs := shared.MapKeys(c.catalog.Products)
+	for id := range newProducts {
+		_, ok := c.catalog.Products[id]
+		if !ok {
+			productIDs = append(productIDs, id)
+		}
+	}
+
+	slices.Sort(productIDs)
+
+	for _, id := range productIDs {
+		// Read the published versions of the product only once it is
+		// processed.
+		cp, ok := c.catalog.Products[id]
+		if ok {
+			versions, err := c.catalogVersions.versions(id)
+			if err != nil {
+				return err
+			}
+
+			cp.Versions = versions
+			c.catalog.Products[id] = cp
+			c.refreshProduct(id)
+		}
+
+		p, ok := newProducts[id]
+		if ok && c.ctx.Err() == nil {
+			c.addVersions(id, p)
+			c.workerPool.Wait()
+			c.deduplicate(id, p)
+		}
+
+		_, ok = c.products[id]
+		if (ok || !c.cfg.partial()) && c.ctx.Err() == nil {
+			c.addDeltas(id, c.catalog.Products[id])
+			c.workerPool.Wait()
+		}
+
+		// Once the build is interrupted, the remaining products are
+		// written as they were published, and the new ones are left out
+		// unless some of their versions were already processed.
+		product, ok := c.catalog.Products[id]
+		if !ok {
+			continue
+		}
+
+		if c.ctx.Err() != nil && len(product.Versions) == 0 {
+			delete(c.catalog.Products, id)
+			continue
+		}
+
+		err := c.cfg.productWriter(id, product)
+		if err != nil {
+			return err
+		}
+
+		product.Versions = nil
+		c.catalog.Products[id] = product
+	}
+
+	return nil
+}
+
+// finish writes the publish times of the new versions and the failed attempts
+// of the operations, if any of them changed.
+func (c *catalogBuilder) finish() error {
+	if c.ctx.Err() != nil {
+		slog.Warn("Build interrupted, product catalog contains only the processed versions", "streamName", c.streamName, "added", c.added)
+	}
+
+	if c.publishedChanged {
+		err := stream.WritePublishedTimes(c.b, c.streamVersion, c.streamName, c.published)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.failuresChanged {
+		err := stream.WriteFailures(c.b, c.streamVersion, c.streamName, c.failures)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deduplicate applies the duplicates action of the product policy to the new
+// versions of the product.
+func (c *catalogBuilder) deduplicate(id string, p stream.Product) {
+	action := c.conf.Policy(c.streamName, id, config.Policy{}).DuplicatesAction()
+	deduplicateVersions(c.b, c.streamName, id, c.catalog.Products[id].Versions, shared.MapKeys(p.Versions), action)
+}
+
+// checkpoint records the progress of the build, so that the hashes of the
+// processed versions are not recalculated if the build is killed.
+func (c *catalogBuilder) checkpoint() {
+	err := c.hashCache.Checkpoint(c.rootDir)
+	if err != nil {
+		slog.Warn("Failed to checkpoint hash cache", "streamName", c.streamName, "error", err)
+	}
+}
+
+// shouldAttempt returns false if the operation with the given key has failed
+// before and is not yet due to be attempted again. The file on the given path
+// is the one that is processed by the operation. If it changed since the last
+// failed attempt, the operation is attempted.
+func (c *catalogBuilder) shouldAttempt(id string, key string, filePath string) bool {
+	if c.failures == nil {
+		return true
+	}
+
+	c.mutex.Lock()
+	failure, ok := c.failures.Get(id, key)
+	c.mutex.Unlock()
+
+	if !ok || c.cfg.retry.Due(failure, c.now) {
+		return true
+	}
+
+	info, err := c.b.Stat(filePath)
+	if err == nil && !info.ModTime().Equal(failure.ModTime) {
+		return true
+	}
+
+	slog.Debug("Skipping previously failed operation", "streamName", c.streamName, "product", id, "key", key, "attempts", failure.Attempts, "error", failure.Error)
+	return false
+}
+
+// recordFailure records the failed attempt of the operation with the given
+// key.
+func (c *catalogBuilder) recordFailure(id string, key string, filePath string, cause error) {
+	c.cfg.report.add(c.streamName, id, key, cause)
+
+	if c.failures == nil {
+		return
+	}
+
+	var modTime time.Time
+
+	info, err := c.b.Stat(filePath)
+	if err == nil {
+		modTime = info.ModTime()
+	}
+
+	c.mutex.Lock()
+	failure := c.failures.Add(id, key, modTime, c.now, cause)
+	c.failuresChanged = true
+	c.mutex.Unlock()
+
+	if c.cfg.retry.Exhausted(failure) {
+		slog.Warn("Giving up on failed operation until its files change", "streamName", c.streamName, "product", id, "key", key, "attempts", failure.Attempts)
+	}
+}
+
+// clearFailure removes the failed attempts of the operation with the given key
+// once it succeeds.
+func (c *catalogBuilder) clearFailure(id string, key string) {
+	if c.failures == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	c.failuresChanged = c.failures.Remove(id, key) || c.failuresChanged
+	c.mutex.Unlock()
+}
+
+// addVersions adds the product to the catalog and schedules a job for each new
+// product version, that adds the version to the catalog once its items are
+// verified.
+func (c *catalogBuilder) addVersions(id string, p stream.Product) {
+	productPath := filepath.Join(c.streamName, c.cfg.pathSchema.ProductRelPath(p))
+
+	// Copy value of the product retrieved from the directory hierarchy
+	// to the catalog's product to ensure the potential new metadata is
+	// applied.
+	c.mutex.Lock()
+	tmp := p
+
+	_, ok := c.catalog.Products[id]
+	if ok {
+		// Retain existing product versions.
+		tmp.Versions = c.catalog.Products[id].Versions
+	} else {
+		// Create new map for product versions. They will be added
+		// in the next step.
+		tmp.Versions = make(map[string]stream.Version, len(p.Versions))
+	}
+
+	c.catalog.Products[id] = tmp
+	c.mutex.Unlock()
+
+	// Versions missing the items required by the product policy are
+	// recorded as failed, instead of being silently skipped.
+	requiredItems := c.conf.Policy(c.streamName, id, config.Policy{}).RequiredItems
+
+	for versionName := range p.Versions {
+		versionPath := filepath.Join(productPath, versionName)
+
+		if !c.shouldAttempt(id, versionName, versionPath) {
+			continue
+		}
+
+		// Add a job for processing a new version.
+		c.workerPool.Submit(func() {
+			c.addVersion(id, p, versionName, versionPath, requiredItems)
+		})
+	}
+}
+
+// addVersion reads the new product version and generates the file hashes. The
+// version is added to the catalog once its items match the checksums file and
+// it passes the smoke test.
+func (c *catalogBuilder) addVersion(id string, p stream.Product, versionName string, versionPath string, requiredItems []string) {
+	version, err := stream.GetVersion(c.ctx, c.rootDir, versionPath, stream.WithHashes(true), stream.WithHashCache(c.hashCache), stream.WithHashAlgorithms(c.cfg.checksums...), stream.WithVerifier(c.cfg.verifier), stream.WithRequiredItems(requiredItems...), c.cfg.uploadGuard)
+	if err != nil {
+		slog.Error("Failed to get version", "streamName", c.streamName, "product", id, "version", versionName, "error", err)
+		if c.ctx.Err() == nil {
+			c.recordFailure(id, versionName, versionPath, err)
+		}
+
+		return
+	}
+
+	// Verify items checksums if checksum file is present
+	// within the version.
+	if version.Checksums != nil {
+		for itemName, item := range version.Items {
+			checksum, ok := version.Checksums[itemName]
+
+			// Ignore verification, if the checksum for the delta
+			// file does not exist. This is because the delta file
+			// is generated after the checksums file is created.
+			if !ok && item.IsDelta() {
+				continue
+			}
+
+			// Verify checksum.
+			if checksum != item.Hash(version.ChecksumAlgorithm) {
+				slog.Error("Checksum mismatch", "streamName", c.streamName, "product", id, "version", versionName, "item", itemName)
+				metrics.ChecksumMismatches.Inc(c.streamName)
+				err := fmt.Errorf("Checksum mismatch of item %q", itemName)
+				c.cfg.report.skip(c.streamName, id, versionName, stream.SkipReasonChecksumMismatch, err)
+				c.recordFailure(id, versionName, versionPath, err)
+				return
+			}
+		}
+	}
+
+	// Launch the new version before it is added to the
+	// catalog, and keep it out if it fails to boot.
+	if c.conf.SmokeTest != nil && c.conf.SmokeTest.Includes(id) {
+		c.smokeTestMutex.Lock()
+		err := smokeTestVersion(c.ctx, c.b, *c.conf.SmokeTest, *version)
+		c.smokeTestMutex.Unlock()
+		if err != nil {
+			slog.Error("Smoke test failed, version is quarantined", "streamName", c.streamName, "product", id, "version", versionName, "error", err)
+			if c.ctx.Err() == nil {
+				metrics.SmokeTestFailures.Inc(c.streamName)
+				c.recordFailure(id, versionName, versionPath, fmt.Errorf("Smoke test failed: %w", err))
+			}
+
+			return
+		}
+	}
+
+	// Installed size is informative, therefore, the version
+	// is published even if it cannot be determined.
+	if c.cfg.sizer != nil {
+		err := setInstalledSizes(c.ctx, c.b, *c.cfg.sizer, version)
+		if err != nil {
+			slog.Warn("Failed to determine installed size", "streamName", c.streamName, "product", id, "version", versionName, "error", err)
+		}
+	}
+
+	if c.cfg.qcow2Info {
+		err := setQcow2Info(c.b, version)
+		if err != nil {
+			slog.Warn("Failed to read qcow2 info", "streamName", c.streamName, "product", id, "version", versionName, "error", err)
+		}
+	}
+
+	// Requirements depend on the product, therefore, they
+	// are taken from the version retrieved with it.
+	version.Requirements = p.Versions[versionName].Requirements
+
+	c.mutex.Lock()
+	c.catalog.Products[id].Versions[versionName] = *version
+	c.publishedChanged = c.published.Add(id, versionName, c.now) || c.publishedChanged
+	c.added++
+	c.mutex.Unlock()
+
+	slog.Info("New version added to the product catalog", "streamName", c.streamName, "product", id, "version", versionName)
+	metrics.VersionsAdded.Inc(c.streamName)
+	c.cfg.report.addVersion(c.streamName, id, versionName)
+	c.clearFailure(id, versionName)
+
+	c.checkpoint()
+}
+
+// deltaTarget is the item of the product version for which delta files are
+// created.
+type deltaTarget struct {
+	id             string
+	productRelPath string
+	versionName    string
+	version        stream.Version
+	itemName       string
+	item           stream.Item
+}
+
+// addDeltas iterates over product versions and finds items that are valid for
+// delta files. If a delta file already exists, it ensures that the catalog
+// contains its file hash. If a delta file does not exist, a job is scheduled
+// to create it and update the catalog with the new file hash. Delta files are
+// created in each of the configured delta formats.
+func (c *catalogBuilder) addDeltas(id string, product stream.Product) {
+	productRelPath := filepath.Join(c.streamName, c.cfg.pathSchema.ProductRelPath(product))
+	policy := c.conf.Policy(c.streamName, id, config.Policy{})
+
+	// Skip products for which delta files are disabled.
+	if !policy.DeltasEnabled() {
+		return
+	}
+
+	versions := shared.MapKeys(product.Versions)
+	slices.Sort(versions)
+
+	for i, targetVerName := range versions {
+		targetVersion := product.Versions[targetVerName]
+
+		// Delta jobs add new items to the version while the
+		// remaining items are still being iterated, therefore,
+		// items are iterated and looked up in a snapshot of the
+		// version items taken before any job is submitted.
+		c.mutex.Lock()
+		items := maps.Clone(targetVersion.Items)
+		c.mutex.Unlock()
+
+		for itemName, item := range items {
+			// Delta should be created only for qcow2, raw disk, and squashfs files.
+			if !slices.Contains([]string{stream.ItemTypeDiskKVM, stream.ItemTypeDiskRaw, stream.ItemTypeSquashfs}, item.Ftype) {
+				continue
+			}
+
+			target := deltaTarget{
+				id:             id,
+				productRelPath: productRelPath,
+				versionName:    targetVerName,
+				version:        targetVersion,
+				itemName:       itemName,
+				item:           item,
+			}
+
+			// Zsync control file depends only on the item itself,
+			// therefore, it is created for every version, even
+			// before the product is established.
+			if slices.Contains(c.cfg.deltaFormats, delta.FormatZsync) && policy.ZsyncAllowed(item.Size) {
+				zsyncName := itemName + ".zsync"
+				zsyncItem, zsyncExists := items[zsyncName]
+
+				c.workerPool.Submit(func() {
+					// Generate zsync file if it does not already exist.
+					if !zsyncExists && !c.createZsync(target, zsyncName) {
+						return
+					}
+
+					if !zsyncExists || zsyncItem.SHA256 == "" {
+						c.addDeltaItem(target, zsyncName)
+					}
+				})
+			}
+
+			// Skip the oldest version because even if the .vcdiff does
+			// not exist, we cannot generate it.
+			if i == 0 || !slices.Contains(c.cfg.deltaFormats, delta.FormatVCDiff) {
+				continue
+			}
+
+			// Skip items of products that are not yet established
+			// and items too small to benefit from delta files.
+			if !policy.DeltasAllowed(len(versions), item.Size) {
+				continue
+			}
+
+			// Create delta files against each of the previous
+			// versions within the delta depth.
+			for _, sourceVerName := range versions[max(i-c.cfg.deltaDepth, 0):i] {
+				deltaName := deltaItemName(items, itemName, item.Ftype, sourceVerName)
+				deltaItem, deltaExists := items[deltaName]
+
+				c.workerPool.Submit(func() {
+					// Generate delta file if it does not already exist.
+					if !deltaExists && !c.createDelta(target, sourceVerName, deltaName) {
+						return
+					}
+
+					// If delta file exists but is missing a hash in the catalog,
+					// or was just generated, calculate it's hash and add it to
+					// the catalog.
+					if !deltaExists || deltaItem.SHA256 == "" {
+						c.addDeltaItem(target, deltaName)
+					}
+				})
+			}
+		}
+	}
+}
+
+// createZsync creates the zsync control file with the given name for the
+// target item. False is returned if the file is not created.
+func (c *catalogBuilder) createZsync(target deltaTarget, zsyncName string) bool {
+	targetPath := path.Join(target.productRelPath, target.versionName, target.itemName)
+	outputPath := path.Join(target.productRelPath, target.versionName, zsyncName)
+	failureKey := stream.FailureKey(target.versionName, zsyncName)
+
+	if !c.shouldAttempt(target.id, failureKey, targetPath) || !c.deltaWindowOpen() {
+		return false
+	}
+
+	if !c.acquireDeltaSlot() {
+		return false
+	}
+
+	err := delta.RunWithPriority(c.cfg.deltaPriority, func() error {
+		return createZsync(c.ctx, c.b, c.tempDir, targetPath, outputPath)
+	})
+	c.releaseDeltaSlot()
+	if err != nil {
+		slog.Error("Failed creating zsync file", "streamName", c.streamName, "product", target.id, "version", target.versionName, "item", zsyncName, "error", err)
+		if c.ctx.Err() == nil {
+			c.recordFailure(target.id, failureKey, targetPath, err)
+		}
+
+		return false
+	}
+
+	slog.Info("Zsync file generated successfully", "streamName", c.streamName, "product", target.id, "version", target.versionName, "item", zsyncName)
+	metrics.DeltasGenerated.Inc(c.streamName)
+	c.cfg.report.addDelta(c.streamName, target.id, target.versionName, zsyncName, "")
+	c.clearFailure(target.id, failureKey)
+
+	return true
+}
+
+// createDelta creates the delta file with the given name from the item of the
+// source version to the target item. False is returned if the file is not
+// created.
+func (c *catalogBuilder) createDelta(target deltaTarget, sourceVerName string, deltaName string) bool {
+	sourcePath := path.Join(target.productRelPath, sourceVerName, target.itemName)
+	targetPath := path.Join(target.productRelPath, target.versionName, target.itemName)
+	outputPath := path.Join(target.productRelPath, target.versionName, deltaName)
+	failureKey := stream.FailureKey(target.versionName, deltaName)
+
+	if !c.shouldAttempt(target.id, failureKey, targetPath) || !c.deltaWindowOpen() {
+		return false
+	}
+
+	// Ensure source path exists.
+	_, err := c.b.Stat(sourcePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// Source does not exist. Skip..
+			return false
+		}
+
+		slog.Error("Failed to read base delta file", "streamName", c.streamName, "product", target.id, "version", target.versionName, "item", target.itemName, "deltaBase", sourceVerName, "error", err)
+		return false
+	}
+
+	if !c.acquireDeltaSlot() {
+		return false
+	}
+
+	err = createDelta(c.ctx, c.b, delta.WithPriority(c.cfg.deltaEncoder, c.cfg.deltaPriority), c.tempDir, sourcePath, targetPath, outputPath, c.cfg.verifyDeltas, target.item.SHA256)
+	c.releaseDeltaSlot()
+	if err != nil {
+		slog.Error("Failed creating delta file", "streamName", c.streamName, "product", target.id, "version", target.versionName, "item", deltaName, "deltaBase", sourceVerName, "error", err)
+		if c.ctx.Err() == nil {
+			c.recordFailure(target.id, failureKey, targetPath, err)
+		}
+
+		return false
+	}
+
+	slog.Info("Delta generated successfully", "streamName", c.streamName, "product", target.id, "version", target.versionName, "item", deltaName, "deltaBase", sourceVerName)
+	metrics.DeltasGenerated.Inc(c.streamName)
+	c.cfg.report.addDelta(c.streamName, target.id, target.versionName, deltaName, sourceVerName)
+	c.clearFailure(target.id, failureKey)
+
+	return true
+}
+
+// addDeltaItem ensures the catalog contains the hashes of the delta item with
+// the given name, and that the item is included in the version checksums file
+// if such file exists and is not signed.
+func (c *catalogBuilder) addDeltaItem(target deltaTarget, deltaName string) {
+	version := target.version
+
+	deltaRelPath := filepath.Join(target.productRelPath, target.versionName, deltaName)
+	deltaItem, err := stream.GetItem(c.ctx, c.rootDir, deltaRelPath,
+		stream.WithHashes(true),
+		stream.WithHashCache(c.hashCache),
+		stream.WithHashAlgorithms(c.cfg.checksums...),
+		stream.WithHashAlgorithms(version.ChecksumAlgorithm),
+	)
+	if err != nil {
+		slog.Error("Failed to get existing delta item", "streamName", c.streamName, "product", target.id, "version", target.versionName, "item", deltaName, "error", err)
+		return
+	}
+
+	// Append delta file hash to the version checksums
+	// file if it exists. Signed checksums file is left
+	// intact, as appending would invalidate its signature.
+	// Checksums map is shared by the jobs creating delta
+	// files of the same version.
+	c.mutex.Lock()
+	_, ok := version.Checksums[deltaName]
+	hasChecksums := len(version.Checksums) > 0 && !version.ChecksumsSigned
+	c.mutex.Unlock()
+
+	if !ok && hasChecksums {
+		// Append new item to the checksums file.
+		checksum := deltaItem.Hash(version.ChecksumAlgorithm)
+		checksumFile := path.Join(target.productRelPath, target.versionName, version.ChecksumAlgorithm.FileName())
+
+		c.checksumMutex.Lock()
+		err := storage.AppendFile(c.b, checksumFile, fmt.Sprintf("%s  %s\n", checksum, deltaName))
+		c.checksumMutex.Unlock()
+		if err != nil {
+			slog.Error("Failed to update checksums file", "streamName", c.streamName, "product", target.id, "version", target.versionName, "error", err)
+			return
+		}
+
+		// Update version checksums map.
+		c.mutex.Lock()
+		c.catalog.Products[target.id].Versions[target.versionName].Checksums[deltaName] = checksum
+		c.mutex.Unlock()
+	}
+
+	// Include delta item with hashes in the catalog.
+	c.mutex.Lock()
+	c.catalog.Products[target.id].Versions[target.versionName].Items[deltaName] = *deltaItem
+	c.mutex.Unlock()
+
+	c.checkpoint()
+}
+
+// acquireDeltaSlot blocks until a delta file can be created. It returns false
+// if the context is cancelled in the meantime.
+func (c *catalogBuilder) acquireDeltaSlot() bool {
+	if c.deltaSlots == nil {
+		return true
+	}
+
+	select {
+	case c.deltaSlots <- struct{}{}:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+// releaseDeltaSlot frees the slot acquired by acquireDeltaSlot.
+func (c *catalogBuilder) releaseDeltaSlot() {
+	if c.deltaSlots != nil {
+		<-c.deltaSlots
+	}
+}
+
+// deltaWindowOpen returns true if delta files can be generated at the current
+// time. Delta files that are not generated outside the delta window are
+// generated by a later build.
+func (c *catalogBuilder) deltaWindowOpen() bool {
+	if c.cfg.deltaWindow.Contains(clock.FromContext(c.ctx).Now()) {
+		return true
+	}
+
+	c.deltaDeferred.Do(func() {
+		slog.Info("Generation of delta files is deferred until the delta window", "streamName", c.streamName, "window", c.cfg.deltaWindow.String())
+	})
+
+	return false
+}
+
+// deduplicateVersions applies the given action to the new product versions
+// whose items are equal to the items of an older version of the same product.
+// Product versions are modified in place.
+func deduplicateVersions(b storage.Backend, streamName string, id string, versions map[string]stream.Version, newVersions []string, action string) {
+	if action == config.DuplicatesKeep {
+		return
+	}
+
+	names := shared.MapKeys(versions)
+	slices.Sort(names)
+	slices.Sort(newVersions)
+
+	for _, name := range newVersions {
+		version, ok := versions[name]
+		if !ok {
+			// Version was not added to the catalog.
+			continue
+		}
+
+		// Find the oldest version with the same content.
+		var original string
+		for _, other := range names {
+			if other == name {
+				break
+			}
+
+			otherVersion, ok := versions[other]
+			if ok && otherVersion.SameContent(version) {
+				original = other
+				break
+			}
+		}
+
+		if original == "" {
+			continue
+		}
+
+		originalItems := versions[original].Items
+
+		switch action {
+		case config.DuplicatesSkip:
+			delete(versions, name)
+			slog.Info("Skipped duplicate product version", "streamName", streamName, "product", id, "version", name, "original", original)
+
+		case config.DuplicatesAlias:
+			for itemName, item := range version.Items {
+				originalItem, ok := originalItems[itemName]
+				if !ok {
+					// Delta items are not part of the original.
+					continue
+				}
+
+				item.Path = originalItem.Path
+				version.Items[itemName] = item
+			}
+
+			slog.Info("Aliased duplicate product version", "streamName", streamName, "product", id, "version", name, "original", original)
+
+		case config.DuplicatesLink:
+			local, ok := b.(*storage.Local)
+			if !ok {
+				slog.Warn("Hard-linking duplicate product versions is supported only for local directories", "streamName", streamName, "product", id, "version", name)
+				continue
+			}
+
+			for itemName, item := range version.Items {
+				originalItem, ok := originalItems[itemName]
+				if !ok || originalItem.Path == item.Path {
+					continue
+				}
+
+				err := local.Link(originalItem.Path, item.Path)
+				if err != nil {
+					slog.Error("Failed to link duplicate item", "streamName", streamName, "product", id, "version", name, "item", itemName, "error", err)
+				}
+			}
+
+			slog.Info("Linked duplicate product version", "streamName", streamName, "product", id, "version", name, "original", original)
+		}
+	}
+}
+
+// createDelta creates the delta file between the source and target files, and
+// publishes it under the output path. Paths are relative to the root of the
+// storage backend. Files that are not stored locally are downloaded first.
+// If verify is true, the delta file is applied to the source file before it
+// is published, and the result must match the given SHA256 hash of the target
+// file, which is calculated if empty.
+func createDelta(ctx context.Context, b storage.Backend, encoder delta.DeltaEncoder, tempDir string, sourcePath string, targetPath string, outputPath string, verify bool, targetSHA256 string) error {
+	sourceFile, releaseSource, err := storage.Fetch(b, sourcePath)
+	if err != nil {
+		return err
+	}
+
+	defer releaseSource()
+
+	targetFile, releaseTarget, err := storage.Fetch(b, targetPath)
+	if err != nil {
+		return err
+	}
+
+	defer releaseTarget()
+
+	// Each delta file is written to its own directory, as delta files
+	// are created concurrently.
+	outputDir, err := os.MkdirTemp(tempDir, "delta-")
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(outputDir)
+
+	outputFile := filepath.Join(outputDir, path.Base(outputPath))
+
+	err = encoder.Encode(ctx, sourceFile, targetFile, outputFile)
+	if err != nil {
+		return err
+	}
+
+	if verify {
+		if targetSHA256 == "" {
+			hashes, err := stream.FileHashes(ctx, []stream.ChecksumAlgorithm{stream.ChecksumSHA256}, targetFile)
+			if err != nil {
+				return err
+			}
+
+			targetSHA256 = hashes[stream.ChecksumSHA256]
+		}
+
+		err = delta.Verify(ctx, delta.DecoderFor(encoder), sourceFile, outputFile, targetSHA256)
+		if err != nil {
+			return fmt.Errorf("Failed to verify delta file: %w", err)
+		}
+	}
+
+	return storage.Publish(b, outputFile, outputPath)
+}
+
+// deltaItemName returns the name of the delta (vcdiff) file that updates the
+// item with the given name and type from the given base version. The legacy
+// name is returned if the version already contains the delta under it.
+func deltaItemName(items map[string]stream.Item, itemName string, ftype string, baseVersion string) string {
+	legacyName := stream.LegacyDeltaFileName(itemName, ftype, baseVersion)
+
+	_, ok := items[legacyName]
+	if ok {
+		return legacyName
+	}
+
+	return stream.DeltaFileName(itemName, ftype, baseVersion)
+}
+
+// smokeTestVersion launches the version as each of the instance types from the
+// smoke test configuration for which the version has the root filesystem, and
+// ensures the test command succeeds within the instances. Versions without the
+// LXD metadata file cannot be launched and are not tested.
+func smokeTestVersion(ctx context.Context, b storage.Backend, conf config.SmokeTestConfig, version stream.Version) error {
+	metaItem, ok := version.Items[stream.ItemTypeMetadata]
+	if !ok {
+		return nil
+	}
+
+	tester := smoketest.Tester{
+		Client:  conf.ClientOrDefault(),
+		Command: conf.Command,
+		Timeout: conf.TimeoutOrDefault(),
+	}
+
+	for _, instanceType := range conf.InstanceTypesOrDefault() {
+		// Root filesystem types in the order of preference.
+		rootFSTypes := []string{stream.ItemTypeSquashfs, stream.ItemTypeRootTarXz}
+		if instanceType == config.InstanceTypeVM {
+			rootFSTypes = []string{stream.ItemTypeDiskKVM}
+		}
+
+		var rootFSPath string
+		for _, rootFSType := range rootFSTypes {
+			for _, item := range version.Items {
+				if item.Ftype == rootFSType {
+					rootFSPath = item.Path
+					break
+				}
+			}
+
+			if rootFSPath != "" {
+				break
+			}
+		}
+
+		if rootFSPath == "" {
+			continue
+		}
+
+		err := smokeTestImage(ctx, b, tester, metaItem.Path, rootFSPath, instanceType == config.InstanceTypeVM)
+		if err != nil {
+			return fmt.Errorf("Instance type %q: %w", instanceType, err)
+		}
+	}
+
+	return nil
+}
+
+// setInstalledSizes sets the installed size of the version items for which it
+// can be determined. Files that are not stored locally are downloaded first.
+func setInstalledSizes(ctx context.Context, b storage.Backend, sizer imagesize.Sizer, version *stream.Version) error {
+	for itemName, item := range version.Items {
+		if !imagesize.Supported(item.Ftype) {
+			continue
+		}
+
+		itemFile, release, err := storage.Fetch(b, item.Path)
+		if err != nil {
+			return err
+		}
+
+		size, err := sizer.InstalledSize(ctx, itemFile, item.Ftype)
+		release()
+		if err != nil {
+			return fmt.Errorf("Item %q: %w", itemName, err)
+		}
+
+		item.InstalledSize = size
+		version.Items[itemName] = item
+	}
+
+	return nil
+}
+
+// setQcow2Info sets the virtual size and compression type of the version's
+// qcow2 items. Only the headers are read, so the files are not downloaded.
+func setQcow2Info(b storage.Backend, version *stream.Version) error {
+	for itemName, item := range version.Items {
+		if item.Ftype != stream.ItemTypeDiskKVM {
+			continue
+		}
+
+		r, err := b.Open(item.Path)
+		if err != nil {
+			return err
+		}
+
+		info, err := stream.ReadQcow2Info(r)
+		_ = r.Close()
+		if err != nil {
+			return fmt.Errorf("Item %q: %w", itemName, err)
+		}
+
+		item.VirtualSize = info.VirtualSize
+		item.Compression = info.Compression
+		version.Items[itemName] = item
+	}
+
+	return nil
+}
+
+// smokeTestImage fetches the image files from the storage backend and tests
+// the image.
+func smokeTestImage(ctx context.Context, b storage.Backend, tester smoketest.Tester, metaPath string, rootFSPath string, vm bool) error {
+	metaFile, releaseMeta, err := storage.Fetch(b, metaPath)
+	if err != nil {
+		return err
+	}
+
+	defer releaseMeta()
+
+	rootFSFile, releaseRootFS, err := storage.Fetch(b, rootFSPath)
+	if err != nil {
+		return err
+	}
+
+	defer releaseRootFS()
+
+	return tester.Test(ctx, smoketest.Image{
+		Metadata: metaFile,
+		RootFS:   rootFSFile,
+		VM:       vm,
+	})
+}
+
+// createZsync creates the zsync control file for the target file, and
+// publishes it under the output path. Paths are relative to the root of the
+// storage backend. Files that are not stored locally are downloaded first.
+func createZsync(ctx context.Context, b storage.Backend, tempDir string, targetPath string, outputPath string) error {
+	targetFile, releaseTarget, err := storage.Fetch(b, targetPath)
+	if err != nil {
+		return err
+	}
+
+	defer releaseTarget()
+
+	outputDir, err := os.MkdirTemp(tempDir, "zsync-")
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(outputDir)
+
+	outputFile := filepath.Join(outputDir, path.Base(outputPath))
+
+	err = delta.CreateZsync(ctx, targetFile, path.Base(targetPath), outputFile)
+	if err != nil {
+		return err
+	}
+
+	return storage.Publish(b, outputFile, outputPath)
+}
+
+// writeProductCatalog builds the product catalog in the same way as
+// buildProductCatalog, except that products are processed one at a time and
+// written to the catalog file on the given path as soon as they are complete.
+// The returned catalog contains all products, but without their versions.
+// If buildWebpage is true, the webpage is populated along the way.
+func writeProductCatalog(ctx context.Context, rootDir string, streamVersion string, streamName string, workers int, path string, buildWebpage bool, opts ...buildOption) (*stream.ProductCatalog, *webpage.WebPage, error) {
+	var page *webpage.WebPage
+	if buildWebpage {
+		page = webpage.NewWebPage(streamName, *stream.NewCatalog(streamName, nil))
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Write product catalog file: %w", err)
+	}
+
+	defer file.Close()
+
+	conf, err := config.Load(rootDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The header is known in advance, because the catalog fields other
+	// than products are derived from the stream name and the config.
+	header := stream.NewCatalog(streamName, nil)
+	header.ContentID = conf.ContentID(streamName)
+	header.DataType = conf.DataType(streamName)
+
+	writer, err := stream.NewCatalogWriter(file, *header)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Write product catalog file: %w", err)
+	}
+
+	writeProduct := func(id string, product stream.Product) error {
+		// Ensure product is valid before writing it, as its versions
+		// are not retained for validation of the whole catalog.
+		if product.ID() != id {
+			return fmt.Errorf("Invalid product %q: %w: ID does not match the product ID %q", id, stream.ErrInvalid, product.ID())
+		}
+
+		err := product.Validate()
+		if err != nil {
+			return fmt.Errorf("Invalid product %q: %w", id, err)
+		}
+
+		if page != nil {
+			page.AddProduct(streamName, product)
+		}
+
+		return writer.WriteProduct(id, product)
+	}
+
+	catalog, err := buildProductCatalog(ctx, rootDir, streamVersion, streamName, workers, append(slices.Clip(opts), withProductWriter(writeProduct))...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Write product catalog file: %w", err)
+	}
+
+	err = catalog.Validate()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid product catalog %q: %w", streamName, err)
+	}
+
+	return catalog, page, file.Close()
+}
+
+// productOutline returns the product with its versions reduced to their names
+// and requirements. When products are processed one at a time, outlines are
+// retained in place of the products until they are processed.
+func productOutline(p stream.Product) stream.Product {
+	versions := make(map[string]stream.Version, len(p.Versions))
+	for name, v := range p.Versions {
+		versions[name] = stream.Version{Requirements: v.Requirements}
+	}
+
+	p.Versions = versions
+	return p
+}
+
+// readCatalogOutline reads the product catalog on the given path one product
+// at a time, and returns it with the outlines of its products.
+func readCatalogOutline(b storage.Backend, catalogPath string) (*stream.ProductCatalog, error) {
+	file, err := b.Open(catalogPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening file: %w", err)
+	}
+
+	defer file.Close()
+
+	reader, err := stream.NewCatalogReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read product catalog %q: %w", catalogPath, err)
+	}
+
+	products := make(map[string]stream.Product)
+
+	for {
+		id, product, err := reader.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+
+			return nil, fmt.Errorf("Failed to read product catalog %q: %w", catalogPath, err)
+		}
+
+		products[id] = productOutline(product)
+	}
+
+	catalog := reader.Header()
+	catalog.Products = products
+
+	return &catalog, nil
+}
+
+// catalogVersionReader reads the versions of the products of the product
+// catalog one product at a time. Products are expected to be requested in the
+// order of the catalog, which is the ascending order of their IDs. Otherwise,
+// the catalog is read again from the beginning.
+type catalogVersionReader struct {
+	b    storage.Backend
+	path string
+
+	file   io.ReadCloser
+	reader *stream.CatalogReader
+}
+
+// versions returns the versions of the product with the given ID.
+func (r *catalogVersionReader) versions(id string) (map[string]stream.Version, error) {
+	// Product preceding the current position is found once the catalog
+	// is read again from the beginning.
+	for range 2 {
+		if r.reader == nil {
+			err := r.open()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for {
+			nextID, product, err := r.reader.Next()
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+
+				return nil, fmt.Errorf("Failed to read product catalog %q: %w", r.path, err)
+			}
+
+			if nextID == id {
+				return product.Versions, nil
+			}
+		}
+
+		r.close()
+	}
+
+	return nil, fmt.Errorf("Product %q not found in product catalog %q", id, r.path)
+}
+
+// open opens the product catalog and positions the reader at its first
+// product.
+func (r *catalogVersionReader) open() error {
+	file, err := r.b.Open(r.path)
+	if err != nil {
+		return fmt.Errorf("Error opening file: %w", err)
+	}
+
+	reader, err := stream.NewCatalogReader(file)
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("Failed to read product catalog %q: %w", r.path, err)
+	}
+
+	r.file = file
+	r.reader = reader
+	return nil
+}
+
+// close closes the product catalog.
+func (r *catalogVersionReader) close() {
+	if r.file != nil {
+		_ = r.file.Close()
+	}
+
+	r.file = nil
+	r.reader = nil
+}
+
+// writeCatalogFile writes the product catalog to the file on the given path.
+// Products are encoded one at a time, which avoids encoding the whole catalog
+// in memory at once.
+func writeCatalogFile(path string, catalog *stream.ProductCatalog) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	err = stream.WriteCatalog(file, *catalog)
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
 }
 
 // DiffProducts is a helper function that compares two product maps and returns
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/webpage"
+)
+
+// Modes in which the identical items are deduplicated.
+const (
+	dedupeModeHardlink = "hardlink"
+	dedupeModeReflink  = "reflink"
+)
+
+type dedupeOptions struct {
+	global *globalOptions
+
+	StreamVersion string
+	ImageDirs     []string
+	Mode          string
+	DryRun        bool
+	Format        string
+	LockTimeout   time.Duration
+}
+
+func (o *dedupeOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "dedupe <path> [flags]",
+		Short: "Replace identical items with links to a single copy",
+		Long: `Replace items with identical SHA256 hashes (for example, metadata tarballs shared across variants)
+with links to a single copy of the file, and report the disk space saved.
+
+Items are read from the product catalogs of the given image directories, and each file is verified
+against its hash before it is replaced, reusing the hashes cached by the build. By default, files are
+replaced with hard links, which share the file including its metadata (e.g. the modification time).
+With --mode reflink, files are replaced with copy-on-write clones instead, which requires a filesystem
+that supports them (e.g. Btrfs or XFS). Since clones cannot be told apart from copies, they are cloned
+again on each run.
+
+Files are replaced atomically, so that the content is served without interruption. Prune accounts for
+the hard links when computing the space freed by the deletions. Deduplication is supported only for
+local directories.`,
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringVar(&o.StreamVersion, "stream-version", "v1", "Stream version")
+	cmd.PersistentFlags().StringSliceVarP(&o.ImageDirs, "image-dir", "d", []string{"images"}, "Image directory (relative to path argument)")
+	cmd.PersistentFlags().StringVar(&o.Mode, "mode", dedupeModeHardlink, "How identical items are linked (hardlink, reflink)")
+	cmd.PersistentFlags().BoolVar(&o.DryRun, "dry-run", false, "Report identical items without linking them")
+	cmd.PersistentFlags().StringVar(&o.Format, "format", "table", "Output format (table, json)")
+	cmd.PersistentFlags().DurationVar(&o.LockTimeout, "lock-timeout", defaultLockTimeout, "Maximum time to wait for another build or prune to finish (0 fails immediately)")
+
+	return cmd
+}
+
+func (o *dedupeOptions) Run(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
+	}
+
+	if o.Mode != dedupeModeHardlink && o.Mode != dedupeModeReflink {
+		return fmt.Errorf("Invalid mode %q. Valid modes are: [hardlink, reflink]", o.Mode)
+	}
+
+	if o.Format != "table" && o.Format != "json" {
+		return fmt.Errorf("Invalid output format %q. Valid formats are: [table, json]", o.Format)
+	}
+
+	if !storage.IsLocal(args[0]) {
+		return fmt.Errorf("Deduplication is supported only for local directories")
+	}
+
+	var result *dedupeResult
+
+	if o.DryRun {
+		var err error
+
+		result, err = dedupeItems(o.global.ctx, args[0], o.StreamVersion, o.ImageDirs, o.Mode, true)
+		if err != nil {
+			return err
+		}
+	} else {
+		unlock, err := lockStreams(o.global.ctx, storage.NewLocal(args[0]), o.LockTimeout)
+		if err != nil {
+			return err
+		}
+
+		result, err = dedupeItems(o.global.ctx, args[0], o.StreamVersion, o.ImageDirs, o.Mode, false)
+		unlock()
+
+		recordCommand(args[0], "dedupe", cmd, args, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeDedupeResult(cmd.OutOrStdout(), result, o.Format)
+}
+
+// dedupeLink is a single file replaced by a link to the identical file.
+type dedupeLink struct {
+	SHA256   string `json:"sha256"`
+	Original string `json:"original"`
+	Path     string `json:"path"`
+
+	// Saved is the number of bytes freed by the replacement. It is zero if
+	// the data of the replaced file is still linked from elsewhere.
+	Saved int64 `json:"saved"`
+}
+
+// dedupeResult lists the files replaced by the deduplication.
+type dedupeResult struct {
+	Mode   string       `json:"mode"`
+	DryRun bool         `json:"dry_run"`
+	Links  []dedupeLink `json:"links"`
+
+	// Saved is the total number of bytes freed by the replacements.
+	Saved int64 `json:"saved"`
+}
+
+// dedupeFile is a file of an item considered for deduplication.
+type dedupeFile struct {
+	path  string
+	info  fs.FileInfo
+	id    shared.FileID
+	links uint64
+}
+
+// dedupeItems replaces the items of the given streams that have identical
+// SHA256 hashes with links to a single file in the given mode. Of each group
+// of identical items, the file with the most links is kept, so that the
+// existing links are preserved. Files that do not match their hash are left
+// untouched. If dryRun is true, the files are only reported.
+func dedupeItems(ctx context.Context, rootDir string, streamVersion string, streamNames []string, mode string, dryRun bool) (*dedupeResult, error) {
+	local := storage.NewLocal(rootDir)
+
+	// Paths of the items grouped by their hashes, and the hash caches of the
+	// streams they belong to.
+	groups := make(map[string][]string)
+	caches := make(map[string]*stream.HashCache)
+
+	for _, streamName := range streamNames {
+		catalogPath := path.Join("streams", streamVersion, fmt.Sprintf("%s.json", streamName))
+
+		catalog, err := storage.ReadJSONFile(local, catalogPath, &stream.ProductCatalog{})
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+
+			slog.Warn("Product catalog not found, skipping stream", "streamName", streamName)
+			continue
+		}
+
+		cache, err := stream.LoadHashCache(rootDir, stream.HashCachePath(streamVersion, streamName))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range catalog.Products {
+			for _, v := range p.Versions {
+				for _, item := range v.Items {
+					itemPath := filepath.ToSlash(item.Path)
+					if item.SHA256 == "" || caches[itemPath] != nil {
+						continue
+					}
+
+					groups[item.SHA256] = append(groups[item.SHA256], itemPath)
+					caches[itemPath] = cache
+				}
+			}
+		}
+	}
+
+	result := &dedupeResult{
+		Mode:   mode,
+		DryRun: dryRun,
+		Links:  []dedupeLink{},
+	}
+
+	// Number of the remaining links of each replaced file, whose data is
+	// freed once the last of them is replaced.
+	remaining := make(map[shared.FileID]uint64)
+
+	hashes := shared.MapKeys(groups)
+	slices.Sort(hashes)
+
+	for _, hash := range hashes {
+		if len(groups[hash]) < 2 {
+			continue
+		}
+
+		paths := groups[hash]
+		slices.Sort(paths)
+
+		files := make([]dedupeFile, 0, len(paths))
+
+		for _, itemPath := range paths {
+			info, err := local.Stat(itemPath)
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				}
+
+				return nil, err
+			}
+
+			fileHash, err := caches[itemPath].FileHash(ctx, rootDir, itemPath)
+			if err != nil {
+				return nil, err
+			}
+
+			if fileHash != hash {
+				slog.Warn("Skipping item that does not match its hash in the product catalog", "path", itemPath)
+				continue
+			}
+
+			id, links, ok := shared.FileLinks(info)
+			if !ok {
+				id = shared.FileID{}
+				links = 1
+			}
+
+			files = append(files, dedupeFile{path: itemPath, info: info, id: id, links: links})
+		}
+
+		if len(files) < 2 {
+			continue
+		}
+
+		// Keep the file with the most links.
+		original := slices.MaxFunc(files, func(a dedupeFile, b dedupeFile) int {
+			return cmp.Compare(a.links, b.links)
+		})
+
+		for _, f := range files {
+			if f.path == original.path || os.SameFile(f.info, original.info) {
+				continue
+			}
+
+			link := dedupeLink{
+				SHA256:   hash,
+				Original: original.path,
+				Path:     f.path,
+			}
+
+			_, ok := remaining[f.id]
+			if !ok || f.id == (shared.FileID{}) {
+				remaining[f.id] = f.links
+			}
+
+			remaining[f.id]--
+			if remaining[f.id] == 0 {
+				link.Saved = f.info.Size()
+			}
+
+			if !dryRun {
+				err := dedupeFileLink(local, original.path, f.path, mode)
+				if err != nil {
+					return nil, err
+				}
+
+				slog.Debug("Linked identical item", "path", f.path, "original", original.path, "mode", mode)
+			}
+
+			result.Links = append(result.Links, link)
+			result.Saved += link.Saved
+		}
+	}
+
+	return result, nil
+}
+
+// dedupeFileLink replaces the file with the given name with a link to the
+// original file in the given mode. Modification time of the parent directory
+// is preserved, as it is used to determine the version age when pruning.
+func dedupeFileLink(local *storage.Local, original string, name string, mode string) error {
+	dirInfo, err := local.Stat(path.Dir(name))
+	if err != nil {
+		return err
+	}
+
+	if mode == dedupeModeReflink {
+		err = local.Reflink(original, name)
+	} else {
+		err = local.Link(original, name)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to link %q to %q: %w", name, original, err)
+	}
+
+	return os.Chtimes(local.Path(path.Dir(name)), dirInfo.ModTime(), dirInfo.ModTime())
+}
+
+// writeDedupeResult writes the replaced files in the given format (table or
+// json). Table lists the replaced files followed by the total saved size.
+func writeDedupeResult(w io.Writer, result *dedupeResult, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SHA256\tPATH\tORIGINAL\tSAVED")
+
+	for _, l := range result.Links {
+		fmt.Fprintf(tw, "%s\n", strings.Join([]string{
+			l.SHA256[:min(len(l.SHA256), 12)],
+			l.Path,
+			l.Original,
+			webpage.FormatSize(l.Saved),
+		}, "\t"))
+	}
+
+	fmt.Fprintf(tw, "TOTAL\t\t\t%s\n", webpage.FormatSize(result.Saved))
+
+	return tw.Flush()
+}
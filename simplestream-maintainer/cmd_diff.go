@@ -0,0 +1,451 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+// Kinds of differences reported by the diff command.
+const (
+	diffAdded   = "added"
+	diffRemoved = "removed"
+	diffChanged = "changed"
+)
+
+type diffOptions struct {
+	global *globalOptions
+
+	StreamVersion string
+	ImageDirs     []string
+	Format        string
+	Hashes        bool
+}
+
+func (o *diffOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diff <path> | diff <catalog-a> <catalog-b> [flags]",
+		Short: "Show differences between product catalogs",
+		Long: `Show products and versions that are added, removed, or changed.
+
+With a single argument, the published product catalogs on the given path are compared with the product
+hierarchy on disk, which shows what the next build would change. With two arguments, the given product
+catalog files are compared with each other. Catalogs are read one product at a time, so that large
+catalogs can be compared with bounded memory usage.
+
+A version is changed if it contains different items, or its items differ in size or SHA256 hash. Delta
+items are ignored, because they are derived from other items. Hashes of the files on disk are compared
+only when they are calculated (see --hashes).
+
+The path may also be an S3 URL in the format s3://bucket/prefix (see the build command).`,
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringVar(&o.StreamVersion, "stream-version", "v1", "Stream version")
+	cmd.PersistentFlags().StringSliceVarP(&o.ImageDirs, "image-dir", "d", []string{"images"}, "Image directory (relative to path argument)")
+	cmd.PersistentFlags().StringVar(&o.Format, "format", "table", "Output format (table, json)")
+	cmd.PersistentFlags().BoolVar(&o.Hashes, "hashes", false, "Calculate hashes of the files on disk to detect changed content of the same size")
+
+	return cmd
+}
+
+func (o *diffOptions) Run(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
+	}
+
+	if o.Format != "table" && o.Format != "json" {
+		return fmt.Errorf("Invalid output format %q. Valid formats are: [table, json]", o.Format)
+	}
+
+	var diffs []catalogDiff
+
+	if len(args) == 2 {
+		var err error
+
+		diffs, err = diffCatalogFiles(args[0], args[1])
+		if err != nil {
+			return err
+		}
+	} else {
+		var err error
+
+		diffs, err = diffStreams(o.global.ctx, args[0], o.StreamVersion, o.ImageDirs, o.global.pathSchema, o.Hashes)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeCatalogDiffs(cmd.OutOrStdout(), diffs, o.Format)
+}
+
+// catalogDiff is a single difference between two product catalogs. Version
+// is empty if the whole product is added or removed.
+type catalogDiff struct {
+	Stream  string `json:"stream"`
+	Product string `json:"product"`
+	Version string `json:"version,omitempty"`
+	Change  string `json:"change"`
+}
+
+// diffStreams compares the published product catalogs of the given streams
+// with the product hierarchy on disk. Missing product catalog is treated as
+// an empty one.
+func diffStreams(ctx context.Context, rootDir string, streamVersion string, streamNames []string, schema stream.PathSchema, hashes bool) ([]catalogDiff, error) {
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []catalogDiff
+
+	for _, streamName := range streamNames {
+		catalogPath := path.Join("streams", streamVersion, fmt.Sprintf("%s.json", streamName))
+
+		products, err := stream.GetProducts(ctx, rootDir, streamName, stream.WithPathSchema(schema), stream.WithHashes(hashes))
+		if err != nil {
+			return nil, err
+		}
+
+		// Published catalog is read one product at a time, so that only
+		// the products on disk are kept in memory.
+		file, err := b.Open(catalogPath)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+
+			slog.Warn("Product catalog not found, reporting all products as added", "streamName", streamName)
+			diffs = append(diffs, diffCatalogs(streamName, stream.NewCatalog(streamName, nil), stream.NewCatalog(streamName, products))...)
+			continue
+		}
+
+		streamDiffs, err := diffCatalogReader(streamName, file, products)
+		_ = file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read product catalog %q: %w", catalogPath, err)
+		}
+
+		diffs = append(diffs, streamDiffs...)
+	}
+
+	return diffs, nil
+}
+
+// diffCatalogReader compares the product catalog read from the given reader
+// with the given products.
+func diffCatalogReader(streamName string, r io.Reader, newProducts map[string]stream.Product) ([]catalogDiff, error) {
+	reader, err := stream.NewCatalogReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []catalogDiff
+
+	seen := make(map[string]bool, len(newProducts))
+
+	for {
+		id, oldProduct, err := reader.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+
+			return nil, err
+		}
+
+		seen[id] = true
+
+		newProduct, ok := newProducts[id]
+		if !ok {
+			diffs = append(diffs, diffProduct(streamName, id, &oldProduct, nil)...)
+			continue
+		}
+
+		diffs = append(diffs, diffProduct(streamName, id, &oldProduct, &newProduct)...)
+	}
+
+	for id, newProduct := range newProducts {
+		if !seen[id] {
+			diffs = append(diffs, diffProduct(streamName, id, nil, &newProduct)...)
+		}
+	}
+
+	sortCatalogDiffs(diffs)
+	return diffs, nil
+}
+
+// errCatalogUnordered is returned when products of the catalog file are not
+// in ascending order of their IDs.
+var errCatalogUnordered = errors.New("Products are not ordered")
+
+// diffCatalogFiles compares the product catalog files on the given paths.
+// Both files are read one product at a time, which bounds the memory usage
+// regardless of the catalog size. This requires products to be ordered by
+// their IDs, as written by the build command. Otherwise, both catalogs are
+// read into memory.
+func diffCatalogFiles(oldPath string, newPath string) ([]catalogDiff, error) {
+	diffs, err := diffOrderedCatalogFiles(oldPath, newPath)
+	if err == nil || !errors.Is(err, errCatalogUnordered) {
+		return diffs, err
+	}
+
+	slog.Debug("Products of the catalogs are not ordered, reading catalogs into memory")
+
+	oldCatalog, err := shared.ReadJSONFile(oldPath, &stream.ProductCatalog{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read product catalog %q: %w", oldPath, err)
+	}
+
+	newCatalog, err := shared.ReadJSONFile(newPath, &stream.ProductCatalog{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read product catalog %q: %w", newPath, err)
+	}
+
+	return diffCatalogs(newCatalog.ContentID, oldCatalog, newCatalog), nil
+}
+
+// diffOrderedCatalogFiles compares the product catalog files by merging their
+// products, which must be in ascending order of their IDs.
+func diffOrderedCatalogFiles(oldPath string, newPath string) ([]catalogDiff, error) {
+	// orderedCatalog reads products of a single catalog file and ensures
+	// they are ordered.
+	type orderedCatalog struct {
+		path    string
+		reader  *stream.CatalogReader
+		id      string
+		product stream.Product
+		started bool
+		done    bool
+	}
+
+	next := func(c *orderedCatalog) error {
+		id, product, err := c.reader.Next()
+		if err != nil {
+			if err == io.EOF {
+				c.done = true
+				return nil
+			}
+
+			return fmt.Errorf("Failed to read product catalog %q: %w", c.path, err)
+		}
+
+		if c.started && id <= c.id {
+			return fmt.Errorf("Product catalog %q: %w", c.path, errCatalogUnordered)
+		}
+
+		c.started = true
+		c.id = id
+		c.product = product
+		return nil
+	}
+
+	catalogs := make([]*orderedCatalog, 0, 2)
+
+	for _, catalogPath := range []string{oldPath, newPath} {
+		file, err := os.Open(catalogPath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read product catalog %q: %w", catalogPath, err)
+		}
+
+		defer file.Close()
+
+		reader, err := stream.NewCatalogReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read product catalog %q: %w", catalogPath, err)
+		}
+
+		c := &orderedCatalog{path: catalogPath, reader: reader}
+
+		err = next(c)
+		if err != nil {
+			return nil, err
+		}
+
+		catalogs = append(catalogs, c)
+	}
+
+	oldCatalog := catalogs[0]
+	newCatalog := catalogs[1]
+
+	var diffs []catalogDiff
+	var err error
+
+	for !oldCatalog.done || !newCatalog.done {
+		switch {
+		case newCatalog.done || (!oldCatalog.done && oldCatalog.id < newCatalog.id):
+			diffs = append(diffs, diffProduct("", oldCatalog.id, &oldCatalog.product, nil)...)
+			err = next(oldCatalog)
+		case oldCatalog.done || newCatalog.id < oldCatalog.id:
+			diffs = append(diffs, diffProduct("", newCatalog.id, nil, &newCatalog.product)...)
+			err = next(newCatalog)
+		default:
+			diffs = append(diffs, diffProduct("", oldCatalog.id, &oldCatalog.product, &newCatalog.product)...)
+
+			err = next(oldCatalog)
+			if err == nil {
+				err = next(newCatalog)
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Content ID is known only once the whole catalog is read, as it may
+	// follow the products.
+	streamName := newCatalog.reader.Header().ContentID
+	for i := range diffs {
+		diffs[i].Stream = streamName
+	}
+
+	sortCatalogDiffs(diffs)
+	return diffs, nil
+}
+
+// diffCatalogs returns products and versions that are added, removed, or
+// changed in the new catalog compared to the old one. Differences are sorted
+// by product ID and version name.
+func diffCatalogs(streamName string, oldCatalog *stream.ProductCatalog, newCatalog *stream.ProductCatalog) []catalogDiff {
+	var diffs []catalogDiff
+
+	for id, oldProduct := range oldCatalog.Products {
+		newProduct, ok := newCatalog.Products[id]
+		if !ok {
+			diffs = append(diffs, diffProduct(streamName, id, &oldProduct, nil)...)
+			continue
+		}
+
+		diffs = append(diffs, diffProduct(streamName, id, &oldProduct, &newProduct)...)
+	}
+
+	for id, newProduct := range newCatalog.Products {
+		_, ok := oldCatalog.Products[id]
+		if !ok {
+			diffs = append(diffs, diffProduct(streamName, id, nil, &newProduct)...)
+		}
+	}
+
+	sortCatalogDiffs(diffs)
+	return diffs
+}
+
+// diffProduct returns the differences between the old and new version of the
+// product with the given ID. If the old product is nil, the product is added,
+// and if the new product is nil, the product is removed.
+func diffProduct(streamName string, id string, oldProduct *stream.Product, newProduct *stream.Product) []catalogDiff {
+	if oldProduct == nil {
+		return []catalogDiff{{Stream: streamName, Product: id, Change: diffAdded}}
+	}
+
+	if newProduct == nil {
+		return []catalogDiff{{Stream: streamName, Product: id, Change: diffRemoved}}
+	}
+
+	var diffs []catalogDiff
+
+	for name, oldVersion := range oldProduct.Versions {
+		newVersion, ok := newProduct.Versions[name]
+		if !ok {
+			diffs = append(diffs, catalogDiff{Stream: streamName, Product: id, Version: name, Change: diffRemoved})
+			continue
+		}
+
+		if !sameVersionItems(oldVersion, newVersion) {
+			diffs = append(diffs, catalogDiff{Stream: streamName, Product: id, Version: name, Change: diffChanged})
+		}
+	}
+
+	for name := range newProduct.Versions {
+		_, ok := oldProduct.Versions[name]
+		if !ok {
+			diffs = append(diffs, catalogDiff{Stream: streamName, Product: id, Version: name, Change: diffAdded})
+		}
+	}
+
+	return diffs
+}
+
+// sortCatalogDiffs sorts the differences by product ID and version name.
+func sortCatalogDiffs(diffs []catalogDiff) {
+	slices.SortFunc(diffs, func(a catalogDiff, b catalogDiff) int {
+		return cmp.Or(cmp.Compare(a.Product, b.Product), cmp.Compare(a.Version, b.Version))
+	})
+}
+
+// sameVersionItems returns true if both versions contain the same non-delta
+// items with equal sizes. SHA256 hashes are compared only if they are known
+// for both items.
+func sameVersionItems(a stream.Version, b stream.Version) bool {
+	count := 0
+
+	for name, item := range a.Items {
+		if item.IsDelta() {
+			continue
+		}
+
+		other, ok := b.Items[name]
+		if !ok || item.Size != other.Size {
+			return false
+		}
+
+		if item.SHA256 != "" && other.SHA256 != "" && item.SHA256 != other.SHA256 {
+			return false
+		}
+
+		count++
+	}
+
+	for _, item := range b.Items {
+		if !item.IsDelta() {
+			count--
+		}
+	}
+
+	return count == 0
+}
+
+// writeCatalogDiffs writes the differences in the given format.
+func writeCatalogDiffs(w io.Writer, diffs []catalogDiff, format string) error {
+	if format == "json" {
+		if diffs == nil {
+			diffs = []catalogDiff{}
+		}
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diffs)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHANGE\tSTREAM\tPRODUCT\tVERSION")
+
+	for _, d := range diffs {
+		version := d.Version
+		if version == "" {
+			version = "-"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", strings.ToUpper(d.Change), d.Stream, d.Product, version)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/webpage"
+)
+
+// duGroups is a list of supported fields by which the disk usage is grouped.
+var duGroups = []string{"stream", "product", "version", "type"}
+
+type duOptions struct {
+	global *globalOptions
+
+	StreamVersion string
+	ImageDirs     []string
+	GroupBy       []string
+	Bytes         bool
+}
+
+func (o *duOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "du <path> [flags]",
+		Short: "Report disk usage of the streams grouped by product, version, and item type",
+		Long: `Report disk usage of the image directories grouped by stream, product, version, and item type.
+
+Usage is split into data referenced by the product catalog and dangling data, which is not referenced
+by the product catalog (for example, versions removed from the catalog, incomplete versions, and
+leftover files). Dangling data is what pruning of dangling resources reclaims, while the referenced
+data shows how much a stricter retention policy could reclaim. Hard linked files (for example,
+items linked by the dedupe command) are counted only once.
+
+The path may also be an S3 URL in the format s3://bucket/prefix (see the build command).`,
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringVar(&o.StreamVersion, "stream-version", "v1", "Stream version")
+	cmd.PersistentFlags().StringSliceVarP(&o.ImageDirs, "image-dir", "d", []string{"images"}, "Image directory (relative to path argument)")
+	cmd.PersistentFlags().StringSliceVar(&o.GroupBy, "group-by", []string{"stream", "product"}, fmt.Sprintf("Fields by which the usage is grouped (%s)", strings.Join(duGroups, ", ")))
+	cmd.PersistentFlags().BoolVar(&o.Bytes, "bytes", false, "Report sizes in bytes")
+
+	return cmd
+}
+
+func (o *duOptions) Run(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
+	}
+
+	if len(o.GroupBy) == 0 {
+		return fmt.Errorf("At least one group is required")
+	}
+
+	for _, group := range o.GroupBy {
+		if !slices.Contains(duGroups, group) {
+			return fmt.Errorf("Invalid group %q (supported: %s)", group, strings.Join(duGroups, ", "))
+		}
+	}
+
+	files, err := diskUsage(args[0], o.StreamVersion, o.ImageDirs, o.global.pathSchema)
+	if err != nil {
+		return err
+	}
+
+	return writeDiskUsage(cmd.OutOrStdout(), summarizeDiskUsage(files, o.GroupBy), o.GroupBy, o.Bytes)
+}
+
+// duFile is a single file within the stream.
+type duFile struct {
+	Stream   string
+	Product  string
+	Version  string
+	ItemType string
+	Size     int64
+
+	// Referenced indicates whether the file is referenced by the product
+	// catalog, either as an item or as part of a referenced version.
+	Referenced bool
+}
+
+// duRow is the disk usage of a group of files.
+type duRow struct {
+	// Values of the group fields in the order of the groups.
+	Keys       []string
+	Referenced int64
+	Dangling   int64
+}
+
+// diskUsage returns all files within the given streams along with their sizes
+// and information whether they are referenced by the product catalog. Files
+// outside of product versions are reported without the product and version.
+// Hard links of the same file are reported with zero size, except for the
+// first one.
+func diskUsage(rootDir string, streamVersion string, streamNames []string, schema stream.PathSchema) ([]duFile, error) {
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []duFile
+	linked := make(map[shared.FileID]bool)
+
+	for _, streamName := range streamNames {
+		catalogPath := path.Join("streams", streamVersion, fmt.Sprintf("%s.json", streamName))
+
+		catalog, err := storage.ReadJSONFile(b, catalogPath, &stream.ProductCatalog{})
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+
+			slog.Warn("Product catalog not found, reporting all data as dangling", "streamName", streamName)
+			catalog = &stream.ProductCatalog{}
+		}
+
+		// Paths of referenced items and their version directories.
+		referenced := referencedPaths(catalog)
+		itemTypes := make(map[string]string)
+
+		for _, p := range catalog.Products {
+			for versionName, v := range p.Versions {
+				referenced[path.Join(streamName, schema.ProductRelPath(p), versionName)] = true
+
+				for _, item := range v.Items {
+					itemTypes[item.Path] = item.Ftype
+				}
+			}
+		}
+
+		err = walkFiles(b, streamName, func(name string, info fs.FileInfo) error {
+			file := duFile{
+				Stream:   streamName,
+				ItemType: itemTypes[name],
+				Size:     info.Size(),
+			}
+
+			if file.ItemType == "" {
+				file.ItemType = stream.FileItemType(info.Name())
+			}
+
+			id, links, ok := shared.FileLinks(info)
+			if ok && links > 1 {
+				if linked[id] {
+					file.Size = 0
+				}
+
+				linked[id] = true
+			}
+
+			// Path within the stream has the format
+			// "distro/release/arch/variant/version/file".
+			parts := strings.Split(strings.TrimPrefix(name, streamName+"/"), "/")
+			if len(parts) >= 6 {
+				file.Product = strings.Join(parts[:4], ":")
+				file.Version = parts[4]
+				file.Referenced = referenced[name] || referenced[path.Join(streamName, path.Join(parts[:5]...))]
+			}
+
+			files = append(files, file)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// walkFiles calls the given function for each file within the directory with
+// the given name, including files in its subdirectories.
+func walkFiles(b storage.Backend, name string, fn func(name string, info fs.FileInfo) error) error {
+	entries, err := b.List(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+
+	for _, entry := range entries {
+		entryPath := path.Join(name, entry.Name())
+
+		if entry.IsDir() {
+			err = walkFiles(b, entryPath, fn)
+		} else {
+			err = fn(entryPath, entry)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// summarizeDiskUsage groups the files by the given fields and returns the
+// disk usage of each group sorted by the group values.
+func summarizeDiskUsage(files []duFile, groupBy []string) []duRow {
+	rows := make(map[string]*duRow)
+
+	for _, f := range files {
+		keys := make([]string, 0, len(groupBy))
+		for _, group := range groupBy {
+			switch group {
+			case "stream":
+				keys = append(keys, f.Stream)
+			case "product":
+				keys = append(keys, f.Product)
+			case "version":
+				keys = append(keys, f.Version)
+			case "type":
+				keys = append(keys, f.ItemType)
+			}
+		}
+
+		key := strings.Join(keys, "\x00")
+
+		row, ok := rows[key]
+		if !ok {
+			row = &duRow{Keys: keys}
+			rows[key] = row
+		}
+
+		if f.Referenced {
+			row.Referenced += f.Size
+		} else {
+			row.Dangling += f.Size
+		}
+	}
+
+	result := make([]duRow, 0, len(rows))
+	for _, row := range rows {
+		result = append(result, *row)
+	}
+
+	slices.SortFunc(result, func(a duRow, b duRow) int {
+		return slices.Compare(a.Keys, b.Keys)
+	})
+
+	return result
+}
+
+// writeDiskUsage writes the disk usage table followed by the total usage.
+func writeDiskUsage(w io.Writer, rows []duRow, groupBy []string, bytes bool) error {
+	formatSize := webpage.FormatSize
+	if bytes {
+		formatSize = func(size int64) string { return strconv.FormatInt(size, 10) }
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	header := make([]string, 0, len(groupBy)+3)
+	for _, group := range groupBy {
+		header = append(header, strings.ToUpper(group))
+	}
+
+	header = append(header, "REFERENCED", "DANGLING", "TOTAL")
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+
+	var total duRow
+	for _, row := range rows {
+		keys := make([]string, 0, len(row.Keys))
+		for _, key := range row.Keys {
+			if key == "" {
+				key = "-"
+			}
+
+			keys = append(keys, key)
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", strings.Join(keys, "\t"), formatSize(row.Referenced), formatSize(row.Dangling), formatSize(row.Referenced+row.Dangling))
+
+		total.Referenced += row.Referenced
+		total.Dangling += row.Dangling
+	}
+
+	fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", "TOTAL"+strings.Repeat("\t", max(len(groupBy)-1, 0)), formatSize(total.Referenced), formatSize(total.Dangling), formatSize(total.Referenced+total.Dangling))
+
+	return tw.Flush()
+}
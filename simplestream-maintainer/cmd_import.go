@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+// importFileNames maps the file names produced by the image builder to the
+// file names of the corresponding items. Other files are not imported.
+var importFileNames = map[string]string{
+	"lxd.tar.xz":      stream.ItemTypeMetadata,
+	"incus.tar.xz":    stream.ItemTypeMetadata,
+	"meta.tar.xz":     "meta.tar.xz",
+	"rootfs.squashfs": "root.squashfs",
+	"root.squashfs":   "root.squashfs",
+	"rootfs.tar.xz":   stream.ItemTypeRootTarXz,
+	"root.tar.xz":     stream.ItemTypeRootTarXz,
+	"disk.qcow2":      "disk.qcow2",
+	"disk1.img":       "disk1.img",
+}
+
+type importOptions struct {
+	global *globalOptions
+
+	OS            string
+	Release       string
+	Arch          string
+	Variant       string
+	Version       string
+	ImageDir      string
+	Definition    string
+	Move          bool
+	Build         bool
+	StreamVersion string
+	Workers       int
+	VersionMTime  bool
+}
+
+func (o *importOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "import <artifact-dir> <path> [flags]",
+		Short: "Import a built image into the product hierarchy",
+		Long: `Import image files built by the image builder (or LXD) from the artifact directory into the product
+hierarchy "stream/distribution/release/architecture/variant/version" on the given path.
+
+Image files are renamed to the names expected by this tool, and the SHA256SUMS file is generated. The
+image config (image.yaml) is taken from the --definition file or the artifact directory, otherwise, a
+minimal one is generated. Files are hard linked if possible, unless they are moved. The version is
+published only once all of its files are in place. Optionally, the index is rebuilt afterwards.
+
+With --version-mtime, modification times of the version directory and its files are set to the build
+time parsed from the version name (in format YYYYMMDD_hhmm). Pruning relies on modification times to
+determine the age of versions and dangling files, so this keeps it consistent even if the files are
+later copied without preserving their modification times. Note that hard linked artifact files share
+the modification time with the version files.`,
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringVar(&o.OS, "os", "", "Distribution name of the imported image")
+	cmd.PersistentFlags().StringVar(&o.Release, "release", "", "Release of the imported image")
+	cmd.PersistentFlags().StringVar(&o.Arch, "arch", "", "Architecture of the imported image")
+	cmd.PersistentFlags().StringVar(&o.Variant, "variant", "default", "Variant of the imported image")
+	cmd.PersistentFlags().StringVar(&o.Version, "version", "", "Product version name (defaults to the current time in format YYYYMMDD_hhmm)")
+	cmd.PersistentFlags().StringVarP(&o.ImageDir, "image-dir", "d", "images", "Target image directory (relative to path argument)")
+	cmd.PersistentFlags().StringVar(&o.Definition, "definition", "", "Image definition file stored as the image config of the imported version")
+	cmd.PersistentFlags().BoolVar(&o.Move, "move", false, "Move image files instead of hard linking them")
+	cmd.PersistentFlags().BoolVar(&o.Build, "build", false, "Build the index once the image is imported")
+	cmd.PersistentFlags().StringVar(&o.StreamVersion, "stream-version", "v1", "Stream version used when building the index")
+	cmd.PersistentFlags().IntVar(&o.Workers, "workers", max(runtime.NumCPU()/2, 1), "Maximum number of concurrent operations used when building the index")
+	cmd.PersistentFlags().BoolVar(&o.VersionMTime, "version-mtime", false, "Set modification times of the imported version to the build time from the version name")
+
+	return cmd
+}
+
+func (o *importOptions) Run(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "artifact-dir")
+	}
+
+	if len(args) < 2 || args[1] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
+	}
+
+	image := importImage{
+		Distro:     o.OS,
+		Release:    o.Release,
+		Arch:       o.Arch,
+		Variant:    o.Variant,
+		Version:    o.Version,
+		Definition: o.Definition,
+
+		VersionMTime: o.VersionMTime,
+	}
+
+	if image.Version == "" {
+		image.Version = time.Now().UTC().Format("20060102_1504")
+	}
+
+	err := o.importImage(args[0], args[1], image)
+	recordCommand(args[1], "import", cmd, args, err)
+
+	return err
+}
+
+// importImage imports the image from the artifact directory into the given
+// root directory, and builds the index if requested.
+func (o *importOptions) importImage(artifactDir string, rootDir string, image importImage) error {
+	versionPath, err := importImageFiles(o.global.ctx, artifactDir, rootDir, o.ImageDir, o.global.pathSchema, image, o.Move)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Imported image", "path", artifactDir, "version", versionPath)
+
+	if !o.Build {
+		return nil
+	}
+
+	return buildIndex(o.global.ctx, rootDir, o.StreamVersion, []string{o.ImageDir}, o.Workers, false, withPathSchema(o.global.pathSchema))
+}
+
+// importImage describes the product version created from the imported image.
+type importImage struct {
+	Distro  string
+	Release string
+	Arch    string
+	Variant string
+	Version string
+
+	// Path of the image definition file that is stored as the image config.
+	// If empty, the image config from the artifact directory is used if it
+	// exists, otherwise, a minimal image config is generated.
+	Definition string
+
+	// VersionMTime sets the modification times of the version directory
+	// and its files to the build time parsed from the version name.
+	VersionMTime bool
+}
+
+// importImageFiles imports the image files from the artifact directory as a
+// new version of the product within the given stream. The version is created
+// within a hidden directory, which is renamed once all files are in place, so
+// that a partially imported version is never published. Path of the created
+// version is returned.
+func importImageFiles(ctx context.Context, artifactDir string, rootDir string, streamName string, schema stream.PathSchema, image importImage, moveFiles bool) (string, error) {
+	fields := map[string]string{
+		"os":      image.Distro,
+		"release": image.Release,
+		"arch":    image.Arch,
+		"variant": image.Variant,
+		"version": image.Version,
+	}
+
+	for _, name := range []string{"os", "release", "arch", "variant", "version"} {
+		value := fields[name]
+		if value == "" || value == "." || value == ".." || strings.HasPrefix(value, ".") || strings.ContainsAny(value, `/\`) {
+			return "", fmt.Errorf("Invalid %s %q", name, value)
+		}
+	}
+
+	var modTime time.Time
+	if image.VersionMTime {
+		var err error
+
+		modTime, err = parseVersionTime(image.Version)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	product := stream.Product{Distro: image.Distro, Release: image.Release, Architecture: image.Arch, Variant: image.Variant}
+	productPath := filepath.Join(rootDir, streamName, schema.ProductRelPath(product))
+	versionPath := filepath.Join(productPath, image.Version)
+	versionPathTemp := filepath.Join(productPath, fmt.Sprintf(".%s", image.Version))
+
+	_, err := os.Stat(versionPath)
+	if err == nil {
+		return "", fmt.Errorf("Product version %q already exists", versionPath)
+	}
+
+	files, err := os.ReadDir(artifactDir)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.RemoveAll(versionPathTemp)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(versionPathTemp, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+
+	defer os.RemoveAll(versionPathTemp)
+
+	var checksums []string
+	var sources []string
+	var moved []string
+	var published bool
+	imported := make(map[string]bool)
+
+	// Moved files are restored if the import fails.
+	defer func() {
+		if published {
+			return
+		}
+
+		for _, src := range moved {
+			_ = os.Rename(filepath.Join(versionPathTemp, importFileNames[filepath.Base(src)]), src)
+		}
+	}()
+
+	for _, f := range files {
+		name, ok := importFileNames[f.Name()]
+		if !ok || f.IsDir() {
+			continue
+		}
+
+		if imported[name] {
+			return "", fmt.Errorf("Multiple image files in %q map to %q", artifactDir, name)
+		}
+
+		imported[name] = true
+
+		src := filepath.Join(artifactDir, f.Name())
+		dst := filepath.Join(versionPathTemp, name)
+
+		if moveFiles && os.Rename(src, dst) == nil {
+			moved = append(moved, src)
+		} else {
+			err = linkOrCopy(src, dst, false)
+			if err != nil {
+				return "", err
+			}
+
+			sources = append(sources, src)
+		}
+
+		hashes, err := stream.FileHashes(ctx, []stream.ChecksumAlgorithm{stream.ChecksumSHA256}, dst)
+		if err != nil {
+			return "", err
+		}
+
+		checksums = append(checksums, fmt.Sprintf("%s  %s\n", hashes[stream.ChecksumSHA256], name))
+	}
+
+	if !imported[stream.ItemTypeMetadata] {
+		return "", fmt.Errorf("No metadata file found in %q", artifactDir)
+	}
+
+	if !imported["root.squashfs"] && !imported["disk.qcow2"] && !imported["disk1.img"] && !imported[stream.ItemTypeRootTarXz] {
+		return "", fmt.Errorf("No root file system found in %q", artifactDir)
+	}
+
+	slices.Sort(checksums)
+
+	err = os.WriteFile(filepath.Join(versionPathTemp, stream.FileChecksumSHA256), []byte(strings.Join(checksums, "")), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	err = writeImportImageConfig(artifactDir, filepath.Join(versionPathTemp, stream.FileImageConfig), image)
+	if err != nil {
+		return "", fmt.Errorf("Failed to write image config: %w", err)
+	}
+
+	if image.VersionMTime {
+		err = storage.NewLocal(versionPathTemp).Chtimes("", modTime)
+		if err != nil {
+			return "", fmt.Errorf("Failed to set modification times: %w", err)
+		}
+	}
+
+	err = os.Rename(versionPathTemp, versionPath)
+	if err != nil {
+		return "", err
+	}
+
+	published = true
+
+	// Files that could not be renamed are removed only once the version
+	// is published.
+	if moveFiles {
+		for _, src := range sources {
+			err := os.Remove(src)
+			if err != nil {
+				slog.Warn("Failed to remove imported file", "path", src, "error", err)
+			}
+		}
+	}
+
+	return versionPath, nil
+}
+
+// writeImportImageConfig writes the image config of the imported version. The
+// config is read from the image definition file, or the artifact directory.
+// If neither exists, a minimal config describing the image is generated.
+func writeImportImageConfig(artifactDir string, path string, image importImage) error {
+	configPath := image.Definition
+	if configPath == "" {
+		configPath = filepath.Join(artifactDir, stream.FileImageConfig)
+	}
+
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		if image.Definition != "" || !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		config := struct {
+			Image shared.DefinitionImage `yaml:"image"`
+		}{
+			Image: shared.DefinitionImage{
+				Description:  fmt.Sprintf("%s %s %s (%s)", image.Distro, image.Release, image.Arch, image.Variant),
+				Distribution: image.Distro,
+				Release:      image.Release,
+				Architecture: image.Arch,
+				Variant:      image.Variant,
+				Serial:       image.Version,
+			},
+		}
+
+		content, err = yaml.Marshal(config)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Ensure the config can be parsed when building the product catalog.
+	err = yaml.Unmarshal(content, &shared.Definition{})
+	if err != nil {
+		return fmt.Errorf("Invalid image config %q: %w", configPath, err)
+	}
+
+	return os.WriteFile(path, content, 0644)
+}
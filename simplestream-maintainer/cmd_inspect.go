@@ -0,0 +1,615 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/config"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+// Checksum states of the files within the inspected version.
+const (
+	inspectChecksumMatch       = "match"
+	inspectChecksumMismatch    = "mismatch"
+	inspectChecksumMissing     = "missing"
+	inspectChecksumNotRequired = "not-required"
+)
+
+// Delta states of the items within the inspected version.
+const (
+	inspectDeltaExists  = "exists"
+	inspectDeltaPending = "pending"
+	inspectDeltaSkipped = "skipped"
+)
+
+type inspectOptions struct {
+	global *globalOptions
+
+	StreamVersion string
+	DeltaDepth    int
+	Keyring       string
+	NoCache       bool
+	Format        string
+}
+
+func (o *inspectOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "inspect <path-to-version> [flags]",
+		Short: "Show how the build sees a single product version",
+		Long: `Show how the build sees a single product version directory.
+
+The path must point to the version directory within the image directory (for example,
+/srv/images/ubuntu/noble/amd64/cloud/20240101_0000). The root directory, stream, and product are derived
+from the path using the path schema.
+
+For each file, the detected item type, the type under which it is included in the product catalog, and the
+result of the verification against the version checksums file are shown. The verdict explains whether the
+version is published, would be added by the next build, or why it is left out (for example, because it is
+incomplete, its checksums do not match, or its previous build attempts failed). The parsed simplestream
+section of image.yaml, the aliases contributed by the version, and the base versions of the delta files
+that the build creates for the version are shown as well.
+
+The path may also be an S3 URL in the format s3://bucket/prefix/... (see the build command).`,
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringVar(&o.StreamVersion, "stream-version", "v1", "Stream version")
+	cmd.PersistentFlags().IntVar(&o.DeltaDepth, "delta-depth", 1, "Number of previous product versions against which delta (vcdiff) files are created (0 defaults to 1)")
+	cmd.PersistentFlags().StringVar(&o.Keyring, "keyring", "", "GPG keyring (as exported by \"gpg --export\") used to verify signed checksum files of the version")
+	cmd.PersistentFlags().BoolVar(&o.NoCache, "no-cache", false, "Calculate all file hashes without consulting the hash cache")
+	cmd.PersistentFlags().StringVar(&o.Format, "format", "table", "Output format (table, json)")
+
+	return cmd
+}
+
+func (o *inspectOptions) Run(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "path-to-version")
+	}
+
+	if o.Format != "table" && o.Format != "json" {
+		return fmt.Errorf("Invalid output format %q. Valid formats are: [table, json]", o.Format)
+	}
+
+	if o.DeltaDepth < 0 {
+		return fmt.Errorf("Delta depth cannot be negative")
+	}
+
+	rootDir, versionRelPath, err := splitVersionPath(args[0], o.global.pathSchema)
+	if err != nil {
+		return err
+	}
+
+	var verifier *stream.Verifier
+	if o.Keyring != "" {
+		verifier = stream.NewVerifier(o.Keyring)
+	}
+
+	result, err := inspectVersion(o.global.ctx, rootDir, o.StreamVersion, versionRelPath, o.global.pathSchema, max(o.DeltaDepth, 1), verifier, !o.NoCache)
+	if err != nil {
+		return err
+	}
+
+	return writeInspectResult(cmd.OutOrStdout(), result, o.Format)
+}
+
+// inspectFile is a single file within the inspected version directory.
+type inspectFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+
+	// Type is the item type detected from the file name.
+	Type string `json:"type"`
+
+	// Ftype is the type under which the file is included in the product
+	// catalog, or empty if the file is not an item.
+	Ftype string `json:"ftype,omitempty"`
+
+	// Checksum is the result of the verification against the version
+	// checksums file, or empty if the version has no checksums file.
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// inspectDelta is a delta file that the build creates for an item of the
+// inspected version.
+type inspectDelta struct {
+	Item   string `json:"item"`
+	Base   string `json:"base"`
+	Delta  string `json:"delta"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// inspectResult contains everything the build sees in a single version.
+type inspectResult struct {
+	Path    string `json:"path"`
+	Stream  string `json:"stream"`
+	Product string `json:"product"`
+	Version string `json:"version"`
+
+	// Published indicates whether the version is in the product catalog.
+	Published bool `json:"published"`
+
+	// Complete indicates whether the version contains the metadata and
+	// at least one root filesystem item.
+	Complete bool `json:"complete"`
+
+	// Verdict summarizes whether the version is (or will be) published.
+	Verdict string `json:"verdict"`
+
+	// Reasons contains why the version is not added to the product catalog.
+	Reasons []string `json:"reasons,omitempty"`
+
+	// Notes contains details that affect the build of the version, but do
+	// not prevent it from being added.
+	Notes []string `json:"notes,omitempty"`
+
+	ChecksumFile    string `json:"checksum_file,omitempty"`
+	ChecksumsSigned bool   `json:"checksums_signed,omitempty"`
+
+	Files []inspectFile `json:"files"`
+
+	// ImageConfig is the simplestream section of the image config file
+	// (image.yaml) in YAML format.
+	ImageConfig string `json:"image_config,omitempty"`
+
+	// Aliases contains the product aliases contributed by the version.
+	Aliases []string `json:"aliases"`
+
+	Deltas []inspectDelta `json:"deltas,omitempty"`
+
+	// Failure is the record of the previous failed build attempts of the
+	// version, if any.
+	Failure *stream.Failure `json:"failure,omitempty"`
+}
+
+// splitVersionPath splits the path of the version directory into the root
+// directory and the path of the version relative to it. The number of path
+// segments below the root directory is given by the path schema.
+func splitVersionPath(versionPath string, schema stream.PathSchema) (string, string, error) {
+	// Stream and product segments, followed by the version.
+	depth := len(strings.Split(schema.String(), "/")) + 1
+
+	split := func(p string) (string, string, bool) {
+		segments := strings.Split(strings.Trim(p, "/"), "/")
+		if len(segments) < depth || slices.Contains(segments[len(segments)-depth:], "") {
+			return "", "", false
+		}
+
+		return strings.Join(segments[:len(segments)-depth], "/"), strings.Join(segments[len(segments)-depth:], "/"), true
+	}
+
+	if storage.IsLocal(versionPath) {
+		absPath, err := filepath.Abs(versionPath)
+		if err != nil {
+			return "", "", err
+		}
+
+		rootDir, relPath, ok := split(filepath.ToSlash(absPath))
+		if !ok {
+			return "", "", fmt.Errorf("Path %q does not match the layout %q of the product version", versionPath, schema.String()+"/{version}")
+		}
+
+		return filepath.FromSlash("/" + rootDir), relPath, nil
+	}
+
+	u, err := url.Parse(versionPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	rootDir, relPath, ok := split(u.Path)
+	if !ok {
+		return "", "", fmt.Errorf("Path %q does not match the layout %q of the product version", versionPath, schema.String()+"/{version}")
+	}
+
+	u.Path = "/" + rootDir
+	return u.String(), relPath, nil
+}
+
+// inspectVersion reports how the build sees the version on the given path
+// relative to the root directory. Delta files are evaluated against the given
+// number of previous published versions. If useCache is true, file hashes of
+// unchanged files are taken from the hash cache of the stream, which is not
+// updated.
+func inspectVersion(ctx context.Context, rootDir string, streamVersion string, versionRelPath string, schema stream.PathSchema, deltaDepth int, verifier *stream.Verifier, useCache bool) (*inspectResult, error) {
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	streamName, _, _ := strings.Cut(versionRelPath, "/")
+	productRelPath, versionName := path.Split(versionRelPath)
+
+	product, err := schema.ParseProductPath(path.Clean(productRelPath))
+	if err != nil {
+		return nil, err
+	}
+
+	id := product.ID()
+
+	result := &inspectResult{
+		Path:    versionRelPath,
+		Stream:  streamName,
+		Product: id,
+		Version: versionName,
+		Aliases: stream.CreateAliases(product.Distro, product.Release, product.Variant),
+	}
+
+	files, err := b.List(versionRelPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("Version directory %q not found", versionRelPath)
+		}
+
+		return nil, err
+	}
+
+	conf, err := config.Load(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	catalogPath := path.Join("streams", streamVersion, fmt.Sprintf("%s.json", streamName))
+	catalog, err := storage.ReadJSONFile(b, catalogPath, &stream.ProductCatalog{})
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+
+		catalog = &stream.ProductCatalog{}
+	}
+
+	_, result.Published = catalog.Products[id].Versions[versionName]
+
+	var hashCache *stream.HashCache
+
+	if useCache {
+		hashCache, err = stream.LoadHashCache(rootDir, stream.HashCachePath(streamVersion, streamName))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	version, err := stream.GetVersion(ctx, rootDir, versionRelPath,
+		stream.WithIncompleteVersions(true),
+		stream.WithHashes(true),
+		stream.WithHashCache(hashCache),
+		stream.WithVerifier(verifier),
+	)
+	if err != nil {
+		if ctx.Err() != nil || (!errors.Is(err, stream.ErrVersionInvalidImageConfig) && !errors.Is(err, stream.ErrVersionInvalidSignature)) {
+			return nil, err
+		}
+
+		result.Reasons = append(result.Reasons, err.Error())
+		version = &stream.Version{}
+	}
+
+	if strings.HasPrefix(versionName, ".") {
+		result.Reasons = append(result.Reasons, "Version directory is hidden, which marks a partially uploaded version")
+	}
+
+	// Completeness requires the metadata and a root filesystem.
+	_, hasMetadata := version.Items[stream.ItemTypeMetadata]
+	hasRootFS := false
+
+	for _, item := range version.Items {
+		if slices.Contains([]string{stream.ItemTypeSquashfs, stream.ItemTypeRootTarXz, stream.ItemTypeDiskKVM, stream.ItemTypeDiskRaw}, item.Ftype) {
+			hasRootFS = true
+		}
+	}
+
+	result.Complete = hasMetadata && hasRootFS
+
+	// Items are not known if the version could not be read.
+	if version.Items != nil {
+		if !hasMetadata {
+			result.Reasons = append(result.Reasons, fmt.Sprintf("Metadata file %q is missing", stream.ItemTypeMetadata))
+		}
+
+		if !hasRootFS {
+			result.Reasons = append(result.Reasons, "Root filesystem (squashfs, tarball, qcow2, or raw disk image) is missing")
+		}
+
+		missing := version.MissingItemTypes(conf.Policy(streamName, id, config.Policy{}).RequiredItems...)
+		if len(missing) > 0 {
+			result.Complete = false
+			result.Reasons = append(result.Reasons, fmt.Sprintf("Items required by the product policy are missing: %s", strings.Join(missing, ", ")))
+		}
+	}
+
+	if version.Checksums != nil {
+		result.ChecksumFile = version.ChecksumAlgorithm.FileName()
+		result.ChecksumsSigned = version.ChecksumsSigned
+	}
+
+	// Report files in the same way the build verifies the items.
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		file := inspectFile{
+			Name: f.Name(),
+			Size: f.Size(),
+			Type: stream.FileItemType(f.Name()),
+		}
+
+		item, ok := version.Items[f.Name()]
+		if ok {
+			file.Ftype = item.Ftype
+
+			if version.Checksums != nil {
+				checksum, ok := version.Checksums[f.Name()]
+
+				switch {
+				case !ok && item.IsDelta():
+					file.Checksum = inspectChecksumNotRequired
+				case !ok:
+					file.Checksum = inspectChecksumMissing
+					result.Reasons = append(result.Reasons, fmt.Sprintf("Checksum of item %q is missing from %q", f.Name(), result.ChecksumFile))
+				case checksum != item.Hash(version.ChecksumAlgorithm):
+					file.Checksum = inspectChecksumMismatch
+					result.Reasons = append(result.Reasons, fmt.Sprintf("Checksum mismatch of item %q", f.Name()))
+				default:
+					file.Checksum = inspectChecksumMatch
+				}
+			}
+		}
+
+		result.Files = append(result.Files, file)
+	}
+
+	// Image config and the aliases it contributes.
+	hasImageConfig := slices.ContainsFunc(files, func(f fs.FileInfo) bool {
+		return f.Name() == stream.FileImageConfig
+	})
+
+	if hasImageConfig && version.Items != nil {
+		content, err := yaml.Marshal(version.ImageConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		result.ImageConfig = string(content)
+	}
+
+	for release, releaseAliases := range version.ImageConfig.ReleaseAliases {
+		if release != product.Release {
+			continue
+		}
+
+		for _, releaseAlias := range strings.Split(releaseAliases, ",") {
+			result.Aliases = append(result.Aliases, stream.CreateAliases(product.Distro, releaseAlias, product.Variant)...)
+		}
+	}
+
+	// Previous failed attempts.
+	failures, err := stream.ReadFailures(b, streamVersion, streamName)
+	if err != nil {
+		return nil, err
+	}
+
+	failure, ok := failures.Get(id, versionName)
+	if ok {
+		result.Failure = &failure
+
+		if !result.Published {
+			result.Notes = append(result.Notes, fmt.Sprintf("Previous build attempts failed (%d attempts), the version may be skipped until the retry backoff expires or its files change", failure.Attempts))
+		}
+	}
+
+	if !result.Published && conf.SmokeTest != nil && conf.SmokeTest.Includes(id) {
+		result.Notes = append(result.Notes, "Version must pass the smoke test before it is added")
+	}
+
+	result.Deltas = inspectDeltas(b, conf, streamName, id, catalog.Products[id], versionRelPath, *version, deltaDepth)
+
+	switch {
+	case result.Published:
+		result.Verdict = "Published"
+	case len(result.Reasons) == 0:
+		result.Verdict = "Added by the next build"
+	default:
+		result.Verdict = "Not added to the product catalog"
+	}
+
+	return result, nil
+}
+
+// inspectDeltas returns the delta files that the build creates for the items
+// of the version, which is added to the published versions of the product.
+// Like in the build, the delta bases are the given number of versions that
+// precede the version by name.
+func inspectDeltas(b storage.Backend, conf *config.Config, streamName string, id string, product stream.Product, versionRelPath string, version stream.Version, deltaDepth int) []inspectDelta {
+	versionDir, versionName := path.Split(versionRelPath)
+	policy := conf.Policy(streamName, id, config.Policy{})
+
+	versions := shared.MapKeys(product.Versions)
+	if !slices.Contains(versions, versionName) {
+		versions = append(versions, versionName)
+	}
+
+	slices.Sort(versions)
+
+	i := slices.Index(versions, versionName)
+	bases := versions[max(i-deltaDepth, 0):i]
+
+	itemNames := shared.MapKeys(version.Items)
+	slices.Sort(itemNames)
+
+	var deltas []inspectDelta
+
+	for _, itemName := range itemNames {
+		item := version.Items[itemName]
+		if !slices.Contains([]string{stream.ItemTypeDiskKVM, stream.ItemTypeDiskRaw, stream.ItemTypeSquashfs}, item.Ftype) {
+			continue
+		}
+
+		for _, base := range bases {
+			delta := inspectDelta{
+				Item:   itemName,
+				Base:   base,
+				Delta:  deltaItemName(version.Items, itemName, item.Ftype, base),
+				Status: inspectDeltaPending,
+			}
+
+			_, exists := version.Items[delta.Delta]
+			_, baseErr := b.Stat(path.Join(versionDir, base, itemName))
+
+			switch {
+			case exists:
+				delta.Status = inspectDeltaExists
+			case !policy.DeltasEnabled():
+				delta.Status = inspectDeltaSkipped
+				delta.Reason = "Delta files are disabled by the policy"
+			case !policy.DeltasAllowed(len(versions), item.Size):
+				delta.Status = inspectDeltaSkipped
+				delta.Reason = "Product has too few versions or the item is too small"
+			case baseErr != nil:
+				delta.Status = inspectDeltaSkipped
+				delta.Reason = "Base version does not contain the item"
+			}
+
+			deltas = append(deltas, delta)
+		}
+	}
+
+	return deltas
+}
+
+// writeInspectResult writes the inspected version in the given format (table
+// or json).
+func writeInspectResult(w io.Writer, result *inspectResult, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+
+	orDash := func(value string) string {
+		if value == "" {
+			return "-"
+		}
+
+		return value
+	}
+
+	yesNo := func(value bool) string {
+		if value {
+			return "yes"
+		}
+
+		return "no"
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Path:\t%s\n", result.Path)
+	fmt.Fprintf(tw, "Stream:\t%s\n", result.Stream)
+	fmt.Fprintf(tw, "Product:\t%s\n", result.Product)
+	fmt.Fprintf(tw, "Version:\t%s\n", result.Version)
+	fmt.Fprintf(tw, "Complete:\t%s\n", yesNo(result.Complete))
+	fmt.Fprintf(tw, "Published:\t%s\n", yesNo(result.Published))
+	fmt.Fprintf(tw, "Verdict:\t%s\n", result.Verdict)
+
+	if result.ChecksumFile != "" {
+		checksumFile := result.ChecksumFile
+		if result.ChecksumsSigned {
+			checksumFile += " (signed)"
+		}
+
+		fmt.Fprintf(tw, "Checksums:\t%s\n", checksumFile)
+	} else {
+		fmt.Fprintf(tw, "Checksums:\t-\n")
+	}
+
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	writeList := func(title string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+
+		fmt.Fprintf(w, "\n%s:\n", title)
+		for _, v := range values {
+			fmt.Fprintf(w, "  - %s\n", v)
+		}
+	}
+
+	writeList("Reasons", result.Reasons)
+	writeList("Notes", result.Notes)
+
+	if result.Failure != nil {
+		fmt.Fprintf(w, "\nLast failure:\n  Attempts: %d\n  Time: %s\n  Error: %s\n", result.Failure.Attempts, result.Failure.LastAttempt.Format(time.RFC3339), result.Failure.Error)
+	}
+
+	fmt.Fprintln(w, "\nFiles:")
+
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  NAME\tSIZE\tTYPE\tFTYPE\tCHECKSUM")
+
+	for _, f := range result.Files {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%s\n", f.Name, strconv.FormatInt(f.Size, 10), f.Type, orDash(f.Ftype), orDash(f.Checksum))
+	}
+
+	err = tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	writeList("Aliases", result.Aliases)
+
+	if result.ImageConfig != "" {
+		fmt.Fprintln(w, "\nImage config:")
+		for _, line := range strings.Split(strings.TrimSpace(result.ImageConfig), "\n") {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+	}
+
+	if len(result.Deltas) > 0 {
+		fmt.Fprintln(w, "\nDeltas:")
+
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "  ITEM\tBASE\tDELTA\tSTATUS")
+
+		for _, d := range result.Deltas {
+			status := d.Status
+			if d.Reason != "" {
+				status += " (" + d.Reason + ")"
+			}
+
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", d.Item, d.Base, d.Delta, status)
+		}
+
+		err = tw.Flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+type listOptions struct {
+	global *globalOptions
+
+	StreamVersion string
+	Streams       []string
+	Format        string
+	FromDisk      bool
+}
+
+func (o *listOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list <path> [flags]",
+		Short: "List products and their versions",
+		Long: `List products of the given streams along with their aliases, architecture, latest version, and the
+number of versions and items.
+
+By default, products are read from the published product catalogs one product at a time. With
+--from-disk, the product hierarchy on disk is listed instead, which includes the products that are not
+yet published. Latest version is determined by the version names.
+
+The path may also be an S3 URL in the format s3://bucket/prefix (see the build command).`,
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringVar(&o.StreamVersion, "stream-version", "v1", "Stream version")
+	cmd.PersistentFlags().StringSliceVar(&o.Streams, "stream", []string{"images"}, "Streams to list")
+	cmd.PersistentFlags().StringVar(&o.Format, "format", "table", "Output format (table, json, yaml)")
+	cmd.PersistentFlags().BoolVar(&o.FromDisk, "from-disk", false, "List the product hierarchy on disk instead of the published product catalogs")
+
+	return cmd
+}
+
+func (o *listOptions) Run(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
+	}
+
+	if !slices.Contains([]string{"table", "json", "yaml"}, o.Format) {
+		return fmt.Errorf("Invalid output format %q. Valid formats are: [table, json, yaml]", o.Format)
+	}
+
+	products, err := listProducts(o.global.ctx, args[0], o.StreamVersion, o.Streams, o.global.pathSchema, o.FromDisk)
+	if err != nil {
+		return err
+	}
+
+	return writeProductList(cmd.OutOrStdout(), products, o.Format)
+}
+
+// productListEntry is a single product listed by the list command.
+type productListEntry struct {
+	Stream       string   `json:"stream" yaml:"stream"`
+	Product      string   `json:"product" yaml:"product"`
+	Aliases      []string `json:"aliases" yaml:"aliases"`
+	Architecture string   `json:"arch" yaml:"arch"`
+	Latest       string   `json:"latest_version,omitempty" yaml:"latest_version,omitempty"`
+	Versions     int      `json:"versions" yaml:"versions"`
+	Items        int      `json:"items" yaml:"items"`
+}
+
+// newProductListEntry returns the list entry of the given product.
+func newProductListEntry(streamName string, id string, p stream.Product) productListEntry {
+	entry := productListEntry{
+		Stream:       streamName,
+		Product:      id,
+		Aliases:      []string{},
+		Architecture: p.Architecture,
+		Versions:     len(p.Versions),
+	}
+
+	if p.Aliases != "" {
+		entry.Aliases = strings.Split(p.Aliases, ",")
+	}
+
+	for name, version := range p.Versions {
+		if name > entry.Latest {
+			entry.Latest = name
+		}
+
+		entry.Items += len(version.Items)
+	}
+
+	return entry
+}
+
+// listProducts returns the products of the given streams sorted by the stream
+// name and product ID. Products are read from the published product catalogs,
+// or from the product hierarchy on disk if fromDisk is true.
+func listProducts(ctx context.Context, rootDir string, streamVersion string, streamNames []string, schema stream.PathSchema, fromDisk bool) ([]productListEntry, error) {
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	streamNames = slices.Clone(streamNames)
+	slices.Sort(streamNames)
+
+	var result []productListEntry
+
+	for _, streamName := range streamNames {
+		var entries []productListEntry
+
+		if fromDisk {
+			products, err := stream.GetProducts(ctx, rootDir, streamName, stream.WithPathSchema(schema))
+			if err != nil {
+				return nil, err
+			}
+
+			for id, p := range products {
+				entries = append(entries, newProductListEntry(streamName, id, p))
+			}
+		} else {
+			catalogPath := path.Join("streams", streamVersion, fmt.Sprintf("%s.json", streamName))
+
+			err := readCatalogProducts(b, catalogPath, func(id string, p stream.Product) {
+				entries = append(entries, newProductListEntry(streamName, id, p))
+			})
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil, fmt.Errorf("Product catalog %q not found", catalogPath)
+				}
+
+				return nil, fmt.Errorf("Failed to read product catalog %q: %w", catalogPath, err)
+			}
+		}
+
+		slices.SortFunc(entries, func(a productListEntry, b productListEntry) int {
+			return strings.Compare(a.Product, b.Product)
+		})
+
+		result = append(result, entries...)
+	}
+
+	return result, nil
+}
+
+// writeProductList writes the listed products in the given format (table,
+// json, or yaml).
+func writeProductList(w io.Writer, products []productListEntry, format string) error {
+	switch format {
+	case "json":
+		// Ensure an empty list is not encoded as null.
+		if products == nil {
+			products = []productListEntry{}
+		}
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(products)
+
+	case "yaml":
+		content, err := yaml.Marshal(products)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(content)
+		return err
+	}
+
+	orDash := func(value string) string {
+		if value == "" {
+			return "-"
+		}
+
+		return value
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STREAM\tPRODUCT\tALIASES\tARCH\tLATEST\tVERSIONS\tITEMS")
+
+	for _, p := range products {
+		fmt.Fprintf(tw, "%s\n", strings.Join([]string{
+			p.Stream,
+			p.Product,
+			orDash(strings.Join(p.Aliases, ",")),
+			orDash(p.Architecture),
+			orDash(p.Latest),
+			strconv.Itoa(p.Versions),
+			strconv.Itoa(p.Items),
+		}, "\t"))
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/pool"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+// legacyIndexRelPath is the path of the legacy image index relative to the
+// root of the legacy image server.
+var legacyIndexRelPath = filepath.Join("meta", "1.0", "index-system")
+
+// legacyFileNames maps the file names used by the legacy image server to the
+// file names of the corresponding items. Other files are not migrated.
+var legacyFileNames = map[string]string{
+	"lxd.tar.xz":      stream.ItemTypeMetadata,
+	"meta.tar.xz":     "meta.tar.xz",
+	"rootfs.squashfs": "root.squashfs",
+	"rootfs.tar.xz":   stream.ItemTypeRootTarXz,
+	"disk.qcow2":      "disk.qcow2",
+}
+
+type migrateOptions struct {
+	global *globalOptions
+
+	ImageDir string
+	Copy     bool
+	Workers  int
+}
+
+func (o *migrateOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "migrate <source> <path> [flags]",
+		Short: "Migrate images from the legacy image server layout",
+		Long: `Migrate images from the legacy LXC image server (images.linuxcontainers.org) layout into the product
+hierarchy expected by this tool.
+
+Images are discovered from the legacy index file (meta/1.0/index-system) if it exists, otherwise, the
+legacy images directory is traversed. Image files are renamed to the names expected by this tool, the
+SHA256SUMS file is generated, and modification times are preserved. Files are hard linked if possible,
+unless copying is requested. Versions that already exist on the target path are skipped.`,
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringVarP(&o.ImageDir, "image-dir", "d", "images", "Target image directory (relative to path argument)")
+	cmd.PersistentFlags().BoolVar(&o.Copy, "copy", false, "Copy files instead of hard linking them")
+	cmd.PersistentFlags().IntVar(&o.Workers, "workers", max(runtime.NumCPU()/2, 1), "Maximum number of concurrent operations")
+
+	return cmd
+}
+
+func (o *migrateOptions) Run(_ *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "source")
+	}
+
+	if len(args) < 2 || args[1] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
+	}
+
+	return migrateLegacyImages(o.global.ctx, args[0], args[1], o.ImageDir, o.global.pathSchema, o.Workers, o.Copy)
+}
+
+// legacyImage is a single image version of the legacy image server.
+type legacyImage struct {
+	Distro  string
+	Release string
+	Arch    string
+	Variant string
+	Serial  string
+
+	// Path of the image version directory relative to the legacy image
+	// server root.
+	RelPath string
+}
+
+// readLegacyImages returns images found on the legacy image server. Images
+// are read from the legacy index file if it exists, otherwise, the legacy
+// images directory is traversed.
+func readLegacyImages(sourceDir string) ([]legacyImage, error) {
+	file, err := os.Open(filepath.Join(sourceDir, legacyIndexRelPath))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return findLegacyImages(sourceDir)
+		}
+
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var images []legacyImage
+
+	// Each line has the format "distro;release;arch;variant;serial;path".
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		parts := strings.Split(line, ";")
+		if len(parts) != 6 {
+			return nil, fmt.Errorf("Invalid legacy index entry %q", line)
+		}
+
+		image := legacyImage{
+			Distro:  parts[0],
+			Release: parts[1],
+			Arch:    parts[2],
+			Variant: parts[3],
+			Serial:  parts[4],
+			RelPath: filepath.Clean(strings.TrimPrefix(parts[5], "/")),
+		}
+
+		// Ensure the index entry cannot reference files outside of the
+		// source and target directories.
+		for _, name := range parts[:5] {
+			if name == "" || name == "." || name == ".." || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+				return nil, fmt.Errorf("Invalid legacy index entry %q", line)
+			}
+		}
+
+		if !filepath.IsLocal(image.RelPath) {
+			return nil, fmt.Errorf("Invalid legacy index entry %q", line)
+		}
+
+		images = append(images, image)
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+// findLegacyImages traverses the legacy images directory, which has the format
+// "images/distro/release/arch/variant/serial", and returns the found images.
+func findLegacyImages(sourceDir string) ([]legacyImage, error) {
+	var images []legacyImage
+
+	imagesDir := filepath.Join(sourceDir, "images")
+
+	err := filepath.WalkDir(imagesDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		// Skip hidden directories.
+		if path != imagesDir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+
+		relPath, err := filepath.Rel(sourceDir, path)
+		if err != nil {
+			return err
+		}
+
+		parts := strings.Split(relPath, string(os.PathSeparator))
+		if len(parts) < 6 {
+			return nil
+		}
+
+		images = append(images, legacyImage{
+			Distro:  parts[1],
+			Release: parts[2],
+			Arch:    parts[3],
+			Variant: parts[4],
+			Serial:  parts[5],
+			RelPath: relPath,
+		})
+
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+// migrateLegacyImages migrates images from the legacy image server on the
+// source path into the given stream on the target path.
+func migrateLegacyImages(ctx context.Context, sourceDir string, rootDir string, streamName string, schema stream.PathSchema, workers int, copyFiles bool) error {
+	images, err := readLegacyImages(sourceDir)
+	if err != nil {
+		return fmt.Errorf("Failed to read legacy images: %w", err)
+	}
+
+	var errs []error
+	var mutex sync.Mutex
+
+	workerPool := pool.New(ctx, workers)
+
+	for _, image := range images {
+		workerPool.Submit(func() {
+			err := migrateLegacyImage(ctx, sourceDir, rootDir, streamName, schema, image, copyFiles)
+			if err != nil {
+				slog.Error("Failed to migrate legacy image", "path", image.RelPath, "error", err)
+
+				mutex.Lock()
+				errs = append(errs, err)
+				mutex.Unlock()
+			}
+		})
+	}
+
+	workerPool.Close()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Failed to migrate %d legacy images", len(errs))
+	}
+
+	return nil
+}
+
+// migrateLegacyImage migrates a single legacy image version. The version is
+// created within a hidden directory, which is renamed once all files are in
+// place, so that a partially migrated version is never published.
+func migrateLegacyImage(ctx context.Context, sourceDir string, rootDir string, streamName string, schema stream.PathSchema, image legacyImage, copyFiles bool) error {
+	srcPath := filepath.Join(sourceDir, image.RelPath)
+	product := stream.Product{Distro: image.Distro, Release: image.Release, Architecture: image.Arch, Variant: image.Variant}
+	productPath := filepath.Join(rootDir, streamName, schema.ProductRelPath(product))
+	versionPath := filepath.Join(productPath, image.Serial)
+	versionPathTemp := filepath.Join(productPath, fmt.Sprintf(".%s", image.Serial))
+
+	// Skip versions that were already migrated.
+	_, err := os.Stat(versionPath)
+	if err == nil {
+		slog.Debug("Skipping already migrated legacy image", "path", image.RelPath)
+		return nil
+	}
+
+	srcInfo, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+
+	err = os.RemoveAll(versionPathTemp)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(versionPathTemp, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(versionPathTemp)
+
+	files, err := os.ReadDir(srcPath)
+	if err != nil {
+		return err
+	}
+
+	var checksums []string
+
+	for _, f := range files {
+		name, ok := legacyFileNames[f.Name()]
+		if !ok || f.IsDir() {
+			continue
+		}
+
+		src := filepath.Join(srcPath, f.Name())
+		dst := filepath.Join(versionPathTemp, name)
+
+		info, err := f.Info()
+		if err != nil {
+			return err
+		}
+
+		err = linkOrCopy(src, dst, copyFiles)
+		if err != nil {
+			return err
+		}
+
+		err = os.Chtimes(dst, info.ModTime(), info.ModTime())
+		if err != nil {
+			return err
+		}
+
+		hashes, err := stream.FileHashes(ctx, []stream.ChecksumAlgorithm{stream.ChecksumSHA256}, dst)
+		if err != nil {
+			return err
+		}
+
+		checksums = append(checksums, fmt.Sprintf("%s  %s\n", hashes[stream.ChecksumSHA256], name))
+	}
+
+	if len(checksums) == 0 {
+		return fmt.Errorf("No image files found in %q", image.RelPath)
+	}
+
+	slices.Sort(checksums)
+
+	checksumPath := filepath.Join(versionPathTemp, stream.FileChecksumSHA256)
+	err = os.WriteFile(checksumPath, []byte(strings.Join(checksums, "")), 0644)
+	if err != nil {
+		return err
+	}
+
+	err = os.Chtimes(checksumPath, srcInfo.ModTime(), srcInfo.ModTime())
+	if err != nil {
+		return err
+	}
+
+	// Preserve modification time of the version directory, as it is used
+	// to determine the version age when pruning.
+	err = os.Chtimes(versionPathTemp, srcInfo.ModTime(), srcInfo.ModTime())
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(versionPathTemp, versionPath)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Migrated legacy image", "path", image.RelPath, "version", versionPath)
+
+	return nil
+}
+
+// linkOrCopy hard links the source file to the destination path. If hard
+// linking is not possible or copy is requested, the file is copied.
+func linkOrCopy(src string, dst string, copyFile bool) error {
+	if !copyFile {
+		err := os.Link(src, dst)
+		if err == nil {
+			return nil
+		}
+
+		slog.Debug("Failed to hard link file, copying it instead", "path", src, "error", err)
+	}
+
+	err := shared.Copy(src, dst)
+	if err != nil {
+		return err
+	}
+
+	return os.Chmod(dst, 0644)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+type migrateStreamOptions struct {
+	global *globalOptions
+
+	FromVersion  string
+	ToVersion    string
+	RemoveSource bool
+	GPGKey       string
+	GPGHomeDir   string
+	LockTimeout  time.Duration
+}
+
+func (o *migrateStreamOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "migrate-stream-version <path> [flags]",
+		Short: "Republish existing product catalogs under a new stream version",
+		Long: `Republish the index and product catalogs of the existing stream version under a new stream version
+directory (for example, streams/v1 to streams/v2). Catalogs are copied, compressed, and signed, and the
+index is written last, once all referenced catalogs are in place.
+
+During the transition period both stream versions are published, so clients that still use the old
+directory are not affected. Once they are migrated, the old stream version can be removed with
+--remove-source, and the serve command can redirect the remaining requests using --stream-redirect.`,
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringVar(&o.FromVersion, "from", "v1", "Stream version to migrate from")
+	cmd.PersistentFlags().StringVar(&o.ToVersion, "to", "", "Stream version to migrate to")
+	cmd.PersistentFlags().BoolVar(&o.RemoveSource, "remove-source", false, "Remove the index and product catalogs of the old stream version once migrated")
+	cmd.PersistentFlags().StringVar(&o.GPGKey, "gpg-key", "", "GPG key used to sign the migrated index and product catalog files")
+	cmd.PersistentFlags().StringVar(&o.GPGHomeDir, "gpg-homedir", "", "GnuPG home directory")
+	cmd.PersistentFlags().DurationVar(&o.LockTimeout, "lock-timeout", defaultLockTimeout, "Maximum time to wait for another build or prune to finish (0 fails immediately)")
+
+	return cmd
+}
+
+func (o *migrateStreamOptions) Run(_ *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
+	}
+
+	var signer *stream.Signer
+	if o.GPGKey != "" {
+		signer = stream.NewSigner(o.GPGKey, o.GPGHomeDir)
+	}
+
+	b, err := storage.New(args[0])
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockStreams(o.global.ctx, b, o.LockTimeout)
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	return migrateStreamVersion(o.global.ctx, args[0], o.FromVersion, o.ToVersion, o.RemoveSource, signer)
+}
+
+// migrateStreamVersion republishes the index and product catalogs of the
+// stream version fromVersion under the stream version toVersion. The index is
+// published only after all product catalogs are in place. If removeSource is
+// true, the index and product catalogs of the old stream version (including
+// their compressed and signed variants) are removed afterwards. If signer is
+// not nil, the published files are signed.
+func migrateStreamVersion(ctx context.Context, rootDir string, fromVersion string, toVersion string, removeSource bool, signer *stream.Signer) error {
+	if fromVersion == "" || toVersion == "" {
+		return fmt.Errorf("Both source and target stream versions are required")
+	}
+
+	if fromVersion == toVersion {
+		return fmt.Errorf("Source and target stream versions must differ")
+	}
+
+	for _, v := range []string{fromVersion, toVersion} {
+		if path.Base(v) != v || v == "." || v == ".." {
+			return fmt.Errorf("Invalid stream version %q", v)
+		}
+	}
+
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return err
+	}
+
+	fromDir := path.Join("streams", fromVersion)
+	toDir := path.Join("streams", toVersion)
+
+	index, err := storage.ReadJSONFile(b, path.Join(fromDir, "index.json"), &stream.StreamIndex{})
+	if err != nil {
+		return fmt.Errorf("Read index of stream version %q: %w", fromVersion, err)
+	}
+
+	newIndex := stream.NewStreamIndex()
+	sourceFiles := []string{path.Join(fromDir, "index.json")}
+
+	streamNames := shared.MapKeys(index.Index)
+	slices.Sort(streamNames)
+
+	for _, streamName := range streamNames {
+		entry := index.Index[streamName]
+
+		catalog, err := storage.ReadJSONFile(b, entry.Path, &stream.ProductCatalog{})
+		if err != nil {
+			return fmt.Errorf("Read product catalog %q: %w", streamName, err)
+		}
+
+		err = catalog.Validate()
+		if err != nil {
+			return fmt.Errorf("Invalid product catalog %q: %w", streamName, err)
+		}
+
+		catalogPath := path.Join(toDir, path.Base(entry.Path))
+
+		err = publishJSONFile(ctx, b, catalog, catalogPath, signer)
+		if err != nil {
+			return fmt.Errorf("Publish product catalog %q: %w", streamName, err)
+		}
+
+		// Retain the time of the last catalog update, as the catalog
+		// content has not changed.
+		newIndex.AddEntry(streamName, catalogPath, *catalog)
+		newEntry := newIndex.Index[streamName]
+		newEntry.Updated = entry.Updated
+		newIndex.Index[streamName] = newEntry
+
+		sourceFiles = append(sourceFiles, entry.Path)
+
+		slog.Info("Migrated product catalog", "streamName", streamName, "path", catalogPath)
+	}
+
+	err = newIndex.Validate()
+	if err != nil {
+		return fmt.Errorf("Invalid index: %w", err)
+	}
+
+	err = publishJSONFile(ctx, b, newIndex, path.Join(toDir, "index.json"), signer)
+	if err != nil {
+		return fmt.Errorf("Publish index file: %w", err)
+	}
+
+	if !removeSource {
+		return nil
+	}
+
+	// Remove the old index first to ensure it never references the
+	// product catalogs that no longer exist.
+	for _, name := range sourceFiles {
+		clearSigned, detached := stream.SignedPaths(name)
+
+		for _, f := range []string{name, name + ".gz", clearSigned, detached} {
+			err := b.Delete(f)
+			if err != nil {
+				return fmt.Errorf("Remove file of stream version %q: %w", fromVersion, err)
+			}
+		}
+	}
+
+	slog.Info("Removed old stream version", "path", fromDir)
+
+	return nil
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/pool"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/version"
+)
+
+type mirrorOptions struct {
+	global *globalOptions
+
+	StreamVersion  string
+	Products       []string
+	LatestOnly     bool
+	Workers        int
+	BandwidthLimit int64
+	BuildWebPage   bool
+	DirIndex       bool
+	VersionMTime   bool
+}
+
+func (o *mirrorOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "mirror <url> <path> [flags]",
+		Short: "Mirror remote simplestream server into the given path",
+		Long: `Mirror remote simplestream server into the given path.
+
+The index and product catalogs are downloaded from the remote server, followed by the files of the
+selected product versions. Each file is verified against its SHA256 hash from the product catalog.
+Interrupted downloads are resumed on the next run, and files that already exist are not downloaded
+again. Once the files are mirrored, the index is rebuilt from the local directory structure.
+
+With --version-mtime, modification times of the mirrored files and version directories are set to the
+build time parsed from the version name (in format YYYYMMDD_hhmm), which keeps pruning by age and
+removal of dangling files consistent with the source server. Versions with other names are left as
+they are. This is not supported on S3.
+
+The path may also be an S3 URL in the format s3://bucket/prefix (see the build command).`,
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringVar(&o.StreamVersion, "stream-version", "v1", "Stream version")
+	cmd.PersistentFlags().StringSliceVar(&o.Products, "product", nil, "Pattern of the product IDs to mirror (e.g. ubuntu:*:*:cloud)")
+	cmd.PersistentFlags().BoolVar(&o.LatestOnly, "latest-only", false, "Mirror only the latest version of each product")
+	cmd.PersistentFlags().IntVar(&o.Workers, "workers", 4, "Maximum number of concurrent downloads")
+	cmd.PersistentFlags().Int64Var(&o.BandwidthLimit, "bandwidth-limit", 0, "Maximum download rate in bytes per second (0 means unlimited)")
+	cmd.PersistentFlags().BoolVar(&o.BuildWebPage, "build-webpage", false, "Build index.html")
+	cmd.PersistentFlags().BoolVar(&o.DirIndex, "dir-index", false, "Write directory listing files (for hosting on object stores without directory listings)")
+	cmd.PersistentFlags().BoolVar(&o.VersionMTime, "version-mtime", false, "Set modification times of the mirrored versions to the build time from the version name")
+
+	return cmd
+}
+
+func (o *mirrorOptions) Run(_ *cobra.Command, args []string) error {
+	if len(args) < 2 || args[0] == "" || args[1] == "" {
+		return fmt.Errorf("Arguments %q and %q are required and cannot be empty", "url", "path")
+	}
+
+	if o.Workers < 1 {
+		return fmt.Errorf("At least 1 worker is required")
+	}
+
+	if o.BandwidthLimit < 0 {
+		return fmt.Errorf("Bandwidth limit cannot be negative")
+	}
+
+	for _, pattern := range o.Products {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("Invalid product pattern %q: %w", pattern, err)
+		}
+	}
+
+	streamNames, err := mirrorStreams(o.global.ctx, args[0], args[1], o.StreamVersion, mirrorSelection{
+		Products:   o.Products,
+		LatestOnly: o.LatestOnly,
+	}, o.Workers, o.BandwidthLimit, o.VersionMTime)
+	if err != nil {
+		return err
+	}
+
+	return buildIndex(o.global.ctx, args[1], o.StreamVersion, streamNames, 0, o.BuildWebPage, withDirIndex(o.DirIndex), withPathSchema(o.global.pathSchema))
+}
+
+// mirrorSelection determines which product versions are mirrored.
+type mirrorSelection struct {
+	// Products are the patterns of the product IDs. If empty, all products
+	// are selected.
+	Products []string
+
+	// LatestOnly selects only the latest version of each product.
+	LatestOnly bool
+}
+
+// selectVersions returns the names of the selected versions of the product
+// with the given ID.
+func (s mirrorSelection) selectVersions(id string, p stream.Product) []string {
+	if len(s.Products) > 0 {
+		matches := slices.ContainsFunc(s.Products, func(pattern string) bool {
+			ok, _ := path.Match(pattern, id)
+			return ok
+		})
+
+		if !matches {
+			return nil
+		}
+	}
+
+	versions := shared.MapKeys(p.Versions)
+	slices.Sort(versions)
+
+	if s.LatestOnly && len(versions) > 1 {
+		versions = versions[len(versions)-1:]
+	}
+
+	return versions
+}
+
+// rateLimiter limits the rate at which bytes are transferred. It is shared
+// among all downloads.
+type rateLimiter struct {
+	rate int64 // Bytes per second.
+
+	mutex sync.Mutex
+	next  time.Time
+}
+
+// wait blocks until n bytes can be transferred without exceeding the rate.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil || l.rate <= 0 {
+		return nil
+	}
+
+	l.mutex.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	l.mutex.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitedReader is a reader whose reads are limited by the rate limiter.
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+// Read implements io.Reader.
+func (r *limitedReader) Read(p []byte) (int, error) {
+	// Read in small chunks to keep the transfer rate smooth.
+	if len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+
+	n, err := r.r.Read(p)
+	if n > 0 {
+		waitErr := r.limiter.wait(r.ctx, n)
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	return n, err
+}
+
+// mirrorClient downloads files from the remote simplestream server.
+type mirrorClient struct {
+	baseURL string
+	client  *http.Client
+	limiter *rateLimiter
+}
+
+// get sends the GET request for the file with the given name. If offset is
+// positive, only the content after the offset is requested.
+func (c *mirrorClient) get(ctx context.Context, name string, offset int64) (*http.Response, error) {
+	u, err := url.JoinPath(c.baseURL, name)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", version.UserAgent())
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Range is not satisfiable if the whole file was already downloaded.
+	if offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return resp, nil
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("Failed to download %q: %s", u, resp.Status)
+	}
+
+	return resp, nil
+}
+
+// getJSON downloads the JSON file with the given name into the given object.
+func getJSON[T any](ctx context.Context, c *mirrorClient, name string, obj *T) (*T, error) {
+	resp, err := c.get(ctx, name, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(obj)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode %q: %w", name, err)
+	}
+
+	return obj, nil
+}
+
+// download downloads the file with the given name into the local file on
+// the given path. If the local file already exists, the download is resumed.
+// Once downloaded, the SHA256 hash of the file is verified.
+func (c *mirrorClient) download(ctx context.Context, name string, localPath string, sha256sum string) error {
+	err := os.MkdirAll(filepath.Dir(localPath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(localPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	// Hash the content downloaded so far.
+	h := sha256.New()
+
+	offset, err := io.Copy(h, file)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.get(ctx, name, offset)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return verifyHash(h, sha256sum)
+	}
+
+	if offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		// Server does not support range requests, start over.
+		slog.Debug("Restarting interrupted download", "path", name)
+		offset = 0
+		h = sha256.New()
+
+		err := file.Truncate(0)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	var body io.Reader = resp.Body
+	if c.limiter != nil {
+		body = &limitedReader{ctx: ctx, r: body, limiter: c.limiter}
+	}
+
+	// Blocks of zeros are not written, so that sparse images (for example,
+	// raw disks) remain sparse.
+	w, err := shared.NewSparseWriter(file)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(io.MultiWriter(w, h), body)
+	if err != nil {
+		return err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return verifyHash(h, sha256sum)
+}
+
+// errChecksumMismatch is returned when the downloaded file does not match
+// its hash from the product catalog.
+var errChecksumMismatch = errors.New("Checksum mismatch")
+
+// verifyHash returns an error if the hash sum does not match the expected
+// SHA256 hash.
+func verifyHash(h hash.Hash, sha256sum string) error {
+	sum := hex.EncodeToString(h.Sum(nil))
+	if sum != sha256sum {
+		return fmt.Errorf("%w: expected %q, got %q", errChecksumMismatch, sha256sum, sum)
+	}
+
+	return nil
+}
+
+// mirrorStreams mirrors the selected product versions of all streams from the
+// remote simplestream server on the given URL into rootDir. Names of the
+// mirrored streams are returned. Partially downloaded files are kept within
+// a hidden directory, so that downloads can be resumed on failure. If the
+// limit is positive, the download rate is limited to the given number of
+// bytes per second.
+func mirrorStreams(ctx context.Context, sourceURL string, rootDir string, streamVersion string, selection mirrorSelection, workers int, limit int64, versionMTime bool) ([]string, error) {
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	timeSetter, ok := b.(storage.TimeSetter)
+	if versionMTime && !ok {
+		return nil, fmt.Errorf("Setting modification times is not supported by the storage backend")
+	}
+
+	c := &mirrorClient{
+		baseURL: strings.TrimSuffix(sourceURL, "/"),
+		client:  &http.Client{},
+	}
+
+	if limit > 0 {
+		c.limiter = &rateLimiter{rate: limit}
+	}
+
+	partialDir := mirrorPartialDir(b)
+
+	// Files already present in the mirror are verified using the hash
+	// cache of the build, which avoids hashing unchanged files again.
+	var mutex sync.Mutex
+	hashCaches := make(map[string]*stream.HashCache)
+
+	indexPath := path.Join("streams", streamVersion, "index.json")
+	index, err := getJSON(ctx, c, indexPath, &stream.StreamIndex{})
+	if err != nil {
+		return nil, err
+	}
+
+	streamNames := shared.MapKeys(index.Index)
+	slices.Sort(streamNames)
+
+	workerPool := pool.New(ctx, workers)
+	defer workerPool.Close()
+
+	failed := 0
+
+	for _, streamName := range streamNames {
+		entry := index.Index[streamName]
+
+		catalog, err := getJSON(ctx, c, entry.Path, &stream.ProductCatalog{})
+		if err != nil {
+			return nil, err
+		}
+
+		err = catalog.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid product catalog %q: %w", streamName, err)
+		}
+
+		hashCache, err := stream.LoadHashCache(rootDir, stream.HashCachePath(streamVersion, streamName))
+		if err != nil {
+			return nil, err
+		}
+
+		hashCaches[streamName] = hashCache
+
+		for id, p := range catalog.Products {
+			for _, versionName := range selection.selectVersions(id, p) {
+				items := make([]stream.Item, 0, len(p.Versions[versionName].Items))
+				for _, item := range p.Versions[versionName].Items {
+					items = append(items, item)
+				}
+
+				// Metadata is mirrored last, as the version is not
+				// considered complete without it.
+				slices.SortFunc(items, func(a stream.Item, b stream.Item) int {
+					if a.Ftype == stream.ItemTypeMetadata {
+						return 1
+					}
+
+					if b.Ftype == stream.ItemTypeMetadata {
+						return -1
+					}
+
+					return strings.Compare(a.Path, b.Path)
+				})
+
+				var modTime time.Time
+				if versionMTime {
+					t, err := parseVersionTime(versionName)
+					if err != nil {
+						slog.Warn("Not setting modification time of the version", "streamName", streamName, "product", id, "version", versionName, "error", err)
+					} else {
+						modTime = t
+					}
+				}
+
+				workerPool.Submit(func() {
+					versionDirs := make(map[string]bool)
+
+					for _, item := range items {
+						versionDirs[path.Dir(item.Path)] = true
+
+						err := mirrorItem(ctx, c, b, rootDir, hashCache, partialDir, item, modTime)
+						if err != nil {
+							slog.Error("Failed to mirror item", "streamName", streamName, "product", id, "version", versionName, "path", item.Path, "error", err)
+
+							mutex.Lock()
+							failed++
+							mutex.Unlock()
+
+							return
+						}
+					}
+
+					if !modTime.IsZero() {
+						for dir := range versionDirs {
+							err := timeSetter.Chtimes(dir, modTime)
+							if err != nil {
+								slog.Warn("Failed to set modification time of the version", "streamName", streamName, "product", id, "version", versionName, "path", dir, "error", err)
+							}
+						}
+					}
+
+					slog.Info("Product version mirrored", "streamName", streamName, "product", id, "version", versionName)
+				})
+			}
+		}
+	}
+
+	workerPool.Wait()
+
+	for streamName, hashCache := range hashCaches {
+		err := hashCache.Save(rootDir)
+		if err != nil {
+			slog.Warn("Failed to save hash cache", "streamName", streamName, "error", err)
+		}
+	}
+
+	if failed > 0 {
+		return nil, fmt.Errorf("Failed to mirror %d product versions", failed)
+	}
+
+	err = os.RemoveAll(partialDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return streamNames, nil
+}
+
+// mirrorPartialDir returns the local directory in which partially downloaded
+// files are kept. For the local backend, the directory is hidden within the
+// root directory, so that files can be moved to their final destination
+// without being copied.
+func mirrorPartialDir(b storage.Backend) string {
+	l, ok := b.(*storage.Local)
+	if ok {
+		return l.Path(".mirror")
+	}
+
+	return filepath.Join(os.TempDir(), "simplestream-maintainer-mirror")
+}
+
+// mirrorItem downloads the item into the storage backend, unless a file with
+// the same size and SHA256 hash already exists. If the modification time is
+// not zero, it is set on the file, which requires the backend to implement
+// storage.TimeSetter.
+func mirrorItem(ctx context.Context, c *mirrorClient, b storage.Backend, rootDir string, hashCache *stream.HashCache, partialDir string, item stream.Item, modTime time.Time) error {
+	itemPath := filepath.ToSlash(item.Path)
+	if !filepath.IsLocal(item.Path) || strings.HasPrefix(itemPath, ".") || strings.Contains(itemPath, "/.") {
+		return fmt.Errorf("Invalid item path %q", item.Path)
+	}
+
+	setModTime := func() error {
+		if modTime.IsZero() {
+			return nil
+		}
+
+		return b.(storage.TimeSetter).Chtimes(itemPath, modTime)
+	}
+
+	info, err := b.Stat(itemPath)
+	if err == nil && info.Size() == item.Size {
+		// Modification time is set before the file is hashed, so that
+		// the hash cache remains valid.
+		if !modTime.IsZero() && !info.ModTime().Equal(modTime) {
+			err := setModTime()
+			if err != nil {
+				return err
+			}
+		}
+
+		sum, err := hashCache.FileHash(ctx, rootDir, itemPath)
+		if err == nil && sum == item.SHA256 {
+			return nil
+		}
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	partialPath := filepath.Join(partialDir, filepath.FromSlash(itemPath))
+
+	err = c.download(ctx, itemPath, partialPath, item.SHA256)
+	if err != nil {
+		// Do not resume download of the corrupted file. Otherwise, the
+		// partial file is kept to resume the download on the next run.
+		if errors.Is(err, errChecksumMismatch) {
+			_ = os.Remove(partialPath)
+		}
+
+		return err
+	}
+
+	err = storage.Publish(b, partialPath, itemPath)
+	if err != nil {
+		return err
+	}
+
+	return setModTime()
+}
@@ -1,170 +1,1487 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log/slog"
-	"os"
+	"path"
 	"path/filepath"
 	"slices"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/spf13/cobra"
 
 	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/clock"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/config"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/metrics"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
 	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/webpage"
 )
 
 type pruneOptions struct {
 	global *globalOptions
 
-	Dangling      bool
-	RetainBuilds  int
-	RetainDays    int
-	StreamVersion string
-	ImageDirs     []string
+	Dangling         bool
+	DanglingGrace    time.Duration
+	RemovedFromDisk  bool
+	RemovedGrace     time.Duration
+	RetainBuilds     int
+	RetainDays       int
+	KeepLastDaily    int
+	KeepLastWeekly   int
+	KeepLastMonthly  int
+	StreamVersion    string
+	ImageDirs        []string
+	GPGKey           string
+	GPGHomeDir       string
+	DirIndex         bool
+	LockTimeout      time.Duration
+	MaxPrunePercent  int
+	MaxOrphanedFiles int
+	Force            bool
+	Plan             bool
+	ApprovedPlan     string
+	Format           string
+
+	// flagChanged reports whether the flag with the given name was set
+	// explicitly on the command line.
+	flagChanged func(name string) bool
 }
 
 func (o *pruneOptions) NewCommand() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:     "prune <path> [flags]",
-		Short:   "Prune product versions",
-		Long:    "Prune product versions except for latest retaining only the specific number of latest ones.",
+		Use:   "prune <path> [flags]",
+		Short: "Prune product versions",
+		Long: `Prune product versions except for latest retaining only the specific number of latest ones.
+
+To protect against misconfigured retention or incomplete product catalogs, prune refuses to remove more
+than --max-prune-percent of the product versions of a stream in one run, and reports the number of
+versions that would be removed for each reason. Likewise, it refuses to remove more than
+--max-orphaned-files orphaned files from a single product version. Use --force to prune them anyway.
+
+Prune first computes a plan of the deletions, along with their reasons and sizes, and then executes it.
+With --plan, the plan is only printed and nothing is modified. A plan printed with "--format json" can
+be reviewed and passed to --approved-plan, in which case prune proceeds only if it would still perform
+exactly the same deletions.
+
+The path may also be an S3 URL in the format s3://bucket/prefix (see the build command).`,
 		GroupID: "main",
 		RunE:    o.Run,
 	}
 
-	cmd.PersistentFlags().BoolVar(&o.Dangling, "dangling", false, "Remove dangling product versions (not referenced from any product catalog)")
+	cmd.PersistentFlags().BoolVar(&o.Dangling, "dangling", false, "Remove dangling product versions (not referenced from any product catalog) and orphaned files within the referenced ones (overrides prune_dangling from the config file if set)")
+	cmd.PersistentFlags().DurationVar(&o.DanglingGrace, "dangling-grace", 6*time.Hour, "Minimum age of dangling product versions and orphaned files before they are removed (overrides dangling_grace from the config file if set)")
+	cmd.PersistentFlags().BoolVar(&o.RemovedFromDisk, "products-removed-from-disk", false, "Remove product versions whose directories no longer exist from the product catalog")
+	cmd.PersistentFlags().DurationVar(&o.RemovedGrace, "removed-grace", 24*time.Hour, "Time for which the product version must be missing before it is removed from the product catalog")
 	cmd.PersistentFlags().IntVar(&o.RetainBuilds, "retain-builds", 10, "Maximum number of product versions to retain")
 	cmd.PersistentFlags().IntVar(&o.RetainDays, "retain-days", 0, "Maximum number of days to retain any product version")
+	cmd.PersistentFlags().IntVar(&o.KeepLastDaily, "keep-last-daily", 0, "Number of most recent days for which the latest product version is retained")
+	cmd.PersistentFlags().IntVar(&o.KeepLastWeekly, "keep-last-weekly", 0, "Number of most recent weeks for which the latest product version is retained")
+	cmd.PersistentFlags().IntVar(&o.KeepLastMonthly, "keep-last-monthly", 0, "Number of most recent months for which the latest product version is retained")
 	cmd.PersistentFlags().StringVar(&o.StreamVersion, "stream-version", "v1", "Stream version")
 	cmd.PersistentFlags().StringSliceVarP(&o.ImageDirs, "image-dir", "d", []string{"images"}, "Image directory (relative to path argument)")
+	cmd.PersistentFlags().StringVar(&o.GPGKey, "gpg-key", "", "GPG key used to sign the modified product catalog files")
+	cmd.PersistentFlags().StringVar(&o.GPGHomeDir, "gpg-homedir", "", "GPG home directory")
+	cmd.PersistentFlags().BoolVar(&o.DirIndex, "dir-index", false, "Update directory listing files after pruning")
+	cmd.PersistentFlags().DurationVar(&o.LockTimeout, "lock-timeout", defaultLockTimeout, "Maximum time to wait for another build or prune to finish (0 fails immediately)")
+	cmd.PersistentFlags().IntVar(&o.MaxPrunePercent, "max-prune-percent", defaultMaxPrunePercent, "Maximum percentage of product versions of a stream removed in one run (0 means no limit)")
+	cmd.PersistentFlags().IntVar(&o.MaxOrphanedFiles, "max-orphaned-files", defaultMaxOrphanedFiles, "Maximum number of orphaned files removed from a single product version in one run (0 means no limit)")
+	cmd.PersistentFlags().BoolVar(&o.Force, "force", false, "Prune even if more product versions or orphaned files than allowed by --max-prune-percent and --max-orphaned-files are removed")
+	cmd.PersistentFlags().BoolVar(&o.Plan, "plan", false, "Print the prune plan without pruning anything")
+	cmd.PersistentFlags().StringVar(&o.ApprovedPlan, "approved-plan", "", "File with the approved prune plan (JSON) that must match the computed plan")
+	cmd.PersistentFlags().StringVar(&o.Format, "format", "table", "Output format of the prune plan (table, json)")
+
+	o.flagChanged = cmd.PersistentFlags().Changed
 
 	return cmd
 }
 
-func (o *pruneOptions) Run(_ *cobra.Command, args []string) error {
+func (o *pruneOptions) Run(cmd *cobra.Command, args []string) error {
 	if len(args) < 1 || args[0] == "" {
 		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
 	}
 
+	if o.MaxPrunePercent < 0 || o.MaxPrunePercent > 100 {
+		return fmt.Errorf("Maximum prune percentage must be within range [0, 100]")
+	}
+
+	if o.MaxOrphanedFiles < 0 {
+		return fmt.Errorf("Maximum number of orphaned files cannot be negative")
+	}
+
+	if o.Plan && o.ApprovedPlan != "" {
+		return fmt.Errorf("Flags %q and %q cannot be used together", "--plan", "--approved-plan")
+	}
+
+	if o.Plan {
+		if o.Format != "table" && o.Format != "json" {
+			return fmt.Errorf("Invalid output format %q. Valid formats are: [table, json]", o.Format)
+		}
+
+		plan, err := o.plan(o.global.ctx, args[0])
+		if err != nil {
+			return err
+		}
+
+		return writePrunePlan(cmd.OutOrStdout(), plan, o.Format)
+	}
+
+	var approved *prunePlan
+	if o.ApprovedPlan != "" {
+		var err error
+
+		approved, err = shared.ReadJSONFile(o.ApprovedPlan, &prunePlan{})
+		if err != nil {
+			return fmt.Errorf("Failed to read approved prune plan: %w", err)
+		}
+	}
+
+	err := o.prune(o.global.ctx, args[0], approved)
+	recordCommand(args[0], "prune", cmd, args, err)
+
+	return err
+}
+
+// flagPolicy returns the policy consisting of the prune flags that were set
+// explicitly on the command line.
+func (o *pruneOptions) flagPolicy() config.Policy {
+	var policy config.Policy
+
+	if o.flagChanged == nil {
+		return policy
+	}
+
+	if o.flagChanged("dangling") {
+		policy.PruneDangling = &o.Dangling
+	}
+
+	if o.flagChanged("dangling-grace") {
+		policy.DanglingGrace = &o.DanglingGrace
+	}
+
+	return policy
+}
+
+// plan computes the prune plan of the streams on the given path as configured
+// by the command flags, without modifying the streams.
+func (o *pruneOptions) plan(ctx context.Context, rootDir string) (*prunePlan, error) {
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return o.planStreams(ctx, rootDir, b)
+}
+
+// planStreams computes the prune plan of all image directories.
+func (o *pruneOptions) planStreams(ctx context.Context, rootDir string, b storage.Backend) (*prunePlan, error) {
+	conf, err := config.Load(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	guard := pruneGuard{MaxPercent: o.MaxPrunePercent, MaxOrphanedFiles: o.MaxOrphanedFiles, Force: o.Force}
+	plan := newPrunePlan(o.StreamVersion)
+
 	for _, dir := range o.ImageDirs {
-		if o.Dangling {
-			err := pruneDanglingProductVersions(args[0], o.StreamVersion, dir)
+		// Settings from the config file take precedence over the flag
+		// defaults, but not over the flags set explicitly.
+		policy := conf.Policy(dir, "", config.Policy{PruneDangling: &o.Dangling, DanglingGrace: &o.DanglingGrace})
+		policy = policy.Merge(o.flagPolicy())
+
+		steps := pruneSteps{
+			RemovedFromDisk: o.RemovedFromDisk,
+			RemovedGrace:    o.RemovedGrace,
+			Dangling:        *policy.PruneDangling,
+			DanglingGrace:   *policy.DanglingGrace,
+			Retention:       true,
+			RetainBuilds:    o.RetainBuilds,
+			RetainDays:      o.RetainDays,
+			GFS:             o.gfsRetention(),
+		}
+
+		s, err := planStreamPrune(ctx, rootDir, b, conf, o.StreamVersion, dir, o.global.pathSchema, steps, guard)
+		if err != nil {
+			return nil, err
+		}
+
+		plan.add(s)
+	}
+
+	err = plan.countHardLinks(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+// prune prunes the streams on the given path as configured by the command
+// flags. If approved is not nil, the streams are pruned only if the computed
+// plan matches the approved one.
+func (o *pruneOptions) prune(ctx context.Context, rootDir string, approved *prunePlan) error {
+	var signer *stream.Signer
+	if o.GPGKey != "" {
+		signer = stream.NewSigner(o.GPGKey, o.GPGHomeDir)
+	}
+
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockStreams(ctx, b, o.LockTimeout)
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	plan, err := o.planStreams(ctx, rootDir, b)
+	if err != nil {
+		return err
+	}
+
+	if approved != nil && !plan.matches(approved) {
+		return fmt.Errorf("Prune plan has changed since it was approved (%d deletions planned, %d approved)", len(plan.Deletions), len(approved.Deletions))
+	}
+
+	err = plan.execute(ctx, b, signer)
+	if err != nil {
+		return err
+	}
+
+	err = pruneEmptyDirs(rootDir, true)
+	if err != nil {
+		return err
+	}
+
+	if o.DirIndex {
+		err := stream.WriteDirIndexes(rootDir)
+		if err != nil {
+			return fmt.Errorf("Failed to write directory listings: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// defaultMaxPrunePercent is the default maximum percentage of product versions
+// of a stream that are removed in one run.
+const defaultMaxPrunePercent = 30
+
+// defaultMaxOrphanedFiles is the default maximum number of orphaned files
+// removed from a single product version in one run.
+const defaultMaxOrphanedFiles = 10
+
+// pruneGuard protects streams from being wiped out by a single prune, for
+// example, due to a misconfigured retention or an incomplete product catalog.
+type pruneGuard struct {
+	// MaxPercent is the maximum percentage of the product versions of a
+	// stream that can be removed in one run. Zero means no limit.
+	MaxPercent int
+
+	// MaxOrphanedFiles is the maximum number of orphaned files removed from
+	// a single product version in one run. Zero means no limit.
+	MaxOrphanedFiles int
+
+	// Force allows exceeding the limits, in which case a warning is logged.
+	Force bool
+}
+
+// check ensures that removing the given number of the total product versions
+// of the stream does not exceed the limit. Reasons map the causes of removal
+// to the number of affected versions, and are reported along with the counts
+// if the limit is exceeded.
+func (g pruneGuard) check(streamName string, removed int, total int, reasons map[string]int) error {
+	if g.MaxPercent <= 0 || removed == 0 || removed*100 <= g.MaxPercent*total {
+		return nil
+	}
+
+	causes := shared.MapKeys(reasons)
+	slices.Sort(causes)
+
+	for i, cause := range causes {
+		causes[i] = fmt.Sprintf("%s: %d", cause, reasons[cause])
+	}
+
+	percent := 100
+	if total > 0 {
+		percent = removed * 100 / total
+	}
+
+	if g.Force {
+		slog.Warn("Pruning more product versions than allowed, because force is set", "streamName", streamName, "removed", removed, "total", total, "percent", percent, "limit", g.MaxPercent, "reasons", strings.Join(causes, ", "))
+		return nil
+	}
+
+	return fmt.Errorf("Refusing to prune %d of %d product versions (%d%%) of stream %q, which exceeds the limit of %d%% (%s). Use --force to prune them anyway", removed, total, percent, streamName, g.MaxPercent, strings.Join(causes, ", "))
+}
+
+// checkOrphaned ensures that the number of orphaned files removed from any
+// product version does not exceed the limit. Orphaned maps the paths of the
+// product versions to the number of their orphaned files. Many orphaned files
+// within a single version more likely indicate an incomplete checksums file
+// than leftovers.
+func (g pruneGuard) checkOrphaned(streamName string, orphaned map[string]int) error {
+	if g.MaxOrphanedFiles <= 0 {
+		return nil
+	}
+
+	var exceeded []string
+	for versionPath, count := range orphaned {
+		if count > g.MaxOrphanedFiles {
+			exceeded = append(exceeded, fmt.Sprintf("%s: %d", versionPath, count))
+		}
+	}
+
+	if len(exceeded) == 0 {
+		return nil
+	}
+
+	slices.Sort(exceeded)
+
+	if g.Force {
+		slog.Warn("Pruning more orphaned files than allowed, because force is set", "streamName", streamName, "limit", g.MaxOrphanedFiles, "versions", strings.Join(exceeded, ", "))
+		return nil
+	}
+
+	return fmt.Errorf("Refusing to prune orphaned files of stream %q, which exceeds the limit of %d files per product version (%s). Use --force to prune them anyway", streamName, g.MaxOrphanedFiles, strings.Join(exceeded, ", "))
+}
+
+// gfsRetention returns the grandfather-father-son retention configured
+// through the command flags.
+func (o *pruneOptions) gfsRetention() gfsRetention {
+	return gfsRetention{
+		Daily:   o.KeepLastDaily,
+		Weekly:  o.KeepLastWeekly,
+		Monthly: o.KeepLastMonthly,
+	}
+}
+
+// gfsRetention defines the number of most recent days, weeks, and months
+// for which the latest product version is retained.
+type gfsRetention struct {
+	Daily   int
+	Weekly  int
+	Monthly int
+}
+
+// retainedVersions returns the set of versions that are retained by the
+// grandfather-father-son policy. Versions must be sorted from the newest to
+// the oldest. For each of the most recent days, weeks (ISO), and months in
+// which at least one version was built, the newest version is retained.
+func (r gfsRetention) retainedVersions(versions []string, versionTime func(version string) (time.Time, error)) (map[string]bool, error) {
+	retained := make(map[string]bool)
+	if r.Daily <= 0 && r.Weekly <= 0 && r.Monthly <= 0 {
+		return retained, nil
+	}
+
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	months := make(map[string]bool)
+
+	for _, v := range versions {
+		t, err := versionTime(v)
+		if err != nil {
+			return nil, err
+		}
+
+		t = t.UTC()
+		year, week := t.ISOWeek()
+
+		day := t.Format("2006-01-02")
+		if !days[day] && len(days) < r.Daily {
+			retained[v] = true
+		}
+
+		days[day] = true
+
+		weekKey := fmt.Sprintf("%d-W%02d", year, week)
+		if !weeks[weekKey] && len(weeks) < r.Weekly {
+			retained[v] = true
+		}
+
+		weeks[weekKey] = true
+
+		month := t.Format("2006-01")
+		if !months[month] && len(months) < r.Monthly {
+			retained[v] = true
+		}
+
+		months[month] = true
+	}
+
+	return retained, nil
+}
+
+// Types of the deletions of the prune plan.
+const (
+	// pruneTypeCatalog removes the product or version from the product
+	// catalog, as its files no longer exist.
+	pruneTypeCatalog = "catalog"
+
+	// pruneTypeDangling removes the files of the product or version that is
+	// not referenced from the product catalog, or the orphaned file within
+	// the referenced version.
+	pruneTypeDangling = "dangling"
+
+	// pruneTypeVersion removes the version from the product catalog along
+	// with its files.
+	pruneTypeVersion = "version"
+
+	// pruneTypeItem removes the item from the product catalog along with
+	// its file.
+	pruneTypeItem = "item"
+)
+
+// pruneDeletion is a single deletion of the prune plan.
+type pruneDeletion struct {
+	Stream  string `json:"stream"`
+	Product string `json:"product"`
+	Version string `json:"version,omitempty"`
+	Path    string `json:"path"`
+	Type    string `json:"type"`
+	Reason  string `json:"reason"`
+
+	// Size is the number of bytes freed by the deletion.
+	Size int64 `json:"size"`
+
+	// KeepFiles indicates that only the product catalog entry is removed,
+	// because its files are still referenced by another version.
+	KeepFiles bool `json:"keep_files,omitempty"`
+}
+
+// prunePlan lists the deletions of a prune, which are computed before
+// anything is pruned, so that they can be reviewed before the plan is
+// executed.
+type prunePlan struct {
+	StreamVersion string          `json:"stream_version"`
+	Deletions     []pruneDeletion `json:"deletions"`
+
+	// Size is the total number of bytes freed by the deletions.
+	Size int64 `json:"size"`
+
+	// streams holds the planned state of the streams, which is written
+	// once the plan is executed.
+	streams []*streamPrune
+}
+
+func newPrunePlan(streamVersion string) *prunePlan {
+	return &prunePlan{
+		StreamVersion: streamVersion,
+		Deletions:     []pruneDeletion{},
+	}
+}
+
+// add adds the planned prune of the stream to the plan.
+func (p *prunePlan) add(s *streamPrune) {
+	p.streams = append(p.streams, s)
+	p.Deletions = append(p.Deletions, s.deletions...)
+
+	for _, d := range s.deletions {
+		p.Size += d.Size
+	}
+}
+
+// countHardLinks adjusts the sizes of the deletions for the hard linked files
+// (e.g. deduplicated items). Space of such file is freed only if all of its
+// links are deleted, in which case it is counted only for the first deletion
+// that removes the file. Only local files are checked.
+func (p *prunePlan) countHardLinks(b storage.Backend) error {
+	_, ok := b.(*storage.Local)
+	if !ok {
+		return nil
+	}
+
+	type linkedFile struct {
+		links int
+		size  int64
+
+		// Indices of the deletions that remove a link of the file.
+		deletions []int
+	}
+
+	files := make(map[shared.FileID]*linkedFile)
+	seen := make(map[string]bool)
+
+	for i, d := range p.Deletions {
+		if d.Type == pruneTypeCatalog || d.KeepFiles || d.Size == 0 {
+			continue
+		}
+
+		visit := func(name string, info fs.FileInfo) error {
+			id, links, ok := shared.FileLinks(info)
+			if !ok || links < 2 || seen[name] {
+				return nil
+			}
+
+			seen[name] = true
+
+			f, ok := files[id]
+			if !ok {
+				f = &linkedFile{links: int(links), size: info.Size()}
+				files[id] = f
+			}
+
+			f.deletions = append(f.deletions, i)
+			return nil
+		}
+
+		info, err := b.Stat(d.Path)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+
+			return err
+		}
+
+		if info.IsDir() {
+			err = walkFiles(b, d.Path, visit)
+		} else {
+			err = visit(d.Path, info)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, f := range files {
+		deletions := f.deletions
+		if len(deletions) >= f.links {
+			// Last link is deleted, therefore, the space is freed
+			// by the first deletion.
+			deletions = deletions[1:]
+		}
+
+		for _, i := range deletions {
+			p.Deletions[i].Size = max(p.Deletions[i].Size-f.size, 0)
+		}
+	}
+
+	p.Size = 0
+	for _, d := range p.Deletions {
+		p.Size += d.Size
+	}
+
+	return nil
+}
+
+// matches returns true if the plan performs the same deletions as the other
+// plan.
+func (p *prunePlan) matches(other *prunePlan) bool {
+	return p.StreamVersion == other.StreamVersion && slices.Equal(p.Deletions, other.Deletions)
+}
+
+// execute writes the planned state of the streams and deletes the planned
+// files. If signer is not nil, the modified product catalogs are signed.
+func (p *prunePlan) execute(ctx context.Context, b storage.Backend, signer *stream.Signer) error {
+	for _, s := range p.streams {
+		err := s.execute(ctx, b, p.StreamVersion, signer)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writePrunePlan writes the prune plan in the given format. Table lists the
+// deletions followed by the total size.
+func writePrunePlan(w io.Writer, plan *prunePlan, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plan)
+	}
+
+	orDash := func(value string) string {
+		if value == "" {
+			return "-"
+		}
+
+		return value
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STREAM\tPRODUCT\tVERSION\tTYPE\tREASON\tSIZE\tPATH")
+
+	for _, d := range plan.Deletions {
+		// Deletions that only modify the product catalog free no space.
+		size := "-"
+		if d.Type != pruneTypeCatalog && !d.KeepFiles {
+			size = webpage.FormatSize(d.Size)
+		}
+
+		fmt.Fprintf(tw, "%s\n", strings.Join([]string{
+			d.Stream,
+			orDash(d.Product),
+			orDash(d.Version),
+			d.Type,
+			d.Reason,
+			size,
+			d.Path,
+		}, "\t"))
+	}
+
+	fmt.Fprintf(tw, "TOTAL\t\t\t\t\t%s\t\n", webpage.FormatSize(plan.Size))
+
+	return tw.Flush()
+}
+
+// pruneSteps defines the steps of the stream prune.
+type pruneSteps struct {
+	// RemovedFromDisk removes the product versions whose directories no
+	// longer exist from the product catalog, once they have been missing
+	// for longer than RemovedGrace.
+	RemovedFromDisk bool
+	RemovedGrace    time.Duration
+
+	// Dangling removes the product versions that are not referenced from
+	// the product catalog, once they are older than DanglingGrace.
+	Dangling      bool
+	DanglingGrace time.Duration
+
+	// Retention removes the product versions and items that are not
+	// retained by the retention policies.
+	Retention    bool
+	RetainBuilds int
+	RetainDays   int
+	GFS          gfsRetention
+}
+
+// streamPrune is the planned prune of a single stream. Planning steps modify
+// the product catalog in memory and record the deletions, while nothing is
+// written until the plan is executed.
+type streamPrune struct {
+	streamName  string
+	catalogPath string
+	catalog     *stream.ProductCatalog
+	published   stream.PublishedTimes
+	now         time.Time
+	deletions   []pruneDeletion
+
+	// publishCatalog indicates that the product catalog was modified, and
+	// updateIndex that the index must no longer list the removed products.
+	publishCatalog bool
+	updateIndex    bool
+
+	// reconciled indicates that the product catalog was reconciled with
+	// the directory structure. Paths that are still within the grace period
+	// are kept in missing along with the time when they were first found
+	// missing, and written to the state file if writeMissing is set.
+	reconciled   bool
+	statePath    string
+	missing      map[string]time.Time
+	writeMissing bool
+
+	// totalVersions is the number of product versions of the stream, and
+	// removedVersions the number of versions removed by all steps per
+	// reason. Both are checked by the guard once all steps are planned.
+	totalVersions   int
+	removedVersions map[string]int
+
+	// orphanedFiles is the number of orphaned files removed from each
+	// product version, keyed by the version path.
+	orphanedFiles map[string]int
+}
+
+// removeVersions records that n product versions are removed for the given
+// reason.
+func (s *streamPrune) removeVersions(reason string, n int) {
+	if n > 0 {
+		s.removedVersions[reason] += n
+	}
+}
+
+// planStreamPrune computes the prune of the stream by running the given steps
+// on the product catalog in memory. The product catalog is reconciled first,
+// as the remaining steps expect the referenced versions to exist. The versions
+// removed by all steps are checked by the guard together, and an error is
+// returned if they exceed its limit.
+func planStreamPrune(ctx context.Context, rootDir string, b storage.Backend, conf *config.Config, streamVersion string, streamName string, schema stream.PathSchema, steps pruneSteps, guard pruneGuard) (*streamPrune, error) {
+	if steps.Retention && steps.RetainBuilds < 1 {
+		return nil, fmt.Errorf("At least 1 product version build must be retained")
+	}
+
+	catalogPath := path.Join("streams", streamVersion, fmt.Sprintf("%s.json", streamName))
+	catalog, err := storage.ReadJSONFile(b, catalogPath, &stream.ProductCatalog{})
+	if err != nil {
+		return nil, err
+	}
+
+	// Publish times take precedence over the version names and the
+	// modification times when determining the age of the version.
+	published, err := stream.ReadPublishedTimes(b, streamVersion, streamName)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &streamPrune{
+		streamName:  streamName,
+		catalogPath: catalogPath,
+		catalog:     catalog,
+		published:   published,
+		now:         clock.FromContext(ctx).Now(),
+
+		removedVersions: make(map[string]int),
+		orphanedFiles:   make(map[string]int),
+	}
+
+	// Versions are counted before any of the steps removes them from the
+	// product catalog.
+	for _, p := range catalog.Products {
+		s.totalVersions += len(p.Versions)
+	}
+
+	if steps.RemovedFromDisk {
+		err := s.planRemovedProducts(b, streamVersion, schema, steps.RemovedGrace)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if steps.Dangling {
+		err := s.planDangling(ctx, rootDir, b, schema, steps.DanglingGrace)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if steps.Retention {
+		err := s.planRetention(b, conf, schema, steps.RetainBuilds, steps.RetainDays, steps.GFS)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	removed := 0
+	for _, n := range s.removedVersions {
+		removed += n
+	}
+
+	err = guard.check(s.streamName, removed, s.totalVersions, s.removedVersions)
+	if err != nil {
+		return nil, err
+	}
+
+	err = guard.checkOrphaned(s.streamName, s.orphanedFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// pruneStream plans the given steps of the stream prune and executes them.
+// If signer is not nil, the modified product catalog is signed.
+func pruneStream(ctx context.Context, rootDir string, streamVersion string, streamName string, schema stream.PathSchema, steps pruneSteps, guard pruneGuard, signer *stream.Signer) (*streamPrune, error) {
+	conf, err := config.Load(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := planStreamPrune(ctx, rootDir, b, conf, streamVersion, streamName, schema, steps, guard)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.execute(ctx, b, streamVersion, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// execute writes the planned state of the stream and deletes the files of
+// the planned deletions. Failed deletions are logged, but do not fail the
+// prune. If signer is not nil, the modified product catalog is signed.
+func (s *streamPrune) execute(ctx context.Context, b storage.Backend, streamVersion string, signer *stream.Signer) error {
+	if s.publishCatalog {
+		err := publishJSONFile(ctx, b, s.catalog, s.catalogPath, signer)
+		if err != nil {
+			return fmt.Errorf("Publish product catalog file: %w", err)
+		}
+
+		err = retainPublishedTimes(b, streamVersion, s.streamName, s.published, s.catalog)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.updateIndex {
+		// Ensure the index no longer lists the removed products.
+		indexPath := path.Join("streams", streamVersion, "index.json")
+		index, err := storage.ReadJSONFile(b, indexPath, &stream.StreamIndex{})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		if index != nil {
+			entry, ok := index.Index[s.streamName]
+			if ok {
+				index.AddEntryAt(s.streamName, entry.Path, *s.catalog, s.now)
+
+				err = publishJSONFile(ctx, b, index, indexPath, signer)
+				if err != nil {
+					return fmt.Errorf("Publish index file: %w", err)
+				}
+			}
+		}
+	}
+
+	// Persist the paths that are still within the grace period.
+	if s.writeMissing {
+		content, err := json.Marshal(s.missing)
+		if err != nil {
+			return err
+		}
+
+		err = storage.WriteFile(b, s.statePath, content)
+		if err != nil {
+			return fmt.Errorf("Failed to write missing product versions: %w", err)
+		}
+	}
+
+	removed := 0
+
+	for _, d := range s.deletions {
+		switch d.Type {
+		case pruneTypeCatalog:
+			if d.Version == "" {
+				slog.Info("Removed product missing from disk from the product catalog", "streamName", s.streamName, "product", d.Product, "path", d.Path)
+			} else {
+				slog.Info("Removed product version missing from disk from the product catalog", "streamName", s.streamName, "product", d.Product, "version", d.Version, "path", d.Path)
+			}
+
+			removed++
+			metrics.Pruned.Inc(s.streamName, "catalog")
+		case pruneTypeDangling:
+			err := b.Delete(d.Path)
 			if err != nil {
-				return err
+				slog.Error("Failed to prune dangling resource", "path", d.Path, "error", err)
+				continue // Do not error out.
+			}
+
+			slog.Info("Pruned dangling resource", "path", d.Path)
+			metrics.Pruned.Inc(s.streamName, "dangling")
+		case pruneTypeVersion:
+			if d.KeepFiles {
+				slog.Info("Retaining files of the pruned product version referenced by another version", "path", d.Path)
+				continue
 			}
+
+			err := b.Delete(d.Path)
+			if err != nil {
+				slog.Error("Failed to prune old product version", "path", d.Path, "error", err)
+				continue // Do not error out.
+			}
+
+			slog.Info("Pruned old product version", "path", d.Path)
+			metrics.Pruned.Inc(s.streamName, "version")
+		case pruneTypeItem:
+			if d.KeepFiles {
+				continue
+			}
+
+			err := b.Delete(d.Path)
+			if err != nil {
+				slog.Error("Failed to prune old product version item", "path", d.Path, "error", err)
+				continue // Do not error out.
+			}
+
+			slog.Info("Pruned old product version item", "path", d.Path)
+			metrics.Pruned.Inc(s.streamName, "item")
 		}
+	}
+
+	if s.reconciled {
+		slog.Info("Reconciled product catalog with the directory structure", "streamName", s.streamName, "removed", removed)
+	}
+
+	return nil
+}
 
-		err := pruneStreamProductVersions(args[0], o.StreamVersion, dir, o.RetainBuilds, o.RetainDays)
-		if err != nil {
-			return err
+// deletionPaths returns the paths of the planned deletions of the given type.
+func (s *streamPrune) deletionPaths(deletionType string) []string {
+	var paths []string
+
+	for _, d := range s.deletions {
+		if d.Type == deletionType {
+			paths = append(paths, d.Path)
 		}
 	}
 
-	return pruneEmptyDirs(args[0], true)
+	return paths
 }
 
 // pruneStreamProductVersions reads the product catalog and removes all product
 // versions except for the number of latests versions defined by retain integer.
-func pruneStreamProductVersions(rootDir string, streamVersion string, streamName string, retainBuilds int, retainDays int) error {
-	if retainBuilds < 1 {
-		return fmt.Errorf("At least 1 product version build must be retained")
+// The retainBuilds and retainDays are overridden by the stream and product
+// policies from the config file, if set. Policies may also limit the number
+// of versions in which items of a certain type are retained, in which case
+// the individual items are removed from older versions. Versions retained by
+// the grandfather-father-son policy are kept even if they are outside the
+// retainBuilds. Nothing is pruned if the number of discarded versions exceeds
+// the limit of the guard. If signer is not nil, the modified product catalog
+// is signed.
+func pruneStreamProductVersions(ctx context.Context, rootDir string, streamVersion string, streamName string, schema stream.PathSchema, retainBuilds int, retainDays int, gfs gfsRetention, guard pruneGuard, signer *stream.Signer) error {
+	steps := pruneSteps{
+		Retention:    true,
+		RetainBuilds: retainBuilds,
+		RetainDays:   retainDays,
+		GFS:          gfs,
 	}
 
-	// Read product catalog.
-	catalogPath := filepath.Join(rootDir, "streams", streamVersion, fmt.Sprintf("%s.json", streamName))
-	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
-	if err != nil {
-		return err
+	_, err := pruneStream(ctx, rootDir, streamVersion, streamName, schema, steps, guard, signer)
+	return err
+}
+
+// planRetention plans the removal of the product versions and items that are
+// not retained by the retention policies (see pruneStreamProductVersions).
+// Files of the discarded versions and items that are still referenced by the
+// retained versions are kept.
+func (s *streamPrune) planRetention(b storage.Backend, conf *config.Config, schema stream.PathSchema, retainBuilds int, retainDays int, gfs gfsRetention) error {
+	basePolicy := config.Policy{
+		RetainBuilds:    &retainBuilds,
+		RetainDays:      &retainDays,
+		KeepLastDaily:   &gfs.Daily,
+		KeepLastWeekly:  &gfs.Weekly,
+		KeepLastMonthly: &gfs.Monthly,
 	}
 
-	// Find versions that need to be discarded.
-	var discardVersions []string
+	// Find versions and items that need to be discarded.
+	var discarded []pruneDeletion
 
-	for id, p := range catalog.Products {
-		productPath := filepath.Join(rootDir, streamName, p.RelPath())
+	for id, p := range s.catalog.Products {
+		productPath := path.Join(s.streamName, schema.ProductRelPath(p))
+
+		policy := conf.Policy(s.streamName, id, basePolicy)
+		retainBuilds := *policy.RetainBuilds
+		retainDays := *policy.RetainDays
 
 		versions := shared.MapKeys(p.Versions)
 		slices.Sort(versions)
 		slices.Reverse(versions)
 
+		retention := gfsRetention{
+			Daily:   *policy.KeepLastDaily,
+			Weekly:  *policy.KeepLastWeekly,
+			Monthly: *policy.KeepLastMonthly,
+		}
+
+		gfsRetained, err := retention.retainedVersions(versions, func(v string) (time.Time, error) {
+			t, ok := s.published.Get(id, v)
+			if ok {
+				return t, nil
+			}
+
+			return versionTime(b, path.Join(productPath, v), v)
+		})
+		if err != nil {
+			return err
+		}
+
+		// Sizes of the items and versions are recorded before any of
+		// the items is removed from the catalog.
+		itemVersions := make(map[string]string)
+		itemSizes := make(map[string]int64)
+		versionSizes := make(map[string]int64, len(p.Versions))
+
+		for name, version := range p.Versions {
+			for _, item := range version.Items {
+				itemVersions[item.Path] = name
+				itemSizes[item.Path] = item.Size
+
+				// Items of aliased versions are not removed
+				// along with the version directory.
+				if strings.HasPrefix(filepath.ToSlash(item.Path), path.Join(productPath, name)+"/") {
+					versionSizes[name] += item.Size
+				}
+			}
+		}
+
+		discardVersion := func(v string, reason string) {
+			delete(p.Versions, v)
+
+			discarded = append(discarded, pruneDeletion{
+				Stream:  s.streamName,
+				Product: id,
+				Version: v,
+				Path:    path.Join(productPath, v),
+				Type:    pruneTypeVersion,
+				Reason:  reason,
+				Size:    versionSizes[v],
+			})
+
+			s.removeVersions(reason, 1)
+		}
+
+		discardItems := func(paths []string, reason string) {
+			for _, itemPath := range paths {
+				discarded = append(discarded, pruneDeletion{
+					Stream:  s.streamName,
+					Product: id,
+					Version: itemVersions[itemPath],
+					Path:    itemPath,
+					Type:    pruneTypeItem,
+					Reason:  reason,
+					Size:    itemSizes[itemPath],
+				})
+			}
+		}
+
+		// Number of retained versions per item type.
+		retainedItems := make(map[string]int, len(policy.RetainItems))
+
 		// Extract versions that need to be discarded.
 		for i, v := range versions {
-			versionPath := filepath.Join(productPath, v)
+			versionPath := path.Join(productPath, v)
 
-			// Remove version outside the retainBuilds.
-			if i >= retainBuilds {
-				delete(catalog.Products[id].Versions, v)
-				discardVersions = append(discardVersions, versionPath)
+			// Remove version outside the retainBuilds, unless it is
+			// retained by the grandfather-father-son policy.
+			if i >= retainBuilds && !gfsRetained[v] {
+				discardVersion(v, "retain-builds")
 				continue
 			}
 
 			// Remove versions older then retainDays.
 			if retainDays > 0 {
-				info, err := os.Stat(versionPath)
-				if err != nil {
-					return err
+				createdAt, ok := s.published.Get(id, v)
+				if !ok {
+					info, err := b.Stat(versionPath)
+					if err != nil {
+						return err
+					}
+
+					createdAt = info.ModTime()
 				}
 
 				maxAge := time.Duration(retainDays) * 24 * time.Hour
-				if time.Since(info.ModTime()) > maxAge {
-					delete(catalog.Products[id].Versions, v)
-					discardVersions = append(discardVersions, versionPath)
+				if s.now.Sub(createdAt) > maxAge {
+					discardVersion(v, "retain-days")
+					continue
+				}
+			}
+
+			// Remove items of types that are already retained in the
+			// required number of newer versions.
+			var items []string
+
+			version := p.Versions[v]
+			for itemType, retain := range policy.RetainItems {
+				if !hasItemType(version, itemType) {
+					continue
 				}
+
+				retainedItems[itemType]++
+				if retainedItems[itemType] > retain {
+					items = append(items, pruneVersionItems(version, itemType)...)
+				}
+			}
+
+			// Remove the whole version if no root file system is left.
+			if !hasItemType(version, stream.ItemTypeSquashfs) && !hasItemType(version, stream.ItemTypeDiskKVM) && !hasItemType(version, stream.ItemTypeDiskRaw) && !hasItemType(version, stream.ItemTypeRootTarXz) {
+				discardVersion(v, "retain-items")
+				continue
 			}
+
+			discardItems(items, "retain-items")
+		}
+
+		// Remove delta files created against the discarded versions
+		// or items, as clients can no longer apply them.
+		discardItems(pruneOrphanedDeltas(p.Versions), "orphaned-delta")
+	}
+
+	// Files of the discarded versions may still be referenced by the
+	// retained versions that alias them.
+	referenced := referencedPaths(s.catalog)
+
+	for i, d := range discarded {
+		if referenced[d.Path] {
+			discarded[i].KeepFiles = true
+			discarded[i].Size = 0
 		}
 	}
 
-	// Write product catalog to a temporary file that is located next
-	// to the final file to ensure atomic replace. Temporary file is
-	// prefixed with a dot to hide it.
-	catalogPathTemp := filepath.Join(rootDir, "streams", streamVersion, fmt.Sprintf(".%s.json.tmp", streamName))
-	err = shared.WriteJSONFile(catalogPathTemp, catalog)
+	sortPruneDeletions(discarded)
+
+	s.deletions = append(s.deletions, discarded...)
+	s.publishCatalog = true
+
+	return nil
+}
+
+// sortPruneDeletions sorts the deletions of a single step by their paths, so
+// that the plan does not depend on the order of the products.
+func sortPruneDeletions(deletions []pruneDeletion) {
+	slices.SortStableFunc(deletions, func(a pruneDeletion, b pruneDeletion) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+}
+
+// publishJSONFile writes the value as JSON to the file with the given name,
+// along with its compressed version. If signer is not nil, the file is also
+// signed. The file is written to a temporary file first, and published once
+// it is signed.
+func publishJSONFile(ctx context.Context, b storage.Backend, value any, name string, signer *stream.Signer) error {
+	tempDir, cleanup, err := storage.TempDir(b)
 	if err != nil {
 		return err
 	}
 
-	defer os.Remove(catalogPathTemp)
+	defer cleanup()
+
+	tempPath := filepath.Join(tempDir, path.Base(name))
+
+	catalog, ok := value.(*stream.ProductCatalog)
+	if ok {
+		err = writeCatalogFile(tempPath, catalog)
+	} else {
+		err = shared.WriteJSONFile(tempPath, value)
+	}
 
-	// Replace existing stream json file.
-	err = os.Rename(catalogPathTemp, catalogPath)
 	if err != nil {
 		return err
 	}
 
-	// Set read permissions.
-	err = os.Chmod(catalogPath, 0644)
+	err = shared.GZipFile(tempPath, tempPath+".gz")
 	if err != nil {
 		return err
 	}
 
-	// Remove old versions.
-	for _, v := range discardVersions {
-		err := os.RemoveAll(v)
+	replaces := []replace{
+		{OldPath: tempPath, NewPath: name},
+		{OldPath: tempPath + ".gz", NewPath: name + ".gz"},
+	}
+
+	if signer != nil {
+		signReplaces, err := signFile(ctx, signer, tempPath, name)
 		if err != nil {
-			slog.Error("Failed to prune old product version", "path", v, "error", err)
-			continue // Do not error out.
+			return fmt.Errorf("Sign file: %w", err)
 		}
 
-		slog.Info("Pruned old product version", "path", v, "error", err)
+		replaces = append(replaces, signReplaces...)
+	}
+
+	// Replace existing file (and its signatures).
+	for _, r := range replaces {
+		err = storage.Publish(b, r.OldPath, r.NewPath)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-// pruneDanglingProductVersions traverses through the stream directory structure
-// and prunes the product versions that are not referenced by the corresponding
-// product catalog.
-func pruneDanglingProductVersions(rootDir string, streamVersion string, streamName string) error {
-	// Get all products including incomplete (from actual directory hierarchy).
-	products, err := stream.GetProducts(rootDir, streamName, stream.WithIncompleteVersions(true))
+// pruneRemovedProducts removes product versions whose directories no longer
+// exist from the product catalog, and products whose directories no longer
+// exist altogether. To avoid dropping entries that are only temporarily
+// unavailable, they are removed once they have been missing for longer than
+// the grace period. The time when each entry was first found missing is kept
+// in a state file next to the product catalog. Paths of the removed entries
+// are returned. Nothing is removed if the number of removed versions exceeds
+// the limit of the guard. If signer is not nil, the modified product catalog
+// is signed.
+func pruneRemovedProducts(ctx context.Context, rootDir string, streamVersion string, streamName string, schema stream.PathSchema, grace time.Duration, guard pruneGuard, signer *stream.Signer) ([]string, error) {
+	steps := pruneSteps{
+		RemovedFromDisk: true,
+		RemovedGrace:    grace,
+	}
+
+	s, err := pruneStream(ctx, rootDir, streamVersion, streamName, schema, steps, guard, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.deletionPaths(pruneTypeCatalog), nil
+}
+
+// planRemovedProducts plans the removal of the products and product versions
+// that are missing from disk from the product catalog (see
+// pruneRemovedProducts).
+func (s *streamPrune) planRemovedProducts(b storage.Backend, streamVersion string, schema stream.PathSchema, grace time.Duration) error {
+	// If the whole stream directory is missing, it is more likely that the
+	// storage is not available than that all products were removed.
+	_, err := b.Stat(s.streamName)
 	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("Skipping product catalog reconciliation, because stream directory does not exist", "streamName", s.streamName)
+			return nil
+		}
+
 		return err
 	}
 
-	// Get current products (from stream json file).
-	catalogPath := filepath.Join(rootDir, "streams", streamVersion, fmt.Sprintf("%s.json", streamName))
-	catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+	statePath := path.Join("streams", streamVersion, fmt.Sprintf(".%s.missing.json", s.streamName))
+	missingSince := make(map[string]time.Time)
+
+	_, err = storage.ReadJSONFile(b, statePath, &missingSince)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("Failed to read missing product versions: %w", err)
+	}
+
+	exists := func(path string) (bool, error) {
+		_, err := b.Stat(path)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return false, nil
+			}
+
+			return false, err
+		}
+
+		return true, nil
+	}
+
+	missing := make(map[string]time.Time)
+
+	// expired records the missing path and returns true if the path has
+	// been missing for longer than the grace period.
+	expired := func(path string) bool {
+		since, ok := missingSince[path]
+		if !ok {
+			since = s.now
+		}
+
+		if s.now.Sub(since) < grace {
+			missing[path] = since
+			return false
+		}
+
+		return true
+	}
+
+	var removals []pruneDeletion
+
+	ids := shared.MapKeys(s.catalog.Products)
+	slices.Sort(ids)
+
+	for _, id := range ids {
+		p := s.catalog.Products[id]
+		productPath := path.Join(s.streamName, schema.ProductRelPath(p))
+
+		ok, err := exists(productPath)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			if expired(productPath) {
+				removals = append(removals, pruneDeletion{
+					Stream:  s.streamName,
+					Product: id,
+					Path:    productPath,
+					Type:    pruneTypeCatalog,
+					Reason:  "missing-from-disk",
+				})
+
+				s.removeVersions("missing-from-disk", len(p.Versions))
+			}
+
+			continue
+		}
+
+		versions := shared.MapKeys(p.Versions)
+		slices.Sort(versions)
+
+		for _, name := range versions {
+			versionPath := path.Join(productPath, name)
+
+			ok, err := exists(versionPath)
+			if err != nil {
+				return err
+			}
+
+			if !ok && expired(versionPath) {
+				removals = append(removals, pruneDeletion{
+					Stream:  s.streamName,
+					Product: id,
+					Version: name,
+					Path:    versionPath,
+					Type:    pruneTypeCatalog,
+					Reason:  "missing-from-disk",
+				})
+
+				s.removeVersions("missing-from-disk", 1)
+			}
+		}
+	}
+
+	for _, r := range removals {
+		if r.Version == "" {
+			delete(s.catalog.Products, r.Product)
+		} else {
+			delete(s.catalog.Products[r.Product].Versions, r.Version)
+		}
+	}
+
+	s.deletions = append(s.deletions, removals...)
+	s.reconciled = true
+	s.statePath = statePath
+	s.missing = missing
+	s.writeMissing = len(missing) > 0 || len(missingSince) > 0
+
+	if len(removals) > 0 {
+		s.publishCatalog = true
+		s.updateIndex = true
+	}
+
+	return nil
+}
+
+// retainPublishedTimes removes the publish times of the product versions that
+// are no longer in the product catalog, and writes them if any was removed.
+func retainPublishedTimes(b storage.Backend, streamVersion string, streamName string, published stream.PublishedTimes, catalog *stream.ProductCatalog) error {
+	if !published.Retain(*catalog) {
+		return nil
+	}
+
+	return stream.WritePublishedTimes(b, streamVersion, streamName, published)
+}
+
+// referencedPaths returns the set of paths of all items within the catalog,
+// including the paths of the directories that contain them.
+func referencedPaths(catalog *stream.ProductCatalog) map[string]bool {
+	paths := make(map[string]bool)
+
+	for _, p := range catalog.Products {
+		for _, v := range p.Versions {
+			for _, item := range v.Items {
+				itemPath := filepath.ToSlash(item.Path)
+				paths[itemPath] = true
+				paths[path.Dir(itemPath)] = true
+			}
+		}
+	}
+
+	return paths
+}
+
+// hasItemType returns true if the version contains an item of the given type.
+func hasItemType(version stream.Version, itemType string) bool {
+	for _, item := range version.Items {
+		if item.Ftype == itemType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pruneVersionItems removes items of the given type, including their delta
+// files, from the version and returns paths of the removed items. Combined
+// hash of the removed item is also removed from the metadata item.
+func pruneVersionItems(version stream.Version, itemType string) []string {
+	var deltaTypes []string
+
+	switch itemType {
+	case stream.ItemTypeSquashfs:
+		deltaTypes = []string{stream.ItemTypeSquashfsDelta, stream.ItemTypeSquashfsZsync}
+	case stream.ItemTypeDiskKVM:
+		deltaTypes = []string{stream.ItemTypeDiskKVMDelta, stream.ItemTypeDiskKVMZsync}
+	case stream.ItemTypeDiskRaw:
+		deltaTypes = []string{stream.ItemTypeDiskRawDelta, stream.ItemTypeDiskRawZsync}
+	}
+
+	var paths []string
+
+	for name, item := range version.Items {
+		if item.Ftype != itemType && !slices.Contains(deltaTypes, item.Ftype) {
+			continue
+		}
+
+		delete(version.Items, name)
+		paths = append(paths, item.Path)
+	}
+
+	metaItem, ok := version.Items[stream.ItemTypeMetadata]
+	if ok {
+		switch itemType {
+		case stream.ItemTypeSquashfs:
+			metaItem.CombinedSHA256SquashFs = ""
+		case stream.ItemTypeDiskKVM:
+			metaItem.CombinedSHA256DiskKvmImg = ""
+		case stream.ItemTypeDiskRaw:
+			metaItem.CombinedSHA256DiskImg = ""
+		case stream.ItemTypeRootTarXz:
+			metaItem.CombinedSHA256RootXz = ""
+		}
+
+		version.Items[stream.ItemTypeMetadata] = metaItem
+	}
+
+	return paths
+}
+
+// pruneOrphanedDeltas removes delta items whose base version is no longer
+// among the given versions, or no longer contains the item from which the
+// delta was created, and returns paths of the removed items.
+func pruneOrphanedDeltas(versions map[string]stream.Version) []string {
+	var paths []string
+
+	for _, version := range versions {
+		for name, item := range version.Items {
+			baseType, ok := stream.DeltaBaseType(item.Ftype)
+			if !ok || item.DeltaBase == "" {
+				continue
+			}
+
+			base, ok := versions[item.DeltaBase]
+			if ok && hasItemType(base, baseType) {
+				continue
+			}
+
+			delete(version.Items, name)
+			paths = append(paths, item.Path)
+		}
+	}
+
+	return paths
+}
+
+// pruneDanglingProductVersions traverses through the stream directory structure
+// and prunes the product versions that are not referenced by the corresponding
+// product catalog, along with the orphaned files within the referenced ones.
+// Product versions and files are pruned only once they are older than the
+// grace period, which protects the versions that are still being uploaded.
+// Nothing is pruned if the number of dangling versions exceeds the limit of
+// the guard.
+func pruneDanglingProductVersions(ctx context.Context, rootDir string, streamVersion string, streamName string, schema stream.PathSchema, grace time.Duration, guard pruneGuard) error {
+	steps := pruneSteps{
+		Dangling:      true,
+		DanglingGrace: grace,
+	}
+
+	_, err := pruneStream(ctx, rootDir, streamVersion, streamName, schema, steps, guard, nil)
+	return err
+}
+
+// planDangling plans the removal of the dangling product versions (see
+// pruneDanglingProductVersions). Sizes of the dangling versions are computed
+// from the files within their directories. Orphaned files do not count towards
+// the removed versions, as the guard limits them per version instead.
+func (s *streamPrune) planDangling(ctx context.Context, rootDir string, b storage.Backend, schema stream.PathSchema, grace time.Duration) error {
+	// Get all products including incomplete (from actual directory hierarchy).
+	products, err := stream.GetProducts(ctx, rootDir, s.streamName, stream.WithIncompleteVersions(true), stream.WithPathSchema(schema))
 	if err != nil {
 		return err
 	}
@@ -172,74 +1489,213 @@ func pruneDanglingProductVersions(rootDir string, streamVersion string, streamNa
 	// If product catalog is empty, skip removal of dangling resources, because this
 	// may result in wiping everything out if, for example, product catalog was build
 	// inproperly or was accidentally deleted.
-	if len(catalog.Products) == 0 {
+	if len(s.catalog.Products) == 0 {
 		slog.Info("Skipping removal of dangling resources, because product catalog is empty")
 		return nil
 	}
 
-	// removeIfOlder gets info of the file on the given path and removes it
+	// isOlder gets info of the file on the given path and returns true
 	// if it's modification time is older then maxAge.
-	removeIfOlder := func(path string, maxAge time.Duration) error {
-		info, err := os.Stat(path)
+	isOlder := func(path string, maxAge time.Duration) (bool, error) {
+		info, err := b.Stat(path)
 		if err != nil {
-			return err
+			return false, err
 		}
 
-		if time.Since(info.ModTime()) > maxAge {
-			err := os.RemoveAll(path)
-			if err != nil {
-				slog.Error("Failed to prune dangling resource", "path", path, "error", err)
-				return nil // Do not error out.
-			}
+		return s.now.Sub(info.ModTime()) > maxAge, nil
+	}
 
-			slog.Info("Pruned dangling resource", "path", path)
-		}
+	// Versions that are not referenced directly may still contain files
+	// referenced by other versions.
+	referenced := referencedPaths(s.catalog)
 
-		return nil
-	}
+	var dangling []pruneDeletion
+	var orphaned []pruneDeletion
 
 	for key, rp := range products {
-		productPath := filepath.Join(rootDir, streamName, rp.RelPath())
+		productPath := path.Join(s.streamName, schema.ProductRelPath(rp))
 
-		cp, ok := catalog.Products[key]
+		cp, ok := s.catalog.Products[key]
 		if !ok {
-			// Remove unreferenced product if older then 6 hours.
-			err := removeIfOlder(productPath, 6*time.Hour)
+			// Remove unreferenced product if older then grace period.
+			old, err := isOlder(productPath, grace)
 			if err != nil {
 				return err
 			}
+
+			if old {
+				dangling = append(dangling, pruneDeletion{
+					Stream:  s.streamName,
+					Product: key,
+					Path:    productPath,
+					Type:    pruneTypeDangling,
+					Reason:  "dangling",
+				})
+
+				// Dangling versions are not in the product
+				// catalog, so they add to the total as well.
+				s.totalVersions += len(rp.Versions)
+				s.removeVersions("dangling", len(rp.Versions))
+			}
 		} else {
 			// Iterate over detected versions and remove unreferenced ones.
-			for rpv := range rp.Versions {
-				_, ok := cp.Versions[rpv]
+			for rpv, v := range rp.Versions {
+				versionPath := path.Join(productPath, rpv)
+
+				cv, ok := cp.Versions[rpv]
 				if ok {
-					// Version is referenced, nothing to do.
+					// Version is referenced, but may contain
+					// orphaned files.
+					files, err := s.planOrphanedFiles(b, key, rpv, versionPath, cv, v, referenced, grace)
+					if err != nil {
+						return err
+					}
+
+					if len(files) > 0 {
+						s.orphanedFiles[versionPath] = len(files)
+					}
+
+					orphaned = append(orphaned, files...)
+					continue
+				}
+
+				if referenced[versionPath] {
+					// Version is referenced by other versions,
+					// nothing to do.
 					continue
 				}
 
 				// Remove unreferenced product version if older
-				// then 6 hours.
-				versionPath := filepath.Join(productPath, rpv)
-				err := removeIfOlder(versionPath, 6*time.Hour)
+				// then grace period.
+				old, err := isOlder(versionPath, grace)
 				if err != nil {
 					return err
 				}
+
+				if old {
+					dangling = append(dangling, pruneDeletion{
+						Stream:  s.streamName,
+						Product: key,
+						Version: rpv,
+						Path:    versionPath,
+						Type:    pruneTypeDangling,
+						Reason:  "dangling",
+					})
+
+					s.totalVersions++
+					s.removeVersions("dangling", 1)
+				}
 			}
 		}
 	}
 
+	for i, d := range dangling {
+		err := walkFiles(b, d.Path, func(_ string, info fs.FileInfo) error {
+			dangling[i].Size += info.Size()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	dangling = append(dangling, orphaned...)
+	sortPruneDeletions(dangling)
+	s.deletions = append(s.deletions, dangling...)
+
 	return nil
 }
 
+// versionMetaFiles are the names of the files within the product version that
+// are not items, but are kept along with them.
+var versionMetaFiles = []string{
+	stream.FileChecksumSHA256,
+	stream.FileChecksumSHA512,
+	stream.FileChecksumBLAKE2b,
+	stream.FileImageConfig,
+	stream.FileDirIndex,
+}
+
+// planOrphanedFiles plans the removal of the files within the directory of the
+// product version referenced from the product catalog (e.g. temporary delta
+// files or editor backups), which are neither items of the version nor listed
+// in its checksums file. Files are removed only once they are older than the
+// grace period. Checksums files along with their signatures, the image config,
+// and directory listings are always kept. Nothing is removed from the version
+// that is being uploaded, as its checksums file may not list the new files yet.
+func (s *streamPrune) planOrphanedFiles(b storage.Backend, product string, versionName string, versionPath string, catalogVersion stream.Version, diskVersion stream.Version, referenced map[string]bool, grace time.Duration) ([]pruneDeletion, error) {
+	files, err := b.List(versionPath)
+	if err != nil {
+		return nil, err
+	}
+
+	uploading := slices.ContainsFunc(files, func(file fs.FileInfo) bool {
+		return file.Name() == defaultUploadSentinel
+	})
+
+	if uploading {
+		slog.Info("Skipping orphaned files of product version, because it is being uploaded", "streamName", s.streamName, "product", product, "version", versionName)
+		return nil, nil
+	}
+
+	var orphaned []pruneDeletion
+
+	for _, file := range files {
+		name := file.Name()
+		filePath := path.Join(versionPath, name)
+
+		if file.IsDir() || referenced[filePath] {
+			continue
+		}
+
+		_, isItem := catalogVersion.Items[name]
+		_, isListed := diskVersion.Checksums[name]
+		if isItem || isListed {
+			continue
+		}
+
+		metaName := strings.TrimSuffix(strings.TrimSuffix(name, stream.FileExtDetachedSignature), stream.FileExtArmoredSignature)
+		if slices.Contains(versionMetaFiles, metaName) {
+			continue
+		}
+
+		if s.now.Sub(file.ModTime()) <= grace {
+			continue
+		}
+
+		orphaned = append(orphaned, pruneDeletion{
+			Stream:  s.streamName,
+			Product: product,
+			Version: versionName,
+			Path:    filePath,
+			Type:    pruneTypeDangling,
+			Reason:  "orphaned",
+			Size:    file.Size(),
+		})
+	}
+
+	return orphaned, nil
+}
+
 // pruneEmptyDirs traverses the file structure on the given path and
 // recursively removes all empty directories. Setting keepBaseDir to
 // true, ensures the function does not remove the base directory if
-// it is empty.
+// it is empty. Base directory may also be an S3 URL.
 func pruneEmptyDirs(baseDir string, keepBaseDir bool) error {
-	baseDir = filepath.Clean(baseDir)
+	b, err := storage.New(baseDir)
+	if err != nil {
+		return err
+	}
+
+	return pruneEmptyDirsIn(b, "", keepBaseDir)
+}
 
+// pruneEmptyDirsIn is like pruneEmptyDirs, except that it removes empty
+// directories within the directory with the given name from the storage
+// backend.
+func pruneEmptyDirsIn(b storage.Backend, dir string, keepBaseDir bool) error {
 	// Read directory contents.
-	files, err := os.ReadDir(baseDir)
+	files, err := b.List(dir)
 	if err != nil {
 		return err
 	}
@@ -251,29 +1707,74 @@ func pruneEmptyDirs(baseDir string, keepBaseDir bool) error {
 				continue
 			}
 
-			child := filepath.Join(baseDir, f.Name())
-			err = pruneEmptyDirs(child, false)
+			child := path.Join(dir, f.Name())
+			err = pruneEmptyDirsIn(b, child, false)
 			if err != nil {
 				return err
 			}
 		}
 
 		// Read files again, as current directory may be empty now.
-		files, err = os.ReadDir(baseDir)
+		files, err = b.List(dir)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+
+			// Directories of object stores cease to exist once
+			// they are empty.
+			files = nil
+		}
+	}
+
+	// Directory that contains only the directory listing is considered
+	// empty.
+	if len(files) == 1 && files[0].Name() == stream.FileDirIndex && !keepBaseDir {
+		err := b.Delete(path.Join(dir, stream.FileDirIndex))
 		if err != nil {
 			return err
 		}
+
+		files = nil
 	}
 
 	// Remove empty directory if it is not marked as base dir.
 	if !keepBaseDir && len(files) == 0 {
-		err := os.Remove(baseDir)
+		err := b.Delete(dir)
 		if err != nil {
 			return err
 		}
 
-		slog.Info("Removed empty directory", "path", baseDir)
+		slog.Info("Removed empty directory", "path", dir)
 	}
 
 	return nil
 }
+
+// versionTime returns the build time of the product version. The time is
+// parsed from the version name if it follows the "YYYYMMDD_hhmm" format,
+// otherwise the modification time of the version directory is used.
+func versionTime(b storage.Backend, versionPath string, versionName string) (time.Time, error) {
+	t, err := parseVersionTime(versionName)
+	if err == nil {
+		return t, nil
+	}
+
+	info, err := b.Stat(versionPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
+
+// parseVersionTime parses the build time from the version name in the format
+// "YYYYMMDD_hhmm".
+func parseVersionTime(versionName string) (time.Time, error) {
+	t, err := time.Parse("20060102_1504", versionName)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Version name %q is not in format YYYYMMDD_hhmm", versionName)
+	}
+
+	return t, nil
+}
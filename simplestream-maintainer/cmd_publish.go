@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/pool"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+)
+
+// schemeSSH is the URL scheme of the publish targets synced using rsync.
+const schemeSSH = "ssh"
+
+// Publish phases in the order in which the files are published.
+const (
+	publishPhaseFiles = iota
+	publishPhaseCatalogs
+	publishPhaseIndexes
+)
+
+type publishOptions struct {
+	global *globalOptions
+
+	Workers     int
+	NoDelete    bool
+	LockTimeout time.Duration
+	Rsync       string
+}
+
+func (o *publishOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "publish <path> <target>... [flags]",
+		Short: "Publish the built tree to one or more targets",
+		Long: `Publish the built tree to one or more targets.
+
+Files are published in the order that keeps the target consistent at any point in time: first the
+image files and other files outside of the "streams" directory, then the product catalogs, and the
+index files last. Files removed from the tree (for example, by prune) are deleted from the target
+only once the new index is published, unless --no-delete is set. Files that exist on the target
+with the same size and a newer modification time are not published again. Hidden files, such as
+hash caches, failure records, snapshots, and partially uploaded versions, are not published.
+
+Target is either a local path, an S3 URL in the format s3://bucket/prefix (see the build command),
+a WebDAV URL in the format webdav://host/path (or webdavs://host/path for HTTPS), or an SSH target
+in the format ssh://[user@]host[:port]/path, which is synced using rsync. WebDAV credentials are
+read either from the URL or from the WEBDAV_USERNAME and WEBDAV_PASSWORD environment variables.
+
+Targets are published one after another, and a failure to publish to one target does not prevent
+publishing to the remaining ones. The streams lock is held during the whole time, so that the tree
+is not modified by a concurrent build or prune.`,
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().IntVar(&o.Workers, "workers", 4, "Maximum number of concurrent uploads (not used for SSH targets)")
+	cmd.PersistentFlags().BoolVar(&o.NoDelete, "no-delete", false, "Keep files on the target that were removed from the tree")
+	cmd.PersistentFlags().DurationVar(&o.LockTimeout, "lock-timeout", defaultLockTimeout, "Maximum time to wait for another build or prune to finish (0 fails immediately)")
+	cmd.PersistentFlags().StringVar(&o.Rsync, "rsync", "rsync", "Path of the rsync client used for SSH targets")
+
+	return cmd
+}
+
+func (o *publishOptions) Run(cmd *cobra.Command, args []string) error {
+	if len(args) < 2 || slices.Contains(args, "") {
+		return fmt.Errorf("Arguments %q and at least one %q are required and cannot be empty", "path", "target")
+	}
+
+	if o.Workers < 1 {
+		return fmt.Errorf("At least 1 worker is required")
+	}
+
+	err := publishTree(o.global.ctx, args[0], args[1:], publishConfig{
+		workers:       o.Workers,
+		deleteRemoved: !o.NoDelete,
+		lockTimeout:   o.LockTimeout,
+		rsync:         o.Rsync,
+	})
+	recordCommand(args[0], "publish", cmd, args, err)
+
+	return err
+}
+
+// publishConfig contains the settings of the publish.
+type publishConfig struct {
+	// workers is the maximum number of concurrent uploads.
+	workers int
+
+	// deleteRemoved deletes files from the target that do not exist in the
+	// published tree.
+	deleteRemoved bool
+
+	// lockTimeout is the maximum time to wait for the streams lock.
+	lockTimeout time.Duration
+
+	// rsync is the path of the rsync client.
+	rsync string
+}
+
+// publishTree publishes the tree in rootDir to each of the given targets.
+func publishTree(ctx context.Context, rootDir string, targets []string, cfg publishConfig) error {
+	for _, target := range targets {
+		if storage.IsLocal(target) && storage.IsLocal(rootDir) {
+			same, err := samePath(rootDir, target)
+			if err != nil {
+				return err
+			}
+
+			if same {
+				return fmt.Errorf("Target %q is the same as the published tree", target)
+			}
+		}
+
+		if isSSHTarget(target) && !storage.IsLocal(rootDir) {
+			return fmt.Errorf("Publishing to SSH target %q requires a local tree", target)
+		}
+	}
+
+	src, err := storage.New(rootDir)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockStreams(ctx, src, cfg.lockTimeout)
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	failed := 0
+
+	for _, target := range targets {
+		slog.Info("Publishing tree", "target", target)
+
+		if isSSHTarget(target) {
+			err = publishRsync(ctx, cfg.rsync, rootDir, target, cfg.deleteRemoved)
+		} else {
+			var dst storage.Backend
+
+			dst, err = storage.New(target)
+			if err == nil {
+				err = publishBackend(ctx, src, dst, cfg.workers, cfg.deleteRemoved)
+			}
+		}
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+
+			slog.Error("Failed to publish tree", "target", target, "error", err)
+			failed++
+			continue
+		}
+
+		slog.Info("Tree published", "target", target)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to publish to %d of %d targets", failed, len(targets))
+	}
+
+	return nil
+}
+
+// publishPhase returns the phase in which the file with the given name is
+// published. Index files (including their signatures) are published last, as
+// they reference the product catalogs, which in turn reference the files.
+func publishPhase(name string) int {
+	streamsPath, ok := strings.CutPrefix(name, "streams/")
+	if !ok {
+		return publishPhaseFiles
+	}
+
+	if strings.Count(streamsPath, "/") == 1 && strings.HasPrefix(path.Base(streamsPath), "index.") {
+		return publishPhaseIndexes
+	}
+
+	return publishPhaseCatalogs
+}
+
+// isHiddenPath returns true if any element of the given path is hidden.
+func isHiddenPath(name string) bool {
+	return slices.ContainsFunc(strings.Split(name, "/"), func(e string) bool {
+		return strings.HasPrefix(e, ".")
+	})
+}
+
+// publishBackend publishes files from the source backend to the target
+// backend in the order given by publishPhase. Files that failed to publish
+// prevent the subsequent phases, so that the target never references missing
+// files. If deleteRemoved is true, files that exist only on the target are
+// deleted once all phases succeed.
+func publishBackend(ctx context.Context, src storage.Backend, dst storage.Backend, workers int, deleteRemoved bool) error {
+	var phases [publishPhaseIndexes + 1][]string
+
+	sources := make(map[string]fs.FileInfo)
+
+	// Published files and their parent directories.
+	published := make(map[string]bool)
+
+	err := walkFiles(src, "", func(name string, info fs.FileInfo) error {
+		if isHiddenPath(name) {
+			return nil
+		}
+
+		sources[name] = info
+		phases[publishPhase(name)] = append(phases[publishPhase(name)], name)
+
+		for p := name; p != "."; p = path.Dir(p) {
+			published[p] = true
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, names := range phases {
+		err := publishFiles(ctx, src, dst, sources, names, workers)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !deleteRemoved {
+		return nil
+	}
+
+	deleted, err := deleteRemovedFiles(dst, "", published)
+	if err != nil {
+		return err
+	}
+
+	if deleted > 0 {
+		slog.Info("Removed files deleted from the target", "count", deleted)
+	}
+
+	return nil
+}
+
+// publishFiles copies the files with the given names from the source backend
+// to the target backend, unless the target already contains the same file.
+func publishFiles(ctx context.Context, src storage.Backend, dst storage.Backend, sources map[string]fs.FileInfo, names []string, workers int) error {
+	workerPool := pool.New(ctx, workers)
+	defer workerPool.Close()
+
+	var mutex sync.Mutex
+	failed := 0
+
+	for _, name := range names {
+		workerPool.Submit(func() {
+			err := publishFile(src, dst, name, sources[name])
+			if err != nil {
+				slog.Error("Failed to publish file", "path", name, "error", err)
+
+				mutex.Lock()
+				failed++
+				mutex.Unlock()
+			}
+		})
+	}
+
+	workerPool.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to publish %d files", failed)
+	}
+
+	return nil
+}
+
+// publishFile copies a single file, unless the target contains the file with
+// the same size that was modified after the source file.
+func publishFile(src storage.Backend, dst storage.Backend, name string, info fs.FileInfo) error {
+	dstInfo, err := dst.Stat(name)
+	if err == nil && !dstInfo.IsDir() && dstInfo.Size() == info.Size() && !dstInfo.ModTime().Before(info.ModTime()) {
+		return nil
+	}
+
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	r, err := src.Open(name)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	err = dst.Write(name, r)
+	if err != nil {
+		return err
+	}
+
+	slog.Debug("File published", "path", name)
+	return nil
+}
+
+// deleteRemovedFiles deletes the files and directories within the directory
+// with the given name on the target that are not among the published paths.
+// Hidden files are kept. The number of deleted entries is returned.
+func deleteRemovedFiles(dst storage.Backend, name string, published map[string]bool) (int, error) {
+	entries, err := dst.List(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, nil
+		}
+
+		return 0, err
+	}
+
+	deleted := 0
+
+	for _, entry := range entries {
+		entryPath := path.Join(name, entry.Name())
+
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		if published[entryPath] {
+			if entry.IsDir() {
+				n, err := deleteRemovedFiles(dst, entryPath, published)
+				deleted += n
+				if err != nil {
+					return deleted, err
+				}
+			}
+
+			continue
+		}
+
+		err := dst.Delete(entryPath)
+		if err != nil {
+			return deleted, err
+		}
+
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// isSSHTarget returns true if the target is synced using rsync over SSH.
+func isSSHTarget(target string) bool {
+	return strings.HasPrefix(target, schemeSSH+"://")
+}
+
+// publishRsync syncs the local tree in rootDir to the SSH target in the format
+// "ssh://[user@]host[:port]/path" using the given rsync client. Rsync is run
+// once for each publish phase, followed by the run that deletes removed files
+// if deleteRemoved is true. Hidden files are excluded from all runs, which
+// also keeps them on the target.
+func publishRsync(ctx context.Context, rsync string, rootDir string, target string, deleteRemoved bool) error {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" || u.Hostname() == "" {
+		return fmt.Errorf("Invalid SSH target %q: expected format %s://[user@]host[:port]/path", target, schemeSSH)
+	}
+
+	dest := u.Hostname() + ":" + strings.TrimSuffix(u.Path, "/") + "/"
+	if u.Path == "" {
+		// Path relative to the home directory of the user.
+		dest = u.Hostname() + ":"
+	}
+
+	if u.User != nil {
+		dest = u.User.Username() + "@" + dest
+	}
+
+	shell := "ssh"
+	if u.Port() != "" {
+		shell = "ssh -p " + u.Port()
+	}
+
+	src := strings.TrimSuffix(rootDir, "/") + "/"
+
+	runs := [][]string{
+		// Files outside of the streams directory.
+		{"--exclude=/streams/", src, dest},
+
+		// Product catalogs.
+		{"--exclude=/*/index.*", src + "streams/", dest + "streams/"},
+
+		// Indexes.
+		{src + "streams/", dest + "streams/"},
+	}
+
+	if deleteRemoved {
+		runs = append(runs, []string{"--delete", src, dest})
+	}
+
+	for _, run := range runs {
+		args := append([]string{"--archive", "--rsh=" + shell, "--exclude=.*"}, run...)
+
+		out, err := exec.CommandContext(ctx, rsync, args...).CombinedOutput()
+		if err != nil {
+			msg := strings.TrimSpace(string(out))
+			if msg != "" {
+				return fmt.Errorf("Failed to run rsync: %w (%s)", err, msg)
+			}
+
+			return fmt.Errorf("Failed to run rsync: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// samePath returns true if the given local paths refer to the same directory.
+func samePath(a string, b string) (bool, error) {
+	absA, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+
+	absB, err := filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+
+	return absA == absB, nil
+}
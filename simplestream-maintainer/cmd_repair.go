@@ -0,0 +1,569 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/clock"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+// Reasons for which the repair removes the references from the product
+// catalog.
+const (
+	// repairReasonMissing indicates that the file of the item no longer
+	// exists.
+	repairReasonMissing = "missing"
+
+	// repairReasonOutdated indicates that the delta or zsync file was
+	// created from the item whose content has changed.
+	repairReasonOutdated = "outdated"
+
+	// repairReasonMissingBase indicates that the base version of the delta
+	// file, or its item, was removed.
+	repairReasonMissingBase = "missing_base"
+
+	// repairReasonIncomplete indicates that the version no longer contains
+	// the metadata and at least one root filesystem.
+	repairReasonIncomplete = "incomplete"
+
+	// repairReasonEmpty indicates that the product no longer contains any
+	// version.
+	repairReasonEmpty = "empty"
+)
+
+// repairChangeRemoved is the change that removes the item, version, or product
+// from the product catalog. Other changes are named after the JSON fields of
+// the updated items.
+const repairChangeRemoved = "removed"
+
+// rootfsTypes are the types of the root filesystem items, whose combined hash
+// with the metadata is stored in the metadata item.
+var rootfsTypes = []string{stream.ItemTypeSquashfs, stream.ItemTypeDiskKVM, stream.ItemTypeDiskRaw, stream.ItemTypeRootTarXz}
+
+type repairOptions struct {
+	global *globalOptions
+
+	StreamVersion string
+	ImageDirs     []string
+	GPGKey        string
+	GPGHomeDir    string
+	DryRun        bool
+	Format        string
+	LockTimeout   time.Duration
+}
+
+func (o *repairOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "repair <path> [flags]",
+		Short: "Repair product catalogs that do not match the files",
+		Long: `Repair product catalogs whose items no longer match the files on the disk (for example, after the
+files were fixed manually), which would otherwise fail the downloads of the clients.
+
+Each item is stat-ed and hashed, reusing the hashes cached by the build for the files that have not
+changed. Items whose size or hashes differ are updated, along with the combined hashes of their version,
+and the derived fields (installed size, virtual size, and compression) are cleared. References to the
+missing files are removed, along with the delta and zsync files created from the changed or removed
+items, which are regenerated by the next build. Versions that are no longer complete and products that
+are left without versions are removed as well.
+
+Every change is printed, and the product catalogs are rewritten (and signed with --gpg-key) only if
+any change was made. With --dry-run, the changes are only printed.
+
+The path may also be an S3 URL in the format s3://bucket/prefix (see the build command).`,
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringVar(&o.StreamVersion, "stream-version", "v1", "Stream version")
+	cmd.PersistentFlags().StringSliceVarP(&o.ImageDirs, "image-dir", "d", []string{"images"}, "Image directory (relative to path argument)")
+	cmd.PersistentFlags().StringVar(&o.GPGKey, "gpg-key", "", "GPG key used to sign the repaired product catalog files")
+	cmd.PersistentFlags().StringVar(&o.GPGHomeDir, "gpg-homedir", "", "GPG home directory")
+	cmd.PersistentFlags().BoolVar(&o.DryRun, "dry-run", false, "Print the changes without repairing the product catalogs")
+	cmd.PersistentFlags().StringVar(&o.Format, "format", "table", "Output format (table, json)")
+	cmd.PersistentFlags().DurationVar(&o.LockTimeout, "lock-timeout", defaultLockTimeout, "Maximum time to wait for another build or prune to finish (0 fails immediately)")
+
+	return cmd
+}
+
+func (o *repairOptions) Run(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
+	}
+
+	if o.Format != "table" && o.Format != "json" {
+		return fmt.Errorf("Invalid output format %q. Valid formats are: [table, json]", o.Format)
+	}
+
+	var signer *stream.Signer
+	if o.GPGKey != "" {
+		signer = stream.NewSigner(o.GPGKey, o.GPGHomeDir)
+	}
+
+	var result *repairResult
+
+	if o.DryRun {
+		var err error
+
+		result, err = repairStreams(o.global.ctx, args[0], o.StreamVersion, o.ImageDirs, true, signer)
+		if err != nil {
+			return err
+		}
+	} else {
+		b, err := storage.New(args[0])
+		if err != nil {
+			return err
+		}
+
+		unlock, err := lockStreams(o.global.ctx, b, o.LockTimeout)
+		if err != nil {
+			return err
+		}
+
+		result, err = repairStreams(o.global.ctx, args[0], o.StreamVersion, o.ImageDirs, false, signer)
+		unlock()
+
+		recordCommand(args[0], "repair", cmd, args, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeRepairResult(cmd.OutOrStdout(), result, o.Format)
+}
+
+// repairChange is a single change of the product catalog made by the repair.
+type repairChange struct {
+	Stream  string `json:"stream"`
+	Product string `json:"product"`
+	Version string `json:"version,omitempty"`
+	Item    string `json:"item,omitempty"`
+
+	// Change is either the name of the updated field, or "removed".
+	Change string `json:"change"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+
+	// Reason for which the item, version, or product was removed.
+	Reason string `json:"reason,omitempty"`
+}
+
+// repairResult lists the changes made by the repair.
+type repairResult struct {
+	StreamVersion string         `json:"stream_version"`
+	DryRun        bool           `json:"dry_run"`
+	Changes       []repairChange `json:"changes"`
+}
+
+// repairStreams repairs the product catalogs of the given streams, so that they
+// match the files on the disk. Modified product catalogs are written, unless
+// dryRun is true. If signer is not nil, they are also signed.
+func repairStreams(ctx context.Context, rootDir string, streamVersion string, streamNames []string, dryRun bool, signer *stream.Signer) (*repairResult, error) {
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &repairResult{
+		StreamVersion: streamVersion,
+		DryRun:        dryRun,
+		Changes:       []repairChange{},
+	}
+
+	for _, streamName := range streamNames {
+		changes, err := repairStream(ctx, rootDir, b, streamVersion, streamName, dryRun, signer)
+		if err != nil {
+			return nil, fmt.Errorf("Stream %q: %w", streamName, err)
+		}
+
+		result.Changes = append(result.Changes, changes...)
+	}
+
+	return result, nil
+}
+
+// repairStream repairs the product catalog of a single stream and returns the
+// changes made.
+func repairStream(ctx context.Context, rootDir string, b storage.Backend, streamVersion string, streamName string, dryRun bool, signer *stream.Signer) ([]repairChange, error) {
+	catalogPath := path.Join("streams", streamVersion, fmt.Sprintf("%s.json", streamName))
+
+	catalog, err := storage.ReadJSONFile(b, catalogPath, &stream.ProductCatalog{})
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+
+		slog.Warn("Product catalog not found, skipping stream", "streamName", streamName)
+		return nil, nil
+	}
+
+	cache, err := stream.LoadHashCache(rootDir, stream.HashCachePath(streamVersion, streamName))
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []repairChange
+	removedProducts := false
+
+	ids := shared.MapKeys(catalog.Products)
+	slices.Sort(ids)
+
+	for _, id := range ids {
+		productChanges, err := repairProduct(ctx, rootDir, b, cache, catalog.Products[id])
+		if err != nil {
+			return nil, fmt.Errorf("Product %q: %w", id, err)
+		}
+
+		if len(catalog.Products[id].Versions) == 0 {
+			delete(catalog.Products, id)
+			productChanges = append(productChanges, repairChange{Change: repairChangeRemoved, Reason: repairReasonEmpty})
+			removedProducts = true
+		}
+
+		for _, c := range productChanges {
+			c.Stream = streamName
+			c.Product = id
+			changes = append(changes, c)
+		}
+	}
+
+	if dryRun || len(changes) == 0 {
+		return changes, nil
+	}
+
+	err = catalog.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid product catalog: %w", err)
+	}
+
+	err = publishJSONFile(ctx, b, catalog, catalogPath, signer)
+	if err != nil {
+		return nil, fmt.Errorf("Publish product catalog file: %w", err)
+	}
+
+	published, err := stream.ReadPublishedTimes(b, streamVersion, streamName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = retainPublishedTimes(b, streamVersion, streamName, published, catalog)
+	if err != nil {
+		return nil, err
+	}
+
+	if removedProducts {
+		// Ensure the index no longer lists the removed products.
+		indexPath := path.Join("streams", streamVersion, "index.json")
+		index, err := storage.ReadJSONFile(b, indexPath, &stream.StreamIndex{})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+
+		if index != nil {
+			entry, ok := index.Index[streamName]
+			if ok {
+				index.AddEntryAt(streamName, entry.Path, *catalog, clock.FromContext(ctx).Now())
+
+				err = publishJSONFile(ctx, b, index, indexPath, signer)
+				if err != nil {
+					return nil, fmt.Errorf("Publish index file: %w", err)
+				}
+			}
+		}
+	}
+
+	// Keep the hashes of the changed files for the next build.
+	err = cache.Save(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("Repaired product catalog", "streamName", streamName, "changes", len(changes))
+
+	return changes, nil
+}
+
+// repairProduct repairs the versions of the product in place and returns the
+// changes made. Stream and product are not set in the returned changes.
+func repairProduct(ctx context.Context, rootDir string, b storage.Backend, cache *stream.HashCache, product stream.Product) ([]repairChange, error) {
+	var changes []repairChange
+
+	// Types of the changed or removed items of each version.
+	changed := make(map[string]map[string]bool)
+
+	versionNames := shared.MapKeys(product.Versions)
+	slices.Sort(versionNames)
+
+	for _, versionName := range versionNames {
+		versionChanges, changedTypes, err := repairVersion(ctx, rootDir, b, cache, product.Versions[versionName])
+		if err != nil {
+			return nil, fmt.Errorf("Version %q: %w", versionName, err)
+		}
+
+		for _, c := range versionChanges {
+			c.Version = versionName
+			changes = append(changes, c)
+		}
+
+		changed[versionName] = changedTypes
+	}
+
+	// Remove versions that are no longer complete.
+	for _, versionName := range versionNames {
+		version := product.Versions[versionName]
+
+		if hasItemType(version, stream.ItemTypeMetadata) && slices.ContainsFunc(rootfsTypes, func(t string) bool { return hasItemType(version, t) }) {
+			continue
+		}
+
+		delete(product.Versions, versionName)
+		changes = append(changes, repairChange{Version: versionName, Change: repairChangeRemoved, Reason: repairReasonIncomplete})
+	}
+
+	// Remove delta and zsync files created from the changed or removed
+	// items, so that they are regenerated by the next build.
+	for _, versionName := range versionNames {
+		version, ok := product.Versions[versionName]
+		if !ok {
+			continue
+		}
+
+		itemNames := shared.MapKeys(version.Items)
+		slices.Sort(itemNames)
+
+		for _, itemName := range itemNames {
+			item := version.Items[itemName]
+			reason := ""
+
+			baseType, isDelta := stream.DeltaBaseType(item.Ftype)
+			if isDelta {
+				base, ok := product.Versions[item.DeltaBase]
+				if changed[versionName][baseType] || changed[item.DeltaBase][baseType] {
+					reason = repairReasonOutdated
+				} else if item.DeltaBase != "" && (!ok || !hasItemType(base, baseType)) {
+					reason = repairReasonMissingBase
+				}
+			} else if strings.HasSuffix(itemName, ".zsync") {
+				target := strings.TrimSuffix(itemName, ".zsync")
+				if changed[versionName][stream.FileItemType(target)] {
+					reason = repairReasonOutdated
+				}
+			}
+
+			if reason == "" {
+				continue
+			}
+
+			delete(version.Items, itemName)
+			changes = append(changes, repairChange{Version: versionName, Item: itemName, Change: repairChangeRemoved, Reason: reason})
+		}
+	}
+
+	return changes, nil
+}
+
+// repairVersion updates the sizes and hashes of the version items that do not
+// match their files, and removes the items whose files are missing. Combined
+// hashes of the metadata item are recalculated if any item is changed. It
+// returns the changes made, and the types of the changed and removed items.
+func repairVersion(ctx context.Context, rootDir string, b storage.Backend, cache *stream.HashCache, version stream.Version) ([]repairChange, map[string]bool, error) {
+	var changes []repairChange
+	changed := make(map[string]bool)
+
+	itemNames := shared.MapKeys(version.Items)
+	slices.Sort(itemNames)
+
+	for _, itemName := range itemNames {
+		item := version.Items[itemName]
+
+		info, err := b.Stat(item.Path)
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				return nil, nil, err
+			}
+
+			delete(version.Items, itemName)
+			changes = append(changes, repairChange{Item: itemName, Change: repairChangeRemoved, Reason: repairReasonMissing})
+			changed[item.Ftype] = true
+			continue
+		}
+
+		algorithms := []stream.ChecksumAlgorithm{stream.ChecksumSHA256}
+		if item.SHA512 != "" {
+			algorithms = append(algorithms, stream.ChecksumSHA512)
+		}
+
+		hashes, err := cache.FileHashes(ctx, rootDir, algorithms, item.Path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Item %q: %w", itemName, err)
+		}
+
+		repaired := item
+		repaired.Size = info.Size()
+		repaired.SHA256 = hashes[stream.ChecksumSHA256]
+		if item.SHA512 != "" {
+			repaired.SHA512 = hashes[stream.ChecksumSHA512]
+		}
+
+		if repaired.Size == item.Size && repaired.SHA256 == item.SHA256 && repaired.SHA512 == item.SHA512 {
+			continue
+		}
+
+		// Fields derived from the content of the file no longer apply.
+		repaired.InstalledSize = 0
+		repaired.VirtualSize = 0
+		repaired.Compression = ""
+
+		version.Items[itemName] = repaired
+		changes = append(changes, itemChanges(itemName, item, repaired)...)
+		changed[item.Ftype] = true
+	}
+
+	if len(changed) == 0 {
+		return changes, changed, nil
+	}
+
+	metaItem, ok := version.Items[stream.ItemTypeMetadata]
+	if !ok {
+		return changes, changed, nil
+	}
+
+	// Recalculate the combined hashes of the metadata with each of the
+	// root filesystems, which are cleared for the removed ones.
+	repaired := metaItem
+	repaired.CombinedSHA256SquashFs = ""
+	repaired.CombinedSHA256DiskKvmImg = ""
+	repaired.CombinedSHA256DiskImg = ""
+	repaired.CombinedSHA256RootXz = ""
+
+	for _, itemName := range itemNames {
+		item, ok := version.Items[itemName]
+		if !ok || !slices.Contains(rootfsTypes, item.Ftype) {
+			continue
+		}
+
+		combined, err := cache.FileHash(ctx, rootDir, metaItem.Path, item.Path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Item %q: %w", itemName, err)
+		}
+
+		switch item.Ftype {
+		case stream.ItemTypeSquashfs:
+			repaired.CombinedSHA256SquashFs = combined
+		case stream.ItemTypeDiskKVM:
+			repaired.CombinedSHA256DiskKvmImg = combined
+		case stream.ItemTypeDiskRaw:
+			repaired.CombinedSHA256DiskImg = combined
+		case stream.ItemTypeRootTarXz:
+			repaired.CombinedSHA256RootXz = combined
+		}
+	}
+
+	version.Items[stream.ItemTypeMetadata] = repaired
+	changes = append(changes, itemChanges(stream.ItemTypeMetadata, metaItem, repaired)...)
+
+	return changes, changed, nil
+}
+
+// itemChanges returns the changes of the item fields that differ between the
+// old and the new item.
+func itemChanges(itemName string, oldItem stream.Item, newItem stream.Item) []repairChange {
+	formatSize := func(size int64) string {
+		if size == 0 {
+			return ""
+		}
+
+		return strconv.FormatInt(size, 10)
+	}
+
+	fields := []struct {
+		name     string
+		oldValue string
+		newValue string
+	}{
+		{name: "size", oldValue: strconv.FormatInt(oldItem.Size, 10), newValue: strconv.FormatInt(newItem.Size, 10)},
+		{name: "sha256", oldValue: oldItem.SHA256, newValue: newItem.SHA256},
+		{name: "sha512", oldValue: oldItem.SHA512, newValue: newItem.SHA512},
+		{name: "combined_squashfs_sha256", oldValue: oldItem.CombinedSHA256SquashFs, newValue: newItem.CombinedSHA256SquashFs},
+		{name: "combined_disk-kvm-img_sha256", oldValue: oldItem.CombinedSHA256DiskKvmImg, newValue: newItem.CombinedSHA256DiskKvmImg},
+		{name: "combined_disk1-img_sha256", oldValue: oldItem.CombinedSHA256DiskImg, newValue: newItem.CombinedSHA256DiskImg},
+		{name: "combined_rootxz_sha256", oldValue: oldItem.CombinedSHA256RootXz, newValue: newItem.CombinedSHA256RootXz},
+		{name: "installed_size", oldValue: formatSize(oldItem.InstalledSize), newValue: formatSize(newItem.InstalledSize)},
+		{name: "virtual_size", oldValue: formatSize(oldItem.VirtualSize), newValue: formatSize(newItem.VirtualSize)},
+		{name: "compression", oldValue: oldItem.Compression, newValue: newItem.Compression},
+	}
+
+	var changes []repairChange
+
+	for _, f := range fields {
+		if f.oldValue == f.newValue {
+			continue
+		}
+
+		changes = append(changes, repairChange{Item: itemName, Change: f.name, Old: f.oldValue, New: f.newValue})
+	}
+
+	return changes
+}
+
+// writeRepairResult writes the changes in the given format (table or json).
+// Hashes are shortened in the table.
+func writeRepairResult(w io.Writer, result *repairResult, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+
+	orDash := func(value string) string {
+		if value == "" {
+			return "-"
+		}
+
+		return value
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STREAM\tPRODUCT\tVERSION\tITEM\tCHANGE\tOLD\tNEW")
+
+	for _, c := range result.Changes {
+		change := c.Change
+		if c.Reason != "" {
+			change = fmt.Sprintf("%s (%s)", c.Change, c.Reason)
+		}
+
+		oldValue := c.Old
+		newValue := c.New
+		if strings.Contains(c.Change, "sha") {
+			oldValue = oldValue[:min(len(oldValue), 12)]
+			newValue = newValue[:min(len(newValue), 12)]
+		}
+
+		fmt.Fprintf(tw, "%s\n", strings.Join([]string{
+			c.Stream,
+			c.Product,
+			orDash(c.Version),
+			orDash(c.Item),
+			change,
+			orDash(oldValue),
+			orDash(newValue),
+		}, "\t"))
+	}
+
+	return tw.Flush()
+}
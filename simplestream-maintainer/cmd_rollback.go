@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+type rollbackOptions struct {
+	global *globalOptions
+
+	StreamVersion string
+	Snapshot      string
+	List          bool
+	LockTimeout   time.Duration
+}
+
+func (o *rollbackOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rollback <path> [flags]",
+		Short: "Republish the index and product catalogs of the previous build",
+		Long: `Republish the index and product catalogs of the previous build.
+
+Before publishing the new index and product catalogs, the build command keeps a snapshot of the
+currently published ones, including their compressed and signed variants (see --snapshots of the build
+command). Rollback republishes the latest snapshot, or the one given by --snapshot, and removes it, so
+that repeated rollbacks go further back. Product catalogs are republished before the index, and
+metadata files that are not part of the snapshot are removed.
+
+Image files are not affected, therefore, files of the restored versions must not have been pruned
+since the snapshot was created. Use --list to show the available snapshots.
+
+The path may also be an S3 URL in the format s3://bucket/prefix (see the build command).`,
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringVar(&o.StreamVersion, "stream-version", "v1", "Stream version")
+	cmd.PersistentFlags().StringVar(&o.Snapshot, "snapshot", "", "ID of the snapshot to restore (defaults to the latest snapshot)")
+	cmd.PersistentFlags().BoolVar(&o.List, "list", false, "List available snapshots instead of restoring one")
+	cmd.PersistentFlags().DurationVar(&o.LockTimeout, "lock-timeout", defaultLockTimeout, "Maximum time to wait for a build or prune to finish (0 fails immediately)")
+
+	return cmd
+}
+
+func (o *rollbackOptions) Run(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
+	}
+
+	b, err := storage.New(args[0])
+	if err != nil {
+		return err
+	}
+
+	if o.List {
+		snapshots, err := stream.ListSnapshots(b, o.StreamVersion)
+		if err != nil {
+			return err
+		}
+
+		return writeSnapshots(cmd.OutOrStdout(), snapshots)
+	}
+
+	err = rollback(o.global.ctx, b, o.StreamVersion, o.Snapshot, o.LockTimeout)
+	recordCommand(args[0], "rollback", cmd, args, err)
+
+	return err
+}
+
+// rollback restores the snapshot with the given ID, or the latest snapshot if
+// the ID is empty, and removes it once it is restored.
+func rollback(ctx context.Context, b storage.Backend, streamVersion string, snapshotID string, lockTimeout time.Duration) error {
+	// Hold the streams lock, so that the restored files are not replaced
+	// by a concurrent build.
+	unlock, err := lockStreams(ctx, b, lockTimeout)
+	if err != nil {
+		return err
+	}
+
+	defer unlock()
+
+	snapshot, err := stream.GetSnapshot(b, streamVersion, snapshotID)
+	if err != nil {
+		return err
+	}
+
+	err = stream.RestoreSnapshot(b, streamVersion, *snapshot)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Restored snapshot", "snapshot", snapshot.ID, "created", snapshot.CreatedAt.Format(time.RFC3339))
+
+	return stream.DeleteSnapshot(b, streamVersion, snapshot.ID)
+}
+
+// writeSnapshots writes the snapshots as a table, starting with the latest.
+func writeSnapshots(w io.Writer, snapshots []stream.Snapshot) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCREATED\tFILES")
+
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		s := snapshots[i]
+		fmt.Fprintf(tw, "%s\t%s\t%d\n", s.ID, s.CreatedAt.Format(time.RFC3339), len(s.Files))
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/canonical/lxd/shared/units"
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/config"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/server"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/systemd"
+)
+
+type serveOptions struct {
+	global *globalOptions
+
+	ListenAddr      string
+	ShutdownTimeout time.Duration
+	URLTTL          time.Duration
+	RequestTimeout  time.Duration
+	AuthTokenFile   string
+	StreamRedirects map[string]string
+	WebPage         string
+	Blobs           bool
+	ProductsAPI     bool
+	StreamVersions  []string
+	MetadataMaxAge  time.Duration
+	FileMaxAge      time.Duration
+	APITokenFile    string
+	APIBuildArgs    string
+	APIPruneArgs    string
+	BuildInterval   time.Duration
+	PruneInterval   time.Duration
+
+	MaxBandwidth         string
+	MaxConnBandwidth     string
+	MaxConnections       int
+	MaxClientConnections int
+}
+
+func (o *serveOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "serve <path> [flags]",
+		Short: "Serve simplestream content from the given path over HTTP",
+		Long: `Serve simplestream content from the given path over HTTP.
+
+Optional features, such as the web page, products and jobs APIs, scheduled builds and prunes, and
+bandwidth limits, are enabled by the flags below. Views, network access policies, and rate limits
+are configured in the configuration file.
+
+The path may also be an S3 URL in the format s3://bucket/prefix, in which case the requests for
+image files are redirected to the pre-signed S3 URLs.`,
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringVar(&o.ListenAddr, "listen", ":8080", "Address on which the server listens")
+	cmd.PersistentFlags().DurationVar(&o.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "Maximum time to wait for active connections on shutdown")
+	cmd.PersistentFlags().DurationVar(&o.RequestTimeout, "request-timeout", server.DefaultRequestTimeout, "Maximum time to start responding to a request (0 disables the timeout)")
+	cmd.PersistentFlags().StringVar(&o.AuthTokenFile, "auth-token-file", "", "File containing the bearer token required from clients")
+	cmd.PersistentFlags().StringToStringVar(&o.StreamRedirects, "stream-redirect", nil, "Redirect requests for missing files of the old stream version to the new one (format: old=new)")
+	cmd.PersistentFlags().StringVar(&o.WebPage, "webpage", "", "Stream whose product catalog is rendered as the root web page (refreshed whenever the product catalog is rebuilt)")
+	cmd.PersistentFlags().BoolVar(&o.Blobs, "blobs", false, "Serve items of the product catalogs by their SHA256 hash on /blob/sha256/<hash>")
+	cmd.PersistentFlags().BoolVar(&o.ProductsAPI, "products-api", false, "Serve products on /api/products and their delta graphs on /api/deltas, filtered by the os, release, arch, variant, stream, and q query parameters")
+	cmd.PersistentFlags().StringSliceVar(&o.StreamVersions, "stream-version", []string{"v1"}, "Stream versions listed on /api/streams, where the web page and products API serve the one selected by the stream_version query parameter (the first one is the default, and the only one whose items are served by hash)")
+	cmd.PersistentFlags().DurationVar(&o.MetadataMaxAge, "metadata-max-age", 0, "Time for which clients may cache the index, product catalogs, and web page without revalidating them using ETags")
+	cmd.PersistentFlags().DurationVar(&o.FileMaxAge, "file-max-age", server.DefaultFileMaxAge, "Time for which clients may cache the image files without revalidating them")
+	cmd.PersistentFlags().DurationVar(&o.URLTTL, "url-ttl", server.DefaultURLTTL, "Lifetime of pre-signed download URLs (S3 only)")
+	cmd.PersistentFlags().StringVar(&o.APITokenFile, "api-token-file", "", "File containing the bearer token required to trigger builds and prunes through /api/v1/build, /api/v1/prune, and /api/v1/prune-plan (enables the jobs API)")
+	cmd.PersistentFlags().StringVar(&o.APIBuildArgs, "api-build-args", "", "Flags of the build command used for builds triggered through the jobs API")
+	cmd.PersistentFlags().StringVar(&o.APIPruneArgs, "api-prune-args", "", "Flags of the prune command used for prunes triggered through the jobs API")
+	cmd.PersistentFlags().DurationVar(&o.BuildInterval, "build-interval", 0, "Interval in which builds configured by --api-build-args are queued along with the jobs API (0 disables scheduled builds)")
+	cmd.PersistentFlags().DurationVar(&o.PruneInterval, "prune-interval", 0, "Interval in which prunes configured by --api-prune-args are queued along with the jobs API (0 disables scheduled prunes)")
+	cmd.PersistentFlags().StringVar(&o.MaxBandwidth, "max-bandwidth", "", "Maximum transfer rate per second of all responses (for example, 1GB)")
+	cmd.PersistentFlags().StringVar(&o.MaxConnBandwidth, "max-connection-bandwidth", "", "Maximum transfer rate per second of each connection (for example, 50MB)")
+	cmd.PersistentFlags().IntVar(&o.MaxConnections, "max-connections", 0, "Maximum number of open connections, where the connections over the limit wait for another one to close (0 disables the limit)")
+	cmd.PersistentFlags().IntVar(&o.MaxClientConnections, "max-client-connections", 0, "Maximum number of open connections of each client address, where the connections over the limit are closed (0 disables the limit)")
+
+	return cmd
+}
+
+func (o *serveOptions) Run(_ *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
+	}
+
+	if storage.IsLocal(args[0]) {
+		info, err := os.Stat(args[0])
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			return fmt.Errorf("Path %q is not a directory", args[0])
+		}
+	}
+
+	if o.URLTTL <= 0 {
+		return fmt.Errorf("Pre-signed URL lifetime must be positive")
+	}
+
+	if len(o.StreamVersions) == 0 || slices.Contains(o.StreamVersions, "") {
+		return fmt.Errorf("Stream versions cannot be empty")
+	}
+
+	if o.BuildInterval < 0 || o.PruneInterval < 0 {
+		return fmt.Errorf("Build and prune intervals cannot be negative")
+	}
+
+	maxBandwidth, err := parseBandwidth(o.MaxBandwidth)
+	if err != nil {
+		return err
+	}
+
+	maxConnBandwidth, err := parseBandwidth(o.MaxConnBandwidth)
+	if err != nil {
+		return err
+	}
+
+	if o.MaxConnections < 0 || o.MaxClientConnections < 0 {
+		return fmt.Errorf("Connection limits cannot be negative")
+	}
+
+	streamVersion := o.StreamVersions[0]
+
+	var authToken string
+
+	if o.AuthTokenFile != "" {
+		authToken, err = readAuthToken(o.AuthTokenFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	options := []server.Option{
+		server.WithURLTTL(o.URLTTL),
+		server.WithRequestTimeout(o.RequestTimeout),
+		server.WithAuthToken(authToken),
+		server.WithStreamRedirects(o.StreamRedirects),
+		server.WithWebPage(streamVersion, o.WebPage),
+		server.WithStreamVersions(o.StreamVersions...),
+		server.WithCacheMaxAge(o.MetadataMaxAge, o.FileMaxAge),
+		server.WithBandwidthLimits(maxBandwidth, maxConnBandwidth),
+		server.WithConnectionLimits(o.MaxConnections, o.MaxClientConnections),
+	}
+
+	if o.Blobs {
+		options = append(options, server.WithBlobs(streamVersion))
+	}
+
+	if o.ProductsAPI {
+		options = append(options, server.WithProductsAPI(streamVersion))
+	}
+
+	if o.APITokenFile != "" || o.BuildInterval > 0 || o.PruneInterval > 0 {
+		operations, err := o.jobOperations(args[0])
+		if err != nil {
+			return err
+		}
+
+		if o.APITokenFile != "" {
+			apiToken, err := readAuthToken(o.APITokenFile)
+			if err != nil {
+				return err
+			}
+
+			options = append(options, server.WithJobs(apiToken, operations))
+		}
+
+		options = append(options,
+			server.WithSchedule("build", operations["build"], o.BuildInterval),
+			server.WithSchedule("prune", operations["prune"], o.PruneInterval),
+			server.WithJobsAudit(func(job server.Job, input []byte) {
+				recordJob(args[0], job, input)
+			}),
+		)
+	}
+
+	conf, err := config.Load(args[0])
+	if err != nil {
+		return err
+	}
+
+	views := make([]server.View, 0, len(conf.Views))
+	for _, view := range conf.Views {
+		views = append(views, server.View{
+			Name:          view.Name,
+			Hosts:         view.Hosts,
+			Architectures: view.Architectures,
+		})
+	}
+
+	if len(views) > 0 {
+		options = append(options, server.WithViews(streamVersion, views...))
+	}
+
+	accessOptions, err := serverAccessOptions(conf.Access)
+	if err != nil {
+		return err
+	}
+
+	options = append(options, accessOptions...)
+
+	s, err := server.NewServer(args[0], options...)
+	if err != nil {
+		return err
+	}
+
+	// Listeners are opened upfront, so that the server does not start if
+	// any of the addresses is unavailable.
+	listener, err := net.Listen("tcp", o.ListenAddr)
+	if err != nil {
+		return err
+	}
+
+	listeners := make(map[string]net.Listener, len(conf.Views))
+	for _, view := range conf.Views {
+		if view.Listen == "" {
+			continue
+		}
+
+		viewListener, err := net.Listen("tcp", view.Listen)
+		if err != nil {
+			_ = listener.Close()
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+
+			return fmt.Errorf("View %q: %w", view.Name, err)
+		}
+
+		listeners[view.Name] = viewListener
+	}
+
+	// Stop all listeners once any of them fails.
+	ctx, cancel := context.WithCancel(o.global.ctx)
+	defer cancel()
+
+	// Requests are accepted as soon as the listeners are open.
+	notifyServiceManager(ctx)
+
+	errCh := make(chan error, len(listeners)+1)
+
+	go func() {
+		errCh <- s.Serve(ctx, listener, o.ShutdownTimeout)
+	}()
+
+	for name, listener := range listeners {
+		go func() {
+			errCh <- s.ServeView(ctx, name, listener, o.ShutdownTimeout)
+		}()
+	}
+
+	var errs []error
+	for range len(listeners) + 1 {
+		err := <-errCh
+		if err != nil {
+			errs = append(errs, err)
+			cancel()
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// notifyServiceManager notifies the service manager (systemd) that the service
+// is ready, and sends the watchdog keep-alives until the context is cancelled,
+// after which the service manager is notified that the service is stopping.
+// Nothing is sent if the process is not run by the service manager.
+func notifyServiceManager(ctx context.Context) {
+	notify := func(state string) {
+		err := systemd.Notify(state)
+		if err != nil {
+			slog.Warn("Failed to notify service manager", "state", state, "error", err)
+		}
+	}
+
+	notify(systemd.Ready)
+
+	go func() {
+		systemd.RunWatchdog(ctx)
+
+		<-ctx.Done()
+		notify(systemd.Stopping)
+	}()
+}
+
+// parseBandwidth parses the transfer rate in bytes per second from the human
+// readable size (for example, "50MB" or "1GiB"). Empty value means no limit.
+func parseBandwidth(value string) (int64, error) {
+	bandwidth, err := units.ParseByteSizeString(value)
+	if err != nil || bandwidth < 0 {
+		return 0, fmt.Errorf("Invalid bandwidth %q", value)
+	}
+
+	return bandwidth, nil
+}
+
+// readAuthToken reads the bearer token from the given file.
+func readAuthToken(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read auth token: %w", err)
+	}
+
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("Auth token file %q is empty", path)
+	}
+
+	return token, nil
+}
+
+// jobOperations returns the build, prune, and prune plan operations of the
+// given path that are triggered through the jobs API. Their options are parsed from the flags
+// of the build and prune commands, so that the operations behave the same as
+// when the commands are run directly.
+func (o *serveOptions) jobOperations(rootDir string) (map[string]server.Operation, error) {
+	build := buildOptions{global: o.global}
+
+	err := build.NewCommand().ParseFlags(strings.Fields(o.APIBuildArgs))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid build arguments: %w", err)
+	}
+
+	buildOpts, err := build.buildOptions()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid build arguments: %w", err)
+	}
+
+	prune := pruneOptions{global: o.global}
+
+	err = prune.NewCommand().ParseFlags(strings.Fields(o.APIPruneArgs))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid prune arguments: %w", err)
+	}
+
+	return map[string]server.Operation{
+		"build": func(ctx context.Context, _ []byte) (any, error) {
+			return nil, buildIndex(ctx, rootDir, build.StreamVersion, build.ImageDirs, build.Workers, build.BuildWebPage, buildOpts...)
+		},
+		"prune": func(ctx context.Context, input []byte) (any, error) {
+			// Prune proceeds only if it matches the approved plan,
+			// if given.
+			var approved *prunePlan
+			if len(input) > 0 {
+				approved = &prunePlan{}
+
+				err := json.Unmarshal(input, approved)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid approved prune plan: %w", err)
+				}
+			}
+
+			return nil, prune.prune(ctx, rootDir, approved)
+		},
+		"prune-plan": func(ctx context.Context, _ []byte) (any, error) {
+			return prune.plan(ctx, rootDir)
+		},
+	}, nil
+}
+
+// serverAccessOptions returns the server options that apply the given network
+// access policies.
+func serverAccessOptions(access config.AccessConfig) ([]server.Option, error) {
+	var downloads server.AccessList
+	var admin server.AccessList
+	var err error
+
+	downloads.Allow, downloads.Deny, err = access.Downloads.Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	admin.Allow, admin.Deny, err = access.Admin.Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	limits := make([]server.RateLimit, 0, len(access.RateLimits))
+	for _, limit := range access.RateLimits {
+		networks, err := config.ParseNetworks(limit.Networks)
+		if err != nil {
+			return nil, err
+		}
+
+		limits = append(limits, server.RateLimit{
+			Networks: networks,
+			Rate:     limit.Rate,
+			Burst:    limit.BurstOrDefault(),
+		})
+	}
+
+	return []server.Option{
+		server.WithAccessLists(downloads, admin),
+		server.WithRateLimits(limits...),
+	}, nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/webpage"
+)
+
+type statsOptions struct {
+	global *globalOptions
+
+	StreamVersion string
+	Streams       []string
+	Products      bool
+	Format        string
+	Bytes         bool
+}
+
+func (o *statsOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "stats <path> [flags]",
+		Short: "Show statistics of the published streams and products",
+		Long: `Show statistics of the streams and products published in the index.
+
+For each stream (and each product if --products is set), the number of products and versions, the total
+size of the items referenced by the product catalog, the size of the delta items, and the delta savings
+are shown. Delta savings are the sum of the differences between the size of each full item and the size
+of the delta item that updates it. For local paths, the disk usage of the items is shown as well, which
+is less than their size if the image files are sparse. Oldest and newest versions are determined by the version names, and
+the last build time is the time when the index entry of the stream was last updated.
+
+The path may also be an S3 URL in the format s3://bucket/prefix (see the build command).`,
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringVar(&o.StreamVersion, "stream-version", "v1", "Stream version")
+	cmd.PersistentFlags().StringSliceVar(&o.Streams, "stream", nil, "Streams to show (defaults to all streams in the index)")
+	cmd.PersistentFlags().BoolVar(&o.Products, "products", false, "Show statistics of individual products")
+	cmd.PersistentFlags().StringVar(&o.Format, "format", "table", "Output format (table, json)")
+	cmd.PersistentFlags().BoolVar(&o.Bytes, "bytes", false, "Report sizes in bytes (table format only)")
+
+	return cmd
+}
+
+func (o *statsOptions) Run(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
+	}
+
+	if o.Format != "table" && o.Format != "json" {
+		return fmt.Errorf("Invalid output format %q. Valid formats are: [table, json]", o.Format)
+	}
+
+	stats, err := streamStatistics(args[0], o.StreamVersion, o.Streams, o.Products)
+	if err != nil {
+		return err
+	}
+
+	return writeStreamStats(cmd.OutOrStdout(), stats, o.Format, o.Bytes)
+}
+
+// productStats holds the statistics of a single product, or the aggregated
+// statistics of all products of a stream.
+type productStats struct {
+	Versions     int    `json:"versions"`
+	Size         int64  `json:"size"`
+	DiskUsage    int64  `json:"disk_usage,omitempty"`
+	DeltaSize    int64  `json:"delta_size"`
+	DeltaSavings int64  `json:"delta_savings"`
+	Oldest       string `json:"oldest_version,omitempty"`
+	Newest       string `json:"newest_version,omitempty"`
+}
+
+// add adds the statistics of the product to the aggregated statistics.
+func (s *productStats) add(other productStats) {
+	s.Versions += other.Versions
+	s.Size += other.Size
+	s.DiskUsage += other.DiskUsage
+	s.DeltaSize += other.DeltaSize
+	s.DeltaSavings += other.DeltaSavings
+
+	if other.Oldest != "" && (s.Oldest == "" || other.Oldest < s.Oldest) {
+		s.Oldest = other.Oldest
+	}
+
+	if other.Newest > s.Newest {
+		s.Newest = other.Newest
+	}
+}
+
+// streamStats holds the statistics of a single stream.
+type streamStats struct {
+	Stream        string `json:"stream"`
+	Updated       string `json:"updated,omitempty"`
+	ProductsCount int    `json:"products_count"`
+
+	productStats
+
+	// Products contains the statistics of individual products mapped by
+	// the product ID, if requested.
+	Products map[string]productStats `json:"products,omitempty"`
+}
+
+// newProductStats calculates the statistics of the given product. If diskUsage
+// is not nil, it is used to determine the disk usage of each item.
+func newProductStats(p stream.Product, diskUsage func(itemPath string) int64) productStats {
+	stats := productStats{Versions: len(p.Versions)}
+
+	for name, version := range p.Versions {
+		if stats.Oldest == "" || name < stats.Oldest {
+			stats.Oldest = name
+		}
+
+		if name > stats.Newest {
+			stats.Newest = name
+		}
+
+		// Sizes of the full items mapped by the item type.
+		fullSizes := make(map[string]int64)
+		for _, item := range version.Items {
+			stats.Size += item.Size
+			fullSizes[item.Ftype] = item.Size
+
+			if diskUsage != nil {
+				stats.DiskUsage += diskUsage(item.Path)
+			}
+		}
+
+		for _, item := range version.Items {
+			baseType, ok := stream.DeltaBaseType(item.Ftype)
+			if !ok {
+				continue
+			}
+
+			stats.DeltaSize += item.Size
+
+			fullSize, ok := fullSizes[baseType]
+			if ok && fullSize > item.Size {
+				stats.DeltaSavings += fullSize - item.Size
+			}
+		}
+	}
+
+	return stats
+}
+
+// streamStatistics returns the statistics of the given streams published in
+// the index. If no streams are given, all streams in the index are included.
+// Product catalogs are read one product at a time.
+func streamStatistics(rootDir string, streamVersion string, streamNames []string, withProducts bool) ([]streamStats, error) {
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	indexPath := path.Join("streams", streamVersion, "index.json")
+
+	index, err := storage.ReadJSONFile(b, indexPath, &stream.StreamIndex{})
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("Index %q not found", indexPath)
+		}
+
+		return nil, err
+	}
+
+	if len(streamNames) == 0 {
+		streamNames = shared.MapKeys(index.Index)
+	} else {
+		streamNames = slices.Clone(streamNames)
+	}
+
+	slices.Sort(streamNames)
+
+	// Disk usage is known only for local files. Hard linked files are
+	// counted for each item.
+	var diskUsage func(itemPath string) int64
+
+	local, ok := b.(*storage.Local)
+	if ok {
+		diskUsage = func(itemPath string) int64 {
+			info, err := os.Stat(local.Path(itemPath))
+			if err != nil || !info.Mode().IsRegular() {
+				return 0
+			}
+
+			usage, _ := shared.DiskUsage(info)
+			return usage
+		}
+	}
+
+	result := make([]streamStats, 0, len(streamNames))
+
+	for _, streamName := range streamNames {
+		entry, ok := index.Index[streamName]
+		if !ok {
+			return nil, fmt.Errorf("Stream %q not found in the index", streamName)
+		}
+
+		stats := streamStats{
+			Stream:  streamName,
+			Updated: entry.Updated,
+		}
+
+		if withProducts {
+			stats.Products = make(map[string]productStats)
+		}
+
+		err := readCatalogProducts(b, entry.Path, func(id string, p stream.Product) {
+			product := newProductStats(p, diskUsage)
+
+			stats.ProductsCount++
+			stats.add(product)
+
+			if withProducts {
+				stats.Products[id] = product
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read product catalog %q: %w", entry.Path, err)
+		}
+
+		result = append(result, stats)
+	}
+
+	return result, nil
+}
+
+// readCatalogProducts calls the given function for each product of the product
+// catalog with the given name.
+func readCatalogProducts(b storage.Backend, name string, fn func(id string, p stream.Product)) error {
+	file, err := b.Open(name)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	reader, err := stream.NewCatalogReader(file)
+	if err != nil {
+		return err
+	}
+
+	for {
+		id, product, err := reader.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			return err
+		}
+
+		fn(id, product)
+	}
+}
+
+// writeStreamStats writes the statistics in the given format. Table lists the
+// streams along with their products, if included.
+func writeStreamStats(w io.Writer, stats []streamStats, format string, bytes bool) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	}
+
+	formatSize := webpage.FormatSize
+	if bytes {
+		formatSize = func(size int64) string { return strconv.FormatInt(size, 10) }
+	}
+
+	orDash := func(value string) string {
+		if value == "" {
+			return "-"
+		}
+
+		return value
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STREAM\tPRODUCT\tPRODUCTS\tVERSIONS\tSIZE\tDISK USAGE\tDELTA SIZE\tDELTA SAVINGS\tOLDEST\tNEWEST\tUPDATED")
+
+	writeRow := func(streamName string, product string, productsCount string, s productStats, updated string) {
+		// Disk usage is not known for remote files.
+		diskUsage := ""
+		if s.DiskUsage > 0 {
+			diskUsage = formatSize(s.DiskUsage)
+		}
+
+		fmt.Fprintf(tw, "%s\n", strings.Join([]string{
+			streamName,
+			orDash(product),
+			productsCount,
+			strconv.Itoa(s.Versions),
+			formatSize(s.Size),
+			orDash(diskUsage),
+			formatSize(s.DeltaSize),
+			formatSize(s.DeltaSavings),
+			orDash(s.Oldest),
+			orDash(s.Newest),
+			orDash(updated),
+		}, "\t"))
+	}
+
+	for _, s := range stats {
+		writeRow(s.Stream, "", strconv.Itoa(s.ProductsCount), s.productStats, s.Updated)
+
+		ids := shared.MapKeys(s.Products)
+		slices.Sort(ids)
+
+		for _, id := range ids {
+			writeRow(s.Stream, id, "-", s.Products[id], "")
+		}
+	}
+
+	return tw.Flush()
+}
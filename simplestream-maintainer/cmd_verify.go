@@ -0,0 +1,548 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/pool"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+type verifyOptions struct {
+	global *globalOptions
+
+	StreamVersion      string
+	ImageDirs          []string
+	Workers            int
+	Checkpoint         string
+	CheckpointInterval time.Duration
+	Sample             float64
+	Period             int
+	HashCommand        string
+	Keyring            string
+}
+
+func (o *verifyOptions) NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify <path> [flags]",
+		Short: "Verify product catalog items",
+		Long: `Verify that the items referenced from product catalogs exist and match their size and SHA256 hash.
+
+Verification of very large trees can be interrupted and resumed by using a checkpoint file. The verified
+items are periodically recorded in the checkpoint file, and skipped when the verification is resumed.
+Once the verification completes, the checkpoint file is removed.
+
+Instead of verifying all items, either a random sample of items can be verified, or the verification
+can be spread over a period of days, where each run verifies a different subset of items.
+
+Verification of SHA256 hashes can be delegated to an external command, such as "sha256sum --check".
+The command is run in the root directory for batches of items, and receives the list of items in the
+format of the sha256sum utility on its standard input (or in the file referenced by the {file}
+argument). The result of each item is parsed from the command output in the format "<path>: OK".
+
+If a GPG keyring is set (see --keyring), the detached signatures of the version checksum files (for
+example, SHA256SUMS.gpg or SHA256SUMS.asc) are also verified against the keys from the keyring.`,
+		GroupID: "main",
+		RunE:    o.Run,
+	}
+
+	cmd.PersistentFlags().StringVar(&o.StreamVersion, "stream-version", "v1", "Stream version")
+	cmd.PersistentFlags().StringSliceVarP(&o.ImageDirs, "image-dir", "d", []string{"images"}, "Image directory (relative to path argument)")
+	cmd.PersistentFlags().IntVar(&o.Workers, "workers", max(runtime.NumCPU()/2, 1), "Maximum number of concurrent operations")
+	cmd.PersistentFlags().StringVar(&o.Checkpoint, "checkpoint", "", "Path of the checkpoint file used to resume interrupted verification")
+	cmd.PersistentFlags().DurationVar(&o.CheckpointInterval, "checkpoint-interval", time.Minute, "Interval in which the checkpoint file is written")
+	cmd.PersistentFlags().Float64Var(&o.Sample, "sample", 100, "Percentage of randomly selected items to verify")
+	cmd.PersistentFlags().IntVar(&o.Period, "period", 0, "Number of days over which verification of all items is spread (one subset per day)")
+	cmd.PersistentFlags().StringVar(&o.HashCommand, "hash-command", "", "External command used to verify SHA256 hashes (for example, \"sha256sum --check\")")
+	cmd.PersistentFlags().StringVar(&o.Keyring, "keyring", "", "GPG keyring (as exported by \"gpg --export\") used to verify signed checksum files of the versions")
+
+	return cmd
+}
+
+func (o *verifyOptions) Run(_ *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
+	}
+
+	if o.Sample <= 0 || o.Sample > 100 {
+		return fmt.Errorf("Sample percentage must be within range (0, 100]")
+	}
+
+	if o.Period < 0 {
+		return fmt.Errorf("Period cannot be negative")
+	}
+
+	if o.Period > 0 && o.Sample < 100 {
+		return fmt.Errorf("Flags %q and %q cannot be used together", "--sample", "--period")
+	}
+
+	var sigErr error
+	if o.Keyring != "" {
+		sigErr = verifySignatures(o.global.ctx, args[0], o.StreamVersion, o.ImageDirs, stream.NewVerifier(o.Keyring))
+	}
+
+	err := verifyItems(o.global.ctx, args[0], o.StreamVersion, o.ImageDirs, o.Workers, verifySelection{
+		Sample: o.Sample,
+		Period: o.Period,
+	}, strings.Fields(o.HashCommand), o.Checkpoint, o.CheckpointInterval)
+
+	return errors.Join(sigErr, err)
+}
+
+// verifySelection determines which items are verified.
+type verifySelection struct {
+	// Sample is the percentage of randomly selected items.
+	Sample float64 `json:"sample"`
+
+	// Seed is the seed used for random selection of items. It is stored in
+	// the checkpoint to ensure the same items are selected on resume.
+	Seed int64 `json:"seed"`
+
+	// Period is the number of days over which the verification of all items
+	// is spread.
+	Period int `json:"period"`
+
+	// Slot is the subset of items (within the period) that is verified.
+	Slot int `json:"slot"`
+}
+
+// selects returns true if the item on the given path is selected for
+// verification.
+func (s verifySelection) selects(itemPath string) bool {
+	h := fnv.New64a()
+	_ = binary.Write(h, binary.LittleEndian, s.Seed)
+	_, _ = h.Write([]byte(itemPath))
+	sum := h.Sum64()
+
+	if s.Period > 1 {
+		return sum%uint64(s.Period) == uint64(s.Slot)
+	}
+
+	if s.Sample < 100 {
+		return float64(sum%10000) < s.Sample*100
+	}
+
+	return true
+}
+
+// verifyCheckpoint records the progress of the verification.
+type verifyCheckpoint struct {
+	// Selection of the items that are being verified.
+	Selection verifySelection `json:"selection"`
+
+	// Paths of verified items.
+	Verified []string `json:"verified"`
+
+	// Paths of items that failed the verification.
+	Failed []string `json:"failed"`
+}
+
+// verifyItem is an item referenced from the product catalog.
+type verifyItem struct {
+	Path   string
+	Size   int64
+	SHA256 string
+}
+
+// verifyBatchSize is the number of items verified by a single invocation of
+// the external hash command.
+const verifyBatchSize = 64
+
+// verifyItems verifies that items referenced from product catalogs of the
+// given streams exist and match their size and SHA256 hash. If hash command
+// is not empty, SHA256 hashes are verified by the external command. If
+// checkpoint path is not empty, the progress is periodically written to the
+// checkpoint file, and verification is resumed from it if the file already
+// exists.
+func verifyItems(ctx context.Context, rootDir string, streamVersion string, streamNames []string, workers int, selection verifySelection, hashCommand []string, checkpointPath string, checkpointInterval time.Duration) error {
+	var checkpoint *verifyCheckpoint
+
+	// Resume from the checkpoint if it exists and was created for the same
+	// kind of selection.
+	if checkpointPath != "" {
+		cp, err := shared.ReadJSONFile(checkpointPath, &verifyCheckpoint{})
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("Failed to read checkpoint: %w", err)
+		}
+
+		if cp != nil && cp.Selection.Sample == selection.Sample && cp.Selection.Period == selection.Period {
+			slog.Info("Resuming verification from checkpoint", "checkpoint", checkpointPath, "verified", len(cp.Verified), "failed", len(cp.Failed))
+			checkpoint = cp
+		}
+	}
+
+	// Initialize new selection unless resumed.
+	if checkpoint == nil {
+		checkpoint = &verifyCheckpoint{
+			Selection: selection,
+		}
+
+		checkpoint.Selection.Seed = rand.Int63()
+
+		if selection.Period > 1 {
+			// Use the same seed for all slots within the period, so
+			// that each item is verified exactly once per period.
+			checkpoint.Selection.Seed = 0
+			checkpoint.Selection.Slot = int(time.Now().Unix()/int64(24*time.Hour/time.Second)) % selection.Period
+		}
+	}
+
+	// Collect items from all product catalogs.
+	var items []verifyItem
+
+	for _, streamName := range streamNames {
+		catalogPath := filepath.Join(rootDir, "streams", streamVersion, fmt.Sprintf("%s.json", streamName))
+		catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+		if err != nil {
+			return err
+		}
+
+		for _, p := range catalog.Products {
+			for _, v := range p.Versions {
+				for _, item := range v.Items {
+					items = append(items, verifyItem{
+						Path:   item.Path,
+						Size:   item.Size,
+						SHA256: item.SHA256,
+					})
+				}
+			}
+		}
+	}
+
+	slices.SortFunc(items, func(a, b verifyItem) int {
+		return cmp.Compare(a.Path, b.Path)
+	})
+
+	done := make(map[string]bool, len(checkpoint.Verified)+len(checkpoint.Failed))
+	for _, path := range checkpoint.Verified {
+		done[path] = true
+	}
+
+	for _, path := range checkpoint.Failed {
+		done[path] = true
+	}
+
+	var mutex sync.Mutex // To safely update the checkpoint.
+
+	// saveCheckpoint writes the current progress to the checkpoint file.
+	saveCheckpoint := func() {
+		if checkpointPath == "" {
+			return
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		pathTemp := filepath.Join(filepath.Dir(checkpointPath), fmt.Sprintf(".%s.tmp", filepath.Base(checkpointPath)))
+
+		err := shared.WriteJSONFile(pathTemp, checkpoint)
+		if err == nil {
+			err = os.Rename(pathTemp, checkpointPath)
+		}
+
+		if err != nil {
+			slog.Warn("Failed to write checkpoint", "checkpoint", checkpointPath, "error", err)
+		}
+	}
+
+	// Periodically write the checkpoint.
+	stopCheckpoints := make(chan struct{})
+	checkpointsDone := make(chan struct{})
+
+	go func() {
+		defer close(checkpointsDone)
+
+		if checkpointPath == "" || checkpointInterval <= 0 {
+			return
+		}
+
+		ticker := time.NewTicker(checkpointInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stopCheckpoints:
+				return
+			case <-ticker.C:
+				saveCheckpoint()
+			}
+		}
+	}()
+
+	var selected []verifyItem
+	for _, item := range items {
+		if done[item.Path] || !checkpoint.Selection.selects(item.Path) {
+			continue
+		}
+
+		selected = append(selected, item)
+	}
+
+	// Items are verified one at a time, unless they are verified in
+	// batches by the external command.
+	batchSize := 1
+	if len(hashCommand) > 0 {
+		batchSize = verifyBatchSize
+	}
+
+	workerPool := pool.New(ctx, workers)
+
+	for i := 0; i < len(selected); i += batchSize {
+		batch := selected[i:min(i+batchSize, len(selected))]
+
+		workerPool.Submit(func() {
+			var errs map[string]error
+			if len(hashCommand) > 0 {
+				errs = verifyItemsExternal(ctx, rootDir, hashCommand, batch)
+			} else {
+				errs = map[string]error{batch[0].Path: verifyItemFile(ctx, rootDir, batch[0])}
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			for _, item := range batch {
+				err := errs[item.Path]
+				if err != nil {
+					slog.Error("Item verification failed", "item", item.Path, "error", err)
+					checkpoint.Failed = append(checkpoint.Failed, item.Path)
+				} else {
+					checkpoint.Verified = append(checkpoint.Verified, item.Path)
+				}
+			}
+		})
+	}
+
+	workerPool.Close()
+	close(stopCheckpoints)
+	<-checkpointsDone
+
+	// Write the final checkpoint if verification was interrupted.
+	if ctx.Err() != nil {
+		saveCheckpoint()
+		return fmt.Errorf("Verification interrupted: %w", ctx.Err())
+	}
+
+	if checkpointPath != "" {
+		err := os.Remove(checkpointPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("Failed to remove checkpoint: %w", err)
+		}
+	}
+
+	slog.Info("Verification completed", "verified", len(checkpoint.Verified), "failed", len(checkpoint.Failed))
+
+	if len(checkpoint.Failed) > 0 {
+		return fmt.Errorf("Verification failed for %d items", len(checkpoint.Failed))
+	}
+
+	return nil
+}
+
+// verifySignatures verifies the detached signatures of the checksum files of
+// all versions referenced from the product catalogs of the given streams.
+// Versions without signed checksum files are skipped.
+func verifySignatures(ctx context.Context, rootDir string, streamVersion string, streamNames []string, verifier *stream.Verifier) error {
+	verified := 0
+	failed := 0
+
+	for _, streamName := range streamNames {
+		catalogPath := filepath.Join(rootDir, "streams", streamVersion, fmt.Sprintf("%s.json", streamName))
+		catalog, err := shared.ReadJSONFile(catalogPath, &stream.ProductCatalog{})
+		if err != nil {
+			return err
+		}
+
+		for id, p := range catalog.Products {
+			for versionName, v := range p.Versions {
+				// Version path is derived from its items, since the
+				// product path depends on the path schema.
+				versionPath := ""
+				for _, item := range v.Items {
+					versionPath = filepath.Dir(item.Path)
+					break
+				}
+
+				if versionPath == "" {
+					continue
+				}
+
+				signed, err := stream.VerifyChecksumsSignature(ctx, rootDir, versionPath, verifier)
+				if err != nil {
+					if ctx.Err() != nil {
+						return fmt.Errorf("Verification interrupted: %w", ctx.Err())
+					}
+
+					slog.Error("Checksums signature verification failed", "streamName", streamName, "product", id, "version", versionName, "error", err)
+					failed++
+				} else if signed {
+					verified++
+				}
+			}
+		}
+	}
+
+	slog.Info("Signature verification completed", "verified", verified, "failed", failed)
+
+	if failed > 0 {
+		return fmt.Errorf("Verification failed for %d checksums signatures", failed)
+	}
+
+	return nil
+}
+
+// verifyItemFile ensures the item's file exists and matches the item's size
+// and SHA256 hash.
+func verifyItemFile(ctx context.Context, rootDir string, item verifyItem) error {
+	path := filepath.Join(rootDir, item.Path)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if info.Size() != item.Size {
+		return fmt.Errorf("Size mismatch: expected %d, got %d", item.Size, info.Size())
+	}
+
+	if item.SHA256 == "" {
+		return nil
+	}
+
+	hashes, err := stream.FileHashes(ctx, []stream.ChecksumAlgorithm{stream.ChecksumSHA256}, path)
+	if err != nil {
+		return err
+	}
+
+	if hashes[stream.ChecksumSHA256] != item.SHA256 {
+		return fmt.Errorf("Checksum mismatch")
+	}
+
+	return nil
+}
+
+// verifyItemsExternal verifies the given items using the external hash
+// command and returns the verification errors mapped by the item paths.
+// Sizes of the items are verified before the command is run, and only the
+// items of the expected size with a known hash are passed to the command.
+func verifyItemsExternal(ctx context.Context, rootDir string, command []string, items []verifyItem) map[string]error {
+	errs := make(map[string]error, len(items))
+
+	var list strings.Builder
+	var pending []string
+
+	for _, item := range items {
+		info, err := os.Stat(filepath.Join(rootDir, item.Path))
+		if err != nil {
+			errs[item.Path] = err
+			continue
+		}
+
+		if info.Size() != item.Size {
+			errs[item.Path] = fmt.Errorf("Size mismatch: expected %d, got %d", item.Size, info.Size())
+			continue
+		}
+
+		if item.SHA256 == "" {
+			continue
+		}
+
+		fmt.Fprintf(&list, "%s  %s\n", item.SHA256, item.Path)
+		pending = append(pending, item.Path)
+	}
+
+	if len(pending) == 0 {
+		return errs
+	}
+
+	results, err := runHashCommand(ctx, rootDir, command, list.String())
+	for _, path := range pending {
+		if err != nil {
+			errs[path] = err
+			continue
+		}
+
+		status, ok := results[path]
+		if !ok {
+			errs[path] = fmt.Errorf("No result reported by the hash command")
+		} else if status != "OK" {
+			errs[path] = fmt.Errorf("Checksum mismatch: %s", status)
+		}
+	}
+
+	return errs
+}
+
+// runHashCommand runs the external hash command in the root directory with
+// the given checksum list, which is written to the standard input of the
+// command, or to the temporary file that replaces the "{file}" argument.
+// The status of each file is parsed from the command output in the format
+// "<path>: <status>". A non-zero exit code is reported only if no status
+// is parsed, as the command is expected to fail if any checksum mismatches.
+func runHashCommand(ctx context.Context, rootDir string, command []string, list string) (map[string]string, error) {
+	args := slices.Clone(command[1:])
+
+	fileIndex := slices.Index(args, "{file}")
+	if fileIndex >= 0 {
+		file, err := os.CreateTemp("", "simplestream-maintainer-checksums-*")
+		if err != nil {
+			return nil, err
+		}
+
+		defer os.Remove(file.Name())
+
+		_, err = file.WriteString(list)
+		if err == nil {
+			err = file.Close()
+		} else {
+			_ = file.Close()
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		args[fileIndex] = file.Name()
+	}
+
+	var stderr strings.Builder
+
+	cmd := exec.CommandContext(ctx, command[0], args...)
+	cmd.Dir = rootDir
+	cmd.Stdin = strings.NewReader(list)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+
+	results := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		path, status, ok := strings.Cut(line, ": ")
+		if ok {
+			results[path] = strings.TrimSpace(status)
+		}
+	}
+
+	if err != nil && len(results) == 0 {
+		return nil, fmt.Errorf("Failed to run hash command: %w (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return results, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/watcher"
+)
+
+type watchOptions struct {
+	global *globalOptions
+	build  buildOptions
+
+	Debounce time.Duration
+}
+
+func (o *watchOptions) NewCommand() *cobra.Command {
+	// Watch command accepts the same flags as the build command.
+	cmd := o.build.NewCommand()
+	cmd.Use = "watch <path> [flags]"
+	cmd.Short = "Rebuild simplestream index on the given path whenever image directories change"
+	cmd.Long = `Build simplestream index on the given path and rebuild it whenever a new product version appears
+in the image directories.
+
+Rebuild is triggered once no changes are observed within the debounce period, which ensures that
+files uploaded together are processed within a single build. Files uploaded into hidden directories
+are ignored until the directory is renamed.
+
+When run by systemd as a service of type "notify", systemd is notified once the watch starts, and the
+watchdog keep-alives are sent if "WatchdogSec" is set for the service.`
+	cmd.RunE = o.Run
+
+	cmd.PersistentFlags().DurationVar(&o.Debounce, "debounce", 10*time.Second, "Period without changes after which the index is rebuilt")
+
+	return cmd
+}
+
+func (o *watchOptions) Run(_ *cobra.Command, args []string) error {
+	if len(args) < 1 || args[0] == "" {
+		return fmt.Errorf("Argument %q is required and cannot be empty", "path")
+	}
+
+	if !storage.IsLocal(args[0]) {
+		return fmt.Errorf("Watching is supported only for local directories")
+	}
+
+	opts, err := o.build.buildOptions()
+	if err != nil {
+		return err
+	}
+
+	rebuild := func() error {
+		return buildIndex(o.global.ctx, args[0], o.build.StreamVersion, o.build.ImageDirs, o.build.Workers, o.build.BuildWebPage, opts...)
+	}
+
+	notifyServiceManager(o.global.ctx)
+
+	return watchStreams(o.global.ctx, args[0], o.build.ImageDirs, o.Debounce, rebuild)
+}
+
+// watchStreams builds the index and rebuilds it whenever the relevant change
+// is detected within the given streams. Rebuild is deferred until there are
+// no changes within the debounce period. Build errors are logged, but do not
+// stop the watch. The function returns once the context is cancelled.
+func watchStreams(ctx context.Context, rootDir string, streamNames []string, debounce time.Duration, rebuild func() error) error {
+	dirs := make([]string, 0, len(streamNames))
+	for _, streamName := range streamNames {
+		dirs = append(dirs, filepath.Join(rootDir, streamName))
+	}
+
+	w, err := watcher.New(dirs...)
+	if err != nil {
+		return err
+	}
+
+	defer w.Close()
+
+	build := func() {
+		slog.Info("Building index")
+
+		err := rebuild()
+		if err != nil {
+			slog.Error("Failed to build index", "error", err)
+			return
+		}
+
+		slog.Info("Index built")
+	}
+
+	// Initial build ensures changes made while not watching are included.
+	build()
+
+	// Debounce timer is stopped until the first change is detected.
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case err := <-w.Errors():
+			slog.Warn("Watch error", "error", err)
+
+		case event, ok := <-w.Events():
+			if !ok {
+				return nil
+			}
+
+			if !isWatchTrigger(rootDir, event) {
+				continue
+			}
+
+			slog.Debug("Change detected", "path", event.Path)
+			timer.Reset(debounce)
+
+		case <-timer.C:
+			build()
+		}
+	}
+}
+
+// isWatchTrigger returns true if the event should trigger a rebuild. Changes
+// within hidden directories and files written by the build itself (delta
+// files and directory listings) are ignored.
+func isWatchTrigger(rootDir string, event watcher.Event) bool {
+	if event.Overflow {
+		return true
+	}
+
+	relPath, err := filepath.Rel(rootDir, event.Path)
+	if err != nil {
+		return false
+	}
+
+	for _, part := range strings.Split(relPath, string(os.PathSeparator)) {
+		if strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+
+	if event.IsDir {
+		return true
+	}
+
+	name := filepath.Base(event.Path)
+	return name != stream.FileDirIndex && !shared.HasSuffix(name, stream.ItemExtSquashfsDelta, stream.ItemExtDiskKVMDelta, stream.ItemExtDiskRawDelta, stream.ItemExtSquashfsZsync, stream.ItemExtDiskKVMZsync, stream.ItemExtDiskRawZsync)
+}
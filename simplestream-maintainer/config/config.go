@@ -0,0 +1,1007 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"math"
+	"net"
+	"net/netip"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+// FileName is the name of the configuration file that is read from the root
+// directory of the simplestream server.
+const FileName = "simplestream.yaml"
+
+// Actions applied to the new product version whose items are equal to the
+// items of an older version of the same product.
+const (
+	// DuplicatesKeep adds the duplicate version to the catalog as is.
+	DuplicatesKeep = "keep"
+
+	// DuplicatesSkip excludes the duplicate version from the catalog.
+	DuplicatesSkip = "skip"
+
+	// DuplicatesAlias adds the duplicate version to the catalog, but its
+	// items reference the files of the original version.
+	DuplicatesAlias = "alias"
+
+	// DuplicatesLink replaces the files of the duplicate version with hard
+	// links to the files of the original version. Supported only for local
+	// directories.
+	DuplicatesLink = "link"
+)
+
+// Config represents the simplestream-maintainer configuration.
+type Config struct {
+	// Requirements contains default product requirements that are applied
+	// at catalog build time if the filter matches the product and the item
+	// types of its latest version. Requirements from the image config
+	// (image.yaml) take precedence over these defaults.
+	Requirements []shared.DefinitionSimplestreamRequirements `yaml:"requirements,omitempty"`
+
+	// Aliases contains custom rolling aliases (for example, "ubuntu/lts"),
+	// where the map key is the alias name. Each alias points at the latest
+	// (or pinned) release of the matching products of each architecture
+	// and variant, and is shifted to the new release once it appears.
+	Aliases map[string]AliasConfig `yaml:"aliases,omitempty"`
+
+	// Streams contains per-stream settings, where the map key represents
+	// the stream name.
+	Streams map[string]StreamConfig `yaml:"streams,omitempty"`
+
+	// Views contains filtered views of the product catalogs served by the
+	// serve command on separate listeners or virtual hosts.
+	Views []ViewConfig `yaml:"views,omitempty"`
+
+	// Entries contains index entries whose product catalogs are composed
+	// of the products of one or more streams. Streams included in any
+	// entry are not published as separate index entries, while the other
+	// streams are published as usual.
+	Entries []EntryConfig `yaml:"entries,omitempty"`
+
+	// Access contains network access policies of the serve command.
+	Access AccessConfig `yaml:"access,omitempty"`
+
+	// Notifications contains the notifiers that receive a summary of each
+	// build that fails, or in which some product versions or delta files
+	// fail.
+	Notifications NotificationsConfig `yaml:"notifications,omitempty"`
+
+	// SmokeTest enables the smoke test of new product versions before
+	// they are added to the product catalog.
+	SmokeTest *SmokeTestConfig `yaml:"smoke_test,omitempty"`
+}
+
+// Instance types launched by the smoke test.
+const (
+	// InstanceTypeContainer launches the container from the squashfs item.
+	InstanceTypeContainer = "container"
+
+	// InstanceTypeVM launches the virtual machine from the disk-kvm.img
+	// item.
+	InstanceTypeVM = "virtual-machine"
+)
+
+// DefaultSmokeTestTimeout is the default maximum time to launch and test a
+// single instance.
+const DefaultSmokeTestTimeout = 10 * time.Minute
+
+// SmokeTestConfig contains settings of the smoke test, which launches each new
+// product version in the local LXD and runs the command within it. Versions
+// that fail the test are not added to the product catalog.
+type SmokeTestConfig struct {
+	// Client is the path of the LXD client. Defaults to "lxc".
+	Client string `yaml:"client,omitempty"`
+
+	// InstanceTypes contains the types of instances that are launched
+	// (container or virtual-machine). Defaults to both. Types for which
+	// the version has no root filesystem item are skipped.
+	InstanceTypes []string `yaml:"instance_types,omitempty"`
+
+	// Command that is run within the instance (for example, "cloud-init
+	// status --wait") and must exit with zero.
+	Command []string `yaml:"command"`
+
+	// Timeout is the maximum time to launch and test a single instance.
+	// Defaults to 10 minutes.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+
+	// Products contains the product ID patterns of the tested products.
+	// Patterns use the syntax of path.Match. If empty, all products are
+	// tested.
+	Products []string `yaml:"products,omitempty"`
+}
+
+// ClientOrDefault returns the path of the LXD client.
+func (s SmokeTestConfig) ClientOrDefault() string {
+	if s.Client == "" {
+		return "lxc"
+	}
+
+	return s.Client
+}
+
+// InstanceTypesOrDefault returns the types of the launched instances.
+func (s SmokeTestConfig) InstanceTypesOrDefault() []string {
+	if len(s.InstanceTypes) == 0 {
+		return []string{InstanceTypeContainer, InstanceTypeVM}
+	}
+
+	return s.InstanceTypes
+}
+
+// TimeoutOrDefault returns the maximum time to launch and test an instance.
+func (s SmokeTestConfig) TimeoutOrDefault() time.Duration {
+	if s.Timeout == 0 {
+		return DefaultSmokeTestTimeout
+	}
+
+	return s.Timeout
+}
+
+// Includes returns true if the product with the given ID is tested.
+func (s SmokeTestConfig) Includes(productID string) bool {
+	return matchProduct(s.Products, productID)
+}
+
+// Validate ensures the smoke test settings are valid.
+func (s SmokeTestConfig) Validate() error {
+	if len(s.Command) == 0 {
+		return fmt.Errorf("Command is required")
+	}
+
+	for _, instanceType := range s.InstanceTypes {
+		if !slices.Contains([]string{InstanceTypeContainer, InstanceTypeVM}, instanceType) {
+			return fmt.Errorf("Invalid instance type %q", instanceType)
+		}
+	}
+
+	if s.Timeout < 0 {
+		return fmt.Errorf("Timeout cannot be negative")
+	}
+
+	for _, pattern := range s.Products {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("Invalid product pattern %q: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// NotificationsConfig contains the notifiers of failed builds. Each notifier
+// that is set receives the summary.
+type NotificationsConfig struct {
+	// Slack posts the summary to the Slack incoming webhook.
+	Slack *SlackConfig `yaml:"slack,omitempty"`
+
+	// Matrix sends the summary to the Matrix room.
+	Matrix *MatrixConfig `yaml:"matrix,omitempty"`
+
+	// SMTP sends the summary by email.
+	SMTP *SMTPConfig `yaml:"smtp,omitempty"`
+}
+
+// SlackConfig contains settings of the Slack notifier.
+type SlackConfig struct {
+	// WebhookURL is the URL of the Slack incoming webhook.
+	WebhookURL string `yaml:"webhook_url"`
+}
+
+// MatrixConfig contains settings of the Matrix notifier.
+type MatrixConfig struct {
+	// Homeserver is the base URL of the Matrix homeserver (for example,
+	// "https://matrix.org").
+	Homeserver string `yaml:"homeserver"`
+
+	// RoomID is the ID of the room to which the summary is sent (for
+	// example, "!abc:matrix.org"). The user must be joined to the room.
+	RoomID string `yaml:"room_id"`
+
+	// AccessToken is the access token of the user sending the summary.
+	AccessToken string `yaml:"access_token"`
+}
+
+// SMTPConfig contains settings of the email notifier.
+type SMTPConfig struct {
+	// Address of the SMTP server in the host:port format. The connection
+	// is upgraded to TLS if the server supports STARTTLS.
+	Address string `yaml:"address"`
+
+	// Username and Password authenticate the sender. Authentication is
+	// skipped if the username is not set.
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+
+	// From is the sender address.
+	From string `yaml:"from"`
+
+	// To contains the recipient addresses.
+	To []string `yaml:"to"`
+}
+
+// Validate ensures the required settings of the configured notifiers are set.
+func (n NotificationsConfig) Validate() error {
+	if n.Slack != nil {
+		u, err := url.Parse(n.Slack.WebhookURL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("Slack: Invalid webhook URL %q", n.Slack.WebhookURL)
+		}
+	}
+
+	if n.Matrix != nil {
+		u, err := url.Parse(n.Matrix.Homeserver)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("Matrix: Invalid homeserver URL %q", n.Matrix.Homeserver)
+		}
+
+		if n.Matrix.RoomID == "" {
+			return fmt.Errorf("Matrix: Room ID is required")
+		}
+
+		if n.Matrix.AccessToken == "" {
+			return fmt.Errorf("Matrix: Access token is required")
+		}
+	}
+
+	if n.SMTP != nil {
+		_, _, err := net.SplitHostPort(n.SMTP.Address)
+		if err != nil {
+			return fmt.Errorf("SMTP: Invalid address %q", n.SMTP.Address)
+		}
+
+		if n.SMTP.From == "" {
+			return fmt.Errorf("SMTP: Sender address is required")
+		}
+
+		if len(n.SMTP.To) == 0 {
+			return fmt.Errorf("SMTP: At least one recipient is required")
+		}
+	}
+
+	return nil
+}
+
+// AccessConfig contains network access policies of the server.
+type AccessConfig struct {
+	// Downloads restricts the networks from which the simplestream content
+	// (index, product catalogs, and image files) can be accessed.
+	Downloads NetworkPolicy `yaml:"downloads,omitempty"`
+
+	// Admin restricts the networks from which the administrative routes
+	// (jobs API and metrics) can be accessed.
+	Admin NetworkPolicy `yaml:"admin,omitempty"`
+
+	// RateLimits contains per-network rate limits of client requests. The
+	// first limit whose networks contain the client's address applies, and
+	// requests over the limit are rejected with 429.
+	RateLimits []RateLimitConfig `yaml:"rate_limits,omitempty"`
+}
+
+// NetworkPolicy allows or denies access from the given networks. Networks are
+// given in CIDR notation (for example, "10.0.0.0/8") or as single addresses.
+// Denied networks take precedence over the allowed ones. If no network is
+// allowed, access is allowed from all networks that are not denied. Requests
+// from other networks are rejected with 403.
+type NetworkPolicy struct {
+	Allow []string `yaml:"allow,omitempty"`
+	Deny  []string `yaml:"deny,omitempty"`
+}
+
+// Parse returns the allowed and denied networks.
+func (p NetworkPolicy) Parse() (allow []netip.Prefix, deny []netip.Prefix, err error) {
+	allow, err = ParseNetworks(p.Allow)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	deny, err = ParseNetworks(p.Deny)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return allow, deny, nil
+}
+
+// RateLimitConfig limits the rate of requests of each client from the given
+// networks.
+type RateLimitConfig struct {
+	// Networks to which the limit applies, given in the same format as in
+	// the network policy.
+	Networks []string `yaml:"networks"`
+
+	// Rate is the number of requests per second allowed for each client.
+	Rate float64 `yaml:"rate"`
+
+	// Burst is the number of requests a client can make at once. Defaults
+	// to the rate rounded up.
+	Burst int `yaml:"burst,omitempty"`
+}
+
+// BurstOrDefault returns the burst of the rate limit, or the rate rounded up
+// if the burst is not set.
+func (r RateLimitConfig) BurstOrDefault() int {
+	if r.Burst > 0 {
+		return r.Burst
+	}
+
+	return max(int(math.Ceil(r.Rate)), 1)
+}
+
+// ParseNetworks parses the networks given in CIDR notation or as single
+// addresses.
+func ParseNetworks(networks []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(networks))
+
+	for _, network := range networks {
+		if !strings.Contains(network, "/") {
+			addr, err := netip.ParseAddr(network)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid network %q", network)
+			}
+
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid network %q", network)
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// EntryConfig contains settings of an index entry whose product catalog is
+// composed of the (optionally filtered) products of the given streams.
+type EntryConfig struct {
+	// Name of the entry, which is also the name of its product catalog
+	// file. Names must be unique and must differ from the stream names.
+	Name string `yaml:"name"`
+
+	// ContentID is the content ID of the product catalog. Defaults to the
+	// entry name.
+	ContentID string `yaml:"content_id,omitempty"`
+
+	// DataType is the data type of the product catalog. Defaults to
+	// "image-downloads".
+	DataType string `yaml:"datatype,omitempty"`
+
+	// Streams whose products are included in the entry.
+	Streams []string `yaml:"streams"`
+
+	// Products contains the product ID patterns (for example, "ubuntu:*")
+	// of the included products. Patterns use the syntax of path.Match. If
+	// empty, all products of the streams are included.
+	Products []string `yaml:"products,omitempty"`
+}
+
+// Includes returns true if the product with the given ID is included in the
+// entry.
+func (e EntryConfig) Includes(productID string) bool {
+	return matchProduct(e.Products, productID)
+}
+
+// matchProduct returns true if the product ID matches any of the patterns, or
+// if there are no patterns.
+func matchProduct(patterns []string, productID string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		match, _ := path.Match(pattern, productID)
+		if match {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CatalogContentID returns the content ID of the product catalog of the entry.
+func (e EntryConfig) CatalogContentID() string {
+	if e.ContentID == "" {
+		return e.Name
+	}
+
+	return e.ContentID
+}
+
+// CatalogDataType returns the data type of the product catalog of the entry.
+func (e EntryConfig) CatalogDataType() string {
+	if e.DataType == "" {
+		return stream.DataTypeImageDownloads
+	}
+
+	return e.DataType
+}
+
+// AliasConfig contains the selector of the products a custom alias points at.
+type AliasConfig struct {
+	// Products contains the product ID patterns (for example, "ubuntu:*")
+	// of the candidate products. Patterns use the syntax of path.Match.
+	Products []string `yaml:"products"`
+
+	// SupportLevel limits the candidates to the products whose release has
+	// the given support level (for example, "lts").
+	SupportLevel string `yaml:"support_level,omitempty"`
+
+	// Release pins the alias to the release with the given name. Defaults
+	// to "latest", which points the alias at the latest release that has
+	// not reached its end of life. Releases are ordered by their end-of-life
+	// dates, and the releases without one by their names.
+	Release string `yaml:"release,omitempty"`
+}
+
+// ViewConfig contains settings of a view that exposes only the products of
+// the given architectures (for example, an arm64-only endpoint for an edge
+// mirror). The index and product catalogs of the default stream version are
+// filtered in memory, while files of other products, as well as signed and
+// compressed catalogs, are not served by the view.
+type ViewConfig struct {
+	// Name of the view. Names must be unique across views.
+	Name string `yaml:"name"`
+
+	// Listen is the address of the separate listener serving the view.
+	Listen string `yaml:"listen,omitempty"`
+
+	// Hosts are virtual hosts whose requests to the main listener are
+	// served by the view.
+	Hosts []string `yaml:"hosts,omitempty"`
+
+	// Architectures of the products included in the view.
+	Architectures []string `yaml:"architectures"`
+}
+
+// StreamConfig contains settings of a single stream.
+type StreamConfig struct {
+	// Policy applied to all products within the stream.
+	Policy `yaml:",inline"`
+
+	// Products contains per-product policies, where the map key is the
+	// product ID pattern (for example, "ubuntu:*:amd64:*"). Patterns use
+	// the syntax of path.Match. If multiple patterns match the product,
+	// they are applied in the lexical order, followed by the exact match.
+	Products map[string]Policy `yaml:"products,omitempty"`
+
+	// AliasPrecedence is the ordered list of product ID patterns used to
+	// resolve aliases generated by multiple products of the same
+	// architecture. The alias is retained by the product matching the
+	// earliest pattern and removed from the others. Patterns use the
+	// syntax of path.Match.
+	AliasPrecedence []string `yaml:"alias_precedence,omitempty"`
+
+	// ContentID is the content ID of the product catalog. Defaults to the
+	// stream name. Content IDs must be unique across streams.
+	ContentID string `yaml:"content_id,omitempty"`
+
+	// DataType is the data type of the product catalog, which is also
+	// referenced by the index entry. Defaults to "image-downloads".
+	DataType string `yaml:"datatype,omitempty"`
+}
+
+// Policy contains retention, delta, and pruning settings. Settings that are
+// not set are inherited from the parent policy.
+type Policy struct {
+	// RetainBuilds is the maximum number of product versions to retain.
+	RetainBuilds *int `yaml:"retain_builds,omitempty"`
+
+	// RetainDays is the maximum number of days to retain any product
+	// version. Zero means versions are retained regardless of their age.
+	RetainDays *int `yaml:"retain_days,omitempty"`
+
+	// KeepLastDaily, KeepLastWeekly, and KeepLastMonthly enable the
+	// grandfather-father-son retention, where the latest product version
+	// of each of the given number of most recent days, weeks, and months
+	// is retained in addition to the versions retained by RetainBuilds.
+	KeepLastDaily   *int `yaml:"keep_last_daily,omitempty"`
+	KeepLastWeekly  *int `yaml:"keep_last_weekly,omitempty"`
+	KeepLastMonthly *int `yaml:"keep_last_monthly,omitempty"`
+
+	// PruneDangling indicates whether product versions that are not
+	// referenced from the product catalog are removed, along with the
+	// orphaned files within the referenced versions. This setting
+	// applies only to the whole stream.
+	PruneDangling *bool `yaml:"prune_dangling,omitempty"`
+
+	// DanglingGrace is the minimum age of the unreferenced product versions
+	// before they are pruned (for example, "12h"). This setting applies
+	// only to the whole stream.
+	DanglingGrace *time.Duration `yaml:"dangling_grace,omitempty"`
+
+	// Deltas indicates whether delta files are generated.
+	Deltas *bool `yaml:"deltas,omitempty"`
+
+	// DeltaMinVersions is the minimum number of product versions that
+	// must be published before delta (VCDiff) files are generated for the
+	// product. Zsync control files do not depend on other versions, hence
+	// they are not affected by this threshold.
+	DeltaMinVersions *int `yaml:"delta_min_versions,omitempty"`
+
+	// DeltaMinSize is the minimum size (in bytes) of the item for which
+	// delta files are generated. Deltas of small items save little.
+	DeltaMinSize *int64 `yaml:"delta_min_size,omitempty"`
+
+	// Duplicates is the action applied to new product versions that
+	// contain the same items as an older version (keep, skip, alias, or
+	// link). Defaults to keep.
+	Duplicates *string `yaml:"duplicates,omitempty"`
+
+	// RetainItems is the maximum number of product versions in which the
+	// items of a certain type are retained, where the map key represents
+	// the item type (squashfs, root.tar.xz, disk-kvm.img, or disk1.img).
+	// Items of such type (and their delta files) are removed from older
+	// versions. Versions without any root filesystem item left are removed
+	// completely.
+	RetainItems map[string]int `yaml:"retain_items,omitempty"`
+
+	// RequiredItems contains the item types (squashfs, root.tar.xz,
+	// disk-kvm.img, or disk1.img) that each new product version must
+	// contain, in addition to the metadata. For example, the products
+	// matching "*:*:*:cloud" may require both squashfs and disk-kvm.img.
+	// Versions missing any of them are not added to the product catalog,
+	// and are recorded as failed. The list replaces the inherited one,
+	// where an empty list removes the requirement.
+	RequiredItems []string `yaml:"required_items,omitempty"`
+}
+
+// Merge returns the policy with the settings of the other policy applied on
+// top of it.
+func (p Policy) Merge(other Policy) Policy {
+	if other.RetainBuilds != nil {
+		p.RetainBuilds = other.RetainBuilds
+	}
+
+	if other.RetainDays != nil {
+		p.RetainDays = other.RetainDays
+	}
+
+	if other.KeepLastDaily != nil {
+		p.KeepLastDaily = other.KeepLastDaily
+	}
+
+	if other.KeepLastWeekly != nil {
+		p.KeepLastWeekly = other.KeepLastWeekly
+	}
+
+	if other.KeepLastMonthly != nil {
+		p.KeepLastMonthly = other.KeepLastMonthly
+	}
+
+	if other.PruneDangling != nil {
+		p.PruneDangling = other.PruneDangling
+	}
+
+	if other.DanglingGrace != nil {
+		p.DanglingGrace = other.DanglingGrace
+	}
+
+	if other.Deltas != nil {
+		p.Deltas = other.Deltas
+	}
+
+	if other.DeltaMinVersions != nil {
+		p.DeltaMinVersions = other.DeltaMinVersions
+	}
+
+	if other.DeltaMinSize != nil {
+		p.DeltaMinSize = other.DeltaMinSize
+	}
+
+	if other.Duplicates != nil {
+		p.Duplicates = other.Duplicates
+	}
+
+	if len(other.RetainItems) > 0 {
+		retainItems := make(map[string]int, len(p.RetainItems)+len(other.RetainItems))
+		maps.Copy(retainItems, p.RetainItems)
+		maps.Copy(retainItems, other.RetainItems)
+		p.RetainItems = retainItems
+	}
+
+	if other.RequiredItems != nil {
+		p.RequiredItems = other.RequiredItems
+	}
+
+	return p
+}
+
+// Validate ensures the policy settings are within the valid ranges.
+func (p Policy) Validate() error {
+	if p.RetainBuilds != nil && *p.RetainBuilds < 1 {
+		return fmt.Errorf("At least 1 product version build must be retained")
+	}
+
+	if p.RetainDays != nil && *p.RetainDays < 0 {
+		return fmt.Errorf("Number of days to retain product versions cannot be negative")
+	}
+
+	if p.KeepLastDaily != nil && *p.KeepLastDaily < 0 {
+		return fmt.Errorf("Number of daily product versions to keep cannot be negative")
+	}
+
+	if p.KeepLastWeekly != nil && *p.KeepLastWeekly < 0 {
+		return fmt.Errorf("Number of weekly product versions to keep cannot be negative")
+	}
+
+	if p.KeepLastMonthly != nil && *p.KeepLastMonthly < 0 {
+		return fmt.Errorf("Number of monthly product versions to keep cannot be negative")
+	}
+
+	if p.DanglingGrace != nil && *p.DanglingGrace < 0 {
+		return fmt.Errorf("Dangling grace period cannot be negative")
+	}
+
+	if p.DeltaMinVersions != nil && *p.DeltaMinVersions < 0 {
+		return fmt.Errorf("Minimum number of product versions for delta files cannot be negative")
+	}
+
+	if p.DeltaMinSize != nil && *p.DeltaMinSize < 0 {
+		return fmt.Errorf("Minimum item size for delta files cannot be negative")
+	}
+
+	if p.Duplicates != nil && !slices.Contains([]string{DuplicatesKeep, DuplicatesSkip, DuplicatesAlias, DuplicatesLink}, *p.Duplicates) {
+		return fmt.Errorf("Invalid duplicates action %q", *p.Duplicates)
+	}
+
+	for itemType, retain := range p.RetainItems {
+		if !slices.Contains([]string{stream.ItemTypeSquashfs, stream.ItemTypeRootTarXz, stream.ItemTypeDiskKVM, stream.ItemTypeDiskRaw}, itemType) {
+			return fmt.Errorf("Retention is not supported for item type %q", itemType)
+		}
+
+		if retain < 1 {
+			return fmt.Errorf("Items of type %q must be retained in at least 1 product version", itemType)
+		}
+	}
+
+	for _, itemType := range p.RequiredItems {
+		if !slices.Contains([]string{stream.ItemTypeSquashfs, stream.ItemTypeRootTarXz, stream.ItemTypeDiskKVM, stream.ItemTypeDiskRaw}, itemType) {
+			return fmt.Errorf("Item type %q cannot be required", itemType)
+		}
+	}
+
+	return nil
+}
+
+// DeltasEnabled returns true unless delta files are disabled by the policy.
+func (p Policy) DeltasEnabled() bool {
+	return p.Deltas == nil || *p.Deltas
+}
+
+// DeltasAllowed returns true if delta files are enabled by the policy and
+// may be generated for the item of the given size within the product with
+// the given number of versions.
+func (p Policy) DeltasAllowed(versions int, itemSize int64) bool {
+	if !p.DeltasEnabled() {
+		return false
+	}
+
+	if p.DeltaMinVersions != nil && versions < *p.DeltaMinVersions {
+		return false
+	}
+
+	if p.DeltaMinSize != nil && itemSize < *p.DeltaMinSize {
+		return false
+	}
+
+	return true
+}
+
+// ZsyncAllowed returns true if delta files are enabled by the policy and a
+// zsync control file may be generated for the item of the given size.
+func (p Policy) ZsyncAllowed(itemSize int64) bool {
+	if !p.DeltasEnabled() {
+		return false
+	}
+
+	return p.DeltaMinSize == nil || itemSize >= *p.DeltaMinSize
+}
+
+// DuplicatesAction returns the action applied to duplicate product versions.
+func (p Policy) DuplicatesAction() string {
+	if p.Duplicates == nil {
+		return DuplicatesKeep
+	}
+
+	return *p.Duplicates
+}
+
+// ContentID returns the content ID of the product catalog of the given stream.
+func (c Config) ContentID(streamName string) string {
+	contentID := c.Streams[streamName].ContentID
+	if contentID == "" {
+		return streamName
+	}
+
+	return contentID
+}
+
+// DataType returns the data type of the product catalog of the given stream.
+func (c Config) DataType(streamName string) string {
+	dataType := c.Streams[streamName].DataType
+	if dataType == "" {
+		return stream.DataTypeImageDownloads
+	}
+
+	return dataType
+}
+
+// CustomAliases returns the custom aliases sorted by their names.
+func (c Config) CustomAliases() []stream.CustomAlias {
+	names := shared.MapKeys(c.Aliases)
+	slices.Sort(names)
+
+	aliases := make([]stream.CustomAlias, 0, len(names))
+	for _, name := range names {
+		alias := c.Aliases[name]
+
+		aliases = append(aliases, stream.CustomAlias{
+			Name:         name,
+			Products:     alias.Products,
+			SupportLevel: alias.SupportLevel,
+			Release:      alias.Release,
+		})
+	}
+
+	return aliases
+}
+
+// Policy returns the effective policy for the product with the given ID
+// within the given stream. The base policy (typically populated from the
+// command line flags) is overridden by the stream policy, which is further
+// overridden by the matching product policies. If productID is empty, only
+// the stream policy is applied.
+func (c Config) Policy(streamName string, productID string, base Policy) Policy {
+	stream, ok := c.Streams[streamName]
+	if !ok {
+		return base
+	}
+
+	policy := base.Merge(stream.Policy)
+
+	if productID == "" {
+		return policy
+	}
+
+	patterns := make([]string, 0, len(stream.Products))
+	for pattern := range stream.Products {
+		if pattern == productID {
+			continue
+		}
+
+		match, _ := path.Match(pattern, productID)
+		if match {
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	slices.Sort(patterns)
+
+	for _, pattern := range patterns {
+		policy = policy.Merge(stream.Products[pattern])
+	}
+
+	exact, ok := stream.Products[productID]
+	if ok {
+		policy = policy.Merge(exact)
+	}
+
+	return policy
+}
+
+// Validate ensures all policies within the configuration are valid.
+func (c Config) Validate() error {
+	contentIDs := make(map[string]string, len(c.Streams))
+
+	streamNames := shared.MapKeys(c.Streams)
+	slices.Sort(streamNames)
+
+	for _, streamName := range streamNames {
+		contentID := c.ContentID(streamName)
+
+		other, ok := contentIDs[contentID]
+		if ok {
+			return fmt.Errorf("Streams %q and %q have the same content ID %q", other, streamName, contentID)
+		}
+
+		contentIDs[contentID] = streamName
+	}
+
+	entryNames := make(map[string]bool, len(c.Entries))
+
+	for _, entry := range c.Entries {
+		if entry.Name == "" || strings.ContainsAny(entry.Name, "/\\") || strings.HasPrefix(entry.Name, ".") {
+			return fmt.Errorf("Invalid entry name %q", entry.Name)
+		}
+
+		if entryNames[entry.Name] {
+			return fmt.Errorf("Entry %q is defined more than once", entry.Name)
+		}
+
+		entryNames[entry.Name] = true
+
+		_, ok := c.Streams[entry.Name]
+		if ok {
+			return fmt.Errorf("Entry %q has the same name as a stream", entry.Name)
+		}
+
+		other, ok := contentIDs[entry.CatalogContentID()]
+		if ok {
+			return fmt.Errorf("Entry %q and stream or entry %q have the same content ID %q", entry.Name, other, entry.CatalogContentID())
+		}
+
+		contentIDs[entry.CatalogContentID()] = entry.Name
+
+		if len(entry.Streams) == 0 {
+			return fmt.Errorf("Entry %q: At least one stream is required", entry.Name)
+		}
+
+		for _, pattern := range entry.Products {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return fmt.Errorf("Entry %q: Invalid product pattern %q: %w", entry.Name, pattern, err)
+			}
+		}
+	}
+
+	for streamName, stream := range c.Streams {
+		err := stream.Policy.Validate()
+		if err != nil {
+			return fmt.Errorf("Stream %q: %w", streamName, err)
+		}
+
+		for pattern, policy := range stream.Products {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return fmt.Errorf("Stream %q: Invalid product pattern %q: %w", streamName, pattern, err)
+			}
+
+			err = policy.Validate()
+			if err != nil {
+				return fmt.Errorf("Stream %q: Product %q: %w", streamName, pattern, err)
+			}
+		}
+
+		for _, pattern := range stream.AliasPrecedence {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return fmt.Errorf("Stream %q: Invalid alias precedence pattern %q: %w", streamName, pattern, err)
+			}
+		}
+	}
+
+	for name, alias := range c.Aliases {
+		// Aliases are published as a comma delimited list.
+		if name == "" || strings.ContainsAny(name, ", \t") {
+			return fmt.Errorf("Invalid alias name %q", name)
+		}
+
+		if len(alias.Products) == 0 {
+			return fmt.Errorf("Alias %q: At least one product pattern is required", name)
+		}
+
+		for _, pattern := range alias.Products {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return fmt.Errorf("Alias %q: Invalid product pattern %q: %w", name, pattern, err)
+			}
+		}
+	}
+
+	viewNames := make(map[string]bool, len(c.Views))
+
+	for _, view := range c.Views {
+		if view.Name == "" {
+			return fmt.Errorf("View name cannot be empty")
+		}
+
+		if viewNames[view.Name] {
+			return fmt.Errorf("View %q is defined more than once", view.Name)
+		}
+
+		viewNames[view.Name] = true
+
+		if len(view.Architectures) == 0 {
+			return fmt.Errorf("View %q: At least one architecture is required", view.Name)
+		}
+
+		if view.Listen == "" && len(view.Hosts) == 0 {
+			return fmt.Errorf("View %q: Either listen address or hosts must be set", view.Name)
+		}
+	}
+
+	_, _, err := c.Access.Downloads.Parse()
+	if err != nil {
+		return fmt.Errorf("Downloads access: %w", err)
+	}
+
+	_, _, err = c.Access.Admin.Parse()
+	if err != nil {
+		return fmt.Errorf("Admin access: %w", err)
+	}
+
+	for i, limit := range c.Access.RateLimits {
+		if len(limit.Networks) == 0 {
+			return fmt.Errorf("Rate limit %d: At least one network is required", i)
+		}
+
+		_, err := ParseNetworks(limit.Networks)
+		if err != nil {
+			return fmt.Errorf("Rate limit %d: %w", i, err)
+		}
+
+		if limit.Rate <= 0 {
+			return fmt.Errorf("Rate limit %d: Rate must be greater than zero", i)
+		}
+
+		if limit.Burst < 0 {
+			return fmt.Errorf("Rate limit %d: Burst cannot be negative", i)
+		}
+	}
+
+	err = c.Notifications.Validate()
+	if err != nil {
+		return fmt.Errorf("Notifications: %w", err)
+	}
+
+	if c.SmokeTest != nil {
+		err := c.SmokeTest.Validate()
+		if err != nil {
+			return fmt.Errorf("Smoke test: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Load reads the configuration file from the given root directory. If the file
+// does not exist, an empty configuration is returned.
+func Load(rootDir string) (*Config, error) {
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := b.Open(FileName)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return &Config{}, nil
+		}
+
+		return nil, err
+	}
+
+	defer file.Close()
+
+	config := &Config{}
+
+	err = yaml.NewDecoder(file).Decode(config)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read config file %q: %w", FileName, err)
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config file %q: %w", FileName, err)
+	}
+
+	return config, nil
+}
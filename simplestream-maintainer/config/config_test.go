@@ -0,0 +1,700 @@
+package config_test
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/config"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+func TestLoad(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Name    string
+		Content string
+		WantErr bool
+	}{
+		{
+			Name: "Missing config file",
+		},
+		{
+			Name: "Valid policies",
+			Content: `
+streams:
+  images:
+    retain_builds: 3
+    retain_items:
+      squashfs: 2
+    products:
+      "ubuntu:*:*:*":
+        retain_days: 30
+      "*:*:*:cloud":
+        required_items: [squashfs, disk-kvm.img]
+`,
+		},
+		{
+			Name: "Invalid stream retention",
+			Content: `
+streams:
+  images:
+    retain_builds: 0
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Invalid item type retention",
+			Content: `
+streams:
+  images:
+    retain_items:
+      squashfs: 0
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Unsupported item type retention",
+			Content: `
+streams:
+  images:
+    retain_items:
+      lxd.tar.xz: 1
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Unsupported required item type",
+			Content: `
+streams:
+  images:
+    required_items: [lxd.tar.xz]
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Invalid product pattern",
+			Content: `
+streams:
+  images:
+    products:
+      "ubuntu:[":
+        retain_builds: 1
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Valid duplicates action",
+			Content: `
+streams:
+  images:
+    duplicates: skip
+    products:
+      "ubuntu:*:*:*":
+        duplicates: link
+`,
+		},
+		{
+			Name: "Invalid duplicates action",
+			Content: `
+streams:
+  images:
+    duplicates: merge
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Valid dangling grace period",
+			Content: `
+streams:
+  images:
+    prune_dangling: true
+    dangling_grace: 36h
+`,
+		},
+		{
+			Name: "Invalid dangling grace period",
+			Content: `
+streams:
+  images:
+    dangling_grace: -1h
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Valid delta thresholds",
+			Content: `
+streams:
+  images:
+    delta_min_versions: 3
+    products:
+      "ubuntu:*:*:*":
+        delta_min_size: 1048576
+`,
+		},
+		{
+			Name: "Invalid delta minimum versions",
+			Content: `
+streams:
+  images:
+    delta_min_versions: -1
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Valid content ID and data type",
+			Content: `
+streams:
+  images:
+    content_id: org.example:images
+  images-minimal:
+    content_id: org.example:images-minimal
+    datatype: image-ids
+`,
+		},
+		{
+			Name: "Colliding content IDs",
+			Content: `
+streams:
+  images:
+    content_id: images-minimal
+  images-minimal: {}
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Valid GFS retention",
+			Content: `
+streams:
+  images:
+    keep_last_daily: 7
+    keep_last_weekly: 4
+    products:
+      "ubuntu:*:*:*":
+        keep_last_monthly: 6
+`,
+		},
+		{
+			Name: "Invalid GFS retention",
+			Content: `
+streams:
+  images:
+    keep_last_weekly: -1
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Valid alias precedence",
+			Content: `
+streams:
+  images:
+    alias_precedence:
+      - "*:*:*:default"
+      - "ubuntu:*:*:cloud"
+`,
+		},
+		{
+			Name: "Invalid alias precedence pattern",
+			Content: `
+streams:
+  images:
+    alias_precedence:
+      - "ubuntu:["
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Valid custom aliases",
+			Content: `
+aliases:
+  ubuntu/lts:
+    products: ["ubuntu:*"]
+    support_level: lts
+  debian/stable:
+    products: ["debian:*"]
+    release: bookworm
+`,
+		},
+		{
+			Name: "Invalid custom alias name",
+			Content: `
+aliases:
+  "ubuntu/lts,ubuntu/latest":
+    products: ["ubuntu:*"]
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Custom alias without products",
+			Content: `
+aliases:
+  ubuntu/lts:
+    support_level: lts
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Invalid custom alias product pattern",
+			Content: `
+aliases:
+  ubuntu/lts:
+    products: ["ubuntu:["]
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Valid views",
+			Content: `
+views:
+  - name: edge
+    listen: ":8081"
+    architectures: [arm64]
+  - name: x86
+    hosts: [x86.example.com]
+    architectures: [amd64, i386]
+`,
+		},
+		{
+			Name: "View without architectures",
+			Content: `
+views:
+  - name: edge
+    listen: ":8081"
+`,
+			WantErr: true,
+		},
+		{
+			Name: "View without listen address and hosts",
+			Content: `
+views:
+  - name: edge
+    architectures: [arm64]
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Valid entries",
+			Content: `
+entries:
+  - name: ubuntu
+    content_id: org.example:ubuntu
+    streams: [images, images-daily]
+    products: ["ubuntu:*"]
+  - name: others
+    streams: [images]
+`,
+		},
+		{
+			Name: "Entry without streams",
+			Content: `
+entries:
+  - name: ubuntu
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Entry with invalid name",
+			Content: `
+entries:
+  - name: ../ubuntu
+    streams: [images]
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Duplicate entry",
+			Content: `
+entries:
+  - name: ubuntu
+    streams: [images]
+  - name: ubuntu
+    streams: [images-daily]
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Entry with the same content ID as a stream",
+			Content: `
+streams:
+  images:
+    retain_builds: 3
+entries:
+  - name: ubuntu
+    content_id: images
+    streams: [images]
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Entry with invalid product pattern",
+			Content: `
+entries:
+  - name: ubuntu
+    streams: [images]
+    products: ["ubuntu:["]
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Duplicate view",
+			Content: `
+views:
+  - name: edge
+    listen: ":8081"
+    architectures: [arm64]
+  - name: edge
+    hosts: [edge.example.com]
+    architectures: [arm64]
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Valid access",
+			Content: `
+access:
+  downloads:
+    allow: [10.0.0.0/8, "fd00::/8"]
+    deny: [10.0.5.0/24]
+  admin:
+    allow: [192.168.1.10]
+  rate_limits:
+    - networks: [0.0.0.0/0, "::/0"]
+      rate: 10
+      burst: 20
+`,
+		},
+		{
+			Name: "Invalid allowed network",
+			Content: `
+access:
+  downloads:
+    allow: [10.0.0.0/33]
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Invalid denied network",
+			Content: `
+access:
+  admin:
+    deny: [campus]
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Rate limit without networks",
+			Content: `
+access:
+  rate_limits:
+    - rate: 10
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Rate limit without rate",
+			Content: `
+access:
+  rate_limits:
+    - networks: [10.0.0.0/8]
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Valid notifications",
+			Content: `
+notifications:
+  slack:
+    webhook_url: https://hooks.slack.com/services/T0/B0/X
+  matrix:
+    homeserver: https://matrix.example.com
+    room_id: "!builds:example.com"
+    access_token: secret
+  smtp:
+    address: mail.example.com:587
+    username: builds
+    password: secret
+    from: builds@example.com
+    to: [ops@example.com]
+`,
+		},
+		{
+			Name: "Invalid Slack webhook URL",
+			Content: `
+notifications:
+  slack:
+    webhook_url: hooks
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Matrix without access token",
+			Content: `
+notifications:
+  matrix:
+    homeserver: https://matrix.example.com
+    room_id: "!builds:example.com"
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Valid smoke test",
+			Content: `
+smoke_test:
+  client: /snap/bin/lxc
+  instance_types: [container]
+  command: [cloud-init, status, --wait]
+  timeout: 5m
+  products: ["ubuntu:*"]
+`,
+		},
+		{
+			Name: "Smoke test without command",
+			Content: `
+smoke_test:
+  instance_types: [container]
+`,
+			WantErr: true,
+		},
+		{
+			Name: "Invalid smoke test instance type",
+			Content: `
+smoke_test:
+  instance_types: [vm]
+  command: ["true"]
+`,
+			WantErr: true,
+		},
+		{
+			Name: "SMTP without recipients",
+			Content: `
+notifications:
+  smtp:
+    address: mail.example.com:25
+    from: builds@example.com
+`,
+			WantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			rootDir := t.TempDir()
+
+			if test.Content != "" {
+				err := os.WriteFile(filepath.Join(rootDir, config.FileName), []byte(test.Content), 0644)
+				require.NoError(t, err)
+			}
+
+			conf, err := config.Load(rootDir)
+			if test.WantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.NotNil(t, conf)
+			}
+		})
+	}
+}
+
+func TestLoadDanglingGrace(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(rootDir, config.FileName), []byte("streams:\n  images:\n    dangling_grace: 36h\n"), 0644)
+	require.NoError(t, err)
+
+	conf, err := config.Load(rootDir)
+	require.NoError(t, err)
+
+	grace := 6 * time.Hour
+	policy := conf.Policy("images", "", config.Policy{DanglingGrace: &grace})
+	require.Equal(t, 36*time.Hour, *policy.DanglingGrace)
+}
+
+func TestConfigPolicy(t *testing.T) {
+	t.Parallel()
+
+	intPtr := func(v int) *int { return &v }
+	boolPtr := func(v bool) *bool { return &v }
+	strPtr := func(v string) *string { return &v }
+
+	conf := config.Config{
+		Streams: map[string]config.StreamConfig{
+			"images": {
+				Policy: config.Policy{
+					RetainBuilds: intPtr(3),
+					RetainItems:  map[string]int{"squashfs": 1, "disk-kvm.img": 2},
+					Duplicates:   strPtr(config.DuplicatesSkip),
+				},
+				Products: map[string]config.Policy{
+					"*:*:*:cloud":              {RequiredItems: []string{"squashfs", "disk-kvm.img"}},
+					"ubuntu:*:*:*":             {RetainBuilds: intPtr(5), Deltas: boolPtr(false), RetainItems: map[string]int{"disk-kvm.img": 4}},
+					"ubuntu:noble:*:*":         {RetainBuilds: intPtr(7)},
+					"ubuntu:noble:amd64:cloud": {RetainBuilds: intPtr(10), Duplicates: strPtr(config.DuplicatesLink), RequiredItems: []string{}},
+				},
+			},
+		},
+	}
+
+	base := config.Policy{RetainBuilds: intPtr(1), RetainDays: intPtr(2)}
+
+	tests := []struct {
+		Name          string
+		Stream        string
+		Product       string
+		RetainBuilds  int
+		RetainDays    int
+		Deltas        bool
+		Duplicates    string
+		RetainItems   map[string]int
+		RequiredItems []string
+	}{
+		{
+			Name:         "Unknown stream uses base policy",
+			Stream:       "other",
+			Product:      "ubuntu:noble:amd64:cloud",
+			RetainBuilds: 1,
+			RetainDays:   2,
+			Deltas:       true,
+			Duplicates:   config.DuplicatesKeep,
+		},
+		{
+			Name:         "Stream policy",
+			Stream:       "images",
+			Product:      "alpine:edge:amd64:default",
+			RetainBuilds: 3,
+			RetainDays:   2,
+			Deltas:       true,
+			Duplicates:   config.DuplicatesSkip,
+			RetainItems:  map[string]int{"squashfs": 1, "disk-kvm.img": 2},
+		},
+		{
+			Name:          "Product pattern policies",
+			Stream:        "images",
+			Product:       "ubuntu:noble:arm64:cloud",
+			RetainBuilds:  7,
+			RetainDays:    2,
+			Deltas:        false,
+			Duplicates:    config.DuplicatesSkip,
+			RetainItems:   map[string]int{"squashfs": 1, "disk-kvm.img": 4},
+			RequiredItems: []string{"squashfs", "disk-kvm.img"},
+		},
+		{
+			Name:          "Exact product policy",
+			Stream:        "images",
+			Product:       "ubuntu:noble:amd64:cloud",
+			RetainBuilds:  10,
+			RetainDays:    2,
+			Deltas:        false,
+			Duplicates:    config.DuplicatesLink,
+			RetainItems:   map[string]int{"squashfs": 1, "disk-kvm.img": 4},
+			RequiredItems: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			policy := conf.Policy(test.Stream, test.Product, base)
+			require.Equal(t, test.RetainBuilds, *policy.RetainBuilds)
+			require.Equal(t, test.RetainDays, *policy.RetainDays)
+			require.Equal(t, test.Deltas, policy.DeltasEnabled())
+			require.Equal(t, test.Duplicates, policy.DuplicatesAction())
+			require.Equal(t, test.RetainItems, policy.RetainItems)
+			require.Equal(t, test.RequiredItems, policy.RequiredItems)
+		})
+	}
+}
+
+func TestPolicyDeltasAllowed(t *testing.T) {
+	t.Parallel()
+
+	intPtr := func(v int) *int { return &v }
+	int64Ptr := func(v int64) *int64 { return &v }
+	boolPtr := func(v bool) *bool { return &v }
+
+	policy := config.Policy{}
+	require.True(t, policy.DeltasAllowed(2, 0))
+
+	policy = config.Policy{Deltas: boolPtr(false)}
+	require.False(t, policy.DeltasAllowed(10, 1<<30))
+
+	policy = config.Policy{DeltaMinVersions: intPtr(3), DeltaMinSize: int64Ptr(1024)}
+	require.False(t, policy.DeltasAllowed(2, 2048))
+	require.False(t, policy.DeltasAllowed(3, 1023))
+	require.True(t, policy.DeltasAllowed(3, 1024))
+}
+
+func TestPolicyZsyncAllowed(t *testing.T) {
+	t.Parallel()
+
+	intPtr := func(v int) *int { return &v }
+	int64Ptr := func(v int64) *int64 { return &v }
+	boolPtr := func(v bool) *bool { return &v }
+
+	policy := config.Policy{}
+	require.True(t, policy.ZsyncAllowed(0))
+
+	policy = config.Policy{Deltas: boolPtr(false)}
+	require.False(t, policy.ZsyncAllowed(1<<30))
+
+	// Minimum number of versions does not apply to zsync control files.
+	policy = config.Policy{DeltaMinVersions: intPtr(3), DeltaMinSize: int64Ptr(1024)}
+	require.False(t, policy.ZsyncAllowed(1023))
+	require.True(t, policy.ZsyncAllowed(1024))
+}
+
+func TestEntryConfig(t *testing.T) {
+	t.Parallel()
+
+	entry := config.EntryConfig{Name: "ubuntu", Streams: []string{"images"}}
+	require.True(t, entry.Includes("alpine:edge:amd64:default"))
+	require.Equal(t, "ubuntu", entry.CatalogContentID())
+	require.Equal(t, stream.DataTypeImageDownloads, entry.CatalogDataType())
+
+	entry.Products = []string{"ubuntu:*", "debian:bookworm:*"}
+	entry.ContentID = "org.example:ubuntu"
+	require.True(t, entry.Includes("ubuntu:noble:amd64:cloud"))
+	require.True(t, entry.Includes("debian:bookworm:arm64:default"))
+	require.False(t, entry.Includes("debian:trixie:arm64:default"))
+	require.Equal(t, "org.example:ubuntu", entry.CatalogContentID())
+}
+
+func TestConfigContentID(t *testing.T) {
+	t.Parallel()
+
+	conf := config.Config{
+		Streams: map[string]config.StreamConfig{
+			"images-minimal": {ContentID: "minimal", DataType: "image-ids"},
+		},
+	}
+
+	require.Equal(t, "images", conf.ContentID("images"))
+	require.Equal(t, stream.DataTypeImageDownloads, conf.DataType("images"))
+	require.Equal(t, "minimal", conf.ContentID("images-minimal"))
+	require.Equal(t, "image-ids", conf.DataType("images-minimal"))
+}
+
+func TestParseNetworks(t *testing.T) {
+	t.Parallel()
+
+	networks, err := config.ParseNetworks([]string{"10.1.2.3/8", "192.168.1.10", "fd00::1"})
+	require.NoError(t, err)
+	require.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.1.10/32"),
+		netip.MustParsePrefix("fd00::1/128"),
+	}, networks)
+
+	_, err = config.ParseNetworks([]string{"10.0.0.0/8", "invalid"})
+	require.Error(t, err)
+
+	require.Equal(t, 3, config.RateLimitConfig{Rate: 2.5}.BurstOrDefault())
+	require.Equal(t, 1, config.RateLimitConfig{Rate: 0.1}.BurstOrDefault())
+	require.Equal(t, 5, config.RateLimitConfig{Rate: 1, Burst: 5}.BurstOrDefault())
+}
@@ -0,0 +1,217 @@
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Decode applies the VCDIFF delta to the source and writes the resulting
+// target to the writer. Only deltas that use the default code table without
+// secondary compression are supported, which includes all deltas created by
+// the native encoder.
+func Decode(source io.ReaderAt, delta io.Reader, target io.Writer) error {
+	r := bufio.NewReader(delta)
+
+	magic := make([]byte, len(vcdiffMagic))
+
+	_, err := io.ReadFull(r, magic)
+	if err != nil || !bytes.Equal(magic, vcdiffMagic) {
+		return fmt.Errorf("Invalid VCDIFF header")
+	}
+
+	indicator, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("Invalid VCDIFF header: %w", err)
+	}
+
+	if indicator&(vcdDecompress|vcdCodeTable) != 0 {
+		return fmt.Errorf("Secondary compression and custom code tables are not supported")
+	}
+
+	if indicator&vcdAppHeader != 0 {
+		size, err := readVarint(r)
+		if err != nil {
+			return fmt.Errorf("Invalid VCDIFF header: %w", err)
+		}
+
+		_, err = r.Discard(int(size))
+		if err != nil {
+			return fmt.Errorf("Invalid VCDIFF header: %w", err)
+		}
+	}
+
+	for {
+		winIndicator, err := r.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return err
+		}
+
+		err = decodeWindow(r, winIndicator, source, target)
+		if err != nil {
+			return fmt.Errorf("Failed to decode VCDIFF window: %w", err)
+		}
+	}
+}
+
+// decodeWindow decodes a single VCDIFF window and writes the resulting
+// target window to the writer.
+func decodeWindow(r *bufio.Reader, winIndicator byte, source io.ReaderAt, target io.Writer) error {
+	if winIndicator&vcdTarget != 0 {
+		return fmt.Errorf("Target window segments are not supported")
+	}
+
+	var segLen, segPos uint64
+	var err error
+
+	if winIndicator&vcdSource != 0 {
+		segLen, err = readVarint(r)
+		if err != nil {
+			return err
+		}
+
+		segPos, err = readVarint(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Length of the delta encoding.
+	_, err = readVarint(r)
+	if err != nil {
+		return err
+	}
+
+	lengths := make([]uint64, 4)
+	for i := range lengths {
+		if i == 1 {
+			// Delta indicator.
+			deltaIndicator, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+
+			if deltaIndicator != 0 {
+				return fmt.Errorf("Secondary compression is not supported")
+			}
+		}
+
+		lengths[i], err = readVarint(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	targetLen, dataLen, instLen, addrLen := lengths[0], lengths[1], lengths[2], lengths[3]
+
+	// Skip the target window checksum.
+	if winIndicator&vcdAdler32 != 0 {
+		_, err = r.Discard(4)
+		if err != nil {
+			return err
+		}
+	}
+
+	sections := make([][]byte, 3)
+	for i, size := range []uint64{dataLen, instLen, addrLen} {
+		sections[i] = make([]byte, size)
+
+		_, err = io.ReadFull(r, sections[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	data := sections[0]
+	insts := bytes.NewReader(sections[1])
+	addrs := bytes.NewReader(sections[2])
+	out := make([]byte, 0, targetLen)
+	cache := addressCache{}
+
+	for insts.Len() > 0 {
+		index, err := insts.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		for _, inst := range codeTable[index] {
+			if inst.kind == instNoop {
+				continue
+			}
+
+			size := uint64(inst.size)
+			if size == 0 {
+				size, err = readVarint(insts)
+				if err != nil {
+					return err
+				}
+			}
+
+			if uint64(len(out))+size > targetLen {
+				return fmt.Errorf("Target window size exceeded")
+			}
+
+			switch inst.kind {
+			case instAdd:
+				if size > uint64(len(data)) {
+					return fmt.Errorf("Data section size exceeded")
+				}
+
+				out = append(out, data[:size]...)
+				data = data[size:]
+
+			case instRun:
+				if len(data) < 1 {
+					return fmt.Errorf("Data section size exceeded")
+				}
+
+				for i := uint64(0); i < size; i++ {
+					out = append(out, data[0])
+				}
+
+				data = data[1:]
+
+			case instCopy:
+				addr, err := cache.decode(segLen+uint64(len(out)), inst.mode, addrs)
+				if err != nil {
+					return err
+				}
+
+				// Copy the part of the region that is within the
+				// source segment.
+				if addr < segLen {
+					n := min(size, segLen-addr)
+					start := len(out)
+					out = out[:start+int(n)]
+
+					_, err := source.ReadAt(out[start:], int64(segPos+addr))
+					if err != nil {
+						return fmt.Errorf("Failed to read source: %w", err)
+					}
+
+					addr += n
+					size -= n
+				}
+
+				// Copy the remaining part from the target window byte
+				// by byte, as the regions may overlap.
+				for i := uint64(0); i < size; i++ {
+					out = append(out, out[addr-segLen+i])
+				}
+			}
+		}
+	}
+
+	if uint64(len(out)) != targetLen {
+		return fmt.Errorf("Target window size mismatch: expected %d, got %d", targetLen, len(out))
+	}
+
+	_, err = target.Write(out)
+	return err
+}
@@ -0,0 +1,190 @@
+package delta
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Supported delta backends.
+const (
+	// BackendNative is a pure Go VCDIFF encoder.
+	BackendNative = "native"
+
+	// BackendXDelta3 is an encoder that uses the external xdelta3 binary.
+	BackendXDelta3 = "xdelta3"
+)
+
+// DeltaEncoder creates delta (VCDIFF) files.
+type DeltaEncoder interface {
+	// Encode writes the delta that transforms the source file into the
+	// target file to the output file.
+	Encode(ctx context.Context, sourcePath string, targetPath string, outputPath string) error
+}
+
+// DeltaDecoder applies delta files.
+type DeltaDecoder interface {
+	// DecodeFile applies the delta file to the source file and writes the
+	// resulting target to the writer.
+	DecodeFile(ctx context.Context, sourcePath string, deltaPath string, w io.Writer) error
+}
+
+// ErrDeltaMismatch is returned when the delta does not reconstruct the target.
+var ErrDeltaMismatch = errors.New("Delta does not reconstruct the target")
+
+// DecoderFor returns the decoder that applies the deltas created by the given
+// encoder. Encoders that do not implement DeltaDecoder are expected to create
+// deltas that can be applied by the native decoder.
+func DecoderFor(encoder DeltaEncoder) DeltaDecoder {
+	decoder, ok := encoder.(DeltaDecoder)
+	if ok {
+		return decoder
+	}
+
+	return NativeEncoder{}
+}
+
+// Verify applies the delta file to the source file using the given decoder
+// and ensures the result matches the given SHA256 hash of the target. If not,
+// an error wrapping ErrDeltaMismatch is returned.
+func Verify(ctx context.Context, decoder DeltaDecoder, sourcePath string, deltaPath string, sha256sum string) error {
+	h := sha256.New()
+
+	err := decoder.DecodeFile(ctx, sourcePath, deltaPath, h)
+	if err != nil {
+		return fmt.Errorf("Failed to apply delta: %w", err)
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	if sum != sha256sum {
+		return fmt.Errorf("%w: Expected SHA256 %q, got %q", ErrDeltaMismatch, sha256sum, sum)
+	}
+
+	return nil
+}
+
+// NewEncoder returns the delta encoder for the given backend. If backend is
+// empty, the native encoder is returned. An error is returned if the backend
+// is not supported or cannot be used on this host.
+func NewEncoder(backend string) (DeltaEncoder, error) {
+	switch backend {
+	case "", BackendNative:
+		return NativeEncoder{}, nil
+
+	case BackendXDelta3:
+		_, err := exec.LookPath("xdelta3")
+		if err != nil {
+			return nil, fmt.Errorf("Delta backend %q is not available: %w", backend, err)
+		}
+
+		return XDelta3Encoder{}, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported delta backend %q. Valid backends are: [%s, %s]", backend, BackendNative, BackendXDelta3)
+}
+
+// Secondary compressors supported by xdelta3.
+var xdelta3SecondaryCompressors = []string{"none", "djw", "fgk", "lzma"}
+
+// XDelta3Encoder creates delta files using the external xdelta3 binary. The
+// zero value uses the maximum compression level and the xdelta3 defaults for
+// the other settings.
+type XDelta3Encoder struct {
+	// Level is the compression level in range [1, 9]. Zero defaults to 9.
+	Level int
+
+	// SourceWindow is the size (in bytes) of the source window, which is
+	// the part of the source file kept in memory to find matches in. For
+	// large files (for example, multi-GB qcow2 images), the default window
+	// (64 MiB) misses matches at larger distances, which results in larger
+	// deltas. Zero uses the xdelta3 default.
+	SourceWindow int64
+
+	// Secondary is the secondary compressor (none, djw, fgk, lzma). Empty
+	// uses the xdelta3 default.
+	Secondary string
+}
+
+// Validate ensures the encoder settings are valid.
+func (e XDelta3Encoder) Validate() error {
+	if e.Level < 0 || e.Level > 9 {
+		return fmt.Errorf("xdelta3 compression level must be within range [1, 9]")
+	}
+
+	if e.SourceWindow < 0 {
+		return fmt.Errorf("xdelta3 source window size cannot be negative")
+	}
+
+	if e.Secondary != "" && !slices.Contains(xdelta3SecondaryCompressors, e.Secondary) {
+		return fmt.Errorf("Unsupported xdelta3 secondary compressor %q. Valid compressors are: [%s]", e.Secondary, strings.Join(xdelta3SecondaryCompressors, ", "))
+	}
+
+	return nil
+}
+
+// args returns the xdelta3 arguments that encode the delta from the source file
+// to the target file.
+func (e XDelta3Encoder) args(sourcePath string, targetPath string, outputPath string) []string {
+	level := e.Level
+	if level == 0 {
+		level = 9
+	}
+
+	// -e compress
+	// -N compression level (0 no-compression -> 9 max-compression)
+	args := []string{"-e", fmt.Sprintf("-%d", level)}
+
+	// -B source window size
+	if e.SourceWindow > 0 {
+		args = append(args, "-B", strconv.FormatInt(e.SourceWindow, 10))
+	}
+
+	// -S secondary compressor
+	if e.Secondary != "" {
+		args = append(args, "-S", e.Secondary)
+	}
+
+	// -s source
+	return append(args, "-s", sourcePath, targetPath, outputPath)
+}
+
+// Encode writes the delta that transforms the source file into the target
+// file to the output file.
+func (e XDelta3Encoder) Encode(ctx context.Context, sourcePath string, targetPath string, outputPath string) error {
+	// The output is included in the error, rather than written to the
+	// standard streams, to keep the logs structured.
+	out, err := exec.CommandContext(ctx, "xdelta3", e.args(sourcePath, targetPath, outputPath)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to run xdelta3: %w (%s)", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// DecodeFile applies the delta file to the source file and writes the resulting
+// target to the writer.
+func (e XDelta3Encoder) DecodeFile(ctx context.Context, sourcePath string, deltaPath string, w io.Writer) error {
+	var stderr bytes.Buffer
+
+	// -d decompress
+	// -c write to standard output
+	// -s source
+	cmd := exec.CommandContext(ctx, "xdelta3", "-d", "-c", "-s", sourcePath, deltaPath)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Failed to run xdelta3: %w (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
@@ -0,0 +1,291 @@
+package delta_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/delta"
+)
+
+func TestNativeEncoder(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(1))
+
+	randomBytes := func(n int) []byte {
+		b := make([]byte, n)
+		_, _ = rnd.Read(b)
+		return b
+	}
+
+	concat := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	source := randomBytes(1 << 20)
+
+	tests := []struct {
+		Name   string
+		Source []byte
+		Target []byte
+	}{
+		{
+			Name:   "Empty source and target",
+			Source: []byte{},
+			Target: []byte{},
+		},
+		{
+			Name:   "Empty source",
+			Source: []byte{},
+			Target: randomBytes(1000),
+		},
+		{
+			Name:   "Empty target",
+			Source: source,
+			Target: []byte{},
+		},
+		{
+			Name:   "Identical files",
+			Source: source,
+			Target: source,
+		},
+		{
+			Name:   "Modified regions",
+			Source: source,
+			Target: concat(source[:1000], randomBytes(50), source[1050:500000], source[600000:], randomBytes(7)),
+		},
+		{
+			Name:   "Reordered regions",
+			Source: source,
+			Target: concat(source[700000:], source[:300000], source[300001:700000]),
+		},
+		{
+			Name:   "Runs of equal bytes",
+			Source: source,
+			Target: concat(bytes.Repeat([]byte{0}, 4096), source[:5000], bytes.Repeat([]byte{'a'}, 17), randomBytes(3)),
+		},
+		{
+			Name:   "Multiple windows",
+			Source: source,
+			Target: concat(bytes.Repeat(source, 9), randomBytes(100)),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			t.Parallel()
+
+			tmpDir := t.TempDir()
+			sourcePath := filepath.Join(tmpDir, "source")
+			targetPath := filepath.Join(tmpDir, "target")
+			outputPath := filepath.Join(tmpDir, "target.vcdiff")
+
+			require.NoError(t, os.WriteFile(sourcePath, test.Source, 0644))
+			require.NoError(t, os.WriteFile(targetPath, test.Target, 0644))
+
+			encoder, err := delta.NewEncoder(delta.BackendNative)
+			require.NoError(t, err)
+
+			err = encoder.Encode(context.Background(), sourcePath, targetPath, outputPath)
+			require.NoError(t, err)
+
+			vcdiff, err := os.ReadFile(outputPath)
+			require.NoError(t, err)
+
+			// Ensure the delta reconstructs the target.
+			result := &bytes.Buffer{}
+			err = delta.Decode(bytes.NewReader(test.Source), bytes.NewReader(vcdiff), result)
+			require.NoError(t, err)
+			require.Equal(t, string(test.Target), result.String())
+
+			// Ensure the delta of similar files is small.
+			if len(test.Source) > 0 && bytes.Equal(test.Source, test.Target) {
+				require.Less(t, len(vcdiff), 100)
+			}
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	t.Parallel()
+
+	source := []byte("0123456789abcdef")
+
+	// Hand-crafted delta that uses combined instructions and all address
+	// modes of the default code table.
+	vcdiff := []byte{
+		0xD6, 0xC3, 0xC4, 0x00, // Magic.
+		0x00,  // Header indicator.
+		0x01,  // Window indicator (VCD_SOURCE).
+		16, 0, // Source segment size and position.
+		21,                 // Length of the delta encoding.
+		27,                 // Target window length.
+		0x00,               // Delta indicator.
+		4,                  // Length of data section.
+		7,                  // Length of instructions section.
+		5,                  // Length of addresses section.
+		'X', 'Y', 'z', '!', // Data section.
+		166,  // ADD 2 + COPY 4 (self).
+		37,   // COPY 5 (here).
+		0, 3, // RUN 3.
+		68,                // COPY 4 (near 1).
+		116,               // COPY 4 (same 0).
+		247,               // COPY 4 (self) + ADD 1.
+		0, 18, 12, 16, 10, // Addresses section.
+	}
+
+	result := &bytes.Buffer{}
+	err := delta.Decode(bytes.NewReader(source), bytes.NewReader(vcdiff), result)
+	require.NoError(t, err)
+	require.Equal(t, "XY012345678zzzXY01XY01abcd!", result.String())
+
+	// Ensure invalid header is rejected.
+	err = delta.Decode(bytes.NewReader(source), bytes.NewReader([]byte("invalid")), result)
+	require.Error(t, err)
+}
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+
+	tmpDir := t.TempDir()
+	sourcePath := filepath.Join(tmpDir, "source")
+	targetPath := filepath.Join(tmpDir, "target")
+	deltaPath := filepath.Join(tmpDir, "target.vcdiff")
+
+	target := []byte(strings.Repeat("target", 1000))
+
+	require.NoError(t, os.WriteFile(sourcePath, []byte(strings.Repeat("source", 1000)), 0644))
+	require.NoError(t, os.WriteFile(targetPath, target, 0644))
+
+	encoder := delta.NativeEncoder{}
+	require.NoError(t, encoder.Encode(context.Background(), sourcePath, targetPath, deltaPath))
+
+	sum := sha256.Sum256(target)
+	decoder := delta.DecoderFor(delta.WithPriority(encoder, delta.Priority{}))
+
+	err := delta.Verify(context.Background(), decoder, sourcePath, deltaPath, hex.EncodeToString(sum[:]))
+	require.NoError(t, err)
+
+	// Ensure the delta is rejected if it does not reconstruct the target.
+	err = delta.Verify(context.Background(), decoder, sourcePath, deltaPath, strings.Repeat("0", 64))
+	require.ErrorIs(t, err, delta.ErrDeltaMismatch)
+
+	// Ensure invalid delta is rejected.
+	err = delta.Verify(context.Background(), decoder, sourcePath, sourcePath, hex.EncodeToString(sum[:]))
+	require.Error(t, err)
+	require.NotErrorIs(t, err, delta.ErrDeltaMismatch)
+}
+
+func TestNewEncoder(t *testing.T) {
+	t.Parallel()
+
+	_, err := delta.NewEncoder("unknown")
+	require.Error(t, err)
+}
+
+func TestXDelta3Encoder(t *testing.T) {
+	// Fake xdelta3 binary records its arguments, which ensures the
+	// settings are passed to xdelta3 regardless of whether it is
+	// installed.
+	binDir := t.TempDir()
+	argsPath := filepath.Join(binDir, "args")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %q\n", argsPath)
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "xdelta3"), []byte(script), 0755))
+	t.Setenv("PATH", binDir)
+
+	tests := []struct {
+		Name     string
+		Encoder  delta.XDelta3Encoder
+		WantArgs string
+		WantErr  bool
+	}{
+		{
+			Name:     "Defaults",
+			WantArgs: "-e -9 -s source target output",
+		},
+		{
+			Name:     "Tuned",
+			Encoder:  delta.XDelta3Encoder{Level: 3, SourceWindow: 1 << 30, Secondary: "lzma"},
+			WantArgs: "-e -3 -B 1073741824 -S lzma -s source target output",
+		},
+		{
+			Name:    "Invalid level",
+			Encoder: delta.XDelta3Encoder{Level: 10},
+			WantErr: true,
+		},
+		{
+			Name:    "Invalid source window",
+			Encoder: delta.XDelta3Encoder{SourceWindow: -1},
+			WantErr: true,
+		},
+		{
+			Name:    "Invalid secondary compressor",
+			Encoder: delta.XDelta3Encoder{Secondary: "zstd"},
+			WantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			err := test.Encoder.Validate()
+			if test.WantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.NoError(t, test.Encoder.Encode(context.Background(), "source", "target", "output"))
+
+			args, err := os.ReadFile(argsPath)
+			require.NoError(t, err)
+			require.Equal(t, test.WantArgs, strings.TrimSpace(string(args)))
+		})
+	}
+}
+
+func BenchmarkNativeEncoder(b *testing.B) {
+	const size = 16 << 20
+
+	rnd := rand.New(rand.NewSource(1))
+
+	source := make([]byte, size)
+	_, _ = rnd.Read(source)
+
+	// Target shares most of the content with the source, similar to
+	// consecutive versions of an image.
+	target := bytes.Clone(source)
+	for i := 0; i < size; i += 1 << 20 {
+		_, _ = rnd.Read(target[i : i+4096])
+	}
+
+	tmpDir := b.TempDir()
+	sourcePath := filepath.Join(tmpDir, "source")
+	targetPath := filepath.Join(tmpDir, "target")
+	outputPath := filepath.Join(tmpDir, "target.vcdiff")
+
+	require.NoError(b, os.WriteFile(sourcePath, source, 0644))
+	require.NoError(b, os.WriteFile(targetPath, target, 0644))
+
+	encoder, err := delta.NewEncoder(delta.BackendNative)
+	require.NoError(b, err)
+
+	b.SetBytes(size)
+	b.ResetTimer()
+
+	for range b.N {
+		err := encoder.Encode(context.Background(), sourcePath, targetPath, outputPath)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,524 @@
+package delta
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"math/bits"
+	"os"
+)
+
+const (
+	// windowSize is the maximum size of the target window. It is kept well
+	// below the window size limits of the common VCDIFF decoders.
+	windowSize = 8 << 20
+
+	// minBlockSize is the minimum size of the source blocks that are
+	// indexed. It is also the minimum size of the matched region.
+	minBlockSize = 32
+
+	// maxIndexEntries limits the number of the source index entries, which
+	// bounds the memory used by the encoder for large source files.
+	maxIndexEntries = 1 << 22
+
+	// minRunSize is the minimum number of equal bytes encoded as a RUN
+	// instruction, instead of an ADD instruction.
+	minRunSize = 16
+
+	// sourceChunkSize is the size of the source chunk that is read at once
+	// when comparing the matched regions.
+	sourceChunkSize = 64 << 10
+
+	// hashBase is the base of the polynomial rolling hash.
+	hashBase = 257
+)
+
+// NativeEncoder creates VCDIFF (RFC 3284) delta files without relying on any
+// external binaries.
+//
+// Source file is indexed in fixed size blocks, and target file is scanned
+// using a rolling hash to find regions that can be copied from the source.
+// The remaining target data is added literally. The resulting delta does
+// not use secondary compression, therefore it may be larger than the one
+// created by xdelta3, but can be decoded by any VCDIFF decoder.
+type NativeEncoder struct{}
+
+// Encode writes the delta that transforms the source file into the target
+// file to the output file.
+func (e NativeEncoder) Encode(ctx context.Context, sourcePath string, targetPath string, outputPath string) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	defer source.Close()
+
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	target, err := os.Open(targetPath)
+	if err != nil {
+		return err
+	}
+
+	defer target.Close()
+
+	output, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+
+	defer output.Close()
+
+	w := bufio.NewWriter(output)
+
+	err = Encode(ctx, source, info.Size(), target, w)
+	if err != nil {
+		return err
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	return output.Close()
+}
+
+// DecodeFile applies the delta file to the source file and writes the resulting
+// target to the writer.
+func (e NativeEncoder) DecodeFile(ctx context.Context, sourcePath string, deltaPath string, w io.Writer) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+
+	defer source.Close()
+
+	deltaFile, err := os.Open(deltaPath)
+	if err != nil {
+		return err
+	}
+
+	defer deltaFile.Close()
+
+	return Decode(source, deltaFile, contextWriter{ctx: ctx, w: w})
+}
+
+// contextWriter stops writing once the context is cancelled.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+// Write implements io.Writer.
+func (w contextWriter) Write(p []byte) (int, error) {
+	err := w.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	return w.w.Write(p)
+}
+
+// Encode writes the VCDIFF delta that transforms the source of the given size
+// into the target to the writer.
+func Encode(ctx context.Context, source io.ReaderAt, sourceSize int64, target io.Reader, w io.Writer) error {
+	enc, err := newEncoder(source, sourceSize)
+	if err != nil {
+		return err
+	}
+
+	// Header without secondary compression and custom code table.
+	_, err = w.Write([]byte{vcdiffMagic[0], vcdiffMagic[1], vcdiffMagic[2], vcdiffMagic[3], 0})
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, windowSize)
+
+	for {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		n, err := io.ReadFull(target, buf)
+		if n > 0 {
+			werr := enc.encodeWindow(buf[:n], w)
+			if werr != nil {
+				return werr
+			}
+		}
+
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+
+			return err
+		}
+	}
+}
+
+// encoder holds the source index and the state of the source reader.
+type encoder struct {
+	source     io.ReaderAt
+	sourceSize int64
+
+	// Size of the indexed source blocks.
+	blockSize int
+
+	// Source index maps the block hash (masked) to the block offset
+	// increased by 1. Zero represents an empty entry. For each entry,
+	// the upper half of the block hash is stored as well, to avoid
+	// reading the source for the blocks that cannot match.
+	index  []int64
+	checks []uint32
+	mask   uint64
+
+	// hashPow is hashBase raised to the power of blockSize.
+	hashPow uint64
+
+	// Cached source chunk.
+	chunk    []byte
+	chunkOff int64
+}
+
+// newEncoder indexes the source and returns a new encoder.
+func newEncoder(source io.ReaderAt, sourceSize int64) (*encoder, error) {
+	blockSize := minBlockSize
+	for sourceSize/int64(blockSize) > maxIndexEntries {
+		blockSize *= 2
+	}
+
+	// Use power of 2 index size, that fits all source blocks.
+	entries := max(sourceSize/int64(blockSize), 1)
+	indexSize := uint64(1) << bits.Len64(uint64(entries))
+
+	e := &encoder{
+		source:     source,
+		sourceSize: sourceSize,
+		blockSize:  blockSize,
+		index:      make([]int64, indexSize),
+		checks:     make([]uint32, indexSize),
+		mask:       indexSize - 1,
+		hashPow:    1,
+		chunk:      make([]byte, 0, 2*sourceChunkSize),
+		chunkOff:   -1,
+	}
+
+	for i := 0; i < blockSize; i++ {
+		e.hashPow *= hashBase
+	}
+
+	// Index source blocks.
+	buf := make([]byte, blockSize*1024)
+	off := int64(0)
+
+	for off+int64(blockSize) <= sourceSize {
+		n, err := source.ReadAt(buf, off)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		n -= n % blockSize
+		if n == 0 {
+			break
+		}
+
+		for i := 0; i < n; i += blockSize {
+			h := hashBlock(buf[i : i+blockSize])
+			e.index[h&e.mask] = off + int64(i) + 1
+			e.checks[h&e.mask] = uint32(h >> 32)
+		}
+
+		off += int64(n)
+	}
+
+	return e, nil
+}
+
+// hashBlock returns the polynomial hash of the block.
+func hashBlock(block []byte) uint64 {
+	var h uint64
+	for _, b := range block {
+		h = h*hashBase + uint64(b)
+	}
+
+	return h
+}
+
+// readSource returns n bytes of the source starting at the given offset.
+// The returned slice may be shorter than n at the end of the source. The
+// source is read in aligned chunks, which are cached.
+func (e *encoder) readSource(off int64, n int) ([]byte, error) {
+	if e.chunkOff < 0 || off < e.chunkOff || off+int64(n) > e.chunkOff+int64(len(e.chunk)) {
+		e.chunkOff = off - off%sourceChunkSize
+		e.chunk = e.chunk[:cap(e.chunk)]
+
+		read, err := e.source.ReadAt(e.chunk, e.chunkOff)
+		if err != nil && !errors.Is(err, io.EOF) {
+			e.chunkOff = -1
+			return nil, err
+		}
+
+		e.chunk = e.chunk[:read]
+	}
+
+	start := int(off - e.chunkOff)
+	end := min(start+n, len(e.chunk))
+
+	if start > end {
+		return nil, nil
+	}
+
+	return e.chunk[start:end], nil
+}
+
+// window contains the sections of a single VCDIFF window.
+type window struct {
+	data  []byte
+	insts []byte
+	addrs []byte
+
+	// Source segment used by COPY instructions.
+	segStart int64
+	segEnd   int64
+
+	// Source offsets and sizes of COPY instructions. Their addresses
+	// are encoded once the source segment is known.
+	copies []copyInst
+}
+
+// copyInst is a COPY instruction from the source.
+type copyInst struct {
+	offset int64
+	size   int
+}
+
+// add appends ADD and RUN instructions for the given literal data.
+func (w *window) add(data []byte) {
+	start := 0
+
+	for i := 0; i < len(data); {
+		// Find the run of equal bytes.
+		j := i + 1
+		for j < len(data) && data[j] == data[i] {
+			j++
+		}
+
+		if j-i < minRunSize {
+			i = j
+			continue
+		}
+
+		w.addLiteral(data[start:i])
+		w.insts = append(w.insts, 0)
+		w.insts = appendVarint(w.insts, uint64(j-i))
+		w.data = append(w.data, data[i])
+
+		start = j
+		i = j
+	}
+
+	w.addLiteral(data[start:])
+}
+
+// addLiteral appends an ADD instruction for the given data.
+func (w *window) addLiteral(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	if len(data) <= 17 {
+		// ADD with size 1-17 (index 2-18).
+		w.insts = append(w.insts, byte(1+len(data)))
+	} else {
+		// ADD with size in the instruction stream (index 1).
+		w.insts = append(w.insts, 1)
+		w.insts = appendVarint(w.insts, uint64(len(data)))
+	}
+
+	w.data = append(w.data, data...)
+}
+
+// addCopy appends a COPY instruction from the source region.
+func (w *window) addCopy(offset int64, size int) {
+	if len(w.copies) == 0 {
+		w.segStart = offset
+		w.segEnd = offset + int64(size)
+	} else {
+		w.segStart = min(w.segStart, offset)
+		w.segEnd = max(w.segEnd, offset+int64(size))
+	}
+
+	w.copies = append(w.copies, copyInst{offset: offset, size: size})
+
+	// The COPY instruction is encoded in self mode (mode 0), where the
+	// address is encoded once the source segment is known.
+	if size >= 4 && size <= 18 {
+		// COPY with size 4-18 (index 20-34).
+		w.insts = append(w.insts, byte(16+size))
+	} else {
+		// COPY with size in the instruction stream (index 19).
+		w.insts = append(w.insts, 19)
+		w.insts = appendVarint(w.insts, uint64(size))
+	}
+}
+
+// encodeWindow finds source matches within the target window and writes
+// the encoded window.
+func (e *encoder) encodeWindow(target []byte, out io.Writer) error {
+	win := &window{}
+	bs := e.blockSize
+	addStart := 0
+	i := 0
+
+	var h uint64
+	if len(target) >= bs {
+		h = hashBlock(target[:bs])
+	}
+
+	for i+bs <= len(target) {
+		match, err := e.match(target, i, h)
+		if err != nil {
+			return err
+		}
+
+		if match >= 0 {
+			start := i
+			srcStart := match
+
+			// Extend the match backwards over the pending literal data.
+			for start > addStart && srcStart > 0 {
+				b, err := e.readSource(srcStart-1, 1)
+				if err != nil {
+					return err
+				}
+
+				if len(b) == 0 || b[0] != target[start-1] {
+					break
+				}
+
+				start--
+				srcStart--
+			}
+
+			// Extend the match forwards.
+			end := i + bs
+			srcEnd := match + int64(bs)
+
+			for end < len(target) && srcEnd < e.sourceSize {
+				b, err := e.readSource(srcEnd, min(sourceChunkSize, len(target)-end))
+				if err != nil {
+					return err
+				}
+
+				n := 0
+				for n < len(b) && b[n] == target[end+n] {
+					n++
+				}
+
+				end += n
+				srcEnd += int64(n)
+
+				if n < len(b) || len(b) == 0 {
+					break
+				}
+			}
+
+			win.add(target[addStart:start])
+			win.addCopy(srcStart, end-start)
+
+			addStart = end
+			i = end
+
+			if i+bs <= len(target) {
+				h = hashBlock(target[i : i+bs])
+			}
+
+			continue
+		}
+
+		// Roll the hash by one byte.
+		if i+bs < len(target) {
+			h = h*hashBase - uint64(target[i])*e.hashPow + uint64(target[i+bs])
+		}
+
+		i++
+	}
+
+	win.add(target[addStart:])
+
+	return e.writeWindow(win, len(target), out)
+}
+
+// match returns the source offset of the block that matches the target
+// block at the given position, or -1 if there is no such block.
+func (e *encoder) match(target []byte, pos int, h uint64) (int64, error) {
+	entry := e.index[h&e.mask]
+	if entry == 0 || e.checks[h&e.mask] != uint32(h>>32) {
+		return -1, nil
+	}
+
+	offset := entry - 1
+
+	block, err := e.readSource(offset, e.blockSize)
+	if err != nil {
+		return -1, err
+	}
+
+	if len(block) != e.blockSize {
+		return -1, nil
+	}
+
+	for i, b := range block {
+		if target[pos+i] != b {
+			return -1, nil
+		}
+	}
+
+	return offset, nil
+}
+
+// writeWindow writes the encoded window.
+func (e *encoder) writeWindow(win *window, targetLen int, out io.Writer) error {
+	// Encode COPY addresses relative to the source segment.
+	for _, c := range win.copies {
+		win.addrs = appendVarint(win.addrs, uint64(c.offset-win.segStart))
+	}
+
+	// Delta encoding.
+	var enc []byte
+	enc = appendVarint(enc, uint64(targetLen))
+	enc = append(enc, 0) // Delta indicator (no secondary compression).
+	enc = appendVarint(enc, uint64(len(win.data)))
+	enc = appendVarint(enc, uint64(len(win.insts)))
+	enc = appendVarint(enc, uint64(len(win.addrs)))
+
+	// Window header.
+	var header []byte
+
+	if len(win.copies) > 0 {
+		header = append(header, vcdSource)
+		header = appendVarint(header, uint64(win.segEnd-win.segStart))
+		header = appendVarint(header, uint64(win.segStart))
+	} else {
+		header = append(header, 0)
+	}
+
+	header = appendVarint(header, uint64(len(enc)+len(win.data)+len(win.insts)+len(win.addrs)))
+
+	for _, b := range [][]byte{header, enc, win.data, win.insts, win.addrs} {
+		_, err := out.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
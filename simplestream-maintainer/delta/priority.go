@@ -0,0 +1,149 @@
+package delta
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// I/O scheduling classes.
+const (
+	// IOClassNone leaves the I/O scheduling class unchanged.
+	IOClassNone = 0
+
+	// IOClassBestEffort is the default I/O scheduling class, where the
+	// level (0-7) determines the priority within the class.
+	IOClassBestEffort = 2
+
+	// IOClassIdle gets disk time only when no other process needs it.
+	IOClassIdle = 3
+)
+
+// Priority is the CPU and I/O scheduling priority of the delta generation.
+type Priority struct {
+	// Nice is the niceness increment (0-19). Zero leaves the CPU priority
+	// unchanged.
+	Nice int
+
+	// IOClass is the I/O scheduling class, and IOLevel is the priority
+	// within the best-effort class (0 is the highest, 7 the lowest).
+	IOClass int
+	IOLevel int
+}
+
+// ParseIOPriority parses the I/O priority in the format "idle", "best-effort",
+// or "best-effort:<level>". An empty value leaves the I/O priority unchanged.
+func ParseIOPriority(value string) (class int, level int, err error) {
+	name, levelStr, hasLevel := strings.Cut(value, ":")
+
+	switch name {
+	case "":
+		return IOClassNone, 0, nil
+
+	case "idle":
+		if hasLevel {
+			return 0, 0, fmt.Errorf("I/O scheduling class %q does not support levels", name)
+		}
+
+		return IOClassIdle, 0, nil
+
+	case "best-effort":
+		level = 4
+		if hasLevel {
+			level, err = strconv.Atoi(levelStr)
+			if err != nil || level < 0 || level > 7 {
+				return 0, 0, fmt.Errorf("Invalid I/O priority level %q. Level must be within range [0, 7]", levelStr)
+			}
+		}
+
+		return IOClassBestEffort, level, nil
+	}
+
+	return 0, 0, fmt.Errorf("Invalid I/O scheduling class %q. Valid classes are: [idle, best-effort]", name)
+}
+
+// Validate ensures the priority settings are within the valid ranges.
+func (p Priority) Validate() error {
+	if p.Nice < 0 || p.Nice > 19 {
+		return fmt.Errorf("Niceness must be within range [0, 19]")
+	}
+
+	if p.IOClass != IOClassNone && p.IOClass != IOClassBestEffort && p.IOClass != IOClassIdle {
+		return fmt.Errorf("Unsupported I/O scheduling class %d", p.IOClass)
+	}
+
+	if p.IOLevel < 0 || p.IOLevel > 7 {
+		return fmt.Errorf("I/O priority level must be within range [0, 7]")
+	}
+
+	return nil
+}
+
+// IsZero returns true if the priority leaves both CPU and I/O priority
+// unchanged.
+func (p Priority) IsZero() bool {
+	return p.Nice == 0 && p.IOClass == IOClassNone
+}
+
+// RunWithPriority runs the function with the given priority. The function is
+// run on a dedicated OS thread, whose priority is lowered, and which is then
+// discarded, so that the priority of the rest of the process is not affected.
+// External commands started by the function inherit the priority.
+func RunWithPriority(p Priority, fn func() error) error {
+	if p.IsZero() {
+		return fn()
+	}
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		// The thread is never unlocked, therefore, it is terminated
+		// once the goroutine exits rather than being reused.
+		runtime.LockOSThread()
+
+		err := p.apply()
+		if err != nil {
+			errCh <- fmt.Errorf("Failed to set priority: %w", err)
+			return
+		}
+
+		errCh <- fn()
+	}()
+
+	return <-errCh
+}
+
+// WithPriority returns the delta encoder that runs the given encoder with the
+// given priority.
+func WithPriority(encoder DeltaEncoder, p Priority) DeltaEncoder {
+	if p.IsZero() {
+		return encoder
+	}
+
+	return priorityEncoder{encoder: encoder, priority: p}
+}
+
+// priorityEncoder runs the underlying encoder with lowered priority.
+type priorityEncoder struct {
+	encoder  DeltaEncoder
+	priority Priority
+}
+
+// Encode writes the delta that transforms the source file into the target
+// file to the output file.
+func (e priorityEncoder) Encode(ctx context.Context, sourcePath string, targetPath string, outputPath string) error {
+	return RunWithPriority(e.priority, func() error {
+		return e.encoder.Encode(ctx, sourcePath, targetPath, outputPath)
+	})
+}
+
+// DecodeFile applies the delta file to the source file and writes the resulting
+// target to the writer.
+func (e priorityEncoder) DecodeFile(ctx context.Context, sourcePath string, deltaPath string, w io.Writer) error {
+	return RunWithPriority(e.priority, func() error {
+		return DecoderFor(e.encoder).DecodeFile(ctx, sourcePath, deltaPath, w)
+	})
+}
@@ -0,0 +1,42 @@
+//go:build linux
+
+package delta
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// ioprioWhoProcess is the IOPRIO_WHO_PROCESS target of the ioprio_set system
+// call, which refers to a single thread when used with a thread ID.
+const ioprioWhoProcess = 1
+
+// ioprioClassShift is the position of the class within the I/O priority.
+const ioprioClassShift = 13
+
+// apply lowers the priority of the calling thread.
+func (p Priority) apply() error {
+	tid := unix.Gettid()
+
+	if p.Nice > 0 {
+		// The system call returns the priority in range [1, 40], which
+		// corresponds to the niceness in range [19, -20].
+		prio, err := unix.Getpriority(unix.PRIO_PROCESS, tid)
+		if err != nil {
+			return err
+		}
+
+		err = unix.Setpriority(unix.PRIO_PROCESS, tid, min(20-prio+p.Nice, 19))
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.IOClass != IOClassNone {
+		_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(p.IOClass<<ioprioClassShift|p.IOLevel))
+		if errno != 0 {
+			return errno
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+//go:build linux
+
+package delta_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/delta"
+)
+
+func TestRunWithPriority(t *testing.T) {
+	t.Parallel()
+
+	// niceness returns the niceness of the calling thread.
+	niceness := func() int {
+		prio, err := unix.Getpriority(unix.PRIO_PROCESS, unix.Gettid())
+		require.NoError(t, err)
+		return 20 - prio
+	}
+
+	// ioClass returns the I/O scheduling class of the calling thread.
+	ioClass := func() int {
+		// IOPRIO_WHO_PROCESS with the thread ID refers to the thread.
+		prio, _, errno := unix.Syscall(unix.SYS_IOPRIO_GET, 1, uintptr(unix.Gettid()), 0)
+		require.Zero(t, errno)
+
+		// Class is stored above the 13 bits of the level.
+		return int(prio >> 13)
+	}
+
+	base := niceness()
+	if base+5 > 19 {
+		t.Skip("Niceness of the process is too high")
+	}
+
+	var gotNice int
+	var gotClass int
+
+	err := delta.RunWithPriority(delta.Priority{Nice: 5, IOClass: delta.IOClassIdle}, func() error {
+		gotNice = niceness()
+		gotClass = ioClass()
+		return nil
+	})
+
+	require.NoError(t, err)
+	require.Equal(t, base+5, gotNice)
+	require.Equal(t, delta.IOClassIdle, gotClass)
+}
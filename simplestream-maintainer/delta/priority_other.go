@@ -0,0 +1,13 @@
+//go:build !linux
+
+package delta
+
+import (
+	"fmt"
+)
+
+// apply returns an error, because lowering the priority of a single thread is
+// not supported on this platform.
+func (p Priority) apply() error {
+	return fmt.Errorf("Setting priority is not supported on this platform")
+}
@@ -0,0 +1,40 @@
+package delta_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/delta"
+)
+
+func TestParseIOPriority(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Value     string
+		WantClass int
+		WantLevel int
+		WantErr   bool
+	}{
+		{Value: "", WantClass: delta.IOClassNone},
+		{Value: "idle", WantClass: delta.IOClassIdle},
+		{Value: "best-effort", WantClass: delta.IOClassBestEffort, WantLevel: 4},
+		{Value: "best-effort:7", WantClass: delta.IOClassBestEffort, WantLevel: 7},
+		{Value: "best-effort:8", WantErr: true},
+		{Value: "idle:1", WantErr: true},
+		{Value: "realtime", WantErr: true},
+	}
+
+	for _, test := range tests {
+		class, level, err := delta.ParseIOPriority(test.Value)
+		if test.WantErr {
+			require.Errorf(t, err, "Expected error for %q", test.Value)
+			continue
+		}
+
+		require.NoError(t, err)
+		require.Equal(t, test.WantClass, class)
+		require.Equal(t, test.WantLevel, level)
+	}
+}
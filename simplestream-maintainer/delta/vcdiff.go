@@ -0,0 +1,219 @@
+package delta
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// VCDIFF format constants as defined in RFC 3284.
+const (
+	// Header indicator bits.
+	vcdDecompress = 0x01
+	vcdCodeTable  = 0x02
+	vcdAppHeader  = 0x04
+
+	// Window indicator bits. The adler32 bit is an extension used by
+	// xdelta3, which stores the checksum of the target window.
+	vcdSource  = 0x01
+	vcdTarget  = 0x02
+	vcdAdler32 = 0x04
+
+	// Address cache sizes of the default code table.
+	vcdNearSize = 4
+	vcdSameSize = 3
+)
+
+// vcdiffMagic is the header of every VCDIFF file (including version 0).
+var vcdiffMagic = []byte{0xD6, 0xC3, 0xC4, 0x00}
+
+// Instruction types.
+const (
+	instNoop = iota
+	instAdd
+	instRun
+	instCopy
+)
+
+// instruction is a single half of the code table entry.
+type instruction struct {
+	kind int
+	size int
+	mode int
+}
+
+// codeTable is the default VCDIFF code table. Each entry consists of up to
+// two instructions.
+var codeTable = buildCodeTable()
+
+// buildCodeTable builds the default code table as described in section 5.6
+// of RFC 3284.
+func buildCodeTable() [256][2]instruction {
+	var table [256][2]instruction
+
+	modes := 2 + vcdNearSize + vcdSameSize
+	i := 0
+
+	// RUN with size in the instruction stream.
+	table[i][0] = instruction{kind: instRun}
+	i++
+
+	// ADD with size 0 (size in the instruction stream) and sizes 1-17.
+	for size := 0; size <= 17; size++ {
+		table[i][0] = instruction{kind: instAdd, size: size}
+		i++
+	}
+
+	// COPY with size 0 (size in the instruction stream) and sizes 4-18
+	// for each address mode.
+	for mode := 0; mode < modes; mode++ {
+		table[i][0] = instruction{kind: instCopy, mode: mode}
+		i++
+
+		for size := 4; size <= 18; size++ {
+			table[i][0] = instruction{kind: instCopy, size: size, mode: mode}
+			i++
+		}
+	}
+
+	// ADD with sizes 1-4 followed by COPY with sizes 4-6 for the self,
+	// here, and near address modes.
+	for mode := 0; mode < 2+vcdNearSize; mode++ {
+		for addSize := 1; addSize <= 4; addSize++ {
+			for copySize := 4; copySize <= 6; copySize++ {
+				table[i][0] = instruction{kind: instAdd, size: addSize}
+				table[i][1] = instruction{kind: instCopy, size: copySize, mode: mode}
+				i++
+			}
+		}
+	}
+
+	// ADD with sizes 1-4 followed by COPY with size 4 for the same
+	// address modes.
+	for mode := 2 + vcdNearSize; mode < modes; mode++ {
+		for addSize := 1; addSize <= 4; addSize++ {
+			table[i][0] = instruction{kind: instAdd, size: addSize}
+			table[i][1] = instruction{kind: instCopy, size: 4, mode: mode}
+			i++
+		}
+	}
+
+	// COPY with size 4 followed by ADD with size 1 for each address mode.
+	for mode := 0; mode < modes; mode++ {
+		table[i][0] = instruction{kind: instCopy, size: 4, mode: mode}
+		table[i][1] = instruction{kind: instAdd, size: 1}
+		i++
+	}
+
+	return table
+}
+
+// appendVarint appends the integer encoded as a VCDIFF variable-length
+// integer (big-endian base 128, where all but the last byte have the most
+// significant bit set).
+func appendVarint(buf []byte, n uint64) []byte {
+	var tmp [10]byte
+
+	i := len(tmp) - 1
+	tmp[i] = byte(n & 0x7f)
+	n >>= 7
+
+	for n > 0 {
+		i--
+		tmp[i] = byte(n&0x7f) | 0x80
+		n >>= 7
+	}
+
+	return append(buf, tmp[i:]...)
+}
+
+// readVarint reads a VCDIFF variable-length integer.
+func readVarint(r io.ByteReader) (uint64, error) {
+	var n uint64
+
+	for i := 0; i < 10; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) && i > 0 {
+				return 0, io.ErrUnexpectedEOF
+			}
+
+			return 0, err
+		}
+
+		n = n<<7 | uint64(b&0x7f)
+
+		if b&0x80 == 0 {
+			return n, nil
+		}
+	}
+
+	return 0, fmt.Errorf("Invalid VCDIFF integer")
+}
+
+// addressCache is the VCDIFF address cache used for encoding and decoding
+// COPY addresses.
+type addressCache struct {
+	near     [vcdNearSize]uint64
+	nextSlot int
+	same     [vcdSameSize * 256]uint64
+}
+
+// update stores the address in the cache.
+func (c *addressCache) update(addr uint64) {
+	c.near[c.nextSlot] = addr
+	c.nextSlot = (c.nextSlot + 1) % vcdNearSize
+	c.same[addr%uint64(len(c.same))] = addr
+}
+
+// decode decodes the address of the COPY instruction with the given mode.
+// The here argument is the current position in the address space.
+func (c *addressCache) decode(here uint64, mode int, addrs io.ByteReader) (uint64, error) {
+	var addr uint64
+
+	switch {
+	case mode == 0:
+		n, err := readVarint(addrs)
+		if err != nil {
+			return 0, err
+		}
+
+		addr = n
+
+	case mode == 1:
+		n, err := readVarint(addrs)
+		if err != nil {
+			return 0, err
+		}
+
+		if n > here {
+			return 0, fmt.Errorf("Invalid VCDIFF address")
+		}
+
+		addr = here - n
+
+	case mode-2 < vcdNearSize:
+		n, err := readVarint(addrs)
+		if err != nil {
+			return 0, err
+		}
+
+		addr = c.near[mode-2] + n
+
+	default:
+		b, err := addrs.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		addr = c.same[(mode-2-vcdNearSize)*256+int(b)]
+	}
+
+	if addr >= here {
+		return 0, fmt.Errorf("Invalid VCDIFF address")
+	}
+
+	c.update(addr)
+
+	return addr, nil
+}
@@ -0,0 +1,82 @@
+package delta
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is a daily time window (in local time) in which delta files are
+// generated. The window may span midnight (for example, "22:00-04:00"). The
+// zero value represents the whole day.
+type Window struct {
+	// Start and End are the offsets from the midnight.
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParseWindow parses the window in the format "HH:MM-HH:MM". An empty value
+// represents the whole day.
+func ParseWindow(value string) (Window, error) {
+	if value == "" {
+		return Window{}, nil
+	}
+
+	startStr, endStr, ok := strings.Cut(value, "-")
+	if !ok {
+		return Window{}, fmt.Errorf("Invalid time window %q. Expected format is HH:MM-HH:MM", value)
+	}
+
+	start, err := parseTimeOfDay(startStr)
+	if err != nil {
+		return Window{}, fmt.Errorf("Invalid time window %q: %w", value, err)
+	}
+
+	end, err := parseTimeOfDay(endStr)
+	if err != nil {
+		return Window{}, fmt.Errorf("Invalid time window %q: %w", value, err)
+	}
+
+	if start == end {
+		return Window{}, fmt.Errorf("Invalid time window %q: Start and end cannot be equal", value)
+	}
+
+	return Window{Start: start, End: end}, nil
+}
+
+// parseTimeOfDay parses the time of day in the format "HH:MM" and returns its
+// offset from the midnight.
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time of day %q", value)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Contains returns true if the given time is within the window.
+func (w Window) Contains(t time.Time) bool {
+	if w.Start == w.End {
+		return true
+	}
+
+	t = t.Local()
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+
+	if w.Start < w.End {
+		return offset >= w.Start && offset < w.End
+	}
+
+	// Window spans midnight.
+	return offset >= w.Start || offset < w.End
+}
+
+// String returns the window in the format "HH:MM-HH:MM".
+func (w Window) String() string {
+	format := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+
+	return format(w.Start) + "-" + format(w.End)
+}
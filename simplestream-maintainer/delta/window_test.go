@@ -0,0 +1,44 @@
+package delta_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/delta"
+)
+
+func TestWindow(t *testing.T) {
+	t.Parallel()
+
+	at := func(hour int, minute int) time.Time {
+		return time.Date(2024, 1, 1, hour, minute, 0, 0, time.Local)
+	}
+
+	// Whole day.
+	w, err := delta.ParseWindow("")
+	require.NoError(t, err)
+	require.True(t, w.Contains(at(12, 0)))
+
+	w, err = delta.ParseWindow("01:00-06:00")
+	require.NoError(t, err)
+	require.Equal(t, "01:00-06:00", w.String())
+	require.False(t, w.Contains(at(0, 59)))
+	require.True(t, w.Contains(at(1, 0)))
+	require.True(t, w.Contains(at(5, 59)))
+	require.False(t, w.Contains(at(6, 0)))
+
+	// Window spanning midnight.
+	w, err = delta.ParseWindow("22:30-04:00")
+	require.NoError(t, err)
+	require.True(t, w.Contains(at(23, 0)))
+	require.True(t, w.Contains(at(3, 0)))
+	require.False(t, w.Contains(at(12, 0)))
+	require.False(t, w.Contains(at(22, 0)))
+
+	for _, value := range []string{"01:00", "01:00-25:00", "1am-6am", "01:00-01:00"} {
+		_, err := delta.ParseWindow(value)
+		require.Errorf(t, err, "Expected error for window %q", value)
+	}
+}
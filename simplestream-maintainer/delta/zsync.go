@@ -0,0 +1,179 @@
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/md4"
+)
+
+// Supported delta formats.
+const (
+	// FormatVCDiff is a delta (VCDIFF) file between two versions of the file.
+	FormatVCDiff = "vcdiff"
+
+	// FormatZsync is a zsync control file, which allows clients to fetch only
+	// the changed blocks of the file using HTTP range requests.
+	FormatZsync = "zsync"
+)
+
+// zsyncVersion is the version of the zsync control file format.
+const zsyncVersion = "0.6.2"
+
+// ValidateFormat returns an error if the given delta format is not supported.
+func ValidateFormat(format string) error {
+	switch format {
+	case FormatVCDiff, FormatZsync:
+		return nil
+	}
+
+	return fmt.Errorf("Unsupported delta format %q. Valid formats are: [%s, %s]", format, FormatVCDiff, FormatZsync)
+}
+
+// zsyncParams returns the block size and the hash lengths (number of
+// consecutive matching blocks, rolling checksum bytes, and strong checksum
+// bytes) for the file of the given size. The values are chosen in the same
+// way as zsyncmake does, so that the control file stays small while the
+// probability of false block matches remains negligible.
+func zsyncParams(size int64) (blockSize int, seqMatches int, rsumBytes int, checksumBytes int) {
+	blockSize = 2048
+	if size >= 100_000_000 {
+		blockSize = 4096
+	}
+
+	seqMatches = 1
+	if size > int64(blockSize) {
+		seqMatches = 2
+	}
+
+	length := math.Max(float64(size), 1)
+	blocks := 1 + length/float64(blockSize)
+
+	rsumBytes = int(math.Ceil(((math.Log(length)+math.Log(float64(blockSize)))/math.Log(2) - 8.6) / float64(seqMatches) / 8))
+	rsumBytes = min(max(rsumBytes, 2), 4)
+
+	checksumBytes = int(math.Ceil((20 + (math.Log(length)+math.Log(blocks))/math.Log(2)) / float64(seqMatches) / 8))
+	checksumBytes = max(checksumBytes, int((7.9+(20+math.Log(blocks)/math.Log(2)))/8))
+	checksumBytes = min(checksumBytes, 16)
+
+	return blockSize, seqMatches, rsumBytes, checksumBytes
+}
+
+// zsyncRsum returns the rolling checksum of the block as used by zsync.
+func zsyncRsum(block []byte) [4]byte {
+	var a, b uint16
+
+	for i, c := range block {
+		a += uint16(c)
+		b += uint16(len(block)-i) * uint16(c)
+	}
+
+	var sum [4]byte
+	binary.BigEndian.PutUint16(sum[0:], a)
+	binary.BigEndian.PutUint16(sum[2:], b)
+
+	return sum
+}
+
+// CreateZsync writes the zsync control file for the target file to the
+// output file. The name is used as the file name and the (relative) URL of
+// the target file within the control file.
+func CreateZsync(ctx context.Context, targetPath string, name string, outputPath string) error {
+	target, err := os.Open(targetPath)
+	if err != nil {
+		return err
+	}
+
+	defer target.Close()
+
+	info, err := target.Stat()
+	if err != nil {
+		return err
+	}
+
+	blockSize, seqMatches, rsumBytes, checksumBytes := zsyncParams(info.Size())
+
+	// Block checksums are collected first, because the header contains
+	// the SHA-1 hash of the whole file.
+	var sums bytes.Buffer
+
+	fileHash := sha1.New()
+	blockHash := md4.New()
+	block := make([]byte, blockSize)
+	reader := bufio.NewReaderSize(target, 1<<20)
+
+	for {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		n, err := io.ReadFull(reader, block)
+		if n == 0 {
+			if err == io.EOF {
+				break
+			}
+
+			return err
+		}
+
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		fileHash.Write(block[:n])
+
+		// The last block is padded with zeros.
+		clear(block[n:])
+
+		rsum := zsyncRsum(block)
+		sums.Write(rsum[4-rsumBytes:])
+
+		blockHash.Reset()
+		blockHash.Write(block)
+		sums.Write(blockHash.Sum(nil)[:checksumBytes])
+
+		if n < blockSize {
+			break
+		}
+	}
+
+	output, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+
+	defer output.Close()
+
+	w := bufio.NewWriter(output)
+
+	fmt.Fprintf(w, "zsync: %s\n", zsyncVersion)
+	fmt.Fprintf(w, "Filename: %s\n", name)
+	fmt.Fprintf(w, "MTime: %s\n", info.ModTime().UTC().Format(time.RFC1123Z))
+	fmt.Fprintf(w, "Blocksize: %d\n", blockSize)
+	fmt.Fprintf(w, "Length: %d\n", info.Size())
+	fmt.Fprintf(w, "Hash-Lengths: %d,%d,%d\n", seqMatches, rsumBytes, checksumBytes)
+	fmt.Fprintf(w, "URL: %s\n", name)
+	fmt.Fprintf(w, "SHA-1: %s\n\n", hex.EncodeToString(fileHash.Sum(nil)))
+
+	_, err = sums.WriteTo(w)
+	if err != nil {
+		return err
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	return output.Close()
+}
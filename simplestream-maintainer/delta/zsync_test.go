@@ -0,0 +1,110 @@
+package delta_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/md4"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/delta"
+)
+
+func TestValidateFormat(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, delta.ValidateFormat(delta.FormatVCDiff))
+	require.NoError(t, delta.ValidateFormat(delta.FormatZsync))
+	require.ErrorContains(t, delta.ValidateFormat("bsdiff"), `Unsupported delta format "bsdiff"`)
+}
+
+func TestCreateZsync(t *testing.T) {
+	t.Parallel()
+
+	rnd := rand.New(rand.NewSource(1))
+
+	tests := []struct {
+		Name string
+		Size int
+	}{
+		{Name: "Empty file", Size: 0},
+		{Name: "Single partial block", Size: 100},
+		{Name: "Exact blocks", Size: 4 * 2048},
+		{Name: "Partial last block", Size: 1<<20 + 7},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			content := make([]byte, test.Size)
+			_, _ = rnd.Read(content)
+
+			targetPath := filepath.Join(dir, "root.squashfs")
+			outputPath := filepath.Join(dir, "root.squashfs.zsync")
+
+			err := os.WriteFile(targetPath, content, 0644)
+			require.NoError(t, err)
+
+			err = delta.CreateZsync(context.Background(), targetPath, "root.squashfs", outputPath)
+			require.NoError(t, err)
+
+			data, err := os.ReadFile(outputPath)
+			require.NoError(t, err)
+
+			// Parse header.
+			header, sums, ok := bytes.Cut(data, []byte("\n\n"))
+			require.True(t, ok, "Header is not terminated")
+
+			fields := make(map[string]string)
+			for _, line := range strings.Split(string(header), "\n") {
+				key, value, ok := strings.Cut(line, ": ")
+				require.True(t, ok, "Invalid header line %q", line)
+				fields[key] = value
+			}
+
+			fileHash := sha1.Sum(content)
+
+			require.Equal(t, "0.6.2", fields["zsync"])
+			require.Equal(t, "root.squashfs", fields["Filename"])
+			require.Equal(t, "root.squashfs", fields["URL"])
+			require.Equal(t, strconv.Itoa(test.Size), fields["Length"])
+			require.Equal(t, hex.EncodeToString(fileHash[:]), fields["SHA-1"])
+
+			blockSize, err := strconv.Atoi(fields["Blocksize"])
+			require.NoError(t, err)
+
+			lengths := strings.Split(fields["Hash-Lengths"], ",")
+			require.Len(t, lengths, 3)
+
+			rsumBytes, err := strconv.Atoi(lengths[1])
+			require.NoError(t, err)
+
+			checksumBytes, err := strconv.Atoi(lengths[2])
+			require.NoError(t, err)
+
+			// Verify block checksums.
+			blocks := (test.Size + blockSize - 1) / blockSize
+			require.Len(t, sums, blocks*(rsumBytes+checksumBytes))
+
+			for i := 0; i < blocks; i++ {
+				block := make([]byte, blockSize)
+				copy(block, content[i*blockSize:])
+
+				h := md4.New()
+				h.Write(block)
+
+				offset := i*(rsumBytes+checksumBytes) + rsumBytes
+				require.Equal(t, h.Sum(nil)[:checksumBytes], sums[offset:offset+checksumBytes], "Checksum mismatch for block %d", i)
+			}
+		})
+	}
+}
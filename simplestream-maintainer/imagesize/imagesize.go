@@ -0,0 +1,168 @@
+// Package imagesize determines the installed size of the image files, which is
+// the disk space required once the image is unpacked, as opposed to the size of
+// the downloaded files.
+package imagesize
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+// Sizer determines the installed size using the external tools. The zero value
+// looks up the tools in the PATH.
+type Sizer struct {
+	// Unsquashfs is the path of the unsquashfs binary used for squashfs
+	// files. Defaults to "unsquashfs".
+	Unsquashfs string
+
+	// QemuImg is the path of the qemu-img binary used for qcow2 files.
+	// Defaults to "qemu-img".
+	QemuImg string
+}
+
+// Supported returns true if the installed size can be determined for the items
+// of the given type.
+func Supported(ftype string) bool {
+	return ftype == stream.ItemTypeSquashfs || ftype == stream.ItemTypeDiskKVM
+}
+
+// Check ensures the external tools are available.
+func (s Sizer) Check() error {
+	for _, tool := range []string{s.unsquashfs(), s.qemuImg()} {
+		_, err := exec.LookPath(tool)
+		if err != nil {
+			return fmt.Errorf("Tool %q required to determine installed size is not available: %w", tool, err)
+		}
+	}
+
+	return nil
+}
+
+// InstalledSize returns the installed size of the local file holding the item
+// of the given type. For squashfs, this is the total size of the regular files
+// within the file system, and for qcow2, the virtual size of the disk.
+func (s Sizer) InstalledSize(ctx context.Context, path string, ftype string) (int64, error) {
+	switch ftype {
+	case stream.ItemTypeSquashfs:
+		out, err := run(ctx, s.unsquashfs(), "-lls", path)
+		if err != nil {
+			return 0, err
+		}
+
+		return parseSquashfsListing(out)
+
+	case stream.ItemTypeDiskKVM:
+		out, err := run(ctx, s.qemuImg(), "info", "--output=json", path)
+		if err != nil {
+			return 0, err
+		}
+
+		return parseQemuImgInfo(out)
+	}
+
+	return 0, fmt.Errorf("Installed size of item type %q cannot be determined", ftype)
+}
+
+func (s Sizer) unsquashfs() string {
+	if s.Unsquashfs == "" {
+		return "unsquashfs"
+	}
+
+	return s.Unsquashfs
+}
+
+func (s Sizer) qemuImg() string {
+	if s.QemuImg == "" {
+		return "qemu-img"
+	}
+
+	return s.QemuImg
+}
+
+// parseSquashfsListing sums the sizes of the regular files in the long listing
+// produced by "unsquashfs -lls", where each file is listed as:
+//
+//	-rw-r--r-- root/root 1234 2024-01-01 00:00 squashfs-root/etc/hostname
+//
+// Other entries (directories, links, and devices) and the informational lines
+// are ignored.
+func parseSquashfsListing(out []byte) (int64, error) {
+	var total int64
+
+	files := 0
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || len(fields[0]) != 10 || fields[0][0] != '-' {
+			continue
+		}
+
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid file size in unsquashfs listing %q: %w", scanner.Text(), err)
+		}
+
+		total += size
+		files++
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	if files == 0 && !bytes.Contains(out, []byte("squashfs-root")) {
+		return 0, fmt.Errorf("Unexpected unsquashfs output: no files are listed")
+	}
+
+	return total, nil
+}
+
+// parseQemuImgInfo returns the virtual size from the JSON output of the
+// "qemu-img info" command.
+func parseQemuImgInfo(out []byte) (int64, error) {
+	var info struct {
+		VirtualSize *int64 `json:"virtual-size"`
+	}
+
+	err := json.Unmarshal(out, &info)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to decode qemu-img output: %w", err)
+	}
+
+	if info.VirtualSize == nil {
+		return 0, fmt.Errorf("Unexpected qemu-img output: virtual size is missing")
+	}
+
+	return *info.VirtualSize, nil
+}
+
+// run runs the tool with the given arguments and returns its standard output.
+// Returned error includes the error output of the failed command.
+func run(ctx context.Context, tool string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, tool, args...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			return nil, fmt.Errorf("Failed to run %q: %w", tool, err)
+		}
+
+		return nil, fmt.Errorf("Failed to run %q: %w (%s)", tool, err, msg)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,112 @@
+package imagesize_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/imagesize"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+// fakeTool writes the script that prints the given output, or fails with the
+// given output if fail is true.
+func fakeTool(t *testing.T, name string, output string, fail bool) string {
+	toolPath := filepath.Join(t.TempDir(), name)
+
+	script := "#!/bin/sh\ncat <<'EOF'\n" + output + "\nEOF\n"
+	if fail {
+		script = "#!/bin/sh\ncat >&2 <<'EOF'\n" + output + "\nEOF\nexit 1\n"
+	}
+
+	require.NoError(t, os.WriteFile(toolPath, []byte(script), 0755))
+	return toolPath
+}
+
+func TestInstalledSize(t *testing.T) {
+	t.Parallel()
+
+	listing := `Parallel unsquashfs: Using 8 processors
+4 inodes (3 blocks) to write
+
+drwxr-xr-x root/root                51 2024-01-01 00:00 squashfs-root
+drwxr-xr-x root/root                38 2024-01-01 00:00 squashfs-root/etc
+-rw-r--r-- root/root              1000 2024-01-01 00:00 squashfs-root/etc/hostname
+crw-rw-rw- root/root             1,  3 2024-01-01 00:00 squashfs-root/etc/null
+lrwxrwxrwx root/root                 8 2024-01-01 00:00 squashfs-root/etc/link -> hostname
+-rwxr-xr-x root/root             24000 2024-01-01 00:00 squashfs-root/init`
+
+	tests := []struct {
+		Name     string
+		Sizer    imagesize.Sizer
+		Ftype    string
+		WantSize int64
+		WantErr  string
+	}{
+		{
+			Name:     "Squashfs",
+			Sizer:    imagesize.Sizer{Unsquashfs: fakeTool(t, "unsquashfs", listing, false)},
+			Ftype:    stream.ItemTypeSquashfs,
+			WantSize: 25000,
+		},
+		{
+			Name:    "Squashfs with unexpected output",
+			Sizer:   imagesize.Sizer{Unsquashfs: fakeTool(t, "unsquashfs", "Nothing to list", false)},
+			Ftype:   stream.ItemTypeSquashfs,
+			WantErr: "no files are listed",
+		},
+		{
+			Name:    "Squashfs is corrupted",
+			Sizer:   imagesize.Sizer{Unsquashfs: fakeTool(t, "unsquashfs", "Can't find a valid SQUASHFS superblock", true)},
+			Ftype:   stream.ItemTypeSquashfs,
+			WantErr: "Can't find a valid SQUASHFS superblock",
+		},
+		{
+			Name:     "Qcow2",
+			Sizer:    imagesize.Sizer{QemuImg: fakeTool(t, "qemu-img", `{"virtual-size": 10737418240, "actual-size": 1048576, "format": "qcow2"}`, false)},
+			Ftype:    stream.ItemTypeDiskKVM,
+			WantSize: 10737418240,
+		},
+		{
+			Name:    "Qcow2 without virtual size",
+			Sizer:   imagesize.Sizer{QemuImg: fakeTool(t, "qemu-img", `{"format": "qcow2"}`, false)},
+			Ftype:   stream.ItemTypeDiskKVM,
+			WantErr: "virtual size is missing",
+		},
+		{
+			Name:    "Unsupported item type",
+			Ftype:   stream.ItemTypeMetadata,
+			WantErr: `Installed size of item type "lxd.tar.xz" cannot be determined`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			size, err := test.Sizer.InstalledSize(context.Background(), "image", test.Ftype)
+			if test.WantErr != "" {
+				require.ErrorContains(t, err, test.WantErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, test.WantSize, size)
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	t.Parallel()
+
+	sizer := imagesize.Sizer{
+		Unsquashfs: fakeTool(t, "unsquashfs", "", false),
+		QemuImg:    fakeTool(t, "qemu-img", "", false),
+	}
+
+	require.NoError(t, sizer.Check())
+
+	sizer.QemuImg = filepath.Join(t.TempDir(), "missing")
+	require.ErrorContains(t, sizer.Check(), "required to determine installed size is not available")
+}
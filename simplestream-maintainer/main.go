@@ -2,24 +2,37 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/spf13/cobra"
-)
 
-var version = "0.0.1"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/metrics"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/version"
+)
 
 type globalOptions struct {
-	flagTimeout   uint
-	flagLogLevel  string
-	flagLogFormat string
+	flagTimeout     uint
+	flagLogLevel    string
+	flagLogFormat   string
+	flagMetricsAddr string
+	flagPathSchema  string
+	flagPprof       string
+	flagTrace       string
 
-	ctx    context.Context
-	cancel context.CancelFunc
+	ctx           context.Context
+	cancel        context.CancelFunc
+	metricsServer *http.Server
+	pathSchema    stream.PathSchema
+	stopProfiling func() error
 }
 
 // NewRootCmd initializes a CLI tool.
@@ -27,12 +40,13 @@ func NewRootCmd() *cobra.Command {
 	o := globalOptions{}
 
 	cmd := &cobra.Command{
-		Use:              "simplestream-maintainer",
-		Short:            "Simplestream server maintainer",
-		Version:          version,
-		SilenceUsage:     true,
-		SilenceErrors:    true,
-		PersistentPreRun: o.PreRun,
+		Use:               "simplestream-maintainer",
+		Short:             "Simplestream server maintainer",
+		Version:           version.Get().String(),
+		SilenceUsage:      true,
+		SilenceErrors:     true,
+		PersistentPreRun:  o.PreRun,
+		PersistentPostRun: o.PostRun,
 	}
 
 	cmd.AddGroup(
@@ -45,16 +59,77 @@ func NewRootCmd() *cobra.Command {
 
 	// Global flags.
 	cmd.PersistentFlags().UintVar(&o.flagTimeout, "timeout", 0, "Timeout in seconds")
+	cmd.PersistentFlags().StringVar(&o.flagLogLevel, "log-level", "info", "Log level (debug, info, warn, error)")
+	cmd.PersistentFlags().StringVar(&o.flagLogFormat, "log-format", "text", "Log format (text, json)")
+
+	// Deprecated aliases of the log flags.
 	cmd.PersistentFlags().StringVar(&o.flagLogLevel, "loglevel", "info", "Log level")
 	cmd.PersistentFlags().StringVar(&o.flagLogFormat, "logformat", "text", "Log format")
+	_ = cmd.PersistentFlags().MarkDeprecated("loglevel", "use --log-level instead")
+	_ = cmd.PersistentFlags().MarkDeprecated("logformat", "use --log-format instead")
+	cmd.PersistentFlags().StringVar(&o.flagMetricsAddr, "metrics-addr", "", "Address on which Prometheus metrics are exposed while the command runs (e.g. :9100)")
+	cmd.PersistentFlags().StringVar(&o.flagPathSchema, "path-schema", stream.DefaultPathSchema, "Layout of product directories (e.g. {stream}/{os}/{release}/{variant}/{arch})")
+	cmd.PersistentFlags().StringVar(&o.flagPprof, "pprof", "", "Write CPU profile of the command to the given file (inspect with \"go tool pprof\")")
+	cmd.PersistentFlags().StringVar(&o.flagTrace, "trace", "", "Write execution trace of the command to the given file (inspect with \"go tool trace\")")
 
 	// Commands.
+	auditOpts := auditOptions{global: &o}
+	cmd.AddCommand(auditOpts.NewCommand())
+
 	buildOpts := buildOptions{global: &o}
 	cmd.AddCommand(buildOpts.NewCommand())
 
+	dedupeOpts := dedupeOptions{global: &o}
+	cmd.AddCommand(dedupeOpts.NewCommand())
+
+	diffOpts := diffOptions{global: &o}
+	cmd.AddCommand(diffOpts.NewCommand())
+
+	duOpts := duOptions{global: &o}
+	cmd.AddCommand(duOpts.NewCommand())
+
+	importOpts := importOptions{global: &o}
+	cmd.AddCommand(importOpts.NewCommand())
+
+	inspectOpts := inspectOptions{global: &o}
+	cmd.AddCommand(inspectOpts.NewCommand())
+
+	listOpts := listOptions{global: &o}
+	cmd.AddCommand(listOpts.NewCommand())
+
+	migrateOpts := migrateOptions{global: &o}
+	cmd.AddCommand(migrateOpts.NewCommand())
+
+	migrateStreamOpts := migrateStreamOptions{global: &o}
+	cmd.AddCommand(migrateStreamOpts.NewCommand())
+
+	mirrorOpts := mirrorOptions{global: &o}
+	cmd.AddCommand(mirrorOpts.NewCommand())
+
 	pruneOpts := pruneOptions{global: &o}
 	cmd.AddCommand(pruneOpts.NewCommand())
 
+	publishOpts := publishOptions{global: &o}
+	cmd.AddCommand(publishOpts.NewCommand())
+
+	repairOpts := repairOptions{global: &o}
+	cmd.AddCommand(repairOpts.NewCommand())
+
+	rollbackOpts := rollbackOptions{global: &o}
+	cmd.AddCommand(rollbackOpts.NewCommand())
+
+	serveOpts := serveOptions{global: &o}
+	cmd.AddCommand(serveOpts.NewCommand())
+
+	statsOpts := statsOptions{global: &o}
+	cmd.AddCommand(statsOpts.NewCommand())
+
+	verifyOpts := verifyOptions{global: &o}
+	cmd.AddCommand(verifyOpts.NewCommand())
+
+	watchOpts := watchOptions{global: &o, build: buildOptions{global: &o}}
+	cmd.AddCommand(watchOpts.NewCommand())
+
 	return cmd
 }
 
@@ -67,7 +142,7 @@ func (o *globalOptions) PreRun(cmd *cobra.Command, args []string) {
 	}
 
 	// Set signals that cancel the context.
-	o.ctx, o.cancel = signal.NotifyContext(o.ctx, os.Interrupt)
+	o.ctx, o.cancel = signal.NotifyContext(o.ctx, os.Interrupt, syscall.SIGTERM)
 
 	// Configure default logger.
 	err := setDefaultLogger(o.flagLogLevel, o.flagLogFormat)
@@ -76,6 +151,87 @@ func (o *globalOptions) PreRun(cmd *cobra.Command, args []string) {
 		fmt.Fprintln(os.Stderr, "Error:", err)
 		os.Exit(1)
 	}
+
+	o.pathSchema, err = stream.ParsePathSchema(o.flagPathSchema)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+
+	info := version.Get()
+	slog.Debug("Running simplestream-maintainer", "command", cmd.Name(), "version", info.Version, "commit", info.Commit, "goVersion", info.GoVersion)
+
+	// Start profiling. Profiles are written also when the command fails,
+	// in which case the post-run hook is not executed.
+	if o.flagPprof != "" || o.flagTrace != "" {
+		o.stopProfiling, err = startProfiling(o.flagPprof, o.flagTrace)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+
+		cobra.OnFinalize(o.finalizeProfiling)
+	}
+
+	// Expose metrics.
+	if o.flagMetricsAddr != "" {
+		o.metricsServer, err = startMetricsServer(o.flagMetricsAddr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+	}
+}
+
+func (o *globalOptions) PostRun(cmd *cobra.Command, args []string) {
+	if o.metricsServer != nil {
+		_ = o.metricsServer.Close()
+	}
+
+	o.finalizeProfiling()
+}
+
+// finalizeProfiling stops profiling if it is in progress.
+func (o *globalOptions) finalizeProfiling() {
+	if o.stopProfiling == nil {
+		return
+	}
+
+	err := o.stopProfiling()
+	if err != nil {
+		slog.Warn("Failed to write profile", "error", err)
+	}
+
+	o.stopProfiling = nil
+}
+
+// startMetricsServer starts the HTTP server that exposes metrics on the
+// "/metrics" path of the given address.
+func startMetricsServer(addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to expose metrics: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.DefaultRegistry.Handler())
+
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 30 * time.Second,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Metrics server failed", "error", err)
+		}
+	}()
+
+	slog.Info("Metrics exposed", "address", listener.Addr().String())
+
+	return server, nil
 }
 
 func setDefaultLogger(level string, format string) error {
@@ -86,7 +242,7 @@ func setDefaultLogger(level string, format string) error {
 		opts.Level = slog.LevelDebug
 	case "info":
 		opts.Level = slog.LevelInfo
-	case "warn":
+	case "warn", "warning":
 		opts.Level = slog.LevelWarn
 	case "error":
 		opts.Level = slog.LevelError
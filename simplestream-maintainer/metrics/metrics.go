@@ -0,0 +1,331 @@
+// Package metrics provides counters and histograms exposed in the Prometheus
+// text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of the Prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Collector is a metric that can be written in the text exposition format.
+type Collector interface {
+	// Write writes the metric to the writer.
+	Write(w io.Writer) error
+}
+
+// Registry is a set of collectors.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+// NewRegistry returns a new empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// DefaultRegistry is the registry of the metrics defined by this package.
+var DefaultRegistry = NewRegistry()
+
+// Register adds the collectors to the registry.
+func (r *Registry) Register(collectors ...Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.collectors = append(r.collectors, collectors...)
+}
+
+// Write writes all registered metrics to the writer.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	collectors := slices.Clone(r.collectors)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+
+	for _, c := range collectors {
+		err := c.Write(bw)
+		if err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Handler returns the HTTP handler that serves the registered metrics.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", ContentType)
+		_ = r.Write(w)
+	})
+}
+
+// metric holds the fields common to all metric types.
+type metric struct {
+	name   string
+	help   string
+	labels []string
+}
+
+// writeHeader writes the HELP and TYPE lines of the metric.
+func (m metric) writeHeader(w io.Writer, metricType string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, escapeHelp(m.help), m.name, metricType)
+	return err
+}
+
+// key joins label values into a single map key.
+func (m metric) key(labelValues []string) string {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("Metric %q requires %d label values, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+
+	return strings.Join(labelValues, "\xff")
+}
+
+// formatLabels formats the label pairs, including the extra pair if its name
+// is not empty.
+func (m metric) formatLabels(key string, extraName string, extraValue string) string {
+	var pairs []string
+
+	if len(m.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", m.labels[i], value))
+		}
+	}
+
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extraName, extraValue))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// CounterVec is a set of counters partitioned by label values.
+type CounterVec struct {
+	metric
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounterVec returns a new counter with the given label names.
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{
+		metric: metric{name: name, help: help, labels: labels},
+		values: make(map[string]float64),
+	}
+}
+
+// Add increases the counter with the given label values by the value, which
+// must not be negative.
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		panic(fmt.Sprintf("Counter %q cannot be decreased", c.name))
+	}
+
+	key := c.key(labelValues)
+
+	c.mu.Lock()
+	c.values[key] += value
+	c.mu.Unlock()
+}
+
+// Inc increases the counter with the given label values by 1.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Value returns the current value of the counter with the given label values.
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	key := c.key(labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.values[key]
+}
+
+// Write implements Collector.
+func (c *CounterVec) Write(w io.Writer) error {
+	err := c.writeHeader(w, "counter")
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		_, err := fmt.Fprintf(w, "%s%s %s\n", c.name, c.formatLabels(k, "", ""), formatFloat(c.values[k]))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DefaultBuckets are the default histogram buckets, suitable for durations
+// (in seconds) of the build and prune operations.
+var DefaultBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600}
+
+// HistogramVec is a set of histograms partitioned by label values.
+type HistogramVec struct {
+	metric
+
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+// histogram holds the observations of a single histogram.
+type histogram struct {
+	counts []uint64 // Per bucket (not cumulative).
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec returns a new histogram with the given upper bounds of the
+// buckets and label names. If buckets are empty, DefaultBuckets are used.
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+
+	return &HistogramVec{
+		metric:  metric{name: name, help: help, labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+}
+
+// Observe records the value in the histogram with the given label values.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+
+	i, _ := slices.BinarySearch(h.buckets, value)
+	if i < len(h.buckets) {
+		hist.counts[i]++
+	}
+
+	hist.count++
+	hist.sum += value
+}
+
+// Count returns the number of observations in the histogram with the given
+// label values.
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	key := h.key(labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hist, ok := h.values[key]
+	if !ok {
+		return 0
+	}
+
+	return hist.count
+}
+
+// Write implements Collector.
+func (h *HistogramVec) Write(w io.Writer) error {
+	err := h.writeHeader(w, "histogram")
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		hist := h.values[k]
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+
+			_, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.formatLabels(k, "le", formatFloat(bound)), cumulative)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			h.name, h.formatLabels(k, "le", "+Inf"), hist.count,
+			h.name, h.formatLabels(k, "", ""), formatFloat(hist.sum),
+			h.name, h.formatLabels(k, "", ""), hist.count)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// formatFloat formats the value as expected by the text exposition format.
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// escapeHelp escapes backslashes and new lines in the help text.
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
@@ -0,0 +1,64 @@
+package metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/metrics"
+)
+
+func TestRegistry(t *testing.T) {
+	t.Parallel()
+
+	counter := metrics.NewCounterVec("test_total", "Test counter.", "stream", "type")
+	counter.Inc("images", "version")
+	counter.Add(2, "images", "version")
+	counter.Inc("other", "item")
+
+	plain := metrics.NewCounterVec("test_bytes_total", "Test counter\nwithout labels.")
+	plain.Add(1024)
+
+	histogram := metrics.NewHistogramVec("test_seconds", "Test histogram.", []float64{5, 1}, "stream")
+	histogram.Observe(0.5, "images")
+	histogram.Observe(1, "images")
+	histogram.Observe(3, "images")
+	histogram.Observe(10, "images")
+
+	require.Equal(t, float64(3), counter.Value("images", "version"))
+	require.Equal(t, uint64(4), histogram.Count("images"))
+
+	registry := metrics.NewRegistry()
+	registry.Register(counter, plain, histogram)
+
+	want := []string{
+		`# HELP test_total Test counter.`,
+		`# TYPE test_total counter`,
+		`test_total{stream="images",type="version"} 3`,
+		`test_total{stream="other",type="item"} 1`,
+		`# HELP test_bytes_total Test counter\nwithout labels.`,
+		`# TYPE test_bytes_total counter`,
+		`test_bytes_total 1024`,
+		`# HELP test_seconds Test histogram.`,
+		`# TYPE test_seconds histogram`,
+		`test_seconds_bucket{stream="images",le="1"} 2`,
+		`test_seconds_bucket{stream="images",le="5"} 3`,
+		`test_seconds_bucket{stream="images",le="+Inf"} 4`,
+		`test_seconds_sum{stream="images"} 14.5`,
+		`test_seconds_count{stream="images"} 4`,
+	}
+
+	rec := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, metrics.ContentType, rec.Header().Get("Content-Type"))
+	require.Equal(t, strings.Join(want, "\n")+"\n", rec.Body.String())
+
+	// Ensure label values must match label names.
+	require.Panics(t, func() { counter.Inc("images") })
+	require.Panics(t, func() { counter.Add(-1, "images", "version") })
+}
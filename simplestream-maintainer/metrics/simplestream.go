@@ -0,0 +1,60 @@
+package metrics
+
+// Metrics of the build and prune operations.
+var (
+	// VersionsAdded counts product versions added to the product catalog.
+	VersionsAdded = NewCounterVec("simplestream_maintainer_versions_added_total",
+		"Number of product versions added to the product catalog.", "stream")
+
+	// DeltasGenerated counts generated delta files.
+	DeltasGenerated = NewCounterVec("simplestream_maintainer_deltas_generated_total",
+		"Number of generated delta files.", "stream")
+
+	// HashBytes counts bytes read when calculating file hashes.
+	HashBytes = NewCounterVec("simplestream_maintainer_hash_bytes_total",
+		"Number of bytes read when calculating file hashes.")
+
+	// ChecksumMismatches counts items whose hash does not match the checksum
+	// from the version's checksum file.
+	ChecksumMismatches = NewCounterVec("simplestream_maintainer_checksum_mismatches_total",
+		"Number of items whose hash does not match the checksum file.", "stream")
+
+	// SmokeTestFailures counts product versions that failed the smoke test.
+	SmokeTestFailures = NewCounterVec("simplestream_maintainer_smoke_test_failures_total",
+		"Number of product versions that failed the smoke test.", "stream")
+
+	// Pruned counts pruned resources by type (version, item, or dangling).
+	Pruned = NewCounterVec("simplestream_maintainer_pruned_total",
+		"Number of pruned resources.", "stream", "type")
+
+	// BuildFailures counts product catalog builds that failed, while the
+	// remaining streams were still published.
+	BuildFailures = NewCounterVec("simplestream_maintainer_build_failures_total",
+		"Number of failed product catalog builds.", "stream")
+
+	// BuildDuration observes durations of product catalog builds.
+	BuildDuration = NewHistogramVec("simplestream_maintainer_build_duration_seconds",
+		"Duration of product catalog builds in seconds.", nil, "stream")
+)
+
+// Metrics of the server.
+var (
+	// StreamRequests counts requests for the stream metadata by the stream
+	// version and the endpoint (index, catalog, webpage, products, or deltas).
+	StreamRequests = NewCounterVec("simplestream_maintainer_stream_requests_total",
+		"Number of requests for the stream metadata.", "stream_version", "endpoint")
+)
+
+func init() {
+	DefaultRegistry.Register(
+		VersionsAdded,
+		DeltasGenerated,
+		HashBytes,
+		ChecksumMismatches,
+		SmokeTestFailures,
+		Pruned,
+		BuildFailures,
+		BuildDuration,
+		StreamRequests,
+	)
+}
@@ -0,0 +1,51 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Matrix sends the summary as a text message to the Matrix room.
+type Matrix struct {
+	homeserver  string
+	roomID      string
+	accessToken string
+	client      *http.Client
+}
+
+// NewMatrix returns the notifier sending messages to the given room on behalf
+// of the user with the given access token.
+func NewMatrix(homeserver string, roomID string, accessToken string) *Matrix {
+	return &Matrix{
+		homeserver:  strings.TrimSuffix(homeserver, "/"),
+		roomID:      roomID,
+		accessToken: accessToken,
+		client:      &http.Client{},
+	}
+}
+
+// Notify implements Notifier.
+func (m *Matrix) Notify(ctx context.Context, summary Summary) error {
+	// Transaction ID makes the request idempotent, so it only has to be
+	// unique among the messages sent with the same access token.
+	txnID := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	u := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s", m.homeserver, url.PathEscape(m.roomID), txnID)
+
+	body := map[string]string{
+		"msgtype": "m.text",
+		"body":    summary.Text(),
+	}
+
+	err := sendJSON(ctx, m.client, http.MethodPut, u, m.accessToken, body)
+	if err != nil {
+		return fmt.Errorf("Failed to send Matrix notification: %w", err)
+	}
+
+	return nil
+}
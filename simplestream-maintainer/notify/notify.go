@@ -0,0 +1,201 @@
+// Package notify sends summaries of failed builds to chat rooms and mailboxes.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/config"
+)
+
+// Failure is a single failed operation of a build.
+type Failure struct {
+	// Stream is the name of the stream in which the operation failed.
+	Stream string
+
+	// Product and Version identify the processed product version. Item is
+	// set if the operation failed on a single item (for example, a delta
+	// file) of the version.
+	Product string
+	Version string
+	Item    string
+
+	// Error describes why the operation failed.
+	Error string
+}
+
+// String returns the failure in a human readable form.
+func (f Failure) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Stream %q", f.Stream)
+
+	if f.Product != "" {
+		fmt.Fprintf(&b, ", product %q", f.Product)
+	}
+
+	if f.Version != "" {
+		fmt.Fprintf(&b, ", version %q", f.Version)
+	}
+
+	if f.Item != "" {
+		fmt.Fprintf(&b, ", item %q", f.Item)
+	}
+
+	return b.String() + ": " + f.Error
+}
+
+// Summary is the summary of a build that finished with errors.
+type Summary struct {
+	// StreamVersion is the stream version that was built.
+	StreamVersion string
+
+	// Failures contains the failed operations, which did not prevent the
+	// build from finishing.
+	Failures []Failure
+
+	// Skipped contains the product versions that were skipped by the
+	// build, along with the reason (e.g. an invalid image config).
+	Skipped []Failure
+
+	// Error is the error with which the build failed, or empty if the
+	// build finished.
+	Error string
+}
+
+// Subject returns the one line summary.
+func (s Summary) Subject() string {
+	if s.Error != "" {
+		return fmt.Sprintf("Build of stream version %q failed", s.StreamVersion)
+	}
+
+	if len(s.Skipped) > 0 {
+		return fmt.Sprintf("Build of stream version %q finished with %d errors and %d skipped versions", s.StreamVersion, len(s.Failures), len(s.Skipped))
+	}
+
+	return fmt.Sprintf("Build of stream version %q finished with %d errors", s.StreamVersion, len(s.Failures))
+}
+
+// Text returns the subject followed by the build error, the list of the
+// failed operations, and the list of the skipped versions.
+func (s Summary) Text() string {
+	var b strings.Builder
+
+	b.WriteString(s.Subject())
+	b.WriteString("\n")
+
+	if s.Error != "" {
+		b.WriteString("\n")
+		b.WriteString(s.Error)
+		b.WriteString("\n")
+	}
+
+	if len(s.Failures) > 0 {
+		b.WriteString("\n")
+	}
+
+	for _, f := range s.Failures {
+		b.WriteString("- ")
+		b.WriteString(f.String())
+		b.WriteString("\n")
+	}
+
+	if len(s.Skipped) > 0 {
+		b.WriteString("\nSkipped versions:\n")
+	}
+
+	for _, f := range s.Skipped {
+		b.WriteString("- ")
+		b.WriteString(f.String())
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+// Notifier sends the summary of a failed build.
+type Notifier interface {
+	Notify(ctx context.Context, summary Summary) error
+}
+
+// New returns the notifier that sends the summary to each notifier from the
+// given configuration, or nil if none is configured.
+func New(conf config.NotificationsConfig) Notifier {
+	var notifiers multiNotifier
+
+	if conf.Slack != nil {
+		notifiers = append(notifiers, NewSlack(conf.Slack.WebhookURL))
+	}
+
+	if conf.Matrix != nil {
+		notifiers = append(notifiers, NewMatrix(conf.Matrix.Homeserver, conf.Matrix.RoomID, conf.Matrix.AccessToken))
+	}
+
+	if conf.SMTP != nil {
+		notifiers = append(notifiers, NewSMTP(conf.SMTP.Address, conf.SMTP.Username, conf.SMTP.Password, conf.SMTP.From, conf.SMTP.To))
+	}
+
+	if len(notifiers) == 0 {
+		return nil
+	}
+
+	return notifiers
+}
+
+// multiNotifier sends the summary to each of the notifiers, even if some of
+// them fail.
+type multiNotifier []Notifier
+
+// Notify implements Notifier.
+func (m multiNotifier) Notify(ctx context.Context, summary Summary) error {
+	var errs []error
+
+	for _, n := range m {
+		err := n.Notify(ctx, summary)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// sendJSON sends the given body encoded as JSON and ensures the request
+// succeeded.
+func sendJSON(ctx context.Context, client *http.Client, method string, url string, token string, body any) error {
+	content, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Unexpected response status %q: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return nil
+}
@@ -0,0 +1,218 @@
+package notify_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/config"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/notify"
+)
+
+var summary = notify.Summary{
+	StreamVersion: "v1",
+	Failures: []notify.Failure{
+		{Stream: "images", Product: "ubuntu:noble:amd64:cloud", Version: "20240101_0000", Error: `Checksum mismatch of item "disk.qcow2"`},
+		{Stream: "images", Product: "ubuntu:noble:amd64:cloud", Version: "20240102_0000", Item: "disk.20240101_0000.qcow2.vcdiff", Error: "Encoder failed"},
+	},
+}
+
+func TestSummary(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, strings.Join([]string{
+		`Build of stream version "v1" finished with 2 errors`,
+		``,
+		`- Stream "images", product "ubuntu:noble:amd64:cloud", version "20240101_0000": Checksum mismatch of item "disk.qcow2"`,
+		`- Stream "images", product "ubuntu:noble:amd64:cloud", version "20240102_0000", item "disk.20240101_0000.qcow2.vcdiff": Encoder failed`,
+		``,
+	}, "\n"), summary.Text())
+
+	failed := notify.Summary{StreamVersion: "v1", Error: "Failed to lock streams"}
+	require.Equal(t, `Build of stream version "v1" failed`, failed.Subject())
+	require.Equal(t, "Build of stream version \"v1\" failed\n\nFailed to lock streams\n", failed.Text())
+
+	skipped := notify.Summary{
+		StreamVersion: "v1",
+		Skipped: []notify.Failure{
+			{Stream: "images", Product: "ubuntu:noble:amd64:cloud", Version: "20240103_0000", Error: "Product version has invalid image config"},
+		},
+	}
+
+	require.Equal(t, `Build of stream version "v1" finished with 0 errors and 1 skipped versions`, skipped.Subject())
+	require.Equal(t, strings.Join([]string{
+		`Build of stream version "v1" finished with 0 errors and 1 skipped versions`,
+		``,
+		`Skipped versions:`,
+		`- Stream "images", product "ubuntu:noble:amd64:cloud", version "20240103_0000": Product version has invalid image config`,
+		``,
+	}, "\n"), skipped.Text())
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	require.Nil(t, notify.New(config.NotificationsConfig{}))
+	require.NotNil(t, notify.New(config.NotificationsConfig{Slack: &config.SlackConfig{WebhookURL: "http://localhost"}}))
+}
+
+func TestSlack(t *testing.T) {
+	t.Parallel()
+
+	var text string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]string{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil || r.Method != http.MethodPost {
+			http.Error(w, "invalid_payload", http.StatusBadRequest)
+			return
+		}
+
+		text = body["text"]
+	}))
+	defer server.Close()
+
+	err := notify.NewSlack(server.URL).Notify(context.Background(), summary)
+	require.NoError(t, err)
+	require.Contains(t, text, summary.Text())
+
+	// Ensure rejected requests are reported.
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no_service", http.StatusNotFound)
+	}))
+	defer failing.Close()
+
+	err = notify.NewSlack(failing.URL).Notify(context.Background(), summary)
+	require.ErrorContains(t, err, "no_service")
+}
+
+func TestMatrix(t *testing.T) {
+	t.Parallel()
+
+	var path string
+	var auth string
+	var body map[string]string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		path = r.URL.EscapedPath()
+		auth = r.Header.Get("Authorization")
+
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"event_id":"$1"}`))
+	}))
+	defer server.Close()
+
+	err := notify.NewMatrix(server.URL+"/", "!builds:example.com", "secret").Notify(context.Background(), summary)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(path, "/_matrix/client/v3/rooms/%21builds:example.com/send/m.room.message/"), path)
+	require.Equal(t, "Bearer secret", auth)
+	require.Equal(t, "m.text", body["msgtype"])
+	require.Equal(t, summary.Text(), body["body"])
+}
+
+func TestSMTP(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	type mail struct {
+		from string
+		to   []string
+		data string
+	}
+
+	mails := make(chan mail, 1)
+
+	// Serve a single session of a minimal SMTP server without TLS and
+	// authentication.
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		tp := textproto.NewConn(conn)
+		_ = tp.PrintfLine("220 localhost ESMTP")
+
+		var m mail
+
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+
+			cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+			switch cmd {
+			case "EHLO", "HELO":
+				_ = tp.PrintfLine("250 localhost")
+			case "MAIL":
+				m.from = strings.TrimPrefix(line, "MAIL FROM:")
+				_ = tp.PrintfLine("250 OK")
+			case "RCPT":
+				m.to = append(m.to, strings.TrimPrefix(line, "RCPT TO:"))
+				_ = tp.PrintfLine("250 OK")
+			case "DATA":
+				_ = tp.PrintfLine("354 Go ahead")
+
+				data, err := tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+
+				m.data = string(data)
+				_ = tp.PrintfLine("250 OK")
+			case "QUIT":
+				_ = tp.PrintfLine("221 Bye")
+				mails <- m
+				return
+			default:
+				_ = tp.PrintfLine("502 Not implemented")
+			}
+		}
+	}()
+
+	n := notify.NewSMTP(listener.Addr().String(), "", "", "builds@example.com", []string{"ops@example.com", "dev@example.com"})
+
+	err = n.Notify(context.Background(), summary)
+	require.NoError(t, err)
+
+	m := <-mails
+	require.Equal(t, "<builds@example.com>", m.from)
+	require.Equal(t, []string{"<ops@example.com>", "<dev@example.com>"}, m.to)
+
+	header, content, ok := strings.Cut(m.data, "\n\n")
+	require.True(t, ok)
+	require.Contains(t, header, `Subject: Build of stream version "v1" finished with 2 errors`)
+	require.Contains(t, header, "To: ops@example.com, dev@example.com")
+	require.Equal(t, summary.Text(), content)
+
+	// Ensure unreachable servers are reported.
+	listener.Close()
+
+	err = n.Notify(context.Background(), summary)
+	require.ErrorContains(t, err, "Failed to send email notification")
+}
@@ -0,0 +1,35 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Slack posts the summary to the Slack incoming webhook.
+type Slack struct {
+	webhookURL string
+	client     *http.Client
+}
+
+// NewSlack returns the notifier posting to the given incoming webhook.
+func NewSlack(webhookURL string) *Slack {
+	return &Slack{
+		webhookURL: webhookURL,
+		client:     &http.Client{},
+	}
+}
+
+// Notify implements Notifier.
+func (s *Slack) Notify(ctx context.Context, summary Summary) error {
+	body := map[string]string{
+		"text": "```\n" + summary.Text() + "```",
+	}
+
+	err := sendJSON(ctx, s.client, http.MethodPost, s.webhookURL, "", body)
+	if err != nil {
+		return fmt.Errorf("Failed to send Slack notification: %w", err)
+	}
+
+	return nil
+}
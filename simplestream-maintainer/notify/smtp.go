@@ -0,0 +1,134 @@
+package notify
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTP sends the summary by email.
+type SMTP struct {
+	address  string
+	username string
+	password string
+	from     string
+	to       []string
+}
+
+// NewSMTP returns the notifier sending emails through the SMTP server on the
+// given address. If the username is empty, emails are sent without
+// authentication.
+func NewSMTP(address string, username string, password string, from string, to []string) *SMTP {
+	return &SMTP{
+		address:  address,
+		username: username,
+		password: password,
+		from:     from,
+		to:       to,
+	}
+}
+
+// Notify implements Notifier.
+func (s *SMTP) Notify(ctx context.Context, summary Summary) error {
+	err := s.send(ctx, summary)
+	if err != nil {
+		return fmt.Errorf("Failed to send email notification: %w", err)
+	}
+
+	return nil
+}
+
+// send delivers the email with the given summary. The connection is upgraded
+// to TLS if the server supports STARTTLS.
+func (s *SMTP) send(ctx context.Context, summary Summary) error {
+	host, _, err := net.SplitHostPort(s.address)
+	if err != nil {
+		return err
+	}
+
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return err
+	}
+
+	// The SMTP client does not support contexts, hence the whole
+	// conversation is bounded by the deadline of the context.
+	deadline, ok := ctx.Deadline()
+	if ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	defer client.Close()
+
+	ok, _ = client.Extension("STARTTLS")
+	if ok {
+		err = client.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.username != "" {
+		err = client.Auth(smtp.PlainAuth("", s.username, s.password, host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = client.Mail(s.from)
+	if err != nil {
+		return err
+	}
+
+	for _, to := range s.to {
+		err = client.Rcpt(to)
+		if err != nil {
+			return err
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(s.message(summary))
+	if err != nil {
+		return err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// message returns the email with the given summary.
+func (s *SMTP) message(summary Summary) []byte {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "From: %s\r\n", s.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", summary.Subject())
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(summary.Text(), "\n", "\r\n"))
+
+	return []byte(b.String())
+}
@@ -0,0 +1,251 @@
+package pool
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// DefaultTuneInterval is the default interval in which the adaptive pool
+// measures the throughput and adjusts the number of workers.
+const DefaultTuneInterval = 2 * time.Second
+
+// Pool runs submitted jobs concurrently while limiting the number of jobs
+// running at the same time.
+//
+// The limit is either fixed, or tuned automatically based on the measured
+// throughput of completed jobs. When the throughput increases with more
+// workers (e.g. jobs are CPU bound), the limit is raised. When it stops
+// increasing or drops (e.g. jobs are disk bound and compete for IO), the
+// limit is lowered.
+type Pool struct {
+	ctx  context.Context
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	limit     int
+	maxLimit  int
+	active    int
+	completed int64
+
+	stop       chan struct{}
+	once       sync.Once
+	stopNotify func() bool
+}
+
+// New returns a pool that runs at most the given number of jobs at the same
+// time. The limit is raised to 1 if lower.
+func New(ctx context.Context, workers int) *Pool {
+	workers = max(workers, 1)
+
+	p := &Pool{
+		ctx:      ctx,
+		limit:    workers,
+		maxLimit: workers,
+		stop:     make(chan struct{}),
+	}
+
+	p.cond = sync.NewCond(&p.mu)
+
+	// Wake up the blocked submitters when the context is cancelled, so
+	// that their jobs are discarded.
+	p.stopNotify = context.AfterFunc(ctx, func() {
+		p.mu.Lock()
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	})
+
+	return p
+}
+
+// NewAdaptive returns a pool that automatically tunes the number of jobs
+// running at the same time between 1 and maxWorkers. Throughput is measured
+// and the limit is adjusted on each tuneInterval. If tuneInterval is not
+// positive, DefaultTuneInterval is used.
+func NewAdaptive(ctx context.Context, maxWorkers int, tuneInterval time.Duration) *Pool {
+	maxWorkers = max(maxWorkers, 1)
+
+	if tuneInterval <= 0 {
+		tuneInterval = DefaultTuneInterval
+	}
+
+	p := New(ctx, 1)
+	p.maxLimit = maxWorkers
+
+	if maxWorkers > 1 {
+		go p.tune(tuneInterval)
+	}
+
+	return p
+}
+
+// Limit returns the current maximum number of concurrent jobs.
+func (p *Pool) Limit() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.limit
+}
+
+// Submit blocks until a worker is available and runs the job in it. If the
+// pool context is cancelled, the job is discarded.
+func (p *Pool) Submit(job func()) {
+	p.submit(job)
+}
+
+// submit runs the job once a worker is available, and returns false if the
+// job is discarded.
+func (p *Pool) submit(job func()) bool {
+	p.mu.Lock()
+	for p.active >= p.limit && p.ctx.Err() == nil {
+		p.cond.Wait()
+	}
+
+	if p.ctx.Err() != nil {
+		p.mu.Unlock()
+		return false
+	}
+
+	p.active++
+	p.mu.Unlock()
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		job()
+
+		p.mu.Lock()
+		p.active--
+		p.completed++
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	}()
+
+	return true
+}
+
+// Wait blocks until all submitted jobs are completed.
+func (p *Pool) Wait() {
+	p.wg.Wait()
+}
+
+// Close waits for the submitted jobs to complete and stops the tuning of an
+// adaptive pool.
+func (p *Pool) Close() {
+	p.Wait()
+	p.once.Do(func() {
+		p.stopNotify()
+		close(p.stop)
+	})
+}
+
+// Group returns a new group of jobs run by the pool.
+func (p *Pool) Group() *Group {
+	return &Group{pool: p}
+}
+
+// Group is a set of jobs that share the workers of the pool with other groups,
+// while they are waited for separately.
+type Group struct {
+	pool *Pool
+	wg   sync.WaitGroup
+}
+
+// Submit blocks until a worker of the pool is available and runs the job in
+// it. If the pool context is cancelled, the job is discarded.
+func (g *Group) Submit(job func()) {
+	g.wg.Add(1)
+
+	ok := g.pool.submit(func() {
+		defer g.wg.Done()
+		job()
+	})
+	if !ok {
+		g.wg.Done()
+	}
+}
+
+// Wait blocks until all jobs submitted to the group are completed.
+func (g *Group) Wait() {
+	g.wg.Wait()
+}
+
+// tune periodically measures the number of jobs completed per second and
+// adjusts the limit accordingly until the pool is closed.
+func (p *Pool) tune(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastCompleted int64
+	var lastThroughput float64
+	lastTime := time.Now()
+	direction := 1
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-p.ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.mu.Lock()
+			completed := p.completed
+			busy := p.active > 0
+			p.mu.Unlock()
+
+			throughput := float64(completed-lastCompleted) / now.Sub(lastTime).Seconds()
+			lastCompleted = completed
+			lastTime = now
+
+			// Do not tune while the pool is idle, as there is nothing
+			// to measure.
+			if !busy && throughput == 0 {
+				continue
+			}
+
+			p.mu.Lock()
+			oldLimit := p.limit
+			p.limit, direction = nextLimit(p.limit, p.maxLimit, direction, throughput, lastThroughput)
+			newLimit := p.limit
+			p.cond.Broadcast()
+			p.mu.Unlock()
+
+			lastThroughput = throughput
+
+			if newLimit != oldLimit {
+				slog.Debug("Adjusted number of workers", "workers", newLimit, "throughput", throughput)
+			}
+		}
+	}
+}
+
+// nextLimit returns the new limit and the direction of the next adjustment
+// based on the throughput measured with the current limit compared to the
+// previously measured throughput.
+//
+// The limit keeps moving in the same direction while the throughput improves
+// by at least 5%. Otherwise, the direction is reversed. This way, the limit
+// converges to the number of workers where adding more of them no longer
+// increases the throughput.
+func nextLimit(limit int, maxLimit int, direction int, throughput float64, lastThroughput float64) (int, int) {
+	if throughput < lastThroughput*1.05 {
+		direction = -direction
+	}
+
+	limit += direction
+
+	if limit < 1 {
+		limit = 1
+		direction = 1
+	}
+
+	if limit > maxLimit {
+		limit = maxLimit
+		direction = -1
+	}
+
+	return limit, direction
+}
@@ -0,0 +1,194 @@
+package pool
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool(t *testing.T) {
+	t.Parallel()
+
+	p := New(context.Background(), 3)
+	defer p.Close()
+
+	var running atomic.Int32
+	var peak atomic.Int32
+	var done atomic.Int32
+
+	for i := 0; i < 20; i++ {
+		p.Submit(func() {
+			n := running.Add(1)
+			defer running.Add(-1)
+
+			for {
+				old := peak.Load()
+				if n <= old || peak.CompareAndSwap(old, n) {
+					break
+				}
+			}
+
+			time.Sleep(5 * time.Millisecond)
+			done.Add(1)
+		})
+	}
+
+	p.Wait()
+
+	require.Equal(t, int32(20), done.Load())
+	require.LessOrEqual(t, peak.Load(), int32(3))
+}
+
+func TestPool_Cancelled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	p := New(ctx, 1)
+	defer p.Close()
+
+	release := make(chan struct{})
+	p.Submit(func() { <-release })
+
+	// Submitter is blocked until the context is cancelled, after which
+	// the job is discarded.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	var ran atomic.Bool
+	p.Submit(func() { ran.Store(true) })
+
+	close(release)
+	p.Wait()
+
+	require.False(t, ran.Load())
+}
+
+func TestPool_Group(t *testing.T) {
+	t.Parallel()
+
+	p := New(context.Background(), 2)
+	defer p.Close()
+
+	// Job of the other group keeps running, while the jobs of the first
+	// group share the remaining worker.
+	release := make(chan struct{})
+	other := p.Group()
+	other.Submit(func() { <-release })
+
+	var done atomic.Int32
+	group := p.Group()
+	for i := 0; i < 5; i++ {
+		group.Submit(func() { done.Add(1) })
+	}
+
+	// Group is waited for without waiting for the other group.
+	group.Wait()
+	require.Equal(t, int32(5), done.Load())
+
+	close(release)
+	other.Wait()
+}
+
+func TestPool_Adaptive(t *testing.T) {
+	t.Parallel()
+
+	p := NewAdaptive(context.Background(), 4, 10*time.Millisecond)
+	defer p.Close()
+
+	require.Equal(t, 1, p.Limit())
+
+	// Jobs that only wait scale with the number of workers, therefore
+	// the limit should be raised.
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Limit() < 2 && time.Now().Before(deadline) {
+		p.Submit(func() { time.Sleep(time.Millisecond) })
+	}
+
+	p.Wait()
+
+	require.GreaterOrEqual(t, p.Limit(), 2)
+	require.LessOrEqual(t, p.Limit(), 4)
+}
+
+func TestNextLimit(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Name           string
+		Limit          int
+		Direction      int
+		Throughput     float64
+		LastThroughput float64
+		WantLimit      int
+		WantDirection  int
+	}{
+		{
+			Name:           "Throughput improved",
+			Limit:          2,
+			Direction:      1,
+			Throughput:     20,
+			LastThroughput: 10,
+			WantLimit:      3,
+			WantDirection:  1,
+		},
+		{
+			Name:           "Throughput dropped",
+			Limit:          4,
+			Direction:      1,
+			Throughput:     8,
+			LastThroughput: 10,
+			WantLimit:      3,
+			WantDirection:  -1,
+		},
+		{
+			Name:           "Throughput improved after lowering the limit",
+			Limit:          3,
+			Direction:      -1,
+			Throughput:     12,
+			LastThroughput: 10,
+			WantLimit:      2,
+			WantDirection:  -1,
+		},
+		{
+			Name:           "Throughput did not improve enough",
+			Limit:          3,
+			Direction:      1,
+			Throughput:     10.2,
+			LastThroughput: 10,
+			WantLimit:      2,
+			WantDirection:  -1,
+		},
+		{
+			Name:           "Lower bound",
+			Limit:          1,
+			Direction:      -1,
+			Throughput:     12,
+			LastThroughput: 10,
+			WantLimit:      1,
+			WantDirection:  1,
+		},
+		{
+			Name:           "Upper bound",
+			Limit:          8,
+			Direction:      1,
+			Throughput:     20,
+			LastThroughput: 10,
+			WantLimit:      8,
+			WantDirection:  -1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			limit, direction := nextLimit(test.Limit, 8, test.Direction, test.Throughput, test.LastThroughput)
+			require.Equal(t, test.WantLimit, limit)
+			require.Equal(t, test.WantDirection, direction)
+		})
+	}
+}
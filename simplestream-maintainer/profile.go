@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+// startProfiling starts writing the CPU profile and the execution trace to
+// the given files. Empty path disables the corresponding output. Returned
+// function stops profiling and closes the files.
+func startProfiling(cpuProfilePath string, tracePath string) (stop func() error, err error) {
+	var stops []func() error
+
+	stop = func() error {
+		var errs []error
+
+		// Stop in reverse order.
+		for i := len(stops) - 1; i >= 0; i-- {
+			errs = append(errs, stops[i]())
+		}
+
+		stops = nil
+		return errors.Join(errs...)
+	}
+
+	defer func() {
+		if err != nil {
+			_ = stop()
+		}
+	}()
+
+	if cpuProfilePath != "" {
+		f, err := os.Create(cpuProfilePath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create CPU profile: %w", err)
+		}
+
+		err = pprof.StartCPUProfile(f)
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("Failed to start CPU profile: %w", err)
+		}
+
+		stops = append(stops, func() error {
+			pprof.StopCPUProfile()
+			return f.Close()
+		})
+
+		slog.Debug("CPU profiling started", "path", cpuProfilePath)
+	}
+
+	if tracePath != "" {
+		f, err := os.Create(tracePath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create execution trace: %w", err)
+		}
+
+		err = trace.Start(f)
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("Failed to start execution trace: %w", err)
+		}
+
+		stops = append(stops, func() error {
+			trace.Stop()
+			return f.Close()
+		})
+
+		slog.Debug("Execution tracing started", "path", tracePath)
+	}
+
+	return stop, nil
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessList allows or denies requests based on the client's address.
+type AccessList struct {
+	// Allow contains the networks from which requests are allowed. If
+	// empty, requests from any network are allowed unless denied.
+	Allow []netip.Prefix
+
+	// Deny contains the networks from which requests are denied. Deny
+	// takes precedence over Allow.
+	Deny []netip.Prefix
+}
+
+// allows returns true if requests from the given address are allowed.
+func (l AccessList) allows(addr netip.Addr) bool {
+	contains := func(p netip.Prefix) bool {
+		return p.Contains(addr)
+	}
+
+	if slices.ContainsFunc(l.Deny, contains) {
+		return false
+	}
+
+	return len(l.Allow) == 0 || slices.ContainsFunc(l.Allow, contains)
+}
+
+// RateLimit limits the rate of requests of each client from the given
+// networks.
+type RateLimit struct {
+	// Networks to which the limit applies.
+	Networks []netip.Prefix
+
+	// Rate is the number of requests per second allowed for each client,
+	// and Burst is the number of requests that can be made at once.
+	Rate  float64
+	Burst int
+}
+
+// isAdminPath returns true if the request path belongs to the administrative
+// routes (jobs API and metrics), which are subject to the admin access list.
+func isAdminPath(p string) bool {
+	return strings.HasPrefix(p, jobsPathPrefix) || p == "/metrics"
+}
+
+// clientAddr returns the address of the request's client. IPv4 addresses
+// mapped to IPv6 are converted to IPv4.
+func clientAddr(r *http.Request) (netip.Addr, bool) {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		addr, err := netip.ParseAddr(r.RemoteAddr)
+		if err != nil {
+			return netip.Addr{}, false
+		}
+
+		return addr.Unmap(), true
+	}
+
+	return addrPort.Addr().Unmap(), true
+}
+
+// withAccess ensures requests are made from the allowed networks. Requests on
+// administrative routes are checked against the admin list, and the others
+// against the downloads list. Denied requests are rejected with 403.
+func withAccess(downloads AccessList, admin AccessList) Middleware {
+	return func(next http.Handler) http.Handler {
+		if len(downloads.Allow)+len(downloads.Deny)+len(admin.Allow)+len(admin.Deny) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			list := downloads
+			if isAdminPath(r.URL.Path) {
+				list = admin
+			}
+
+			addr, ok := clientAddr(r)
+			if !ok || !list.allows(addr) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimiter limits the rate of requests per client using token buckets.
+type rateLimiter struct {
+	limits []RateLimit
+	now    func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[netip.Addr]*tokenBucket
+	lastSweep time.Time
+}
+
+// tokenBucket holds the tokens of a single client.
+type tokenBucket struct {
+	limit   *RateLimit
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(limits []RateLimit) *rateLimiter {
+	return &rateLimiter{
+		limits:  limits,
+		now:     time.Now,
+		buckets: make(map[netip.Addr]*tokenBucket),
+	}
+}
+
+// limitFor returns the first rate limit whose networks contain the address,
+// or nil if no limit applies.
+func (l *rateLimiter) limitFor(addr netip.Addr) *RateLimit {
+	for i, limit := range l.limits {
+		for _, network := range limit.Networks {
+			if network.Contains(addr) {
+				return &l.limits[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+// allow takes a token from the client's bucket. If the bucket is empty, it
+// returns false along with the time after which the next token is available.
+func (l *rateLimiter) allow(addr netip.Addr) (bool, time.Duration) {
+	limit := l.limitFor(addr)
+	if limit == nil {
+		return true, 0
+	}
+
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	bucket, ok := l.buckets[addr]
+	if !ok {
+		bucket = &tokenBucket{limit: limit, tokens: float64(limit.Burst), updated: now}
+		l.buckets[addr] = bucket
+	}
+
+	bucket.refill(now)
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / limit.Rate * float64(time.Second))
+	}
+
+	bucket.tokens--
+	return true, 0
+}
+
+// sweep removes the buckets that are full again, as they are equivalent to
+// new ones. Buckets are swept at most once per minute.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+
+	l.lastSweep = now
+
+	for addr, bucket := range l.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= float64(bucket.limit.Burst) {
+			delete(l.buckets, addr)
+		}
+	}
+}
+
+// refill adds the tokens accumulated since the last update.
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.Rate)
+		b.updated = now
+	}
+}
+
+// withRateLimit rejects requests of the clients that exceed their rate limit
+// with 429 and the Retry-After header.
+func withRateLimit(limiter *rateLimiter) Middleware {
+	return func(next http.Handler) http.Handler {
+		if limiter == nil || len(limiter.limits) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addr, ok := clientAddr(r)
+			if ok {
+				allowed, retryAfter := limiter.allow(addr)
+				if !allowed {
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+					http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
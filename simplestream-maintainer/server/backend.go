@@ -0,0 +1,209 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+)
+
+// isMetadata returns true if the file with the given name is part of the
+// stream metadata (index, product catalogs, and the web page), which is
+// always served by the server itself.
+func isMetadata(name string) bool {
+	return strings.HasPrefix(name, "streams/") || !strings.Contains(name, "/")
+}
+
+// backendHandler returns a handler that serves files from the storage backend.
+// If the backend supports pre-signed URLs, requests for image files are
+// redirected to the URLs that are valid for the given duration, so that the
+// content is downloaded directly from the storage. Stream metadata is served
+// by the handler along with the caching headers set by the given cache, and
+// conditional requests for it are answered without the content. Single byte
+// ranges are supported for the proxied files, so that interrupted downloads
+// can be resumed. Directory listings are not supported.
+func backendHandler(b storage.Backend, urlTTL time.Duration, cache *httpCache) http.Handler {
+	presigner, canPresign := b.(storage.Presigner)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !methodAllowed(w, r) {
+			return
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if isHidden(name) {
+			http.NotFound(w, r)
+			return
+		}
+
+		info, err := b.Stat(name)
+		if err == nil && info.IsDir() {
+			// Serve the web page in place of the directory.
+			name = path.Join(name, "index.html")
+			info, err = b.Stat(name)
+		}
+
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				slog.Error("Failed to get file info", "path", name, "error", err)
+				http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+				return
+			}
+
+			http.NotFound(w, r)
+			return
+		}
+
+		if canPresign && !isMetadata(name) {
+			url, err := presigner.PresignURL(name, urlTTL)
+			if err != nil {
+				slog.Error("Failed to pre-sign URL", "path", name, "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+
+			// Prevent caching of the redirect beyond the URL lifetime.
+			w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(urlTTL.Seconds())/2))
+			http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+			return
+		}
+
+		contentType := contentType(name)
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+		w.Header().Set("Accept-Ranges", "bytes")
+
+		etag := cache.setHeaders(w, name, info)
+		if notModified(w, r, etag, info.ModTime()) {
+			return
+		}
+
+		start, length, ok := parseRange(r, etag, info.Size())
+		if !ok {
+			w.Header().Del("Content-Type")
+			w.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(info.Size(), 10))
+			http.Error(w, http.StatusText(http.StatusRequestedRangeNotSatisfiable), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		status := http.StatusOK
+		if length < info.Size() {
+			status = http.StatusPartialContent
+			w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, info.Size()))
+		}
+
+		if r.Method == http.MethodHead {
+			w.WriteHeader(status)
+			return
+		}
+
+		f, err := b.Open(name)
+		if err != nil {
+			slog.Error("Failed to open file", "path", name, "error", err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+
+		defer f.Close()
+
+		err = skip(f, start)
+		if err != nil {
+			slog.Error("Failed to seek file", "path", name, "error", err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+
+		w.WriteHeader(status)
+
+		_, err = io.CopyN(w, f, length)
+		if err != nil {
+			// Headers are already sent, so only log the error.
+			slog.Warn("Failed to serve file", "path", name, "error", err)
+		}
+	})
+}
+
+// parseRange returns the start and length of the content requested by the
+// Range header of the request. The whole content is returned if the header is
+// not set, requests multiple ranges, or the If-Range precondition does not
+// match the given entity tag. False is returned if the range cannot be
+// satisfied.
+func parseRange(r *http.Request, etag string, size int64) (start int64, length int64, ok bool) {
+	header := r.Header.Get("Range")
+	if header == "" || strings.Contains(header, ",") {
+		return 0, size, true
+	}
+
+	ifRange := r.Header.Get("If-Range")
+	if ifRange != "" && (etag == "" || ifRange != etag) {
+		return 0, size, true
+	}
+
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found {
+		return 0, size, true
+	}
+
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	if first == "" {
+		// Suffix range requests the last bytes of the content.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+
+		n = min(n, size)
+		return size - n, n, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+
+		end = min(end, size-1)
+	}
+
+	return start, end - start + 1, true
+}
+
+// skip advances the reader by the given number of bytes, seeking if the
+// reader supports it.
+func skip(r io.Reader, n int64) error {
+	if n == 0 {
+		return nil
+	}
+
+	seeker, ok := r.(io.Seeker)
+	if ok {
+		_, err := seeker.Seek(n, io.SeekStart)
+		return err
+	}
+
+	_, err := io.CopyN(io.Discard, r, n)
+	return err
+}
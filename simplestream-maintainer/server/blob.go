@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// blobPathPrefix is the URL path prefix of the content-addressed items.
+const blobPathPrefix = "/blob/sha256/"
+
+// blobHandler serves items referenced from the product catalogs by their
+// SHA256 hash. Requests are served by the files handler as if they were made
+// for the path of the item with the given hash. The lookup table is rebuilt
+// whenever the product catalogs change.
+type blobHandler struct {
+	catalogs catalogSource
+	files    http.Handler
+
+	mu         sync.Mutex
+	generation int
+	paths      map[string]string
+}
+
+// newBlobHandler returns a handler that serves items from the cached product
+// catalogs by their SHA256 hash using the given files handler.
+func newBlobHandler(catalogs catalogSource, files http.Handler) *blobHandler {
+	return &blobHandler{
+		catalogs: catalogs,
+		files:    files,
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *blobHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !methodAllowed(w, r) {
+		return
+	}
+
+	hash := strings.ToLower(strings.TrimPrefix(r.URL.Path, blobPathPrefix))
+
+	_, err := hex.DecodeString(hash)
+	if err != nil || len(hash) != 64 {
+		http.NotFound(w, r)
+		return
+	}
+
+	paths, err := h.lookup()
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+
+		slog.Error("Failed to read product catalogs", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	itemPath, ok := paths[hash]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Content of the content-addressed URL never changes.
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", `"`+hash+`"`)
+
+	req := r.Clone(r.Context())
+	req.URL.Path = "/" + itemPath
+	req.URL.RawPath = ""
+
+	h.files.ServeHTTP(w, req)
+}
+
+// lookup returns the map of item paths by their SHA256 hashes. The map is
+// rebuilt only if the product catalogs changed since it was last built.
+func (h *blobHandler) lookup() (map[string]string, error) {
+	snapshot, err := h.catalogs.get()
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.paths != nil && h.generation == snapshot.generation {
+		return h.paths, nil
+	}
+
+	paths := make(map[string]string)
+
+	for _, catalog := range snapshot.catalogs {
+		for _, p := range catalog.Products {
+			for _, v := range p.Versions {
+				for _, item := range v.Items {
+					if item.SHA256 != "" {
+						paths[item.SHA256] = item.Path
+					}
+				}
+			}
+		}
+	}
+
+	h.paths = paths
+	h.generation = snapshot.generation
+
+	slog.Debug("Rebuilt content-addressed item lookup", "items", len(paths))
+
+	return h.paths, nil
+}
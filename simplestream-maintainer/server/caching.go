@@ -0,0 +1,254 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+)
+
+// DefaultFileMaxAge is the default time for which clients and proxies may
+// cache the image files without revalidating them.
+const DefaultFileMaxAge = 24 * time.Hour
+
+// fileHash is the SHA256 hash of the file content along with the stamp of
+// the file from which it was calculated.
+type fileHash struct {
+	stamp fileStamp
+	hash  string
+}
+
+// httpCache sets the caching headers of the served files. ETags of the stream
+// metadata files are SHA256 hashes of their content, which are calculated
+// again only if the files change, and ETags of the image files are their
+// SHA256 hashes from the product catalogs.
+type httpCache struct {
+	b              storage.Backend
+	catalogs       catalogSource
+	metadataMaxAge time.Duration
+	fileMaxAge     time.Duration
+	private        bool
+
+	mu         sync.Mutex
+	hashes     map[string]fileHash
+	generation int
+	itemHashes map[string]string
+}
+
+// newHTTPCache returns the caching headers of the files from the storage
+// backend. Image files are looked up in the given product catalogs, which may
+// be nil. If private is true, responses may be cached only by the clients.
+func newHTTPCache(b storage.Backend, catalogs catalogSource, metadataMaxAge time.Duration, fileMaxAge time.Duration, private bool) *httpCache {
+	return &httpCache{
+		b:              b,
+		catalogs:       catalogs,
+		metadataMaxAge: metadataMaxAge,
+		fileMaxAge:     fileMaxAge,
+		private:        private,
+		hashes:         make(map[string]fileHash),
+	}
+}
+
+// cacheControl returns the Cache-Control header of the file with the given
+// name. Files whose maximum age is not positive must be revalidated on each
+// use.
+func (c *httpCache) cacheControl(name string) string {
+	scope := "public"
+	if c.private {
+		scope = "private"
+	}
+
+	maxAge := c.fileMaxAge
+	if isMetadata(name) {
+		maxAge = c.metadataMaxAge
+	}
+
+	if maxAge <= 0 {
+		return scope + ", no-cache"
+	}
+
+	return scope + ", max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+}
+
+// setHeaders sets the Cache-Control, ETag, and Last-Modified headers of the
+// given file and returns its ETag, which is empty if not known. Headers that
+// are already set (for example, by the blob handler) are kept.
+func (c *httpCache) setHeaders(w http.ResponseWriter, name string, info fs.FileInfo) string {
+	header := w.Header()
+
+	if header.Get("Cache-Control") == "" {
+		header.Set("Cache-Control", c.cacheControl(name))
+	}
+
+	if header.Get("ETag") == "" {
+		etag := c.etag(name, info)
+		if etag != "" {
+			header.Set("ETag", etag)
+		}
+	}
+
+	header.Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+
+	return header.Get("ETag")
+}
+
+// etag returns the ETag of the given file, or an empty string if it is not
+// known.
+func (c *httpCache) etag(name string, info fs.FileInfo) string {
+	var hash string
+
+	if isMetadata(name) {
+		var err error
+
+		hash, err = c.fileHash(name, info)
+		if err != nil {
+			slog.Debug("Failed to calculate file hash", "path", name, "error", err)
+			return ""
+		}
+	} else {
+		hash = c.itemHash(name)
+	}
+
+	if hash == "" {
+		return ""
+	}
+
+	return `"` + hash + `"`
+}
+
+// fileHash returns the SHA256 hash of the file content. The hash is
+// calculated again only if the size or the modification time of the file
+// changed.
+func (c *httpCache) fileHash(name string, info fs.FileInfo) (string, error) {
+	stamp := fileStamp{size: info.Size(), modTime: info.ModTime()}
+
+	c.mu.Lock()
+	cached, ok := c.hashes[name]
+	c.mu.Unlock()
+
+	if ok && cached.stamp == stamp {
+		return cached.hash, nil
+	}
+
+	f, err := c.b.Open(name)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	h := sha256.New()
+
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	c.mu.Lock()
+	c.hashes[name] = fileHash{stamp: stamp, hash: hash}
+	c.mu.Unlock()
+
+	return hash, nil
+}
+
+// itemHash returns the SHA256 hash of the item on the given path from the
+// product catalogs, or an empty string if the path is not an item. The lookup
+// table is rebuilt whenever the product catalogs change.
+func (c *httpCache) itemHash(name string) string {
+	if c.catalogs == nil {
+		return ""
+	}
+
+	snapshot, err := c.catalogs.get()
+	if err != nil {
+		return ""
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.itemHashes == nil || c.generation != snapshot.generation {
+		hashes := make(map[string]string)
+
+		for _, catalog := range snapshot.catalogs {
+			for _, p := range catalog.Products {
+				for _, v := range p.Versions {
+					for _, item := range v.Items {
+						if item.SHA256 != "" {
+							hashes[item.Path] = item.SHA256
+						}
+					}
+				}
+			}
+		}
+
+		c.itemHashes = hashes
+		c.generation = snapshot.generation
+	}
+
+	return c.itemHashes[name]
+}
+
+// contentETag returns the strong ETag of the given content.
+func contentETag(content []byte) string {
+	hash := sha256.Sum256(content)
+	return `"` + hex.EncodeToString(hash[:]) + `"`
+}
+
+// notModified returns true if the conditional request is satisfied by the
+// representation with the given ETag and modification time, in which case
+// the 304 response is written. If-None-Match takes precedence over
+// If-Modified-Since, and is compared weakly, so that the ETags of compressed
+// responses also match.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modTime time.Time) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	match := false
+
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	ifModifiedSince := r.Header.Get("If-Modified-Since")
+
+	if ifNoneMatch != "" {
+		match = etag != "" && etagMatches(ifNoneMatch, etag)
+	} else if ifModifiedSince != "" && !modTime.IsZero() {
+		since, err := http.ParseTime(ifModifiedSince)
+		match = err == nil && !modTime.Truncate(time.Second).After(since)
+	}
+
+	if !match {
+		return false
+	}
+
+	// Response without content must not describe the content.
+	header := w.Header()
+	header.Del("Content-Type")
+	header.Del("Content-Length")
+
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches returns true if any of the entity tags from the If-None-Match
+// header weakly matches the given ETag.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+
+	return false
+}
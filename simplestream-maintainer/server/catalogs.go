@@ -0,0 +1,165 @@
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+// fileStamp identifies the version of the file. Negative size indicates that
+// the file does not exist.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// catalogSnapshot holds the stream index, and the product catalogs and the
+// publish times of their versions mapped by the stream names. Generation is
+// increased whenever the catalogs are read again.
+type catalogSnapshot struct {
+	index      *stream.StreamIndex
+	catalogs   map[string]*stream.ProductCatalog
+	published  map[string]stream.PublishedTimes
+	generation int
+
+	// excludedDirs contains directories of the products that were
+	// filtered out of the catalogs. It is set only for filtered views.
+	excludedDirs map[string]bool
+}
+
+// catalogSource provides snapshots of the product catalogs.
+type catalogSource interface {
+	get() (*catalogSnapshot, error)
+}
+
+// catalogCache keeps the product catalogs referenced from the index of a
+// single stream version along with the publish times of their versions.
+// Catalogs are read again only if the index, any of the product catalogs, or
+// publish times change, which is detected from their sizes and modification
+// times.
+type catalogCache struct {
+	b             storage.Backend
+	streamVersion string
+	indexPath     string
+
+	mu       sync.Mutex
+	stamps   map[string]fileStamp
+	snapshot *catalogSnapshot
+}
+
+// newCatalogCache returns the cache of product catalogs of the given stream
+// version.
+func newCatalogCache(b storage.Backend, streamVersion string) *catalogCache {
+	return &catalogCache{
+		b:             b,
+		streamVersion: streamVersion,
+		indexPath:     path.Join("streams", streamVersion, "index.json"),
+	}
+}
+
+// get returns the snapshot of the product catalogs. Returned snapshot must
+// not be modified.
+func (c *catalogCache) get() (*catalogSnapshot, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.snapshot != nil && c.unchanged() {
+		return c.snapshot, nil
+	}
+
+	stamps := make(map[string]fileStamp)
+
+	stamp := func(name string, optional bool) error {
+		info, err := c.b.Stat(name)
+		if err != nil {
+			if optional && errors.Is(err, fs.ErrNotExist) {
+				stamps[name] = fileStamp{size: -1}
+				return nil
+			}
+
+			return err
+		}
+
+		stamps[name] = fileStamp{size: info.Size(), modTime: info.ModTime()}
+		return nil
+	}
+
+	// Stamps are taken before reading the files, so that changes made
+	// while reading them are detected on the next call.
+	err := stamp(c.indexPath, false)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := storage.ReadJSONFile(c.b, c.indexPath, &stream.StreamIndex{})
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &catalogSnapshot{
+		index:      index,
+		catalogs:   make(map[string]*stream.ProductCatalog, len(index.Index)),
+		published:  make(map[string]stream.PublishedTimes, len(index.Index)),
+		generation: 1,
+	}
+
+	if c.snapshot != nil {
+		snapshot.generation = c.snapshot.generation + 1
+	}
+
+	for streamName, entry := range index.Index {
+		err := stamp(entry.Path, false)
+		if err != nil {
+			return nil, err
+		}
+
+		catalog, err := storage.ReadJSONFile(c.b, entry.Path, &stream.ProductCatalog{})
+		if err != nil {
+			return nil, err
+		}
+
+		err = stamp(stream.PublishedTimesPath(c.streamVersion, streamName), true)
+		if err != nil {
+			return nil, err
+		}
+
+		published, err := stream.ReadPublishedTimes(c.b, c.streamVersion, streamName)
+		if err != nil {
+			return nil, err
+		}
+
+		snapshot.catalogs[streamName] = catalog
+		snapshot.published[streamName] = published
+	}
+
+	c.stamps = stamps
+	c.snapshot = snapshot
+
+	return c.snapshot, nil
+}
+
+// unchanged returns true if none of the files from which the catalogs were
+// read changed.
+func (c *catalogCache) unchanged() bool {
+	for name, stamp := range c.stamps {
+		info, err := c.b.Stat(name)
+		if err != nil {
+			if stamp.size < 0 && errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+
+			return false
+		}
+
+		if info.Size() != stamp.size || !info.ModTime().Equal(stamp.modTime) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/metrics"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+// deltasPath is the URL path of the delta graph endpoint.
+const deltasPath = "/api/deltas"
+
+// productDeltas is the delta graph of a single product returned by the delta
+// graph endpoint.
+type productDeltas struct {
+	Stream string `json:"stream"`
+	ID     string `json:"id"`
+
+	stream.DeltaGraph
+
+	// Cheapest upgrade paths from the requested version to the latest
+	// version for each item type of the latest version.
+	Upgrades []stream.UpgradePath `json:"upgrades,omitempty"`
+}
+
+// deltasHandler serves the delta graphs of the products from the cached
+// product catalogs. Products are filtered the same way as by the products
+// query endpoint. If query parameter "from" is set to a version name, the
+// cheapest upgrade paths from that version to the latest version are
+// included for the products that contain such version. Parameter
+// "stream_version" selects the stream version of the catalogs.
+func deltasHandler(catalogs versionedCatalogs) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !methodAllowed(w, r) {
+			return
+		}
+
+		query := r.URL.Query()
+		for key := range query {
+			_, ok := productFilters[key]
+			if !ok && key != "q" && key != "from" && key != streamVersionParam {
+				http.Error(w, "Unknown filter "+key, http.StatusBadRequest)
+				return
+			}
+		}
+
+		source, streamVersion, ok := catalogs.forRequest(w, r)
+		if !ok {
+			return
+		}
+
+		metrics.StreamRequests.Inc(streamVersion, "deltas")
+
+		snapshot, err := source.get()
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("Failed to read product catalogs", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if snapshot == nil {
+			snapshot = &catalogSnapshot{}
+		}
+
+		from := query.Get("from")
+		result := []productDeltas{}
+
+		for _, info := range filterProducts(snapshot, query) {
+			graph := stream.NewDeltaGraph(snapshot.catalogs[info.Stream].Products[info.ID])
+			deltas := productDeltas{
+				Stream:     info.Stream,
+				ID:         info.ID,
+				DeltaGraph: graph,
+			}
+
+			if from != "" && info.LatestVersion != "" && slices.Contains(graph.Versions, from) {
+				for _, itemType := range []string{stream.ItemTypeSquashfs, stream.ItemTypeDiskKVM, stream.ItemTypeDiskRaw} {
+					upgrade, ok := graph.UpgradePath(from, info.LatestVersion, itemType)
+					if ok {
+						deltas.Upgrades = append(deltas.Upgrades, upgrade)
+					}
+				}
+			}
+
+			result = append(result, deltas)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(result)
+		if err != nil {
+			slog.Warn("Failed to write deltas response", "error", err)
+		}
+	})
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// contentTypes maps file extensions (or file names) of the simplestream
+// content to their content types.
+var contentTypes = map[string]string{
+	".json":      "application/json",
+	".sjson":     "text/plain; charset=utf-8",
+	".gpg":       "application/pgp-signature",
+	".gz":        "application/gzip",
+	".xz":        "application/x-xz",
+	".squashfs":  "application/octet-stream",
+	".qcow2":     "application/octet-stream",
+	".img":       "application/octet-stream",
+	".vcdiff":    "application/octet-stream",
+	".yaml":      "text/plain; charset=utf-8",
+	".html":      "text/html; charset=utf-8",
+	"SHA256SUMS": "text/plain; charset=utf-8",
+	"SHA512SUMS": "text/plain; charset=utf-8",
+	"B2SUMS":     "text/plain; charset=utf-8",
+}
+
+// contentType returns the content type for the file on the given path.
+// If the content type is not known, an empty string is returned.
+func contentType(filePath string) string {
+	name := path.Base(filePath)
+
+	contentType, ok := contentTypes[name]
+	if ok {
+		return contentType
+	}
+
+	return contentTypes[path.Ext(name)]
+}
+
+// isHidden returns true if any element of the given slash-separated path is
+// hidden (prefixed with a dot). Hidden files are never served, because they
+// represent temporary files and partially uploaded versions.
+func isHidden(urlPath string) bool {
+	for _, part := range strings.Split(urlPath, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// visibleFS is a http.FileSystem that hides hidden files and directories.
+type visibleFS struct {
+	fs http.FileSystem
+}
+
+// Open opens the file on the given path. If the path is hidden, an error
+// fs.ErrNotExist is returned.
+func (v visibleFS) Open(name string) (http.File, error) {
+	if isHidden(name) {
+		return nil, fs.ErrNotExist
+	}
+
+	f, err := v.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return visibleFile{File: f}, nil
+}
+
+// visibleFile is a http.File that excludes hidden files from the directory
+// listing.
+type visibleFile struct {
+	http.File
+}
+
+// Readdir returns the directory contents without hidden files.
+func (f visibleFile) Readdir(count int) ([]fs.FileInfo, error) {
+	files, err := f.File.Readdir(count)
+
+	visible := make([]fs.FileInfo, 0, len(files))
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), ".") {
+			visible = append(visible, file)
+		}
+	}
+
+	return visible, err
+}
+
+// methodAllowed returns true if the request method is either GET or HEAD.
+// Otherwise, the error response is written and false is returned.
+func methodAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+
+	w.Header().Set("Allow", "GET, HEAD")
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	return false
+}
+
+// fileHandler returns a handler that serves files from the root directory.
+// Range and conditional requests are supported for all files, whose caching
+// headers are set by the given cache.
+func fileHandler(rootDir string, cache *httpCache) http.Handler {
+	fileServer := http.FileServer(visibleFS{fs: http.Dir(filepath.Clean(rootDir))})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !methodAllowed(w, r) {
+			return
+		}
+
+		// File server answers the conditional requests using the ETag
+		// set in advance.
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if !isHidden(name) {
+			info, err := os.Stat(filepath.Join(rootDir, filepath.FromSlash(name)))
+			if err == nil && info.Mode().IsRegular() {
+				cache.setHeaders(w, name, info)
+			}
+		}
+
+		// Set the content type in advance to prevent content sniffing.
+		contentType := contentType(r.URL.Path)
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+
+		fileServer.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// jobsPathPrefix is the path prefix of the jobs API.
+const jobsPathPrefix = "/api/v1/"
+
+// maxQueuedJobs is the maximum number of jobs waiting to be run. Once the
+// queue is full, new jobs are rejected.
+const maxQueuedJobs = 100
+
+// maxFinishedJobs is the number of finished jobs whose status is retained.
+const maxFinishedJobs = 100
+
+// maxJobInputSize is the maximum size of the request body passed to the
+// operation.
+const maxJobInputSize = 16 << 20
+
+// ScheduledJobClient is the client of the jobs submitted by the scheduler.
+const ScheduledJobClient = "scheduler"
+
+// Statuses of the jobs.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// Operation is an operation (e.g. build or prune) that can be triggered
+// through the jobs API. The context is cancelled once the server stops. The
+// input is the body of the request that triggered the job, which is empty if
+// not given. The result, if not nil, is served along with the job status.
+type Operation func(ctx context.Context, input []byte) (any, error)
+
+// Job is an operation triggered through the jobs API.
+type Job struct {
+	ID         string     `json:"id"`
+	Operation  string     `json:"operation"`
+	Client     string     `json:"client,omitempty"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Result     any        `json:"result,omitempty"`
+
+	run   Operation
+	input []byte
+}
+
+// jobQueue runs the queued jobs one at a time in the order in which they
+// were submitted.
+type jobQueue struct {
+	// audit, if set, is called with each finished job and its input.
+	audit func(job Job, input []byte)
+
+	mu       sync.Mutex
+	jobs     map[string]*Job
+	finished []string
+	queue    chan *Job
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	started sync.Once
+	done    chan struct{}
+}
+
+func newJobQueue(audit func(job Job, input []byte)) *jobQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &jobQueue{
+		audit:  audit,
+		jobs:   make(map[string]*Job),
+		queue:  make(chan *Job, maxQueuedJobs),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+}
+
+// submit queues a new job that runs the named operation with the given input
+// on behalf of the given client. It returns false if the queue is full.
+func (q *jobQueue) submit(operation string, run Operation, client string, input []byte) (Job, bool) {
+	q.started.Do(func() {
+		go q.run()
+	})
+
+	job := &Job{
+		ID:        newJobID(),
+		Operation: operation,
+		Client:    client,
+		Status:    JobQueued,
+		CreatedAt: time.Now().UTC(),
+		run:       run,
+		input:     input,
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	select {
+	case q.queue <- job:
+	default:
+		return Job{}, false
+	}
+
+	q.jobs[job.ID] = job
+	return *job, true
+}
+
+// get returns the job with the given ID.
+func (q *jobQueue) get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+
+	return *job, true
+}
+
+// run runs the queued jobs until the queue is stopped.
+func (q *jobQueue) run() {
+	defer close(q.done)
+
+	for {
+		select {
+		case <-q.ctx.Done():
+			return
+		case job := <-q.queue:
+			q.runJob(job)
+		}
+	}
+}
+
+// runJob runs the job and records its result.
+func (q *jobQueue) runJob(job *Job) {
+	started := time.Now().UTC()
+
+	q.mu.Lock()
+	job.Status = JobRunning
+	job.StartedAt = &started
+	q.mu.Unlock()
+
+	slog.Info("Job started", "job", job.ID, "operation", job.Operation)
+
+	result, err := job.run(q.ctx, job.input)
+	finished := time.Now().UTC()
+
+	q.mu.Lock()
+
+	input := job.input
+
+	job.FinishedAt = &finished
+	job.Status = JobSucceeded
+	job.Result = result
+	job.run = nil
+	job.input = nil
+	if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+		slog.Error("Job failed", "job", job.ID, "operation", job.Operation, "error", err)
+	} else {
+		slog.Info("Job finished", "job", job.ID, "operation", job.Operation, "duration", finished.Sub(started).String())
+	}
+
+	// Forget the oldest finished jobs.
+	q.finished = append(q.finished, job.ID)
+	if len(q.finished) > maxFinishedJobs {
+		for _, id := range q.finished[:len(q.finished)-maxFinishedJobs] {
+			delete(q.jobs, id)
+		}
+
+		q.finished = slices.Clone(q.finished[len(q.finished)-maxFinishedJobs:])
+	}
+
+	finishedJob := *job
+	q.mu.Unlock()
+
+	// Audit is called without holding the lock, so that the status of the
+	// jobs can be served meanwhile.
+	if q.audit != nil {
+		q.audit(finishedJob, input)
+	}
+}
+
+// stop cancels the running job and waits for it to finish. Queued jobs are
+// not run.
+func (q *jobQueue) stop() {
+	q.cancel()
+
+	q.started.Do(func() {
+		close(q.done)
+	})
+
+	<-q.done
+}
+
+// newJobID returns a new random job ID.
+func newJobID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// schedule submits a job of the named operation on behalf of the scheduler
+// immediately and then every interval, until the context is cancelled. The
+// job is not submitted again while the previous one has not finished, so
+// that slow operations do not pile up in the queue.
+func (q *jobQueue) schedule(ctx context.Context, name string, run Operation, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last Job
+
+	for {
+		job, ok := q.get(last.ID)
+		if ok && (job.Status == JobQueued || job.Status == JobRunning) {
+			slog.Warn("Skipping scheduled job, as the previous one has not finished yet", "operation", name, "job", job.ID)
+		} else {
+			last, ok = q.submit(name, run, ScheduledJobClient, nil)
+			if !ok {
+				slog.Warn("Skipping scheduled job, as there are too many queued jobs", "operation", name)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// jobsHandler serves the jobs API. Operations are triggered by POST requests
+// on "/api/v1/<operation>", which respond with the queued job, and the status
+// of the job is served on "/api/v1/jobs/<id>". The request body is passed to
+// the operation as its input.
+func jobsHandler(q *jobQueue, operations map[string]Operation) http.Handler {
+	mux := http.NewServeMux()
+
+	for name, run := range operations {
+		mux.HandleFunc(jobsPathPrefix+name, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", "POST")
+				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				return
+			}
+
+			input, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxJobInputSize))
+			if err != nil {
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+					return
+				}
+
+				http.Error(w, "Failed to read request body", http.StatusBadRequest)
+				return
+			}
+
+			client := r.RemoteAddr
+			addr, ok := clientAddr(r)
+			if ok {
+				client = addr.String()
+			}
+
+			job, ok := q.submit(name, run, client, input)
+			if !ok {
+				http.Error(w, "Too many queued jobs", http.StatusServiceUnavailable)
+				return
+			}
+
+			w.Header().Set("Location", jobsPathPrefix+"jobs/"+job.ID)
+			writeJob(w, http.StatusAccepted, job)
+		})
+	}
+
+	mux.HandleFunc(jobsPathPrefix+"jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !methodAllowed(w, r) {
+			return
+		}
+
+		job, ok := q.get(r.PathValue("id"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		writeJob(w, http.StatusOK, job)
+	})
+
+	return mux
+}
+
+// writeJob writes the job as JSON response with the given status code.
+func writeJob(w http.ResponseWriter, status int, job Job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(job)
+	if err != nil {
+		slog.Warn("Failed to write job response", "job", job.ID, "error", err)
+	}
+}
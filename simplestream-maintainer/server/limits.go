@@ -0,0 +1,301 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// bandwidthChunk is the maximum number of bytes written at once by the
+// throttled response writer, which keeps the transfer smooth.
+const bandwidthChunk = 32 * 1024
+
+// bandwidthLimiter limits the number of bytes transferred per second. Bytes
+// are taken from the bucket holding up to one second of transfer, and the
+// writer waits while the bucket is in debt.
+type bandwidthLimiter struct {
+	rate float64
+	now  func() time.Time
+
+	mu      sync.Mutex
+	tokens  float64
+	updated time.Time
+}
+
+// newBandwidthLimiter returns the limiter of the given number of bytes per
+// second, or nil if the rate is not positive.
+func newBandwidthLimiter(rate int64) *bandwidthLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &bandwidthLimiter{
+		rate:    float64(rate),
+		now:     time.Now,
+		tokens:  float64(rate),
+		updated: time.Now(),
+	}
+}
+
+// reserve takes the given number of bytes from the bucket and returns the
+// time to wait before they can be transferred.
+func (l *bandwidthLimiter) reserve(n int) time.Duration {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	elapsed := now.Sub(l.updated).Seconds()
+	if elapsed > 0 {
+		l.tokens = min(l.rate, l.tokens+elapsed*l.rate)
+		l.updated = now
+	}
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// wait blocks until the given number of bytes can be transferred, or the
+// context is cancelled.
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	delay := l.reserve(n)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// connLimiterKey is the context key of the connection's bandwidth limiter.
+type connLimiterKey struct{}
+
+// throttledWriter writes the response within the bandwidth limits.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	limiters []*bandwidthLimiter
+}
+
+// Write implements http.ResponseWriter.
+func (w *throttledWriter) Write(b []byte) (int, error) {
+	var written int
+
+	for len(b) > 0 {
+		chunk := b[:min(len(b), bandwidthChunk)]
+
+		for _, l := range w.limiters {
+			err := l.wait(w.ctx, len(chunk))
+			if err != nil {
+				return written, err
+			}
+		}
+
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+// Unwrap returns the underlying response writer for http.ResponseController.
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withBandwidthLimit limits the transfer rate of the response bodies. The
+// total limiter is shared by all responses, while the limiter of each
+// connection is taken from the request context (see Server.serve). Responses
+// are not limited if neither limiter is set.
+func withBandwidthLimit(total *bandwidthLimiter) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var limiters []*bandwidthLimiter
+
+			conn, _ := r.Context().Value(connLimiterKey{}).(*bandwidthLimiter)
+			if conn != nil {
+				limiters = append(limiters, conn)
+			}
+
+			if total != nil {
+				limiters = append(limiters, total)
+			}
+
+			if len(limiters) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			next.ServeHTTP(&throttledWriter{ResponseWriter: w, ctx: r.Context(), limiters: limiters}, r)
+		})
+	}
+}
+
+// connLimiter limits the number of open connections, both in total and per
+// client address.
+type connLimiter struct {
+	total     chan struct{}
+	perClient int
+
+	mu      sync.Mutex
+	clients map[netip.Addr]int
+}
+
+// newConnLimiter returns the limiter of the given number of connections in
+// total and per client, where zero means no limit. Nil is returned if
+// neither is limited.
+func newConnLimiter(total int, perClient int) *connLimiter {
+	if total <= 0 && perClient <= 0 {
+		return nil
+	}
+
+	l := &connLimiter{
+		perClient: max(perClient, 0),
+		clients:   make(map[netip.Addr]int),
+	}
+
+	if total > 0 {
+		l.total = make(chan struct{}, total)
+	}
+
+	return l
+}
+
+// acquire takes a connection slot of the client with the given address, and
+// returns false if the client has reached its limit.
+func (l *connLimiter) acquire(addr netip.Addr) bool {
+	if l.perClient == 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.clients[addr] >= l.perClient {
+		return false
+	}
+
+	l.clients[addr]++
+	return true
+}
+
+// release returns the connection slot of the client with the given address.
+func (l *connLimiter) release(addr netip.Addr) {
+	if l.perClient == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.clients[addr]--
+	if l.clients[addr] <= 0 {
+		delete(l.clients, addr)
+	}
+}
+
+// limitedListener accepts connections within the limits of the connection
+// limiter. Once the total limit is reached, new connections wait in the
+// listen queue until another connection is closed. Connections of the clients
+// that reached their limit are closed immediately.
+type limitedListener struct {
+	net.Listener
+	limiter *connLimiter
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// limitListener wraps the listener with the given connection limiter. If the
+// limiter is nil, the listener is returned as is.
+func limitListener(listener net.Listener, limiter *connLimiter) net.Listener {
+	if limiter == nil {
+		return listener
+	}
+
+	return &limitedListener{Listener: listener, limiter: limiter, done: make(chan struct{})}
+}
+
+// Accept implements net.Listener.
+func (l *limitedListener) Accept() (net.Conn, error) {
+	for {
+		if l.limiter.total != nil {
+			select {
+			case l.limiter.total <- struct{}{}:
+			case <-l.done:
+				return nil, net.ErrClosed
+			}
+		}
+
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.releaseTotal()
+			return nil, err
+		}
+
+		addr := netip.Addr{}
+		addrPort, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+		if err == nil {
+			addr = addrPort.Addr().Unmap()
+		}
+
+		if !l.limiter.acquire(addr) {
+			slog.Debug("Rejected connection over the client limit", "remoteAddr", conn.RemoteAddr().String())
+			_ = conn.Close()
+			l.releaseTotal()
+			continue
+		}
+
+		return &limitedConn{Conn: conn, release: func() {
+			l.limiter.release(addr)
+			l.releaseTotal()
+		}}, nil
+	}
+}
+
+// Close implements net.Listener.
+func (l *limitedListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// releaseTotal returns the slot of the total connection limit.
+func (l *limitedListener) releaseTotal() {
+	if l.limiter.total != nil {
+		<-l.limiter.total
+	}
+}
+
+// limitedConn returns its connection slots once closed.
+type limitedConn struct {
+	net.Conn
+	closeOnce sync.Once
+	release   func()
+}
+
+// Close implements net.Conn.
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(c.release)
+	return err
+}
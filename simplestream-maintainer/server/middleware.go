@@ -0,0 +1,417 @@
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"maps"
+	"net/http"
+	"path"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/metrics"
+)
+
+// Middleware wraps the handler with additional behavior.
+type Middleware func(http.Handler) http.Handler
+
+// chain wraps the handler with the given middlewares, where the first
+// middleware is the outermost one.
+func chain(h http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+
+	return h
+}
+
+// statusWriter records the status code and the number of bytes written.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter.
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+// Unwrap returns the underlying response writer for http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withLogging logs each served request. Requests that failed with a server
+// error are logged as warnings.
+func withLogging() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w}
+
+			next.ServeHTTP(sw, r)
+
+			if sw.status == 0 {
+				sw.status = http.StatusOK
+			}
+
+			level := slog.LevelDebug
+			if sw.status >= http.StatusInternalServerError {
+				level = slog.LevelWarn
+			}
+
+			slog.Log(r.Context(), level, "Request served",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", sw.status,
+				"size", sw.size,
+				"duration", time.Since(start),
+				"remoteAddr", r.RemoteAddr,
+			)
+		})
+	}
+}
+
+// withRecovery recovers from panics within the handler. The panic is logged
+// and, unless the response has already started, a server error is returned.
+func withRecovery() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sw := &statusWriter{ResponseWriter: w}
+
+			defer func() {
+				err := recover()
+				if err == nil {
+					return
+				}
+
+				// Propagate the deliberate abort of the response.
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
+				slog.Error("Request handler panicked", "method", r.Method, "path", r.URL.Path, "error", err, "stack", string(debug.Stack()))
+
+				if sw.status == 0 {
+					http.Error(sw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				}
+			}()
+
+			next.ServeHTTP(sw, r)
+		})
+	}
+}
+
+// withAuth ensures requests carry the given bearer token. If the token is
+// empty, requests are not authenticated.
+func withAuth(token string) Middleware {
+	return func(next http.Handler) http.Handler {
+		if token == "" {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scheme, value, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+			if !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare([]byte(value), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// timeoutWriter discards the response of the handler once the timeout
+// response is written. Headers are kept separately until the response
+// starts, so that the timeout response can be written concurrently.
+type timeoutWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+
+	mu       sync.Mutex
+	started  bool
+	timedOut bool
+}
+
+// Header implements http.ResponseWriter.
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut || tw.started {
+		return
+	}
+
+	tw.start()
+	tw.w.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter.
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+
+	if !tw.started {
+		tw.start()
+	}
+
+	return tw.w.Write(b)
+}
+
+// start copies the headers to the underlying response writer. From now on,
+// headers are modified directly.
+func (tw *timeoutWriter) start() {
+	maps.Copy(tw.w.Header(), tw.header)
+	tw.header = tw.w.Header()
+	tw.started = true
+}
+
+// Unwrap returns the underlying response writer for http.ResponseController.
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.w
+}
+
+// withTimeout cancels the request context and responds with the status 503
+// if the handler does not start the response within the given timeout.
+// Responses that have already started are not interrupted, which ensures
+// downloads of large files are not limited by the timeout. Zero timeout
+// disables the middleware.
+func withTimeout(timeout time.Duration) Middleware {
+	return func(next http.Handler) http.Handler {
+		if timeout <= 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithCancel(r.Context())
+			defer cancel()
+
+			tw := &timeoutWriter{w: w, header: make(http.Header)}
+
+			timer := time.AfterFunc(timeout, func() {
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+
+				if tw.started {
+					return
+				}
+
+				tw.timedOut = true
+				cancel()
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			})
+
+			defer timer.Stop()
+
+			next.ServeHTTP(tw, r.WithContext(ctx))
+
+			// Start the response if the handler returned without writing
+			// it, so that the timer cannot respond on the finished request
+			// and the headers set by the handler are not lost.
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+
+			if !tw.started && !tw.timedOut {
+				tw.start()
+			}
+		})
+	}
+}
+
+// gzipWriter compresses the response body if the response is compressible.
+// The decision is made once the response starts, based on its status code
+// and content type.
+type gzipWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *gzipWriter) WriteHeader(status int) {
+	if !w.decided {
+		w.decided = true
+
+		header := w.Header()
+		if status == http.StatusOK && header.Get("Content-Encoding") == "" && isCompressible(header.Get("Content-Type")) {
+			header.Del("Content-Length")
+			header.Set("Content-Encoding", "gzip")
+
+			// Compressed representation is not byte-for-byte
+			// identical, so its ETag is weak.
+			etag := header.Get("ETag")
+			if etag != "" && !strings.HasPrefix(etag, "W/") {
+				header.Set("ETag", "W/"+etag)
+			}
+
+			w.gz = gzip.NewWriter(w.ResponseWriter)
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter.
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Close flushes the compressed data.
+func (w *gzipWriter) Close() error {
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+
+	return nil
+}
+
+// Unwrap returns the underlying response writer for http.ResponseController.
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withGzip compresses the responses of the compressible content types if the
+// client accepts it. Range and HEAD requests are never compressed.
+func withGzip() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+
+			if r.Method == http.MethodHead || r.Header.Get("Range") != "" || !acceptsGzip(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			gw := &gzipWriter{ResponseWriter: w}
+			defer func() {
+				err := gw.Close()
+				if err != nil {
+					slog.Debug("Failed to close compressed response", "path", r.URL.Path, "error", err)
+				}
+			}()
+
+			next.ServeHTTP(gw, r)
+		})
+	}
+}
+
+// isCompressible returns true if the content of the given type is worth
+// compressing.
+func isCompressible(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/json") || strings.HasPrefix(contentType, "text/")
+}
+
+// acceptsGzip returns true if the client accepts gzip encoded responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+		if name == "gzip" && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withStreamRedirects redirects requests for files of the old stream versions
+// that do not exist to the same files of the new stream versions. Existing
+// files are served as usual, so both stream versions can be served during
+// the transition period.
+func withStreamRedirects(redirects map[string]string, exists func(name string) bool) Middleware {
+	return func(next http.Handler) http.Handler {
+		if len(redirects) == 0 {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+
+			parts := strings.SplitN(name, "/", 3)
+			if len(parts) == 3 && parts[0] == "streams" {
+				newVersion, ok := redirects[parts[1]]
+				if ok && !exists(name) {
+					target := "/" + path.Join("streams", newVersion, parts[2])
+					if r.URL.RawQuery != "" {
+						target += "?" + r.URL.RawQuery
+					}
+
+					http.Redirect(w, r, target, http.StatusMovedPermanently)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// withStreamMetrics counts the requests for the index and product catalog
+// files of each stream version. Only successful and redirected requests are
+// counted, so that requests for non-existent stream versions cannot create
+// arbitrary metric labels.
+func withStreamMetrics() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+
+			parts := strings.Split(name, "/")
+			if len(parts) != 3 || parts[0] != "streams" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			sw := &statusWriter{ResponseWriter: w}
+			next.ServeHTTP(sw, r)
+
+			if sw.status >= http.StatusBadRequest {
+				return
+			}
+
+			endpoint := "catalog"
+			if strings.HasPrefix(parts[2], "index.") {
+				endpoint = "index"
+			}
+
+			metrics.StreamRequests.Inc(parts[1], endpoint)
+		})
+	}
+}
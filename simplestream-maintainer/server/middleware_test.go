@@ -0,0 +1,280 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/metrics"
+)
+
+func TestChain(t *testing.T) {
+	t.Parallel()
+
+	var order []string
+
+	mark := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	h := chain(http.NotFoundHandler(), mark("first"), mark("second"))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	require.Equal(t, []string{"first", "second"}, order)
+}
+
+func TestWithRecovery(t *testing.T) {
+	t.Parallel()
+
+	h := withRecovery()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("test")
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	// Ensure the deliberate abort is propagated.
+	h = withRecovery()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	require.PanicsWithValue(t, http.ErrAbortHandler, func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	})
+}
+
+func TestWithAuth(t *testing.T) {
+	t.Parallel()
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		Name          string
+		Token         string
+		Authorization string
+		WantStatus    int
+	}{
+		{
+			Name:       "Authentication disabled",
+			WantStatus: http.StatusOK,
+		},
+		{
+			Name:       "Missing token",
+			Token:      "secret",
+			WantStatus: http.StatusUnauthorized,
+		},
+		{
+			Name:          "Invalid token",
+			Token:         "secret",
+			Authorization: "Bearer other",
+			WantStatus:    http.StatusUnauthorized,
+		},
+		{
+			Name:          "Invalid scheme",
+			Token:         "secret",
+			Authorization: "Basic secret",
+			WantStatus:    http.StatusUnauthorized,
+		},
+		{
+			Name:          "Valid token",
+			Token:         "secret",
+			Authorization: "Bearer secret",
+			WantStatus:    http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.Authorization != "" {
+				req.Header.Set("Authorization", test.Authorization)
+			}
+
+			rec := httptest.NewRecorder()
+			withAuth(test.Token)(ok).ServeHTTP(rec, req)
+			require.Equal(t, test.WantStatus, rec.Code)
+		})
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	t.Parallel()
+
+	// Ensure the handler that does not respond in time is cancelled.
+	cancelled := make(chan struct{})
+	h := withTimeout(10 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(cancelled)
+
+		_, err := w.Write([]byte("late"))
+		require.ErrorIs(t, err, http.ErrHandlerTimeout)
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	<-cancelled
+
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.NotContains(t, rec.Body.String(), "late")
+
+	// Ensure the started response is not interrupted.
+	h = withTimeout(10 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("start-"))
+		time.Sleep(50 * time.Millisecond)
+		_, _ = w.Write([]byte("end"))
+	}))
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "text/plain", rec.Header().Get("Content-Type"))
+	require.Equal(t, "start-end", rec.Body.String())
+
+	// Ensure headers of the handler that returns without writing are kept
+	// and the timer does not respond on the finished request.
+	h = withTimeout(10 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/elsewhere")
+	}))
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	time.Sleep(50 * time.Millisecond)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "/elsewhere", rec.Header().Get("Location"))
+	require.Empty(t, rec.Body.String())
+}
+
+func TestWithGzip(t *testing.T) {
+	t.Parallel()
+
+	content := `{"format":"index:1.0"}`
+
+	h := withGzip()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType(r.URL.Path))
+		_, _ = w.Write([]byte(content))
+	}))
+
+	serve := func(path string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Ensure compressible content is compressed.
+	rec := serve("/index.json", map[string]string{"Accept-Encoding": "br, gzip"})
+	require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	require.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+
+	gz, err := gzip.NewReader(rec.Body)
+	require.NoError(t, err)
+
+	body, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	require.Equal(t, content, string(body))
+
+	// Ensure content is not compressed otherwise.
+	for _, test := range []struct {
+		Path   string
+		Header map[string]string
+	}{
+		{Path: "/index.json"},
+		{Path: "/index.json", Header: map[string]string{"Accept-Encoding": "gzip;q=0"}},
+		{Path: "/index.json", Header: map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-1"}},
+		{Path: "/root.squashfs", Header: map[string]string{"Accept-Encoding": "gzip"}},
+	} {
+		rec := serve(test.Path, test.Header)
+		require.Empty(t, rec.Header().Get("Content-Encoding"))
+		require.Equal(t, content, rec.Body.String())
+	}
+}
+
+func TestWithStreamRedirects(t *testing.T) {
+	t.Parallel()
+
+	existing := map[string]bool{
+		"streams/v1/index.json": true,
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := withStreamRedirects(map[string]string{"v1": "v2"}, func(name string) bool { return existing[name] })(ok)
+
+	tests := []struct {
+		Name         string
+		Path         string
+		WantStatus   int
+		WantLocation string
+	}{
+		{
+			Name:       "Existing file of the old stream version",
+			Path:       "/streams/v1/index.json",
+			WantStatus: http.StatusOK,
+		},
+		{
+			Name:         "Missing file of the old stream version",
+			Path:         "/streams/v1/images.json",
+			WantStatus:   http.StatusMovedPermanently,
+			WantLocation: "/streams/v2/images.json",
+		},
+		{
+			Name:       "File of the new stream version",
+			Path:       "/streams/v2/images.json",
+			WantStatus: http.StatusOK,
+		},
+		{
+			Name:       "File outside streams directory",
+			Path:       "/images/v1/root.squashfs",
+			WantStatus: http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, test.Path, nil))
+			require.Equal(t, test.WantStatus, rec.Code)
+			require.Equal(t, test.WantLocation, rec.Header().Get("Location"))
+		})
+	}
+}
+
+func TestWithStreamMetrics(t *testing.T) {
+	t.Parallel()
+
+	h := withStreamMetrics()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/streams/metrics-v1/index.json" {
+			http.NotFound(w, r)
+		}
+	}))
+
+	serve := func(path string) {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	// Ensure served stream files are counted.
+	before := metrics.StreamRequests.Value("metrics-v1", "index")
+	serve("/streams/metrics-v1/index.json")
+	require.Equal(t, before+1, metrics.StreamRequests.Value("metrics-v1", "index"))
+
+	// Ensure files of non-existent stream versions are not counted.
+	serve("/streams/metrics-missing/index.json")
+	require.Zero(t, metrics.StreamRequests.Value("metrics-missing", "index"))
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/metrics"
+)
+
+// productsPath is the URL path of the products query endpoint.
+const productsPath = "/api/products"
+
+// productFilters is a list of query parameters by which the products can be
+// filtered along with the functions returning the matching product fields.
+var productFilters = map[string]func(p productInfo) []string{
+	"stream":  func(p productInfo) []string { return []string{p.Stream} },
+	"os":      func(p productInfo) []string { return []string{p.Distro, p.OS} },
+	"release": func(p productInfo) []string { return []string{p.Release} },
+	"arch":    func(p productInfo) []string { return []string{p.Architecture} },
+	"variant": func(p productInfo) []string { return []string{p.Variant} },
+}
+
+// productInfo is a summary of a single product returned by the products
+// query endpoint.
+type productInfo struct {
+	Stream        string   `json:"stream"`
+	ID            string   `json:"id"`
+	Distro        string   `json:"distro"`
+	OS            string   `json:"os"`
+	Release       string   `json:"release"`
+	ReleaseTitle  string   `json:"release_title"`
+	Architecture  string   `json:"arch"`
+	Variant       string   `json:"variant"`
+	Aliases       []string `json:"aliases"`
+	Versions      []string `json:"versions"`
+	LatestVersion string   `json:"latest_version"`
+
+	// Times when the versions were first published, mapped by the
+	// version names. Versions published before the publish times were
+	// recorded are omitted.
+	Published map[string]time.Time `json:"published,omitempty"`
+}
+
+// productsHandler serves the products from the cached product catalogs that
+// match the filters given as query parameters. Each filter may be given
+// multiple times, in which case products matching any of the values are
+// returned. Parameter "q" is a free-text search, where the product must
+// contain all of the given words in its ID, name, release title, or aliases.
+// Parameter "stream_version" selects the stream version of the catalogs.
+func productsHandler(catalogs versionedCatalogs) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !methodAllowed(w, r) {
+			return
+		}
+
+		query := r.URL.Query()
+		for key := range query {
+			_, ok := productFilters[key]
+			if !ok && key != "q" && key != streamVersionParam {
+				http.Error(w, "Unknown filter "+key, http.StatusBadRequest)
+				return
+			}
+		}
+
+		source, streamVersion, ok := catalogs.forRequest(w, r)
+		if !ok {
+			return
+		}
+
+		metrics.StreamRequests.Inc(streamVersion, "products")
+
+		snapshot, err := source.get()
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("Failed to read product catalogs", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if snapshot == nil {
+			snapshot = &catalogSnapshot{}
+		}
+
+		products := filterProducts(snapshot, query)
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(products)
+		if err != nil {
+			slog.Warn("Failed to write products response", "error", err)
+		}
+	})
+}
+
+// filterProducts returns products from the given catalogs that match the
+// query, sorted by stream name and product ID.
+func filterProducts(snapshot *catalogSnapshot, query url.Values) []productInfo {
+	terms := strings.Fields(strings.ToLower(query.Get("q")))
+	products := []productInfo{}
+
+	for streamName, catalog := range snapshot.catalogs {
+		for id, p := range catalog.Products {
+			versions := shared.MapKeys(p.Versions)
+			slices.Sort(versions)
+
+			info := productInfo{
+				Stream:       streamName,
+				ID:           id,
+				Distro:       p.Distro,
+				OS:           p.OS,
+				Release:      p.Release,
+				ReleaseTitle: p.ReleaseTitle,
+				Architecture: p.Architecture,
+				Variant:      p.Variant,
+				Aliases:      []string{},
+				Versions:     versions,
+			}
+
+			if p.Aliases != "" {
+				info.Aliases = strings.Split(p.Aliases, ",")
+			}
+
+			if len(versions) > 0 {
+				info.LatestVersion = versions[len(versions)-1]
+			}
+
+			for _, v := range versions {
+				published, ok := snapshot.published[streamName].Get(id, v)
+				if !ok {
+					continue
+				}
+
+				if info.Published == nil {
+					info.Published = make(map[string]time.Time)
+				}
+
+				info.Published[v] = published
+			}
+
+			if matchProduct(info, query, terms) {
+				products = append(products, info)
+			}
+		}
+	}
+
+	slices.SortFunc(products, func(a productInfo, b productInfo) int {
+		return strings.Compare(a.Stream+":"+a.ID, b.Stream+":"+b.ID)
+	})
+
+	return products
+}
+
+// matchProduct returns true if the product matches all filters from the query
+// and contains all of the search terms.
+func matchProduct(p productInfo, query url.Values, terms []string) bool {
+	for key, fields := range productFilters {
+		values := query[key]
+		if len(values) == 0 {
+			continue
+		}
+
+		match := slices.ContainsFunc(fields(p), func(field string) bool {
+			return slices.ContainsFunc(values, func(value string) bool {
+				return strings.EqualFold(field, value)
+			})
+		})
+
+		if !match {
+			return false
+		}
+	}
+
+	text := strings.ToLower(strings.Join(append([]string{p.ID, p.OS, p.ReleaseTitle}, p.Aliases...), " "))
+	for _, term := range terms {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,596 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/metrics"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/version"
+)
+
+// DefaultURLTTL is the default lifetime of the pre-signed download URLs.
+const DefaultURLTTL = time.Hour
+
+// DefaultRequestTimeout is the default maximum time in which the handler must
+// start the response.
+const DefaultRequestTimeout = 30 * time.Second
+
+// Server serves the simplestream content (index, product catalogs, and image
+// files) from the root directory over HTTP.
+type Server struct {
+	rootDir        string
+	urlTTL         time.Duration
+	requestTimeout time.Duration
+	authToken      string
+	redirects      map[string]string
+	webPageVersion string
+	webPageStream  string
+	blobVersion    string
+	productVersion string
+	viewVersion    string
+	views          []View
+	streamVersions []string
+	metadataMaxAge time.Duration
+	fileMaxAge     time.Duration
+	jobsToken      string
+	operations     map[string]Operation
+	jobsAudit      func(job Job, input []byte)
+	schedules      []schedule
+	downloadAccess AccessList
+	adminAccess    AccessList
+	rateLimits     []RateLimit
+	maxBandwidth   int64
+	connBandwidth  int64
+	maxConns       int
+	maxClientConns int
+	bandwidth      *bandwidthLimiter
+	conns          *connLimiter
+	jobs           *jobQueue
+	cache          *httpCache
+	handler        http.Handler
+	viewHandlers   map[string]http.Handler
+	jobsHandler    http.Handler
+}
+
+// Option is a functional option for the server.
+type Option func(*Server)
+
+// WithURLTTL sets the lifetime of the pre-signed URLs to which the requests
+// for image files are redirected when the root directory is stored in S3.
+func WithURLTTL(ttl time.Duration) Option {
+	return func(s *Server) {
+		if ttl > 0 {
+			s.urlTTL = ttl
+		}
+	}
+}
+
+// WithRequestTimeout sets the maximum time in which the handler must start
+// the response. Zero disables the timeout.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.requestTimeout = max(timeout, 0)
+	}
+}
+
+// WithAuthToken ensures all requests must carry the given bearer token. If the
+// token is empty, requests are not authenticated.
+func WithAuthToken(token string) Option {
+	return func(s *Server) {
+		s.authToken = token
+	}
+}
+
+// WithStreamRedirects redirects requests for files of the old stream version
+// that do not exist to the same files of the new stream version. Redirects
+// are given as a map of old to new stream versions (for example, "v1" to
+// "v2"), which allows serving the old stream version while both exist.
+func WithStreamRedirects(redirects map[string]string) Option {
+	return func(s *Server) {
+		s.redirects = redirects
+	}
+}
+
+// WithWebPage serves the web page rendered from the product catalog of the
+// given stream as the root page. The page is rendered on demand, and refreshed
+// whenever the product catalog changes.
+func WithWebPage(streamVersion string, streamName string) Option {
+	return func(s *Server) {
+		s.webPageVersion = streamVersion
+		s.webPageStream = streamName
+	}
+}
+
+// WithBlobs serves items referenced from the product catalogs of the given
+// stream version by their SHA256 hash on "/blob/sha256/<hash>", regardless
+// of their path.
+func WithBlobs(streamVersion string) Option {
+	return func(s *Server) {
+		s.blobVersion = streamVersion
+	}
+}
+
+// WithProductsAPI serves products from the product catalogs of the given
+// stream version on "/api/products", filtered by the query parameters "os",
+// "release", "arch", "variant", and "stream", and searched by the free-text
+// query parameter "q". Delta graphs of the same products are served on
+// "/api/deltas", with the cheapest upgrade paths from the version given by the
+// query parameter "from".
+func WithProductsAPI(streamVersion string) Option {
+	return func(s *Server) {
+		s.productVersion = streamVersion
+	}
+}
+
+// WithStreamVersions serves the product catalogs of the given stream versions
+// side by side, where the first one is the default. Stream versions are listed
+// on "/api/streams" along with the paths of their indexes, and the web page and
+// products API serve the stream version selected by the query parameter
+// "stream_version". Requests without the parameter are served from the stream
+// version set by WithWebPage and WithProductsAPI.
+func WithStreamVersions(versions ...string) Option {
+	return func(s *Server) {
+		s.streamVersions = versions
+	}
+}
+
+// WithCacheMaxAge sets the time for which clients and proxies may cache the
+// stream metadata (index, product catalogs, and the web page) and the image
+// files without revalidating them. If the time is not positive, the files
+// must be revalidated on each use, which is cheap, because conditional
+// requests for unchanged files are answered without the content.
+func WithCacheMaxAge(metadata time.Duration, files time.Duration) Option {
+	return func(s *Server) {
+		s.metadataMaxAge = metadata
+		s.fileMaxAge = files
+	}
+}
+
+// WithViews serves the filtered views of the product catalogs of the given
+// stream version. Requests whose host matches one of the view's hosts are
+// served by the view. Views can also be served on separate listeners using
+// ServeView.
+func WithViews(streamVersion string, views ...View) Option {
+	return func(s *Server) {
+		s.viewVersion = streamVersion
+		s.views = views
+	}
+}
+
+// WithJobs serves the jobs API on "/api/v1/", which allows triggering the
+// given operations remotely. Each operation is triggered by a POST request on
+// "/api/v1/<name>", which queues a new job and responds with its ID. Status
+// of the job is served on "/api/v1/jobs/<id>". Jobs are run one at a time.
+// Requests to the jobs API must carry the given bearer token, regardless of
+// the token set by WithAuthToken.
+func WithJobs(token string, operations map[string]Operation) Option {
+	return func(s *Server) {
+		s.jobsToken = token
+		s.operations = operations
+	}
+}
+
+// WithJobsAudit calls the given function with each job finished through the
+// jobs API and the input the job was triggered with, which allows recording
+// the administrative actions.
+func WithJobsAudit(audit func(job Job, input []byte)) Option {
+	return func(s *Server) {
+		s.jobsAudit = audit
+	}
+}
+
+// schedule is an operation run periodically by the server.
+type schedule struct {
+	name      string
+	operation Operation
+	interval  time.Duration
+}
+
+// WithSchedule runs the given operation as a job once the server starts
+// serving and then every interval, until it stops. Scheduled jobs share the
+// queue with the jobs triggered through the jobs API, so that they never run
+// concurrently with each other, and are audited with the client
+// ScheduledJobClient. A job is not scheduled again while the previous one is
+// still queued or running. Non-positive interval disables the schedule.
+func WithSchedule(name string, operation Operation, interval time.Duration) Option {
+	return func(s *Server) {
+		if interval > 0 {
+			s.schedules = append(s.schedules, schedule{name: name, operation: operation, interval: interval})
+		}
+	}
+}
+
+// WithAccessLists restricts the networks from which the server can be
+// accessed. Administrative routes (jobs API and metrics) are restricted by
+// the admin list, and all other routes by the downloads list. Requests from
+// denied networks are rejected with 403.
+func WithAccessLists(downloads AccessList, admin AccessList) Option {
+	return func(s *Server) {
+		s.downloadAccess = downloads
+		s.adminAccess = admin
+	}
+}
+
+// WithRateLimits limits the rate of requests of each client. The first limit
+// whose networks contain the client's address applies, and clients from other
+// networks are not limited. Requests exceeding the limit are rejected with 429.
+func WithRateLimits(limits ...RateLimit) Option {
+	return func(s *Server) {
+		s.rateLimits = limits
+	}
+}
+
+// WithBandwidthLimits limits the transfer rate of the responses in bytes per
+// second, both in total and per connection. Zero means no limit.
+func WithBandwidthLimits(total int64, perConn int64) Option {
+	return func(s *Server) {
+		s.maxBandwidth = total
+		s.connBandwidth = perConn
+	}
+}
+
+// WithConnectionLimits limits the number of open connections, both in total
+// and per client address. Zero means no limit. Connections over the total
+// limit wait until another connection is closed, while connections of the
+// clients over their limit are closed immediately.
+func WithConnectionLimits(total int, perClient int) Option {
+	return func(s *Server) {
+		s.maxConns = total
+		s.maxClientConns = perClient
+	}
+}
+
+// NewServer creates a new server for the given root directory, which may also
+// be an S3 URL. Image files stored in S3 are not proxied through the server,
+// instead, clients are redirected to their pre-signed URLs.
+func NewServer(rootDir string, options ...Option) (*Server, error) {
+	s := &Server{
+		rootDir:        rootDir,
+		urlTTL:         DefaultURLTTL,
+		requestTimeout: DefaultRequestTimeout,
+		fileMaxAge:     DefaultFileMaxAge,
+	}
+
+	for _, option := range options {
+		option(s)
+	}
+
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Handlers of the same stream version share the cached catalogs.
+	caches := make(map[string]*catalogCache)
+	catalogs := func(streamVersion string) *catalogCache {
+		cache, ok := caches[streamVersion]
+		if !ok {
+			cache = newCatalogCache(b, streamVersion)
+			caches[streamVersion] = cache
+		}
+
+		return cache
+	}
+
+	// ETags of the image files are looked up in the product catalogs of
+	// the default stream version.
+	var items catalogSource
+	if len(s.streamVersions) > 0 {
+		items = catalogs(s.streamVersions[0])
+	}
+
+	s.cache = newHTTPCache(b, items, s.metadataMaxAge, s.fileMaxAge, s.authToken != "")
+
+	var files http.Handler
+	var exists func(name string) bool
+
+	if storage.IsLocal(rootDir) {
+		files = fileHandler(rootDir, s.cache)
+		exists = func(name string) bool {
+			_, err := os.Stat(filepath.Join(rootDir, filepath.FromSlash(name)))
+			return err == nil
+		}
+	} else {
+		if s.urlTTL > storage.MaxPresignTTL {
+			return nil, fmt.Errorf("Pre-signed URL lifetime cannot exceed %s", storage.MaxPresignTTL)
+		}
+
+		files = backendHandler(b, s.urlTTL, s.cache)
+		exists = func(name string) bool {
+			_, err := b.Stat(name)
+			return err == nil
+		}
+	}
+
+	for _, limit := range s.rateLimits {
+		if limit.Rate <= 0 || limit.Burst < 1 {
+			return nil, fmt.Errorf("Rate limit must have a positive rate and burst")
+		}
+	}
+
+	if s.maxBandwidth < 0 || s.connBandwidth < 0 {
+		return nil, fmt.Errorf("Bandwidth limit cannot be negative")
+	}
+
+	if s.maxConns < 0 || s.maxClientConns < 0 {
+		return nil, fmt.Errorf("Connection limit cannot be negative")
+	}
+
+	// Clients are limited across all routes.
+	limiter := newRateLimiter(s.rateLimits)
+
+	// Bandwidth and connections are limited across all listeners.
+	s.bandwidth = newBandwidthLimiter(s.maxBandwidth)
+	s.conns = newConnLimiter(s.maxConns, s.maxClientConns)
+
+	// All routes share the same middlewares, where the first one is
+	// the outermost.
+	withMiddlewares := func(handler http.Handler) http.Handler {
+		return chain(handler,
+			withLogging(),
+			withRecovery(),
+			withAccess(s.downloadAccess, s.adminAccess),
+			withRateLimit(limiter),
+			withAuth(s.authToken),
+			withTimeout(s.requestTimeout),
+			withBandwidthLimit(s.bandwidth),
+			withGzip(),
+			withStreamMetrics(),
+			withStreamRedirects(s.redirects, exists),
+		)
+	}
+
+	s.handler = withMiddlewares(s.newMux(b, files, catalogs, nil))
+
+	if len(s.operations) > 0 || len(s.schedules) > 0 {
+		s.jobs = newJobQueue(s.jobsAudit)
+	}
+
+	if len(s.operations) > 0 {
+		if s.jobsToken == "" {
+			return nil, fmt.Errorf("Jobs API requires an auth token")
+		}
+
+		s.jobsHandler = chain(jobsHandler(s.jobs, s.operations),
+			withLogging(),
+			withRecovery(),
+			withAccess(s.downloadAccess, s.adminAccess),
+			withRateLimit(limiter),
+			withAuth(s.jobsToken),
+			withTimeout(s.requestTimeout),
+		)
+	}
+	s.viewHandlers = make(map[string]http.Handler, len(s.views))
+
+	for _, view := range s.views {
+		_, ok := s.viewHandlers[view.Name]
+		if ok {
+			return nil, fmt.Errorf("Duplicate view %q", view.Name)
+		}
+
+		s.viewHandlers[view.Name] = withMiddlewares(s.newMux(b, files, catalogs, &view))
+	}
+
+	return s, nil
+}
+
+// newMux returns the router of the server. If the view is given, the catalogs
+// and files are filtered by the view.
+func (s *Server) newMux(b storage.Backend, files http.Handler, catalogs func(streamVersion string) *catalogCache, view *View) *http.ServeMux {
+	// Filtered catalogs are shared between the handlers of the view.
+	filtered := make(map[string]catalogSource)
+	source := func(streamVersion string) catalogSource {
+		if view == nil {
+			return catalogs(streamVersion)
+		}
+
+		c, ok := filtered[streamVersion]
+		if !ok {
+			c = &viewCatalogs{source: catalogs(streamVersion), view: *view}
+			filtered[streamVersion] = c
+		}
+
+		return c
+	}
+
+	mux := http.NewServeMux()
+
+	if view == nil {
+		mux.Handle("/", files)
+	} else {
+		mux.Handle("/", viewFilesHandler(source(s.viewVersion), s.viewVersion, files, s.cache))
+	}
+
+	if s.webPageStream != "" {
+		var include func(p stream.Product) bool
+		if view != nil {
+			include = view.includes
+		}
+
+		versions := s.versions(s.webPageVersion)
+		pages := make(map[string]*webPageHandler, len(versions))
+
+		for _, v := range versions {
+			pages[v] = newWebPageHandler(b, v, versions, s.webPageStream, include, s.cache)
+		}
+
+		page := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			streamVersion, ok := selectStreamVersion(w, r, s.webPageVersion, pages)
+			if !ok {
+				return
+			}
+
+			metrics.StreamRequests.Inc(streamVersion, "webpage")
+			pages[streamVersion].ServeHTTP(w, r)
+		})
+
+		mux.Handle("/{$}", page)
+		mux.Handle("/index.html", page)
+	}
+
+	if s.blobVersion != "" {
+		mux.Handle(blobPathPrefix, newBlobHandler(source(s.blobVersion), files))
+	}
+
+	if s.productVersion != "" {
+		catalogs := newVersionedCatalogs(s.versions(s.productVersion), source)
+		mux.Handle(productsPath, productsHandler(catalogs))
+		mux.Handle(deltasPath, deltasHandler(catalogs))
+	}
+
+	if len(s.streamVersions) > 0 {
+		mux.Handle(streamVersionsPath, streamVersionsHandler(b, s.streamVersions))
+	}
+
+	mux.Handle("/metrics", metrics.DefaultRegistry.Handler())
+	mux.Handle("/api/version", versionHandler())
+
+	return mux
+}
+
+// versionHandler returns a handler that responds with the version and the
+// build information of the server.
+func versionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !methodAllowed(w, r) {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(version.Get())
+		if err != nil {
+			slog.Warn("Failed to write version response", "error", err)
+		}
+	})
+}
+
+// ServeHTTP implements http.Handler. Requests are served by the view whose
+// host matches the request's host, if any. Views do not serve the jobs API.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, view := range s.views {
+		if view.matchesHost(r.Host) {
+			s.viewHandlers[view.Name].ServeHTTP(w, r)
+			return
+		}
+	}
+
+	if s.jobsHandler != nil && strings.HasPrefix(r.URL.Path, jobsPathPrefix) {
+		s.jobsHandler.ServeHTTP(w, r)
+		return
+	}
+
+	s.handler.ServeHTTP(w, r)
+}
+
+// ListenAndServe listens on the given address and serves requests until the
+// context is cancelled. Once the context is cancelled, the server is shut down
+// gracefully, waiting up to shutdownTimeout for active connections to finish.
+func (s *Server) ListenAndServe(ctx context.Context, addr string, shutdownTimeout time.Duration) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ctx, listener, shutdownTimeout)
+}
+
+// Serve serves requests on the given listener until the context is cancelled.
+// Scheduled jobs are submitted while the server is serving. Once the server is
+// shut down, the running job is cancelled and the queued jobs are discarded.
+// See ListenAndServe for details.
+func (s *Server) Serve(ctx context.Context, listener net.Listener, shutdownTimeout time.Duration) error {
+	if s.jobs != nil {
+		defer s.jobs.stop()
+	}
+
+	if len(s.schedules) > 0 {
+		scheduleCtx, cancel := context.WithCancel(ctx)
+
+		var wg sync.WaitGroup
+		defer wg.Wait()
+		defer cancel()
+
+		for _, sched := range s.schedules {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.jobs.schedule(scheduleCtx, sched.name, sched.operation, sched.interval)
+			}()
+		}
+	}
+
+	return s.serve(ctx, listener, s, shutdownTimeout)
+}
+
+// ServeView serves requests on the given listener using the view with the
+// given name until the context is cancelled. See ListenAndServe for details.
+func (s *Server) ServeView(ctx context.Context, name string, listener net.Listener, shutdownTimeout time.Duration) error {
+	handler, ok := s.viewHandlers[name]
+	if !ok {
+		return fmt.Errorf("View %q not found", name)
+	}
+
+	return s.serve(ctx, listener, handler, shutdownTimeout)
+}
+
+func (s *Server) serve(ctx context.Context, listener net.Listener, handler http.Handler, shutdownTimeout time.Duration) error {
+	httpServer := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+
+	// Each connection gets its own bandwidth limiter, which is shared by
+	// the requests served over that connection.
+	if s.connBandwidth > 0 {
+		httpServer.ConnContext = func(ctx context.Context, _ net.Conn) context.Context {
+			return context.WithValue(ctx, connLimiterKey{}, newBandwidthLimiter(s.connBandwidth))
+		}
+	}
+
+	listener = limitListener(listener, s.conns)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- httpServer.Serve(listener)
+	}()
+
+	slog.Info("Server started", "address", listener.Addr().String(), "rootDir", s.rootDir, "version", version.Version)
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down server", "address", listener.Addr().String())
+
+	// Use a new context, as the original one is already cancelled.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := httpServer.Shutdown(shutdownCtx)
+	if err != nil {
+		return err
+	}
+
+	err = <-errCh
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
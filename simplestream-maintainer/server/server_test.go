@@ -0,0 +1,1545 @@
+package server_test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/metrics"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/server"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/testutils"
+)
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	files := map[string]string{
+		"streams/v1/index.json":                             `{"format":"index:1.0"}`,
+		"streams/v1/.index.json.tmp":                        `{}`,
+		"images/ubuntu/noble/amd64/cloud/v1/root.squashfs":  "0123456789",
+		"images/ubuntu/noble/amd64/cloud/v1/SHA256SUMS":     "sums",
+		"images/ubuntu/noble/amd64/cloud/.v2/root.squashfs": "hidden",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(rootDir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), os.ModePerm))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+
+	s, err := server.NewServer(rootDir)
+	require.NoError(t, err)
+
+	tests := []struct {
+		Name            string
+		Method          string
+		Path            string
+		Range           string
+		WantStatus      int
+		WantContentType string
+		WantBody        string
+	}{
+		{
+			Name:            "Index file",
+			Path:            "/streams/v1/index.json",
+			WantStatus:      http.StatusOK,
+			WantContentType: "application/json",
+			WantBody:        `{"format":"index:1.0"}`,
+		},
+		{
+			Name:            "Image file",
+			Path:            "/images/ubuntu/noble/amd64/cloud/v1/root.squashfs",
+			WantStatus:      http.StatusOK,
+			WantContentType: "application/octet-stream",
+			WantBody:        "0123456789",
+		},
+		{
+			Name:            "Image file range",
+			Path:            "/images/ubuntu/noble/amd64/cloud/v1/root.squashfs",
+			Range:           "bytes=2-5",
+			WantStatus:      http.StatusPartialContent,
+			WantContentType: "application/octet-stream",
+			WantBody:        "2345",
+		},
+		{
+			Name:            "Checksums file",
+			Path:            "/images/ubuntu/noble/amd64/cloud/v1/SHA256SUMS",
+			WantStatus:      http.StatusOK,
+			WantContentType: "text/plain; charset=utf-8",
+			WantBody:        "sums",
+		},
+		{
+			Name:       "Hidden file",
+			Path:       "/streams/v1/.index.json.tmp",
+			WantStatus: http.StatusNotFound,
+		},
+		{
+			Name:       "Hidden version",
+			Path:       "/images/ubuntu/noble/amd64/cloud/.v2/root.squashfs",
+			WantStatus: http.StatusNotFound,
+		},
+		{
+			Name:       "Missing file",
+			Path:       "/streams/v1/images.json",
+			WantStatus: http.StatusNotFound,
+		},
+		{
+			Name:            "Metrics",
+			Path:            "/metrics",
+			WantStatus:      http.StatusOK,
+			WantContentType: metrics.ContentType,
+		},
+		{
+			Name:            "Version",
+			Path:            "/api/version",
+			WantStatus:      http.StatusOK,
+			WantContentType: "application/json",
+		},
+		{
+			Name:       "Invalid method",
+			Method:     http.MethodPost,
+			Path:       "/streams/v1/index.json",
+			WantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			method := test.Method
+			if method == "" {
+				method = http.MethodGet
+			}
+
+			req := httptest.NewRequest(method, test.Path, nil)
+			if test.Range != "" {
+				req.Header.Set("Range", test.Range)
+			}
+
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+
+			require.Equal(t, test.WantStatus, rec.Code)
+
+			if test.WantContentType != "" {
+				require.Equal(t, test.WantContentType, rec.Header().Get("Content-Type"))
+			}
+
+			if test.WantBody != "" {
+				require.Equal(t, test.WantBody, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestServer_WebPage(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+	catalogPath := filepath.Join(rootDir, "streams", "v1", "images.json")
+
+	writeCatalog := func(release string, modTime time.Time) {
+		catalog := stream.NewCatalog("images", map[string]stream.Product{
+			"ubuntu:" + release + ":amd64:cloud": {
+				OS: "Ubuntu", Distro: "ubuntu", Release: release, Architecture: "amd64", Variant: "cloud",
+				Versions: map[string]stream.Version{
+					"20240101_1200": {Items: map[string]stream.Item{
+						"lxd.tar.xz":    {Ftype: stream.ItemTypeMetadata, Size: 1024},
+						"root.squashfs": {Ftype: stream.ItemTypeSquashfs, Size: 2048},
+					}},
+				},
+			},
+		})
+
+		require.NoError(t, os.MkdirAll(filepath.Dir(catalogPath), os.ModePerm))
+		require.NoError(t, shared.WriteJSONFile(catalogPath, catalog))
+		require.NoError(t, os.Chtimes(catalogPath, modTime, modTime))
+	}
+
+	// Ensure the static index.html is not served in place of the page.
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "index.html"), []byte("static-index-page"), 0644))
+
+	s, err := server.NewServer(rootDir, server.WithWebPage("v1", "images"))
+	require.NoError(t, err)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	// Ensure missing product catalog is reported.
+	require.Equal(t, http.StatusNotFound, get("/").Code)
+
+	writeCatalog("noble", time.Now().Add(-time.Hour))
+
+	for _, path := range []string{"/", "/index.html"} {
+		rec := get(path)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+		require.Contains(t, rec.Body.String(), "noble")
+		require.NotContains(t, rec.Body.String(), "static-index-page")
+	}
+
+	// Ensure the page is refreshed once the product catalog changes.
+	writeCatalog("jammy", time.Now())
+
+	rec := get("/")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "jammy")
+	require.NotContains(t, rec.Body.String(), "noble")
+
+	// Ensure other files are still served.
+	rec = get("/streams/v1/images.json")
+	require.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestServer_Blobs(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	writeStream := func(itemPath string, content string) string {
+		fullPath := filepath.Join(rootDir, itemPath)
+		require.NoError(t, os.MkdirAll(filepath.Dir(fullPath), os.ModePerm))
+		require.NoError(t, os.WriteFile(fullPath, []byte(content), 0644))
+
+		sum := sha256.Sum256([]byte(content))
+		hash := hex.EncodeToString(sum[:])
+
+		catalog := stream.NewCatalog("images", map[string]stream.Product{
+			"ubuntu:noble:amd64:cloud": {
+				Versions: map[string]stream.Version{
+					"01": {Items: map[string]stream.Item{
+						"root.squashfs": {Path: itemPath, SHA256: hash, Size: int64(len(content))},
+					}},
+				},
+			},
+		})
+
+		index := stream.NewStreamIndex()
+		index.AddEntry("images", "streams/v1/images.json", *catalog)
+
+		require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "streams", "v1"), os.ModePerm))
+		require.NoError(t, shared.WriteJSONFile(filepath.Join(rootDir, "streams", "v1", "images.json"), catalog))
+		require.NoError(t, shared.WriteJSONFile(filepath.Join(rootDir, "streams", "v1", "index.json"), index))
+
+		// Ensure the change is detected regardless of the timestamp
+		// granularity.
+		modTime := time.Now().Add(time.Duration(len(content)) * time.Second)
+		require.NoError(t, os.Chtimes(filepath.Join(rootDir, "streams", "v1", "images.json"), modTime, modTime))
+
+		return hash
+	}
+
+	hash := writeStream("images/ubuntu/noble/amd64/cloud/01/root.squashfs", "0123456789")
+
+	s, err := server.NewServer(rootDir, server.WithBlobs("v1"))
+	require.NoError(t, err)
+
+	serve := func(path string, rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Ensure item is served by its hash.
+	rec := serve("/blob/sha256/"+hash, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "0123456789", rec.Body.String())
+	require.Contains(t, rec.Header().Get("Cache-Control"), "immutable")
+
+	rec = serve("/blob/sha256/"+hash, "bytes=2-5")
+	require.Equal(t, http.StatusPartialContent, rec.Code)
+	require.Equal(t, "2345", rec.Body.String())
+
+	// Ensure unknown and invalid hashes are not found.
+	require.Equal(t, http.StatusNotFound, serve("/blob/sha256/"+strings.Repeat("0", 64), "").Code)
+	require.Equal(t, http.StatusNotFound, serve("/blob/sha256/not-a-hash", "").Code)
+
+	// Ensure item is found after the product is renamed.
+	newHash := writeStream("images/ubuntu/noble/amd64/renamed/01/root.squashfs", "renamed-content")
+
+	rec = serve("/blob/sha256/"+newHash, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "renamed-content", rec.Body.String())
+	require.Equal(t, http.StatusNotFound, serve("/blob/sha256/"+hash, "").Code)
+}
+
+func TestServer_ProductsAPI(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	catalog := stream.NewCatalog("images", map[string]stream.Product{
+		"ubuntu:noble:amd64:cloud": {
+			Aliases:      "ubuntu/noble/cloud,ubuntu/24.04/cloud",
+			Architecture: "amd64",
+			Distro:       "ubuntu",
+			OS:           "Ubuntu",
+			Release:      "noble",
+			ReleaseTitle: "24.04 LTS",
+			Variant:      "cloud",
+			Versions: map[string]stream.Version{
+				"20240101_1200": {},
+				"20240102_1200": {},
+			},
+		},
+		"ubuntu:noble:arm64:cloud": {
+			Architecture: "arm64",
+			Distro:       "ubuntu",
+			OS:           "Ubuntu",
+			Release:      "noble",
+			Variant:      "cloud",
+		},
+		"alpine:edge:arm64:default": {
+			Aliases:      "alpine/edge",
+			Architecture: "arm64",
+			Distro:       "alpine",
+			OS:           "Alpine",
+			Release:      "edge",
+			Variant:      "default",
+		},
+	})
+
+	index := stream.NewStreamIndex()
+	index.AddEntry("images", "streams/v1/images.json", *catalog)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "streams", "v1"), os.ModePerm))
+	require.NoError(t, shared.WriteJSONFile(filepath.Join(rootDir, "streams", "v1", "images.json"), catalog))
+	require.NoError(t, shared.WriteJSONFile(filepath.Join(rootDir, "streams", "v1", "index.json"), index))
+
+	publishedAt := time.Date(2024, 1, 2, 12, 30, 0, 0, time.UTC)
+	published := stream.PublishedTimes{}
+	published.Add("ubuntu:noble:amd64:cloud", "20240102_1200", publishedAt)
+	require.NoError(t, stream.WritePublishedTimes(storage.NewLocal(rootDir), "v1", "images", published))
+
+	s, err := server.NewServer(rootDir, server.WithProductsAPI("v1"))
+	require.NoError(t, err)
+
+	query := func(query string) (int, []string) {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/products"+query, nil))
+
+		var products []struct {
+			ID            string               `json:"id"`
+			Versions      []string             `json:"versions"`
+			LatestVersion string               `json:"latest_version"`
+			Published     map[string]time.Time `json:"published"`
+		}
+
+		if rec.Code == http.StatusOK {
+			require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &products))
+		}
+
+		ids := []string{}
+		for _, p := range products {
+			ids = append(ids, p.ID)
+
+			if p.ID == "ubuntu:noble:amd64:cloud" {
+				require.Equal(t, []string{"20240101_1200", "20240102_1200"}, p.Versions)
+				require.Equal(t, "20240102_1200", p.LatestVersion)
+				require.Equal(t, map[string]time.Time{"20240102_1200": publishedAt}, p.Published)
+			}
+		}
+
+		return rec.Code, ids
+	}
+
+	tests := []struct {
+		Query      string
+		WantStatus int
+		WantIDs    []string
+	}{
+		{
+			Query:      "",
+			WantStatus: http.StatusOK,
+			WantIDs:    []string{"alpine:edge:arm64:default", "ubuntu:noble:amd64:cloud", "ubuntu:noble:arm64:cloud"},
+		},
+		{
+			Query:      "?os=ubuntu&release=noble&arch=arm64&variant=cloud",
+			WantStatus: http.StatusOK,
+			WantIDs:    []string{"ubuntu:noble:arm64:cloud"},
+		},
+		{
+			Query:      "?os=Alpine",
+			WantStatus: http.StatusOK,
+			WantIDs:    []string{"alpine:edge:arm64:default"},
+		},
+		{
+			Query:      "?arch=arm64&arch=amd64&stream=images",
+			WantStatus: http.StatusOK,
+			WantIDs:    []string{"alpine:edge:arm64:default", "ubuntu:noble:amd64:cloud", "ubuntu:noble:arm64:cloud"},
+		},
+		{
+			Query:      "?q=24.04",
+			WantStatus: http.StatusOK,
+			WantIDs:    []string{"ubuntu:noble:amd64:cloud"},
+		},
+		{
+			Query:      "?q=ubuntu+ARM64",
+			WantStatus: http.StatusOK,
+			WantIDs:    []string{"ubuntu:noble:arm64:cloud"},
+		},
+		{
+			Query:      "?release=jammy",
+			WantStatus: http.StatusOK,
+			WantIDs:    []string{},
+		},
+		{
+			Query:      "?unknown=value",
+			WantStatus: http.StatusBadRequest,
+			WantIDs:    []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Query, func(t *testing.T) {
+			status, ids := query(test.Query)
+			require.Equal(t, test.WantStatus, status)
+			require.Equal(t, test.WantIDs, ids)
+		})
+	}
+}
+
+func TestServer_DeltasAPI(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	catalog := stream.NewCatalog("images", map[string]stream.Product{
+		"ubuntu:noble:amd64:cloud": {
+			Architecture: "amd64",
+			Distro:       "ubuntu",
+			OS:           "Ubuntu",
+			Release:      "noble",
+			Variant:      "cloud",
+			Versions: map[string]stream.Version{
+				"20240101_1200": {Items: map[string]stream.Item{
+					"rootfs.squashfs": {Ftype: stream.ItemTypeSquashfs, Size: 100},
+				}},
+				"20240102_1200": {Items: map[string]stream.Item{
+					"rootfs.squashfs":      {Ftype: stream.ItemTypeSquashfs, Size: 100},
+					"20240101_1200.vcdiff": {Ftype: stream.ItemTypeSquashfsDelta, Size: 10, DeltaBase: "20240101_1200"},
+				}},
+			},
+		},
+		"alpine:edge:arm64:default": {
+			Architecture: "arm64",
+			Distro:       "alpine",
+			OS:           "Alpine",
+			Release:      "edge",
+			Variant:      "default",
+		},
+	})
+
+	index := stream.NewStreamIndex()
+	index.AddEntry("images", "streams/v1/images.json", *catalog)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "streams", "v1"), os.ModePerm))
+	require.NoError(t, shared.WriteJSONFile(filepath.Join(rootDir, "streams", "v1", "images.json"), catalog))
+	require.NoError(t, shared.WriteJSONFile(filepath.Join(rootDir, "streams", "v1", "index.json"), index))
+
+	s, err := server.NewServer(rootDir, server.WithProductsAPI("v1"))
+	require.NoError(t, err)
+
+	type productDeltas struct {
+		ID       string                          `json:"id"`
+		Versions []string                        `json:"versions"`
+		Deltas   []stream.DeltaEdge              `json:"deltas"`
+		Coverage map[string]stream.DeltaCoverage `json:"coverage"`
+		Upgrades []stream.UpgradePath            `json:"upgrades"`
+	}
+
+	query := func(query string) (int, []productDeltas) {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/deltas"+query, nil))
+
+		var products []productDeltas
+		if rec.Code == http.StatusOK {
+			require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &products))
+		}
+
+		return rec.Code, products
+	}
+
+	status, products := query("?os=ubuntu")
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, products, 1)
+	require.Equal(t, "ubuntu:noble:amd64:cloud", products[0].ID)
+	require.Equal(t, []string{"20240101_1200", "20240102_1200"}, products[0].Versions)
+	require.Equal(t, []stream.DeltaEdge{{
+		Base:     "20240101_1200",
+		Target:   "20240102_1200",
+		ItemType: stream.ItemTypeSquashfs,
+		Size:     10,
+	}}, products[0].Deltas)
+	require.Equal(t, map[string]stream.DeltaCoverage{stream.ItemTypeSquashfs: {Versions: 1, Covered: 1}}, products[0].Coverage)
+	require.Empty(t, products[0].Upgrades)
+
+	status, products = query("?os=ubuntu&from=20240101_1200")
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, products, 1)
+	require.Len(t, products[0].Upgrades, 1)
+	require.Equal(t, "20240102_1200", products[0].Upgrades[0].To)
+	require.Equal(t, products[0].Deltas, products[0].Upgrades[0].Deltas)
+	require.Equal(t, int64(10), products[0].Upgrades[0].Size)
+	require.Equal(t, int64(100), products[0].Upgrades[0].FullSize)
+
+	status, products = query("?from=20240101_1200")
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, products, 2)
+	require.Equal(t, "alpine:edge:arm64:default", products[0].ID)
+	require.Empty(t, products[0].Upgrades)
+
+	status, _ = query("?unknown=value")
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestServer_StreamVersions(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	// Each stream version contains a different product.
+	for streamVersion, id := range map[string]string{"v1": "ubuntu:jammy:amd64:cloud", "v2": "ubuntu:noble:amd64:cloud"} {
+		catalog := stream.NewCatalog("images", map[string]stream.Product{
+			id: {
+				Architecture: "amd64",
+				Distro:       "ubuntu",
+				OS:           "Ubuntu",
+				Release:      strings.Split(id, ":")[1],
+				Variant:      "cloud",
+				Versions: map[string]stream.Version{
+					"01": {Items: map[string]stream.Item{
+						"root.squashfs": {Ftype: stream.ItemTypeSquashfs, Size: 2048},
+					}},
+				},
+			},
+		})
+
+		index := stream.NewStreamIndex()
+		index.AddEntry("images", fmt.Sprintf("streams/%s/images.json", streamVersion), *catalog)
+
+		require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "streams", streamVersion), os.ModePerm))
+		require.NoError(t, shared.WriteJSONFile(filepath.Join(rootDir, "streams", streamVersion, "images.json"), catalog))
+		require.NoError(t, shared.WriteJSONFile(filepath.Join(rootDir, "streams", streamVersion, "index.json"), index))
+	}
+
+	s, err := server.NewServer(rootDir,
+		server.WithWebPage("v1", "images"),
+		server.WithProductsAPI("v1"),
+		server.WithStreamVersions("v1", "v2", "v3"),
+	)
+	require.NoError(t, err)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	// Ensure stream versions are listed along with their indexes.
+	rec := get("/api/streams")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var versions []map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &versions))
+	require.Equal(t, []map[string]any{
+		{"version": "v1", "index_path": "/streams/v1/index.json", "default": true, "available": true},
+		{"version": "v2", "index_path": "/streams/v2/index.json", "default": false, "available": true},
+		{"version": "v3", "index_path": "/streams/v3/index.json", "default": false, "available": false},
+	}, versions)
+
+	// Ensure products API serves the selected stream version.
+	products := func(query string) []string {
+		rec := get("/api/products" + query)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var products []struct {
+			ID string `json:"id"`
+		}
+
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &products))
+
+		ids := []string{}
+		for _, p := range products {
+			ids = append(ids, p.ID)
+		}
+
+		return ids
+	}
+
+	require.Equal(t, []string{"ubuntu:jammy:amd64:cloud"}, products(""))
+	require.Equal(t, []string{"ubuntu:jammy:amd64:cloud"}, products("?stream_version=v1"))
+	require.Equal(t, []string{"ubuntu:noble:amd64:cloud"}, products("?stream_version=v2&release=noble"))
+	require.Equal(t, http.StatusNotFound, get("/api/products?stream_version=v4").Code)
+	require.Equal(t, http.StatusOK, get("/api/deltas?stream_version=v2").Code)
+
+	// Ensure the web page is rendered from the selected stream version,
+	// and allows switching between them.
+	rec = get("/?stream_version=v2")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "noble")
+	require.NotContains(t, rec.Body.String(), "jammy")
+	require.Contains(t, rec.Body.String(), `<option value="v2" selected>Stream v2</option>`)
+	require.Contains(t, rec.Body.String(), `<option value="v1">Stream v1</option>`)
+	require.Equal(t, http.StatusNotFound, get("/?stream_version=v4").Code)
+
+	// Ensure requests are counted per stream version.
+	before := metrics.StreamRequests.Value("v2", "index")
+	require.Equal(t, http.StatusOK, get("/streams/v2/index.json").Code)
+	require.Equal(t, before+1, metrics.StreamRequests.Value("v2", "index"))
+}
+
+func TestServer_Caching(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+	itemPath := "images/ubuntu/noble/amd64/cloud/01/root.squashfs"
+	itemHash := strings.Repeat("a", 64)
+
+	catalog := stream.NewCatalog("images", map[string]stream.Product{
+		"ubuntu:noble:amd64:cloud": {
+			Architecture: "amd64",
+			Distro:       "ubuntu",
+			OS:           "Ubuntu",
+			Release:      "noble",
+			Variant:      "cloud",
+			Versions: map[string]stream.Version{
+				"01": {Items: map[string]stream.Item{
+					"root.squashfs": {Ftype: stream.ItemTypeSquashfs, Path: itemPath, SHA256: itemHash, Size: 10},
+				}},
+			},
+		},
+	})
+
+	index := stream.NewStreamIndex()
+	index.AddEntry("images", "streams/v1/images.json", *catalog)
+
+	indexPath := filepath.Join(rootDir, "streams", "v1", "index.json")
+	require.NoError(t, os.MkdirAll(filepath.Dir(indexPath), os.ModePerm))
+	require.NoError(t, shared.WriteJSONFile(filepath.Join(rootDir, "streams", "v1", "images.json"), catalog))
+	require.NoError(t, shared.WriteJSONFile(indexPath, index))
+	require.NoError(t, os.MkdirAll(filepath.Join(rootDir, filepath.Dir(itemPath)), os.ModePerm))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, itemPath), []byte("0123456789"), 0644))
+
+	s, err := server.NewServer(rootDir,
+		server.WithWebPage("v1", "images"),
+		server.WithStreamVersions("v1"),
+		server.WithCacheMaxAge(0, time.Hour),
+	)
+	require.NoError(t, err)
+
+	serve := func(path string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	indexETag := func() string {
+		content, err := os.ReadFile(indexPath)
+		require.NoError(t, err)
+
+		hash := sha256.Sum256(content)
+		return `"` + hex.EncodeToString(hash[:]) + `"`
+	}
+
+	// Ensure metadata must be revalidated, and its ETag is the hash of
+	// its content.
+	rec := serve("/streams/v1/index.json", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "public, no-cache", rec.Header().Get("Cache-Control"))
+	require.Equal(t, indexETag(), rec.Header().Get("ETag"))
+
+	lastModified := rec.Header().Get("Last-Modified")
+	require.NotEmpty(t, lastModified)
+
+	// Ensure unchanged metadata is not downloaded again.
+	rec = serve("/streams/v1/index.json", map[string]string{"If-None-Match": indexETag()})
+	require.Equal(t, http.StatusNotModified, rec.Code)
+	require.Empty(t, rec.Body.String())
+
+	rec = serve("/streams/v1/index.json", map[string]string{"If-Modified-Since": lastModified})
+	require.Equal(t, http.StatusNotModified, rec.Code)
+
+	// Ensure compressed metadata has a weak ETag, which also matches.
+	rec = serve("/streams/v1/index.json", map[string]string{"Accept-Encoding": "gzip"})
+	require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	require.Equal(t, "W/"+indexETag(), rec.Header().Get("ETag"))
+
+	rec = serve("/streams/v1/index.json", map[string]string{"Accept-Encoding": "gzip", "If-None-Match": "W/" + indexETag()})
+	require.Equal(t, http.StatusNotModified, rec.Code)
+
+	// Ensure changed metadata is downloaded again.
+	oldETag := indexETag()
+	index.AddEntryAt("images", "streams/v1/images.json", *catalog, time.Unix(0, 0))
+	require.NoError(t, shared.WriteJSONFile(indexPath, index))
+
+	rec = serve("/streams/v1/index.json", map[string]string{"If-None-Match": oldETag})
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, indexETag(), rec.Header().Get("ETag"))
+	require.NotEqual(t, oldETag, indexETag())
+
+	// Ensure image files are cached for the configured time, and their
+	// ETag is the hash from the product catalog.
+	rec = serve("/"+itemPath, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "public, max-age=3600", rec.Header().Get("Cache-Control"))
+	require.Equal(t, `"`+itemHash+`"`, rec.Header().Get("ETag"))
+
+	rec = serve("/"+itemPath, map[string]string{"If-None-Match": `"` + itemHash + `"`})
+	require.Equal(t, http.StatusNotModified, rec.Code)
+
+	// Ensure the rendered web page is revalidated as well.
+	rec = serve("/", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "public, no-cache", rec.Header().Get("Cache-Control"))
+
+	etag := rec.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	rec = serve("/", map[string]string{"If-None-Match": etag})
+	require.Equal(t, http.StatusNotModified, rec.Code)
+
+	// Ensure responses of authenticated servers are cached only privately.
+	s, err = server.NewServer(rootDir, server.WithAuthToken("secret"))
+	require.NoError(t, err)
+
+	rec = serve("/streams/v1/index.json", map[string]string{"Authorization": "Bearer secret"})
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "private, no-cache", rec.Header().Get("Cache-Control"))
+}
+
+func TestServer_S3(t *testing.T) {
+	s3Server := httptest.NewServer(testutils.NewFakeS3("bucket"))
+	defer s3Server.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "access")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	rootURL := fmt.Sprintf("s3://bucket/root?endpoint=%s", s3Server.URL)
+
+	b, err := storage.New(rootURL)
+	require.NoError(t, err)
+
+	files := map[string]string{
+		"index.html":            "<html></html>",
+		"streams/v1/index.json": `{"format":"index:1.0"}`,
+		"images/ubuntu/noble/amd64/cloud/v1/root.squashfs":  "0123456789",
+		"images/ubuntu/noble/amd64/cloud/.v2/root.squashfs": "hidden",
+	}
+
+	for name, content := range files {
+		require.NoError(t, storage.WriteFile(b, name, []byte(content)))
+	}
+
+	s, err := server.NewServer(rootURL, server.WithURLTTL(10*time.Minute))
+	require.NoError(t, err)
+
+	serve := func(method string, path string, acceptGzip bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if acceptGzip {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Ensure metadata is served directly.
+	rec := serve(http.MethodGet, "/streams/v1/index.json", false)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	require.Equal(t, `{"format":"index:1.0"}`, rec.Body.String())
+
+	rec = serve(http.MethodGet, "/", false)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "<html></html>", rec.Body.String())
+
+	// Ensure unchanged metadata is not downloaded again.
+	etag := serve(http.MethodGet, "/streams/v1/index.json", false).Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	req := httptest.NewRequest(http.MethodGet, "/streams/v1/index.json", nil)
+	req.Header.Set("If-None-Match", etag)
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusNotModified, rec.Code)
+	require.Empty(t, rec.Body.String())
+
+	// Ensure metadata is compressed if the client accepts it.
+	rec = serve(http.MethodGet, "/streams/v1/index.json", true)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+
+	gz, err := gzip.NewReader(rec.Body)
+	require.NoError(t, err)
+
+	content, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	require.Equal(t, `{"format":"index:1.0"}`, string(content))
+
+	// Ensure proxied files support range requests.
+	serveRange := func(rangeHeader string, ifRange string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/streams/v1/index.json", nil)
+		req.Header.Set("Range", rangeHeader)
+		if ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec = serveRange("bytes=2-7", "")
+	require.Equal(t, http.StatusPartialContent, rec.Code)
+	require.Equal(t, "bytes 2-7/22", rec.Header().Get("Content-Range"))
+	require.Equal(t, "6", rec.Header().Get("Content-Length"))
+	require.Equal(t, `format`, rec.Body.String())
+
+	rec = serveRange("bytes=-4", etag)
+	require.Equal(t, http.StatusPartialContent, rec.Code)
+	require.Equal(t, `.0"}`, rec.Body.String())
+
+	rec = serveRange("bytes=18-", `"outdated"`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, `{"format":"index:1.0"}`, rec.Body.String())
+
+	rec = serveRange("bytes=100-", "")
+	require.Equal(t, http.StatusRequestedRangeNotSatisfiable, rec.Code)
+	require.Equal(t, "bytes */22", rec.Header().Get("Content-Range"))
+
+	// Ensure image files are redirected to the pre-signed URL.
+	rec = serve(http.MethodGet, "/images/ubuntu/noble/amd64/cloud/v1/root.squashfs", false)
+	require.Equal(t, http.StatusTemporaryRedirect, rec.Code)
+
+	location, err := url.Parse(rec.Header().Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, "600", location.Query().Get("X-Amz-Expires"))
+	require.Equal(t, "/bucket/root/images/ubuntu/noble/amd64/cloud/v1/root.squashfs", location.Path)
+
+	resp, err := http.Get(location.String())
+	require.NoError(t, err)
+
+	content, err = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "0123456789", string(content))
+
+	// Ensure hidden and missing files are not found.
+	rec = serve(http.MethodGet, "/images/ubuntu/noble/amd64/cloud/.v2/root.squashfs", false)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = serve(http.MethodGet, "/images/ubuntu/noble/amd64/cloud/v1/missing", false)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	// Ensure the URL lifetime is limited.
+	_, err = server.NewServer(rootURL, server.WithURLTTL(8*24*time.Hour))
+	require.Error(t, err)
+}
+
+func TestServer_PathTraversal(t *testing.T) {
+	t.Parallel()
+
+	s, err := server.NewServer(t.TempDir())
+	require.NoError(t, err)
+
+	// Ensure files outside of the root directory are not served.
+	for _, path := range []string{"/../../etc/passwd", "/streams/../../../etc/passwd"} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		require.NotEqual(t, http.StatusOK, rec.Code)
+	}
+}
+
+func TestServer_GracefulShutdown(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s, err := server.NewServer(t.TempDir())
+	require.NoError(t, err)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Serve(ctx, listener, time.Second)
+	}()
+
+	// Ensure server responds.
+	resp, err := http.Get("http://" + listener.Addr().String() + "/missing")
+	require.NoError(t, err)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Ensure server stops without an error once the context is cancelled.
+	cancel()
+
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "Server did not shut down")
+	}
+}
+
+func TestServer_Views(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	catalog := stream.NewCatalog("images", map[string]stream.Product{
+		"ubuntu:noble:amd64:cloud": {
+			Architecture: "amd64",
+			Distro:       "ubuntu",
+			Release:      "noble",
+			Variant:      "cloud",
+			Versions: map[string]stream.Version{
+				"20240101_1200": {
+					Items: map[string]stream.Item{
+						"root.squashfs": {Path: "images/ubuntu/noble/amd64/cloud/20240101_1200/root.squashfs"},
+					},
+				},
+			},
+		},
+		"ubuntu:noble:arm64:cloud": {
+			Architecture: "arm64",
+			Distro:       "ubuntu",
+			Release:      "noble",
+			Variant:      "cloud",
+			Versions: map[string]stream.Version{
+				"20240101_1200": {
+					Items: map[string]stream.Item{
+						"root.squashfs": {Path: "images/ubuntu/noble/arm64/cloud/20240101_1200/root.squashfs"},
+					},
+				},
+			},
+		},
+	})
+
+	index := stream.NewStreamIndex()
+	index.AddEntry("images", "streams/v1/images.json", *catalog)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "streams", "v1"), os.ModePerm))
+	require.NoError(t, shared.WriteJSONFile(filepath.Join(rootDir, "streams", "v1", "images.json"), catalog))
+	require.NoError(t, shared.WriteJSONFile(filepath.Join(rootDir, "streams", "v1", "index.json"), index))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "streams", "v1", "images.json.gpg"), []byte("signed"), 0644))
+
+	for _, p := range catalog.Products {
+		for _, v := range p.Versions {
+			for _, item := range v.Items {
+				require.NoError(t, os.MkdirAll(filepath.Join(rootDir, filepath.Dir(item.Path)), os.ModePerm))
+				require.NoError(t, os.WriteFile(filepath.Join(rootDir, item.Path), []byte(p.Architecture), 0644))
+			}
+		}
+	}
+
+	views := []server.View{
+		{Name: "edge", Hosts: []string{"edge.example.com"}, Architectures: []string{"arm64"}},
+		{Name: "listener", Architectures: []string{"amd64"}},
+	}
+
+	s, err := server.NewServer(rootDir, server.WithProductsAPI("v1"), server.WithViews("v1", views...))
+	require.NoError(t, err)
+
+	serve := func(host string, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = host
+
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	productIDs := func(rec *httptest.ResponseRecorder) []string {
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var c stream.ProductCatalog
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &c))
+
+		ids := shared.MapKeys(c.Products)
+		slices.Sort(ids)
+		return ids
+	}
+
+	// Main listener serves unfiltered content.
+	require.Equal(t, []string{"ubuntu:noble:amd64:cloud", "ubuntu:noble:arm64:cloud"}, productIDs(serve("example.com", "/streams/v1/images.json")))
+	require.Equal(t, http.StatusOK, serve("example.com", "/images/ubuntu/noble/amd64/cloud/20240101_1200/root.squashfs").Code)
+	require.Equal(t, http.StatusOK, serve("example.com", "/streams/v1/images.json.gpg").Code)
+
+	// View is selected by the host, regardless of the port and case.
+	require.Equal(t, []string{"ubuntu:noble:arm64:cloud"}, productIDs(serve("EDGE.example.com:8443", "/streams/v1/images.json")))
+
+	rec := serve("edge.example.com", "/streams/v1/index.json")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var viewIndex stream.StreamIndex
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &viewIndex))
+	require.Equal(t, []string{"ubuntu:noble:arm64:cloud"}, viewIndex.Index["images"].Products)
+
+	// Files of the excluded products and catalogs that cannot be filtered
+	// are not served by the view.
+	require.Equal(t, http.StatusOK, serve("edge.example.com", "/images/ubuntu/noble/arm64/cloud/20240101_1200/root.squashfs").Code)
+	require.Equal(t, http.StatusNotFound, serve("edge.example.com", "/images/ubuntu/noble/amd64/cloud/20240101_1200/root.squashfs").Code)
+	require.Equal(t, http.StatusNotFound, serve("edge.example.com", "/streams/v1/images.json.gpg").Code)
+
+	// Products API is filtered by the view.
+	rec = serve("edge.example.com", "/api/products")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "ubuntu:noble:arm64:cloud")
+	require.NotContains(t, rec.Body.String(), "ubuntu:noble:amd64:cloud")
+
+	// View is served on a separate listener.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.ServeView(ctx, "listener", listener, time.Second)
+	}()
+
+	get := func(path string) int {
+		resp, err := http.Get("http://" + listener.Addr().String() + path)
+		require.NoError(t, err)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusOK, get("/images/ubuntu/noble/amd64/cloud/20240101_1200/root.squashfs"))
+	require.Equal(t, http.StatusNotFound, get("/images/ubuntu/noble/arm64/cloud/20240101_1200/root.squashfs"))
+
+	cancel()
+	require.NoError(t, <-errCh)
+
+	// Unknown view cannot be served.
+	require.Error(t, s.ServeView(context.Background(), "unknown", listener, time.Second))
+}
+
+func TestServer_Jobs(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	// Jobs API cannot be served without authentication.
+	_, err := server.NewServer(rootDir, server.WithJobs("", map[string]server.Operation{"build": nil}))
+	require.Error(t, err)
+
+	builds := make(chan struct{}, 1)
+	operations := map[string]server.Operation{
+		"build": func(ctx context.Context, _ []byte) (any, error) {
+			builds <- struct{}{}
+			return nil, nil
+		},
+		"prune": func(ctx context.Context, _ []byte) (any, error) {
+			return nil, errors.New("prune failed")
+		},
+		"echo": func(ctx context.Context, input []byte) (any, error) {
+			return map[string]string{"input": string(input)}, nil
+		},
+	}
+
+	audited := make(chan server.Job, 10)
+	audit := func(job server.Job, input []byte) {
+		audited <- job
+	}
+
+	s, err := server.NewServer(rootDir, server.WithAuthToken("read"), server.WithJobs("secret", operations), server.WithJobsAudit(audit))
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	doWithBody := func(method string, path string, token string, body io.Reader) (*http.Response, server.Job) {
+		req, err := http.NewRequest(method, ts.URL+path, body)
+		require.NoError(t, err)
+
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var job server.Job
+		if resp.Header.Get("Content-Type") == "application/json" {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&job))
+		}
+
+		return resp, job
+	}
+
+	do := func(method string, path string, token string) (*http.Response, server.Job) {
+		return doWithBody(method, path, token, nil)
+	}
+
+	// waitJob waits until the job with the given ID finishes.
+	waitJob := func(id string) server.Job {
+		var job server.Job
+
+		require.Eventually(t, func() bool {
+			var resp *http.Response
+			resp, job = do(http.MethodGet, "/api/v1/jobs/"+id, "secret")
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			return job.Status == server.JobSucceeded || job.Status == server.JobFailed
+		}, 5*time.Second, 10*time.Millisecond)
+
+		return job
+	}
+
+	// Ensure jobs API requires its own token.
+	resp, _ := do(http.MethodPost, "/api/v1/build", "")
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, _ = do(http.MethodPost, "/api/v1/build", "read")
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Ensure other routes still require the read token.
+	resp, _ = do(http.MethodGet, "/api/version", "secret")
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// Ensure operations are triggered only by POST requests.
+	resp, _ = do(http.MethodGet, "/api/v1/build", "secret")
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	// Ensure build is queued and finishes successfully.
+	resp, job := do(http.MethodPost, "/api/v1/build", "secret")
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	require.Equal(t, "/api/v1/jobs/"+job.ID, resp.Header.Get("Location"))
+	require.Equal(t, "build", job.Operation)
+	require.NotEmpty(t, job.ID)
+
+	job = waitJob(job.ID)
+	require.Equal(t, server.JobSucceeded, job.Status)
+	require.NotNil(t, job.StartedAt)
+	require.NotNil(t, job.FinishedAt)
+	require.Len(t, builds, 1)
+
+	// Ensure failed job reports the error.
+	_, job = do(http.MethodPost, "/api/v1/prune", "secret")
+
+	job = waitJob(job.ID)
+	require.Equal(t, server.JobFailed, job.Status)
+	require.Equal(t, "prune failed", job.Error)
+	require.Nil(t, job.Result)
+
+	// Ensure finished jobs are audited along with the client that
+	// triggered them.
+	for _, want := range []string{"build", "prune"} {
+		var auditedJob server.Job
+
+		select {
+		case auditedJob = <-audited:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Job %q was not audited", want)
+		}
+
+		require.Equal(t, want, auditedJob.Operation)
+		require.Equal(t, "127.0.0.1", auditedJob.Client)
+	}
+
+	// Ensure request body is passed to the operation, and its result is
+	// served along with the job status.
+	resp, job = doWithBody(http.MethodPost, "/api/v1/echo", "secret", strings.NewReader("plan"))
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	job = waitJob(job.ID)
+	require.Equal(t, server.JobSucceeded, job.Status)
+	require.Equal(t, map[string]any{"input": "plan"}, job.Result)
+
+	// Ensure too large request bodies are rejected.
+	resp, _ = doWithBody(http.MethodPost, "/api/v1/echo", "secret", strings.NewReader(strings.Repeat("x", 16<<20+1)))
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	// Ensure unknown jobs and operations are not found.
+	resp, _ = do(http.MethodGet, "/api/v1/jobs/unknown", "secret")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = do(http.MethodPost, "/api/v1/unknown", "secret")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestServer_Schedule(t *testing.T) {
+	t.Parallel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	runs := make(chan struct{}, 10)
+	build := func(ctx context.Context, _ []byte) (any, error) {
+		runs <- struct{}{}
+		return nil, nil
+	}
+
+	audited := make(chan server.Job, 10)
+	audit := func(job server.Job, input []byte) {
+		audited <- job
+	}
+
+	s, err := server.NewServer(t.TempDir(), server.WithSchedule("build", build, 50*time.Millisecond), server.WithJobsAudit(audit))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Serve(ctx, listener, time.Second)
+	}()
+
+	// Ensure the operation runs repeatedly and is audited on behalf of
+	// the scheduler.
+	for range 2 {
+		select {
+		case <-runs:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Scheduled job did not run")
+		}
+
+		select {
+		case job := <-audited:
+			require.Equal(t, "build", job.Operation)
+			require.Equal(t, server.ScheduledJobClient, job.Client)
+			require.Equal(t, server.JobSucceeded, job.Status)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Scheduled job was not audited")
+		}
+	}
+
+	// Ensure scheduled operations are not exposed through the jobs API.
+	resp, err := http.Post("http://"+listener.Addr().String()+"/api/v1/build", "", nil)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.NotEqual(t, http.StatusAccepted, resp.StatusCode)
+
+	cancel()
+
+	select {
+	case err := <-errCh:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "Server did not shut down")
+	}
+}
+
+func TestServer_AccessLists(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	path := filepath.Join(rootDir, "streams", "v1", "index.json")
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), os.ModePerm))
+	require.NoError(t, os.WriteFile(path, []byte(`{"format":"index:1.0"}`), 0644))
+
+	downloads := server.AccessList{
+		Allow: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8")},
+		Deny:  []netip.Prefix{netip.MustParsePrefix("10.0.5.0/24")},
+	}
+
+	admin := server.AccessList{
+		Allow: []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+	}
+
+	s, err := server.NewServer(rootDir, server.WithAccessLists(downloads, admin))
+	require.NoError(t, err)
+
+	tests := []struct {
+		Name       string
+		RemoteAddr string
+		Path       string
+		WantStatus int
+	}{
+		{
+			Name:       "Allowed download",
+			RemoteAddr: "10.1.2.3:1234",
+			Path:       "/streams/v1/index.json",
+			WantStatus: http.StatusOK,
+		},
+		{
+			Name:       "Allowed download (IPv6)",
+			RemoteAddr: "[fd12::1]:1234",
+			Path:       "/streams/v1/index.json",
+			WantStatus: http.StatusOK,
+		},
+		{
+			Name:       "Allowed download (IPv4-mapped IPv6)",
+			RemoteAddr: "[::ffff:10.1.2.3]:1234",
+			Path:       "/streams/v1/index.json",
+			WantStatus: http.StatusOK,
+		},
+		{
+			Name:       "Denied download",
+			RemoteAddr: "10.0.5.7:1234",
+			Path:       "/streams/v1/index.json",
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:       "Download from network not allowed",
+			RemoteAddr: "192.168.1.1:1234",
+			Path:       "/streams/v1/index.json",
+			WantStatus: http.StatusForbidden,
+		},
+		{
+			Name:       "Allowed admin",
+			RemoteAddr: "10.0.0.1:1234",
+			Path:       "/metrics",
+			WantStatus: http.StatusOK,
+		},
+		{
+			Name:       "Admin from network not allowed",
+			RemoteAddr: "10.1.2.3:1234",
+			Path:       "/metrics",
+			WantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.Path, nil)
+			req.RemoteAddr = test.RemoteAddr
+
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, req)
+
+			require.Equal(t, test.WantStatus, rec.Code)
+		})
+	}
+}
+
+func TestServer_RateLimits(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	// Rate limits require positive rate and burst.
+	_, err := server.NewServer(rootDir, server.WithRateLimits(server.RateLimit{Rate: 0, Burst: 1}))
+	require.Error(t, err)
+
+	limit := server.RateLimit{
+		Networks: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")},
+		Rate:     0.001,
+		Burst:    2,
+	}
+
+	s, err := server.NewServer(rootDir, server.WithRateLimits(limit))
+	require.NoError(t, err)
+
+	get := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/version", nil)
+		req.RemoteAddr = remoteAddr
+
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Ensure the client can make burst requests.
+	require.Equal(t, http.StatusOK, get("192.168.1.1:1000").Code)
+	require.Equal(t, http.StatusOK, get("192.168.1.1:1001").Code)
+
+	// Ensure further requests are rejected.
+	rec := get("192.168.1.1:1002")
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	require.NotEmpty(t, rec.Header().Get("Retry-After"))
+
+	// Ensure other clients from the same network have their own limit.
+	require.Equal(t, http.StatusOK, get("192.168.1.2:1000").Code)
+
+	// Ensure clients from other networks are not limited.
+	for range 5 {
+		require.Equal(t, http.StatusOK, get("10.0.0.1:1000").Code)
+	}
+}
+
+func TestServer_BandwidthLimits(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+	content := strings.Repeat("x", 30000)
+
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "root.squashfs"), []byte(content), 0o644))
+
+	// Bandwidth limits cannot be negative.
+	_, err := server.NewServer(rootDir, server.WithBandwidthLimits(-1, 0))
+	require.Error(t, err)
+
+	download := func(t *testing.T, s *server.Server) time.Duration {
+		t.Helper()
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go func() { _ = s.Serve(ctx, listener, time.Second) }()
+
+		start := time.Now()
+
+		resp, err := http.Get("http://" + listener.Addr().String() + "/root.squashfs")
+		require.NoError(t, err)
+
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, content, string(body))
+
+		return time.Since(start)
+	}
+
+	// Ensure the transfer rate is limited, where the first second of
+	// transfer is allowed at once.
+	t.Run("Total", func(t *testing.T) {
+		t.Parallel()
+
+		s, err := server.NewServer(rootDir, server.WithBandwidthLimits(20000, 0))
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, download(t, s), 400*time.Millisecond)
+	})
+
+	t.Run("Connection", func(t *testing.T) {
+		t.Parallel()
+
+		s, err := server.NewServer(rootDir, server.WithBandwidthLimits(0, 20000))
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, download(t, s), 400*time.Millisecond)
+	})
+}
+
+func TestServer_ConnectionLimits(t *testing.T) {
+	t.Parallel()
+
+	// Connection limits cannot be negative.
+	_, err := server.NewServer(t.TempDir(), server.WithConnectionLimits(0, -1))
+	require.Error(t, err)
+
+	// serve starts the server with the given connection limits and returns
+	// its address.
+	serve := func(t *testing.T, total int, perClient int) string {
+		t.Helper()
+
+		s, err := server.NewServer(t.TempDir(), server.WithConnectionLimits(total, perClient))
+		require.NoError(t, err)
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+
+		go func() { _ = s.Serve(ctx, listener, time.Second) }()
+
+		return listener.Addr().String()
+	}
+
+	// connect opens a keep-alive connection, which is accepted by the server
+	// once the request on it is answered.
+	connect := func(t *testing.T, addr string) net.Conn {
+		t.Helper()
+
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+
+		_, err = conn.Write([]byte("GET /api/version HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err)
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		return conn
+	}
+
+	get := func(addr string) error {
+		client := &http.Client{
+			Timeout:   500 * time.Millisecond,
+			Transport: &http.Transport{DisableKeepAlives: true},
+		}
+
+		resp, err := client.Get("http://" + addr + "/api/version")
+		if err != nil {
+			return err
+		}
+
+		_ = resp.Body.Close()
+		return nil
+	}
+
+	t.Run("Total", func(t *testing.T) {
+		t.Parallel()
+
+		addr := serve(t, 1, 0)
+		conn := connect(t, addr)
+
+		// Ensure the connection over the limit waits.
+		require.Error(t, get(addr))
+
+		// Ensure connections are accepted once the slot is released.
+		_ = conn.Close()
+		require.Eventually(t, func() bool { return get(addr) == nil }, 5*time.Second, 50*time.Millisecond)
+	})
+
+	t.Run("Client", func(t *testing.T) {
+		t.Parallel()
+
+		addr := serve(t, 0, 1)
+		conn := connect(t, addr)
+
+		// Ensure the connection over the client limit is closed.
+		require.Error(t, get(addr))
+
+		// Ensure connections are accepted once the slot is released.
+		_ = conn.Close()
+		require.Eventually(t, func() bool { return get(addr) == nil }, 5*time.Second, 50*time.Millisecond)
+	})
+}
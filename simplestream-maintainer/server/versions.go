@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"path"
+	"slices"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+)
+
+// streamVersionsPath is the URL path of the endpoint listing the served
+// stream versions.
+const streamVersionsPath = "/api/streams"
+
+// streamVersionParam is the query parameter by which clients select the
+// stream version of the web page and products API.
+const streamVersionParam = "stream_version"
+
+// streamVersionInfo is a summary of a single stream version returned by the
+// stream versions endpoint.
+type streamVersionInfo struct {
+	Version   string `json:"version"`
+	IndexPath string `json:"index_path"`
+	Default   bool   `json:"default"`
+	Available bool   `json:"available"`
+}
+
+// versions returns the stream versions served along with the given default
+// stream version, which is always the first one.
+func (s *Server) versions(defaultVersion string) []string {
+	versions := []string{defaultVersion}
+
+	for _, v := range s.streamVersions {
+		if !slices.Contains(versions, v) {
+			versions = append(versions, v)
+		}
+	}
+
+	return versions
+}
+
+// versionedCatalogs provides the product catalogs of multiple stream versions,
+// one of which is used for requests that do not select the stream version.
+type versionedCatalogs struct {
+	defaultVersion string
+	sources        map[string]catalogSource
+}
+
+// newVersionedCatalogs returns the product catalogs of the given stream
+// versions, where the first one is the default.
+func newVersionedCatalogs(versions []string, source func(streamVersion string) catalogSource) versionedCatalogs {
+	c := versionedCatalogs{
+		defaultVersion: versions[0],
+		sources:        make(map[string]catalogSource, len(versions)),
+	}
+
+	for _, v := range versions {
+		c.sources[v] = source(v)
+	}
+
+	return c
+}
+
+// forRequest returns the product catalogs of the stream version selected by
+// the request along with the name of the stream version. If the selected
+// stream version is not served, the request is rejected and false is returned.
+func (c versionedCatalogs) forRequest(w http.ResponseWriter, r *http.Request) (catalogSource, string, bool) {
+	streamVersion, ok := selectStreamVersion(w, r, c.defaultVersion, c.sources)
+	if !ok {
+		return nil, "", false
+	}
+
+	return c.sources[streamVersion], streamVersion, true
+}
+
+// selectStreamVersion returns the stream version selected by the query
+// parameter "stream_version" of the request, or the default stream version
+// if the parameter is not set. If the selected stream version is not among
+// the served ones, the request is rejected with 404 and false is returned.
+func selectStreamVersion[T any](w http.ResponseWriter, r *http.Request, defaultVersion string, served map[string]T) (string, bool) {
+	streamVersion := r.URL.Query().Get(streamVersionParam)
+	if streamVersion == "" {
+		return defaultVersion, true
+	}
+
+	_, ok := served[streamVersion]
+	if !ok {
+		http.Error(w, "Unknown stream version "+streamVersion, http.StatusNotFound)
+		return "", false
+	}
+
+	return streamVersion, true
+}
+
+// streamVersionsHandler lists the given stream versions, where the first one
+// is the default, along with the paths of their indexes. Stream versions
+// whose index does not exist are listed as unavailable.
+func streamVersionsHandler(b storage.Backend, versions []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !methodAllowed(w, r) {
+			return
+		}
+
+		result := make([]streamVersionInfo, 0, len(versions))
+
+		for i, v := range versions {
+			indexPath := path.Join("streams", v, "index.json")
+			_, err := b.Stat(indexPath)
+
+			result = append(result, streamVersionInfo{
+				Version:   v,
+				IndexPath: "/" + indexPath,
+				Default:   i == 0,
+				Available: err == nil,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(result)
+		if err != nil {
+			slog.Warn("Failed to write stream versions response", "error", err)
+		}
+	})
+}
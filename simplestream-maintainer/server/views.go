@@ -0,0 +1,238 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+// View is a filtered view of the simplestream content. Index and product
+// catalogs served by the view contain only the products of the view's
+// architectures, and files of other products are not served.
+type View struct {
+	// Name of the view.
+	Name string
+
+	// Hosts (virtual hosts) whose requests are served by the view. The
+	// port of the request's host is ignored.
+	Hosts []string
+
+	// Architectures of the products included in the view.
+	Architectures []string
+}
+
+// includes returns true if the product is included in the view.
+func (v View) includes(p stream.Product) bool {
+	return slices.Contains(v.Architectures, p.Architecture)
+}
+
+// matchesHost returns true if the given request host is one of the view's
+// hosts.
+func (v View) matchesHost(host string) bool {
+	name, _, err := net.SplitHostPort(host)
+	if err != nil {
+		name = host
+	}
+
+	return slices.ContainsFunc(v.Hosts, func(h string) bool {
+		return strings.EqualFold(h, name)
+	})
+}
+
+// filter returns a copy of the snapshot that contains only the products
+// included in the view. Products are also removed from the index entries,
+// and directories of the removed products are recorded, so that their files
+// are not served.
+func (v View) filter(snapshot *catalogSnapshot) *catalogSnapshot {
+	filtered := &catalogSnapshot{
+		catalogs:     make(map[string]*stream.ProductCatalog, len(snapshot.catalogs)),
+		published:    snapshot.published,
+		generation:   snapshot.generation,
+		excludedDirs: make(map[string]bool),
+	}
+
+	for streamName, catalog := range snapshot.catalogs {
+		products := make(map[string]stream.Product)
+
+		for id, p := range catalog.Products {
+			if v.includes(p) {
+				products[id] = p
+				continue
+			}
+
+			// Product directory is the parent of the version
+			// directories in which the items are located.
+			for _, version := range p.Versions {
+				for _, item := range version.Items {
+					filtered.excludedDirs[path.Dir(path.Dir(item.Path))] = true
+				}
+			}
+		}
+
+		c := *catalog
+		c.Products = products
+		filtered.catalogs[streamName] = &c
+	}
+
+	if snapshot.index != nil {
+		index := *snapshot.index
+		index.Index = make(map[string]stream.StreamIndexEntry, len(snapshot.index.Index))
+
+		for streamName, entry := range snapshot.index.Index {
+			catalog := filtered.catalogs[streamName]
+
+			entry.Products = slices.DeleteFunc(slices.Clone(entry.Products), func(id string) bool {
+				_, ok := catalog.Products[id]
+				return !ok
+			})
+
+			index.Index[streamName] = entry
+		}
+
+		filtered.index = &index
+	}
+
+	return filtered
+}
+
+// excludes returns true if the file on the given path is located within the
+// directory of the product that is filtered out of the view.
+func (s *catalogSnapshot) excludes(name string) bool {
+	for dir := path.Clean(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if s.excludedDirs[dir] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// viewCatalogs provides the product catalogs filtered by the view. Catalogs
+// are filtered again only when the underlying catalogs change.
+type viewCatalogs struct {
+	source catalogSource
+	view   View
+
+	mu       sync.Mutex
+	snapshot *catalogSnapshot
+}
+
+// get returns the snapshot of the filtered product catalogs. Returned
+// snapshot must not be modified.
+func (c *viewCatalogs) get() (*catalogSnapshot, error) {
+	snapshot, err := c.source.get()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.snapshot == nil || c.snapshot.generation != snapshot.generation {
+		c.snapshot = c.view.filter(snapshot)
+		slog.Debug("Filtered product catalogs", "view", c.view.Name)
+	}
+
+	return c.snapshot, nil
+}
+
+// viewFilesHandler serves the files of the view. Index and product catalogs
+// of the given stream version are served from the filtered catalogs. Other
+// files of the stream version, such as signed and compressed catalogs, and
+// all files of other stream versions are not served, because they cannot be
+// filtered. Files of the excluded products are not served either.
+func viewFilesHandler(catalogs catalogSource, streamVersion string, files http.Handler, cache *httpCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !methodAllowed(w, r) {
+			return
+		}
+
+		name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+
+		snapshot, err := catalogs.get()
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("Failed to read product catalogs", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if snapshot == nil {
+			snapshot = &catalogSnapshot{}
+		}
+
+		if path.Dir(path.Dir(name)) == "streams" {
+			if path.Dir(name) != path.Join("streams", streamVersion) {
+				http.NotFound(w, r)
+				return
+			}
+
+			value := findIndexFile(snapshot, name)
+			if value == nil {
+				http.NotFound(w, r)
+				return
+			}
+
+			content, err := json.Marshal(value)
+			if err != nil {
+				slog.Error("Failed to encode filtered catalog", "path", name, "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+
+			content = append(content, '\n')
+			etag := contentETag(content)
+
+			w.Header().Set("Content-Type", contentType(name))
+			w.Header().Set("Cache-Control", cache.cacheControl(name))
+			w.Header().Set("ETag", etag)
+
+			if notModified(w, r, etag, time.Time{}) {
+				return
+			}
+
+			_, err = w.Write(content)
+			if err != nil {
+				slog.Warn("Failed to write filtered catalog", "path", name, "error", err)
+			}
+
+			return
+		}
+
+		if snapshot.excludes(name) {
+			http.NotFound(w, r)
+			return
+		}
+
+		files.ServeHTTP(w, r)
+	})
+}
+
+// findIndexFile returns the filtered index or product catalog that is stored
+// on the given path, or nil if there is no such file.
+func findIndexFile(snapshot *catalogSnapshot, name string) any {
+	if snapshot.index == nil {
+		return nil
+	}
+
+	if path.Base(name) == "index.json" {
+		return snapshot.index
+	}
+
+	for streamName, entry := range snapshot.index.Index {
+		if entry.Path == name {
+			return snapshot.catalogs[streamName]
+		}
+	}
+
+	return nil
+}
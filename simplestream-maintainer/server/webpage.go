@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/webpage"
+)
+
+// webPageHandler serves the web page rendered from the product catalog of a
+// single stream. The rendered page is cached until the product catalog file
+// changes, which is detected from its size and modification time, so that
+// the page is refreshed on every rebuild of the catalog. If the include
+// function is set, only the products for which it returns true are shown.
+type webPageHandler struct {
+	b              storage.Backend
+	streamName     string
+	streamVersion  string
+	streamVersions []string
+	catalogPath    string
+	include        func(p stream.Product) bool
+	cache          *httpCache
+
+	mu      sync.Mutex
+	size    int64
+	modTime time.Time
+	content []byte
+	etag    string
+}
+
+// newWebPageHandler returns a handler that serves the web page of the given
+// stream, optionally showing only the products matching the include function.
+// If multiple stream versions are served, the page links to each of them.
+// Caching headers of the page are set by the given cache.
+func newWebPageHandler(b storage.Backend, streamVersion string, streamVersions []string, streamName string, include func(p stream.Product) bool, cache *httpCache) *webPageHandler {
+	return &webPageHandler{
+		b:              b,
+		streamName:     streamName,
+		streamVersion:  streamVersion,
+		streamVersions: streamVersions,
+		catalogPath:    path.Join("streams", streamVersion, fmt.Sprintf("%s.json", streamName)),
+		include:        include,
+		cache:          cache,
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *webPageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !methodAllowed(w, r) {
+		return
+	}
+
+	content, etag, modTime, err := h.render()
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+
+		slog.Error("Failed to render web page", "streamName", h.streamName, "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", h.cache.cacheControl("index.html"))
+	w.Header().Set("ETag", etag)
+
+	if notModified(w, r, etag, modTime) {
+		return
+	}
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	_, err = w.Write(content)
+	if err != nil {
+		slog.Warn("Failed to serve web page", "streamName", h.streamName, "error", err)
+	}
+}
+
+// render returns the rendered web page along with its ETag and the
+// modification time of the product catalog it was rendered from. The page is rendered again only
+// if the product catalog changed since the last render.
+func (h *webPageHandler) render() ([]byte, string, time.Time, error) {
+	info, err := h.b.Stat(h.catalogPath)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.content != nil && info.Size() == h.size && info.ModTime().Equal(h.modTime) {
+		return h.content, h.etag, h.modTime, nil
+	}
+
+	catalog, err := storage.ReadJSONFile(h.b, h.catalogPath, &stream.ProductCatalog{})
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+
+	if h.include != nil {
+		maps.DeleteFunc(catalog.Products, func(_ string, p stream.Product) bool {
+			return !h.include(p)
+		})
+	}
+
+	page := webpage.NewWebPage(h.streamName, *catalog)
+	page.UpdatedAt = info.ModTime().UTC()
+
+	if len(h.streamVersions) > 1 {
+		page.StreamVersion = h.streamVersion
+		page.StreamVersions = h.streamVersions
+	}
+
+	var buf bytes.Buffer
+
+	err = page.Render(&buf)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+
+	h.content = buf.Bytes()
+	h.etag = contentETag(h.content)
+	h.size = info.Size()
+	h.modTime = info.ModTime()
+
+	slog.Debug("Rendered web page", "streamName", h.streamName, "path", h.catalogPath)
+
+	return h.content, h.etag, h.modTime, nil
+}
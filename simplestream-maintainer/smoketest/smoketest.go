@@ -0,0 +1,160 @@
+// Package smoketest launches images in the local LXD to ensure they boot
+// before they are published.
+package smoketest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// cleanupTimeout is the maximum time to delete the instance and the image
+// once the test finishes.
+const cleanupTimeout = time.Minute
+
+// agentInterval is the interval in which the instance is checked whether it
+// is ready to run commands.
+const agentInterval = 2 * time.Second
+
+// Image contains the local paths of the image files launched by the test.
+type Image struct {
+	// Metadata is the path of the LXD metadata file (lxd.tar.xz).
+	Metadata string
+
+	// RootFS is the path of the root filesystem (squashfs, tarball, or qcow2).
+	RootFS string
+
+	// VM indicates whether the image is launched as a virtual machine.
+	VM bool
+}
+
+// Tester launches instances using the LXD client and runs the test command
+// within them.
+type Tester struct {
+	// Client is the path of the LXD client (lxc).
+	Client string
+
+	// Command that must exit with zero within the instance.
+	Command []string
+
+	// Timeout is the maximum time to launch and test a single instance.
+	// Zero means no limit.
+	Timeout time.Duration
+}
+
+// Test imports the image, launches an instance from it, and runs the command
+// within the instance once it is ready. The instance and the image are
+// removed afterwards, regardless of the result.
+func (t Tester) Test(ctx context.Context, image Image) error {
+	if len(t.Command) == 0 {
+		return fmt.Errorf("Smoke test command is not set")
+	}
+
+	name, err := instanceName()
+	if err != nil {
+		return err
+	}
+
+	if t.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+		defer cancel()
+	}
+
+	err = t.lxc(ctx, "image", "import", image.Metadata, image.RootFS, "--alias", name)
+	if err != nil {
+		return fmt.Errorf("Failed to import image: %w", err)
+	}
+
+	defer t.cleanup(ctx, "image", "delete", name)
+
+	launchArgs := []string{"launch", name, name}
+	if image.VM {
+		launchArgs = append(launchArgs, "--vm")
+	}
+
+	err = t.lxc(ctx, launchArgs...)
+
+	// Instance may exist even if it failed to start.
+	defer t.cleanup(ctx, "delete", "--force", name)
+
+	if err != nil {
+		return fmt.Errorf("Failed to launch instance: %w", err)
+	}
+
+	err = t.waitReady(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	err = t.lxc(ctx, append([]string{"exec", name, "--"}, t.Command...)...)
+	if err != nil {
+		return fmt.Errorf("Command %q failed: %w", strings.Join(t.Command, " "), err)
+	}
+
+	return nil
+}
+
+// waitReady waits until the commands can be run within the instance, which
+// for virtual machines requires the LXD agent to start.
+func (t Tester) waitReady(ctx context.Context, name string) error {
+	for {
+		err := t.lxc(ctx, "exec", name, "--", "true")
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Instance is not ready: %w", errors.Join(ctx.Err(), err))
+		case <-time.After(agentInterval):
+		}
+	}
+}
+
+// cleanup runs the LXD client to remove the test resources. It runs even if
+// the given context is already done.
+func (t Tester) cleanup(ctx context.Context, args ...string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+
+	err := t.lxc(ctx, args...)
+	if err != nil {
+		slog.Warn("Failed to clean up after smoke test", "error", err)
+	}
+}
+
+// lxc runs the LXD client with the given arguments. Returned error includes
+// the output of the failed command.
+func (t Tester) lxc(ctx context.Context, args ...string) error {
+	out, err := exec.CommandContext(ctx, t.Client, args...).CombinedOutput()
+	if err != nil {
+		msg := strings.TrimSpace(string(out))
+		if msg == "" {
+			return err
+		}
+
+		return fmt.Errorf("%w (%s)", err, msg)
+	}
+
+	return nil
+}
+
+// instanceName returns the random name of the test instance, which is also
+// the alias of the imported image.
+func instanceName() (string, error) {
+	buf := make([]byte, 6)
+
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return "smoke-test-" + hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,133 @@
+package smoketest_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/smoketest"
+)
+
+// fakeClient writes the fake LXD client, which records its arguments into the
+// returned log file and fails if the subcommand matches the given failing
+// one (for example, "launch").
+func fakeClient(t *testing.T, failing string) (string, string) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "log")
+	clientPath := filepath.Join(dir, "lxc")
+
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$*" >> %q
+case "$*" in
+%s) echo "Error: boom" >&2; exit 1 ;;
+esac
+`, logPath, failing)
+
+	require.NoError(t, os.WriteFile(clientPath, []byte(script), 0755))
+	return clientPath, logPath
+}
+
+// readLog returns the recorded calls with the random instance name replaced
+// by "NAME".
+func readLog(t *testing.T, logPath string) []string {
+	content, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+
+	content = regexp.MustCompile(`smoke-test-[0-9a-f]+`).ReplaceAll(content, []byte("NAME"))
+	return strings.Split(strings.TrimSpace(string(content)), "\n")
+}
+
+func TestTester(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Name      string
+		Failing   string
+		VM        bool
+		WantErr   string
+		WantCalls []string
+	}{
+		{
+			Name: "Container",
+			WantCalls: []string{
+				"image import meta.tar.xz root.squashfs --alias NAME",
+				"launch NAME NAME",
+				"exec NAME -- true",
+				"exec NAME -- cloud-init status --wait",
+				"delete --force NAME",
+				"image delete NAME",
+			},
+		},
+		{
+			Name:    "Virtual machine with failing command",
+			Failing: "exec*cloud-init*",
+			VM:      true,
+			WantErr: `Command "cloud-init status --wait" failed: exit status 1 (Error: boom)`,
+			WantCalls: []string{
+				"image import meta.tar.xz root.squashfs --alias NAME",
+				"launch NAME NAME --vm",
+				"exec NAME -- true",
+				"exec NAME -- cloud-init status --wait",
+				"delete --force NAME",
+				"image delete NAME",
+			},
+		},
+		{
+			Name:    "Failing launch",
+			Failing: "launch*",
+			WantErr: "Failed to launch instance",
+			WantCalls: []string{
+				"image import meta.tar.xz root.squashfs --alias NAME",
+				"launch NAME NAME",
+				"delete --force NAME",
+				"image delete NAME",
+			},
+		},
+		{
+			Name:    "Failing import",
+			Failing: "image\\ import*",
+			WantErr: "Failed to import image",
+			WantCalls: []string{
+				"image import meta.tar.xz root.squashfs --alias NAME",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			t.Parallel()
+
+			failing := test.Failing
+			if failing == "" {
+				failing = "never"
+			}
+
+			client, logPath := fakeClient(t, failing)
+
+			tester := smoketest.Tester{
+				Client:  client,
+				Command: []string{"cloud-init", "status", "--wait"},
+			}
+
+			err := tester.Test(context.Background(), smoketest.Image{
+				Metadata: "meta.tar.xz",
+				RootFS:   "root.squashfs",
+				VM:       test.VM,
+			})
+
+			if test.WantErr != "" {
+				require.ErrorContains(t, err, test.WantErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			require.Equal(t, test.WantCalls, readLog(t, logPath))
+		})
+	}
+}
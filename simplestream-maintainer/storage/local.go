@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// Local is the backend that stores files within the local directory.
+type Local struct {
+	root string
+}
+
+// NewLocal returns the backend for the local directory on the given path.
+func NewLocal(root string) *Local {
+	return &Local{root: root}
+}
+
+// Path returns the local path of the file with the given name.
+func (l *Local) Path(name string) string {
+	return filepath.Join(l.root, filepath.FromSlash(name))
+}
+
+// Open implements Backend.
+func (l *Local) Open(name string) (io.ReadCloser, error) {
+	return os.Open(l.Path(name))
+}
+
+// Stat implements Backend.
+func (l *Local) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(l.Path(name))
+}
+
+// List implements Backend.
+func (l *Local) List(name string) ([]fs.FileInfo, error) {
+	entries, err := os.ReadDir(l.Path(name))
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]fs.FileInfo, 0, len(entries))
+
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// File was removed in the meantime.
+				continue
+			}
+
+			return nil, err
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// Write implements Backend. Content is written to a temporary file that is
+// located next to the final file and is prefixed with a dot to hide it. Once
+// written and synced, the temporary file is moved to the final destination.
+func (l *Local) Write(name string, r io.Reader) error {
+	path := l.Path(name)
+
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	return shared.AtomicWriteFile(path, r, 0644)
+}
+
+// Rename implements Backend.
+func (l *Local) Rename(oldName string, newName string) error {
+	newPath := l.Path(newName)
+
+	err := os.MkdirAll(filepath.Dir(newPath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(l.Path(oldName), newPath)
+}
+
+// Delete implements Backend.
+func (l *Local) Delete(name string) error {
+	return os.RemoveAll(l.Path(name))
+}
+
+// Chtimes implements TimeSetter. Access time is set to the modification time.
+func (l *Local) Chtimes(name string, modTime time.Time) error {
+	return filepath.WalkDir(l.Path(name), func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		return os.Chtimes(path, modTime, modTime)
+	})
+}
+
+// Link replaces the file with the new name with a hard link to the file with
+// the old name. The link is created under a temporary name first, so that the
+// file is replaced atomically.
+func (l *Local) Link(oldName string, newName string) error {
+	newPath := l.Path(newName)
+	tempPath := filepath.Join(filepath.Dir(newPath), fmt.Sprintf(".%s.link.tmp", filepath.Base(newPath)))
+
+	_ = os.Remove(tempPath)
+
+	err := os.Link(l.Path(oldName), tempPath)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tempPath, newPath)
+	if err != nil {
+		_ = os.Remove(tempPath)
+		return err
+	}
+
+	return nil
+}
+
+// Reflink replaces the file with the new name with a copy-on-write clone of
+// the file with the old name, which shares its data blocks. Unlike hard links,
+// the files remain independent (e.g. in their modification times). The clone
+// is created under a temporary name first, so that the file is replaced
+// atomically. If the filesystem does not support cloning, an error wrapping
+// errors.ErrUnsupported is returned.
+func (l *Local) Reflink(oldName string, newName string) error {
+	newPath := l.Path(newName)
+	tempPath := filepath.Join(filepath.Dir(newPath), fmt.Sprintf(".%s.reflink.tmp", filepath.Base(newPath)))
+
+	info, err := os.Stat(newPath)
+	if err != nil {
+		return err
+	}
+
+	src, err := os.Open(l.Path(oldName))
+	if err != nil {
+		return err
+	}
+
+	defer src.Close()
+
+	dst, err := os.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tempPath)
+
+	err = shared.CloneFile(dst, src)
+	if err != nil {
+		_ = dst.Close()
+		return fmt.Errorf("Failed to clone file %q: %w", oldName, err)
+	}
+
+	err = dst.Close()
+	if err != nil {
+		return err
+	}
+
+	// Preserve modification time of the replaced file, as its content
+	// does not change.
+	err = os.Chtimes(tempPath, info.ModTime(), info.ModTime())
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, newPath)
+}
+
+// move moves the local file on the given path to the file with the given
+// name and sets its read permissions. If the local file is on a different
+// filesystem, it is copied instead.
+func (l *Local) move(localPath string, name string) error {
+	path := l.Path(name)
+
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	return shared.AtomicMoveFile(localPath, path, 0644)
+}
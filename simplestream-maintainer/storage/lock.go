@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrLockNotSupported is returned when the backend does not support locking.
+var ErrLockNotSupported = errors.New("Locking is not supported by the storage backend")
+
+// lockRetryInterval is the interval in which the lock is retried while it is
+// held by another process.
+var lockRetryInterval = 500 * time.Millisecond
+
+// Lock acquires the exclusive advisory lock on the file with the given name,
+// which is created if it does not exist. If the lock is held by another
+// process, Lock waits until it is released, the timeout expires, or the
+// context is cancelled. Zero timeout means the lock is tried only once. The
+// returned function releases the lock.
+//
+// Only the local backend supports locking, for other backends an error
+// wrapping ErrLockNotSupported is returned.
+func Lock(ctx context.Context, b Backend, name string, timeout time.Duration) (func(), error) {
+	l, ok := b.(*Local)
+	if !ok {
+		return nil, ErrLockNotSupported
+	}
+
+	lockPath := l.Path(name)
+
+	err := os.MkdirAll(filepath.Dir(lockPath), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	for {
+		err = unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			break
+		}
+
+		if !errors.Is(err, unix.EWOULDBLOCK) {
+			_ = file.Close()
+			return nil, fmt.Errorf("Failed to lock %q: %w", name, err)
+		}
+
+		if !time.Now().Before(deadline) {
+			_ = file.Close()
+			return nil, fmt.Errorf("Timed out after %s waiting for lock %q", timeout, name)
+		}
+
+		select {
+		case <-ctx.Done():
+			_ = file.Close()
+			return nil, ctx.Err()
+		case <-time.After(min(lockRetryInterval, time.Until(deadline))):
+		}
+	}
+
+	unlock := func() {
+		_ = unix.Flock(int(file.Fd()), unix.LOCK_UN)
+		_ = file.Close()
+	}
+
+	return unlock, nil
+}
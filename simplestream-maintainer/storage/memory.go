@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/clock"
+)
+
+// SchemeMemory is the URL scheme of the in-memory backend.
+const SchemeMemory = "mem"
+
+// memoryBackends contains the in-memory backends by their roots.
+var memoryBackends sync.Map
+
+// memoryBackendID is the ID of the last created in-memory backend.
+var memoryBackendID atomic.Int64
+
+// Memory is the backend that stores files in memory, which allows the code
+// that accepts the root directory to be tested without touching the disk.
+// The backend is referred to by the root returned from Root. Modification
+// times of the files are taken from the clock. Like with S3, directories
+// exist implicitly as long as they contain any file.
+type Memory struct {
+	root  string
+	clock clock.Clock
+
+	mu    sync.Mutex
+	files map[string]memoryFile
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemory returns a new empty in-memory backend whose files are stamped
+// with the time of the given clock. If clock is nil, the system clock is
+// used. The backend remains available through its root until it is closed.
+func NewMemory(c clock.Clock) *Memory {
+	if c == nil {
+		c = clock.System
+	}
+
+	m := &Memory{
+		root:  fmt.Sprintf("%s://%d", SchemeMemory, memoryBackendID.Add(1)),
+		clock: c,
+		files: make(map[string]memoryFile),
+	}
+
+	memoryBackends.Store(m.root, m)
+	return m
+}
+
+// lookupMemory returns the in-memory backend with the given root.
+func lookupMemory(root string) (*Memory, error) {
+	m, ok := memoryBackends.Load(root)
+	if !ok {
+		return nil, fmt.Errorf("In-memory storage %q does not exist", root)
+	}
+
+	return m.(*Memory), nil
+}
+
+// Root returns the root that refers to the backend, such as "mem://1".
+func (m *Memory) Root() string {
+	return m.root
+}
+
+// Close removes the backend, so that it can no longer be referred to by its
+// root.
+func (m *Memory) Close() {
+	memoryBackends.Delete(m.root)
+}
+
+// Chtimes implements TimeSetter.
+func (m *Memory) Chtimes(name string, modTime time.Time) error {
+	name = memoryName(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	found := false
+
+	for key, file := range m.files {
+		if key == name || isWithin(key, name) {
+			file.modTime = modTime
+			m.files[key] = file
+			found = true
+		}
+	}
+
+	if !found {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return nil
+}
+
+// Open implements Backend.
+func (m *Memory) Open(name string) (io.ReadCloser, error) {
+	name = memoryName(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return io.NopCloser(bytes.NewReader(file.data)), nil
+}
+
+// Stat implements Backend.
+func (m *Memory) Stat(name string) (fs.FileInfo, error) {
+	name = memoryName(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, ok := m.files[name]
+	if ok {
+		return fileInfo{name: path.Base(name), size: int64(len(file.data)), modTime: file.modTime}, nil
+	}
+
+	info := fileInfo{name: path.Base(name), isDir: true}
+	found := false
+
+	for key, file := range m.files {
+		if !isWithin(key, name) {
+			continue
+		}
+
+		found = true
+
+		if file.modTime.After(info.modTime) {
+			info.modTime = file.modTime
+		}
+	}
+
+	if !found && name != "" {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return info, nil
+}
+
+// List implements Backend.
+func (m *Memory) List(name string) ([]fs.FileInfo, error) {
+	name = memoryName(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entries := make(map[string]fileInfo)
+
+	for key, file := range m.files {
+		if !isWithin(key, name) {
+			continue
+		}
+
+		child, _, isDir := strings.Cut(strings.TrimPrefix(key, dirPrefix(name)), "/")
+
+		entry, ok := entries[child]
+		if !ok {
+			entry = fileInfo{name: child, isDir: isDir}
+		}
+
+		if !isDir {
+			entry.size = int64(len(file.data))
+		}
+
+		if file.modTime.After(entry.modTime) {
+			entry.modTime = file.modTime
+		}
+
+		entries[child] = entry
+	}
+
+	if len(entries) == 0 && name != "" {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		infos = append(infos, entry)
+	}
+
+	slices.SortFunc(infos, func(a fs.FileInfo, b fs.FileInfo) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	return infos, nil
+}
+
+// Write implements Backend.
+func (m *Memory) Write(name string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	name = memoryName(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.files[name] = memoryFile{data: data, modTime: m.clock.Now()}
+	return nil
+}
+
+// Rename implements Backend. Directories are renamed along with their
+// contents.
+func (m *Memory) Rename(oldName string, newName string) error {
+	oldName = memoryName(oldName)
+	newName = memoryName(newName)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, ok := m.files[oldName]
+	if ok {
+		delete(m.files, oldName)
+		m.files[newName] = file
+		return nil
+	}
+
+	found := false
+
+	for key, file := range m.files {
+		if !isWithin(key, oldName) {
+			continue
+		}
+
+		delete(m.files, key)
+		m.files[path.Join(newName, strings.TrimPrefix(key, dirPrefix(oldName)))] = file
+		found = true
+	}
+
+	if !found {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrNotExist}
+	}
+
+	return nil
+}
+
+// Delete implements Backend.
+func (m *Memory) Delete(name string) error {
+	name = memoryName(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key := range m.files {
+		if key == name || isWithin(key, name) {
+			delete(m.files, key)
+		}
+	}
+
+	return nil
+}
+
+// memoryName returns the cleaned name of the file, where an empty name refers
+// to the root.
+func memoryName(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+// isWithin returns true if the file with the given name is located within the
+// directory with the given name.
+func isWithin(name string, dir string) bool {
+	return strings.HasPrefix(name, dirPrefix(dir))
+}
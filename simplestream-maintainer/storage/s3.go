@@ -0,0 +1,512 @@
+package storage
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/version"
+)
+
+// SchemeS3 is the URL scheme of the S3 backend.
+const SchemeS3 = "s3"
+
+// S3 is the backend that stores files as objects within the S3 bucket. Object
+// keys are file names prefixed with the configured prefix. Directories are not
+// stored, instead, they are derived from the object keys.
+type S3 struct {
+	bucket    string
+	prefix    string
+	endpoint  *url.URL
+	pathStyle bool
+
+	signer *signer
+	client *http.Client
+}
+
+// NewS3 returns the backend for the S3 URL in the format "s3://bucket/prefix".
+//
+// Credentials are read from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and
+// AWS_SESSION_TOKEN environment variables. The region is set using either the
+// "region" URL query parameter or the AWS_REGION environment variable, and
+// defaults to us-east-1. S3 compatible object stores can be used by setting
+// their endpoint using either the "endpoint" URL query parameter or the
+// AWS_ENDPOINT_URL environment variable.
+func NewS3(rawURL string) (*S3, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid S3 URL %q: %w", rawURL, err)
+	}
+
+	if u.Scheme != SchemeS3 || u.Host == "" {
+		return nil, fmt.Errorf("Invalid S3 URL %q: expected format %s://bucket/prefix", rawURL, SchemeS3)
+	}
+
+	query := u.Query()
+
+	region := firstNonEmpty(query.Get("region"), os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+	endpoint := firstNonEmpty(query.Get("endpoint"), os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL"))
+
+	s := &S3{
+		bucket: u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+		signer: &signer{
+			accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			region:       region,
+			now:          time.Now,
+		},
+		client: http.DefaultClient,
+	}
+
+	if endpoint != "" {
+		// Custom endpoints do not necessarily support virtual-hosted
+		// style requests.
+		s.endpoint, err = url.Parse(endpoint)
+		if err != nil || s.endpoint.Host == "" {
+			return nil, fmt.Errorf("Invalid S3 endpoint %q", endpoint)
+		}
+
+		s.pathStyle = true
+	} else {
+		// Bucket names that contain dots are not valid host names for
+		// TLS certificates of the virtual-hosted style requests.
+		s.endpoint = &url.URL{Scheme: "https", Host: fmt.Sprintf("s3.%s.amazonaws.com", region)}
+		s.pathStyle = strings.Contains(s.bucket, ".")
+	}
+
+	return s, nil
+}
+
+// PresignURL implements Presigner. If credentials are not set, the returned
+// URL is not signed, which is suitable only for publicly readable buckets.
+func (s *S3) PresignURL(name string, ttl time.Duration) (string, error) {
+	if ttl < time.Second || ttl > MaxPresignTTL {
+		return "", fmt.Errorf("Pre-signed URL lifetime must be between 1s and %s", MaxPresignTTL)
+	}
+
+	host, escapedPath := s.location(s.key(name))
+
+	query := make(map[string]string)
+	s.signer.presign(http.MethodGet, host, escapedPath, query, ttl)
+
+	rawURL := fmt.Sprintf("%s://%s%s", s.endpoint.Scheme, host, escapedPath)
+	if len(query) > 0 {
+		rawURL += "?" + canonicalQuery(query)
+	}
+
+	return rawURL, nil
+}
+
+// Open implements Backend.
+func (s *S3) Open(name string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, s.key(name), nil, nil, nil, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return resp.Body, nil
+}
+
+// Stat implements Backend. Directory's modification time is the modification
+// time of the most recently modified object within the directory.
+func (s *S3) Stat(name string) (fs.FileInfo, error) {
+	key := s.key(name)
+
+	if key != s.prefix {
+		resp, err := s.do(http.MethodHead, key, nil, nil, nil, 0)
+		if err == nil {
+			_ = resp.Body.Close()
+
+			modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+
+			return fileInfo{name: path.Base(name), size: resp.ContentLength, modTime: modTime}, nil
+		}
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+		}
+	}
+
+	// Object does not exist, check whether any object exists within the
+	// directory with the same name.
+	info := fileInfo{name: path.Base(name), isDir: true}
+	found := false
+
+	err := s.list(dirPrefix(key), "", func(result listResult) error {
+		for _, o := range result.Contents {
+			found = true
+
+			if o.LastModified.After(info.modTime) {
+				info.modTime = o.LastModified
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	if !found && key != s.prefix {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return info, nil
+}
+
+// List implements Backend.
+func (s *S3) List(name string) ([]fs.FileInfo, error) {
+	key := s.key(name)
+	prefix := dirPrefix(key)
+
+	var infos []fs.FileInfo
+
+	err := s.list(prefix, "/", func(result listResult) error {
+		for _, p := range result.CommonPrefixes {
+			dirName := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/")
+			infos = append(infos, fileInfo{name: dirName, isDir: true})
+		}
+
+		for _, o := range result.Contents {
+			// Skip directory markers.
+			if o.Key == prefix || strings.HasSuffix(o.Key, "/") {
+				continue
+			}
+
+			infos = append(infos, fileInfo{name: strings.TrimPrefix(o.Key, prefix), size: o.Size, modTime: o.LastModified})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: "list", Path: name, Err: err}
+	}
+
+	// Directory exists only if it contains at least one object, except
+	// for the root directory.
+	if len(infos) == 0 && key != s.prefix {
+		return nil, &fs.PathError{Op: "list", Path: name, Err: fs.ErrNotExist}
+	}
+
+	slices.SortFunc(infos, func(a fs.FileInfo, b fs.FileInfo) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	return infos, nil
+}
+
+// Write implements Backend. Objects are replaced atomically by S3 itself. If
+// the size of the content cannot be determined in advance, the content is
+// first written to a local temporary file.
+func (s *S3) Write(name string, r io.Reader) error {
+	var size int64
+
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		size = int64(v.Len())
+
+	case *os.File:
+		info, err := v.Stat()
+		if err != nil {
+			return err
+		}
+
+		size = info.Size()
+
+	default:
+		file, err := os.CreateTemp("", ".s3-upload.*.tmp")
+		if err != nil {
+			return err
+		}
+
+		defer os.Remove(file.Name())
+		defer file.Close()
+
+		size, err = io.Copy(file, r)
+		if err != nil {
+			return err
+		}
+
+		_, err = file.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+
+		r = file
+	}
+
+	resp, err := s.do(http.MethodPut, s.key(name), nil, nil, io.NopCloser(r), size)
+	if err != nil {
+		return &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+
+	return resp.Body.Close()
+}
+
+// Rename implements Backend. The object is copied to the new key, after
+// which the old object is deleted.
+func (s *S3) Rename(oldName string, newName string) error {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", fmt.Sprintf("/%s/%s", s.bucket, uriEncode(s.key(oldName), false)))
+
+	resp, err := s.do(http.MethodPut, s.key(newName), nil, header, nil, 0)
+	if err != nil {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: err}
+	}
+
+	defer resp.Body.Close()
+
+	// Copy may fail after the response status is already sent, in which
+	// case the error is returned in the response body.
+	err = checkCopyResult(resp.Body)
+	if err != nil {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: err}
+	}
+
+	return s.deleteObject(s.key(oldName))
+}
+
+// Delete implements Backend.
+func (s *S3) Delete(name string) error {
+	key := s.key(name)
+
+	if key != s.prefix {
+		err := s.deleteObject(key)
+		if err != nil {
+			return &fs.PathError{Op: "delete", Path: name, Err: err}
+		}
+	}
+
+	// Delete objects within the directory with the same name.
+	var keys []string
+
+	err := s.list(dirPrefix(key), "", func(result listResult) error {
+		for _, o := range result.Contents {
+			keys = append(keys, o.Key)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return &fs.PathError{Op: "delete", Path: name, Err: err}
+	}
+
+	for _, k := range keys {
+		err := s.deleteObject(k)
+		if err != nil {
+			return &fs.PathError{Op: "delete", Path: name, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// deleteObject deletes the object with the given key. Deleting non-existing
+// object is not an error.
+func (s *S3) deleteObject(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil, nil, 0)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// listResult is the result of the ListObjectsV2 request.
+type listResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+// list lists the objects with the given key prefix and calls the function
+// for each page of the results. If the delimiter is set, keys that contain
+// the delimiter after the prefix are grouped into common prefixes.
+func (s *S3) list(prefix string, delimiter string, fn func(result listResult) error) error {
+	query := map[string]string{
+		"list-type": "2",
+		"prefix":    prefix,
+	}
+
+	if delimiter != "" {
+		query["delimiter"] = delimiter
+	}
+
+	for {
+		resp, err := s.do(http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return err
+		}
+
+		var result listResult
+
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		_ = resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to decode list response: %w", err)
+		}
+
+		err = fn(result)
+		if err != nil {
+			return err
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+
+		query["continuation-token"] = result.NextContinuationToken
+	}
+}
+
+// do sends the signed request for the object with the given key, or for the
+// bucket if the key is empty. Unsuccessful responses are converted into
+// errors, where missing objects are reported as fs.ErrNotExist.
+func (s *S3) do(method string, key string, query map[string]string, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	host, escapedPath := s.location(key)
+
+	rawURL := fmt.Sprintf("%s://%s%s", s.endpoint.Scheme, host, escapedPath)
+	if len(query) > 0 {
+		rawURL += "?" + canonicalQuery(query)
+	}
+
+	// Request with non-nil body and zero content length would be sent
+	// using chunked encoding, which is not supported by S3.
+	if size == 0 {
+		body = nil
+	}
+
+	req, err := http.NewRequest(method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.ContentLength = size
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	req.Header.Set("User-Agent", version.UserAgent())
+
+	s.signer.sign(req)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fs.ErrNotExist
+	}
+
+	return nil, responseError(resp)
+}
+
+// location returns the host and the escaped path of the object with the given
+// key, or of the bucket if the key is empty.
+func (s *S3) location(key string) (host string, escapedPath string) {
+	if !s.pathStyle {
+		return fmt.Sprintf("%s.%s", s.bucket, s.endpoint.Host), "/" + uriEncode(key, false)
+	}
+
+	escapedPath = "/" + uriEncode(s.bucket, true)
+	if key != "" {
+		escapedPath += "/" + uriEncode(key, false)
+	}
+
+	return s.endpoint.Host, escapedPath
+}
+
+// responseError converts the error response into an error.
+func responseError(resp *http.Response) error {
+	var result struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+
+	_ = xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&result)
+
+	if result.Code == "" {
+		return fmt.Errorf("S3 request failed: %s", resp.Status)
+	}
+
+	return fmt.Errorf("S3 request failed: %s: %s: %s", resp.Status, result.Code, result.Message)
+}
+
+// checkCopyResult returns an error if the body of the copy response contains
+// an error instead of the copy result.
+func checkCopyResult(body io.Reader) error {
+	var result struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+
+	err := xml.NewDecoder(io.LimitReader(body, 64*1024)).Decode(&result)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("Failed to decode copy response: %w", err)
+	}
+
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf("S3 copy failed: %s: %s", result.Code, result.Message)
+	}
+
+	return nil
+}
+
+// key returns the object key of the file with the given name.
+func (s *S3) key(name string) string {
+	return strings.Trim(path.Join(s.prefix, name), "/")
+}
+
+// dirPrefix returns the key prefix of the objects within the directory with
+// the given key.
+func dirPrefix(key string) string {
+	if key == "" {
+		return ""
+	}
+
+	return key + "/"
+}
+
+// firstNonEmpty returns the first non-empty value.
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,203 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unsignedPayload is used instead of the payload hash, which allows streaming
+// the request body without reading it twice.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// signer signs S3 requests using AWS Signature Version 4.
+type signer struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	region       string
+	now          func() time.Time
+}
+
+// sign adds the authorization header to the request. Signed headers are the
+// host, range, and all x-amz-* headers. If the request does not set the
+// payload hash, the payload is not signed. Requests are sent anonymously
+// if the access key is not set.
+func (s *signer) sign(req *http.Request) {
+	if s.accessKey == "" {
+		return
+	}
+
+	t := s.now().UTC()
+
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	}
+
+	req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	// Collect canonical headers.
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	headers := map[string]string{"host": host}
+
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if k != "range" && !strings.HasPrefix(k, "x-amz-") {
+			continue
+		}
+
+		values := make([]string, 0, len(v))
+		for _, value := range v {
+			values = append(values, strings.Join(strings.Fields(value), " "))
+		}
+
+		headers[k] = strings.Join(values, ",")
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+
+	slices.Sort(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, headers[k])
+	}
+
+	signedHeaders := strings.Join(names, ";")
+
+	query := make(map[string]string)
+	for k, v := range req.URL.Query() {
+		query[k] = v[0]
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(query),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	signature := s.signature(t, canonicalRequest)
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, s.scope(t), signedHeaders, signature))
+}
+
+// presign adds the signature to the query parameters of the request with the
+// given method, host, and escaped path, so that the request can be sent
+// without credentials until the signature expires. Only the host header is
+// signed. Query parameters are left unchanged if the access key is not set.
+func (s *signer) presign(method string, host string, escapedPath string, query map[string]string, expires time.Duration) {
+	if s.accessKey == "" {
+		return
+	}
+
+	t := s.now().UTC()
+
+	query["X-Amz-Algorithm"] = "AWS4-HMAC-SHA256"
+	query["X-Amz-Credential"] = fmt.Sprintf("%s/%s", s.accessKey, s.scope(t))
+	query["X-Amz-Date"] = t.Format("20060102T150405Z")
+	query["X-Amz-Expires"] = strconv.Itoa(int(expires.Seconds()))
+	query["X-Amz-SignedHeaders"] = "host"
+
+	if s.sessionToken != "" {
+		query["X-Amz-Security-Token"] = s.sessionToken
+	}
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		escapedPath,
+		canonicalQuery(query),
+		fmt.Sprintf("host:%s\n", host),
+		"host",
+		unsignedPayload,
+	}, "\n")
+
+	query["X-Amz-Signature"] = s.signature(t, canonicalRequest)
+}
+
+// scope returns the credential scope for the given time.
+func (s *signer) scope(t time.Time) string {
+	return fmt.Sprintf("%s/%s/s3/aws4_request", t.Format("20060102"), s.region)
+}
+
+// signature returns the signature of the canonical request at the given time.
+func (s *signer) signature(t time.Time, canonicalRequest string) string {
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		t.Format("20060102T150405Z"),
+		s.scope(t),
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), t.Format("20060102"))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of the data using the given key.
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery returns the query string with the parameters sorted by their
+// names and encoded as required by the signature.
+func canonicalQuery(query map[string]string) string {
+	names := make([]string, 0, len(query))
+	for k := range query {
+		names = append(names, k)
+	}
+
+	slices.Sort(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, k := range names {
+		pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(query[k], true))
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode encodes all characters except the unreserved ones. Slashes are
+// encoded only if encodeSlash is true.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,272 @@
+// Package storage provides access to the files served by the simplestream
+// server, which may be stored on the local file system, in an S3 bucket, or on
+// a WebDAV server.
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Backend provides access to the files stored under a single root. File names
+// are slash-separated paths relative to the root, where an empty name refers
+// to the root itself.
+type Backend interface {
+	// Open opens the file with the given name for reading.
+	Open(name string) (io.ReadCloser, error)
+
+	// Stat returns information about the file or directory with the given
+	// name. An error wrapping fs.ErrNotExist is returned if neither exists.
+	Stat(name string) (fs.FileInfo, error)
+
+	// List returns the entries of the directory with the given name sorted
+	// by their names.
+	List(name string) ([]fs.FileInfo, error)
+
+	// Write replaces the file with the given name with the content read from
+	// the reader. The file is replaced atomically, which means that readers
+	// observe either the old or the new content, but never a partial file.
+	// Parent directories are created if necessary.
+	Write(name string, r io.Reader) error
+
+	// Rename moves the file with the old name to the new name, replacing the
+	// existing file.
+	Rename(oldName string, newName string) error
+
+	// Delete removes the file or the directory with the given name, including
+	// its contents. Deleting a non-existing file is not an error.
+	Delete(name string) error
+}
+
+// MaxPresignTTL is the maximum lifetime of the pre-signed URL.
+const MaxPresignTTL = 7 * 24 * time.Hour
+
+// Presigner is implemented by backends that can issue time-limited URLs, using
+// which the files can be downloaded directly from the storage.
+type Presigner interface {
+	// PresignURL returns the URL of the file with the given name that is
+	// valid for the given duration.
+	PresignURL(name string, ttl time.Duration) (string, error)
+}
+
+// TimeSetter is implemented by backends that can set the modification time of
+// the stored files.
+type TimeSetter interface {
+	// Chtimes sets the modification time of the file with the given name,
+	// or of the directory with the given name and all files within it.
+	Chtimes(name string, modTime time.Time) error
+}
+
+// New returns the backend for the given root, which is either a path of the
+// local directory, an S3 URL in the format "s3://bucket/prefix", a WebDAV URL
+// in the format "webdav://host/path" (or "webdavs://host/path"), or the root of
+// the in-memory backend in the format "mem://id".
+func New(root string) (Backend, error) {
+	if strings.HasPrefix(root, SchemeS3+"://") {
+		return NewS3(root)
+	}
+
+	if strings.HasPrefix(root, SchemeWebDAV+"://") || strings.HasPrefix(root, SchemeWebDAVS+"://") {
+		return NewWebDAV(root)
+	}
+
+	if strings.HasPrefix(root, SchemeMemory+"://") {
+		return lookupMemory(root)
+	}
+
+	return NewLocal(root), nil
+}
+
+// IsLocal returns true if the given root refers to the local file system.
+func IsLocal(root string) bool {
+	for _, scheme := range []string{SchemeS3, SchemeWebDAV, SchemeWebDAVS, SchemeMemory} {
+		if strings.HasPrefix(root, scheme+"://") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ReadFile reads the whole file with the given name.
+func ReadFile(b Backend, name string) ([]byte, error) {
+	r, err := b.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// WriteFile replaces the file with the given name with the given data.
+func WriteFile(b Backend, name string, data []byte) error {
+	return b.Write(name, bytes.NewReader(data))
+}
+
+// ReadJSONFile reads the JSON file with the given name and decodes it into the
+// given structure.
+func ReadJSONFile[T any](b Backend, name string, obj *T) (*T, error) {
+	r, err := b.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening file: %w", err)
+	}
+
+	defer r.Close()
+
+	err = json.NewDecoder(r).Decode(obj)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding JSON: %w", err)
+	}
+
+	return obj, nil
+}
+
+// AppendFile appends the content to the existing file with the given name.
+// The backend may need to rewrite the whole file, therefore, concurrent
+// appends to the same file must be synchronized by the caller.
+func AppendFile(b Backend, name string, content string) error {
+	if content == "" {
+		return nil
+	}
+
+	l, ok := b.(*Local)
+	if ok {
+		file, err := os.OpenFile(l.Path(name), os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+
+		_, err = file.WriteString(content)
+		return err
+	}
+
+	data, err := ReadFile(b, name)
+	if err != nil {
+		return err
+	}
+
+	return WriteFile(b, name, append(data, content...))
+}
+
+// TempDir creates a local temporary directory in which files are prepared
+// before they are published using Publish. For the local backend, the
+// directory is hidden within the root directory, so that files can be moved
+// to their final destination without being copied. The returned function
+// removes the directory.
+func TempDir(b Backend) (string, func(), error) {
+	dir := ""
+
+	l, ok := b.(*Local)
+	if ok {
+		err := os.MkdirAll(l.root, os.ModePerm)
+		if err != nil {
+			return "", nil, err
+		}
+
+		dir = l.root
+	}
+
+	tempDir, err := os.MkdirTemp(dir, ".tmp-")
+	if err != nil {
+		return "", nil, err
+	}
+
+	return tempDir, func() { _ = os.RemoveAll(tempDir) }, nil
+}
+
+// Publish moves the local file on the given path to the file with the given
+// name. The local file is consumed in the process.
+func Publish(b Backend, localPath string, name string) error {
+	l, ok := b.(*Local)
+	if ok {
+		return l.move(localPath, name)
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	err = b.Write(name, file)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(localPath)
+}
+
+// Fetch returns the path of the local file with the content of the file with
+// the given name. For the local backend, the path of the file itself is
+// returned. Otherwise, the file is downloaded into a temporary file, which is
+// removed by the returned function.
+func Fetch(b Backend, name string) (string, func(), error) {
+	l, ok := b.(*Local)
+	if ok {
+		return l.Path(name), func() {}, nil
+	}
+
+	r, err := b.Open(name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	defer r.Close()
+
+	file, err := os.CreateTemp("", fmt.Sprintf(".%s.*.tmp", path.Base(name)))
+	if err != nil {
+		return "", nil, err
+	}
+
+	defer file.Close()
+
+	remove := func() { _ = os.Remove(file.Name()) }
+
+	_, err = io.Copy(file, r)
+	if err != nil {
+		remove()
+		return "", nil, err
+	}
+
+	err = file.Close()
+	if err != nil {
+		remove()
+		return "", nil, err
+	}
+
+	return file.Name(), remove, nil
+}
+
+// fileInfo implements fs.FileInfo for backends without native file info.
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (i fileInfo) Name() string       { return i.name }
+func (i fileInfo) Size() int64        { return i.size }
+func (i fileInfo) ModTime() time.Time { return i.modTime }
+func (i fileInfo) IsDir() bool        { return i.isDir }
+func (i fileInfo) Sys() any           { return nil }
+
+func (i fileInfo) Mode() fs.FileMode {
+	if i.isDir {
+		return fs.ModeDir | 0755
+	}
+
+	return 0644
+}
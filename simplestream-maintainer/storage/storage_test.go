@@ -0,0 +1,376 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/clock"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/testutils"
+)
+
+func TestNew(t *testing.T) {
+	t.Setenv("AWS_ENDPOINT_URL", "")
+	t.Setenv("AWS_ENDPOINT_URL_S3", "")
+
+	b, err := storage.New("/srv/images")
+	require.NoError(t, err)
+	require.IsType(t, &storage.Local{}, b)
+	require.True(t, storage.IsLocal("/srv/images"))
+
+	b, err = storage.New("s3://bucket/prefix?region=eu-west-1")
+	require.NoError(t, err)
+	require.IsType(t, &storage.S3{}, b)
+	require.False(t, storage.IsLocal("s3://bucket/prefix"))
+
+	_, err = storage.New("s3:///prefix")
+	require.Error(t, err)
+
+	b, err = storage.New("webdavs://dav.example.com/images")
+	require.NoError(t, err)
+	require.IsType(t, &storage.WebDAV{}, b)
+	require.False(t, storage.IsLocal("webdav://dav.example.com/images"))
+
+	m := storage.NewMemory(nil)
+	defer m.Close()
+
+	b, err = storage.New(m.Root())
+	require.NoError(t, err)
+	require.Same(t, m, b)
+	require.False(t, storage.IsLocal(m.Root()))
+
+	m.Close()
+
+	_, err = storage.New(m.Root())
+	require.Error(t, err)
+}
+
+func TestLocal(t *testing.T) {
+	t.Parallel()
+
+	testBackend(t, storage.NewLocal(t.TempDir()))
+}
+
+func TestLocalLink(t *testing.T) {
+	t.Parallel()
+
+	b := storage.NewLocal(t.TempDir())
+
+	require.NoError(t, storage.WriteFile(b, "v1/disk.img", []byte("disk")))
+	require.NoError(t, storage.WriteFile(b, "v2/disk.img", []byte("disk")))
+
+	// Ensure the file is replaced with a hard link.
+	require.NoError(t, b.Link("v1/disk.img", "v2/disk.img"))
+
+	info1, err := os.Stat(b.Path("v1/disk.img"))
+	require.NoError(t, err)
+
+	info2, err := os.Stat(b.Path("v2/disk.img"))
+	require.NoError(t, err)
+
+	require.True(t, os.SameFile(info1, info2))
+
+	// Ensure no temporary files are left behind.
+	infos, err := b.List("v2")
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+}
+
+func TestLocalReflink(t *testing.T) {
+	t.Parallel()
+
+	b := storage.NewLocal(t.TempDir())
+
+	require.NoError(t, storage.WriteFile(b, "v1/disk.img", []byte("disk")))
+	require.NoError(t, storage.WriteFile(b, "v2/disk.img", []byte("disk")))
+
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, os.Chtimes(b.Path("v2/disk.img"), modTime, modTime))
+
+	err := b.Reflink("v1/disk.img", "v2/disk.img")
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("Filesystem does not support cloning files")
+	}
+
+	require.NoError(t, err)
+
+	// Ensure the file is replaced with an independent clone, which keeps
+	// its modification time.
+	info1, err := os.Stat(b.Path("v1/disk.img"))
+	require.NoError(t, err)
+
+	info2, err := os.Stat(b.Path("v2/disk.img"))
+	require.NoError(t, err)
+
+	require.False(t, os.SameFile(info1, info2))
+	require.Equal(t, modTime, info2.ModTime().UTC())
+
+	content, err := storage.ReadFile(b, "v2/disk.img")
+	require.NoError(t, err)
+	require.Equal(t, "disk", string(content))
+
+	// Ensure no temporary files are left behind.
+	infos, err := b.List("v2")
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+}
+
+func TestLocalChtimes(t *testing.T) {
+	t.Parallel()
+
+	modTime := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	b := storage.NewLocal(t.TempDir())
+
+	require.NoError(t, storage.WriteFile(b, "images/1/disk.img", []byte("disk")))
+	require.NoError(t, storage.WriteFile(b, "images/2/disk.img", []byte("disk")))
+
+	// Ensure the directory and the files within it are updated.
+	require.NoError(t, b.Chtimes("images/1", modTime))
+
+	for _, name := range []string{"images/1", "images/1/disk.img"} {
+		info, err := b.Stat(name)
+		require.NoError(t, err)
+		require.True(t, modTime.Equal(info.ModTime()), name)
+	}
+
+	info, err := b.Stat("images/2/disk.img")
+	require.NoError(t, err)
+	require.False(t, modTime.Equal(info.ModTime()))
+
+	require.ErrorIs(t, b.Chtimes("images/missing", modTime), fs.ErrNotExist)
+}
+
+func TestMemory(t *testing.T) {
+	t.Parallel()
+
+	m := storage.NewMemory(nil)
+	defer m.Close()
+
+	testBackend(t, m)
+}
+
+func TestMemoryChtimes(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	m := storage.NewMemory(clock.NewFake(now))
+	defer m.Close()
+
+	require.NoError(t, storage.WriteFile(m, "images/1/disk.img", []byte("disk")))
+	require.NoError(t, storage.WriteFile(m, "images/2/disk.img", []byte("disk")))
+
+	info, err := m.Stat("images/1/disk.img")
+	require.NoError(t, err)
+	require.Equal(t, now, info.ModTime())
+
+	// Ensure directory reports the modification time of its newest file.
+	require.NoError(t, m.Chtimes("images/1", now.Add(-time.Hour)))
+
+	info, err = m.Stat("images/1")
+	require.NoError(t, err)
+	require.Equal(t, now.Add(-time.Hour), info.ModTime())
+
+	info, err = m.Stat("images")
+	require.NoError(t, err)
+	require.Equal(t, now, info.ModTime())
+
+	require.ErrorIs(t, m.Chtimes("images/missing", now), fs.ErrNotExist)
+}
+
+func TestS3(t *testing.T) {
+	server := httptest.NewServer(testutils.NewFakeS3("bucket"))
+	defer server.Close()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "access")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	b, err := storage.NewS3(fmt.Sprintf("s3://bucket/root/dir?endpoint=%s", server.URL))
+	require.NoError(t, err)
+
+	testBackend(t, b)
+}
+
+func TestWebDAV(t *testing.T) {
+	server := httptest.NewServer(testutils.NewFakeWebDAV())
+	defer server.Close()
+
+	t.Setenv("WEBDAV_USERNAME", "user")
+	t.Setenv("WEBDAV_PASSWORD", "secret")
+
+	rawURL := strings.Replace(server.URL, "http://", "webdav://", 1)
+
+	b, err := storage.NewWebDAV(rawURL)
+	require.NoError(t, err)
+
+	testBackend(t, b)
+
+	// Ensure credentials from the URL take precedence.
+	b, err = storage.NewWebDAV(strings.Replace(server.URL, "http://", "webdav://user:wrong@", 1))
+	require.NoError(t, err)
+
+	_, err = b.Stat("")
+	require.ErrorContains(t, err, "401")
+}
+
+// testBackend ensures the backend behaves as expected by the Backend interface.
+func testBackend(t *testing.T, b storage.Backend) {
+	t.Helper()
+
+	// Write files.
+	files := map[string]string{
+		"streams/v1/index.json":     "{}",
+		"images/ubuntu/1/disk.img":  "disk",
+		"images/ubuntu/1/meta.tar":  "meta",
+		"images/ubuntu/2/disk.img":  "disk2",
+		"images/ubuntu/a b+c/x.img": "special",
+	}
+
+	for name, content := range files {
+		require.NoError(t, storage.WriteFile(b, name, []byte(content)))
+	}
+
+	// Replace existing file using a reader of unknown size.
+	require.NoError(t, b.Write("streams/v1/index.json", io.MultiReader(strings.NewReader(`{"a":`), strings.NewReader(`1}`))))
+
+	data, err := storage.ReadFile(b, "streams/v1/index.json")
+	require.NoError(t, err)
+	require.Equal(t, `{"a":1}`, string(data))
+
+	// Stat file and directory.
+	info, err := b.Stat("images/ubuntu/1/disk.img")
+	require.NoError(t, err)
+	require.Equal(t, "disk.img", info.Name())
+	require.Equal(t, int64(4), info.Size())
+	require.False(t, info.IsDir())
+	require.WithinDuration(t, time.Now(), info.ModTime(), time.Minute)
+
+	info, err = b.Stat("images/ubuntu")
+	require.NoError(t, err)
+	require.True(t, info.IsDir())
+
+	_, err = b.Stat("images/missing")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = b.Open("images/missing")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	// List directories.
+	listNames := func(name string) []string {
+		infos, err := b.List(name)
+		require.NoError(t, err)
+
+		names := make([]string, 0, len(infos))
+		for _, info := range infos {
+			if info.IsDir() {
+				names = append(names, info.Name()+"/")
+			} else {
+				names = append(names, info.Name())
+			}
+		}
+
+		return names
+	}
+
+	require.Equal(t, []string{"images/", "streams/"}, listNames(""))
+	require.Equal(t, []string{"1/", "2/", "a b+c/"}, listNames("images/ubuntu"))
+	require.Equal(t, []string{"disk.img", "meta.tar"}, listNames("images/ubuntu/1"))
+
+	_, err = b.List("images/missing")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	// Append to a file.
+	require.NoError(t, storage.AppendFile(b, "images/ubuntu/1/meta.tar", "-more"))
+
+	data, err = storage.ReadFile(b, "images/ubuntu/1/meta.tar")
+	require.NoError(t, err)
+	require.Equal(t, "meta-more", string(data))
+
+	// Rename a file.
+	require.NoError(t, b.Rename("images/ubuntu/a b+c/x.img", "images/ubuntu/3/x.img"))
+
+	_, err = b.Stat("images/ubuntu/a b+c/x.img")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	data, err = storage.ReadFile(b, "images/ubuntu/3/x.img")
+	require.NoError(t, err)
+	require.Equal(t, "special", string(data))
+
+	// Publish and fetch a local file.
+	tempDir, cleanup, err := storage.TempDir(b)
+	require.NoError(t, err)
+
+	defer cleanup()
+
+	localPath := filepath.Join(tempDir, "file")
+	require.NoError(t, os.WriteFile(localPath, []byte("published"), 0600))
+	require.NoError(t, storage.Publish(b, localPath, "images/ubuntu/3/published"))
+	require.NoFileExists(t, localPath)
+
+	fetchedPath, release, err := storage.Fetch(b, "images/ubuntu/3/published")
+	require.NoError(t, err)
+
+	data, err = os.ReadFile(fetchedPath)
+	require.NoError(t, err)
+	require.Equal(t, "published", string(data))
+	release()
+
+	// Delete a file and a directory.
+	require.NoError(t, b.Delete("images/ubuntu/2/disk.img"))
+	require.NoError(t, b.Delete("images/ubuntu/1"))
+	require.NoError(t, b.Delete("images/ubuntu/missing"))
+
+	_, err = b.Stat("images/ubuntu/1/meta.tar")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	require.NotContains(t, listNames("images/ubuntu"), "1/")
+}
+
+func TestLock(t *testing.T) {
+	t.Parallel()
+
+	b := storage.NewLocal(t.TempDir())
+
+	unlock, err := storage.Lock(context.Background(), b, "streams/.lock", 0)
+	require.NoError(t, err)
+	require.FileExists(t, b.Path("streams/.lock"))
+
+	// Ensure the lock cannot be acquired while it is held.
+	_, err = storage.Lock(context.Background(), b, "streams/.lock", 0)
+	require.ErrorContains(t, err, "Timed out")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = storage.Lock(ctx, b, "streams/.lock", time.Minute)
+	require.ErrorIs(t, err, context.Canceled)
+
+	// Ensure the waiting process acquires the lock once it is released.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		unlock()
+	}()
+
+	unlockNext, err := storage.Lock(context.Background(), b, "streams/.lock", time.Minute)
+	require.NoError(t, err)
+	unlockNext()
+
+	// Ensure locking is reported as unsupported for other backends.
+	s3, err := storage.New("s3://bucket/prefix?region=eu-west-1")
+	require.NoError(t, err)
+
+	_, err = storage.Lock(context.Background(), s3, "streams/.lock", 0)
+	require.ErrorIs(t, err, storage.ErrLockNotSupported)
+}
@@ -0,0 +1,414 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/version"
+)
+
+// SchemeWebDAV is the URL scheme of the WebDAV backend using HTTP, and
+// SchemeWebDAVS is the one using HTTPS.
+const (
+	SchemeWebDAV  = "webdav"
+	SchemeWebDAVS = "webdavs"
+)
+
+// propfindBody requests the properties of the resources needed to construct
+// their file info.
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:getcontentlength/><D:getlastmodified/></D:prop></D:propfind>`
+
+// WebDAV is the backend that stores files on the WebDAV server. Directories
+// are stored as WebDAV collections.
+type WebDAV struct {
+	base     *url.URL
+	username string
+	password string
+
+	client *http.Client
+}
+
+// NewWebDAV returns the backend for the WebDAV URL in the format
+// "webdav://host/path", or "webdavs://host/path" for HTTPS.
+//
+// Credentials for the basic authentication are read either from the URL or
+// from the WEBDAV_USERNAME and WEBDAV_PASSWORD environment variables.
+func NewWebDAV(rawURL string) (*WebDAV, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid WebDAV URL %q: %w", rawURL, err)
+	}
+
+	if (u.Scheme != SchemeWebDAV && u.Scheme != SchemeWebDAVS) || u.Host == "" {
+		return nil, fmt.Errorf("Invalid WebDAV URL %q: expected format %s://host/path", rawURL, SchemeWebDAV)
+	}
+
+	d := &WebDAV{
+		base:     &url.URL{Scheme: "http", Host: u.Host, Path: "/" + strings.Trim(u.Path, "/")},
+		username: os.Getenv("WEBDAV_USERNAME"),
+		password: os.Getenv("WEBDAV_PASSWORD"),
+		client:   http.DefaultClient,
+	}
+
+	if u.Scheme == SchemeWebDAVS {
+		d.base.Scheme = "https"
+	}
+
+	if u.User != nil {
+		d.username = u.User.Username()
+		d.password, _ = u.User.Password()
+	}
+
+	return d, nil
+}
+
+// Open implements Backend.
+func (d *WebDAV) Open(name string) (io.ReadCloser, error) {
+	resp, err := d.do(http.MethodGet, name, nil, nil)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return resp.Body, nil
+}
+
+// Stat implements Backend.
+func (d *WebDAV) Stat(name string) (fs.FileInfo, error) {
+	infos, err := d.propfind(name, "0")
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	if len(infos) == 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+
+	info := infos[0]
+	info.name = path.Base(name)
+
+	return info, nil
+}
+
+// List implements Backend.
+func (d *WebDAV) List(name string) ([]fs.FileInfo, error) {
+	infos, err := d.propfind(name, "1")
+	if err != nil {
+		return nil, &fs.PathError{Op: "list", Path: name, Err: err}
+	}
+
+	dirPath := d.path(name)
+	result := make([]fs.FileInfo, 0, len(infos))
+
+	for _, info := range infos {
+		// Response includes the listed collection itself.
+		if info.href == dirPath {
+			if !info.isDir {
+				return nil, &fs.PathError{Op: "list", Path: name, Err: fmt.Errorf("Not a directory")}
+			}
+
+			continue
+		}
+
+		result = append(result, info.fileInfo)
+	}
+
+	slices.SortFunc(result, func(a fs.FileInfo, b fs.FileInfo) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	return result, nil
+}
+
+// Write implements Backend. The content is uploaded into a hidden temporary
+// file, which is then moved over the existing file.
+func (d *WebDAV) Write(name string, r io.Reader) error {
+	err := d.mkdirAll(path.Dir(name))
+	if err != nil {
+		return &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+
+	suffix := make([]byte, 6)
+
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return err
+	}
+
+	tempName := path.Join(path.Dir(name), fmt.Sprintf(".%s.%s.tmp", path.Base(name), hex.EncodeToString(suffix)))
+
+	resp, err := d.do(http.MethodPut, tempName, nil, r)
+	if err != nil {
+		return &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+
+	_ = resp.Body.Close()
+
+	err = d.move(tempName, name)
+	if err != nil {
+		_ = d.Delete(tempName)
+		return &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// Rename implements Backend.
+func (d *WebDAV) Rename(oldName string, newName string) error {
+	err := d.mkdirAll(path.Dir(newName))
+	if err != nil {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: err}
+	}
+
+	err = d.move(oldName, newName)
+	if err != nil {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: err}
+	}
+
+	return nil
+}
+
+// Delete implements Backend. Collections are deleted by the server including
+// their contents.
+func (d *WebDAV) Delete(name string) error {
+	resp, err := d.do(http.MethodDelete, name, nil, nil)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		return &fs.PathError{Op: "delete", Path: name, Err: err}
+	}
+
+	return resp.Body.Close()
+}
+
+// move moves the resource with the old name to the new name, replacing the
+// existing resource.
+func (d *WebDAV) move(oldName string, newName string) error {
+	header := http.Header{}
+	header.Set("Destination", d.url(newName).String())
+	header.Set("Overwrite", "T")
+
+	resp, err := d.do("MOVE", oldName, header, nil)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// mkdirAll creates the collection with the given name along with its missing
+// parents, including the root collection. The parent of the root collection
+// must exist.
+func (d *WebDAV) mkdirAll(name string) error {
+	name = strings.Trim(path.Clean(name), "/")
+	if name == "." {
+		name = ""
+	}
+
+	info, err := d.Stat(name)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%q is not a directory", name)
+		}
+
+		return nil
+	}
+
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if name != "" {
+		err = d.mkdirAll(path.Dir(name))
+		if err != nil {
+			return err
+		}
+	}
+
+	resp, err := d.do("MKCOL", name, nil, nil)
+	if err != nil {
+		var statusErr *webdavStatusError
+
+		// Collection was created in the meantime.
+		if errors.As(err, &statusErr) && statusErr.code == http.StatusMethodNotAllowed {
+			return nil
+		}
+
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// webdavInfo is the file info of the resource from the PROPFIND response.
+type webdavInfo struct {
+	fileInfo
+
+	// href is the unescaped path of the resource without the trailing slash.
+	href string
+}
+
+// multistatus is the response of the PROPFIND request.
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ContentLength int64  `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// propfind returns the properties of the resource with the given name, and
+// with depth "1" also the properties of the resources within the collection.
+// Missing resource is reported as fs.ErrNotExist.
+func (d *WebDAV) propfind(name string, depth string) ([]webdavInfo, error) {
+	header := http.Header{}
+	header.Set("Depth", depth)
+	header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	resp, err := d.do("PROPFIND", name, header, strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	var result multistatus
+
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode PROPFIND response: %w", err)
+	}
+
+	infos := make([]webdavInfo, 0, len(result.Responses))
+
+	for _, r := range result.Responses {
+		u, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid href %q in PROPFIND response: %w", r.Href, err)
+		}
+
+		info := webdavInfo{href: strings.TrimSuffix(u.Path, "/")}
+		info.name = path.Base(info.href)
+
+		for _, p := range r.Propstat {
+			// Missing properties are reported with the status 404.
+			if !strings.Contains(p.Status, " 200") {
+				continue
+			}
+
+			info.isDir = info.isDir || p.Prop.ResourceType.Collection != nil
+			info.size = max(info.size, p.Prop.ContentLength)
+
+			modTime, err := http.ParseTime(p.Prop.LastModified)
+			if err == nil {
+				info.modTime = modTime
+			}
+		}
+
+		if info.isDir {
+			info.size = 0
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// webdavStatusError is returned when the server responds with an unexpected
+// status code.
+type webdavStatusError struct {
+	code   int
+	status string
+}
+
+// Error implements error.
+func (e *webdavStatusError) Error() string {
+	return fmt.Sprintf("WebDAV request failed: %s", e.status)
+}
+
+// do sends the request for the resource with the given name. Unsuccessful
+// responses are converted into errors, where missing resources are reported
+// as fs.ErrNotExist.
+func (d *WebDAV) do(method string, name string, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, d.url(name).String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set the content length of local files, as not all servers support
+	// chunked uploads.
+	file, ok := body.(*os.File)
+	if ok {
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+
+		req.ContentLength = info.Size()
+		if req.ContentLength == 0 {
+			req.Body = http.NoBody
+		}
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	req.Header.Set("User-Agent", version.UserAgent())
+
+	if d.username != "" {
+		req.SetBasicAuth(d.username, d.password)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	_ = resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fs.ErrNotExist
+	}
+
+	return nil, &webdavStatusError{code: resp.StatusCode, status: resp.Status}
+}
+
+// path returns the unescaped path of the resource with the given name.
+func (d *WebDAV) path(name string) string {
+	return strings.TrimSuffix(path.Join(d.base.Path, name), "/")
+}
+
+// url returns the URL of the resource with the given name.
+func (d *WebDAV) url(name string) *url.URL {
+	u := *d.base
+	u.Path = path.Join(d.base.Path, name)
+
+	return &u
+}
@@ -0,0 +1,309 @@
+package stream
+
+import (
+	"cmp"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// AliasConflict describes an alias that was generated by multiple products
+// of the same architecture, and how the conflict was resolved.
+type AliasConflict struct {
+	// Alias that is in conflict.
+	Alias string
+
+	// Architecture of the conflicting products.
+	Architecture string
+
+	// ID of the product that retains the alias.
+	Product string
+
+	// Sorted IDs of the products from which the alias was removed.
+	Excluded []string
+}
+
+// ResolveAliasConflicts ensures each alias references at most one product
+// per architecture. When multiple products generate the same alias, the
+// alias is retained by the product that matches the earliest pattern in the
+// precedence list (using the syntax of path.Match). Products that do not
+// match any pattern come last. Remaining ties are resolved in favour of the
+// product that lists the alias earlier (an alias derived from the product's
+// own release is preferred over a release alias), and finally by the product
+// ID. The alias is removed from all other products.
+//
+// Products are updated in place and the list of resolved conflicts is
+// returned sorted by architecture and alias.
+func ResolveAliasConflicts(products map[string]Product, precedence []string) []AliasConflict {
+	type aliasKey struct {
+		arch  string
+		alias string
+	}
+
+	ids := shared.MapKeys(products)
+	slices.Sort(ids)
+
+	// Collect products that reference each alias.
+	owners := make(map[aliasKey][]string)
+	for _, id := range ids {
+		for _, alias := range products[id].aliasList() {
+			key := aliasKey{arch: products[id].Architecture, alias: alias}
+			if !slices.Contains(owners[key], id) {
+				owners[key] = append(owners[key], id)
+			}
+		}
+	}
+
+	// rank returns the index of the first precedence pattern matching
+	// the product ID, or the length of the precedence list if none does.
+	rank := func(id string) int {
+		for i, pattern := range precedence {
+			match, _ := path.Match(pattern, id)
+			if match {
+				return i
+			}
+		}
+
+		return len(precedence)
+	}
+
+	var conflicts []AliasConflict
+	excluded := make(map[string][]string)
+
+	for key, candidates := range owners {
+		if len(candidates) < 2 {
+			continue
+		}
+
+		// Candidates are already sorted by ID, so the stable sort
+		// retains the ID order for the remaining ties.
+		slices.SortStableFunc(candidates, func(a string, b string) int {
+			rankA, rankB := rank(a), rank(b)
+			if rankA != rankB {
+				return rankA - rankB
+			}
+
+			return slices.Index(products[a].aliasList(), key.alias) - slices.Index(products[b].aliasList(), key.alias)
+		})
+
+		for _, id := range candidates[1:] {
+			excluded[id] = append(excluded[id], key.alias)
+		}
+
+		losers := slices.Clone(candidates[1:])
+		slices.Sort(losers)
+
+		conflicts = append(conflicts, AliasConflict{
+			Alias:        key.alias,
+			Architecture: key.arch,
+			Product:      candidates[0],
+			Excluded:     losers,
+		})
+	}
+
+	// Remove excluded aliases from the products.
+	for id, aliases := range excluded {
+		p := products[id]
+		p.Aliases = strings.Join(slices.DeleteFunc(p.aliasList(), func(alias string) bool {
+			return slices.Contains(aliases, alias)
+		}), ",")
+
+		products[id] = p
+	}
+
+	slices.SortFunc(conflicts, func(a AliasConflict, b AliasConflict) int {
+		if a.Architecture != b.Architecture {
+			return strings.Compare(a.Architecture, b.Architecture)
+		}
+
+		return strings.Compare(a.Alias, b.Alias)
+	})
+
+	return conflicts
+}
+
+// CustomAliasLatest is the release of the custom alias that points at the
+// latest release of the matching products.
+const CustomAliasLatest = "latest"
+
+// CustomAlias is a rolling alias (for example, "ubuntu/lts") that points at a
+// release of the matching products.
+type CustomAlias struct {
+	// Name of the alias.
+	Name string
+
+	// Products contains the product ID patterns of the candidate products.
+	// Patterns use the syntax of path.Match.
+	Products []string
+
+	// SupportLevel limits the candidates to the products whose release has
+	// the given support level (for example, "lts"), if not empty.
+	SupportLevel string
+
+	// Release is the name of the release the alias points at, or "latest"
+	// (the default) for the latest release of the candidates.
+	Release string
+}
+
+// ApplyCustomAliases adds the custom aliases to the products. For each
+// architecture and variant, the alias is added to the candidate product with
+// the alias release, or the latest release if the alias release is "latest".
+// Releases that reached their end of life at the given time are not
+// candidates for the latest release, and products without versions are not
+// candidates at all. Like the release aliases, the alias is suffixed with
+// the variant, and the variant is omitted for the default variant.
+//
+// Custom aliases previously added to the products are removed first, so that
+// the aliases are shifted to the new release once it appears. Products are
+// updated in place.
+func ApplyCustomAliases(products map[string]Product, aliases []CustomAlias, now time.Time) {
+	if len(aliases) == 0 {
+		return
+	}
+
+	ids := shared.MapKeys(products)
+	slices.Sort(ids)
+
+	// Remove previously added custom aliases.
+	for _, id := range ids {
+		p := products[id]
+
+		var custom []string
+		for _, alias := range aliases {
+			custom = append(custom, CreateAliases(alias.Name, "", p.Variant)...)
+		}
+
+		p.Aliases = strings.Join(slices.DeleteFunc(p.aliasList(), func(alias string) bool {
+			return slices.Contains(custom, alias)
+		}), ",")
+
+		products[id] = p
+	}
+
+	for _, alias := range aliases {
+		release := alias.Release
+		if release == "" {
+			release = CustomAliasLatest
+		}
+
+		// Selected product of each architecture and variant.
+		selected := make(map[[2]string]string)
+
+		for _, id := range ids {
+			p := products[id]
+
+			if len(p.Versions) == 0 || !matchAny(alias.Products, id) {
+				continue
+			}
+
+			if alias.SupportLevel != "" && !strings.EqualFold(p.SupportLevel, alias.SupportLevel) {
+				continue
+			}
+
+			if release == CustomAliasLatest {
+				if p.IsEOL(now) {
+					continue
+				}
+			} else if p.Release != release {
+				continue
+			}
+
+			key := [2]string{p.Architecture, p.Variant}
+
+			other, ok := selected[key]
+			if !ok || compareReleases(products[other], p) < 0 {
+				selected[key] = id
+			}
+		}
+
+		for _, id := range selected {
+			p := products[id]
+			p.Aliases = strings.Join(append(p.aliasList(), CreateAliases(alias.Name, "", p.Variant)...), ",")
+			products[id] = p
+		}
+	}
+}
+
+// compareReleases compares the releases of the given products, and returns a
+// positive number if the release of the first product is newer. Releases are
+// ordered by their end-of-life dates, and the releases without one (which are
+// considered older) by their names.
+func compareReleases(a Product, b Product) int {
+	eolA, errA := time.Parse(ReleaseEOLFormat, a.ReleaseEOL)
+	eolB, errB := time.Parse(ReleaseEOLFormat, b.ReleaseEOL)
+
+	switch {
+	case errA == nil && errB == nil && !eolA.Equal(eolB):
+		return eolA.Compare(eolB)
+	case errA == nil && errB != nil:
+		return 1
+	case errA != nil && errB == nil:
+		return -1
+	}
+
+	return compareReleaseNames(a.Release, b.Release)
+}
+
+// compareReleaseNames compares the release names, where the sequences of
+// digits are compared numerically (for example, "3.20" is newer than "3.9").
+func compareReleaseNames(a string, b string) int {
+	for a != "" && b != "" {
+		numA, restA := cutDigits(a)
+		numB, restB := cutDigits(b)
+
+		if numA != "" && numB != "" {
+			x, _ := strconv.ParseUint(numA, 10, 64)
+			y, _ := strconv.ParseUint(numB, 10, 64)
+
+			if x != y {
+				return cmp.Compare(x, y)
+			}
+
+			a, b = restA, restB
+			continue
+		}
+
+		if a[0] != b[0] {
+			return cmp.Compare(a[0], b[0])
+		}
+
+		a, b = a[1:], b[1:]
+	}
+
+	return cmp.Compare(len(a), len(b))
+}
+
+// cutDigits returns the leading digits of the string and the rest of it.
+func cutDigits(s string) (string, string) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+
+	return s[:i], s[i:]
+}
+
+// matchAny returns true if the ID matches any of the patterns.
+func matchAny(patterns []string, id string) bool {
+	for _, pattern := range patterns {
+		match, _ := path.Match(pattern, id)
+		if match {
+			return true
+		}
+	}
+
+	return false
+}
+
+// aliasList returns the product aliases as a list.
+func (p Product) aliasList() []string {
+	if p.Aliases == "" {
+		return nil
+	}
+
+	return strings.Split(p.Aliases, ",")
+}
@@ -0,0 +1,225 @@
+package stream_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+func TestResolveAliasConflicts(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Name          string
+		Products      map[string]stream.Product
+		Precedence    []string
+		WantAliases   map[string]string
+		WantConflicts []stream.AliasConflict
+	}{
+		{
+			Name: "No conflicts",
+			Products: map[string]stream.Product{
+				"ubuntu:noble:amd64:default": {Architecture: "amd64", Aliases: "ubuntu/noble/default,ubuntu/noble"},
+				"ubuntu:noble:amd64:cloud":   {Architecture: "amd64", Aliases: "ubuntu/noble/cloud"},
+			},
+			WantAliases: map[string]string{
+				"ubuntu:noble:amd64:default": "ubuntu/noble/default,ubuntu/noble",
+				"ubuntu:noble:amd64:cloud":   "ubuntu/noble/cloud",
+			},
+		},
+		{
+			Name: "Same alias on different architectures",
+			Products: map[string]stream.Product{
+				"ubuntu:noble:amd64:default": {Architecture: "amd64", Aliases: "ubuntu/noble"},
+				"ubuntu:noble:arm64:default": {Architecture: "arm64", Aliases: "ubuntu/noble"},
+			},
+			WantAliases: map[string]string{
+				"ubuntu:noble:amd64:default": "ubuntu/noble",
+				"ubuntu:noble:arm64:default": "ubuntu/noble",
+			},
+		},
+		{
+			Name: "Own release takes precedence over release alias",
+			Products: map[string]stream.Product{
+				"ubuntu:24.04:amd64:default": {Architecture: "amd64", Aliases: "ubuntu/24.04/default,ubuntu/24.04,ubuntu/noble/default,ubuntu/noble"},
+				"ubuntu:noble:amd64:default": {Architecture: "amd64", Aliases: "ubuntu/noble/default,ubuntu/noble"},
+			},
+			WantAliases: map[string]string{
+				"ubuntu:24.04:amd64:default": "ubuntu/24.04/default,ubuntu/24.04",
+				"ubuntu:noble:amd64:default": "ubuntu/noble/default,ubuntu/noble",
+			},
+			WantConflicts: []stream.AliasConflict{
+				{Alias: "ubuntu/noble", Architecture: "amd64", Product: "ubuntu:noble:amd64:default", Excluded: []string{"ubuntu:24.04:amd64:default"}},
+				{Alias: "ubuntu/noble/default", Architecture: "amd64", Product: "ubuntu:noble:amd64:default", Excluded: []string{"ubuntu:24.04:amd64:default"}},
+			},
+		},
+		{
+			Name: "Precedence patterns",
+			Products: map[string]stream.Product{
+				"ubuntu:noble:amd64:cloud":   {Architecture: "amd64", Aliases: "ubuntu/noble/cloud,ubuntu/noble"},
+				"ubuntu:noble:amd64:default": {Architecture: "amd64", Aliases: "ubuntu/noble/default,ubuntu/noble"},
+				"ubuntu:noble:amd64:desktop": {Architecture: "amd64", Aliases: "ubuntu/noble/desktop,ubuntu/noble"},
+			},
+			Precedence: []string{"*:*:*:cloud", "*:*:*:default"},
+			WantAliases: map[string]string{
+				"ubuntu:noble:amd64:cloud":   "ubuntu/noble/cloud,ubuntu/noble",
+				"ubuntu:noble:amd64:default": "ubuntu/noble/default",
+				"ubuntu:noble:amd64:desktop": "ubuntu/noble/desktop",
+			},
+			WantConflicts: []stream.AliasConflict{
+				{Alias: "ubuntu/noble", Architecture: "amd64", Product: "ubuntu:noble:amd64:cloud", Excluded: []string{"ubuntu:noble:amd64:default", "ubuntu:noble:amd64:desktop"}},
+			},
+		},
+		{
+			Name: "Product ID order for remaining ties",
+			Products: map[string]stream.Product{
+				"ubuntu:noble:amd64:b": {Architecture: "amd64", Aliases: "ubuntu/noble"},
+				"ubuntu:noble:amd64:a": {Architecture: "amd64", Aliases: "ubuntu/noble"},
+			},
+			WantAliases: map[string]string{
+				"ubuntu:noble:amd64:a": "ubuntu/noble",
+				"ubuntu:noble:amd64:b": "",
+			},
+			WantConflicts: []stream.AliasConflict{
+				{Alias: "ubuntu/noble", Architecture: "amd64", Product: "ubuntu:noble:amd64:a", Excluded: []string{"ubuntu:noble:amd64:b"}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			t.Parallel()
+
+			conflicts := stream.ResolveAliasConflicts(test.Products, test.Precedence)
+			require.Equal(t, test.WantConflicts, conflicts)
+
+			aliases := make(map[string]string, len(test.Products))
+			for id, p := range test.Products {
+				aliases[id] = p.Aliases
+			}
+
+			require.Equal(t, test.WantAliases, aliases)
+		})
+	}
+}
+
+func TestApplyCustomAliases(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	versions := map[string]stream.Version{"01": {}}
+
+	// product returns the product with a single version.
+	product := func(release string, arch string, variant string, eol string, supportLevel string, aliases string) stream.Product {
+		return stream.Product{
+			Distro:       "ubuntu",
+			Release:      release,
+			Architecture: arch,
+			Variant:      variant,
+			ReleaseEOL:   eol,
+			SupportLevel: supportLevel,
+			Aliases:      aliases,
+			Versions:     versions,
+		}
+	}
+
+	tests := []struct {
+		Name        string
+		Products    map[string]stream.Product
+		Aliases     []stream.CustomAlias
+		WantAliases map[string]string
+	}{
+		{
+			Name: "Latest release per architecture and variant",
+			Products: map[string]stream.Product{
+				"ubuntu:jammy:amd64:default":    product("jammy", "amd64", "default", "2027-06-01", "lts", "ubuntu/jammy"),
+				"ubuntu:noble:amd64:default":    product("noble", "amd64", "default", "2029-05-31", "lts", "ubuntu/noble"),
+				"ubuntu:noble:amd64:cloud":      product("noble", "amd64", "cloud", "2029-05-31", "lts", "ubuntu/noble/cloud"),
+				"ubuntu:jammy:arm64:default":    product("jammy", "arm64", "default", "2027-06-01", "lts", "ubuntu/jammy"),
+				"ubuntu:oracular:amd64:default": product("oracular", "amd64", "default", "2025-07-01", "interim", "ubuntu/oracular"),
+			},
+			Aliases: []stream.CustomAlias{{Name: "ubuntu/lts", Products: []string{"ubuntu:*"}, SupportLevel: "lts"}},
+			WantAliases: map[string]string{
+				"ubuntu:jammy:amd64:default":    "ubuntu/jammy",
+				"ubuntu:noble:amd64:default":    "ubuntu/noble,ubuntu/lts/default,ubuntu/lts",
+				"ubuntu:noble:amd64:cloud":      "ubuntu/noble/cloud,ubuntu/lts/cloud",
+				"ubuntu:jammy:arm64:default":    "ubuntu/jammy,ubuntu/lts/default,ubuntu/lts",
+				"ubuntu:oracular:amd64:default": "ubuntu/oracular",
+			},
+		},
+		{
+			Name: "Alias is shifted from the previous release",
+			Products: map[string]stream.Product{
+				"ubuntu:noble:amd64:default":    product("noble", "amd64", "default", "2029-05-31", "", "ubuntu/noble,ubuntu/latest/default,ubuntu/latest"),
+				"ubuntu:oracular:amd64:default": product("oracular", "amd64", "default", "", "", "ubuntu/oracular"),
+				"ubuntu:plucky:amd64:default":   product("plucky", "amd64", "default", "2030-01-01", "", "ubuntu/plucky"),
+			},
+			Aliases: []stream.CustomAlias{{Name: "ubuntu/latest", Products: []string{"ubuntu:*"}, Release: stream.CustomAliasLatest}},
+			WantAliases: map[string]string{
+				"ubuntu:noble:amd64:default":    "ubuntu/noble",
+				"ubuntu:oracular:amd64:default": "ubuntu/oracular",
+				"ubuntu:plucky:amd64:default":   "ubuntu/plucky,ubuntu/latest/default,ubuntu/latest",
+			},
+		},
+		{
+			Name: "Releases at their end of life and without versions are skipped",
+			Products: map[string]stream.Product{
+				"ubuntu:focal:amd64:cloud":  product("focal", "amd64", "cloud", "2024-05-31", "", "ubuntu/focal/cloud"),
+				"ubuntu:jammy:amd64:cloud":  product("jammy", "amd64", "cloud", "2027-06-01", "", "ubuntu/jammy/cloud"),
+				"ubuntu:noble:amd64:cloud":  {Distro: "ubuntu", Release: "noble", Architecture: "amd64", Variant: "cloud", ReleaseEOL: "2029-05-31"},
+				"ubuntu:bionic:arm64:cloud": product("bionic", "arm64", "cloud", "2023-05-31", "", "ubuntu/bionic/cloud"),
+			},
+			Aliases: []stream.CustomAlias{{Name: "ubuntu/current", Products: []string{"ubuntu:*"}}},
+			WantAliases: map[string]string{
+				"ubuntu:focal:amd64:cloud":  "ubuntu/focal/cloud",
+				"ubuntu:jammy:amd64:cloud":  "ubuntu/jammy/cloud,ubuntu/current/cloud",
+				"ubuntu:noble:amd64:cloud":  "",
+				"ubuntu:bionic:arm64:cloud": "ubuntu/bionic/cloud",
+			},
+		},
+		{
+			Name: "Releases without end-of-life dates are ordered by name",
+			Products: map[string]stream.Product{
+				"alpine:3.9:amd64:default":  product("3.9", "amd64", "default", "", "", "alpine/3.9"),
+				"alpine:3.20:amd64:default": product("3.20", "amd64", "default", "", "", "alpine/3.20"),
+				"alpine:edge:amd64:default": product("edge", "amd64", "default", "", "", "alpine/edge"),
+			},
+			Aliases: []stream.CustomAlias{{Name: "alpine/stable", Products: []string{"alpine:3.*"}}},
+			WantAliases: map[string]string{
+				"alpine:3.9:amd64:default":  "alpine/3.9",
+				"alpine:3.20:amd64:default": "alpine/3.20,alpine/stable/default,alpine/stable",
+				"alpine:edge:amd64:default": "alpine/edge",
+			},
+		},
+		{
+			Name: "Pinned release",
+			Products: map[string]stream.Product{
+				"debian:bookworm:amd64:default": product("bookworm", "amd64", "default", "2028-06-30", "", "debian/bookworm"),
+				"debian:trixie:amd64:default":   product("trixie", "amd64", "default", "2030-06-30", "", "debian/trixie,debian/stable"),
+			},
+			Aliases: []stream.CustomAlias{{Name: "debian/stable", Products: []string{"debian:*"}, Release: "bookworm"}},
+			WantAliases: map[string]string{
+				"debian:bookworm:amd64:default": "debian/bookworm,debian/stable/default,debian/stable",
+				"debian:trixie:amd64:default":   "debian/trixie",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			t.Parallel()
+
+			stream.ApplyCustomAliases(test.Products, test.Aliases, now)
+
+			aliases := make(map[string]string, len(test.Products))
+			for id, p := range test.Products {
+				aliases[id] = p.Aliases
+			}
+
+			require.Equal(t, test.WantAliases, aliases)
+		})
+	}
+}
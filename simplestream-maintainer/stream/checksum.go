@@ -0,0 +1,256 @@
+package stream
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/blake2b"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/metrics"
+)
+
+// ChecksumAlgorithm is a hash algorithm used for file checksums.
+type ChecksumAlgorithm string
+
+const (
+	// ChecksumSHA256 represents the SHA256 hash algorithm.
+	ChecksumSHA256 ChecksumAlgorithm = "sha256"
+
+	// ChecksumSHA512 represents the SHA512 hash algorithm.
+	ChecksumSHA512 ChecksumAlgorithm = "sha512"
+
+	// ChecksumBLAKE2b represents the BLAKE2b-512 hash algorithm.
+	ChecksumBLAKE2b ChecksumAlgorithm = "blake2b"
+)
+
+// checksumFiles is a list of supported checksum files and their algorithms
+// in the order of preference. If a version contains multiple checksum files,
+// the first one found is used for verification.
+var checksumFiles = []struct {
+	name      string
+	algorithm ChecksumAlgorithm
+}{
+	{name: FileChecksumSHA512, algorithm: ChecksumSHA512},
+	{name: FileChecksumBLAKE2b, algorithm: ChecksumBLAKE2b},
+	{name: FileChecksumSHA256, algorithm: ChecksumSHA256},
+}
+
+// ParseChecksumAlgorithm returns the checksum algorithm with the given name.
+func ParseChecksumAlgorithm(name string) (ChecksumAlgorithm, error) {
+	switch ChecksumAlgorithm(name) {
+	case ChecksumSHA256, ChecksumSHA512, ChecksumBLAKE2b:
+		return ChecksumAlgorithm(name), nil
+	}
+
+	return "", fmt.Errorf("Unsupported checksum algorithm %q", name)
+}
+
+// New returns a new hash for the checksum algorithm.
+func (a ChecksumAlgorithm) New() hash.Hash {
+	switch a {
+	case ChecksumSHA512:
+		return sha512.New()
+	case ChecksumBLAKE2b:
+		// Error is returned only for invalid key length.
+		h, _ := blake2b.New512(nil)
+		return h
+	default:
+		return sha256.New()
+	}
+}
+
+// FileName returns the name of the checksum file for the algorithm.
+func (a ChecksumAlgorithm) FileName() string {
+	for _, f := range checksumFiles {
+		if f.algorithm == a {
+			return f.name
+		}
+	}
+
+	return FileChecksumSHA256
+}
+
+// HashRequest requests the hashes of the files with the given names for each
+// of the given algorithms. If multiple names are given, the resulting hashes
+// are the combined hashes of all files in the given order.
+type HashRequest struct {
+	Algorithms []ChecksumAlgorithm
+	Names      []string
+}
+
+// FileHashes calculates hashes of the files on the given paths for each of
+// the given algorithms. Files are read only once, regardless of the number
+// of algorithms. If multiple paths are given, the resulting hashes are the
+// combined hashes of all files. Reading is stopped once the context is
+// cancelled.
+func FileHashes(ctx context.Context, algorithms []ChecksumAlgorithm, paths ...string) (map[ChecksumAlgorithm]string, error) {
+	open := func(path string) (io.ReadCloser, error) {
+		return os.Open(path)
+	}
+
+	return fileHashes(ctx, open, algorithms, paths...)
+}
+
+// fileHashes is like FileHashes, except that files are opened using the given
+// function.
+func fileHashes(ctx context.Context, open func(name string) (io.ReadCloser, error), algorithms []ChecksumAlgorithm, names ...string) (map[ChecksumAlgorithm]string, error) {
+	writer, hashes := newHashWriter(algorithms)
+
+	for _, name := range names {
+		n, err := copyFile(ctx, writer, open, name)
+		metrics.HashBytes.Add(float64(n))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sumHashes(hashes), nil
+}
+
+// batchFileHashes calculates the hashes for each of the requests, reading each
+// file only once, even if it is included in multiple requests. Files are read
+// in the order in which they first appear in the requests. Requests that list
+// their files in a different order are calculated separately.
+func batchFileHashes(ctx context.Context, open func(name string) (io.ReadCloser, error), requests []HashRequest) ([]map[ChecksumAlgorithm]string, error) {
+	var order []string
+
+	position := make(map[string]int)
+
+	for _, r := range requests {
+		for _, name := range r.Names {
+			_, ok := position[name]
+			if !ok {
+				position[name] = len(order)
+				order = append(order, name)
+			}
+		}
+	}
+
+	// Writers of all requests that include the file.
+	writers := make(map[string][]io.Writer, len(order))
+	hashes := make([]map[ChecksumAlgorithm]hash.Hash, len(requests))
+	results := make([]map[ChecksumAlgorithm]string, len(requests))
+
+	for i, r := range requests {
+		if !inOrder(r.Names, position) {
+			var err error
+
+			results[i], err = fileHashes(ctx, open, r.Algorithms, r.Names...)
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		var writer io.Writer
+		writer, hashes[i] = newHashWriter(r.Algorithms)
+
+		for _, name := range r.Names {
+			writers[name] = append(writers[name], writer)
+		}
+	}
+
+	for _, name := range order {
+		if len(writers[name]) == 0 {
+			continue
+		}
+
+		n, err := copyFile(ctx, io.MultiWriter(writers[name]...), open, name)
+		metrics.HashBytes.Add(float64(n))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range requests {
+		if hashes[i] != nil {
+			results[i] = sumHashes(hashes[i])
+		}
+	}
+
+	return results, nil
+}
+
+// inOrder returns true if the names are unique and listed in the increasing
+// order of their positions.
+func inOrder(names []string, position map[string]int) bool {
+	for i := 1; i < len(names); i++ {
+		if position[names[i]] <= position[names[i-1]] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newHashWriter returns the writer that writes into a new hash of each of the
+// given algorithms, along with such hashes.
+func newHashWriter(algorithms []ChecksumAlgorithm) (io.Writer, map[ChecksumAlgorithm]hash.Hash) {
+	hashes := make(map[ChecksumAlgorithm]hash.Hash, len(algorithms))
+	writers := make([]io.Writer, 0, len(algorithms))
+
+	for _, a := range algorithms {
+		_, ok := hashes[a]
+		if ok {
+			continue
+		}
+
+		h := a.New()
+		hashes[a] = h
+		writers = append(writers, h)
+	}
+
+	return io.MultiWriter(writers...), hashes
+}
+
+// sumHashes returns the hex encoded sums of the given hashes.
+func sumHashes(hashes map[ChecksumAlgorithm]hash.Hash) map[ChecksumAlgorithm]string {
+	result := make(map[ChecksumAlgorithm]string, len(hashes))
+	for a, h := range hashes {
+		result[a] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	return result
+}
+
+// copyFile copies the content of the file with the given name to the writer
+// and returns the number of copied bytes.
+func copyFile(ctx context.Context, w io.Writer, open func(name string) (io.ReadCloser, error), name string) (int64, error) {
+	err := ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := open(name)
+	if err != nil {
+		return 0, err
+	}
+
+	defer file.Close()
+
+	return io.Copy(w, contextReader{ctx: ctx, r: file})
+}
+
+// contextReader is a reader that fails once the context is cancelled, which
+// allows interrupting long reads, such as hashing of large files.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read implements io.Reader.
+func (r contextReader) Read(p []byte) (int, error) {
+	err := r.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	return r.r.Read(p)
+}
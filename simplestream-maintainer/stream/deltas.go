@@ -0,0 +1,292 @@
+package stream
+
+import (
+	"cmp"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// deltaBaseTypes maps the types of delta (VCDiff) items to the types of items
+// from which they are created.
+var deltaBaseTypes = map[string]string{
+	ItemTypeSquashfsDelta: ItemTypeSquashfs,
+	ItemTypeDiskKVMDelta:  ItemTypeDiskKVM,
+	ItemTypeDiskRawDelta:  ItemTypeDiskRaw,
+}
+
+// DeltaBaseType returns the type of the item from which the delta item of the
+// given type is created, and whether the given type is a delta (VCDiff) type.
+// Zsync control files are not deltas against another version.
+func DeltaBaseType(ftype string) (string, bool) {
+	baseType, ok := deltaBaseTypes[ftype]
+	return baseType, ok
+}
+
+// deltaBaseMarker separates the name of the item from the base version in the
+// names of delta (VCDiff) files, so that base versions containing dots are
+// parsed unambiguously.
+const deltaBaseMarker = ".from-"
+
+// deltaFileExt returns the extension of the delta (VCDiff) file created for the
+// item of the given type.
+func deltaFileExt(ftype string) string {
+	switch ftype {
+	case ItemTypeDiskKVM:
+		return ItemExtDiskKVMDelta
+	case ItemTypeDiskRaw:
+		return ItemExtDiskRawDelta
+	default:
+		return ItemExtSquashfsDelta
+	}
+}
+
+// DeltaFileName returns the name of the delta (VCDiff) file that updates the
+// item with the given name and type from the given base version. For example,
+// the delta of "disk.qcow2" from version "20240101.1" is named
+// "disk.from-20240101.1.qcow2.vcdiff".
+func DeltaFileName(itemName string, ftype string, baseVersion string) string {
+	prefix := strings.TrimSuffix(itemName, path.Ext(itemName))
+	return prefix + deltaBaseMarker + baseVersion + deltaFileExt(ftype)
+}
+
+// LegacyDeltaFileName returns the name under which the delta (VCDiff) file was
+// created before the base version was marked (for example,
+// "disk.20240101.qcow2.vcdiff"). Such files are still recognized, so that
+// they are not created again.
+func LegacyDeltaFileName(itemName string, ftype string, baseVersion string) string {
+	prefix := strings.TrimSuffix(itemName, path.Ext(itemName))
+	return prefix + "." + baseVersion + deltaFileExt(ftype)
+}
+
+// DeltaBaseVersion returns the base version encoded in the name of the delta
+// (VCDiff) file of the given type. In names without the base marker, the base
+// version follows the first dot of the item name, or is the whole name without
+// the extension if it contains no dot.
+func DeltaBaseVersion(name string, ftype string) string {
+	var ext string
+
+	switch ftype {
+	case ItemTypeSquashfsDelta:
+		ext = ItemExtSquashfsDelta
+	case ItemTypeDiskKVMDelta:
+		ext = ItemExtDiskKVMDelta
+	case ItemTypeDiskRawDelta:
+		ext = ItemExtDiskRawDelta
+	default:
+		return ""
+	}
+
+	rest := strings.TrimSuffix(name, ext)
+
+	_, base, ok := strings.Cut(rest, deltaBaseMarker)
+	if ok {
+		return base
+	}
+
+	_, base, ok = strings.Cut(rest, ".")
+	if ok {
+		return base
+	}
+
+	return rest
+}
+
+// DeltaEdge is a delta file that updates the item of the base version to the
+// item of the same type in the target version.
+type DeltaEdge struct {
+	// Base is the version from which the delta file was created.
+	Base string `json:"base"`
+
+	// Target is the version that contains the delta file.
+	Target string `json:"target"`
+
+	// ItemType is the type of the item updated by the delta file.
+	ItemType string `json:"ftype"`
+
+	// Path and size of the delta file.
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// DeltaCoverage summarizes how many versions can be updated using a delta
+// file of a specific item type.
+type DeltaCoverage struct {
+	// Versions is the number of versions that contain the item type,
+	// except for the oldest one, which has no base.
+	Versions int `json:"versions"`
+
+	// Covered is the number of versions that contain at least one delta
+	// file of the item type.
+	Covered int `json:"covered"`
+}
+
+// UpgradePath is the cheapest way to update an item from one version to
+// another.
+type UpgradePath struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	ItemType string `json:"ftype"`
+
+	// Deltas to apply in order. If empty, downloading the whole item
+	// is the cheapest option.
+	Deltas []DeltaEdge `json:"deltas"`
+
+	// Size is the total size to download, and FullSize is the size of
+	// the whole item of the target version.
+	Size     int64 `json:"size"`
+	FullSize int64 `json:"full_size"`
+}
+
+// DeltaGraph describes the delta files of a product, where versions are the
+// nodes and delta files are the edges from the base to the target version.
+type DeltaGraph struct {
+	// Versions of the product in ascending order.
+	Versions []string `json:"versions"`
+
+	// Deltas sorted by target version, base version, and item type.
+	Deltas []DeltaEdge `json:"deltas"`
+
+	// Coverage of the versions by the delta files mapped by item type.
+	Coverage map[string]DeltaCoverage `json:"coverage"`
+
+	// items holds the sizes of the items from which deltas are created,
+	// mapped by the version and the item type.
+	items map[string]map[string]int64
+}
+
+// NewDeltaGraph returns the delta graph of the given product.
+func NewDeltaGraph(p Product) DeltaGraph {
+	g := DeltaGraph{
+		Versions: shared.MapKeys(p.Versions),
+		Deltas:   []DeltaEdge{},
+		Coverage: make(map[string]DeltaCoverage),
+		items:    make(map[string]map[string]int64, len(p.Versions)),
+	}
+
+	slices.Sort(g.Versions)
+
+	// Item types from which the deltas are created.
+	baseTypes := make([]string, 0, len(deltaBaseTypes))
+	for _, baseType := range deltaBaseTypes {
+		baseTypes = append(baseTypes, baseType)
+	}
+
+	for i, versionName := range g.Versions {
+		covered := make(map[string]bool)
+		g.items[versionName] = make(map[string]int64)
+
+		for _, item := range p.Versions[versionName].Items {
+			if slices.Contains(baseTypes, item.Ftype) {
+				g.items[versionName][item.Ftype] = item.Size
+				continue
+			}
+
+			baseType, ok := DeltaBaseType(item.Ftype)
+			if !ok || item.DeltaBase == "" {
+				continue
+			}
+
+			g.Deltas = append(g.Deltas, DeltaEdge{
+				Base:     item.DeltaBase,
+				Target:   versionName,
+				ItemType: baseType,
+				Path:     item.Path,
+				Size:     item.Size,
+			})
+
+			covered[baseType] = true
+		}
+
+		// The oldest version has no base to be updated from.
+		if i == 0 {
+			continue
+		}
+
+		for itemType := range g.items[versionName] {
+			c := g.Coverage[itemType]
+			c.Versions++
+			if covered[itemType] {
+				c.Covered++
+			}
+
+			g.Coverage[itemType] = c
+		}
+	}
+
+	slices.SortFunc(g.Deltas, func(a DeltaEdge, b DeltaEdge) int {
+		return cmp.Or(cmp.Compare(a.Target, b.Target), cmp.Compare(a.Base, b.Base), cmp.Compare(a.ItemType, b.ItemType))
+	})
+
+	return g
+}
+
+// UpgradePath returns the cheapest way to update the item of the given type
+// from one version to another, either by applying a chain of delta files or
+// by downloading the whole item. It returns false if the target version does
+// not contain the item.
+func (g DeltaGraph) UpgradePath(from string, to string, itemType string) (UpgradePath, bool) {
+	fullSize, ok := g.items[to][itemType]
+	if !ok {
+		return UpgradePath{}, false
+	}
+
+	result := UpgradePath{
+		From:     from,
+		To:       to,
+		ItemType: itemType,
+		Deltas:   []DeltaEdge{},
+		Size:     fullSize,
+		FullSize: fullSize,
+	}
+
+	// Find the cheapest chain of deltas using Dijkstra's algorithm, where
+	// the cost of the edge is the size of the delta file.
+	costs := map[string]int64{from: 0}
+	via := make(map[string]DeltaEdge)
+	visited := make(map[string]bool)
+
+	for {
+		current := ""
+		for version, cost := range costs {
+			if !visited[version] && (current == "" || cost < costs[current] || (cost == costs[current] && version < current)) {
+				current = version
+			}
+		}
+
+		if current == "" || current == to {
+			break
+		}
+
+		visited[current] = true
+
+		for _, edge := range g.Deltas {
+			if edge.Base != current || edge.ItemType != itemType || visited[edge.Target] {
+				continue
+			}
+
+			cost := costs[current] + edge.Size
+			prev, ok := costs[edge.Target]
+			if !ok || cost < prev {
+				costs[edge.Target] = cost
+				via[edge.Target] = edge
+			}
+		}
+	}
+
+	cost, ok := costs[to]
+	if !ok || cost >= fullSize {
+		return result, true
+	}
+
+	for version := to; version != from; version = via[version].Base {
+		result.Deltas = append(result.Deltas, via[version])
+	}
+
+	slices.Reverse(result.Deltas)
+	result.Size = cost
+
+	return result, true
+}
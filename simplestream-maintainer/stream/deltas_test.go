@@ -0,0 +1,110 @@
+package stream_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+func TestDeltaFileName(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Item     string
+		Ftype    string
+		Base     string
+		WantName string
+	}{
+		{Item: "root.squashfs", Ftype: stream.ItemTypeSquashfs, Base: "20240101_0000", WantName: "root.from-20240101_0000.vcdiff"},
+		{Item: "root.squashfs", Ftype: stream.ItemTypeSquashfs, Base: "20240101.1", WantName: "root.from-20240101.1.vcdiff"},
+		{Item: "disk.qcow2", Ftype: stream.ItemTypeDiskKVM, Base: "2024.01.01.2", WantName: "disk.from-2024.01.01.2.qcow2.vcdiff"},
+		{Item: "disk1.img", Ftype: stream.ItemTypeDiskRaw, Base: "v1.0", WantName: "disk1.from-v1.0.img.vcdiff"},
+		{Item: "root.fs.squashfs", Ftype: stream.ItemTypeSquashfs, Base: "1.2", WantName: "root.fs.from-1.2.vcdiff"},
+	}
+
+	for _, test := range tests {
+		name := stream.DeltaFileName(test.Item, test.Ftype, test.Base)
+		require.Equal(t, test.WantName, name)
+
+		// Ensure the base version is parsed back from the name.
+		require.Equal(t, test.Base, stream.DeltaBaseVersion(name, stream.FileItemType(name)))
+	}
+
+	// Ensure base versions are parsed from the legacy names.
+	require.Equal(t, "disk.20240101.1.qcow2.vcdiff", stream.LegacyDeltaFileName("disk.qcow2", stream.ItemTypeDiskKVM, "20240101.1"))
+	require.Equal(t, "20240101.1", stream.DeltaBaseVersion("root.20240101.1.vcdiff", stream.ItemTypeSquashfsDelta))
+	require.Equal(t, "20240101.1", stream.DeltaBaseVersion("disk1.20240101.1.img.vcdiff", stream.ItemTypeDiskRawDelta))
+	require.Equal(t, "20240101", stream.DeltaBaseVersion("20240101.qcow2.vcdiff", stream.ItemTypeDiskKVMDelta))
+
+	// Ensure other items have no base version.
+	require.Empty(t, stream.DeltaBaseVersion("root.squashfs.zsync", stream.ItemTypeSquashfsZsync))
+}
+
+func TestDeltaGraph(t *testing.T) {
+	t.Parallel()
+
+	squashfs := func(size int64) stream.Item {
+		return stream.Item{Ftype: stream.ItemTypeSquashfs, Size: size}
+	}
+
+	delta := func(base string, path string, size int64) stream.Item {
+		return stream.Item{Ftype: stream.ItemTypeSquashfsDelta, Path: path, Size: size, DeltaBase: base}
+	}
+
+	product := stream.Product{
+		Versions: map[string]stream.Version{
+			"v1": {Items: map[string]stream.Item{
+				"rootfs.squashfs": squashfs(100),
+				"disk.qcow2":      {Ftype: stream.ItemTypeDiskKVM, Size: 300},
+			}},
+			"v2": {Items: map[string]stream.Item{
+				"rootfs.squashfs": squashfs(100),
+				"v1.vcdiff":       delta("v1", "v2/v1.vcdiff", 10),
+				"disk.qcow2":      {Ftype: stream.ItemTypeDiskKVM, Size: 300},
+			}},
+			"v3": {Items: map[string]stream.Item{
+				"rootfs.squashfs": squashfs(100),
+				"v1.vcdiff":       delta("v1", "v3/v1.vcdiff", 50),
+				"v2.vcdiff":       delta("v2", "v3/v2.vcdiff", 20),
+			}},
+		},
+	}
+
+	g := stream.NewDeltaGraph(product)
+
+	require.Equal(t, []string{"v1", "v2", "v3"}, g.Versions)
+	require.Equal(t, []stream.DeltaEdge{
+		{Base: "v1", Target: "v2", ItemType: stream.ItemTypeSquashfs, Path: "v2/v1.vcdiff", Size: 10},
+		{Base: "v1", Target: "v3", ItemType: stream.ItemTypeSquashfs, Path: "v3/v1.vcdiff", Size: 50},
+		{Base: "v2", Target: "v3", ItemType: stream.ItemTypeSquashfs, Path: "v3/v2.vcdiff", Size: 20},
+	}, g.Deltas)
+	require.Equal(t, map[string]stream.DeltaCoverage{
+		stream.ItemTypeSquashfs: {Versions: 2, Covered: 2},
+		stream.ItemTypeDiskKVM:  {Versions: 1, Covered: 0},
+	}, g.Coverage)
+
+	// Chain of deltas is cheaper than the direct delta.
+	path, ok := g.UpgradePath("v1", "v3", stream.ItemTypeSquashfs)
+	require.True(t, ok)
+	require.Equal(t, []stream.DeltaEdge{g.Deltas[0], g.Deltas[2]}, path.Deltas)
+	require.Equal(t, int64(30), path.Size)
+	require.Equal(t, int64(100), path.FullSize)
+
+	// No deltas lead to the target version.
+	path, ok = g.UpgradePath("v1", "v2", stream.ItemTypeDiskKVM)
+	require.True(t, ok)
+	require.Empty(t, path.Deltas)
+	require.Equal(t, int64(300), path.Size)
+
+	// Unknown base version.
+	path, ok = g.UpgradePath("v0", "v3", stream.ItemTypeSquashfs)
+	require.True(t, ok)
+	require.Empty(t, path.Deltas)
+	require.Equal(t, int64(100), path.Size)
+
+	// Target version does not contain the item.
+	_, ok = g.UpgradePath("v1", "v3", stream.ItemTypeDiskKVM)
+	require.False(t, ok)
+}
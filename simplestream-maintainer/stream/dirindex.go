@@ -0,0 +1,148 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+)
+
+// FileDirIndex is the name of the file containing the directory listing.
+const FileDirIndex = "dirindex.json"
+
+// DirIndex is a machine-readable listing of a single directory. It allows
+// clients to enumerate the content of object stores that do not provide
+// directory listings.
+type DirIndex struct {
+	// List of directory entries sorted by name. Hidden entries and the
+	// directory listing itself are excluded.
+	Entries []DirIndexEntry `json:"entries"`
+}
+
+// DirIndexEntry is a single entry of the directory listing.
+type DirIndexEntry struct {
+	// Name of the file or directory.
+	Name string `json:"name"`
+
+	// Type of the entry, either "file" or "directory".
+	Type string `json:"type"`
+
+	// Size of the file. Not set for directories.
+	Size int64 `json:"size,omitempty"`
+
+	// Modification time of the file. Not set for directories.
+	Modified *time.Time `json:"modified,omitempty"`
+}
+
+// Directory index entry types.
+const (
+	DirIndexEntryFile      = "file"
+	DirIndexEntryDirectory = "directory"
+)
+
+// GetDirIndex returns the listing of the directory on the given path.
+func GetDirIndex(dirPath string) (*DirIndex, error) {
+	return getDirIndex(storage.NewLocal(dirPath), "")
+}
+
+// getDirIndex returns the listing of the directory with the given name from
+// the storage backend.
+func getDirIndex(b storage.Backend, dirName string) (*DirIndex, error) {
+	files, err := b.List(dirName)
+	if err != nil {
+		return nil, err
+	}
+
+	index := &DirIndex{
+		Entries: []DirIndexEntry{},
+	}
+
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), ".") || f.Name() == FileDirIndex {
+			continue
+		}
+
+		if f.IsDir() {
+			index.Entries = append(index.Entries, DirIndexEntry{
+				Name: f.Name(),
+				Type: DirIndexEntryDirectory,
+			})
+
+			continue
+		}
+
+		if !f.Mode().IsRegular() {
+			continue
+		}
+
+		modified := f.ModTime().UTC()
+
+		index.Entries = append(index.Entries, DirIndexEntry{
+			Name:     f.Name(),
+			Type:     DirIndexEntryFile,
+			Size:     f.Size(),
+			Modified: &modified,
+		})
+	}
+
+	return index, nil
+}
+
+// WriteDirIndexes writes the directory listing into each non-hidden directory
+// within the given root directory, including the root directory itself. The
+// listing file is replaced only if its content has changed. Root directory
+// may also be an S3 URL.
+func WriteDirIndexes(rootDir string) error {
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return err
+	}
+
+	var walk func(dirName string) error
+	walk = func(dirName string) error {
+		index, err := getDirIndex(b, dirName)
+		if err != nil {
+			return err
+		}
+
+		content, err := json.Marshal(index)
+		if err != nil {
+			return err
+		}
+
+		indexName := path.Join(dirName, FileDirIndex)
+
+		// Skip unchanged listings.
+		old, err := storage.ReadFile(b, indexName)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		if err != nil || !bytes.Equal(old, content) {
+			err := storage.WriteFile(b, indexName, content)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, e := range index.Entries {
+			if e.Type != DirIndexEntryDirectory {
+				continue
+			}
+
+			err := walk(path.Join(dirName, e.Name))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return walk("")
+}
@@ -0,0 +1,72 @@
+package stream_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+func TestWriteDirIndexes(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	files := map[string]string{
+		"streams/v1/index.json":             "{}",
+		"images/ubuntu/noble/1/lxd.tar.xz":  "metadata",
+		"images/ubuntu/noble/1/disk.qcow2":  "qcow2",
+		"images/ubuntu/noble/.2/lxd.tar.xz": "hidden",
+		".hidden":                           "hidden",
+	}
+
+	for path, content := range files {
+		path = filepath.Join(rootDir, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), os.ModePerm))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+
+	err := stream.WriteDirIndexes(rootDir)
+	require.NoError(t, err)
+
+	// entryNames returns names and types of the listing entries.
+	entryNames := func(relPath string) map[string]string {
+		index, err := shared.ReadJSONFile(filepath.Join(rootDir, relPath, stream.FileDirIndex), &stream.DirIndex{})
+		require.NoError(t, err)
+
+		names := make(map[string]string, len(index.Entries))
+		for _, e := range index.Entries {
+			names[e.Name] = e.Type
+		}
+
+		return names
+	}
+
+	require.Equal(t, map[string]string{"images": "directory", "streams": "directory"}, entryNames(""))
+	require.Equal(t, map[string]string{"1": "directory"}, entryNames("images/ubuntu/noble"))
+	require.Equal(t, map[string]string{"lxd.tar.xz": "file", "disk.qcow2": "file"}, entryNames("images/ubuntu/noble/1"))
+	require.NoFileExists(t, filepath.Join(rootDir, "images/ubuntu/noble/.2", stream.FileDirIndex))
+
+	// Ensure file sizes are listed.
+	index, err := stream.GetDirIndex(filepath.Join(rootDir, "images/ubuntu/noble/1"))
+	require.NoError(t, err)
+	require.Len(t, index.Entries, 2)
+	require.Equal(t, "disk.qcow2", index.Entries[0].Name)
+	require.Equal(t, int64(5), index.Entries[0].Size)
+
+	// Ensure unchanged listing is not rewritten.
+	indexPath := filepath.Join(rootDir, "images/ubuntu/noble/1", stream.FileDirIndex)
+	infoBefore, err := os.Stat(indexPath)
+	require.NoError(t, err)
+
+	err = stream.WriteDirIndexes(rootDir)
+	require.NoError(t, err)
+
+	infoAfter, err := os.Stat(indexPath)
+	require.NoError(t, err)
+	require.True(t, os.SameFile(infoBefore, infoAfter))
+}
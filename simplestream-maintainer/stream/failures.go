@@ -0,0 +1,215 @@
+package stream
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+)
+
+// Failure is a record of the failed attempts to process a product version
+// or one of its delta files.
+type Failure struct {
+	// Attempts is the number of consecutive failed attempts.
+	Attempts int `json:"attempts"`
+
+	// LastAttempt is the time of the last failed attempt.
+	LastAttempt time.Time `json:"last_attempt"`
+
+	// ModTime is the modification time of the processed file at the time
+	// of the last failed attempt. Once the file changes (e.g. the version
+	// is uploaded again), previous failed attempts are no longer counted.
+	ModTime time.Time `json:"mod_time"`
+
+	// Error of the last failed attempt.
+	Error string `json:"error"`
+}
+
+// Failures holds the failed attempts mapped by the product ID and the key of
+// the failed operation. The key is either the version name, or the version
+// name and the delta file name joined with a slash (see FailureKey).
+type Failures map[string]map[string]Failure
+
+// FailureKey returns the key of the failed operation on the given product
+// version. If the item name is not empty, the key refers to the item (e.g.
+// delta file) within the version.
+func FailureKey(versionName string, itemName string) string {
+	if itemName == "" {
+		return versionName
+	}
+
+	return path.Join(versionName, itemName)
+}
+
+// FailuresPath returns the path of the file, relative to the root directory,
+// in which the failed attempts of the given stream are stored. The file is
+// hidden, so that it is not served along with the product catalog.
+func FailuresPath(streamVersion string, streamName string) string {
+	return path.Join("streams", streamVersion, fmt.Sprintf(".%s.failures.json", streamName))
+}
+
+// ReadFailures reads the failed attempts of the given stream. If the file does
+// not exist, empty failures are returned.
+func ReadFailures(b storage.Backend, streamVersion string, streamName string) (Failures, error) {
+	failures := Failures{}
+
+	_, err := storage.ReadJSONFile(b, FailuresPath(streamVersion, streamName), &failures)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("Failed to read failed attempts: %w", err)
+	}
+
+	return failures, nil
+}
+
+// WriteFailures replaces the failed attempts of the given stream.
+func WriteFailures(b storage.Backend, streamVersion string, streamName string, failures Failures) error {
+	content, err := json.MarshalIndent(failures, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = storage.WriteFile(b, FailuresPath(streamVersion, streamName), content)
+	if err != nil {
+		return fmt.Errorf("Failed to write failed attempts: %w", err)
+	}
+
+	return nil
+}
+
+// Get returns the failed attempts of the operation with the given key, and
+// whether any are recorded.
+func (f Failures) Get(productID string, key string) (Failure, bool) {
+	failure, ok := f[productID][key]
+	return failure, ok
+}
+
+// Add records a failed attempt of the operation with the given key. Attempts
+// are counted only while the processed file has the same modification time.
+// The updated record is returned.
+func (f Failures) Add(productID string, key string, modTime time.Time, now time.Time, err error) Failure {
+	failure, ok := f.Get(productID, key)
+	if !ok || !failure.ModTime.Equal(modTime) {
+		failure = Failure{}
+	}
+
+	failure.Attempts++
+	failure.LastAttempt = now.UTC()
+	failure.ModTime = modTime.UTC()
+	failure.Error = err.Error()
+
+	if f[productID] == nil {
+		f[productID] = make(map[string]Failure)
+	}
+
+	f[productID][key] = failure
+	return failure
+}
+
+// Remove removes the failed attempts of the operation with the given key. It
+// returns true if any were recorded.
+func (f Failures) Remove(productID string, key string) bool {
+	_, ok := f.Get(productID, key)
+	if !ok {
+		return false
+	}
+
+	delete(f[productID], key)
+	if len(f[productID]) == 0 {
+		delete(f, productID)
+	}
+
+	return true
+}
+
+// Retain removes failed attempts of the product versions that no longer exist
+// within the given products. It returns true if any failed attempt was
+// removed.
+func (f Failures) Retain(products map[string]Product) bool {
+	changed := false
+
+	for id, failures := range f {
+		for key := range failures {
+			versionName, _, _ := strings.Cut(key, "/")
+
+			_, ok := products[id].Versions[versionName]
+			if !ok {
+				delete(failures, key)
+				changed = true
+			}
+		}
+
+		if len(failures) == 0 {
+			delete(f, id)
+		}
+	}
+
+	return changed
+}
+
+// RetryPolicy determines when the failed operations are attempted again. The
+// delay between the attempts grows exponentially from the initial backoff up
+// to the maximum backoff.
+type RetryPolicy struct {
+	// Backoff is the delay after the first failed attempt. If zero, failed
+	// operations are attempted again on every build.
+	Backoff time.Duration
+
+	// MaxBackoff is the upper limit of the delay. If zero, the delay is not
+	// limited.
+	MaxBackoff time.Duration
+
+	// MaxAttempts is the number of failed attempts after which the operation
+	// is no longer attempted. If zero, the number of attempts is not limited.
+	MaxAttempts int
+}
+
+// Enabled returns true if failed operations are not attempted again on every
+// build.
+func (p RetryPolicy) Enabled() bool {
+	return p.Backoff > 0 || p.MaxAttempts > 0
+}
+
+// Delay returns the delay after the given number of failed attempts.
+func (p RetryPolicy) Delay(attempts int) time.Duration {
+	if attempts < 1 || p.Backoff <= 0 {
+		return 0
+	}
+
+	delay := p.Backoff
+	for i := 1; i < attempts; i++ {
+		// Stop doubling once the limit is reached or the delay
+		// would overflow.
+		if (p.MaxBackoff > 0 && delay >= p.MaxBackoff) || delay >= time.Duration(1<<62) {
+			break
+		}
+
+		delay *= 2
+	}
+
+	if p.MaxBackoff > 0 {
+		delay = min(delay, p.MaxBackoff)
+	}
+
+	return delay
+}
+
+// Exhausted returns true if the operation has failed too many times to be
+// attempted again.
+func (p RetryPolicy) Exhausted(failure Failure) bool {
+	return p.MaxAttempts > 0 && failure.Attempts >= p.MaxAttempts
+}
+
+// Due returns true if the failed operation should be attempted again at the
+// given time.
+func (p RetryPolicy) Due(failure Failure, now time.Time) bool {
+	if p.Exhausted(failure) {
+		return false
+	}
+
+	return !now.Before(failure.LastAttempt.Add(p.Delay(failure.Attempts)))
+}
@@ -0,0 +1,107 @@
+package stream_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+func TestFailures(t *testing.T) {
+	t.Parallel()
+
+	b := storage.NewLocal(t.TempDir())
+
+	// Ensure missing file results in empty failures.
+	failures, err := stream.ReadFailures(b, "v1", "images")
+	require.NoError(t, err)
+	require.Empty(t, failures)
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	modTime := now.Add(-time.Hour)
+	deltaKey := stream.FailureKey("02", "root.01.vcdiff")
+
+	// Ensure attempts are counted while the file is unchanged.
+	failures.Add("ubuntu:noble:amd64:cloud", "01", modTime, now, errors.New("first"))
+	failure := failures.Add("ubuntu:noble:amd64:cloud", "01", modTime, now.Add(time.Minute), errors.New("second"))
+	require.Equal(t, 2, failure.Attempts)
+	require.Equal(t, "second", failure.Error)
+	require.Equal(t, now.Add(time.Minute), failure.LastAttempt)
+
+	// Ensure attempts are reset once the file changes.
+	failures.Add("ubuntu:noble:amd64:cloud", deltaKey, modTime, now, errors.New("delta"))
+	failure = failures.Add("ubuntu:noble:amd64:cloud", deltaKey, now, now, errors.New("delta"))
+	require.Equal(t, 1, failure.Attempts)
+
+	// Ensure failures are read back.
+	require.NoError(t, stream.WriteFailures(b, "v1", "images", failures))
+	require.FileExists(t, b.Path(stream.FailuresPath("v1", "images")))
+
+	failures, err = stream.ReadFailures(b, "v1", "images")
+	require.NoError(t, err)
+
+	got, ok := failures.Get("ubuntu:noble:amd64:cloud", "01")
+	require.True(t, ok)
+	require.Equal(t, 2, got.Attempts)
+	require.True(t, modTime.Equal(got.ModTime))
+
+	// Ensure only failures of the existing versions are retained.
+	products := map[string]stream.Product{
+		"ubuntu:noble:amd64:cloud": {
+			Versions: map[string]stream.Version{"02": {}},
+		},
+	}
+
+	require.True(t, failures.Retain(products))
+	require.False(t, failures.Retain(products))
+
+	_, ok = failures.Get("ubuntu:noble:amd64:cloud", "01")
+	require.False(t, ok)
+
+	// Ensure removal of the last failure removes the product.
+	require.True(t, failures.Remove("ubuntu:noble:amd64:cloud", deltaKey))
+	require.False(t, failures.Remove("ubuntu:noble:amd64:cloud", deltaKey))
+	require.Empty(t, failures)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	t.Parallel()
+
+	policy := stream.RetryPolicy{
+		Backoff:     10 * time.Minute,
+		MaxBackoff:  time.Hour,
+		MaxAttempts: 5,
+	}
+
+	require.True(t, policy.Enabled())
+	require.False(t, stream.RetryPolicy{}.Enabled())
+
+	// Ensure delay grows exponentially up to the limit.
+	require.Equal(t, time.Duration(0), policy.Delay(0))
+	require.Equal(t, 10*time.Minute, policy.Delay(1))
+	require.Equal(t, 20*time.Minute, policy.Delay(2))
+	require.Equal(t, 40*time.Minute, policy.Delay(3))
+	require.Equal(t, time.Hour, policy.Delay(4))
+	require.Equal(t, time.Hour, policy.Delay(100))
+
+	// Ensure delay does not overflow without the limit.
+	require.Positive(t, stream.RetryPolicy{Backoff: time.Hour}.Delay(1000))
+
+	lastAttempt := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	failure := stream.Failure{Attempts: 2, LastAttempt: lastAttempt}
+
+	require.False(t, policy.Due(failure, lastAttempt.Add(19*time.Minute)))
+	require.True(t, policy.Due(failure, lastAttempt.Add(20*time.Minute)))
+
+	// Ensure exhausted operations are never due.
+	failure.Attempts = 5
+	require.True(t, policy.Exhausted(failure))
+	require.False(t, policy.Due(failure, lastAttempt.Add(24*time.Hour)))
+
+	// Ensure failed operations are always due without a policy.
+	require.True(t, stream.RetryPolicy{}.Due(failure, lastAttempt))
+}
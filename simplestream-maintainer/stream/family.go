@@ -0,0 +1,85 @@
+package stream
+
+import (
+	"slices"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// Family groups the products of the same distribution and holds aggregate
+// statistics about them.
+type Family struct {
+	// Name of the distribution.
+	Distro string `json:"distro"`
+
+	// Pretty name of the operating system.
+	OS string `json:"os"`
+
+	// Sorted list of distribution releases.
+	Releases []string `json:"releases"`
+
+	// Sorted list of architectures available across all releases.
+	Architectures []string `json:"architectures"`
+
+	// Sorted list of IDs of the products within the family.
+	Products []string `json:"products"`
+
+	// Total number of product versions within the family.
+	Versions int `json:"versions"`
+
+	// Total size of all items within the family.
+	Size int64 `json:"size"`
+}
+
+// Families groups catalog products by their distribution and returns the list
+// of families sorted by distribution name.
+func (c ProductCatalog) Families() []Family {
+	families := make(map[string]*Family)
+
+	ids := shared.MapKeys(c.Products)
+	slices.Sort(ids)
+
+	for _, id := range ids {
+		p := c.Products[id]
+
+		f, ok := families[p.Distro]
+		if !ok {
+			f = &Family{
+				Distro: p.Distro,
+				OS:     p.OS,
+			}
+
+			families[p.Distro] = f
+		}
+
+		if !slices.Contains(f.Releases, p.Release) {
+			f.Releases = append(f.Releases, p.Release)
+		}
+
+		if !slices.Contains(f.Architectures, p.Architecture) {
+			f.Architectures = append(f.Architectures, p.Architecture)
+		}
+
+		f.Products = append(f.Products, id)
+		f.Versions += len(p.Versions)
+
+		for _, v := range p.Versions {
+			for _, item := range v.Items {
+				f.Size += item.Size
+			}
+		}
+	}
+
+	distros := shared.MapKeys(families)
+	slices.Sort(distros)
+
+	result := make([]Family, 0, len(distros))
+	for _, distro := range distros {
+		f := families[distro]
+		slices.Sort(f.Releases)
+		slices.Sort(f.Architectures)
+		result = append(result, *f)
+	}
+
+	return result
+}
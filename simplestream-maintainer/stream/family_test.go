@@ -0,0 +1,57 @@
+package stream_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+func TestFamilies(t *testing.T) {
+	t.Parallel()
+
+	version := func(sizes ...int64) stream.Version {
+		v := stream.Version{Items: map[string]stream.Item{}}
+		for i, size := range sizes {
+			v.Items[string(rune('a'+i))] = stream.Item{Size: size}
+		}
+
+		return v
+	}
+
+	catalog := stream.NewCatalog("images", map[string]stream.Product{
+		"ubuntu:noble:amd64:cloud": {
+			Distro: "ubuntu", OS: "Ubuntu", Release: "noble", Architecture: "amd64",
+			Versions: map[string]stream.Version{"v1": version(10, 20), "v2": version(5)},
+		},
+		"ubuntu:jammy:arm64:default": {
+			Distro: "ubuntu", OS: "Ubuntu", Release: "jammy", Architecture: "arm64",
+			Versions: map[string]stream.Version{"v1": version(1)},
+		},
+		"alpine:edge:amd64:default": {
+			Distro: "alpine", OS: "Alpine", Release: "edge", Architecture: "amd64",
+		},
+	})
+
+	want := []stream.Family{
+		{
+			Distro:        "alpine",
+			OS:            "Alpine",
+			Releases:      []string{"edge"},
+			Architectures: []string{"amd64"},
+			Products:      []string{"alpine:edge:amd64:default"},
+		},
+		{
+			Distro:        "ubuntu",
+			OS:            "Ubuntu",
+			Releases:      []string{"jammy", "noble"},
+			Architectures: []string{"amd64", "arm64"},
+			Products:      []string{"ubuntu:jammy:arm64:default", "ubuntu:noble:amd64:cloud"},
+			Versions:      3,
+			Size:          36,
+		},
+	}
+
+	require.Equal(t, want, catalog.Families())
+}
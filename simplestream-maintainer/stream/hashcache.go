@@ -0,0 +1,338 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+)
+
+// HashCache caches file hashes keyed by the file path, size, and modification
+// time. It allows skipping hash calculation for files that have not changed
+// since their hash was last calculated.
+//
+// Since the cache is saved only once the build finishes, entries calculated
+// in the meantime can be checkpointed to the progress journal next to the
+// cache file. The journal is replayed when the cache is loaded, so that the
+// build interrupted by a crash does not need to recalculate them.
+type HashCache struct {
+	mutex   sync.Mutex
+	relPath string
+	entries map[string]hashCacheEntry
+
+	// Entries that were not yet written to the journal.
+	pending map[string]hashCacheEntry
+
+	// Serializes writes to the journal.
+	journalMutex sync.Mutex
+}
+
+// hashCacheEntry contains cached hashes of a single file (or a combination
+// of files) per algorithm. Stamps contain the size and the modification time
+// of each file the hashes were calculated from.
+type hashCacheEntry struct {
+	Stamps []string                     `json:"stamps"`
+	Hashes map[ChecksumAlgorithm]string `json:"hashes"`
+}
+
+// hashCacheRecord is a single line of the progress journal.
+type hashCacheRecord struct {
+	Key string `json:"key"`
+	hashCacheEntry
+}
+
+// HashCachePath returns the path of the hash cache file of the given stream,
+// relative to the root directory.
+func HashCachePath(streamVersion string, streamName string) string {
+	return path.Join("streams", streamVersion, fmt.Sprintf(".%s.hashes.json", streamName))
+}
+
+// LoadHashCache reads the hash cache from the file on the given path relative
+// to rootDir, and applies the entries from the progress journal left behind
+// by an interrupted build. If the file does not exist, an empty cache is
+// returned.
+func LoadHashCache(rootDir string, relPath string) (*HashCache, error) {
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := &HashCache{
+		relPath: relPath,
+		entries: make(map[string]hashCacheEntry),
+		pending: make(map[string]hashCacheEntry),
+	}
+
+	_, err = storage.ReadJSONFile(b, relPath, &cache.entries)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("Failed to read hash cache: %w", err)
+	}
+
+	if cache.entries == nil {
+		cache.entries = make(map[string]hashCacheEntry)
+	}
+
+	journal, err := storage.ReadFile(b, cache.journalPath())
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("Failed to read hash cache journal: %w", err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(journal))
+	scanner.Buffer(nil, 1024*1024)
+
+	for scanner.Scan() {
+		var record hashCacheRecord
+
+		// The last record may be incomplete if the build was killed
+		// while it was being written.
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil || record.Key == "" {
+			continue
+		}
+
+		cache.entries[record.Key] = record.hashCacheEntry
+	}
+
+	return cache, nil
+}
+
+// journalPath returns the path of the progress journal, which is located next
+// to the cache file (e.g. ".images.hashes.progress").
+func (c *HashCache) journalPath() string {
+	return strings.TrimSuffix(c.relPath, path.Ext(c.relPath)) + ".progress"
+}
+
+// Checkpoint appends the entries calculated since the last checkpoint to the
+// progress journal. A nil cache is a no-op.
+func (c *HashCache) Checkpoint(rootDir string) error {
+	if c == nil {
+		return nil
+	}
+
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return err
+	}
+
+	c.journalMutex.Lock()
+	defer c.journalMutex.Unlock()
+
+	c.mutex.Lock()
+	pending := c.pending
+	c.pending = make(map[string]hashCacheEntry)
+	c.mutex.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	var content strings.Builder
+
+	for key, entry := range pending {
+		line, err := json.Marshal(hashCacheRecord{Key: key, hashCacheEntry: entry})
+		if err != nil {
+			return err
+		}
+
+		content.Write(line)
+		content.WriteString("\n")
+	}
+
+	err = storage.AppendFile(b, c.journalPath(), content.String())
+	if errors.Is(err, fs.ErrNotExist) {
+		err = storage.WriteFile(b, c.journalPath(), []byte(content.String()))
+	}
+
+	return err
+}
+
+// Save writes the hash cache to the file it was loaded from. Entries of the
+// files that no longer exist are dropped. Cache file is replaced atomically.
+func (c *HashCache) Save(rootDir string) error {
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return err
+	}
+
+	c.journalMutex.Lock()
+	defer c.journalMutex.Unlock()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key := range c.entries {
+		for _, relPath := range strings.Split(key, "|") {
+			_, err := b.Stat(relPath)
+			if err != nil {
+				delete(c.entries, key)
+				break
+			}
+		}
+	}
+
+	content, err := json.MarshalIndent(c.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = storage.WriteFile(b, c.relPath, content)
+	if err != nil {
+		return err
+	}
+
+	// Journal is no longer needed, as all entries are saved.
+	c.pending = make(map[string]hashCacheEntry)
+
+	return b.Delete(c.journalPath())
+}
+
+// FileHash returns the combined SHA256 hash of the files on the given paths
+// relative to rootDir. If the files have not changed since the hash was last
+// calculated, the cached hash is returned. Otherwise, the hash is calculated
+// and stored in the cache. A nil cache always calculates the hash.
+func (c *HashCache) FileHash(ctx context.Context, rootDir string, relPaths ...string) (string, error) {
+	hashes, err := c.FileHashes(ctx, rootDir, []ChecksumAlgorithm{ChecksumSHA256}, relPaths...)
+	if err != nil {
+		return "", err
+	}
+
+	return hashes[ChecksumSHA256], nil
+}
+
+// FileHashes is like FileHash, except that it returns the combined hashes of
+// the files for each of the given algorithms. If any of the hashes is not
+// cached, all of them are calculated in a single pass over the files.
+func (c *HashCache) FileHashes(ctx context.Context, rootDir string, algorithms []ChecksumAlgorithm, relPaths ...string) (map[ChecksumAlgorithm]string, error) {
+	hashes, err := c.BatchFileHashes(ctx, rootDir, []HashRequest{{Algorithms: algorithms, Names: relPaths}})
+	if err != nil {
+		return nil, err
+	}
+
+	return hashes[0], nil
+}
+
+// BatchFileHashes returns the hashes for each of the requests, where names
+// are file paths relative to rootDir. Cached hashes are returned for the files
+// that have not changed, while the remaining hashes are calculated reading
+// each file only once, even if it is included in multiple requests (e.g. the
+// metadata file combined with each of the root filesystem files).
+func (c *HashCache) BatchFileHashes(ctx context.Context, rootDir string, requests []HashRequest) ([]map[ChecksumAlgorithm]string, error) {
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if c == nil {
+		return batchFileHashes(ctx, b.Open, requests)
+	}
+
+	results := make([]map[ChecksumAlgorithm]string, len(requests))
+	fileStamps := make(map[string]string)
+
+	var missing []int
+	var missingStamps [][]string
+
+	for i, r := range requests {
+		stamps := make([]string, 0, len(r.Names))
+		for _, relPath := range r.Names {
+			stamp, ok := fileStamps[relPath]
+			if !ok {
+				info, err := b.Stat(relPath)
+				if err != nil {
+					return nil, err
+				}
+
+				stamp = fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano())
+				fileStamps[relPath] = stamp
+			}
+
+			stamps = append(stamps, stamp)
+		}
+
+		hashes, ok := c.lookup(strings.Join(r.Names, "|"), stamps, r.Algorithms)
+		if ok {
+			results[i] = hashes
+			continue
+		}
+
+		missing = append(missing, i)
+		missingStamps = append(missingStamps, stamps)
+	}
+
+	if len(missing) == 0 {
+		return results, nil
+	}
+
+	pending := make([]HashRequest, 0, len(missing))
+	for _, i := range missing {
+		pending = append(pending, requests[i])
+	}
+
+	hashes, err := batchFileHashes(ctx, b.Open, pending)
+	if err != nil {
+		return nil, err
+	}
+
+	for j, i := range missing {
+		c.store(strings.Join(requests[i].Names, "|"), missingStamps[j], hashes[j])
+		results[i] = hashes[j]
+	}
+
+	return results, nil
+}
+
+// lookup returns the cached hashes of the entry with the given key for each of
+// the given algorithms, if the entry has the given stamps and contains all of
+// them.
+func (c *HashCache) lookup(key string, stamps []string, algorithms []ChecksumAlgorithm) (map[ChecksumAlgorithm]string, bool) {
+	c.mutex.Lock()
+	entry, ok := c.entries[key]
+	c.mutex.Unlock()
+
+	if !ok || !slices.Equal(entry.Stamps, stamps) {
+		return nil, false
+	}
+
+	hashes := make(map[ChecksumAlgorithm]string, len(algorithms))
+
+	for _, a := range algorithms {
+		hash, ok := entry.Hashes[a]
+		if !ok {
+			return nil, false
+		}
+
+		hashes[a] = hash
+	}
+
+	return hashes, true
+}
+
+// store stores the calculated hashes in the entry with the given key. Cached
+// hashes of other algorithms are retained if the files are unchanged.
+func (c *HashCache) store(key string, stamps []string, hashes map[ChecksumAlgorithm]string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || !slices.Equal(entry.Stamps, stamps) {
+		entry = hashCacheEntry{Stamps: stamps}
+	}
+
+	newHashes := make(map[ChecksumAlgorithm]string, len(entry.Hashes)+len(hashes))
+	maps.Copy(newHashes, entry.Hashes)
+	maps.Copy(newHashes, hashes)
+	entry.Hashes = newHashes
+
+	c.entries[key] = entry
+	c.pending[key] = entry
+}
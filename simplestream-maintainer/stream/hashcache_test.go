@@ -0,0 +1,296 @@
+package stream_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/testutils"
+)
+
+func TestHashCache(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+	cacheRelPath := stream.HashCachePath("v1", "images")
+	cachePath := filepath.Join(rootDir, cacheRelPath)
+	require.Equal(t, "streams/v1/.images.hashes.json", cacheRelPath)
+
+	item := testutils.MockItem("images/file.qcow2")
+	item.Create(t, rootDir)
+
+	// Calculate the hash and store it in the cache.
+	cache, err := stream.LoadHashCache(rootDir, cacheRelPath)
+	require.NoError(t, err)
+
+	hash, err := cache.FileHash(context.Background(), rootDir, item.RelPath())
+	require.NoError(t, err)
+	require.Equal(t, testutils.ItemDefaultContentSHA, hash)
+
+	err = cache.Save(rootDir)
+	require.NoError(t, err)
+
+	// Modify the file content, but retain its size and modification time.
+	info, err := os.Stat(item.AbsPath())
+	require.NoError(t, err)
+
+	err = os.WriteFile(item.AbsPath(), []byte("TEST-CONTENT"), 0644)
+	require.NoError(t, err)
+
+	err = os.Chtimes(item.AbsPath(), info.ModTime(), info.ModTime())
+	require.NoError(t, err)
+
+	// Ensure the hash is retrieved from the reloaded cache.
+	cache, err = stream.LoadHashCache(rootDir, cacheRelPath)
+	require.NoError(t, err)
+
+	hash, err = cache.FileHash(context.Background(), rootDir, item.RelPath())
+	require.NoError(t, err)
+	require.Equal(t, testutils.ItemDefaultContentSHA, hash)
+
+	// Ensure the hash is recalculated once the modification time changes.
+	newTime := info.ModTime().Add(time.Minute)
+	err = os.Chtimes(item.AbsPath(), newTime, newTime)
+	require.NoError(t, err)
+
+	hash, err = cache.FileHash(context.Background(), rootDir, item.RelPath())
+	require.NoError(t, err)
+	require.NotEqual(t, testutils.ItemDefaultContentSHA, hash)
+
+	// Ensure nil cache always calculates the hash.
+	var nilCache *stream.HashCache
+	hash2, err := nilCache.FileHash(context.Background(), rootDir, item.RelPath())
+	require.NoError(t, err)
+	require.Equal(t, hash, hash2)
+
+	// Ensure entries of removed files are dropped on save.
+	err = os.Remove(item.AbsPath())
+	require.NoError(t, err)
+
+	err = cache.Save(rootDir)
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(cachePath)
+	require.NoError(t, err)
+	require.Equal(t, "{}", string(content[:2]))
+}
+
+func TestHashCache_Checkpoint(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+	cacheRelPath := filepath.Join("streams", "v1", ".images.hashes.json")
+	journalPath := filepath.Join(rootDir, "streams", "v1", ".images.hashes.progress")
+
+	item := testutils.MockItem("images/file.qcow2")
+	item.Create(t, rootDir)
+
+	// Calculate the hash and checkpoint it, but do not save the cache, as
+	// if the build was killed.
+	cache, err := stream.LoadHashCache(rootDir, cacheRelPath)
+	require.NoError(t, err)
+
+	_, err = cache.FileHash(context.Background(), rootDir, item.RelPath())
+	require.NoError(t, err)
+
+	err = cache.Checkpoint(rootDir)
+	require.NoError(t, err)
+	require.FileExists(t, journalPath)
+
+	// Simulate a record that was only partially written.
+	file, err := os.OpenFile(journalPath, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"key":"images/oth`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	// Modify the file content, but retain its size and modification time.
+	info, err := os.Stat(item.AbsPath())
+	require.NoError(t, err)
+
+	err = os.WriteFile(item.AbsPath(), []byte("TEST-CONTENT"), 0644)
+	require.NoError(t, err)
+
+	err = os.Chtimes(item.AbsPath(), info.ModTime(), info.ModTime())
+	require.NoError(t, err)
+
+	// Ensure the hash is retrieved from the journal.
+	cache, err = stream.LoadHashCache(rootDir, cacheRelPath)
+	require.NoError(t, err)
+
+	hash, err := cache.FileHash(context.Background(), rootDir, item.RelPath())
+	require.NoError(t, err)
+	require.Equal(t, testutils.ItemDefaultContentSHA, hash)
+
+	// Ensure the journal is removed once the cache is saved.
+	err = cache.Save(rootDir)
+	require.NoError(t, err)
+	require.NoFileExists(t, journalPath)
+
+	// Ensure nil cache does not write the journal.
+	var nilCache *stream.HashCache
+	require.NoError(t, nilCache.Checkpoint(rootDir))
+	require.NoFileExists(t, journalPath)
+}
+
+func TestFileHashes(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	item := testutils.MockItem("images/file.qcow2")
+	item.Create(t, rootDir)
+
+	algorithms := []stream.ChecksumAlgorithm{stream.ChecksumSHA256, stream.ChecksumSHA512, stream.ChecksumBLAKE2b}
+	want := map[stream.ChecksumAlgorithm]string{
+		stream.ChecksumSHA256:  testutils.ItemDefaultContentSHA,
+		stream.ChecksumSHA512:  testutils.ItemDefaultContentSHA512,
+		stream.ChecksumBLAKE2b: testutils.ItemDefaultContentBLAKE2b,
+	}
+
+	cache, err := stream.LoadHashCache(rootDir, ".hashes.json")
+	require.NoError(t, err)
+
+	// Ensure only the requested hash is calculated and cached.
+	hashes, err := cache.FileHashes(context.Background(), rootDir, algorithms[:1], item.RelPath())
+	require.NoError(t, err)
+	require.Equal(t, map[stream.ChecksumAlgorithm]string{stream.ChecksumSHA256: want[stream.ChecksumSHA256]}, hashes)
+
+	// Ensure missing hashes are calculated for the cached file.
+	hashes, err = cache.FileHashes(context.Background(), rootDir, algorithms, item.RelPath())
+	require.NoError(t, err)
+	require.Equal(t, want, hashes)
+
+	// Ensure nil cache calculates the same hashes.
+	var nilCache *stream.HashCache
+	hashes, err = nilCache.FileHashes(context.Background(), rootDir, algorithms, item.RelPath())
+	require.NoError(t, err)
+	require.Equal(t, want, hashes)
+
+	// Ensure hashing is interrupted once the context is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = nilCache.FileHashes(ctx, rootDir, algorithms, item.RelPath())
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestBatchFileHashes(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	meta := testutils.MockItem("images/lxd.tar.xz").WithContent("metadata")
+	meta.Create(t, rootDir)
+
+	rootfs := testutils.MockItem("images/root.squashfs").WithContent("rootfs")
+	rootfs.Create(t, rootDir)
+
+	algorithms := []stream.ChecksumAlgorithm{stream.ChecksumSHA256, stream.ChecksumSHA512}
+	requests := []stream.HashRequest{
+		{Algorithms: algorithms, Names: []string{meta.RelPath()}},
+		{Algorithms: algorithms, Names: []string{rootfs.RelPath()}},
+		{Algorithms: algorithms[:1], Names: []string{meta.RelPath(), rootfs.RelPath()}},
+		// Files are listed in a different order than they are read.
+		{Algorithms: algorithms[:1], Names: []string{rootfs.RelPath(), meta.RelPath()}},
+	}
+
+	// Expect the same hashes as if each request was calculated separately.
+	want := make([]map[stream.ChecksumAlgorithm]string, 0, len(requests))
+	for _, r := range requests {
+		paths := make([]string, 0, len(r.Names))
+		for _, name := range r.Names {
+			paths = append(paths, filepath.Join(rootDir, name))
+		}
+
+		hashes, err := stream.FileHashes(context.Background(), r.Algorithms, paths...)
+		require.NoError(t, err)
+		want = append(want, hashes)
+	}
+
+	require.NotEqual(t, want[2], want[3])
+
+	// Ensure nil cache calculates the hashes.
+	var nilCache *stream.HashCache
+	hashes, err := nilCache.BatchFileHashes(context.Background(), rootDir, requests)
+	require.NoError(t, err)
+	require.Equal(t, want, hashes)
+
+	// Ensure the calculated hashes are cached.
+	cache, err := stream.LoadHashCache(rootDir, ".hashes.json")
+	require.NoError(t, err)
+
+	hashes, err = cache.BatchFileHashes(context.Background(), rootDir, requests)
+	require.NoError(t, err)
+	require.Equal(t, want, hashes)
+
+	// Modify the metadata content, but retain its size and modification time.
+	info, err := os.Stat(meta.AbsPath())
+	require.NoError(t, err)
+
+	err = os.WriteFile(meta.AbsPath(), []byte("METADATA"), 0644)
+	require.NoError(t, err)
+
+	err = os.Chtimes(meta.AbsPath(), info.ModTime(), info.ModTime())
+	require.NoError(t, err)
+
+	hashes, err = cache.BatchFileHashes(context.Background(), rootDir, requests)
+	require.NoError(t, err)
+	require.Equal(t, want, hashes)
+
+	// Ensure only the hashes of the changed file are recalculated.
+	newTime := info.ModTime().Add(time.Minute)
+	err = os.Chtimes(meta.AbsPath(), newTime, newTime)
+	require.NoError(t, err)
+
+	hashes, err = cache.BatchFileHashes(context.Background(), rootDir, requests)
+	require.NoError(t, err)
+	require.Equal(t, want[1], hashes[1])
+	require.NotEqual(t, want[0], hashes[0])
+	require.NotEqual(t, want[2], hashes[2])
+	require.NotEqual(t, want[3], hashes[3])
+}
+
+func BenchmarkFileHashes(b *testing.B) {
+	const size = 16 << 20
+
+	rootDir := b.TempDir()
+
+	item := testutils.MockItem("images/file.qcow2").WithGeneratedContent(1, size)
+	item.Create(b, rootDir)
+
+	for _, algorithm := range []stream.ChecksumAlgorithm{stream.ChecksumSHA256, stream.ChecksumSHA512, stream.ChecksumBLAKE2b} {
+		b.Run(string(algorithm), func(b *testing.B) {
+			b.SetBytes(size)
+
+			for range b.N {
+				_, err := stream.FileHashes(context.Background(), []stream.ChecksumAlgorithm{algorithm}, item.AbsPath())
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	b.Run("cached", func(b *testing.B) {
+		cache, err := stream.LoadHashCache(rootDir, ".hashes.json")
+		require.NoError(b, err)
+
+		_, err = cache.FileHash(context.Background(), rootDir, item.RelPath())
+		require.NoError(b, err)
+
+		b.ResetTimer()
+
+		for range b.N {
+			_, err := cache.FileHash(context.Background(), rootDir, item.RelPath())
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,279 @@
+package stream
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	yamlv3 "gopkg.in/yaml.v3"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// imageConfigFields are the known top-level fields of the image config.
+var imageConfigFields = []string{"image", "source", "targets", "files", "packages", "actions", "mappings", "environment", "simplestream"}
+
+// ImageConfigIssue is a problem found in the image config, along with its
+// position within the file.
+type ImageConfigIssue struct {
+	Line    int
+	Column  int
+	Field   string
+	Message string
+}
+
+// String returns the issue prefixed with its position and field.
+func (i ImageConfigIssue) String() string {
+	var b strings.Builder
+
+	if i.Line > 0 {
+		fmt.Fprintf(&b, "line %d, column %d: ", i.Line, i.Column)
+	}
+
+	if i.Field != "" {
+		b.WriteString(i.Field)
+		b.WriteString(": ")
+	}
+
+	b.WriteString(i.Message)
+	return b.String()
+}
+
+// ImageConfigError is returned when the image config does not match the
+// schema. It lists all found errors.
+type ImageConfigError struct {
+	Issues []ImageConfigIssue
+}
+
+// Error implements error.
+func (e *ImageConfigError) Error() string {
+	msgs := make([]string, 0, len(e.Issues))
+	for _, issue := range e.Issues {
+		msgs = append(msgs, issue.String())
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// imageConfigValidator walks the image config and collects the issues.
+type imageConfigValidator struct {
+	errors   []ImageConfigIssue
+	warnings []ImageConfigIssue
+}
+
+// ValidateImageConfig validates the content of the image config against the
+// schema. Problems that prevent the config from being applied (invalid
+// syntax, types, or values) are returned as an ImageConfigError, while the
+// unknown fields, which are ignored, are returned as warnings.
+func ValidateImageConfig(content []byte) ([]ImageConfigIssue, error) {
+	var doc yamlv3.Node
+
+	err := yamlv3.Unmarshal(content, &doc)
+	if err != nil {
+		return nil, &ImageConfigError{Issues: []ImageConfigIssue{{Message: err.Error()}}}
+	}
+
+	// Empty document.
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	v := &imageConfigValidator{}
+
+	root := resolveNode(doc.Content[0])
+	if v.expectKind(root, "", yamlv3.MappingNode) {
+		v.fields(root, "", imageConfigFields, func(field string, node *yamlv3.Node) {
+			if field == "simplestream" {
+				v.simplestream(node, field)
+			}
+		})
+	}
+
+	if len(v.errors) > 0 {
+		return v.warnings, &ImageConfigError{Issues: v.errors}
+	}
+
+	return v.warnings, nil
+}
+
+// simplestream validates the simplestream section of the image config.
+func (v *imageConfigValidator) simplestream(node *yamlv3.Node, field string) {
+	if !v.expectKind(node, field, yamlv3.MappingNode) {
+		return
+	}
+
+	known := []string{"distro_name", "release_aliases", "release_eol", "support_level", "lifecycle", "requirements"}
+
+	v.fields(node, field, known, func(key string, value *yamlv3.Node) {
+		path := field + "." + key
+
+		switch key {
+		case "distro_name":
+			v.expectKind(value, path, yamlv3.ScalarNode)
+		case "release_aliases", "support_level", "lifecycle":
+			v.stringMap(value, path, nil)
+		case "release_eol":
+			v.stringMap(value, path, func(value *yamlv3.Node, path string) {
+				_, err := time.Parse(ReleaseEOLFormat, value.Value)
+				if err != nil {
+					v.errorf(value, path, "Invalid end-of-life date %q (expected format YYYY-MM-DD)", value.Value)
+				}
+			})
+		case "requirements":
+			if !v.expectKind(value, path, yamlv3.SequenceNode) {
+				return
+			}
+
+			for i, req := range value.Content {
+				v.requirements(resolveNode(req), fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+	})
+}
+
+// requirements validates a single entry of the image requirements.
+func (v *imageConfigValidator) requirements(node *yamlv3.Node, field string) {
+	if !v.expectKind(node, field, yamlv3.MappingNode) {
+		return
+	}
+
+	known := []string{"requirements", "releases", "architectures", "variants", "types"}
+
+	v.fields(node, field, known, func(key string, value *yamlv3.Node) {
+		path := field + "." + key
+
+		switch key {
+		case "requirements":
+			v.stringMap(value, path, nil)
+		case "releases", "architectures", "variants":
+			v.stringList(value, path, nil)
+		case "types":
+			v.stringList(value, path, func(value *yamlv3.Node, path string) {
+				filterType := shared.DefinitionFilterType(value.Value)
+				if filterType != shared.DefinitionFilterTypeContainer && filterType != shared.DefinitionFilterTypeVM {
+					v.errorf(value, path, "Invalid type %q (expected container or vm)", value.Value)
+				}
+			})
+		}
+	})
+}
+
+// fields calls the given function for each field of the mapping node. Fields
+// that are not known are reported as warnings.
+func (v *imageConfigValidator) fields(node *yamlv3.Node, field string, known []string, fn func(key string, value *yamlv3.Node)) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		value := resolveNode(node.Content[i+1])
+
+		if !slices.Contains(known, key.Value) {
+			v.warnings = append(v.warnings, newImageConfigIssue(key, joinField(field, key.Value), "Unknown field"))
+			continue
+		}
+
+		// Null values are treated as omitted.
+		if value.Kind == yamlv3.ScalarNode && value.Tag == "!!null" {
+			continue
+		}
+
+		fn(key.Value, value)
+	}
+}
+
+// stringMap ensures the node is a mapping of strings, and calls the given
+// function (if not nil) for each value.
+func (v *imageConfigValidator) stringMap(node *yamlv3.Node, field string, fn func(value *yamlv3.Node, field string)) {
+	if !v.expectKind(node, field, yamlv3.MappingNode) {
+		return
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := resolveNode(node.Content[i])
+		value := resolveNode(node.Content[i+1])
+		path := joinField(field, key.Value)
+
+		if !v.expectKind(key, path, yamlv3.ScalarNode) || !v.expectKind(value, path, yamlv3.ScalarNode) {
+			continue
+		}
+
+		if fn != nil {
+			fn(value, path)
+		}
+	}
+}
+
+// stringList ensures the node is a list of strings, and calls the given
+// function (if not nil) for each value.
+func (v *imageConfigValidator) stringList(node *yamlv3.Node, field string, fn func(value *yamlv3.Node, field string)) {
+	if !v.expectKind(node, field, yamlv3.SequenceNode) {
+		return
+	}
+
+	for i, value := range node.Content {
+		value = resolveNode(value)
+		path := fmt.Sprintf("%s[%d]", field, i)
+
+		if !v.expectKind(value, path, yamlv3.ScalarNode) {
+			continue
+		}
+
+		if fn != nil {
+			fn(value, path)
+		}
+	}
+}
+
+// expectKind reports an error if the node is not of the given kind.
+func (v *imageConfigValidator) expectKind(node *yamlv3.Node, field string, kind yamlv3.Kind) bool {
+	if node.Kind == kind {
+		return true
+	}
+
+	var expected string
+
+	switch kind {
+	case yamlv3.MappingNode:
+		expected = "a mapping"
+	case yamlv3.SequenceNode:
+		expected = "a list"
+	default:
+		expected = "a string"
+	}
+
+	v.errorf(node, field, "Expected %s", expected)
+	return false
+}
+
+// errorf reports an error at the position of the given node.
+func (v *imageConfigValidator) errorf(node *yamlv3.Node, field string, format string, args ...any) {
+	v.errors = append(v.errors, newImageConfigIssue(node, field, fmt.Sprintf(format, args...)))
+}
+
+// newImageConfigIssue returns the issue at the position of the given node.
+func newImageConfigIssue(node *yamlv3.Node, field string, msg string) ImageConfigIssue {
+	return ImageConfigIssue{
+		Line:    node.Line,
+		Column:  node.Column,
+		Field:   field,
+		Message: msg,
+	}
+}
+
+// resolveNode returns the node referenced by the alias node, or the node
+// itself if it is not an alias.
+func resolveNode(node *yamlv3.Node) *yamlv3.Node {
+	for node.Kind == yamlv3.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+
+	return node
+}
+
+// joinField appends the key to the path of the parent field.
+func joinField(field string, key string) string {
+	if field == "" {
+		return key
+	}
+
+	return field + "." + key
+}
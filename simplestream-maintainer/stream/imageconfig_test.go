@@ -0,0 +1,195 @@
+package stream_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/testutils"
+)
+
+func TestValidateImageConfig(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Name         string
+		Config       []string
+		WantErrors   []string
+		WantWarnings []string
+	}{
+		{
+			Name: "Empty config",
+		},
+		{
+			Name: "Valid config",
+			Config: []string{
+				"image:",
+				"  distribution: ubuntu",
+				"simplestream:",
+				"  distro_name: Ubuntu",
+				"  release_aliases:",
+				"    noble: 24.04",
+				"  release_eol:",
+				"    noble: 2029-05-31",
+				"  support_level:",
+				"    noble: lts",
+				"  requirements:",
+				"  - requirements:",
+				"      secure_boot: false",
+				"    releases: [noble]",
+				"    types: [vm]",
+			},
+		},
+		{
+			Name:       "Invalid syntax",
+			Config:     []string{"simplestream:", "  distro_name: Ubuntu", "\trelease_eol: {}"},
+			WantErrors: []string{"yaml: line 2: found a tab character that violates indentation"},
+		},
+		{
+			Name:       "Config is not a mapping",
+			Config:     []string{"invalid::config"},
+			WantErrors: []string{"line 1, column 1: Expected a mapping"},
+		},
+		{
+			Name: "Invalid values",
+			Config: []string{
+				"simplestream:",
+				"  distro_name:",
+				"  - Ubuntu",
+				"  release_eol:",
+				"    noble: May 2029",
+				"    jammy: 2027-04-01",
+				"  lifecycle: eol",
+				"  requirements:",
+				"  - types: [vm, lxc]",
+				"    releases: noble",
+			},
+			WantErrors: []string{
+				"line 3, column 3: simplestream.distro_name: Expected a string",
+				`line 5, column 12: simplestream.release_eol.noble: Invalid end-of-life date "May 2029" (expected format YYYY-MM-DD)`,
+				"line 7, column 14: simplestream.lifecycle: Expected a mapping",
+				`line 9, column 17: simplestream.requirements[0].types[1]: Invalid type "lxc" (expected container or vm)`,
+				"line 10, column 15: simplestream.requirements[0].releases: Expected a list",
+			},
+		},
+		{
+			Name: "Unknown fields",
+			Config: []string{
+				"imgae:",
+				"  distribution: ubuntu",
+				"simplestream:",
+				"  release_eol:",
+				"    noble: 2029-05-31",
+				"  release_eeol:",
+				"    noble: 2029-05-31",
+				"  requirements:",
+				"  - requirement:",
+				"      secure_boot: false",
+			},
+			WantWarnings: []string{
+				"line 1, column 1: imgae: Unknown field",
+				"line 6, column 3: simplestream.release_eeol: Unknown field",
+				"line 9, column 5: simplestream.requirements[0].requirement: Unknown field",
+			},
+		},
+		{
+			Name: "Aliases are resolved",
+			Config: []string{
+				"eol: &eol",
+				"  noble: never",
+				"simplestream:",
+				"  release_eol: *eol",
+			},
+			WantErrors: []string{
+				`line 2, column 10: simplestream.release_eol.noble: Invalid end-of-life date "never" (expected format YYYY-MM-DD)`,
+			},
+			WantWarnings: []string{
+				"line 1, column 1: eol: Unknown field",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			t.Parallel()
+
+			warnings, err := stream.ValidateImageConfig([]byte(strings.Join(test.Config, "\n")))
+
+			var gotWarnings []string
+			for _, w := range warnings {
+				gotWarnings = append(gotWarnings, w.String())
+			}
+
+			require.Equal(t, test.WantWarnings, gotWarnings)
+
+			if len(test.WantErrors) == 0 {
+				require.NoError(t, err)
+				return
+			}
+
+			var configErr *stream.ImageConfigError
+			require.True(t, errors.As(err, &configErr), "Expected ImageConfigError, got %v", err)
+
+			var gotErrors []string
+			for _, issue := range configErr.Issues {
+				gotErrors = append(gotErrors, issue.String())
+			}
+
+			require.Equal(t, test.WantErrors, gotErrors)
+		})
+	}
+}
+
+func TestGetProduct_SkippedVersions(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("2024_01_01").
+			WithFiles("lxd.tar.xz", "root.squashfs").
+			SetImageConfig(
+				"simplestream:",
+				"  release_eol:",
+				"    noble: May 2029",
+			),
+		testutils.MockVersion("2024_01_02").
+			WithFiles("lxd.tar.xz", "root.squashfs").
+			SetImageConfig(
+				"simplestream:",
+				"  distro_name: Ubuntu",
+				"  release_eeol:",
+				"    noble: 2029-05-31",
+			),
+	)
+
+	p.Create(t, rootDir)
+
+	// Ensure the invalid version fails the product by default.
+	_, err := stream.GetProduct(context.Background(), rootDir, p.RelPath())
+	require.ErrorIs(t, err, stream.ErrVersionInvalidImageConfig)
+
+	// Ensure the invalid version is skipped and reported.
+	skipped := make(map[string]error)
+
+	product, err := stream.GetProduct(context.Background(), rootDir, p.RelPath(), stream.WithSkippedVersions(func(id string, versionName string, err error) {
+		require.Equal(t, "ubuntu:noble:amd64:cloud", id)
+		skipped[versionName] = err
+	}))
+	require.NoError(t, err)
+	require.Equal(t, "Ubuntu", product.OS)
+	require.Len(t, product.Versions, 1)
+
+	require.Len(t, skipped, 1)
+	require.ErrorIs(t, skipped["2024_01_01"], stream.ErrVersionInvalidImageConfig)
+	require.ErrorContains(t, skipped["2024_01_01"], `image.yaml: line 3, column 12: simplestream.release_eol.noble: Invalid end-of-life date "May 2029"`)
+
+	// Ensure the warnings of the valid version are retained.
+	warnings := product.Versions["2024_01_02"].ImageConfigWarnings
+	require.Len(t, warnings, 1)
+	require.Equal(t, "line 3, column 3: simplestream.release_eeol: Unknown field", warnings[0].String())
+}
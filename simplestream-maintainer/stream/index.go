@@ -26,8 +26,15 @@ func NewStreamIndex() StreamIndex {
 	}
 }
 
-// AddEntry adds catalog and a list of its products to the index.
+// AddEntry adds catalog and a list of its products to the index. The entry is
+// marked as updated at the current time.
 func (i *StreamIndex) AddEntry(streamName string, catalogPath string, catalog ProductCatalog) {
+	i.AddEntryAt(streamName, catalogPath, catalog, time.Now())
+}
+
+// AddEntryAt is like AddEntry, except that the entry is marked as updated at
+// the given time.
+func (i *StreamIndex) AddEntryAt(streamName string, catalogPath string, catalog ProductCatalog, updated time.Time) {
 	products := make([]string, 0, len(catalog.Products))
 	for p := range catalog.Products {
 		products = append(products, p)
@@ -39,7 +46,7 @@ func (i *StreamIndex) AddEntry(streamName string, catalogPath string, catalog Pr
 		Format:   "products:1.0",
 		Path:     catalogPath,
 		Datatype: catalog.DataType,
-		Updated:  time.Now().Format(time.RFC3339),
+		Updated:  updated.Format(time.RFC3339),
 		Products: products,
 	}
 }
@@ -0,0 +1,106 @@
+package stream
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"time"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+)
+
+// PublishedTimes holds the times when product versions were first added to
+// the product catalog, mapped by the product ID and the version name. Unlike
+// the version names and the modification times of the version directories,
+// these times are not affected by copying the image directories around (for
+// example, using rsync).
+type PublishedTimes map[string]map[string]time.Time
+
+// PublishedTimesPath returns the path of the file, relative to the root
+// directory, in which the publish times of the given stream are stored. The
+// file is hidden, so that it is not served along with the product catalog.
+func PublishedTimesPath(streamVersion string, streamName string) string {
+	return path.Join("streams", streamVersion, fmt.Sprintf(".%s.published.json", streamName))
+}
+
+// ReadPublishedTimes reads the publish times of the given stream. If the file
+// does not exist, empty publish times are returned.
+func ReadPublishedTimes(b storage.Backend, streamVersion string, streamName string) (PublishedTimes, error) {
+	times := PublishedTimes{}
+
+	_, err := storage.ReadJSONFile(b, PublishedTimesPath(streamVersion, streamName), &times)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("Failed to read publish times: %w", err)
+	}
+
+	return times, nil
+}
+
+// WritePublishedTimes replaces the publish times of the given stream.
+func WritePublishedTimes(b storage.Backend, streamVersion string, streamName string, times PublishedTimes) error {
+	content, err := json.MarshalIndent(times, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = storage.WriteFile(b, PublishedTimesPath(streamVersion, streamName), content)
+	if err != nil {
+		return fmt.Errorf("Failed to write publish times: %w", err)
+	}
+
+	return nil
+}
+
+// Get returns the time when the product version was first published, and
+// whether the time is known.
+func (t PublishedTimes) Get(productID string, versionName string) (time.Time, bool) {
+	published, ok := t[productID][versionName]
+	return published, ok
+}
+
+// Add records the given time as the publish time of the product version,
+// unless the version already has one. It returns true if the time was added.
+func (t PublishedTimes) Add(productID string, versionName string, published time.Time) bool {
+	_, ok := t.Get(productID, versionName)
+	if ok {
+		return false
+	}
+
+	if t[productID] == nil {
+		t[productID] = make(map[string]time.Time)
+	}
+
+	t[productID][versionName] = published.UTC()
+	return true
+}
+
+// Retain removes publish times of the product versions that are not in the
+// given product catalog. It returns true if any publish time was removed.
+func (t PublishedTimes) Retain(catalog ProductCatalog) bool {
+	changed := false
+
+	for id, versions := range t {
+		p, ok := catalog.Products[id]
+		if !ok {
+			delete(t, id)
+			changed = true
+			continue
+		}
+
+		for name := range versions {
+			_, ok := p.Versions[name]
+			if !ok {
+				delete(versions, name)
+				changed = true
+			}
+		}
+
+		if len(versions) == 0 {
+			delete(t, id)
+		}
+	}
+
+	return changed
+}
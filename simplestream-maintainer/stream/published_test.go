@@ -0,0 +1,64 @@
+package stream_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+func TestPublishedTimes(t *testing.T) {
+	t.Parallel()
+
+	b := storage.NewLocal(t.TempDir())
+
+	// Ensure missing file results in empty publish times.
+	published, err := stream.ReadPublishedTimes(b, "v1", "images")
+	require.NoError(t, err)
+	require.Empty(t, published)
+
+	first := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	second := first.Add(24 * time.Hour)
+
+	// Ensure the first publish time is retained.
+	require.True(t, published.Add("ubuntu:noble:amd64:cloud", "01", first))
+	require.True(t, published.Add("ubuntu:noble:amd64:cloud", "02", second))
+	require.True(t, published.Add("alpine:edge:amd64:cloud", "01", second))
+	require.False(t, published.Add("ubuntu:noble:amd64:cloud", "01", second))
+
+	got, ok := published.Get("ubuntu:noble:amd64:cloud", "01")
+	require.True(t, ok)
+	require.Equal(t, first, got)
+
+	_, ok = published.Get("ubuntu:noble:amd64:cloud", "03")
+	require.False(t, ok)
+
+	// Ensure publish times are read back.
+	require.NoError(t, stream.WritePublishedTimes(b, "v1", "images", published))
+	require.FileExists(t, b.Path(stream.PublishedTimesPath("v1", "images")))
+
+	published, err = stream.ReadPublishedTimes(b, "v1", "images")
+	require.NoError(t, err)
+
+	got, ok = published.Get("ubuntu:noble:amd64:cloud", "02")
+	require.True(t, ok)
+	require.True(t, second.Equal(got))
+
+	// Ensure only versions within the catalog are retained.
+	catalog := stream.NewCatalog("images", map[string]stream.Product{
+		"ubuntu:noble:amd64:cloud": {
+			Versions: map[string]stream.Version{"02": {}},
+		},
+	})
+
+	require.True(t, published.Retain(*catalog))
+	require.False(t, published.Retain(*catalog))
+	require.Equal(t, []string{"ubuntu:noble:amd64:cloud"}, shared.MapKeys(published))
+
+	_, ok = published.Get("ubuntu:noble:amd64:cloud", "01")
+	require.False(t, ok)
+}
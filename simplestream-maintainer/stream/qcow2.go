@@ -0,0 +1,91 @@
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// qcow2Magic is the header of every qcow2 file ("QFI\xfb").
+var qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+// qcow2CompressionTypeBit is the incompatible feature bit indicating that the
+// compression type is set in the header.
+const qcow2CompressionTypeBit = 1 << 3
+
+// Compression types of the qcow2 clusters.
+const (
+	Qcow2CompressionZlib = "zlib"
+	Qcow2CompressionZstd = "zstd"
+)
+
+// Qcow2Info holds the information read from the qcow2 header.
+type Qcow2Info struct {
+	// VirtualSize is the size of the disk seen by the virtual machine.
+	VirtualSize int64
+
+	// Compression is the algorithm used for the compressed clusters.
+	Compression string
+}
+
+// ReadQcow2Info reads the qcow2 header from the given reader, so that only the
+// beginning of the file is read. Versions 2 and 3 of the format are supported.
+func ReadQcow2Info(r io.Reader) (*Qcow2Info, error) {
+	// Header of version 3 with the compression type, which is padded
+	// to the multiple of 8 bytes.
+	header := make([]byte, 112)
+
+	n, err := io.ReadFull(r, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("Failed to read qcow2 header: %w", err)
+	}
+
+	// Header of version 2 is 72 bytes long.
+	if n < 72 || [4]byte(header[:4]) != [4]byte(qcow2Magic) {
+		return nil, fmt.Errorf("Not a qcow2 file")
+	}
+
+	version := binary.BigEndian.Uint32(header[4:8])
+	if version != 2 && version != 3 {
+		return nil, fmt.Errorf("Unsupported qcow2 version %d", version)
+	}
+
+	size := binary.BigEndian.Uint64(header[24:32])
+	if size > 1<<63-1 {
+		return nil, fmt.Errorf("Invalid qcow2 virtual size %d", size)
+	}
+
+	info := &Qcow2Info{
+		VirtualSize: int64(size),
+		Compression: Qcow2CompressionZlib,
+	}
+
+	if version == 2 {
+		return info, nil
+	}
+
+	if n < 104 {
+		return nil, fmt.Errorf("Truncated qcow2 header")
+	}
+
+	incompatible := binary.BigEndian.Uint64(header[72:80])
+	headerLength := binary.BigEndian.Uint32(header[100:104])
+
+	if incompatible&qcow2CompressionTypeBit != 0 {
+		if headerLength <= 104 || n <= 104 {
+			return nil, fmt.Errorf("Truncated qcow2 header")
+		}
+
+		switch header[104] {
+		case 0:
+			info.Compression = Qcow2CompressionZlib
+		case 1:
+			info.Compression = Qcow2CompressionZstd
+		default:
+			return nil, fmt.Errorf("Unknown qcow2 compression type %d", header[104])
+		}
+	}
+
+	return info, nil
+}
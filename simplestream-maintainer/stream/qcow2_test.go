@@ -0,0 +1,101 @@
+package stream_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+// qcow2Header returns the qcow2 header of the given version, virtual size,
+// and compression type (-1 omits the compression type).
+func qcow2Header(version uint32, size uint64, compression int) []byte {
+	header := make([]byte, 112)
+	copy(header, "QFI\xfb")
+	binary.BigEndian.PutUint32(header[4:], version)
+	binary.BigEndian.PutUint64(header[24:], size)
+
+	if version == 2 {
+		return header[:72]
+	}
+
+	binary.BigEndian.PutUint32(header[100:], 104)
+
+	if compression >= 0 {
+		binary.BigEndian.PutUint64(header[72:], 1<<3)
+		binary.BigEndian.PutUint32(header[100:], 112)
+		header[104] = byte(compression)
+	}
+
+	return header
+}
+
+func TestReadQcow2Info(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Name    string
+		Content []byte
+		Want    *stream.Qcow2Info
+		WantErr string
+	}{
+		{
+			Name:    "Version 2",
+			Content: qcow2Header(2, 10*1024*1024*1024, -1),
+			Want:    &stream.Qcow2Info{VirtualSize: 10 * 1024 * 1024 * 1024, Compression: stream.Qcow2CompressionZlib},
+		},
+		{
+			Name:    "Version 3 without compression type",
+			Content: qcow2Header(3, 4096, -1),
+			Want:    &stream.Qcow2Info{VirtualSize: 4096, Compression: stream.Qcow2CompressionZlib},
+		},
+		{
+			Name:    "Version 3 with zstd compression",
+			Content: append(qcow2Header(3, 4096, 1), make([]byte, 1024)...),
+			Want:    &stream.Qcow2Info{VirtualSize: 4096, Compression: stream.Qcow2CompressionZstd},
+		},
+		{
+			Name:    "Unknown compression type",
+			Content: qcow2Header(3, 4096, 7),
+			WantErr: "Unknown qcow2 compression type 7",
+		},
+		{
+			Name:    "Unsupported version",
+			Content: qcow2Header(4, 4096, -1),
+			WantErr: "Unsupported qcow2 version 4",
+		},
+		{
+			Name:    "Truncated header",
+			Content: qcow2Header(3, 4096, 1)[:80],
+			WantErr: "Truncated qcow2 header",
+		},
+		{
+			Name:    "Not a qcow2 file",
+			Content: bytes.Repeat([]byte("test-content"), 10),
+			WantErr: "Not a qcow2 file",
+		},
+		{
+			Name:    "Empty file",
+			Content: nil,
+			WantErr: "Failed to read qcow2 header",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			t.Parallel()
+
+			info, err := stream.ReadQcow2Info(bytes.NewReader(test.Content))
+			if test.WantErr != "" {
+				require.ErrorContains(t, err, test.WantErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, test.Want, info)
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// CatalogReader reads a product catalog in JSON format one product at a time.
+// This allows processing large product catalogs without keeping all products
+// in memory.
+type CatalogReader struct {
+	dec        *json.Decoder
+	header     ProductCatalog
+	inProducts bool
+	done       bool
+}
+
+// NewCatalogReader creates a new catalog reader and reads the catalog fields
+// preceding the products from the given reader.
+func NewCatalogReader(r io.Reader) (*CatalogReader, error) {
+	cr := &CatalogReader{dec: json.NewDecoder(r)}
+
+	err := cr.expectDelim('{')
+	if err != nil {
+		return nil, err
+	}
+
+	err = cr.readFields()
+	if err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+// Header returns the catalog without products. Fields that follow the products
+// in the input are known only once all products are read.
+func (cr *CatalogReader) Header() ProductCatalog {
+	return cr.header
+}
+
+// Next reads the next product of the catalog. Products are returned in the
+// order of the input. Once all products are read, io.EOF is returned.
+func (cr *CatalogReader) Next() (string, Product, error) {
+	for !cr.done {
+		if !cr.inProducts {
+			err := cr.readFields()
+			if err != nil {
+				return "", Product{}, err
+			}
+
+			continue
+		}
+
+		if !cr.dec.More() {
+			// End of products.
+			err := cr.expectDelim('}')
+			if err != nil {
+				return "", Product{}, err
+			}
+
+			cr.inProducts = false
+			continue
+		}
+
+		id, err := cr.readKey()
+		if err != nil {
+			return "", Product{}, err
+		}
+
+		var product Product
+
+		err = cr.dec.Decode(&product)
+		if err != nil {
+			return "", Product{}, fmt.Errorf("Failed to decode product %q: %w", id, err)
+		}
+
+		return id, product, nil
+	}
+
+	return "", Product{}, io.EOF
+}
+
+// readFields reads the catalog fields until the start of the products or the
+// end of the catalog.
+func (cr *CatalogReader) readFields() error {
+	for cr.dec.More() {
+		key, err := cr.readKey()
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "content_id":
+			err = cr.dec.Decode(&cr.header.ContentID)
+		case "format":
+			err = cr.dec.Decode(&cr.header.Format)
+		case "datatype":
+			err = cr.dec.Decode(&cr.header.DataType)
+		case "products":
+			token, err := cr.dec.Token()
+			if err != nil {
+				return err
+			}
+
+			if token == nil {
+				// Products are null.
+				continue
+			}
+
+			if token != json.Delim('{') {
+				return fmt.Errorf("Invalid product catalog: Products must be an object")
+			}
+
+			cr.inProducts = true
+			return nil
+		default:
+			// Skip unknown fields.
+			err = cr.dec.Decode(&json.RawMessage{})
+		}
+
+		if err != nil {
+			return fmt.Errorf("Failed to decode field %q: %w", key, err)
+		}
+	}
+
+	err := cr.expectDelim('}')
+	if err != nil {
+		return err
+	}
+
+	cr.done = true
+	return nil
+}
+
+// readKey reads the key of the next object member.
+func (cr *CatalogReader) readKey() (string, error) {
+	token, err := cr.dec.Token()
+	if err != nil {
+		return "", err
+	}
+
+	key, ok := token.(string)
+	if !ok {
+		return "", fmt.Errorf("Invalid product catalog: Unexpected token %v", token)
+	}
+
+	return key, nil
+}
+
+// expectDelim reads the next token and ensures it is the given delimiter.
+func (cr *CatalogReader) expectDelim(delim json.Delim) error {
+	token, err := cr.dec.Token()
+	if err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+
+		return err
+	}
+
+	if token != delim {
+		return fmt.Errorf("Invalid product catalog: Expected %q, got %v", delim, token)
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package stream_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+func TestCatalogReader(t *testing.T) {
+	t.Parallel()
+
+	products := map[string]stream.Product{
+		"ubuntu:noble:amd64:cloud": {
+			Distro:       "ubuntu",
+			Release:      "noble",
+			Architecture: "amd64",
+			Variant:      "cloud",
+			Versions: map[string]stream.Version{
+				"20240101_0000": {
+					Items: map[string]stream.Item{
+						"lxd.tar.xz": {Ftype: "lxd.tar.xz", Path: "images/lxd.tar.xz", Size: 12},
+					},
+				},
+			},
+		},
+		"alpine:edge:arm64:default": {Distro: "alpine", Release: "edge"},
+	}
+
+	catalog := stream.NewCatalog("images", products)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, stream.WriteCatalog(buf, *catalog))
+
+	reader, err := stream.NewCatalogReader(buf)
+	require.NoError(t, err)
+	require.Equal(t, "images", reader.Header().ContentID)
+	require.Equal(t, "products:1.0", reader.Header().Format)
+	require.Nil(t, reader.Header().Products)
+
+	got := make(map[string]stream.Product)
+	var ids []string
+
+	for {
+		id, product, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+
+		require.NoError(t, err)
+		got[id] = product
+		ids = append(ids, id)
+	}
+
+	// Ensure products are read in the order of the file.
+	require.Equal(t, []string{"alpine:edge:arm64:default", "ubuntu:noble:amd64:cloud"}, ids)
+	require.Equal(t, products, got)
+
+	// Ensure subsequent reads keep returning EOF.
+	_, _, err = reader.Next()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestCatalogReader_Fields(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Name      string
+		Content   string
+		WantIDs   []string
+		WantID    string
+		WantErr   bool
+		WantEarly bool
+	}{
+		{
+			Name:    "Fields after products",
+			Content: `{"products": {"a": {}, "b": {}}, "unknown": [1, {"x": 2}], "content_id": "images"}`,
+			WantIDs: []string{"a", "b"},
+			WantID:  "images",
+		},
+		{
+			Name:    "Null products",
+			Content: `{"content_id": "images", "products": null}`,
+			WantID:  "images",
+		},
+		{
+			Name:    "Missing products",
+			Content: `{"content_id": "images"}`,
+			WantID:  "images",
+		},
+		{
+			Name:    "Invalid product",
+			Content: `{"content_id": "images", "products": {"a": []}}`,
+			WantErr: true,
+		},
+		{
+			Name:    "Truncated catalog",
+			Content: `{"content_id": "images", "products": {"a": {}`,
+			WantIDs: []string{"a"},
+			WantErr: true,
+		},
+		{
+			Name:      "Not an object",
+			Content:   `[]`,
+			WantErr:   true,
+			WantEarly: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			reader, err := stream.NewCatalogReader(strings.NewReader(test.Content))
+			if test.WantEarly {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+
+			var ids []string
+
+			for {
+				id, _, err := reader.Next()
+				if err == io.EOF {
+					break
+				}
+
+				if err != nil {
+					require.True(t, test.WantErr, "Unexpected error: %v", err)
+					require.Equal(t, test.WantIDs, ids)
+					return
+				}
+
+				ids = append(ids, id)
+			}
+
+			require.False(t, test.WantErr)
+			require.Equal(t, test.WantIDs, ids)
+			require.Equal(t, test.WantID, reader.Header().ContentID)
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package stream
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+)
+
+// buildReportPrefix and buildReportSuffix surround the time at which the build
+// started in the names of the build report files.
+const (
+	buildReportPrefix = ".build-report-"
+	buildReportSuffix = ".json"
+)
+
+// Reasons for which the product versions are skipped by the build.
+const (
+	// SkipReasonIncomplete indicates that the version is missing some
+	// files, or is still being uploaded.
+	SkipReasonIncomplete = "incomplete"
+
+	// SkipReasonChecksumMismatch indicates that the hash of any item does
+	// not match the one from the version's checksums file.
+	SkipReasonChecksumMismatch = "checksum_mismatch"
+
+	// SkipReasonInvalidConfig indicates that the version has an invalid
+	// image config.
+	SkipReasonInvalidConfig = "invalid_config"
+)
+
+// BuildReport summarizes a single build of the stream version, so that it can
+// be processed by CI pipelines without parsing the logs.
+type BuildReport struct {
+	// Root is the root directory of the build. This field is set only
+	// within the combined build report.
+	Root string `json:"root,omitempty"`
+
+	// StreamVersion is the version of the built streams.
+	StreamVersion string `json:"stream_version"`
+
+	// StartedAt and FinishedAt are the times at which the build started
+	// and finished.
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+
+	// Duration of the build in seconds.
+	Duration float64 `json:"duration"`
+
+	// Error of the failed or interrupted build.
+	Error string `json:"error,omitempty"`
+
+	// Streams contains the reports of the built streams ordered by name.
+	Streams []StreamReport `json:"streams"`
+}
+
+// CombinedBuildReport summarizes the builds of multiple root directories
+// within a single invocation.
+type CombinedBuildReport struct {
+	// StartedAt and FinishedAt are the times at which the first build
+	// started and the last build finished.
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+
+	// Duration of the builds in seconds.
+	Duration float64 `json:"duration"`
+
+	// Error of any failed or interrupted build.
+	Error string `json:"error,omitempty"`
+
+	// Builds contains the reports of the builds ordered by root directory.
+	Builds []BuildReport `json:"builds"`
+}
+
+// Sort orders the builds by root directory, along with their streams and
+// entries (see BuildReport.Sort).
+func (r *CombinedBuildReport) Sort() {
+	slices.SortFunc(r.Builds, func(a BuildReport, b BuildReport) int {
+		return strings.Compare(a.Root, b.Root)
+	})
+
+	for i := range r.Builds {
+		r.Builds[i].Sort()
+	}
+}
+
+// StreamReport summarizes the build of a single stream.
+type StreamReport struct {
+	// Name of the stream.
+	Name string `json:"name"`
+
+	// Duration of the stream build in seconds.
+	Duration float64 `json:"duration"`
+
+	// Error of the failed stream build.
+	Error string `json:"error,omitempty"`
+
+	// Added contains the versions added to the product catalog.
+	Added []ReportEntry `json:"added"`
+
+	// Skipped contains the versions that were not added to the product
+	// catalog, along with the reason (see SkipReasonIncomplete).
+	Skipped []ReportEntry `json:"skipped"`
+
+	// Deltas contains the delta files created for the versions.
+	Deltas []ReportEntry `json:"deltas"`
+
+	// Errors contains the failed operations on versions and their items.
+	Errors []ReportEntry `json:"errors"`
+}
+
+// ReportEntry refers to a product version, or to its item, within the build
+// report.
+type ReportEntry struct {
+	Product string `json:"product"`
+	Version string `json:"version"`
+	Item    string `json:"item,omitempty"`
+
+	// Base is the version from which the delta item was created.
+	Base string `json:"base,omitempty"`
+
+	// Reason for which the version was skipped.
+	Reason string `json:"reason,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// Sort orders the streams by name and their entries by product, version, and
+// item, so that the report does not depend on the order of the operations.
+func (r *BuildReport) Sort() {
+	slices.SortFunc(r.Streams, func(a StreamReport, b StreamReport) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	compare := func(a ReportEntry, b ReportEntry) int {
+		if a.Product != b.Product {
+			return strings.Compare(a.Product, b.Product)
+		}
+
+		if a.Version != b.Version {
+			return strings.Compare(a.Version, b.Version)
+		}
+
+		return strings.Compare(a.Item, b.Item)
+	}
+
+	for _, s := range r.Streams {
+		slices.SortStableFunc(s.Added, compare)
+		slices.SortStableFunc(s.Skipped, compare)
+		slices.SortStableFunc(s.Deltas, compare)
+		slices.SortStableFunc(s.Errors, compare)
+	}
+}
+
+// BuildReportPath returns the path of the report, relative to the root
+// directory, of the build of the given stream version that started at the
+// given time. The file is hidden, so that it is not served along with the
+// product catalogs. Reports of the later builds are lexically greater.
+func BuildReportPath(streamVersion string, startedAt time.Time) string {
+	return path.Join("streams", streamVersion, buildReportPrefix+startedAt.UTC().Format(snapshotIDLayout)+buildReportSuffix)
+}
+
+// WriteBuildReport writes the report of the build of its stream version, and
+// returns the path of the report file.
+func WriteBuildReport(b storage.Backend, report BuildReport) (string, error) {
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	reportPath := BuildReportPath(report.StreamVersion, report.StartedAt)
+
+	err = storage.WriteFile(b, reportPath, content)
+	if err != nil {
+		return "", fmt.Errorf("Failed to write build report: %w", err)
+	}
+
+	return reportPath, nil
+}
+
+// ListBuildReports returns the paths of the build reports of the given stream
+// version, relative to the root directory, ordered from the oldest to the
+// latest.
+func ListBuildReports(b storage.Backend, streamVersion string) ([]string, error) {
+	dir := path.Join("streams", streamVersion)
+
+	entries, err := b.List(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("Failed to list build reports: %w", err)
+	}
+
+	var paths []string
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, buildReportPrefix) || !strings.HasSuffix(name, buildReportSuffix) {
+			continue
+		}
+
+		paths = append(paths, path.Join(dir, name))
+	}
+
+	slices.Sort(paths)
+
+	return paths, nil
+}
+
+// PruneBuildReports removes all but the given number of the latest build
+// reports of the given stream version.
+func PruneBuildReports(b storage.Backend, streamVersion string, retain int) error {
+	paths, err := ListBuildReports(b, streamVersion)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(paths)-max(retain, 0); i++ {
+		err := b.Delete(paths[i])
+		if err != nil {
+			return fmt.Errorf("Failed to delete build report %q: %w", paths[i], err)
+		}
+	}
+
+	return nil
+}
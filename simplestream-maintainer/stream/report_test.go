@@ -0,0 +1,77 @@
+package stream_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+func TestBuildReports(t *testing.T) {
+	t.Parallel()
+
+	b := storage.NewLocal(t.TempDir())
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// Ensure no reports are listed before the first build.
+	paths, err := stream.ListBuildReports(b, "v1")
+	require.NoError(t, err)
+	require.Empty(t, paths)
+
+	report := stream.BuildReport{
+		StreamVersion: "v1",
+		StartedAt:     now,
+		Streams: []stream.StreamReport{
+			{
+				Name: "images",
+				Added: []stream.ReportEntry{
+					{Product: "ubuntu:noble:amd64:cloud", Version: "02"},
+					{Product: "alpine:edge:amd64:cloud", Version: "01"},
+				},
+			},
+			{Name: "containers"},
+		},
+	}
+
+	// Ensure the streams and their entries are sorted.
+	report.Sort()
+	require.Equal(t, "containers", report.Streams[0].Name)
+	require.Equal(t, "alpine:edge:amd64:cloud", report.Streams[1].Added[0].Product)
+
+	reportPath, err := stream.WriteBuildReport(b, report)
+	require.NoError(t, err)
+	require.Equal(t, "streams/v1/.build-report-20240101T120000.000000000Z.json", reportPath)
+
+	content, err := storage.ReadFile(b, reportPath)
+	require.NoError(t, err)
+
+	var got stream.BuildReport
+	require.NoError(t, json.Unmarshal(content, &got))
+	require.Equal(t, report, got)
+
+	// Ensure only the latest reports are kept, and other hidden files are
+	// left intact.
+	require.NoError(t, storage.WriteFile(b, "streams/v1/.images.failures.json", []byte("{}")))
+
+	for i := 1; i <= 3; i++ {
+		report.StartedAt = now.Add(time.Duration(i) * time.Hour)
+		_, err := stream.WriteBuildReport(b, report)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, stream.PruneBuildReports(b, "v1", 2))
+
+	paths, err = stream.ListBuildReports(b, "v1")
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"streams/v1/.build-report-20240101T140000.000000000Z.json",
+		"streams/v1/.build-report-20240101T150000.000000000Z.json",
+	}, paths)
+
+	_, err = b.Stat("streams/v1/.images.failures.json")
+	require.NoError(t, err)
+}
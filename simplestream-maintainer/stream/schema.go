@@ -0,0 +1,138 @@
+package stream
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// DefaultPathSchema is the default layout of product directories relative to
+// the root directory.
+const DefaultPathSchema = "{stream}/{distro}/{release}/{arch}/{variant}"
+
+// pathSchemaFields maps the placeholders of the path schema to the product
+// fields. Placeholder "os" is an alias for "distro".
+var pathSchemaFields = map[string]string{
+	"distro":  "distro",
+	"os":      "distro",
+	"release": "release",
+	"arch":    "arch",
+	"variant": "variant",
+}
+
+// defaultPathSchemaFields are the product fields of the default path schema
+// in the order in which they appear in the product path.
+var defaultPathSchemaFields = []string{"distro", "release", "arch", "variant"}
+
+// PathSchema describes the layout of product directories within a stream.
+// The stream name is always the first path segment, followed by the product
+// distro, release, architecture, and variant in any order. The zero value
+// represents the default layout.
+type PathSchema struct {
+	fields []string
+}
+
+// ParsePathSchema parses the path schema template, such as
+// "{stream}/{os}/{release}/{variant}/{arch}". Each placeholder must be used
+// exactly once and must form the whole path segment.
+func ParsePathSchema(schema string) (PathSchema, error) {
+	segments := strings.Split(strings.Trim(schema, "/"), "/")
+	if segments[0] != "{stream}" {
+		return PathSchema{}, fmt.Errorf("Path schema %q must start with {stream}", schema)
+	}
+
+	var fields []string
+
+	for _, segment := range segments[1:] {
+		name, ok := strings.CutPrefix(segment, "{")
+		if ok {
+			name, ok = strings.CutSuffix(name, "}")
+		}
+
+		field, known := pathSchemaFields[name]
+		if !ok || !known {
+			return PathSchema{}, fmt.Errorf("Path schema %q contains invalid segment %q", schema, segment)
+		}
+
+		if slices.Contains(fields, field) {
+			return PathSchema{}, fmt.Errorf("Path schema %q contains %q more than once", schema, field)
+		}
+
+		fields = append(fields, field)
+	}
+
+	if len(fields) != len(defaultPathSchemaFields) {
+		return PathSchema{}, fmt.Errorf("Path schema %q must contain {distro}, {release}, {arch}, and {variant}", schema)
+	}
+
+	return PathSchema{fields: fields}, nil
+}
+
+// String returns the path schema template.
+func (s PathSchema) String() string {
+	segments := []string{"{stream}"}
+	for _, field := range s.productFields() {
+		segments = append(segments, "{"+field+"}")
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// ProductRelPath returns the path of the given product relative to the
+// stream's root directory.
+func (s PathSchema) ProductRelPath(p Product) string {
+	values := map[string]string{
+		"distro":  p.Distro,
+		"release": p.Release,
+		"arch":    p.Architecture,
+		"variant": p.Variant,
+	}
+
+	var segments []string
+	for _, field := range s.productFields() {
+		segments = append(segments, values[field])
+	}
+
+	return path.Join(segments...)
+}
+
+// ParseProductPath returns a product populated with the distro, release,
+// architecture, and variant from the given product path, which includes the
+// stream name. An error is returned if the path does not match the schema.
+func (s PathSchema) ParseProductPath(productRelPath string) (*Product, error) {
+	fields := s.productFields()
+
+	parts := strings.Split(path.Clean(productRelPath), "/")
+	if len(parts) != len(fields)+1 {
+		return nil, fmt.Errorf("%w: path %q does not match the required format %q", ErrProductInvalidPath, productRelPath, s)
+	}
+
+	p := &Product{}
+
+	for i, field := range fields {
+		value := parts[i+1]
+
+		switch field {
+		case "distro":
+			p.Distro = value
+		case "release":
+			p.Release = value
+			p.ReleaseTitle = value
+		case "arch":
+			p.Architecture = value
+		case "variant":
+			p.Variant = value
+		}
+	}
+
+	return p, nil
+}
+
+func (s PathSchema) productFields() []string {
+	if len(s.fields) == 0 {
+		return defaultPathSchemaFields
+	}
+
+	return s.fields
+}
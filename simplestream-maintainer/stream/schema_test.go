@@ -0,0 +1,108 @@
+package stream_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/testutils"
+)
+
+func TestParsePathSchema(t *testing.T) {
+	t.Parallel()
+
+	product := stream.Product{
+		Distro:       "ubuntu",
+		Release:      "noble",
+		Architecture: "amd64",
+		Variant:      "cloud",
+	}
+
+	tests := []struct {
+		Name        string
+		Schema      string
+		WantString  string
+		WantRelPath string
+		WantErr     bool
+	}{
+		{
+			Name:        "Default schema",
+			Schema:      stream.DefaultPathSchema,
+			WantString:  stream.DefaultPathSchema,
+			WantRelPath: "ubuntu/noble/amd64/cloud",
+		},
+		{
+			Name:        "Custom schema with os alias",
+			Schema:      "{stream}/{os}/{release}/{variant}/{arch}",
+			WantString:  "{stream}/{distro}/{release}/{variant}/{arch}",
+			WantRelPath: "ubuntu/noble/cloud/amd64",
+		},
+		{
+			Name:    "Stream is not the first segment",
+			Schema:  "{distro}/{stream}/{release}/{arch}/{variant}",
+			WantErr: true,
+		},
+		{
+			Name:    "Missing placeholder",
+			Schema:  "{stream}/{distro}/{release}/{arch}",
+			WantErr: true,
+		},
+		{
+			Name:    "Duplicate placeholder",
+			Schema:  "{stream}/{distro}/{os}/{release}/{arch}",
+			WantErr: true,
+		},
+		{
+			Name:    "Unknown placeholder",
+			Schema:  "{stream}/{distro}/{release}/{arch}/{flavor}",
+			WantErr: true,
+		},
+		{
+			Name:    "Segment is not a placeholder",
+			Schema:  "{stream}/images-{distro}/{release}/{arch}/{variant}",
+			WantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			schema, err := stream.ParsePathSchema(test.Schema)
+			if test.WantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, test.WantString, schema.String())
+			require.Equal(t, test.WantRelPath, schema.ProductRelPath(product))
+		})
+	}
+
+	// Ensure zero value uses the default schema.
+	require.Equal(t, stream.DefaultPathSchema, stream.PathSchema{}.String())
+	require.Equal(t, product.RelPath(), stream.PathSchema{}.ProductRelPath(product))
+}
+
+func TestGetProducts_PathSchema(t *testing.T) {
+	t.Parallel()
+
+	schema, err := stream.ParsePathSchema("{stream}/{os}/{release}/{variant}/{arch}")
+	require.NoError(t, err)
+
+	p := testutils.MockProduct("images/ubuntu/noble/cloud/amd64").AddVersions(
+		testutils.MockVersion("2024_01_01").WithFiles("lxd.tar.xz", "root.squashfs"))
+	p.Create(t, t.TempDir())
+
+	products, err := stream.GetProducts(context.Background(), p.RootDir(), p.StreamName(), stream.WithPathSchema(schema))
+	require.NoError(t, err)
+	require.Len(t, products, 1)
+
+	product, ok := products["ubuntu:noble:amd64:cloud"]
+	require.True(t, ok, "Product not found: %v", products)
+	require.Equal(t, "amd64", product.Architecture)
+	require.Equal(t, "cloud", product.Variant)
+	require.Equal(t, "ubuntu/noble/cloud", product.Aliases)
+	require.Equal(t, "ubuntu/noble/cloud/amd64", schema.ProductRelPath(product))
+}
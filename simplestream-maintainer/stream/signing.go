@@ -0,0 +1,223 @@
+package stream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+)
+
+// Static list of signed file extensions.
+const (
+	// FileExtClearSigned is the extension of the clear-signed JSON files.
+	FileExtClearSigned = ".sjson"
+
+	// FileExtDetachedSignature is the extension of the detached signature files.
+	FileExtDetachedSignature = ".gpg"
+
+	// FileExtArmoredSignature is the extension of the armored detached
+	// signature files.
+	FileExtArmoredSignature = ".asc"
+)
+
+// checksumSignatureExts is a list of extensions of the detached signatures
+// of the version checksum files (e.g. "SHA256SUMS.gpg").
+var checksumSignatureExts = []string{FileExtDetachedSignature, FileExtArmoredSignature}
+
+// Signer signs stream files using GPG.
+type Signer struct {
+	// KeyID is the ID (or fingerprint) of the key used for signing.
+	KeyID string
+
+	// HomeDir is the GPG home directory. If empty, the GPG default is used.
+	HomeDir string
+}
+
+// NewSigner returns a new GPG signer for the given key and GPG home directory.
+func NewSigner(keyID string, homeDir string) *Signer {
+	return &Signer{
+		KeyID:   keyID,
+		HomeDir: homeDir,
+	}
+}
+
+// ClearSign writes the clear-signed content of the file on srcPath to dstPath.
+func (s Signer) ClearSign(ctx context.Context, srcPath string, dstPath string) error {
+	return s.run(ctx, "--clearsign", "--output", dstPath, srcPath)
+}
+
+// DetachSign writes the armored detached signature of the file on srcPath to
+// dstPath.
+func (s Signer) DetachSign(ctx context.Context, srcPath string, dstPath string) error {
+	return s.run(ctx, "--armor", "--detach-sign", "--output", dstPath, srcPath)
+}
+
+// run executes the gpg command with the common arguments followed by the
+// given ones.
+func (s Signer) run(ctx context.Context, args ...string) error {
+	if s.KeyID == "" {
+		return fmt.Errorf("GPG key is required for signing")
+	}
+
+	gpgArgs := []string{"--batch", "--yes"}
+
+	if s.HomeDir != "" {
+		gpgArgs = append(gpgArgs, "--homedir", s.HomeDir)
+	}
+
+	gpgArgs = append(gpgArgs, "--local-user", s.KeyID)
+	gpgArgs = append(gpgArgs, args...)
+
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "gpg", gpgArgs...)
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Failed to sign file: %w (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// SignedPaths returns paths of the clear-signed and detached signature files
+// for the JSON file on the given path. For example, for "index.json", paths
+// "index.sjson" and "index.json.gpg" are returned.
+func SignedPaths(path string) (clearSigned string, detached string) {
+	clearSigned = strings.TrimSuffix(path, ".json") + FileExtClearSigned
+	detached = path + FileExtDetachedSignature
+
+	return clearSigned, detached
+}
+
+// Verifier verifies detached signatures using GPG.
+type Verifier struct {
+	// Keyring is the path of the keyring (as exported by "gpg --export")
+	// containing the trusted public keys.
+	Keyring string
+}
+
+// NewVerifier returns a new GPG verifier that trusts the keys from the given
+// keyring.
+func NewVerifier(keyring string) *Verifier {
+	return &Verifier{
+		Keyring: keyring,
+	}
+}
+
+// Verify ensures the given detached signature (either binary or armored) of
+// the given data is made by one of the keys from the keyring.
+func (v Verifier) Verify(ctx context.Context, signature []byte, data []byte) error {
+	if v.Keyring == "" {
+		return fmt.Errorf("GPG keyring is required for verification")
+	}
+
+	// Relative keyring paths are resolved by gpgv against its home
+	// directory, so ensure the path is absolute.
+	keyring, err := filepath.Abs(v.Keyring)
+	if err != nil {
+		return err
+	}
+
+	// The signed data is passed on standard input, but the signature has
+	// to be read from a file.
+	sigFile, err := os.CreateTemp("", "simplestream-maintainer-signature-*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(sigFile.Name())
+
+	_, err = sigFile.Write(signature)
+	if err == nil {
+		err = sigFile.Close()
+	} else {
+		_ = sigFile.Close()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "gpgv", "--keyring", keyring, sigFile.Name(), "-")
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Failed to verify signature: %w (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// VerifyChecksumsSignature verifies the detached signature of the preferred
+// checksum file within the given version. It returns false if the version
+// contains no signed checksum file.
+func VerifyChecksumsSignature(ctx context.Context, rootDir string, versionRelPath string, verifier *Verifier) (bool, error) {
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return false, err
+	}
+
+	for _, f := range checksumFiles {
+		checksumRelPath := filepath.Join(versionRelPath, f.name)
+
+		_, err := b.Stat(checksumRelPath)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+
+			return false, err
+		}
+
+		return verifyChecksumsSignature(ctx, b, checksumRelPath, verifier)
+	}
+
+	return false, nil
+}
+
+// verifyChecksumsSignature verifies the detached signature of the checksum
+// file on the given path, if such signature exists. If the verifier is nil,
+// the signature is not verified. It returns true if the signature exists.
+func verifyChecksumsSignature(ctx context.Context, b storage.Backend, checksumRelPath string, verifier *Verifier) (bool, error) {
+	for _, ext := range checksumSignatureExts {
+		signature, err := storage.ReadFile(b, checksumRelPath+ext)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+
+			return false, err
+		}
+
+		if verifier == nil {
+			return true, nil
+		}
+
+		data, err := storage.ReadFile(b, checksumRelPath)
+		if err != nil {
+			return true, err
+		}
+
+		err = verifier.Verify(ctx, signature, data)
+		if err != nil {
+			return true, fmt.Errorf("Invalid signature %q: %w", filepath.Base(checksumRelPath+ext), err)
+		}
+
+		return true, nil
+	}
+
+	return false, nil
+}
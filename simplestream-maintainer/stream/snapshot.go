@@ -0,0 +1,282 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+)
+
+// snapshotIDLayout is the layout of the snapshot ID, which is the time when the
+// snapshot was created. IDs of the later snapshots are lexically greater.
+const snapshotIDLayout = "20060102T150405.000000000Z"
+
+// ErrSnapshotNotFound is returned when the snapshot does not exist.
+var ErrSnapshotNotFound = errors.New("Snapshot not found")
+
+// Snapshot is a copy of the metadata files (index and product catalogs,
+// including their compressed and signed variants) of a single stream version,
+// as they were published at the time the snapshot was created.
+type Snapshot struct {
+	// ID of the snapshot.
+	ID string `json:"id"`
+
+	// CreatedAt is the time when the snapshot was created.
+	CreatedAt time.Time `json:"created_at"`
+
+	// Files contains the names of the files within the stream version's
+	// directory.
+	Files []string `json:"files"`
+}
+
+// SnapshotsDir returns the path of the directory, relative to the root
+// directory, in which the snapshots of the given stream version are stored.
+// The directory is hidden, so that the snapshots are not served.
+func SnapshotsDir(streamVersion string) string {
+	return path.Join("streams", streamVersion, ".snapshots")
+}
+
+// listMetadataFiles returns the names of the non-hidden files in the given
+// directory. If the directory does not exist, no files are returned.
+func listMetadataFiles(b storage.Backend, dir string) ([]string, error) {
+	entries, err := b.List(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var names []string
+
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		names = append(names, entry.Name())
+	}
+
+	return names, nil
+}
+
+// copyBackendFile copies the file with the given name to the new name.
+func copyBackendFile(b storage.Backend, name string, newName string) error {
+	r, err := b.Open(name)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	return b.Write(newName, r)
+}
+
+// CreateSnapshot copies the currently published metadata files of the given
+// stream version into a new snapshot created at the given time. If no files
+// are published, no snapshot is created and nil is returned.
+func CreateSnapshot(b storage.Backend, streamVersion string, createdAt time.Time) (*Snapshot, error) {
+	metaDir := path.Join("streams", streamVersion)
+
+	names, err := listMetadataFiles(b, metaDir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list metadata files: %w", err)
+	}
+
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	// Ensure the ID is unique, even if the clock did not advance since
+	// the previous snapshot.
+	createdAt = createdAt.UTC()
+	for {
+		_, err := b.Stat(path.Join(SnapshotsDir(streamVersion), createdAt.Format(snapshotIDLayout)))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				break
+			}
+
+			return nil, err
+		}
+
+		createdAt = createdAt.Add(time.Nanosecond)
+	}
+
+	snapshot := &Snapshot{
+		ID:        createdAt.Format(snapshotIDLayout),
+		CreatedAt: createdAt,
+		Files:     names,
+	}
+
+	snapshotDir := path.Join(SnapshotsDir(streamVersion), snapshot.ID)
+
+	for _, name := range names {
+		err := copyBackendFile(b, path.Join(metaDir, name), path.Join(snapshotDir, name))
+		if err != nil {
+			// Do not leave a partial snapshot behind.
+			_ = b.Delete(snapshotDir)
+			return nil, fmt.Errorf("Failed to copy %q into snapshot: %w", name, err)
+		}
+	}
+
+	return snapshot, nil
+}
+
+// ListSnapshots returns the snapshots of the given stream version, ordered
+// from the oldest to the latest.
+func ListSnapshots(b storage.Backend, streamVersion string) ([]Snapshot, error) {
+	entries, err := b.List(SnapshotsDir(streamVersion))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("Failed to list snapshots: %w", err)
+	}
+
+	var snapshots []Snapshot
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		createdAt, err := time.Parse(snapshotIDLayout, entry.Name())
+		if err != nil {
+			// Not a snapshot.
+			continue
+		}
+
+		names, err := listMetadataFiles(b, path.Join(SnapshotsDir(streamVersion), entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list files of snapshot %q: %w", entry.Name(), err)
+		}
+
+		snapshots = append(snapshots, Snapshot{
+			ID:        entry.Name(),
+			CreatedAt: createdAt,
+			Files:     names,
+		})
+	}
+
+	slices.SortFunc(snapshots, func(a Snapshot, b Snapshot) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	return snapshots, nil
+}
+
+// PruneSnapshots removes all but the given number of the latest snapshots of
+// the given stream version.
+func PruneSnapshots(b storage.Backend, streamVersion string, retain int) error {
+	snapshots, err := ListSnapshots(b, streamVersion)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(snapshots)-max(retain, 0); i++ {
+		err := DeleteSnapshot(b, streamVersion, snapshots[i].ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteSnapshot removes the snapshot with the given ID.
+func DeleteSnapshot(b storage.Backend, streamVersion string, id string) error {
+	err := b.Delete(path.Join(SnapshotsDir(streamVersion), id))
+	if err != nil {
+		return fmt.Errorf("Failed to delete snapshot %q: %w", id, err)
+	}
+
+	return nil
+}
+
+// RestoreSnapshot republishes the metadata files of the given snapshot. The
+// product catalogs are published first and the index files last, so that the
+// index never references catalogs that are not in place. Published metadata
+// files that are not part of the snapshot are removed afterwards.
+func RestoreSnapshot(b storage.Backend, streamVersion string, snapshot Snapshot) error {
+	if len(snapshot.Files) == 0 {
+		return fmt.Errorf("Snapshot %q is empty", snapshot.ID)
+	}
+
+	metaDir := path.Join("streams", streamVersion)
+	snapshotDir := path.Join(SnapshotsDir(streamVersion), snapshot.ID)
+
+	isIndex := func(name string) bool {
+		return strings.HasPrefix(name, "index.")
+	}
+
+	files := slices.Clone(snapshot.Files)
+	slices.SortStableFunc(files, func(a string, b string) int {
+		switch {
+		case isIndex(a) == isIndex(b):
+			return 0
+		case isIndex(a):
+			return 1
+		default:
+			return -1
+		}
+	})
+
+	for _, name := range files {
+		err := copyBackendFile(b, path.Join(snapshotDir, name), path.Join(metaDir, name))
+		if err != nil {
+			return fmt.Errorf("Failed to restore %q from snapshot %q: %w", name, snapshot.ID, err)
+		}
+	}
+
+	published, err := listMetadataFiles(b, metaDir)
+	if err != nil {
+		return fmt.Errorf("Failed to list metadata files: %w", err)
+	}
+
+	for _, name := range published {
+		if slices.Contains(snapshot.Files, name) {
+			continue
+		}
+
+		err := b.Delete(path.Join(metaDir, name))
+		if err != nil {
+			return fmt.Errorf("Failed to remove %q: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// GetSnapshot returns the snapshot with the given ID. If the ID is empty, the
+// latest snapshot is returned. ErrSnapshotNotFound is returned if there is no
+// such snapshot.
+func GetSnapshot(b storage.Backend, streamVersion string, id string) (*Snapshot, error) {
+	snapshots, err := ListSnapshots(b, streamVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	if id == "" {
+		if len(snapshots) == 0 {
+			return nil, ErrSnapshotNotFound
+		}
+
+		return &snapshots[len(snapshots)-1], nil
+	}
+
+	for _, snapshot := range snapshots {
+		if snapshot.ID == id {
+			return &snapshot, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrSnapshotNotFound, id)
+}
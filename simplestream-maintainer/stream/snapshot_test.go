@@ -0,0 +1,94 @@
+package stream_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+func TestSnapshots(t *testing.T) {
+	t.Parallel()
+
+	b := storage.NewLocal(t.TempDir())
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	publish := func(files map[string]string) {
+		for name, content := range files {
+			require.NoError(t, storage.WriteFile(b, "streams/v1/"+name, []byte(content)))
+		}
+	}
+
+	read := func(name string) string {
+		content, err := storage.ReadFile(b, "streams/v1/"+name)
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	// Ensure no snapshot is created if nothing is published.
+	snapshot, err := stream.CreateSnapshot(b, "v1", now)
+	require.NoError(t, err)
+	require.Nil(t, snapshot)
+
+	_, err = stream.GetSnapshot(b, "v1", "")
+	require.ErrorIs(t, err, stream.ErrSnapshotNotFound)
+
+	// Ensure hidden files are not included in the snapshot.
+	publish(map[string]string{
+		"index.json":             "index-1",
+		"images.json":            "images-1",
+		".images.published.json": "{}",
+	})
+
+	first, err := stream.CreateSnapshot(b, "v1", now)
+	require.NoError(t, err)
+	require.Equal(t, []string{"images.json", "index.json"}, first.Files)
+
+	// Ensure snapshots created at the same time get unique IDs.
+	publish(map[string]string{
+		"index.json":      "index-2",
+		"images.json":     "images-2",
+		"images.json.gpg": "signature-2",
+	})
+
+	second, err := stream.CreateSnapshot(b, "v1", now)
+	require.NoError(t, err)
+	require.NotEqual(t, first.ID, second.ID)
+
+	snapshots, err := stream.ListSnapshots(b, "v1")
+	require.NoError(t, err)
+	require.Equal(t, []stream.Snapshot{*first, *second}, snapshots)
+
+	latest, err := stream.GetSnapshot(b, "v1", "")
+	require.NoError(t, err)
+	require.Equal(t, second.ID, latest.ID)
+
+	// Ensure the snapshot is restored, and files that are not part of it
+	// are removed, while hidden files are retained.
+	publish(map[string]string{
+		"index.json":  "index-3",
+		"images.json": "images-3",
+	})
+
+	require.NoError(t, stream.RestoreSnapshot(b, "v1", *first))
+	require.Equal(t, "index-1", read("index.json"))
+	require.Equal(t, "images-1", read("images.json"))
+	require.NoFileExists(t, b.Path("streams/v1/images.json.gpg"))
+	require.FileExists(t, b.Path("streams/v1/.images.published.json"))
+
+	// Ensure only the latest snapshots are retained.
+	third, err := stream.CreateSnapshot(b, "v1", now.Add(time.Hour))
+	require.NoError(t, err)
+
+	require.NoError(t, stream.PruneSnapshots(b, "v1", 2))
+
+	snapshots, err = stream.ListSnapshots(b, "v1")
+	require.NoError(t, err)
+	require.Equal(t, []stream.Snapshot{*second, *third}, snapshots)
+
+	_, err = stream.GetSnapshot(b, "v1", first.ID)
+	require.ErrorIs(t, err, stream.ErrSnapshotNotFound)
+}
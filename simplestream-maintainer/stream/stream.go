@@ -2,20 +2,26 @@ package stream
 
 import (
 	"bufio"
-	"crypto/sha256"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"maps"
 	"os"
 	"path"
 	"path/filepath"
 	"slices"
 	"strings"
+	"time"
 
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
+	"gopkg.in/yaml.v2"
 
 	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/clock"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
 )
 
 var (
@@ -27,6 +33,14 @@ var (
 	// ErrVersionInvalidImageConfig indicates version's image config is invalid.
 	ErrVersionInvalidImageConfig = errors.New("Product version has invalid image config")
 
+	// ErrVersionInvalidSignature indicates that the signature of version's
+	// checksum file is not made by any of the trusted keys.
+	ErrVersionInvalidSignature = errors.New("Product version has invalid checksums signature")
+
+	// ErrVersionMissingItems indicates that version does not contain all
+	// item types required for the product.
+	ErrVersionMissingItems = errors.New("Product version is missing required items")
+
 	// ErrProductInvalidPath indicates that product's path is invalid because
 	// either the directory on the given path does not exist, or it's path
 	// does not match the expected format.
@@ -38,11 +52,26 @@ const (
 	// FileChecksumSHA256 is the name of the checksum file containing SHA256 hashes.
 	FileChecksumSHA256 = "SHA256SUMS"
 
+	// FileChecksumSHA512 is the name of the checksum file containing SHA512 hashes.
+	FileChecksumSHA512 = "SHA512SUMS"
+
+	// FileChecksumBLAKE2b is the name of the checksum file containing BLAKE2b-512 hashes.
+	FileChecksumBLAKE2b = "B2SUMS"
+
 	// FileImageConfig is the name of the file that contains additional information
 	// about the version.
 	FileImageConfig = "image.yaml"
 )
 
+const (
+	// ReleaseEOLFormat is the format of the release end-of-life date.
+	ReleaseEOLFormat = "2006-01-02"
+
+	// LifecycleEOL is the lifecycle stage of releases that reached their
+	// end of life.
+	LifecycleEOL = "eol"
+)
+
 // ItemType is a type of the file that item holds.
 type ItemType string
 
@@ -62,10 +91,31 @@ const (
 	// ItemTypeDiskKVMDelta represents VM's root file system delta (VCDiff).
 	ItemTypeDiskKVMDelta = "disk-kvm.img.vcdiff"
 
-	// ItemTypeRootTarXz represents root file system as a tarball.
+	// ItemTypeSquashfsZsync represents container's root file system zsync
+	// control file.
+	ItemTypeSquashfsZsync = "squashfs.zsync"
+
+	// ItemTypeDiskKVMZsync represents VM's root file system zsync control file.
+	ItemTypeDiskKVMZsync = "disk-kvm.img.zsync"
+
+	// ItemTypeDiskRaw represents VM's root file system (raw disk image).
+	ItemTypeDiskRaw = "disk1.img"
+
+	// ItemTypeDiskRawDelta represents VM's raw root file system delta (VCDiff).
+	ItemTypeDiskRawDelta = "disk1.img.vcdiff"
+
+	// ItemTypeDiskRawZsync represents VM's raw root file system zsync control
+	// file.
+	ItemTypeDiskRawZsync = "disk1.img.zsync"
+
+	// ItemTypeRootTarXz represents container's root file system as an
+	// xz-compressed tarball, for images that cannot be built as squashfs.
 	ItemTypeRootTarXz = "root.tar.xz"
 )
 
+// rootTarXzNames are the file names of container's root file system tarball.
+var rootTarXzNames = []string{ItemTypeRootTarXz, "rootfs.tar.xz"}
+
 // ItemExt is file extension of the the file that item holds.
 type ItemExt string
 
@@ -84,6 +134,21 @@ const (
 
 	// ItemExtDiskKVMDelta is a file extension of VM's root file system delta (VCDiff).
 	ItemExtDiskKVMDelta = ".qcow2.vcdiff"
+
+	// ItemExtSquashfsZsync is a file extension of container's root file system zsync control file.
+	ItemExtSquashfsZsync = ".squashfs.zsync"
+
+	// ItemExtDiskKVMZsync is a file extension of VM's root file system zsync control file.
+	ItemExtDiskKVMZsync = ".qcow2.zsync"
+
+	// ItemExtDiskRaw is a file extension of VM's raw root file system.
+	ItemExtDiskRaw = ".img"
+
+	// ItemExtDiskRawDelta is a file extension of VM's raw root file system delta (VCDiff).
+	ItemExtDiskRawDelta = ".img.vcdiff"
+
+	// ItemExtDiskRawZsync is a file extension of VM's raw root file system zsync control file.
+	ItemExtDiskRawZsync = ".img.zsync"
 )
 
 // List of item extensions that will be included in a product version.
@@ -93,6 +158,11 @@ var allowedItemExtensions = []string{
 	ItemExtSquashfsDelta,
 	ItemExtDiskKVM,
 	ItemExtDiskKVMDelta,
+	ItemExtSquashfsZsync,
+	ItemExtDiskKVMZsync,
+	ItemExtDiskRaw,
+	ItemExtDiskRawDelta,
+	ItemExtDiskRawZsync,
 }
 
 // Item represents a file within a product version.
@@ -111,11 +181,20 @@ type Item struct {
 	// SHA256 hash of the file.
 	SHA256 string `json:"sha256,omitempty"`
 
+	// SHA512 hash of the file. This field is set only when SHA512 hashes
+	// are requested or the version contains a SHA512 checksums file.
+	SHA512 string `json:"sha512,omitempty"`
+
 	// CombinedSHA256DiskKvmImg stores the combined SHA256 hash of the metadata
 	// and VM file system (qcow2) files. This field is set only for the metadata
 	// item when both files exist in the same product version.
 	CombinedSHA256DiskKvmImg string `json:"combined_disk-kvm-img_sha256,omitempty"`
 
+	// CombinedSHA256DiskImg stores the combined SHA256 hash of the metadata
+	// and VM file system (raw disk image) files. This field is set only for
+	// the metadata item when both files exist in the same product version.
+	CombinedSHA256DiskImg string `json:"combined_disk1-img_sha256,omitempty"`
+
 	// CombinedSHA256DiskKvmImg stores the combined SHA256 hash of the metadata
 	// and container file system (squashfs) files. This field is set only for
 	// the metadata item when both files exist in the same product version.
@@ -126,29 +205,154 @@ type Item struct {
 	// item when both files exist in the same product version.
 	CombinedSHA256RootXz string `json:"combined_rootxz_sha256,omitempty"`
 
+	// InstalledSize is the disk space required once the file is unpacked,
+	// which is the total size of the files within the squashfs, or the
+	// virtual size of the qcow2 disk. This field is set only when the
+	// installed size is requested, and only for such items.
+	InstalledSize int64 `json:"installed_size,omitempty"`
+
+	// VirtualSize is the size of the disk seen by the virtual machine, and
+	// Compression is the algorithm of the compressed clusters. These fields
+	// are set only for the qcow2 items when their info is requested.
+	VirtualSize int64  `json:"virtual_size,omitempty"`
+	Compression string `json:"compression,omitempty"`
+
 	// DeltaBase indicates the version from which the delta (.vcdiff) file was
 	// calculated from. This field is set only for the delta items.
 	DeltaBase string `json:"delta_base,omitempty"`
+
+	// hashes contains calculated hashes of the file that are not part of
+	// the product catalog.
+	hashes map[ChecksumAlgorithm]string `json:"-"`
+}
+
+// Hash returns the item's hash for the given checksum algorithm, or an empty
+// string if such hash is not known.
+func (i Item) Hash(algorithm ChecksumAlgorithm) string {
+	switch algorithm {
+	case ChecksumSHA256:
+		return i.SHA256
+	case ChecksumSHA512:
+		return i.SHA512
+	}
+
+	return i.hashes[algorithm]
+}
+
+// setHashes sets the item hashes, retaining those that have no dedicated item
+// field.
+func (i *Item) setHashes(hashes map[ChecksumAlgorithm]string) {
+	i.SHA256 = hashes[ChecksumSHA256]
+	i.SHA512 = hashes[ChecksumSHA512]
+
+	hashes = maps.Clone(hashes)
+	delete(hashes, ChecksumSHA256)
+	delete(hashes, ChecksumSHA512)
+
+	if len(hashes) > 0 {
+		i.hashes = hashes
+	}
+}
+
+// IsDelta returns true if the item is derived from other items of the product
+// to allow incremental downloads, either as a delta (VCDiff) file or a zsync
+// control file.
+func (i Item) IsDelta() bool {
+	switch i.Ftype {
+	case ItemTypeSquashfsDelta, ItemTypeDiskKVMDelta, ItemTypeDiskRawDelta,
+		ItemTypeSquashfsZsync, ItemTypeDiskKVMZsync, ItemTypeDiskRawZsync:
+		return true
+	}
+
+	return false
 }
 
 // Version represents a list of items available for the given image version.
 type Version struct {
 	// incomplete version is either a hidden directory which is considered
 	// partially uploaded version, or does not contain both the metadata
-	// and at least one rootfs file (squashfs or qcow2).
+	// and at least one rootfs file (squashfs, tarball, qcow2, or raw disk).
 	incomplete bool `json:"-"`
 
 	// Checksums of files within the version.
 	Checksums map[string]string `json:"-"`
 
+	// ChecksumAlgorithm is the algorithm of the version checksums.
+	ChecksumAlgorithm ChecksumAlgorithm `json:"-"`
+
+	// ChecksumsSigned indicates that the checksum file has a detached
+	// signature, which means the file must not be modified.
+	ChecksumsSigned bool `json:"-"`
+
 	// ImageConfig contains additional information about the product version.
 	ImageConfig shared.DefinitionSimplestream `json:"-"`
 
+	// ImageConfigWarnings contains the problems found in the image config
+	// that do not prevent it from being applied (e.g. unknown fields).
+	ImageConfigWarnings []ImageConfigIssue `json:"-"`
+
+	// Map of the requirements that need to be satisfied in order for the
+	// image version to work. Product requirements are those of the latest
+	// version, while older versions may differ (e.g. secure boot may be
+	// required only by the newer versions).
+	Requirements map[string]string `json:"requirements,omitempty"`
+
 	// Map of items found within the version, where the map key
 	// represents file name.
 	Items map[string]Item `json:"items,omitempty"`
 }
 
+// MissingItemTypes returns the given item types that are not held by any of
+// the version items.
+func (v Version) MissingItemTypes(itemTypes ...string) []string {
+	var missing []string
+
+	for _, itemType := range itemTypes {
+		found := false
+
+		for _, item := range v.Items {
+			if item.Ftype == itemType {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			missing = append(missing, itemType)
+		}
+	}
+
+	return missing
+}
+
+// SameContent returns true if both versions contain the same items with equal
+// SHA256 hashes. Delta items are ignored, because they are derived from other
+// items.
+func (v Version) SameContent(other Version) bool {
+	count := 0
+
+	for name, item := range v.Items {
+		if item.IsDelta() {
+			continue
+		}
+
+		otherItem, ok := other.Items[name]
+		if !ok || item.SHA256 == "" || item.SHA256 != otherItem.SHA256 {
+			return false
+		}
+
+		count++
+	}
+
+	for _, item := range other.Items {
+		if !item.IsDelta() {
+			count--
+		}
+	}
+
+	return count == 0 && len(v.Items) > 0
+}
+
 // Product represents a single image with all its available versions.
 type Product struct {
 	// List of aliases using which the product (image) can be referenced.
@@ -172,6 +376,16 @@ type Product struct {
 	// Name of the image variant.
 	Variant string `json:"variant"`
 
+	// Date (YYYY-MM-DD) when the release reaches its end of life and stops
+	// receiving updates.
+	ReleaseEOL string `json:"release_eol,omitempty"`
+
+	// Support level of the release (for example, "lts").
+	SupportLevel string `json:"support_level,omitempty"`
+
+	// Lifecycle stage of the release (for example, "supported" or "eol").
+	Lifecycle string `json:"lifecycle,omitempty"`
+
 	// Map of image versions, where the map key represents the version name.
 	Versions map[string]Version `json:"versions,omitempty"`
 
@@ -186,7 +400,24 @@ func (p Product) ID() string {
 	return fmt.Sprintf("%s:%s:%s:%s", p.Distro, p.Release, p.Architecture, p.Variant)
 }
 
-// RelPath returns the product's path relative to the stream's root directory.
+// IsEOL returns true if the product's release has reached its end of life
+// at the given time, either because its lifecycle stage is "eol" or its
+// end-of-life date has passed.
+func (p Product) IsEOL(now time.Time) bool {
+	if strings.EqualFold(p.Lifecycle, LifecycleEOL) {
+		return true
+	}
+
+	eol, err := time.Parse(ReleaseEOLFormat, p.ReleaseEOL)
+	if err != nil {
+		return false
+	}
+
+	return !now.Before(eol)
+}
+
+// RelPath returns the product's path relative to the stream's root directory
+// using the default path schema.
 func (p Product) RelPath() string {
 	return filepath.Join(p.Distro, p.Release, p.Architecture, p.Variant)
 }
@@ -206,7 +437,11 @@ type ProductCatalog struct {
 	Products map[string]Product `json:"products"`
 }
 
-// NewCatalog creates a new product catalog.
+// DataTypeImageDownloads is the default data type of the product catalog.
+const DataTypeImageDownloads = "image-downloads"
+
+// NewCatalog creates a new product catalog. The stream name is used as the
+// content ID.
 func NewCatalog(streamName string, products map[string]Product) *ProductCatalog {
 	if products == nil {
 		products = make(map[string]Product)
@@ -214,7 +449,7 @@ func NewCatalog(streamName string, products map[string]Product) *ProductCatalog
 
 	return &ProductCatalog{
 		ContentID: streamName,
-		DataType:  "image-downloads",
+		DataType:  DataTypeImageDownloads,
 		Format:    "products:1.0",
 		Products:  products,
 	}
@@ -224,8 +459,18 @@ func NewCatalog(streamName string, products map[string]Product) *ProductCatalog
 type Option func(*options)
 
 type options struct {
-	includeIncomplete bool
-	calcHashes        bool
+	includeIncomplete   bool
+	calcHashes          bool
+	requirementDefaults []shared.DefinitionSimplestreamRequirements
+	hashCache           *HashCache
+	hashAlgorithms      []ChecksumAlgorithm
+	pathSchema          PathSchema
+	verifier            *Verifier
+	productFilter       func(id string) bool
+	requiredItems       []string
+	uploadSentinel      string
+	minAge              time.Duration
+	skipVersion         func(id string, versionName string, err error)
 }
 
 func newOptions(opts ...Option) *options {
@@ -255,67 +500,211 @@ func WithHashes(val bool) Option {
 	}
 }
 
-// GetProducts traverses through the directories on the given path and retrieves
-// a map of found products.
-func GetProducts(rootDir string, streamRelPath string, options ...Option) (map[string]Product, error) {
-	streamPath := filepath.Join(rootDir, streamRelPath)
+// WithHashAlgorithms ensures that item hashes are also calculated using the
+// given algorithms, in addition to SHA256. Has no effect unless hashes are
+// calculated.
+func WithHashAlgorithms(algorithms ...ChecksumAlgorithm) Option {
+	return func(o *options) {
+		o.hashAlgorithms = append(o.hashAlgorithms, algorithms...)
+	}
+}
 
-	products := make(map[string]Product)
+// WithHashCache sets the cache that is consulted when calculating file hashes.
+// Hashes of the files that have not changed are retrieved from the cache.
+func WithHashCache(cache *HashCache) Option {
+	return func(o *options) {
+		o.hashCache = cache
+	}
+}
 
-	// Traverse recursively through directories and populate map of products.
-	err := filepath.WalkDir(streamPath, func(path string, file fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
+// WithVerifier ensures that the signature of the version checksum file is
+// verified if the version contains one (e.g. "SHA256SUMS.gpg"). Versions
+// whose signature is not made by any of the trusted keys are rejected.
+func WithVerifier(verifier *Verifier) Option {
+	return func(o *options) {
+		o.verifier = verifier
+	}
+}
 
-		// Get product path relative to rootDir.
-		relPath, err := filepath.Rel(rootDir, path)
+// WithRequirementDefaults sets the default product requirements. Defaults
+// are applied to the product before the requirements from the image config,
+// which means the image config can override them.
+func WithRequirementDefaults(reqs []shared.DefinitionSimplestreamRequirements) Option {
+	return func(o *options) {
+		o.requirementDefaults = reqs
+	}
+}
+
+// WithPathSchema sets the layout of product directories that is used to parse
+// the product paths.
+func WithPathSchema(schema PathSchema) Option {
+	return func(o *options) {
+		o.pathSchema = schema
+	}
+}
+
+// WithProductFilter ensures only the products whose ID is accepted by the given
+// function are retrieved. Directories of other products are not read.
+func WithProductFilter(filter func(id string) bool) Option {
+	return func(o *options) {
+		o.productFilter = filter
+	}
+}
+
+// WithRequiredItems ensures the version contains items of the given types,
+// otherwise, the version is considered incomplete.
+func WithRequiredItems(itemTypes ...string) Option {
+	return func(o *options) {
+		o.requiredItems = append(o.requiredItems, itemTypes...)
+	}
+}
+
+// WithUploadGuard ensures versions that may still be uploaded are considered
+// incomplete, so that their files are not read halfway. These are versions
+// whose directory contains the sentinel file with the given name (if not
+// empty), or any file modified within the given minimum age (if positive).
+func WithUploadGuard(sentinel string, minAge time.Duration) Option {
+	return func(o *options) {
+		o.uploadSentinel = sentinel
+		o.minAge = minAge
+	}
+}
+
+// WithSkippedVersions ensures versions with an invalid image config are
+// skipped instead of failing the retrieval of the whole product. The given
+// function is called with the product ID, version name, and the reason of
+// each skipped version, including the incomplete versions, which are always
+// skipped (see ErrVersionIncomplete).
+func WithSkippedVersions(fn func(id string, versionName string, err error)) Option {
+	return func(o *options) {
+		o.skipVersion = fn
+	}
+}
+
+// GetProducts traverses through the directories on the given path and retrieves
+// a map of found products. Root directory may also be an S3 URL. Traversal is
+// stopped once the context is cancelled.
+func GetProducts(ctx context.Context, rootDir string, streamRelPath string, options ...Option) (map[string]Product, error) {
+	productRelPaths, err := ListProducts(ctx, rootDir, streamRelPath, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	products := make(map[string]Product, len(productRelPaths))
+
+	for _, relPath := range productRelPaths {
+		err := ctx.Err()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		// Get product on the given path.
-		product, err := GetProduct(rootDir, relPath, options...)
+		product, err := GetProduct(ctx, rootDir, relPath, options...)
 		if err != nil {
 			if errors.Is(err, ErrProductInvalidPath) {
 				// Ignore invalid product paths.
-				return nil
+				continue
 			}
 
-			return err
+			return nil, err
 		}
 
 		// Skip products with no versions (empty products).
 		if len(product.Versions) == 0 {
-			return nil
+			continue
 		}
 
 		products[product.ID()] = *product
+	}
+
+	return products, nil
+}
+
+// ListProducts traverses through the directories on the given path and returns
+// the relative paths of the product directories without reading the products.
+// This allows reading the products one at a time. Products excluded by the
+// product filter are not listed. Traversal is stopped once the context is
+// cancelled.
+func ListProducts(ctx context.Context, rootDir string, streamRelPath string, options ...Option) ([]string, error) {
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := newOptions(options...)
+	productPathLength := len(strings.Split(DefaultPathSchema, "/"))
+
+	var productRelPaths []string
+
+	// Traverse recursively through directories and collect product paths.
+	// Directories nested deeper than products are not traversed.
+	var walk func(relPath string) error
+	walk = func(relPath string) error {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		if len(strings.Split(relPath, "/")) >= productPathLength {
+			// Skip products excluded by the filter before reading
+			// their versions.
+			if opts.productFilter != nil {
+				p, err := opts.pathSchema.ParseProductPath(relPath)
+				if err == nil && !opts.productFilter(p.ID()) {
+					return nil
+				}
+			}
+
+			productRelPaths = append(productRelPaths, relPath)
+			return nil
+		}
+
+		files, err := b.List(relPath)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			if !f.IsDir() {
+				continue
+			}
+
+			err := walk(path.Join(relPath, f.Name()))
+			if err != nil {
+				return err
+			}
+		}
+
 		return nil
-	})
+	}
+
+	err = walk(path.Clean(filepath.ToSlash(streamRelPath)))
 	if err != nil {
 		return nil, err
 	}
 
-	return products, nil
+	return productRelPaths, nil
 }
 
 // GetProduct reads the product on the given path including all of its versions.
 // Product's relative path must match the predetermined format, otherwise, an error
 // is returned.
-func GetProduct(rootDir string, productRelPath string, options ...Option) (*Product, error) {
-	productPath := filepath.Join(rootDir, productRelPath)
-	productPathFormat := "stream/distribution/release/architecture/variant"
-	productPathLength := len(strings.Split(productPathFormat, string(os.PathSeparator)))
+func GetProduct(ctx context.Context, rootDir string, productRelPath string, options ...Option) (*Product, error) {
+	opts := newOptions(options...)
 
-	// Ensure product relative path matches the required format.
-	parts := strings.Split(productRelPath, string(os.PathSeparator))
-	if len(parts) < productPathLength || len(parts) > productPathLength {
-		return nil, fmt.Errorf("%w: path %q does not match the required format %q", ErrProductInvalidPath, productRelPath, productPathFormat)
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ensure product relative path matches the path schema.
+	p, err := opts.pathSchema.ParseProductPath(filepath.ToSlash(productRelPath))
+	if err != nil {
+		return nil, err
 	}
 
 	// Ensure product path is a directory.
-	info, err := os.Stat(productPath)
+	info, err := b.Stat(productRelPath)
 	if err != nil {
 		return nil, fmt.Errorf("%w: %w", ErrProductInvalidPath, err)
 	}
@@ -324,18 +713,10 @@ func GetProduct(rootDir string, productRelPath string, options ...Option) (*Prod
 		return nil, fmt.Errorf("%w: not a directory", ErrProductInvalidPath)
 	}
 
-	// New product.
-	p := Product{
-		Variant:      parts[len(parts)-1],
-		Architecture: parts[len(parts)-2],
-		Release:      parts[len(parts)-3],
-		ReleaseTitle: parts[len(parts)-3],
-		Distro:       parts[len(parts)-4],
-		Requirements: make(map[string]string, 0),
-	}
+	p.Requirements = make(map[string]string, 0)
 
 	// Check product content.
-	files, err := os.ReadDir(productPath)
+	files, err := b.List(productRelPath)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to read product contents: %w", err)
 	}
@@ -351,10 +732,19 @@ func GetProduct(rootDir string, productRelPath string, options ...Option) (*Prod
 		versionRelPath := filepath.Join(productRelPath, f.Name())
 
 		// Parse product version.
-		version, err := GetVersion(rootDir, versionRelPath, options...)
+		version, err := GetVersion(ctx, rootDir, versionRelPath, options...)
 		if err != nil {
 			if errors.Is(err, ErrVersionIncomplete) {
 				// Ignore incomplete versions.
+				if opts.skipVersion != nil {
+					opts.skipVersion(p.ID(), f.Name(), err)
+				}
+
+				continue
+			}
+
+			if errors.Is(err, ErrVersionInvalidImageConfig) && opts.skipVersion != nil {
+				opts.skipVersion(p.ID(), f.Name(), err)
 				continue
 			}
 
@@ -365,21 +755,26 @@ func GetProduct(rootDir string, productRelPath string, options ...Option) (*Prod
 		if !version.incomplete {
 			// Reset old values.
 			aliases = []string{}
-			p.Requirements = make(map[string]string)
 
 			// Set pretty OS name.
 			osName = version.ImageConfig.DistroName
 
-			// Set product requirements.
-			for _, req := range version.ImageConfig.Requirements {
-				// Apply requirements if filter matches the current product.
-				// Note that instance types are not supported because requirements
-				// are applied to the product itself and not a specific version.
-				if shared.ApplyFilter(&req.DefinitionFilter, p.Release, p.Architecture, p.Variant, "", 0) {
-					for k, v := range req.Requirements {
-						p.Requirements[k] = v
-					}
-				}
+			// Set release lifecycle information.
+			p.ReleaseEOL = version.ImageConfig.ReleaseEOL[p.Release]
+			p.SupportLevel = version.ImageConfig.SupportLevel[p.Release]
+			p.Lifecycle = version.ImageConfig.Lifecycle[p.Release]
+
+			// Set version requirements. Defaults are applied first, so
+			// that the image config can override them. Product inherits
+			// the requirements of the latest version, so that clients
+			// unaware of the version requirements keep working.
+			reqs := make(map[string]string)
+			p.applyRequirements(reqs, *version, opts.requirementDefaults)
+			p.applyRequirements(reqs, *version, version.ImageConfig.Requirements)
+
+			p.Requirements = reqs
+			if len(reqs) > 0 {
+				version.Requirements = maps.Clone(reqs)
 			}
 
 			// Evaluate additional aliases.
@@ -413,20 +808,61 @@ func GetProduct(rootDir string, productRelPath string, options ...Option) (*Prod
 		p.OS = cases.Title(language.English).String(p.Distro)
 	}
 
-	return &p, nil
+	return p, nil
+}
+
+// applyRequirements applies requirements whose filter matches the product to
+// the target requirements. Filter types (container/vm) are matched against
+// the instance types supported by the given version.
+func (p *Product) applyRequirements(target map[string]string, version Version, reqs []shared.DefinitionSimplestreamRequirements) {
+	var types []shared.DefinitionFilterType
+
+	for _, item := range version.Items {
+		switch item.Ftype {
+		case ItemTypeDiskKVM, ItemTypeDiskRaw:
+			types = append(types, shared.DefinitionFilterTypeVM)
+		case ItemTypeSquashfs, ItemTypeRootTarXz:
+			types = append(types, shared.DefinitionFilterTypeContainer)
+		}
+	}
+
+	for _, req := range reqs {
+		match := false
+
+		if len(req.Types) == 0 {
+			match = shared.ApplyFilter(&req.DefinitionFilter, p.Release, p.Architecture, p.Variant, "", 0)
+		} else {
+			for _, t := range types {
+				if shared.ApplyFilter(&req.DefinitionFilter, p.Release, p.Architecture, p.Variant, t, shared.ImageTargetContainer|shared.ImageTargetVM) {
+					match = true
+					break
+				}
+			}
+		}
+
+		if match {
+			for k, v := range req.Requirements {
+				target[k] = v
+			}
+		}
+	}
 }
 
 // GetVersion retrieves metadata for a single version, by reading directory
 // files and converting those that should be incuded in the product catalog
 // into items. For the relevant items, the file hashes are calculated, if
 // calcHashes is set to true.
-func GetVersion(rootDir string, versionRelPath string, options ...Option) (*Version, error) {
+func GetVersion(ctx context.Context, rootDir string, versionRelPath string, options ...Option) (*Version, error) {
 	opts := newOptions(options...)
-	versionPath := filepath.Join(rootDir, versionRelPath)
+
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return nil, err
+	}
 
 	// Hidden versions are considered incomplete, as they may contain
 	// partially uploaded files.
-	if strings.HasPrefix(filepath.Base(versionPath), ".") && !opts.includeIncomplete {
+	if strings.HasPrefix(filepath.Base(versionRelPath), ".") && !opts.includeIncomplete {
 		return nil, fmt.Errorf("%w (hidden version): %q", ErrVersionIncomplete, versionRelPath)
 	}
 
@@ -436,102 +872,223 @@ func GetVersion(rootDir string, versionRelPath string, options ...Option) (*Vers
 	}
 
 	// Get files on version path.
-	files, err := os.ReadDir(versionPath)
+	files, err := b.List(versionRelPath)
 	if err != nil {
 		return nil, err
 	}
 
+	// Versions that are still being uploaded are considered incomplete.
+	reason := uploadInProgress(clock.FromContext(ctx).Now(), files, opts.uploadSentinel, opts.minAge)
+	if reason != "" && !opts.includeIncomplete {
+		return nil, fmt.Errorf("%w (%s): %q", ErrVersionIncomplete, reason, versionRelPath)
+	}
+
+	// Read the preferred checksum file and convert it to a map of filename
+	// and checksum pairs. Ensure the item hashes are calculated using the
+	// same algorithm, so they can be verified.
+	for _, f := range checksumFiles {
+		version.Checksums, err = readChecksumFile(ctx, b, filepath.Join(versionRelPath, f.name))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			return nil, fmt.Errorf("Failed to read checksums file: %w", err)
+		}
+
+		// Checksums cannot be trusted unless their signature is valid.
+		version.ChecksumsSigned, err = verifyChecksumsSignature(ctx, b, filepath.Join(versionRelPath, f.name), opts.verifier)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrVersionInvalidSignature, err)
+		}
+
+		version.ChecksumAlgorithm = f.algorithm
+		options = append(slices.Clip(options), WithHashAlgorithms(f.algorithm))
+		break
+	}
+
 	// Extract relevant items from the version directory.
 	for _, file := range files {
+		err := ctx.Err()
+		if err != nil {
+			return nil, err
+		}
+
 		if file.IsDir() {
 			// Skip directories.
 			continue
 		}
 
 		if shared.HasSuffix(file.Name(), allowedItemExtensions...) {
-			// Get an item and calculate its hash if necessary.
+			// Get an item. Hashes are calculated once all items are known.
 			itemRelPath := filepath.Join(versionRelPath, file.Name())
-			item, err := GetItem(rootDir, itemRelPath, options...)
+			item, err := GetItem(ctx, rootDir, itemRelPath, append(slices.Clip(options), WithHashes(false))...)
 			if err != nil {
 				return nil, err
 			}
 
 			version.Items[file.Name()] = *item
-		} else if file.Name() == FileChecksumSHA256 {
-			// Read the checksum file and convert it to a map
-			// of filename and checksum pairs.
-			checksumPath := filepath.Join(versionPath, file.Name())
-			version.Checksums, err = ReadChecksumFile(checksumPath)
-			if err != nil {
-				return nil, fmt.Errorf("Failed to read checksums file: %w", err)
-			}
 		} else if file.Name() == FileImageConfig {
 			// Read the image config file.
-			configPath := filepath.Join(versionPath, file.Name())
-			config, err := shared.ReadYAMLFile(configPath, &shared.Definition{})
+			config, warnings, err := readImageConfig(b, filepath.Join(versionRelPath, file.Name()))
 			if err != nil {
 				return nil, fmt.Errorf("%w: %w", ErrVersionInvalidImageConfig, err)
 			}
 
 			version.ImageConfig = config.Simplestream
+			version.ImageConfigWarnings = warnings
 		}
 	}
 
-	// Check whether version is complete, and calculate combined hashes if necessary.
-	metaItem, ok := version.Items[ItemTypeMetadata]
-	if ok {
-		metaItemPath := filepath.Join(versionPath, ItemTypeMetadata)
+	// Version is complete if it contains the metadata and at least one root
+	// filesystem, for which the combined hash is calculated.
+	var combinedItems []string
 
+	_, ok := version.Items[ItemTypeMetadata]
+	if ok {
 		for itemName, item := range version.Items {
-			if !slices.Contains([]string{ItemTypeSquashfs, ItemTypeDiskKVM, ItemTypeRootTarXz}, item.Ftype) {
-				// Skip files that are not required for combined checksum.
-				continue
+			if slices.Contains([]string{ItemTypeSquashfs, ItemTypeDiskKVM, ItemTypeDiskRaw, ItemTypeRootTarXz}, item.Ftype) {
+				combinedItems = append(combinedItems, itemName)
+				version.incomplete = false
 			}
+		}
+	}
 
-			itemHash := ""
+	if opts.calcHashes {
+		algorithms := append([]ChecksumAlgorithm{ChecksumSHA256}, newOptions(options...).hashAlgorithms...)
 
-			if opts.calcHashes {
-				// Calculate combined hash for the item.
-				itemPath := filepath.Join(versionPath, itemName)
-				itemHash, err = shared.FileHash(sha256.New(), metaItemPath, itemPath)
-				if err != nil {
-					return nil, err
-				}
-			}
+		err := version.calcHashes(ctx, rootDir, opts.hashCache, algorithms, combinedItems)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-			switch item.Ftype {
-			case ItemTypeDiskKVM:
-				metaItem.CombinedSHA256DiskKvmImg = itemHash
-				version.incomplete = false
+	// At least metadata and one of the rootfs files must exist
+	// for the version to be considered complete.
+	if version.incomplete && !opts.includeIncomplete {
+		return nil, fmt.Errorf("%w: %q", ErrVersionIncomplete, versionRelPath)
+	}
 
-			case ItemTypeSquashfs:
-				metaItem.CombinedSHA256SquashFs = itemHash
-				version.incomplete = false
+	// Version must also contain all required item types.
+	missing := version.MissingItemTypes(opts.requiredItems...)
+	if len(missing) > 0 {
+		if !opts.includeIncomplete {
+			return nil, fmt.Errorf("%w: %s", ErrVersionMissingItems, strings.Join(missing, ", "))
+		}
 
-			case ItemTypeRootTarXz:
-				metaItem.CombinedSHA256RootXz = itemHash
+		version.incomplete = true
+	}
+
+	if reason != "" {
+		version.incomplete = true
+	}
+
+	return &version, nil
+}
+
+// uploadInProgress returns the reason why the version with the given files
+// may still be uploaded, or an empty string if the upload is finished. This
+// is the case if the version contains the sentinel file, or any of its files
+// was modified within the minimum age at the given time.
+func uploadInProgress(now time.Time, files []fs.FileInfo, sentinel string, minAge time.Duration) string {
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		if sentinel != "" && file.Name() == sentinel {
+			return fmt.Sprintf("upload in progress, sentinel file %q exists", sentinel)
+		}
+
+		if minAge > 0 && now.Sub(file.ModTime()) < minAge {
+			return fmt.Sprintf("upload in progress, file %q was modified within %s", file.Name(), minAge)
+		}
+	}
+
+	return ""
+}
+
+// calcHashes calculates the hashes of all version items for the given
+// algorithms, along with the combined hashes of the metadata and each of the
+// given root filesystem items. Each file is read only once.
+func (v *Version) calcHashes(ctx context.Context, rootDir string, cache *HashCache, algorithms []ChecksumAlgorithm, combinedItems []string) error {
+	// Metadata goes first, so that it is read before the root filesystems
+	// it is combined with.
+	itemNames := shared.MapKeys(v.Items)
+	slices.SortFunc(itemNames, func(a string, b string) int {
+		if (a == ItemTypeMetadata) != (b == ItemTypeMetadata) {
+			if a == ItemTypeMetadata {
+				return -1
 			}
+
+			return 1
 		}
 
-		version.Items[ItemTypeMetadata] = metaItem
+		return strings.Compare(a, b)
+	})
+
+	slices.Sort(combinedItems)
+
+	requests := make([]HashRequest, 0, len(itemNames)+len(combinedItems))
+
+	for _, itemName := range itemNames {
+		requests = append(requests, HashRequest{Algorithms: algorithms, Names: []string{v.Items[itemName].Path}})
 	}
 
-	// At least metadata and one of squashfs or qcow2 files must exist
-	// for the version to be considered complete.
-	if version.incomplete && !opts.includeIncomplete {
-		return nil, fmt.Errorf("%w: %q", ErrVersionIncomplete, versionRelPath)
+	metaItem := v.Items[ItemTypeMetadata]
+
+	for _, itemName := range combinedItems {
+		requests = append(requests, HashRequest{Algorithms: []ChecksumAlgorithm{ChecksumSHA256}, Names: []string{metaItem.Path, v.Items[itemName].Path}})
 	}
 
-	return &version, nil
+	hashes, err := cache.BatchFileHashes(ctx, rootDir, requests)
+	if err != nil {
+		return err
+	}
+
+	for i, itemName := range itemNames {
+		item := v.Items[itemName]
+		item.setHashes(hashes[i])
+		v.Items[itemName] = item
+	}
+
+	if len(combinedItems) == 0 {
+		return nil
+	}
+
+	metaItem = v.Items[ItemTypeMetadata]
+
+	for i, itemName := range combinedItems {
+		itemHash := hashes[len(itemNames)+i][ChecksumSHA256]
+
+		switch v.Items[itemName].Ftype {
+		case ItemTypeDiskKVM:
+			metaItem.CombinedSHA256DiskKvmImg = itemHash
+		case ItemTypeDiskRaw:
+			metaItem.CombinedSHA256DiskImg = itemHash
+		case ItemTypeSquashfs:
+			metaItem.CombinedSHA256SquashFs = itemHash
+		case ItemTypeRootTarXz:
+			metaItem.CombinedSHA256RootXz = itemHash
+		}
+	}
+
+	v.Items[ItemTypeMetadata] = metaItem
+
+	return nil
 }
 
 // GetItem retrieves item metadata for the file on a given path. If calcHash is
 // set to true, the file's hash is calculated.
-func GetItem(rootDir string, itemRelPath string, options ...Option) (*Item, error) {
+func GetItem(ctx context.Context, rootDir string, itemRelPath string, options ...Option) (*Item, error) {
 	opts := newOptions(options...)
-	itemPath := filepath.Join(rootDir, itemRelPath)
 
-	file, err := os.Stat(itemPath)
+	b, err := storage.New(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := b.Stat(itemRelPath)
 	if err != nil {
 		return nil, err
 	}
@@ -541,42 +1098,80 @@ func GetItem(rootDir string, itemRelPath string, options ...Option) (*Item, erro
 	item.Path = itemRelPath
 
 	if opts.calcHashes {
-		hash, err := shared.FileHash(sha256.New(), itemPath)
+		algorithms := append([]ChecksumAlgorithm{ChecksumSHA256}, opts.hashAlgorithms...)
+
+		hashes, err := opts.hashCache.FileHashes(ctx, rootDir, algorithms, itemRelPath)
 		if err != nil {
 			return nil, err
 		}
 
-		item.SHA256 = hash
+		item.setHashes(hashes)
 	}
 
-	switch filepath.Ext(itemPath) {
+	item.Ftype = FileItemType(file.Name())
+
+	item.DeltaBase = DeltaBaseVersion(file.Name(), item.Ftype)
+
+	return &item, nil
+}
+
+// FileItemType returns the item type of the file with the given name. If the
+// file does not hold a known item type, the file name is returned.
+func FileItemType(name string) string {
+	switch filepath.Ext(name) {
 	case ItemExtSquashfs:
-		item.Ftype = ItemTypeSquashfs
+		return ItemTypeSquashfs
 
 	case ItemExtDiskKVM:
-		item.Ftype = ItemTypeDiskKVM
+		return ItemTypeDiskKVM
+
+	case ItemExtDiskRaw:
+		return ItemTypeDiskRaw
 
 	case ".vcdiff":
-		parts := strings.Split(file.Name(), ".")
-		if strings.HasSuffix(file.Name(), ItemExtDiskKVMDelta) {
-			item.Ftype = ItemTypeDiskKVMDelta
-			item.DeltaBase = parts[len(parts)-3]
-		} else {
-			item.Ftype = ItemTypeSquashfsDelta
-			item.DeltaBase = parts[len(parts)-2]
+		if strings.HasSuffix(name, ItemExtDiskKVMDelta) {
+			return ItemTypeDiskKVMDelta
+		}
+
+		if strings.HasSuffix(name, ItemExtDiskRawDelta) {
+			return ItemTypeDiskRawDelta
+		}
+
+		return ItemTypeSquashfsDelta
+
+	case ".zsync":
+		if strings.HasSuffix(name, ItemExtDiskKVMZsync) {
+			return ItemTypeDiskKVMZsync
+		}
+
+		if strings.HasSuffix(name, ItemExtDiskRawZsync) {
+			return ItemTypeDiskRawZsync
 		}
 
+		return ItemTypeSquashfsZsync
+
+	case ".xz":
+		if slices.Contains(rootTarXzNames, name) {
+			return ItemTypeRootTarXz
+		}
+
+		return name
+
 	default:
-		item.Ftype = file.Name()
+		return name
 	}
-
-	return &item, nil
 }
 
 // ReadChecksumFile reads a checksum file and returns a map of filename
 // checksum pairs.
-func ReadChecksumFile(path string) (map[string]string, error) {
-	file, err := os.Open(path)
+func ReadChecksumFile(ctx context.Context, path string) (map[string]string, error) {
+	return readChecksumFile(ctx, storage.NewLocal(filepath.Dir(path)), filepath.Base(path))
+}
+
+// readChecksumFile reads the checksum file with the given name from the
+// storage backend.
+func readChecksumFile(ctx context.Context, b storage.Backend, name string) (map[string]string, error) {
+	file, err := b.Open(name)
 	if err != nil {
 		return nil, err
 	}
@@ -585,7 +1180,7 @@ func ReadChecksumFile(path string) (map[string]string, error) {
 
 	checksums := make(map[string]string)
 
-	scanner := bufio.NewScanner(file)
+	scanner := bufio.NewScanner(contextReader{ctx: ctx, r: file})
 	for scanner.Scan() {
 		// Trim all leading and trailing whitespace.
 		line := strings.TrimSpace(scanner.Text())
@@ -602,9 +1197,45 @@ func ReadChecksumFile(path string) (map[string]string, error) {
 		checksums[filename] = checksum
 	}
 
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
 	return checksums, nil
 }
 
+// readImageConfig reads the image config file with the given name from the
+// storage backend. The config is validated against the schema, and the
+// warnings found during the validation are returned along with the config.
+func readImageConfig(b storage.Backend, name string) (*shared.Definition, []ImageConfigIssue, error) {
+	file, err := b.Open(name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error opening file: %w", err)
+	}
+
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error reading file: %w", err)
+	}
+
+	warnings, err := ValidateImageConfig(content)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path.Base(name), err)
+	}
+
+	config := &shared.Definition{}
+
+	err = yaml.Unmarshal(content, config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error decoding YAML: %w", err)
+	}
+
+	return config, warnings, nil
+}
+
 // CreateAliases creates aliases from the given distro, release, and variant.
 // It appends them to the aliases slice and returns the updated slice.
 func CreateAliases(distro string, release string, variant string) []string {
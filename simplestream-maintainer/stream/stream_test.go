@@ -1,16 +1,20 @@
 package stream_test
 
 import (
+	"context"
+	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/clock"
 	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
 	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/testutils"
 )
@@ -57,6 +61,17 @@ func TestGetItem(t *testing.T) {
 				SHA256: "a42d519714d616e9411dbceec4b52808bd6b1ee53e6f6497a281d655357d8b71",
 			},
 		},
+		{
+			Name:     "Item rootfs tarball with hash",
+			Mock:     testutils.MockItem("rootfs.tar.xz").WithContent("container"),
+			CalcHash: true,
+			WantItem: stream.Item{
+				Size:   9,
+				Path:   "rootfs.tar.xz",
+				Ftype:  "root.tar.xz",
+				SHA256: "a42d519714d616e9411dbceec4b52808bd6b1ee53e6f6497a281d655357d8b71",
+			},
+		},
 		{
 			Name: "Item squashfs vcdiff",
 			Mock: testutils.MockItem("test/delta.123123.vcdiff").WithContent("vcdiff"),
@@ -79,13 +94,88 @@ func TestGetItem(t *testing.T) {
 				SHA256:    "",
 			},
 		},
+		{
+			Name: "Item squashfs vcdiff with dotted base version",
+			Mock: testutils.MockItem("test/root.from-20240101.1.vcdiff").WithContent(""),
+			WantItem: stream.Item{
+				Path:      "test/root.from-20240101.1.vcdiff",
+				Ftype:     "squashfs.vcdiff",
+				DeltaBase: "20240101.1",
+			},
+		},
+		{
+			Name: "Item qcow2 vcdiff with dotted base version",
+			Mock: testutils.MockItem("test/disk.from-20240101.1.qcow2.vcdiff").WithContent(""),
+			WantItem: stream.Item{
+				Path:      "test/disk.from-20240101.1.qcow2.vcdiff",
+				Ftype:     "disk-kvm.img.vcdiff",
+				DeltaBase: "20240101.1",
+			},
+		},
+		{
+			Name: "Item legacy qcow2 vcdiff with dotted base version",
+			Mock: testutils.MockItem("test/disk.20240101.1.qcow2.vcdiff").WithContent(""),
+			WantItem: stream.Item{
+				Path:      "test/disk.20240101.1.qcow2.vcdiff",
+				Ftype:     "disk-kvm.img.vcdiff",
+				DeltaBase: "20240101.1",
+			},
+		},
+		{
+			Name:     "Item raw disk with hash",
+			Mock:     testutils.MockItem("disk1.img").WithContent("VM"),
+			CalcHash: true,
+			WantItem: stream.Item{
+				Size:   2,
+				Path:   "disk1.img",
+				Ftype:  "disk1.img",
+				SHA256: "8e5abdd396d535012cb3b24b6c998ab6d8f8118fe5c564c21c624c54964464e6",
+			},
+		},
+		{
+			Name: "Item raw disk vcdiff",
+			Mock: testutils.MockItem("test/disk1.2024_01_01.img.vcdiff").WithContent(""),
+			WantItem: stream.Item{
+				Size:      0,
+				Path:      "test/disk1.2024_01_01.img.vcdiff",
+				Ftype:     "disk1.img.vcdiff",
+				DeltaBase: "2024_01_01",
+			},
+		},
+		{
+			Name: "Item raw disk zsync",
+			Mock: testutils.MockItem("test/disk1.img.zsync").WithContent("zsync"),
+			WantItem: stream.Item{
+				Size:  5,
+				Path:  "test/disk1.img.zsync",
+				Ftype: "disk1.img.zsync",
+			},
+		},
+		{
+			Name: "Item squashfs zsync",
+			Mock: testutils.MockItem("test/root.squashfs.zsync").WithContent("zsync"),
+			WantItem: stream.Item{
+				Size:  5,
+				Path:  "test/root.squashfs.zsync",
+				Ftype: "squashfs.zsync",
+			},
+		},
+		{
+			Name: "Item qcow2 zsync",
+			Mock: testutils.MockItem("test/disk.qcow2.zsync").WithContent("zsync"),
+			WantItem: stream.Item{
+				Size:  5,
+				Path:  "test/disk.qcow2.zsync",
+				Ftype: "disk-kvm.img.zsync",
+			},
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.Name, func(t *testing.T) {
 			test.Mock.Create(t, t.TempDir())
 
-			item, err := stream.GetItem(test.Mock.RootDir(), test.Mock.RelPath(), stream.WithHashes(test.CalcHash))
+			item, err := stream.GetItem(context.Background(), test.Mock.RootDir(), test.Mock.RelPath(), stream.WithHashes(test.CalcHash))
 			if test.WantErr != nil {
 				assert.ErrorIs(t, err, test.WantErr)
 			} else {
@@ -100,11 +190,12 @@ func TestGetVersion(t *testing.T) {
 	t.Parallel()
 
 	tests := []struct {
-		Name        string
-		Mock        testutils.VersionMock
-		CalcHashes  bool
-		WantErr     error
-		WantVersion stream.Version
+		Name          string
+		Mock          testutils.VersionMock
+		CalcHashes    bool
+		RequiredItems []string
+		WantErr       error
+		WantVersion   stream.Version
 	}{
 		{
 			Name: "Version is incomplete: missing rootfs",
@@ -129,6 +220,35 @@ func TestGetVersion(t *testing.T) {
 			),
 			WantErr: stream.ErrVersionIncomplete,
 		},
+		{
+			Name: "Version is incomplete: missing required items",
+			Mock: testutils.MockVersion("20241010_1212").AddItems(
+				testutils.MockItem("lxd.tar.xz"),
+				testutils.MockItem("rootfs.squashfs"),
+			),
+			RequiredItems: []string{"squashfs", "disk-kvm.img"},
+			WantErr:       stream.ErrVersionMissingItems,
+		},
+		{
+			Name: "Valid version with required items",
+			Mock: testutils.MockVersion("20241010_1212").AddItems(
+				testutils.MockItem("lxd.tar.xz"),
+				testutils.MockItem("rootfs.squashfs"),
+			),
+			RequiredItems: []string{"squashfs"},
+			WantVersion: stream.Version{
+				Items: map[string]stream.Item{
+					"lxd.tar.xz": {
+						Size:  12,
+						Ftype: "lxd.tar.xz",
+					},
+					"rootfs.squashfs": {
+						Size:  12,
+						Ftype: "squashfs",
+					},
+				},
+			},
+		},
 		{
 			Name: "Valid version without item hashes",
 			Mock: testutils.MockVersion("v10").AddItems(
@@ -183,6 +303,52 @@ func TestGetVersion(t *testing.T) {
 				},
 			},
 		},
+		{
+			Name:       "Valid version with item hashes: Raw disk VM",
+			CalcHashes: true,
+			Mock: testutils.MockVersion("v10").AddItems(
+				testutils.MockItem("lxd.tar.xz"),
+				testutils.MockItem("disk1.img"),
+			),
+			WantVersion: stream.Version{
+				Items: map[string]stream.Item{
+					"lxd.tar.xz": {
+						Size:                  12,
+						Ftype:                 "lxd.tar.xz",
+						SHA256:                "0a3666a0710c08aa6d0de92ce72beeb5b93124cce1bf3701c9d6cdeb543cb73e",
+						CombinedSHA256DiskImg: "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
+					},
+					"disk1.img": {
+						Size:   12,
+						Ftype:  "disk1.img",
+						SHA256: "0a3666a0710c08aa6d0de92ce72beeb5b93124cce1bf3701c9d6cdeb543cb73e",
+					},
+				},
+			},
+		},
+		{
+			Name:       "Valid version with item hashes: Container tarball",
+			CalcHashes: true,
+			Mock: testutils.MockVersion("v10").AddItems(
+				testutils.MockItem("lxd.tar.xz"),
+				testutils.MockItem("rootfs.tar.xz"),
+			),
+			WantVersion: stream.Version{
+				Items: map[string]stream.Item{
+					"lxd.tar.xz": {
+						Size:                 12,
+						Ftype:                "lxd.tar.xz",
+						SHA256:               "0a3666a0710c08aa6d0de92ce72beeb5b93124cce1bf3701c9d6cdeb543cb73e",
+						CombinedSHA256RootXz: "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
+					},
+					"rootfs.tar.xz": {
+						Size:   12,
+						Ftype:  "root.tar.xz",
+						SHA256: "0a3666a0710c08aa6d0de92ce72beeb5b93124cce1bf3701c9d6cdeb543cb73e",
+					},
+				},
+			},
+		},
 		{
 			Name:       "Valid version with item hashes: Container and VM including delta files",
 			CalcHashes: true,
@@ -227,13 +393,46 @@ func TestGetVersion(t *testing.T) {
 				},
 			},
 		},
+		{
+			Name:       "Valid version with SHA512 checksums file",
+			CalcHashes: true,
+			Mock: testutils.MockVersion("v10").AddItems(
+				testutils.MockItem("lxd.tar.xz"),
+				testutils.MockItem("disk.qcow2"),
+			).SetChecksumsFile(stream.FileChecksumSHA512,
+				testutils.ItemDefaultContentSHA512+"  lxd.tar.xz",
+				testutils.ItemDefaultContentSHA512+"  disk.qcow2",
+			),
+			WantVersion: stream.Version{
+				ChecksumAlgorithm: stream.ChecksumSHA512,
+				Checksums: map[string]string{
+					"lxd.tar.xz": testutils.ItemDefaultContentSHA512,
+					"disk.qcow2": testutils.ItemDefaultContentSHA512,
+				},
+				Items: map[string]stream.Item{
+					"lxd.tar.xz": {
+						Size:                     12,
+						Ftype:                    "lxd.tar.xz",
+						SHA256:                   testutils.ItemDefaultContentSHA,
+						SHA512:                   testutils.ItemDefaultContentSHA512,
+						CombinedSHA256DiskKvmImg: "d9da2d2151ce5c89dfb8e1c329b286a02bd8464deb38f0f4d858486a27b796bf",
+					},
+					"disk.qcow2": {
+						Size:   12,
+						Ftype:  "disk-kvm.img",
+						SHA256: testutils.ItemDefaultContentSHA,
+						SHA512: testutils.ItemDefaultContentSHA512,
+					},
+				},
+			},
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.Name, func(t *testing.T) {
 			test.Mock.Create(t, t.TempDir())
 
-			version, err := stream.GetVersion(test.Mock.RootDir(), test.Mock.RelPath(), stream.WithHashes(test.CalcHashes))
+			version, err := stream.GetVersion(context.Background(), test.Mock.RootDir(), test.Mock.RelPath(), stream.WithHashes(test.CalcHashes), stream.WithRequiredItems(test.RequiredItems...))
 			if test.WantErr != nil {
 				assert.ErrorIs(t, err, test.WantErr)
 			} else {
@@ -256,6 +455,7 @@ func TestGetProduct(t *testing.T) {
 	tests := []struct {
 		Name        string
 		Mock        testutils.ProductMock
+		Options     []stream.Option
 		IgnoreItems bool
 		WantErr     error
 		WantProduct stream.Product
@@ -302,7 +502,7 @@ func TestGetProduct(t *testing.T) {
 					"secure_boot": "false",
 				},
 				Versions: map[string]stream.Version{
-					"2024_01_01": {},
+					"2024_01_01": {Requirements: map[string]string{"secure_boot": "false"}},
 				},
 			},
 		},
@@ -332,11 +532,56 @@ func TestGetProduct(t *testing.T) {
 				Requirements: map[string]string{
 					"secure_boot": "true",
 				},
+				Versions: map[string]stream.Version{
+					"2024_01_01": {Requirements: map[string]string{"secure_boot": "true"}},
+				},
+			},
+		},
+		{
+			Name: "Product version with valid config (release lifecycle)",
+			Mock: testutils.MockProduct("stream/ubuntu/noble/amd64/cloud").AddVersions(
+				testutils.MockVersion("2024_01_01").
+					WithFiles("lxd.tar.xz", "root.squashfs").
+					SetImageConfig(
+						"simplestream:",
+						"  release_eol:",
+						"    noble: 2029-05-31",
+						"    focal: 2025-05-31", // EOL of a different release.
+						"  support_level:",
+						"    noble: lts",
+						"  lifecycle:",
+						"    noble: supported",
+					)),
+			IgnoreItems: true,
+			WantProduct: stream.Product{
+				Aliases:      "ubuntu/noble/cloud",
+				Distro:       "ubuntu",
+				OS:           "Ubuntu",
+				Release:      "noble",
+				ReleaseTitle: "noble",
+				Architecture: "amd64",
+				Variant:      "cloud",
+				ReleaseEOL:   "2029-05-31",
+				SupportLevel: "lts",
+				Lifecycle:    "supported",
+				Requirements: map[string]string{},
 				Versions: map[string]stream.Version{
 					"2024_01_01": {},
 				},
 			},
 		},
+		{
+			Name: "Product version with invalid config (release end-of-life date)",
+			Mock: testutils.MockProduct("stream/ubuntu/noble/amd64/cloud").AddVersions(
+				testutils.MockVersion("2024_01_01").
+					WithFiles("lxd.tar.xz", "root.squashfs").
+					SetImageConfig(
+						"simplestream:",
+						"  release_eol:",
+						"    noble: May 2029",
+					)),
+			WantErr: stream.ErrVersionInvalidImageConfig,
+		},
 		{
 			Name: "Product version with a valid config (no simplestreams section)",
 			Mock: testutils.MockProduct("stream/distro/release/arch/variant").AddVersions(
@@ -418,8 +663,9 @@ func TestGetProduct(t *testing.T) {
 					"custom1":     "false",
 				},
 				Versions: map[string]stream.Version{
-					"1": {},
-					"2": {},
+					// Each version retains its own requirements.
+					"1": {Requirements: map[string]string{"secure_boot": "true", "nesting": "true"}},
+					"2": {Requirements: map[string]string{"secure_boot": "false", "custom1": "false"}},
 				},
 			},
 		},
@@ -566,6 +812,75 @@ func TestGetProduct(t *testing.T) {
 				},
 			},
 		},
+		{
+			Name: "Product with default requirements matching architecture and types",
+			Mock: testutils.MockProduct("stream/distro/release/arm64/default").AddVersions(
+				testutils.MockVersion("2024_01_01").WithFiles("lxd.tar.xz", "root.squashfs", "disk.qcow2")),
+			Options: []stream.Option{
+				stream.WithRequirementDefaults([]shared.DefinitionSimplestreamRequirements{
+					{
+						DefinitionFilter: shared.DefinitionFilter{Architectures: []string{"arm64"}, Types: []shared.DefinitionFilterType{"vm"}},
+						Requirements:     map[string]string{"secureboot": "false"},
+					},
+					{
+						DefinitionFilter: shared.DefinitionFilter{Architectures: []string{"amd64"}},
+						Requirements:     map[string]string{"nesting": "true"},
+					},
+				}),
+			},
+			IgnoreItems: true,
+			WantProduct: stream.Product{
+				Aliases:      "distro/release/default,distro/release",
+				Distro:       "distro",
+				OS:           "Distro",
+				Release:      "release",
+				ReleaseTitle: "release",
+				Architecture: "arm64",
+				Variant:      "default",
+				Requirements: map[string]string{"secureboot": "false"},
+				Versions: map[string]stream.Version{
+					"2024_01_01": {Requirements: map[string]string{"secureboot": "false"}},
+				},
+			},
+		},
+		{
+			Name: "Product with default requirements not matching types and overridden by config",
+			Mock: testutils.MockProduct("stream/distro/release/arm64/default").AddVersions(
+				testutils.MockVersion("2024_01_01").
+					WithFiles("lxd.tar.xz", "root.squashfs").
+					SetImageConfig(
+						"simplestream:",
+						"  requirements:",
+						"  - requirements:",
+						"      nesting: false",
+					)),
+			Options: []stream.Option{
+				stream.WithRequirementDefaults([]shared.DefinitionSimplestreamRequirements{
+					{
+						DefinitionFilter: shared.DefinitionFilter{Types: []shared.DefinitionFilterType{"vm"}},
+						Requirements:     map[string]string{"secureboot": "false"},
+					},
+					{
+						DefinitionFilter: shared.DefinitionFilter{Types: []shared.DefinitionFilterType{"container"}},
+						Requirements:     map[string]string{"nesting": "true", "privileged": "false"},
+					},
+				}),
+			},
+			IgnoreItems: true,
+			WantProduct: stream.Product{
+				Aliases:      "distro/release/default,distro/release",
+				Distro:       "distro",
+				OS:           "Distro",
+				Release:      "release",
+				ReleaseTitle: "release",
+				Architecture: "arm64",
+				Variant:      "default",
+				Requirements: map[string]string{"nesting": "false", "privileged": "false"},
+				Versions: map[string]stream.Version{
+					"2024_01_01": {Requirements: map[string]string{"nesting": "false", "privileged": "false"}},
+				},
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -573,7 +888,7 @@ func TestGetProduct(t *testing.T) {
 			p := test.Mock
 			p.Create(t, t.TempDir())
 
-			product, err := stream.GetProduct(p.RootDir(), p.RelPath())
+			product, err := stream.GetProduct(context.Background(), p.RootDir(), p.RelPath(), test.Options...)
 			if test.WantErr != nil {
 				assert.ErrorIs(t, err, test.WantErr)
 				return
@@ -582,9 +897,10 @@ func TestGetProduct(t *testing.T) {
 			require.NoError(t, err)
 
 			if test.IgnoreItems {
-				// Remove all items from the resulting product.
-				for id := range product.Versions {
-					product.Versions[id] = stream.Version{}
+				// Remove all items from the resulting product, but
+				// retain the version requirements.
+				for id, v := range product.Versions {
+					product.Versions[id] = stream.Version{Requirements: v.Requirements}
 				}
 			}
 
@@ -679,7 +995,7 @@ func TestGetProducts(t *testing.T) {
 				require.Fail(t, "Test must include at least one mocked product!")
 			}
 
-			products, err := stream.GetProducts(tmpDir, ps[0].StreamName())
+			products, err := stream.GetProducts(context.Background(), tmpDir, ps[0].StreamName())
 			require.NoError(t, err)
 
 			// Ensure expected products are found.
@@ -699,6 +1015,75 @@ func TestGetProducts(t *testing.T) {
 	}
 }
 
+func TestGetProducts_Cancelled(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("01").WithFiles("lxd.tar.xz", "root.squashfs"))
+	p.Create(t, rootDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Ensure traversal and hashing stop once the context is cancelled.
+	_, err := stream.GetProducts(ctx, rootDir, "images", stream.WithHashes(true))
+	require.ErrorIs(t, err, context.Canceled)
+
+	_, err = stream.GetItem(ctx, rootDir, "images/ubuntu/noble/amd64/cloud/01/root.squashfs", stream.WithHashes(true))
+	require.ErrorIs(t, err, context.Canceled)
+
+	// Ensure deadlines are respected.
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	_, err = stream.GetProduct(ctx, rootDir, "images/ubuntu/noble/amd64/cloud")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+func TestGetProducts_UploadGuard(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("01").WithFiles("lxd.tar.xz", "root.squashfs").WithAge(time.Hour),
+		testutils.MockVersion("02").WithFiles("lxd.tar.xz", "root.squashfs"),
+		testutils.MockVersion("03").WithFiles("lxd.tar.xz", "root.squashfs", ".upload-in-progress").WithAge(time.Hour))
+	p.Create(t, rootDir)
+
+	guard := stream.WithUploadGuard(".upload-in-progress", 10*time.Minute)
+
+	// Ensure versions that may still be uploaded are skipped.
+	products, err := stream.GetProducts(context.Background(), rootDir, "images", guard)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"01"}, shared.MapKeys(products["ubuntu:noble:amd64:cloud"].Versions))
+
+	_, err = stream.GetVersion(context.Background(), rootDir, "images/ubuntu/noble/amd64/cloud/02", guard)
+	require.ErrorIs(t, err, stream.ErrVersionIncomplete)
+	require.ErrorContains(t, err, `file "lxd.tar.xz" was modified within 10m0s`)
+
+	_, err = stream.GetVersion(context.Background(), rootDir, "images/ubuntu/noble/amd64/cloud/03", guard)
+	require.ErrorIs(t, err, stream.ErrVersionIncomplete)
+	require.ErrorContains(t, err, `sentinel file ".upload-in-progress" exists`)
+
+	// Ensure recently modified version is included once it is old enough.
+	ctx := clock.WithContext(context.Background(), clock.NewFake(time.Now().Add(time.Hour)))
+
+	products, err = stream.GetProducts(ctx, rootDir, "images", guard)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"01", "02"}, shared.MapKeys(products["ubuntu:noble:amd64:cloud"].Versions))
+
+	// Ensure versions are retrieved if incomplete versions are included.
+	_, err = stream.GetVersion(context.Background(), rootDir, "images/ubuntu/noble/amd64/cloud/03", guard, stream.WithIncompleteVersions(true))
+	require.NoError(t, err)
+
+	// Ensure versions are not skipped without the guard.
+	products, err = stream.GetProducts(context.Background(), rootDir, "images")
+	require.NoError(t, err)
+	require.Len(t, products["ubuntu:noble:amd64:cloud"].Versions, 3)
+}
+
 func TestDoesNotExist(t *testing.T) {
 	t.Parallel()
 
@@ -730,11 +1115,11 @@ func TestDoesNotExist(t *testing.T) {
 
 			switch test.Mock.(type) {
 			case testutils.ItemMock:
-				_, err = stream.GetItem(test.Mock.RootDir(), test.Mock.RelPath())
+				_, err = stream.GetItem(context.Background(), test.Mock.RootDir(), test.Mock.RelPath())
 			case testutils.VersionMock:
-				_, err = stream.GetVersion(test.Mock.RootDir(), test.Mock.RelPath())
+				_, err = stream.GetVersion(context.Background(), test.Mock.RootDir(), test.Mock.RelPath())
 			case testutils.ProductMock:
-				_, err = stream.GetProduct(test.Mock.RootDir(), test.Mock.RelPath())
+				_, err = stream.GetProduct(context.Background(), test.Mock.RootDir(), test.Mock.RelPath())
 			default:
 				require.Fail(t, "Unknown mock type")
 			}
@@ -816,7 +1201,7 @@ func TestReadChecksumFile(t *testing.T) {
 			require.NoError(t, err)
 
 			// Ensure checksums are read correctly.
-			checksums, err := stream.ReadChecksumFile(filePath)
+			checksums, err := stream.ReadChecksumFile(context.Background(), filePath)
 			require.NoError(t, err)
 			require.Equal(t, test.Expect, checksums)
 		})
@@ -880,3 +1265,109 @@ func TestCreateAliases(t *testing.T) {
 		})
 	}
 }
+
+func TestVersionSameContent(t *testing.T) {
+	t.Parallel()
+
+	version := func(items map[string]string) stream.Version {
+		v := stream.Version{Items: make(map[string]stream.Item)}
+		for name, hash := range items {
+			v.Items[name] = stream.Item{Ftype: name, SHA256: hash}
+		}
+
+		return v
+	}
+
+	base := version(map[string]string{"lxd.tar.xz": "a", "squashfs": "b"})
+
+	require.True(t, base.SameContent(version(map[string]string{"lxd.tar.xz": "a", "squashfs": "b"})))
+	require.True(t, base.SameContent(version(map[string]string{"lxd.tar.xz": "a", "squashfs": "b", "squashfs.vcdiff": "c"})))
+	require.False(t, base.SameContent(version(map[string]string{"lxd.tar.xz": "a", "squashfs": "c"})))
+	require.False(t, base.SameContent(version(map[string]string{"lxd.tar.xz": "a"})))
+	require.False(t, base.SameContent(version(map[string]string{"lxd.tar.xz": "a", "squashfs": "b", "disk-kvm.img": "d"})))
+	require.False(t, version(nil).SameContent(version(nil)))
+}
+
+func TestProductIsEOL(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		Name    string
+		Product stream.Product
+		WantEOL bool
+	}{
+		{
+			Name:    "No lifecycle information",
+			Product: stream.Product{},
+		},
+		{
+			Name:    "End-of-life date in the future",
+			Product: stream.Product{ReleaseEOL: "2029-05-31"},
+		},
+		{
+			Name:    "End-of-life date in the past",
+			Product: stream.Product{ReleaseEOL: "2025-05-31"},
+			WantEOL: true,
+		},
+		{
+			Name:    "End-of-life date is today",
+			Product: stream.Product{ReleaseEOL: "2025-06-01"},
+			WantEOL: true,
+		},
+		{
+			Name:    "Lifecycle stage is EOL",
+			Product: stream.Product{ReleaseEOL: "2029-05-31", Lifecycle: "EOL"},
+			WantEOL: true,
+		},
+		{
+			Name:    "Invalid end-of-life date",
+			Product: stream.Product{ReleaseEOL: "invalid"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			require.Equal(t, test.WantEOL, test.Product.IsEOL(now))
+		})
+	}
+}
+
+func BenchmarkGetProducts(b *testing.B) {
+	rootDir := b.TempDir()
+
+	// Synthetic tree of 50 products with 5 versions each.
+	for i := range 50 {
+		p := testutils.MockProduct(fmt.Sprintf("images/ubuntu/release%02d/amd64/cloud", i))
+
+		for j := range 5 {
+			seed := int64(i*10 + j)
+			p = p.AddVersions(testutils.MockVersion(fmt.Sprintf("2024_01_%02d", j+1)).AddItems(
+				testutils.MockItem("lxd.tar.xz").WithGeneratedContent(seed, 4<<10),
+				testutils.MockItem("root.squashfs").WithGeneratedContent(seed, 64<<10),
+				testutils.MockItem("disk.qcow2").WithGeneratedContent(seed, 64<<10),
+			))
+		}
+
+		p.Create(b, rootDir)
+	}
+
+	b.Run("without hashes", func(b *testing.B) {
+		for range b.N {
+			_, err := stream.GetProducts(context.Background(), rootDir, "images")
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("with hashes", func(b *testing.B) {
+		for range b.N {
+			_, err := stream.GetProducts(context.Background(), rootDir, "images", stream.WithHashes(true))
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
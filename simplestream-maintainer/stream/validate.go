@@ -0,0 +1,295 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// ErrInvalid indicates that the stream index, product catalog, or any of its
+// products, versions, or items are invalid.
+var ErrInvalid = errors.New("Invalid stream content")
+
+// sha256Regex matches lowercase hex encoded SHA256 hash.
+var sha256Regex = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// sha512Regex matches lowercase hex encoded SHA512 hash.
+var sha512Regex = regexp.MustCompile("^[0-9a-f]{128}$")
+
+// invalidf returns an error wrapping ErrInvalid with the given message.
+func invalidf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalid, fmt.Sprintf(format, args...))
+}
+
+// validateName ensures that the name is non-empty and usable as a single
+// path element.
+func validateName(field string, name string) error {
+	if name == "" {
+		return invalidf("%s is required", field)
+	}
+
+	if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return invalidf("%s %q is not a valid path element", field, name)
+	}
+
+	return nil
+}
+
+// validateRelPath ensures that the path is a clean relative path that does
+// not escape the root directory.
+func validateRelPath(field string, p string) error {
+	if p == "" {
+		return invalidf("%s is required", field)
+	}
+
+	if path.IsAbs(p) || path.Clean(p) != p || p == ".." || strings.HasPrefix(p, "../") {
+		return invalidf("%s %q is not a clean relative path", field, p)
+	}
+
+	return nil
+}
+
+// validateHash ensures that the non-empty hash matches the given regex.
+func validateHash(field string, hash string, regex *regexp.Regexp) error {
+	if hash != "" && !regex.MatchString(hash) {
+		return invalidf("%s %q is not a valid hash", field, hash)
+	}
+
+	return nil
+}
+
+// Validate ensures the stream index entries contain all required fields and
+// reference product catalogs using valid paths.
+func (i StreamIndex) Validate() error {
+	if i.Format != "index:1.0" {
+		return invalidf("Unsupported index format %q", i.Format)
+	}
+
+	var errs []error
+
+	for name, entry := range i.Index {
+		err := entry.Validate()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Index entry %q: %w", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate ensures the index entry contains all required fields.
+func (e StreamIndexEntry) Validate() error {
+	err := validateRelPath("Path", e.Path)
+	if err != nil {
+		return err
+	}
+
+	if e.Format != "products:1.0" {
+		return invalidf("Unsupported format %q", e.Format)
+	}
+
+	if e.Datatype == "" {
+		return invalidf("Datatype is required")
+	}
+
+	for _, id := range e.Products {
+		if id == "" {
+			return invalidf("Product ID cannot be empty")
+		}
+	}
+
+	return nil
+}
+
+// Validate ensures the product catalog contains all required fields and that
+// all of its products are valid.
+func (c ProductCatalog) Validate() error {
+	if c.ContentID == "" {
+		return invalidf("Content ID is required")
+	}
+
+	if c.Format != "products:1.0" {
+		return invalidf("Unsupported catalog format %q", c.Format)
+	}
+
+	if c.DataType == "" {
+		return invalidf("Datatype is required")
+	}
+
+	var errs []error
+
+	ids := shared.MapKeys(c.Products)
+	slices.Sort(ids)
+
+	for _, id := range ids {
+		p := c.Products[id]
+
+		if p.ID() != id {
+			errs = append(errs, fmt.Errorf("Product %q: %w", id, invalidf("ID does not match the product ID %q", p.ID())))
+			continue
+		}
+
+		err := p.Validate()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Product %q: %w", id, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate ensures the product contains all required fields and that all of
+// its versions are valid.
+func (p Product) Validate() error {
+	fields := []struct {
+		name  string
+		value string
+	}{
+		{name: "Distro", value: p.Distro},
+		{name: "Release", value: p.Release},
+		{name: "Architecture", value: p.Architecture},
+		{name: "Variant", value: p.Variant},
+	}
+
+	for _, f := range fields {
+		err := validateName(f.name, f.value)
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.ReleaseEOL != "" {
+		_, err := time.Parse(ReleaseEOLFormat, p.ReleaseEOL)
+		if err != nil {
+			return invalidf("Release end-of-life date %q is not in format YYYY-MM-DD", p.ReleaseEOL)
+		}
+	}
+
+	var errs []error
+
+	names := shared.MapKeys(p.Versions)
+	slices.Sort(names)
+
+	for _, name := range names {
+		err := validateName("Version name", name)
+		if err == nil {
+			err = p.Versions[name].validate(p, name)
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Version %q: %w", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validate ensures the version items are valid. The path of each item must
+// be located in the version directory of the given product, and delta items
+// must reference an older version.
+func (v Version) validate(p Product, versionName string) error {
+	names := shared.MapKeys(v.Items)
+	slices.Sort(names)
+
+	for _, name := range names {
+		item := v.Items[name]
+
+		err := item.Validate()
+		if err != nil {
+			return fmt.Errorf("Item %q: %w", name, err)
+		}
+
+		versionDir := path.Dir(item.Path)
+		if path.Base(item.Path) != name || path.Base(versionDir) != versionName || !isProductDir(path.Dir(versionDir), p) {
+			return fmt.Errorf("Item %q: %w", name, invalidf("Path %q does not match the item location", item.Path))
+		}
+
+		if item.DeltaBase != "" && item.DeltaBase >= versionName {
+			return fmt.Errorf("Item %q: %w", name, invalidf("Delta base %q is not older than the version", item.DeltaBase))
+		}
+	}
+
+	return nil
+}
+
+// isProductDir returns true if the last segments of the given directory are
+// the product's distro, release, architecture, and variant. Segments may be
+// in any order to allow custom path schemas.
+func isProductDir(dir string, p Product) bool {
+	want := []string{p.Distro, p.Release, p.Architecture, p.Variant}
+
+	segments := strings.Split(dir, "/")
+	if len(segments) < len(want) {
+		return false
+	}
+
+	got := slices.Clone(segments[len(segments)-len(want):])
+
+	slices.Sort(want)
+	slices.Sort(got)
+
+	return slices.Equal(want, got)
+}
+
+// Validate ensures the item contains all required fields, a valid path, and
+// correctly formatted hashes.
+func (i Item) Validate() error {
+	if i.Ftype == "" {
+		return invalidf("Ftype is required")
+	}
+
+	err := validateRelPath("Path", i.Path)
+	if err != nil {
+		return err
+	}
+
+	if i.Size < 0 {
+		return invalidf("Size cannot be negative")
+	}
+
+	if i.InstalledSize < 0 {
+		return invalidf("Installed size cannot be negative")
+	}
+
+	if i.VirtualSize < 0 {
+		return invalidf("Virtual size cannot be negative")
+	}
+
+	hashes := []struct {
+		name  string
+		value string
+		regex *regexp.Regexp
+	}{
+		{name: "SHA256", value: i.SHA256, regex: sha256Regex},
+		{name: "SHA512", value: i.SHA512, regex: sha512Regex},
+		{name: "Combined disk-kvm.img SHA256", value: i.CombinedSHA256DiskKvmImg, regex: sha256Regex},
+		{name: "Combined disk1.img SHA256", value: i.CombinedSHA256DiskImg, regex: sha256Regex},
+		{name: "Combined squashfs SHA256", value: i.CombinedSHA256SquashFs, regex: sha256Regex},
+		{name: "Combined rootxz SHA256", value: i.CombinedSHA256RootXz, regex: sha256Regex},
+	}
+
+	for _, h := range hashes {
+		err := validateHash(h.name, h.value, h.regex)
+		if err != nil {
+			return err
+		}
+	}
+
+	isDelta := i.Ftype == ItemTypeDiskKVMDelta || i.Ftype == ItemTypeDiskRawDelta || i.Ftype == ItemTypeSquashfsDelta
+	if isDelta {
+		err := validateName("Delta base", i.DeltaBase)
+		if err != nil {
+			return err
+		}
+	} else if i.DeltaBase != "" {
+		return invalidf("Delta base is set for non-delta item type %q", i.Ftype)
+	}
+
+	return nil
+}
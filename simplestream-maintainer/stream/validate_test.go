@@ -0,0 +1,161 @@
+package stream_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/testutils"
+)
+
+func TestProductCatalogValidate(t *testing.T) {
+	t.Parallel()
+
+	// validProduct returns a new valid product with a single version.
+	validProduct := func() stream.Product {
+		return stream.Product{
+			Distro:       "ubuntu",
+			Release:      "noble",
+			Architecture: "amd64",
+			Variant:      "cloud",
+			Versions: map[string]stream.Version{
+				"20240102": {
+					Items: map[string]stream.Item{
+						"disk.qcow2": {
+							Ftype:  stream.ItemTypeDiskKVM,
+							Path:   "images/ubuntu/noble/amd64/cloud/20240102/disk.qcow2",
+							SHA256: testutils.ItemDefaultContentSHA,
+						},
+						"disk.20240101.qcow2.vcdiff": {
+							Ftype:     stream.ItemTypeDiskKVMDelta,
+							Path:      "images/ubuntu/noble/amd64/cloud/20240102/disk.20240101.qcow2.vcdiff",
+							DeltaBase: "20240101",
+						},
+					},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		Name    string
+		Modify  func(c *stream.ProductCatalog)
+		WantErr bool
+	}{
+		{
+			Name:   "Valid catalog",
+			Modify: func(c *stream.ProductCatalog) {},
+		},
+		{
+			Name:    "Missing content ID",
+			Modify:  func(c *stream.ProductCatalog) { c.ContentID = "" },
+			WantErr: true,
+		},
+		{
+			Name:    "Unsupported format",
+			Modify:  func(c *stream.ProductCatalog) { c.Format = "products:2.0" },
+			WantErr: true,
+		},
+		{
+			Name: "Product ID mismatch",
+			Modify: func(c *stream.ProductCatalog) {
+				c.Products["ubuntu:noble:arm64:cloud"] = c.Products["ubuntu:noble:amd64:cloud"]
+			},
+			WantErr: true,
+		},
+		{
+			Name: "Invalid product variant",
+			Modify: func(c *stream.ProductCatalog) {
+				p := validProduct()
+				p.Variant = "../cloud"
+				c.Products = map[string]stream.Product{p.ID(): p}
+			},
+			WantErr: true,
+		},
+		{
+			Name: "Invalid release end-of-life date",
+			Modify: func(c *stream.ProductCatalog) {
+				p := validProduct()
+				p.ReleaseEOL = "31/05/2029"
+				c.Products = map[string]stream.Product{p.ID(): p}
+			},
+			WantErr: true,
+		},
+		{
+			Name: "Invalid item hash",
+			Modify: func(c *stream.ProductCatalog) {
+				item := c.Products["ubuntu:noble:amd64:cloud"].Versions["20240102"].Items["disk.qcow2"]
+				item.SHA256 = "ABC"
+				c.Products["ubuntu:noble:amd64:cloud"].Versions["20240102"].Items["disk.qcow2"] = item
+			},
+			WantErr: true,
+		},
+		{
+			Name: "Item path escapes root directory",
+			Modify: func(c *stream.ProductCatalog) {
+				item := c.Products["ubuntu:noble:amd64:cloud"].Versions["20240102"].Items["disk.qcow2"]
+				item.Path = "../ubuntu/noble/amd64/cloud/20240102/disk.qcow2"
+				c.Products["ubuntu:noble:amd64:cloud"].Versions["20240102"].Items["disk.qcow2"] = item
+			},
+			WantErr: true,
+		},
+		{
+			Name: "Item path does not match its location",
+			Modify: func(c *stream.ProductCatalog) {
+				item := c.Products["ubuntu:noble:amd64:cloud"].Versions["20240102"].Items["disk.qcow2"]
+				item.Path = "images/ubuntu/noble/amd64/cloud/20240101/disk.qcow2"
+				c.Products["ubuntu:noble:amd64:cloud"].Versions["20240102"].Items["disk.qcow2"] = item
+			},
+			WantErr: true,
+		},
+		{
+			Name: "Delta base is newer than the version",
+			Modify: func(c *stream.ProductCatalog) {
+				item := c.Products["ubuntu:noble:amd64:cloud"].Versions["20240102"].Items["disk.20240101.qcow2.vcdiff"]
+				item.DeltaBase = "20240103"
+				c.Products["ubuntu:noble:amd64:cloud"].Versions["20240102"].Items["disk.20240101.qcow2.vcdiff"] = item
+			},
+			WantErr: true,
+		},
+		{
+			Name: "Delta base is missing",
+			Modify: func(c *stream.ProductCatalog) {
+				item := c.Products["ubuntu:noble:amd64:cloud"].Versions["20240102"].Items["disk.20240101.qcow2.vcdiff"]
+				item.DeltaBase = ""
+				c.Products["ubuntu:noble:amd64:cloud"].Versions["20240102"].Items["disk.20240101.qcow2.vcdiff"] = item
+			},
+			WantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			p := validProduct()
+			catalog := stream.NewCatalog("images", map[string]stream.Product{p.ID(): p})
+			test.Modify(catalog)
+
+			err := catalog.Validate()
+			if test.WantErr {
+				require.ErrorIs(t, err, stream.ErrInvalid)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestStreamIndexValidate(t *testing.T) {
+	t.Parallel()
+
+	index := stream.NewStreamIndex()
+	index.AddEntry("images", "streams/v1/images.json", *stream.NewCatalog("images", nil))
+	require.NoError(t, index.Validate())
+
+	index.AddEntry("images", "/streams/v1/images.json", *stream.NewCatalog("images", nil))
+	require.ErrorIs(t, index.Validate(), stream.ErrInvalid)
+
+	index = stream.NewStreamIndex()
+	index.Format = "index:2.0"
+	require.ErrorIs(t, index.Validate(), stream.ErrInvalid)
+}
@@ -0,0 +1,136 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+)
+
+// CatalogWriter writes a product catalog in JSON format one product at a time.
+// This allows encoding large product catalogs without keeping all products in
+// memory. The produced output matches the output of json.Encoder configured
+// with two space indentation.
+type CatalogWriter struct {
+	w      io.Writer
+	lastID string
+	count  int
+	closed bool
+}
+
+// NewCatalogWriter creates a new catalog writer and writes the catalog header
+// (all fields except products) to the given writer. Products of the given
+// catalog are ignored and need to be written using WriteProduct.
+func NewCatalogWriter(w io.Writer, catalog ProductCatalog) (*CatalogWriter, error) {
+	fields := []struct {
+		key   string
+		value string
+	}{
+		{key: "content_id", value: catalog.ContentID},
+		{key: "format", value: catalog.Format},
+		{key: "datatype", value: catalog.DataType},
+	}
+
+	_, err := io.WriteString(w, "{\n")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range fields {
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = fmt.Fprintf(w, "  %q: %s,\n", f.key, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = io.WriteString(w, `  "products": {`)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CatalogWriter{w: w}, nil
+}
+
+// WriteProduct encodes the given product and writes it to the catalog. Products
+// must be written in ascending order of their IDs to ensure the output is equal
+// to the one of an encoded product map.
+func (cw *CatalogWriter) WriteProduct(id string, product Product) error {
+	if cw.closed {
+		return fmt.Errorf("Catalog writer is closed")
+	}
+
+	if cw.count > 0 && id <= cw.lastID {
+		return fmt.Errorf("Product %q must be written before product %q", id, cw.lastID)
+	}
+
+	key, err := json.Marshal(id)
+	if err != nil {
+		return err
+	}
+
+	value, err := json.MarshalIndent(product, "    ", "  ")
+	if err != nil {
+		return err
+	}
+
+	separator := "\n"
+	if cw.count > 0 {
+		separator = ",\n"
+	}
+
+	_, err = fmt.Fprintf(cw.w, "%s    %s: %s", separator, key, value)
+	if err != nil {
+		return err
+	}
+
+	cw.lastID = id
+	cw.count++
+	return nil
+}
+
+// Close writes the end of the catalog. It does not close the underlying writer.
+func (cw *CatalogWriter) Close() error {
+	if cw.closed {
+		return nil
+	}
+
+	cw.closed = true
+
+	end := "}\n}\n"
+	if cw.count > 0 {
+		end = "\n  }\n}\n"
+	}
+
+	_, err := io.WriteString(cw.w, end)
+	return err
+}
+
+// WriteCatalog writes the product catalog to the given writer one product at
+// a time, in ascending order of product IDs. The output is equal to the one
+// of json.Encoder configured with two space indentation, however, only a
+// single product is encoded in memory at once.
+func WriteCatalog(w io.Writer, catalog ProductCatalog) error {
+	writer, err := NewCatalogWriter(w, catalog)
+	if err != nil {
+		return err
+	}
+
+	ids := shared.MapKeys(catalog.Products)
+	slices.Sort(ids)
+
+	for _, id := range ids {
+		err := writer.WriteProduct(id, catalog.Products[id])
+		if err != nil {
+			return err
+		}
+	}
+
+	return writer.Close()
+}
@@ -0,0 +1,126 @@
+package stream_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+func TestCatalogWriter(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		Name     string
+		Products map[string]stream.Product
+	}{
+		{
+			Name:     "Empty catalog",
+			Products: map[string]stream.Product{},
+		},
+		{
+			Name: "Single product",
+			Products: map[string]stream.Product{
+				"ubuntu:noble:amd64:cloud": {
+					Distro:       "ubuntu",
+					Release:      "noble",
+					Architecture: "amd64",
+					Variant:      "cloud",
+					Requirements: map[string]string{},
+					Versions: map[string]stream.Version{
+						"20240101_0000": {
+							Items: map[string]stream.Item{
+								"lxd.tar.xz": {Ftype: "lxd.tar.xz", Path: "images/lxd.tar.xz", Size: 12},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			Name: "Multiple products",
+			Products: map[string]stream.Product{
+				"ubuntu:noble:amd64:cloud":   {Distro: "ubuntu", Release: "noble", Aliases: "ubuntu/noble/cloud"},
+				"alpine:edge:arm64:default":  {Distro: "alpine", Release: "edge", Aliases: "alpine/edge,alpine/edge/default"},
+				"debian:bookworm:amd64:<&>":  {Distro: "debian", Release: "bookworm", Variant: "<&>"},
+				"ubuntu:noble:amd64:desktop": {Distro: "ubuntu", Release: "noble"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			catalog := stream.NewCatalog("images", test.Products)
+
+			// Encode the catalog as a whole.
+			want := &bytes.Buffer{}
+			encoder := json.NewEncoder(want)
+			encoder.SetIndent("", "  ")
+			err := encoder.Encode(catalog)
+			require.NoError(t, err)
+
+			// Encode the catalog one product at a time.
+			got := &bytes.Buffer{}
+			writer, err := stream.NewCatalogWriter(got, *catalog)
+			require.NoError(t, err)
+
+			ids := shared.MapKeys(test.Products)
+			slices.Sort(ids)
+
+			for _, id := range ids {
+				err := writer.WriteProduct(id, test.Products[id])
+				require.NoError(t, err)
+			}
+
+			err = writer.Close()
+			require.NoError(t, err)
+
+			require.Equal(t, want.String(), got.String())
+		})
+	}
+}
+
+func TestCatalogWriter_Order(t *testing.T) {
+	t.Parallel()
+
+	writer, err := stream.NewCatalogWriter(&bytes.Buffer{}, *stream.NewCatalog("images", nil))
+	require.NoError(t, err)
+
+	err = writer.WriteProduct("b", stream.Product{})
+	require.NoError(t, err)
+
+	// Ensure products written out of order are rejected.
+	err = writer.WriteProduct("a", stream.Product{})
+	require.Error(t, err)
+
+	// Ensure duplicate products are rejected.
+	err = writer.WriteProduct("b", stream.Product{})
+	require.Error(t, err)
+}
+
+func TestWriteCatalog(t *testing.T) {
+	t.Parallel()
+
+	catalog := stream.NewCatalog("images", map[string]stream.Product{
+		"ubuntu:noble:amd64:cloud": {Distro: "ubuntu", Release: "noble"},
+		"alpine:edge:arm64:cloud":  {Distro: "alpine", Release: "edge"},
+	})
+
+	path := filepath.Join(t.TempDir(), "images.json")
+	require.NoError(t, shared.WriteJSONFile(path, catalog))
+
+	want, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	// Ensure the output equals the one of the encoded catalog.
+	got := &bytes.Buffer{}
+	require.NoError(t, stream.WriteCatalog(got, *catalog))
+	require.Equal(t, string(want), got.String())
+}
@@ -0,0 +1,101 @@
+// Package systemd notifies the service manager about the state of the
+// service (readiness, shutdown, and watchdog keep-alives), which allows
+// running long-lived commands as services of type "notify".
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// States sent to the service manager.
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// Status returns the state that sets the free-form status of the service
+// shown by the service manager.
+func Status(status string) string {
+	return "STATUS=" + status
+}
+
+// Notify sends the given states to the service manager over the socket set by
+// the NOTIFY_SOCKET environment variable. If the variable is not set, the
+// process is not run by the service manager (or is not expected to notify
+// it), and nothing is sent.
+func Notify(states ...string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// Socket in the abstract namespace is prefixed with "@".
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("Failed to connect to the notify socket: %w", err)
+	}
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(strings.Join(states, "\n")))
+	if err != nil {
+		return fmt.Errorf("Failed to notify the service manager: %w", err)
+	}
+
+	return nil
+}
+
+// WatchdogInterval returns the interval within which the service manager
+// expects the watchdog keep-alives, as set by the WATCHDOG_USEC environment
+// variable. Zero is returned if the watchdog is not enabled for this process.
+func WatchdogInterval() time.Duration {
+	pid := os.Getenv("WATCHDOG_PID")
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// RunWatchdog sends the watchdog keep-alives at half of the watchdog interval
+// until the context is cancelled. It returns immediately if the watchdog is
+// not enabled.
+func RunWatchdog(ctx context.Context) {
+	interval := WatchdogInterval()
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			err := Notify(Watchdog)
+			if err != nil {
+				slog.Warn("Failed to send watchdog keep-alive", "error", err)
+			}
+		}
+	}
+}
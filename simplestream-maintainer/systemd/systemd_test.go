@@ -0,0 +1,98 @@
+package systemd_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/systemd"
+)
+
+// listenNotifySocket creates the notify socket and points NOTIFY_SOCKET to it.
+func listenNotifySocket(t *testing.T) *net.UnixConn {
+	t.Helper()
+
+	socket := filepath.Join(t.TempDir(), "notify.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	t.Setenv("NOTIFY_SOCKET", socket)
+
+	return conn
+}
+
+// readState reads a single message sent to the notify socket.
+func readState(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+
+	return string(buf[:n])
+}
+
+func TestNotify(t *testing.T) {
+	// Ensure nothing is sent if the socket is not set.
+	t.Setenv("NOTIFY_SOCKET", "")
+	require.NoError(t, systemd.Notify(systemd.Ready))
+
+	conn := listenNotifySocket(t)
+
+	err := systemd.Notify(systemd.Ready, systemd.Status("Serving"))
+	require.NoError(t, err)
+	require.Equal(t, "READY=1\nSTATUS=Serving", readState(t, conn))
+
+	err = systemd.Notify(systemd.Stopping)
+	require.NoError(t, err)
+	require.Equal(t, "STOPPING=1", readState(t, conn))
+
+	// Ensure missing socket is reported.
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing.sock"))
+	require.Error(t, systemd.Notify(systemd.Ready))
+}
+
+func TestWatchdog(t *testing.T) {
+	conn := listenNotifySocket(t)
+
+	// Ensure watchdog is disabled if not set or set for another process.
+	t.Setenv("WATCHDOG_USEC", "")
+	require.Zero(t, systemd.WatchdogInterval())
+
+	t.Setenv("WATCHDOG_USEC", "100000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	require.Zero(t, systemd.WatchdogInterval())
+
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	require.Equal(t, 100*time.Millisecond, systemd.WatchdogInterval())
+
+	// Ensure keep-alives are sent until the context is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		systemd.RunWatchdog(ctx)
+	}()
+
+	require.Equal(t, "WATCHDOG=1", readState(t, conn))
+	require.Equal(t, "WATCHDOG=1", readState(t, conn))
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watchdog did not stop")
+	}
+}
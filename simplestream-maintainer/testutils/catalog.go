@@ -0,0 +1,54 @@
+package testutils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+)
+
+// BuildCatalog returns the product catalog of the given stream built from the
+// directory structure within the root directory. Unlike the catalog created
+// by ProductMock.AddProductCatalog, items include their hashes, as they do in
+// the catalog built by the build command. Delta files are not generated.
+func BuildCatalog(t testing.TB, rootDir string, streamName string, options ...stream.Option) *stream.ProductCatalog {
+	options = append([]stream.Option{stream.WithHashes(true)}, options...)
+
+	products, err := stream.GetProducts(context.Background(), rootDir, streamName, options...)
+	require.NoError(t, err, "Failed to read products of stream %q", streamName)
+
+	return stream.NewCatalog(streamName, products)
+}
+
+// WriteCatalogs writes the given product catalogs and the index that
+// references them into the directory "streams/<streamVersion>" within the
+// root directory. Content ID of each catalog is used as its stream name.
+// The written index is returned.
+func WriteCatalogs(t testing.TB, rootDir string, streamVersion string, catalogs ...*stream.ProductCatalog) stream.StreamIndex {
+	metaDir := filepath.Join(rootDir, "streams", streamVersion)
+
+	err := os.MkdirAll(metaDir, os.ModePerm)
+	require.NoError(t, err)
+
+	index := stream.NewStreamIndex()
+
+	for _, catalog := range catalogs {
+		catalogName := fmt.Sprintf("%s.json", catalog.ContentID)
+
+		err := shared.WriteJSONFile(filepath.Join(metaDir, catalogName), catalog)
+		require.NoError(t, err, "Failed to write product catalog %q", catalogName)
+
+		index.AddEntry(catalog.ContentID, filepath.ToSlash(filepath.Join("streams", streamVersion, catalogName)), *catalog)
+	}
+
+	err = shared.WriteJSONFile(filepath.Join(metaDir, "index.json"), index)
+	require.NoError(t, err, "Failed to write index")
+
+	return index
+}
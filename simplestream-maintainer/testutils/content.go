@@ -0,0 +1,26 @@
+package testutils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+)
+
+// GenerateContent returns pseudo-random content of the given size. The same
+// seed always produces the same content, which allows asserting the hashes of
+// the generated files. Contents generated using different seeds differ, which
+// is useful for creating versions whose delta files are not empty.
+func GenerateContent(seed int64, size int) []byte {
+	content := make([]byte, size)
+
+	r := rand.New(rand.NewSource(seed))
+	_, _ = r.Read(content)
+
+	return content
+}
+
+// ContentSHA256 returns the hex encoded SHA256 hash of the given content.
+func ContentSHA256(content []byte) string {
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,248 @@
+package testutils
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// FakeS3 is a minimal in-memory implementation of the S3 API, that supports
+// only path-style requests to a single bucket. Requests must be signed using
+// the access key "access".
+type FakeS3 struct {
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string]fakeObject
+}
+
+type fakeObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewFakeS3 returns a new fake S3 server for the given bucket.
+func NewFakeS3(bucket string) *FakeS3 {
+	return &FakeS3{
+		bucket:  bucket,
+		objects: make(map[string]fakeObject),
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (s *FakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Accept requests signed either using the authorization header or
+	// using the query parameters of the pre-signed URL.
+	signed := strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/")
+	presigned := r.Method == http.MethodGet && strings.HasPrefix(r.URL.Query().Get("X-Amz-Credential"), "access/") && r.URL.Query().Get("X-Amz-Signature") != ""
+
+	if !signed && !presigned {
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.bucket {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		s.list(w, r)
+
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		o, ok := s.objects[key]
+		if !ok {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Last-Modified", o.modTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", fmt.Sprint(len(o.data)))
+		_, _ = w.Write(o.data)
+
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		_, srcKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+
+		o, ok := s.objects[srcKey]
+		if !ok {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+
+		s.objects[key] = fakeObject{data: o.data, modTime: time.Now()}
+		_, _ = w.Write([]byte("<CopyObjectResult></CopyObjectResult>"))
+
+	case r.Method == http.MethodPut:
+		if r.ContentLength < 0 {
+			http.Error(w, "", http.StatusLengthRequired)
+			return
+		}
+
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		s.objects[key] = fakeObject{data: data, modTime: time.Now()}
+
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
+
+// list implements ListObjectsV2, returning at most 2 keys per page to
+// exercise pagination.
+func (s *FakeS3) list(w http.ResponseWriter, r *http.Request) {
+	type content struct {
+		Key          string
+		LastModified time.Time
+		Size         int
+	}
+
+	type commonPrefix struct {
+		Prefix string
+	}
+
+	var result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		IsTruncated           bool
+		NextContinuationToken string
+		Contents              []content
+		CommonPrefixes        []commonPrefix
+	}
+
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	token := query.Get("continuation-token")
+
+	keys := make([]string, 0, len(s.objects))
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+
+	slices.Sort(keys)
+
+	var entries []string
+	for _, k := range keys {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+
+		if delimiter != "" {
+			i := strings.Index(k[len(prefix):], delimiter)
+			if i >= 0 {
+				k = k[:len(prefix)+i+1]
+			}
+		}
+
+		if k <= token || (len(entries) > 0 && entries[len(entries)-1] == k) {
+			continue
+		}
+
+		entries = append(entries, k)
+	}
+
+	if len(entries) > 2 {
+		entries = entries[:2]
+		result.IsTruncated = true
+		result.NextContinuationToken = entries[1]
+	}
+
+	for _, k := range entries {
+		if strings.HasSuffix(k, delimiter) && delimiter != "" {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: k})
+		} else {
+			result.Contents = append(result.Contents, content{Key: k, LastModified: s.objects[k].modTime, Size: len(s.objects[k].data)})
+		}
+	}
+
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+// UploadDir uploads files within the local directory to the bucket, using
+// their paths relative to the directory prefixed with the given prefix as
+// object keys. Modification times of the files are preserved.
+func (s *FakeS3) UploadDir(t *testing.T, dir string, prefix string) {
+	t.Helper()
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		s.objects[strings.TrimPrefix(prefix+"/"+filepath.ToSlash(relPath), "/")] = fakeObject{data: data, modTime: info.ModTime()}
+		s.mu.Unlock()
+
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// Keys returns the sorted keys of all objects in the bucket.
+func (s *FakeS3) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.objects))
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+
+	slices.Sort(keys)
+
+	return keys
+}
+
+// Object returns the content of the object with the given key.
+func (s *FakeS3) Object(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.objects[key]
+	return o.data, ok
+}
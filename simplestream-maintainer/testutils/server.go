@@ -0,0 +1,24 @@
+package testutils
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/server"
+)
+
+// NewMockServer starts an HTTP server that serves the simplestream content
+// from the given root directory in the same way as the serve command. The
+// server is closed once the test finishes. Clients can reach it on the
+// returned server's URL.
+func NewMockServer(t *testing.T, rootDir string, options ...server.Option) *httptest.Server {
+	s, err := server.NewServer(rootDir, options...)
+	require.NoError(t, err, "Failed to create simplestream server")
+
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	return ts
+}
@@ -1,6 +1,15 @@
+// Package testutils provides helpers for testing against the simplestream
+// content produced by the simplestream-maintainer. Mocks create product
+// directory structures on disk, catalog helpers build and write product
+// catalogs and the index, content generators produce deterministic item
+// files, and mock servers serve the resulting content over HTTP.
+//
+// The helpers are part of the public API and may be used by other projects
+// to test their integration with the simplestream-maintainer.
 package testutils
 
 import (
+	"context"
 	"fmt"
 	"io/fs"
 	"os"
@@ -21,12 +30,23 @@ const (
 
 	// ItemDefaultContentSHA is the SHA256 hash of the default item content.
 	ItemDefaultContentSHA = "0a3666a0710c08aa6d0de92ce72beeb5b93124cce1bf3701c9d6cdeb543cb73e"
+
+	// ItemDefaultContentSHA512 is the SHA512 hash of the default item content.
+	ItemDefaultContentSHA512 = "0cdf868929505ba14dad2faad98ea8fb19497641014ed4a6bf2b90b95c96c14c686c4f2950162bfea2a7c8b8da7647fa09047f3edb2785e51ad610e55464d609"
+
+	// ItemDefaultContentBLAKE2b is the BLAKE2b-512 hash of the default item content.
+	ItemDefaultContentBLAKE2b = "74f6a71f421f65344ed39f1f88d730d62b59b834b7a24616983633b2cc68a4a1e70e9b1553d6378fca57fe062c364e1dc441bb33dcdc750906a9c2731656778c"
 )
 
 // Mock is an interface for all mock types.
 type Mock interface {
+	// RootDir returns the directory in which the mock is created.
 	RootDir() string
+
+	// RelPath returns the path of the mock relative to its root directory.
 	RelPath() string
+
+	// AbsPath returns the absolute path of the mock.
 	AbsPath() string
 }
 
@@ -36,19 +56,23 @@ type common struct {
 	relPath string
 }
 
+// RootDir returns the directory in which the mock is created. It is empty
+// until the mock is created.
 func (c common) RootDir() string {
 	return c.rootDir
 }
 
+// RelPath returns the path of the mock relative to its root directory.
 func (c common) RelPath() string {
 	return c.relPath
 }
 
+// AbsPath returns the absolute path of the mock.
 func (c common) AbsPath() string {
 	return filepath.Join(c.rootDir, c.relPath)
 }
 
-func (c *common) setRootDir(t *testing.T, rootDir string) {
+func (c *common) setRootDir(t testing.TB, rootDir string) {
 	// Validation to prevent common issues during development.
 	require.NotEmpty(t, rootDir, "Attempt to set an empty root dir for a mock!")
 	if c.rootDir != "" && c.rootDir != rootDir {
@@ -120,7 +144,7 @@ func (p ProductMock) SetFilesAge(age time.Duration) ProductMock {
 
 // Create creates the mocked product directory structure in the given directory.
 // According to the mock's configuration, product catalog and config are created.
-func (p *ProductMock) Create(t *testing.T, rootDir string) ProductMock {
+func (p *ProductMock) Create(t testing.TB, rootDir string) ProductMock {
 	p.setRootDir(t, rootDir)
 
 	// Ensure product dir exists.
@@ -165,6 +189,9 @@ type VersionMock struct {
 	// Version checksums file content.
 	checksums string
 
+	// Version checksums file name.
+	checksumsFile string
+
 	// Image config.
 	imageConfig string
 
@@ -204,6 +231,14 @@ func (v VersionMock) SetChecksums(entries ...string) VersionMock {
 	return v
 }
 
+// SetChecksumsFile is like SetChecksums, except that the entries are written
+// to the checksum file with the given name (e.g. SHA512SUMS).
+func (v VersionMock) SetChecksumsFile(fileName string, entries ...string) VersionMock {
+	v = v.SetChecksums(entries...)
+	v.checksumsFile = fileName
+	return v
+}
+
 // SetImageConfig sets image config with the given content that is written
 // when a product version is created.
 func (v VersionMock) SetImageConfig(lines ...string) VersionMock {
@@ -212,7 +247,7 @@ func (v VersionMock) SetImageConfig(lines ...string) VersionMock {
 }
 
 // Create creates the mocked version directory structure in the given directory.
-func (v *VersionMock) Create(t *testing.T, rootDir string) VersionMock {
+func (v *VersionMock) Create(t testing.TB, rootDir string) VersionMock {
 	v.setRootDir(t, rootDir)
 
 	// Ensure version dir exists.
@@ -226,7 +261,12 @@ func (v *VersionMock) Create(t *testing.T, rootDir string) VersionMock {
 
 	// Create checsums file.
 	if v.checksums != "" {
-		checksumPath := filepath.Join(v.AbsPath(), stream.FileChecksumSHA256)
+		checksumsFile := v.checksumsFile
+		if checksumsFile == "" {
+			checksumsFile = stream.FileChecksumSHA256
+		}
+
+		checksumPath := filepath.Join(v.AbsPath(), checksumsFile)
 		err = os.WriteFile(checksumPath, []byte(v.checksums), os.ModePerm)
 		require.NoError(t, err)
 	}
@@ -278,8 +318,15 @@ func (i ItemMock) WithContent(lines ...string) ItemMock {
 	return i
 }
 
+// WithGeneratedContent sets the content of the item to the content of the
+// given size generated by GenerateContent using the given seed.
+func (i ItemMock) WithGeneratedContent(seed int64, size int) ItemMock {
+	i.content = string(GenerateContent(seed, size))
+	return i
+}
+
 // Create creates a mocked file in the given root directory.
-func (i *ItemMock) Create(t *testing.T, rootDir string) ItemMock {
+func (i *ItemMock) Create(t testing.TB, rootDir string) ItemMock {
 	i.setRootDir(t, rootDir)
 
 	// Ensure parent dir exists.
@@ -295,11 +342,11 @@ func (i *ItemMock) Create(t *testing.T, rootDir string) ItemMock {
 
 // mockProductCatalog creates product catalog from the current directory
 // structure. It does not generate any delta files and does not include hashes.
-func mockProductCatalog(t *testing.T, rootDir string, streamName string) {
+func mockProductCatalog(t testing.TB, rootDir string, streamName string) {
 	metaDir := filepath.Join(rootDir, "streams", "v1")
 
 	// Get products from the current directory structure.
-	products, err := stream.GetProducts(rootDir, streamName)
+	products, err := stream.GetProducts(context.Background(), rootDir, streamName)
 	require.NoError(t, err)
 
 	// Create product catalog.
@@ -317,7 +364,7 @@ func mockProductCatalog(t *testing.T, rootDir string, streamName string) {
 
 // setFilesAge recursively sets the age (modification time) of the files in the
 // given path. This is especially useful for testing removal of dangling files.
-func setFilesAge(t *testing.T, path string, age time.Duration) {
+func setFilesAge(t testing.TB, path string, age time.Duration) {
 	newModTime := time.Now().Add(-age)
 
 	err := filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
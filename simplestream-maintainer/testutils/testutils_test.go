@@ -0,0 +1,65 @@
+package testutils_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/testutils"
+)
+
+func TestGenerateContent(t *testing.T) {
+	t.Parallel()
+
+	content := testutils.GenerateContent(1, 1024)
+	require.Len(t, content, 1024)
+	require.Equal(t, content, testutils.GenerateContent(1, 1024))
+	require.NotEqual(t, content, testutils.GenerateContent(2, 1024))
+
+	require.Equal(t, testutils.ItemDefaultContentSHA, testutils.ContentSHA256([]byte(testutils.ItemDefaultContent)))
+}
+
+func TestMockServer(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	p := testutils.MockProduct("images/ubuntu/noble/amd64/cloud").AddVersions(
+		testutils.MockVersion("20240101_1200").AddItems(
+			testutils.MockItem("lxd.tar.xz"),
+			testutils.MockItem("root.squashfs").WithGeneratedContent(1, 4096)))
+	p.Create(t, rootDir)
+
+	catalog := testutils.BuildCatalog(t, rootDir, p.StreamName())
+	index := testutils.WriteCatalogs(t, rootDir, "v1", catalog)
+	require.Equal(t, []string{"ubuntu:noble:amd64:cloud"}, index.Index["images"].Products)
+
+	item := catalog.Products["ubuntu:noble:amd64:cloud"].Versions["20240101_1200"].Items["root.squashfs"]
+	require.Equal(t, testutils.ContentSHA256(testutils.GenerateContent(1, 4096)), item.SHA256)
+
+	s := testutils.NewMockServer(t, rootDir)
+
+	get := func(path string) []byte {
+		resp, err := http.Get(s.URL + "/" + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusOK, resp.StatusCode, "Unexpected status for %q", path)
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		return body
+	}
+
+	var served stream.ProductCatalog
+	require.NoError(t, json.Unmarshal(get(filepath.ToSlash(index.Index["images"].Path)), &served))
+	require.Equal(t, catalog.Products, served.Products)
+
+	require.Equal(t, item.SHA256, testutils.ContentSHA256(get(item.Path)))
+}
@@ -0,0 +1,254 @@
+package testutils
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeWebDAV is a minimal in-memory implementation of the WebDAV server, that
+// supports the methods used by the storage backend. Requests must use the
+// basic authentication with the user "user" and the password "secret".
+type FakeWebDAV struct {
+	mu    sync.Mutex
+	files map[string]fakeObject
+	dirs  map[string]bool
+}
+
+// NewFakeWebDAV returns a new fake WebDAV server.
+func NewFakeWebDAV() *FakeWebDAV {
+	return &FakeWebDAV{
+		files: make(map[string]fakeObject),
+		dirs:  map[string]bool{"/": true},
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (s *FakeWebDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, password, ok := r.BasicAuth()
+	if !ok || user != "user" || password != "secret" {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+
+	name := cleanDAVPath(r.URL.Path)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		f, ok := s.files[name]
+		if !ok {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Last-Modified", f.modTime.UTC().Format(http.TimeFormat))
+		_, _ = w.Write(f.data)
+
+	case http.MethodPut:
+		if !s.dirs[path.Dir(name)] {
+			http.Error(w, "", http.StatusConflict)
+			return
+		}
+
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		s.files[name] = fakeObject{data: data, modTime: time.Now()}
+		w.WriteHeader(http.StatusCreated)
+
+	case "MKCOL":
+		if s.dirs[name] || s.exists(name) {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !s.dirs[path.Dir(name)] {
+			http.Error(w, "", http.StatusConflict)
+			return
+		}
+
+		s.dirs[name] = true
+		w.WriteHeader(http.StatusCreated)
+
+	case "MOVE":
+		dest, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		destName := cleanDAVPath(dest.Path)
+
+		f, ok := s.files[name]
+		if !ok {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+
+		if !s.dirs[path.Dir(destName)] {
+			http.Error(w, "", http.StatusConflict)
+			return
+		}
+
+		delete(s.files, name)
+		s.files[destName] = f
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		if !s.exists(name) {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+
+		for n := range s.files {
+			if n == name || strings.HasPrefix(n, name+"/") {
+				delete(s.files, n)
+			}
+		}
+
+		for d := range s.dirs {
+			if d == name || strings.HasPrefix(d, name+"/") {
+				delete(s.dirs, d)
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	case "PROPFIND":
+		s.propfind(w, r, name)
+
+	default:
+		http.Error(w, "", http.StatusMethodNotAllowed)
+	}
+}
+
+// exists returns true if the file or the collection with the given name
+// exists.
+func (s *FakeWebDAV) exists(name string) bool {
+	_, ok := s.files[name]
+	return ok || s.dirs[name]
+}
+
+// propfind responds with the properties of the resource, and with depth "1"
+// also with the properties of the resources within the collection.
+func (s *FakeWebDAV) propfind(w http.ResponseWriter, r *http.Request, name string) {
+	if !s.exists(name) {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	type resourceType struct {
+		Collection *struct{} `xml:"D:collection"`
+	}
+
+	type prop struct {
+		ResourceType  resourceType `xml:"D:resourcetype"`
+		ContentLength string       `xml:"D:getcontentlength,omitempty"`
+		LastModified  string       `xml:"D:getlastmodified,omitempty"`
+	}
+
+	type propstat struct {
+		Prop   prop   `xml:"D:prop"`
+		Status string `xml:"D:status"`
+	}
+
+	type response struct {
+		Href     string   `xml:"D:href"`
+		Propstat propstat `xml:"D:propstat"`
+	}
+
+	var result struct {
+		XMLName   xml.Name   `xml:"D:multistatus"`
+		Namespace string     `xml:"xmlns:D,attr"`
+		Responses []response `xml:"D:response"`
+	}
+
+	result.Namespace = "DAV:"
+
+	names := []string{name}
+	if r.Header.Get("Depth") == "1" && s.dirs[name] {
+		for n := range s.files {
+			if path.Dir(n) == name {
+				names = append(names, n)
+			}
+		}
+
+		for d := range s.dirs {
+			if d != "/" && path.Dir(d) == name {
+				names = append(names, d)
+			}
+		}
+
+		slices.Sort(names[1:])
+	}
+
+	for _, n := range names {
+		resp := response{
+			Href:     (&url.URL{Path: n}).EscapedPath(),
+			Propstat: propstat{Status: "HTTP/1.1 200 OK"},
+		}
+
+		f, ok := s.files[n]
+		if ok {
+			resp.Propstat.Prop.ContentLength = fmt.Sprint(len(f.data))
+			resp.Propstat.Prop.LastModified = f.modTime.UTC().Format(http.TimeFormat)
+		} else {
+			resp.Href += "/"
+			resp.Propstat.Prop.ResourceType.Collection = &struct{}{}
+		}
+
+		result.Responses = append(result.Responses, resp)
+	}
+
+	out, err := xml.Marshal(result)
+	if err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	_, _ = w.Write(out)
+}
+
+// Files returns the sorted paths of all files on the server.
+func (s *FakeWebDAV) Files() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.files))
+	for n := range s.files {
+		names = append(names, n)
+	}
+
+	slices.Sort(names)
+
+	return names
+}
+
+// File returns the content of the file on the given path.
+func (s *FakeWebDAV) File(name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.files[cleanDAVPath(name)]
+	return f.data, ok
+}
+
+// cleanDAVPath returns the cleaned absolute path without the trailing slash.
+func cleanDAVPath(p string) string {
+	return path.Clean("/" + p)
+}
@@ -0,0 +1,94 @@
+// Package version provides the version and the build information of the
+// simplestream-maintainer.
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Version of the simplestream-maintainer. Version, Commit, and BuildDate can
+// be set at build time using:
+//
+//	-ldflags "-X github.com/canonical/lxd-imagebuilder/simplestream-maintainer/version.Version=..."
+var Version = "0.0.1"
+
+// Commit is the git commit from which the binary was built. If not set at
+// build time, it is read from the build information embedded by Go.
+var Commit = ""
+
+// BuildDate is the date when the binary was built. If not set at build time,
+// the commit date embedded by Go is used instead.
+var BuildDate = ""
+
+// Info contains the version and the build information.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the version and the build information.
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+
+	buildInfo, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+
+	var modified bool
+
+	for _, s := range buildInfo.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			if info.Commit == "" {
+				info.Commit = s.Value
+			}
+
+		case "vcs.time":
+			if info.BuildDate == "" {
+				info.BuildDate = s.Value
+			}
+
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+
+	if modified && Commit == "" && info.Commit != "" {
+		info.Commit += "-dirty"
+	}
+
+	return info
+}
+
+// String returns the version followed by the available build information.
+func (i Info) String() string {
+	details := []string{}
+
+	if i.Commit != "" {
+		details = append(details, "commit "+i.Commit)
+	}
+
+	if i.BuildDate != "" {
+		details = append(details, "built "+i.BuildDate)
+	}
+
+	details = append(details, i.GoVersion)
+
+	return fmt.Sprintf("%s (%s)", i.Version, strings.Join(details, ", "))
+}
+
+// UserAgent returns the user agent used in outbound requests.
+func UserAgent() string {
+	return "simplestream-maintainer/" + Version
+}
@@ -0,0 +1,29 @@
+package version_test
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/version"
+)
+
+func TestInfoString(t *testing.T) {
+	t.Parallel()
+
+	info := version.Info{Version: "1.2.3", Commit: "abc", BuildDate: "2024-01-01T00:00:00Z", GoVersion: "go1.22.0"}
+	require.Equal(t, "1.2.3 (commit abc, built 2024-01-01T00:00:00Z, go1.22.0)", info.String())
+
+	info = version.Info{Version: "1.2.3", GoVersion: "go1.22.0"}
+	require.Equal(t, "1.2.3 (go1.22.0)", info.String())
+}
+
+func TestGet(t *testing.T) {
+	t.Parallel()
+
+	info := version.Get()
+	require.Equal(t, version.Version, info.Version)
+	require.Equal(t, runtime.Version(), info.GoVersion)
+	require.Equal(t, "simplestream-maintainer/"+version.Version, version.UserAgent())
+}
@@ -0,0 +1,16 @@
+// Package watcher reports changes within directory trees.
+package watcher
+
+// Event represents a file or directory that was created, written, or moved
+// into one of the watched directory trees.
+type Event struct {
+	// Path of the affected file or directory.
+	Path string
+
+	// IsDir indicates whether the event concerns a directory.
+	IsDir bool
+
+	// Overflow indicates that some events were lost. In such case, the
+	// event path is set to the root of the affected directory tree.
+	Overflow bool
+}
@@ -0,0 +1,216 @@
+//go:build linux
+
+package watcher
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchMask is the mask of inotify events that are reported.
+const watchMask = unix.IN_CREATE | unix.IN_MOVED_TO | unix.IN_CLOSE_WRITE
+
+// Watcher watches directory trees using inotify. Newly created directories
+// are watched automatically, except for hidden ones, which are expected to
+// be either temporary or partially uploaded. Once the hidden directory is
+// renamed, its contents are watched as well.
+type Watcher struct {
+	fd   int
+	file *os.File
+
+	roots []string
+
+	mu      sync.Mutex
+	watches map[int]string // Watch descriptor to directory path.
+
+	events  chan Event
+	errors  chan error
+	closing chan struct{}
+	done    chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// New starts watching the given directories (recursively).
+func New(dirs ...string) (*Watcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to initialize inotify: %w", err)
+	}
+
+	w := &Watcher{
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		roots:   dirs,
+		watches: make(map[int]string),
+		events:  make(chan Event, 128),
+		errors:  make(chan error, 1),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	for _, dir := range dirs {
+		err := w.addRecursive(dir)
+		if err != nil {
+			_ = w.file.Close()
+			return nil, err
+		}
+	}
+
+	go w.readEvents()
+
+	return w, nil
+}
+
+// Events returns the channel of file system events. The channel is closed
+// once the watcher is closed.
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Errors returns the channel of errors that occurred while reading events.
+func (w *Watcher) Errors() <-chan error {
+	return w.errors
+}
+
+// Close stops watching the directories. It is safe to call Close multiple
+// times.
+func (w *Watcher) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.closing)
+		w.closeErr = w.file.Close()
+		<-w.done
+	})
+
+	return w.closeErr
+}
+
+// addRecursive watches the given directory and all of its non-hidden
+// subdirectories.
+func (w *Watcher) addRecursive(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Directory may be removed in the meantime.
+			if path != dir && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+
+			return err
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+
+		wd, err := unix.InotifyAddWatch(w.fd, path, watchMask)
+		if err != nil {
+			return fmt.Errorf("Failed to watch directory %q: %w", path, err)
+		}
+
+		w.mu.Lock()
+		w.watches[wd] = path
+		w.mu.Unlock()
+
+		return nil
+	})
+}
+
+// readEvents reads inotify events until the watcher is closed.
+func (w *Watcher) readEvents() {
+	defer close(w.done)
+	defer close(w.events)
+
+	buf := make([]byte, unix.SizeofInotifyEvent*4096)
+
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				w.sendError(err)
+			}
+
+			return
+		}
+
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			wd := int(int32(binary.NativeEndian.Uint32(buf[off:])))
+			mask := binary.NativeEndian.Uint32(buf[off+4:])
+			nameLen := int(binary.NativeEndian.Uint32(buf[off+12:]))
+
+			nameStart := off + unix.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[nameStart:nameStart+nameLen], "\x00"))
+			off = nameStart + nameLen
+
+			w.handleEvent(wd, mask, name)
+		}
+	}
+}
+
+// handleEvent converts the inotify event into a watcher event.
+func (w *Watcher) handleEvent(wd int, mask uint32, name string) {
+	if mask&unix.IN_Q_OVERFLOW != 0 {
+		for _, root := range w.roots {
+			w.send(Event{Path: root, IsDir: true, Overflow: true})
+		}
+
+		return
+	}
+
+	w.mu.Lock()
+	dir, ok := w.watches[wd]
+	if mask&unix.IN_IGNORED != 0 {
+		// Watched directory was removed.
+		delete(w.watches, wd)
+	}
+
+	w.mu.Unlock()
+
+	if !ok || name == "" {
+		return
+	}
+
+	event := Event{
+		Path:  filepath.Join(dir, name),
+		IsDir: mask&unix.IN_ISDIR != 0,
+	}
+
+	// Watch new directories.
+	if event.IsDir && !strings.HasPrefix(name, ".") {
+		err := w.addRecursive(event.Path)
+		if err != nil && !errors.Is(err, unix.ENOENT) {
+			w.sendError(err)
+		}
+	}
+
+	w.send(event)
+}
+
+// send sends the event unless the watcher is being closed.
+func (w *Watcher) send(event Event) {
+	select {
+	case w.events <- event:
+	case <-w.closing:
+	}
+}
+
+// sendError sends the error, unless the previous error was not yet received.
+func (w *Watcher) sendError(err error) {
+	select {
+	case w.errors <- err:
+	default:
+	}
+}
@@ -0,0 +1,31 @@
+//go:build !linux
+
+package watcher
+
+import (
+	"fmt"
+)
+
+// Watcher watches directory trees. It is supported only on Linux.
+type Watcher struct{}
+
+// New returns an error, because watching directories is not supported on
+// this platform.
+func New(dirs ...string) (*Watcher, error) {
+	return nil, fmt.Errorf("Watching directories is not supported on this platform")
+}
+
+// Events returns a nil channel.
+func (w *Watcher) Events() <-chan Event {
+	return nil
+}
+
+// Errors returns a nil channel.
+func (w *Watcher) Errors() <-chan error {
+	return nil
+}
+
+// Close does nothing.
+func (w *Watcher) Close() error {
+	return nil
+}
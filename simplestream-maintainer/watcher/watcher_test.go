@@ -0,0 +1,74 @@
+//go:build linux
+
+package watcher_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/watcher"
+)
+
+func TestWatcher(t *testing.T) {
+	t.Parallel()
+
+	rootDir := t.TempDir()
+
+	w, err := watcher.New(rootDir)
+	require.NoError(t, err)
+
+	defer w.Close()
+
+	// waitEvent waits for the event on the given path.
+	waitEvent := func(path string, isDir bool) {
+		timeout := time.After(5 * time.Second)
+
+		for {
+			select {
+			case event := <-w.Events():
+				if event.Path == path {
+					require.Equal(t, isDir, event.IsDir)
+					return
+				}
+
+			case err := <-w.Errors():
+				require.NoError(t, err)
+
+			case <-timeout:
+				t.Fatalf("Timed out waiting for event on %q", path)
+			}
+		}
+	}
+
+	// Ensure new directory is reported and watched.
+	dir := filepath.Join(rootDir, "product")
+	require.NoError(t, os.Mkdir(dir, os.ModePerm))
+	waitEvent(dir, true)
+
+	file := filepath.Join(dir, "lxd.tar.xz")
+	require.NoError(t, os.WriteFile(file, []byte("content"), 0644))
+	waitEvent(file, false)
+
+	// Ensure renamed hidden directory is reported and watched.
+	hiddenDir := filepath.Join(dir, ".version")
+	require.NoError(t, os.Mkdir(hiddenDir, os.ModePerm))
+	waitEvent(hiddenDir, true)
+
+	versionDir := filepath.Join(dir, "version")
+	require.NoError(t, os.Rename(hiddenDir, versionDir))
+	waitEvent(versionDir, true)
+
+	file = filepath.Join(versionDir, "disk.qcow2")
+	require.NoError(t, os.WriteFile(file, []byte("content"), 0644))
+	waitEvent(file, false)
+
+	// Ensure events channel is closed once the watcher is closed.
+	require.NoError(t, w.Close())
+
+	for range w.Events() {
+	}
+}
@@ -1,53 +1,246 @@
 package webpage
 
 import (
+	"bytes"
 	"fmt"
 	"html/template"
-	"os"
+	"io"
+	"path"
 	"path/filepath"
 	"slices"
+	"strings"
 	"time"
 
 	"github.com/canonical/lxd-imagebuilder/embed"
 	"github.com/canonical/lxd-imagebuilder/shared"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/storage"
 	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
 )
 
+// templateFuncs contains functions available within the webpage template.
+var templateFuncs = template.FuncMap{
+	"formatSize": FormatSize,
+	"formatTime": FormatTime,
+}
+
+// indexTemplate is the parsed webpage template. It is parsed on startup, so
+// that errors within the embedded template are caught early.
+var indexTemplate = template.Must(ParseTemplate())
+
+// ParseTemplate parses the embedded webpage template. Execution of the
+// returned template fails on missing keys.
+func ParseTemplate() (*template.Template, error) {
+	t, err := template.New("index.html").Funcs(templateFuncs).Option("missingkey=error").ParseFS(embed.GetTemplates(), "templates/index.html")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse webpage template: %w", err)
+	}
+
+	return t, nil
+}
+
+// FormatSize formats the size in bytes into a human readable string using
+// binary units (for example, "1.5 GiB").
+func FormatSize(size int64) string {
+	const unit = 1024
+
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit && exp < 5; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// FormatTime formats the time in the format "YYYY-MM-DD (hh:mm)". Zero time
+// is formatted as "N/A".
+func FormatTime(t time.Time) string {
+	if t.IsZero() {
+		return "N/A"
+	}
+
+	return t.Format("2006-01-02 (15:04)")
+}
+
 // WebPageImage represents webpage table entries.
 type WebPageImage struct {
-	Distribution         string
-	Release              string
-	Architecture         string
-	Variant              string
-	VersionPath          string
-	VersionLastBuildDate string
-	SupportsContainer    bool
-	SupportsVM           bool
+	Distribution      string
+	Release           string
+	Architecture      string
+	Variant           string
+	VersionPath       string
+	VersionLastBuild  time.Time
+	Size              int64
+	SupportsContainer bool
+	SupportsVM        bool
+
+	// InstalledSize is the largest installed size of the image root
+	// filesystems, if known.
+	InstalledSize int64
+
+	// VirtualSize is the largest virtual size of the image disks, if known.
+	VirtualSize int64
+
+	// ReleaseEOL is the end-of-life date of the image release, if known.
+	ReleaseEOL string
+
+	// EOL indicates the image release has reached its end of life.
+	EOL bool
+}
+
+// WebPageArchitecture represents the image of a single architecture within
+// a combined image.
+type WebPageArchitecture struct {
+	Name              string
+	VersionPath       string
+	VersionLastBuild  time.Time
+	Size              int64
+	InstalledSize     int64
+	VirtualSize       int64
+	SupportsContainer bool
+	SupportsVM        bool
+}
+
+// WebPageCombinedImage represents images of the same distribution, release,
+// and variant across all architectures.
+type WebPageCombinedImage struct {
+	Distribution string
+	Release      string
+	Variant      string
+
+	// Architectures contains the images of individual architectures
+	// sorted by the architecture name.
+	Architectures []WebPageArchitecture
+
+	// VersionLastBuild is the latest build time of all architectures.
+	VersionLastBuild time.Time
+
+	// SupportsContainer and SupportsVM indicate whether the image of any
+	// architecture supports containers or VMs.
+	SupportsContainer bool
+	SupportsVM        bool
+
+	ReleaseEOL string
+	EOL        bool
+}
+
+// ArchitectureNames returns the names of the image architectures separated
+// by a space.
+func (i WebPageCombinedImage) ArchitectureNames() string {
+	names := make([]string, 0, len(i.Architectures))
+	for _, arch := range i.Architectures {
+		names = append(names, arch.Name)
+	}
+
+	return strings.Join(names, " ")
+}
+
+// WebPageRelease represents images of a single distribution release.
+type WebPageRelease struct {
+	Name   string
+	Images []WebPageImage
+}
+
+// Combined groups the release images by variant, so that images of different
+// architectures are combined into a single entry. The order of images is
+// retained, hence combined images are ordered by the first image of each
+// variant.
+func (r WebPageRelease) Combined() []WebPageCombinedImage {
+	var combined []WebPageCombinedImage
+
+	for _, image := range r.Images {
+		i := slices.IndexFunc(combined, func(c WebPageCombinedImage) bool { return c.Variant == image.Variant })
+		if i < 0 {
+			combined = append(combined, WebPageCombinedImage{
+				Distribution: image.Distribution,
+				Release:      image.Release,
+				Variant:      image.Variant,
+			})
+
+			i = len(combined) - 1
+		}
+
+		c := &combined[i]
+		c.Architectures = append(c.Architectures, WebPageArchitecture{
+			Name:              image.Architecture,
+			VersionPath:       image.VersionPath,
+			VersionLastBuild:  image.VersionLastBuild,
+			Size:              image.Size,
+			InstalledSize:     image.InstalledSize,
+			VirtualSize:       image.VirtualSize,
+			SupportsContainer: image.SupportsContainer,
+			SupportsVM:        image.SupportsVM,
+		})
+
+		if image.VersionLastBuild.After(c.VersionLastBuild) {
+			c.VersionLastBuild = image.VersionLastBuild
+		}
+
+		c.SupportsContainer = c.SupportsContainer || image.SupportsContainer
+		c.SupportsVM = c.SupportsVM || image.SupportsVM
+
+		// End of life is the same for the whole release, but it may be
+		// missing in some of the products.
+		if c.ReleaseEOL == "" {
+			c.ReleaseEOL = image.ReleaseEOL
+		}
+
+		c.EOL = c.EOL || image.EOL
+	}
+
+	for i := range combined {
+		slices.SortStableFunc(combined[i].Architectures, func(a WebPageArchitecture, b WebPageArchitecture) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+	}
+
+	return combined
+}
+
+// WebPageFamily represents images of a single distribution grouped by
+// release, along with aggregate statistics.
+type WebPageFamily struct {
+	Name           string
+	Releases       []WebPageRelease
+	Architectures  []string
+	ImageCount     int
+	ContainerCount int
+	VMCount        int
+	Size           int64
 }
 
 // WebPage represents the data that will be used to populate the webpage template.
 type WebPage struct {
-	FaviconURL      string
-	LogoURL         string
-	Title           string
-	Paragraphs      []template.HTML
-	FooterCopyright string
-	FooterUpdatedAt string
+	FaviconURL string
+	LogoURL    string
+	Title      string
+	Paragraphs []template.HTML
+	UpdatedAt  time.Time
+
+	// StreamVersion is the stream version of the rendered product catalog,
+	// and StreamVersions are all stream versions the page can be switched
+	// to. Stream versions are not shown if only one is served.
+	StreamVersion  string
+	StreamVersions []string
 
 	Images []WebPageImage
 }
 
-// NewWebPage creates initializes a webpage struct from the given product catalog.
-func NewWebPage(catalog stream.ProductCatalog) *WebPage {
+// NewWebPage creates initializes a webpage struct from the given product catalog
+// of the given stream.
+func NewWebPage(streamName string, catalog stream.ProductCatalog) *WebPage {
 	// This is hardcoded in case we ever decide to manage index.html
 	// using a configuration file. In such case, we just have to parse
 	// those values and the rest of the code will work as expected.
 	page := WebPage{
-		Title:           "LXD Images",
-		FaviconURL:      "https://raw.githubusercontent.com/canonical/lxd/main/doc/.sphinx/_static/favicon.ico",
-		LogoURL:         "https://raw.githubusercontent.com/canonical/lxd/main/doc/.sphinx/_static/tag.png",
-		FooterCopyright: fmt.Sprintf("© %d Canonical Ltd.", time.Now().Year()),
-		FooterUpdatedAt: fmt.Sprintf("Last updated: %s UTC", time.Now().UTC().Format("02 Jan 2006 (15:04)")),
+		Title:      "LXD Images",
+		FaviconURL: "https://raw.githubusercontent.com/canonical/lxd/main/doc/.sphinx/_static/favicon.ico",
+		LogoURL:    "https://raw.githubusercontent.com/canonical/lxd/main/doc/.sphinx/_static/tag.png",
+		UpdatedAt:  time.Now().UTC(),
 		Paragraphs: []template.HTML{
 			template.HTML("Images hosted on this server are available in LXD through the predefined remote <code>images:</code>. For detailed instructions about LXD image management, please refer to our <a href='https://documentation.ubuntu.com/lxd/en/latest/howto/images_manage'>How to Manage Images</a> guide in the official documentation."),
 			template.HTML("Images are built daily and we retain the last 2 successful builds of each image for up to 10 days. Thus, if a particular build fails on any given day, the previous successful builds will remain accessible."),
@@ -62,78 +255,154 @@ func NewWebPage(catalog stream.ProductCatalog) *WebPage {
 
 	// Iterate over products and their versions to extract hosted images.
 	for _, id := range productIds {
-		product := catalog.Products[id]
-		versionIds := shared.MapKeys(product.Versions)
+		page.AddProduct(streamName, catalog.Products[id])
+	}
+
+	return &page
+}
+
+// AddProduct extracts the image from the latest version of the given product
+// and appends it to the webpage images. Products without versions are ignored.
+func (p *WebPage) AddProduct(streamName string, product stream.Product) {
+	versionIds := shared.MapKeys(product.Versions)
+
+	if len(versionIds) == 0 {
+		// Ignore empty products
+		return
+	}
+
+	image := WebPageImage{
+		Distribution: product.OS,
+		Release:      product.Release,
+		Architecture: product.Architecture,
+		Variant:      product.Variant,
+		ReleaseEOL:   product.ReleaseEOL,
+		EOL:          product.IsEOL(time.Now()),
+	}
+
+	slices.Sort(versionIds)
+	last := versionIds[len(versionIds)-1]
+	lastVersion := product.Versions[last]
+
+	// Parse build time from the version name in format "YYYYMMDD_hhmm".
+	buildTime, err := time.Parse("20060102_1504", last)
+	if err == nil {
+		image.VersionLastBuild = buildTime
+		image.VersionPath = filepath.Join("/", streamName, product.RelPath(), last)
+	}
+
+	// Iterate over version items and check if the image supports
+	// containers and/or VMs. Delta files are not included in the size.
+	// Version path is taken from the item paths if possible, as products
+	// may be stored using a custom path schema.
+	for _, item := range lastVersion.Items {
+		if image.VersionPath != "" && item.Path != "" {
+			image.VersionPath = path.Join("/", path.Dir(item.Path))
+		}
+
+		if !item.IsDelta() {
+			image.Size += item.Size
+		}
+
+		image.InstalledSize = max(image.InstalledSize, item.InstalledSize)
+		image.VirtualSize = max(image.VirtualSize, item.VirtualSize)
+
+		if item.Ftype == stream.ItemTypeSquashfs || item.Ftype == stream.ItemTypeRootTarXz {
+			image.SupportsContainer = true
+		}
+
+		if item.Ftype == stream.ItemTypeDiskKVM || item.Ftype == stream.ItemTypeDiskRaw {
+			image.SupportsVM = true
+		}
+	}
+
+	p.Images = append(p.Images, image)
+}
 
-		if len(versionIds) == 0 {
-			// Ignore empty products
-			continue
+// Families groups webpage images by distribution and release. The order of
+// images is retained, hence families and releases are ordered the same as
+// images.
+func (p WebPage) Families() []WebPageFamily {
+	var families []WebPageFamily
+
+	for _, image := range p.Images {
+		i := slices.IndexFunc(families, func(f WebPageFamily) bool { return f.Name == image.Distribution })
+		if i < 0 {
+			families = append(families, WebPageFamily{Name: image.Distribution})
+			i = len(families) - 1
 		}
 
-		image := WebPageImage{
-			Distribution: product.OS,
-			Release:      product.Release,
-			Architecture: product.Architecture,
-			Variant:      product.Variant,
+		f := &families[i]
+
+		j := slices.IndexFunc(f.Releases, func(r WebPageRelease) bool { return r.Name == image.Release })
+		if j < 0 {
+			f.Releases = append(f.Releases, WebPageRelease{Name: image.Release})
+			j = len(f.Releases) - 1
 		}
 
-		slices.Sort(versionIds)
-		last := versionIds[len(versionIds)-1]
-		lastVersion := product.Versions[last]
-
-		// Converts timestamp from format "YYYYMMDD_hhmm" into a prettier
-		// format "YYYY-MM-DD (hh:mm)".
-		time, err := time.Parse("20060102_1504", last)
-		if err != nil {
-			image.VersionLastBuildDate = "N/A"
-		} else {
-			image.VersionLastBuildDate = time.Format("2006-01-02 (15:04)")
-			image.VersionPath = filepath.Join("/", catalog.ContentID, product.RelPath(), last)
+		f.Releases[j].Images = append(f.Releases[j].Images, image)
+		f.ImageCount++
+		f.Size += image.Size
+
+		if !slices.Contains(f.Architectures, image.Architecture) {
+			f.Architectures = append(f.Architectures, image.Architecture)
 		}
 
-		// Iterate over version items and check if the image supports
-		// containers and/or VMs.
-		for _, item := range lastVersion.Items {
-			if item.Ftype == stream.ItemTypeSquashfs {
-				image.SupportsContainer = true
-			}
+		if image.SupportsContainer {
+			f.ContainerCount++
+		}
 
-			if item.Ftype == stream.ItemTypeDiskKVM {
-				image.SupportsVM = true
-			}
+		if image.SupportsVM {
+			f.VMCount++
 		}
+	}
 
-		page.Images = append(page.Images, image)
+	for i := range families {
+		slices.Sort(families[i].Architectures)
 	}
 
-	return &page
+	return families
 }
 
-// Write parses the webpage template, populates it, and writes it to index.html
-// in the rootDir. File is first written to a temporary file and then moved
-// to the final destination to avoid partial writes in case of errors.
-func (p WebPage) Write(rootDir string) error {
-	path := filepath.Join(rootDir, "index.html")
-	pathTmp := filepath.Join(rootDir, ".index.html.tmp")
+// Architectures returns sorted architectures of all webpage images.
+func (p WebPage) Architectures() []string {
+	var archs []string
+
+	for _, image := range p.Images {
+		if !slices.Contains(archs, image.Architecture) {
+			archs = append(archs, image.Architecture)
+		}
+	}
+
+	slices.Sort(archs)
+	return archs
+}
 
-	t, err := template.ParseFS(embed.GetTemplates(), "templates/index.html")
+// Render populates the webpage template and writes the result to w.
+func (p WebPage) Render(w io.Writer) error {
+	err := indexTemplate.Execute(w, p)
 	if err != nil {
-		return err
+		return fmt.Errorf("Failed to render webpage: %w", err)
 	}
 
-	defer os.Remove(pathTmp)
+	return nil
+}
 
-	f, err := os.OpenFile(pathTmp, os.O_CREATE|os.O_WRONLY, 0644)
+// Write renders the webpage and writes it to index.html in the rootDir, which
+// may also be an S3 URL. File is replaced atomically to avoid partial writes
+// in case of errors.
+func (p WebPage) Write(rootDir string) error {
+	b, err := storage.New(rootDir)
 	if err != nil {
 		return err
 	}
 
-	defer f.Close()
+	var buf bytes.Buffer
 
-	err = t.Execute(f, p)
+	err = p.Render(&buf)
 	if err != nil {
 		return err
 	}
 
-	return os.Rename(pathTmp, path)
+	return b.Write("index.html", &buf)
 }
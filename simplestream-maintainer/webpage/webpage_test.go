@@ -0,0 +1,177 @@
+package webpage_test
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/stream"
+	"github.com/canonical/lxd-imagebuilder/simplestream-maintainer/webpage"
+)
+
+var update = flag.Bool("update", false, "Update golden files")
+
+func TestFormatSize(t *testing.T) {
+	t.Parallel()
+
+	tests := map[int64]string{
+		0:                      "0 B",
+		1023:                   "1023 B",
+		1024:                   "1.0 KiB",
+		1536:                   "1.5 KiB",
+		300 * 1024 * 1024:      "300.0 MiB",
+		5 * 1024 * 1024 * 1024: "5.0 GiB",
+	}
+
+	for size, want := range tests {
+		require.Equal(t, want, webpage.FormatSize(size))
+	}
+}
+
+func TestFormatTime(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, "N/A", webpage.FormatTime(time.Time{}))
+	require.Equal(t, "2024-05-01 (13:45)", webpage.FormatTime(time.Date(2024, 5, 1, 13, 45, 0, 0, time.UTC)))
+}
+
+func TestParseTemplate(t *testing.T) {
+	t.Parallel()
+
+	_, err := webpage.ParseTemplate()
+	require.NoError(t, err)
+}
+
+func TestWebPageRender(t *testing.T) {
+	t.Parallel()
+
+	catalog := stream.NewCatalog("images", map[string]stream.Product{
+		"ubuntu:noble:amd64:cloud": {
+			OS: "Ubuntu", Distro: "ubuntu", Release: "noble", Architecture: "amd64", Variant: "cloud",
+			Versions: map[string]stream.Version{
+				"20240101_1200": {Items: map[string]stream.Item{
+					"lxd.tar.xz":    {Ftype: stream.ItemTypeMetadata, Size: 1024},
+					"root.squashfs": {Ftype: stream.ItemTypeSquashfs, Size: 300 * 1024 * 1024},
+				}},
+				"20240102_1200": {Items: map[string]stream.Item{
+					"lxd.tar.xz":                 {Ftype: stream.ItemTypeMetadata, Size: 1024},
+					"root.squashfs":              {Ftype: stream.ItemTypeSquashfs, Size: 300 * 1024 * 1024},
+					"disk.qcow2":                 {Ftype: stream.ItemTypeDiskKVM, Size: 500 * 1024 * 1024},
+					"20240101_1200.vcdiff":       {Ftype: stream.ItemTypeSquashfsDelta, Size: 10 * 1024 * 1024},
+					"20240101_1200.qcow2.vcdiff": {Ftype: stream.ItemTypeDiskKVMDelta, Size: 20 * 1024 * 1024},
+				}},
+			},
+		},
+		"ubuntu:jammy:arm64:default": {
+			OS: "Ubuntu", Distro: "ubuntu", Release: "jammy", Architecture: "arm64", Variant: "default",
+			Versions: map[string]stream.Version{
+				"20240101_1200": {Items: map[string]stream.Item{
+					"lxd.tar.xz": {Ftype: stream.ItemTypeMetadata, Size: 1024},
+					"disk.qcow2": {Ftype: stream.ItemTypeDiskKVM, Size: 1024 * 1024 * 1024, VirtualSize: 10 * 1024 * 1024 * 1024},
+				}},
+			},
+		},
+		"alpine:edge:amd64:default": {
+			OS: "Alpine", Distro: "alpine", Release: "edge", Architecture: "amd64", Variant: "default",
+			Versions: map[string]stream.Version{
+				"custom": {Items: map[string]stream.Item{
+					"lxd.tar.xz":    {Ftype: stream.ItemTypeMetadata, Size: 512},
+					"root.squashfs": {Ftype: stream.ItemTypeSquashfs, Size: 2048},
+				}},
+			},
+		},
+		"debian:buster:amd64:default": {
+			OS: "Debian", Distro: "debian", Release: "buster", Architecture: "amd64", Variant: "default",
+			ReleaseEOL: "2024-06-30",
+			Versions: map[string]stream.Version{
+				"20240101_1200": {Items: map[string]stream.Item{
+					"lxd.tar.xz":    {Ftype: stream.ItemTypeMetadata, Size: 512},
+					"root.squashfs": {Ftype: stream.ItemTypeSquashfs, Size: 1024},
+				}},
+			},
+		},
+		"ubuntu:noble:arm64:cloud": {
+			OS: "Ubuntu", Distro: "ubuntu", Release: "noble", Architecture: "arm64", Variant: "cloud",
+			ReleaseEOL: "2099-05-31", SupportLevel: "lts",
+			Versions: map[string]stream.Version{
+				"20240101_1200": {Items: map[string]stream.Item{
+					"lxd.tar.xz":    {Ftype: stream.ItemTypeMetadata, Size: 1024},
+					"root.squashfs": {Ftype: stream.ItemTypeSquashfs, Size: 300 * 1024 * 1024},
+				}},
+			},
+		},
+		"debian:trixie:amd64:default": {
+			OS: "Debian", Distro: "debian", Release: "trixie", Architecture: "amd64", Variant: "default",
+		},
+	})
+
+	page := webpage.NewWebPage("images", *catalog)
+	page.UpdatedAt = time.Date(2024, 1, 3, 8, 30, 0, 0, time.UTC)
+
+	var buf bytes.Buffer
+	err := page.Render(&buf)
+	require.NoError(t, err)
+
+	goldenPath := filepath.Join("testdata", "index.golden.html")
+
+	if *update {
+		err := os.WriteFile(goldenPath, buf.Bytes(), 0644)
+		require.NoError(t, err)
+	}
+
+	golden, err := os.ReadFile(goldenPath)
+	require.NoError(t, err)
+	require.Equal(t, string(golden), buf.String(), "Rendered webpage differs from the golden file (run tests with -update to regenerate it)")
+}
+
+func TestWebPageReleaseCombined(t *testing.T) {
+	t.Parallel()
+
+	build := func(day int) time.Time {
+		return time.Date(2024, 1, day, 12, 0, 0, 0, time.UTC)
+	}
+
+	release := webpage.WebPageRelease{
+		Name: "noble",
+		Images: []webpage.WebPageImage{
+			{Distribution: "Ubuntu", Release: "noble", Architecture: "arm64", Variant: "cloud", VersionPath: "/arm64", VersionLastBuild: build(1), Size: 10, SupportsContainer: true},
+			{Distribution: "Ubuntu", Release: "noble", Architecture: "amd64", Variant: "default", VersionPath: "/default", VersionLastBuild: build(1), Size: 5, SupportsContainer: true},
+			{Distribution: "Ubuntu", Release: "noble", Architecture: "amd64", Variant: "cloud", VersionPath: "/amd64", VersionLastBuild: build(2), Size: 20, SupportsVM: true, ReleaseEOL: "2029-05-31"},
+		},
+	}
+
+	want := []webpage.WebPageCombinedImage{
+		{
+			Distribution: "Ubuntu",
+			Release:      "noble",
+			Variant:      "cloud",
+			Architectures: []webpage.WebPageArchitecture{
+				{Name: "amd64", VersionPath: "/amd64", VersionLastBuild: build(2), Size: 20, SupportsVM: true},
+				{Name: "arm64", VersionPath: "/arm64", VersionLastBuild: build(1), Size: 10, SupportsContainer: true},
+			},
+			VersionLastBuild:  build(2),
+			SupportsContainer: true,
+			SupportsVM:        true,
+			ReleaseEOL:        "2029-05-31",
+		},
+		{
+			Distribution: "Ubuntu",
+			Release:      "noble",
+			Variant:      "default",
+			Architectures: []webpage.WebPageArchitecture{
+				{Name: "amd64", VersionPath: "/default", VersionLastBuild: build(1), Size: 5, SupportsContainer: true},
+			},
+			VersionLastBuild:  build(1),
+			SupportsContainer: true,
+		},
+	}
+
+	combined := release.Combined()
+	require.Equal(t, want, combined)
+	require.Equal(t, "amd64 arm64", combined[0].ArchitectureNames())
+}